@@ -3,6 +3,8 @@ package common
 import (
 	"fmt"
 	"math"
+	"strconv"
+	"strings"
 )
 
 // Codes from here: https://github.com/dustin/go-humanize/blob/afde56e7acacd811f6c94228c2c61af2b0e93158/bytes.go#L64-L101
@@ -55,3 +57,28 @@ func IBytes(s uint64) string {
 	sizes := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
 	return humanateBytes(s, 1024, sizes)
 }
+
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"pb", PB}, {"tb", TB}, {"gb", GB}, {"mb", MB}, {"kb", KB}, {"b", Byte},
+}
+
+// ParseBytes parses a byte size value of the settings, e.g. "500mb" or "10gb", with binary units.
+//
+// ParseBytes("1kb") -> 1024
+func ParseBytes(s string) (uint64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	for _, unit := range byteUnits {
+		if !strings.HasSuffix(value, unit.suffix) {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), 64)
+		if err != nil || number < 0 {
+			break
+		}
+		return uint64(number * float64(unit.size)), nil
+	}
+	return 0, fmt.Errorf("failed to parse [%s] as a byte size value, a unit such as [b], [kb], [mb] or [gb] is required", s)
+}
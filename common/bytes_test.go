@@ -11,3 +11,19 @@ func TestBytes(t *testing.T) {
 	assert.Equal(t, "115 GiB", IBytes(123123123123))
 	assert.Equal(t, "112 TiB", IBytes(123123123123123))
 }
+
+func TestParseBytes(t *testing.T) {
+	size, err := ParseBytes("500mb")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(500*MB), size)
+	size, err = ParseBytes("1.5kb")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1536), size)
+	size, err = ParseBytes("10b")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), size)
+	_, err = ParseBytes("10")
+	assert.NotNil(t, err)
+	_, err = ParseBytes("85%")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,23 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// Compress deflates the bytes, e.g. a cluster state before it is published.
+func Compress(b []byte) []byte {
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.BestSpeed)
+	writer.Write(b)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+// Decompress inflates the bytes of Compress.
+func Decompress(b []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(b))
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,20 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	content := []byte(strings.Repeat(`{"properties":{"message":{"type":"text"}}}`, 100))
+
+	compressed := Compress(content)
+	decompressed, err := Decompress(compressed)
+
+	assert.Less(t, len(compressed), len(content))
+	assert.Nil(t, err)
+	assert.Equal(t, content, decompressed)
+	_, err = Decompress([]byte("not deflated"))
+	assert.NotNil(t, err)
+}
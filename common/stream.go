@@ -0,0 +1,465 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Version is the version of the transport protocol a node speaks. Two nodes talk with the lowest of their versions,
+// so a node reads the messages of the previous version and a cluster is upgraded one node at a time.
+type Version int32
+
+const (
+	V_1 Version = 1
+	// V_2 adds the term and the version of the last accepted state to the joins
+	V_2 Version = 2
+
+	// CurrentVersion is the version the messages are written with
+	CurrentVersion = V_2
+	// MinCompatibleVersion is the oldest version of the nodes this node talks to
+	MinCompatibleVersion = V_1
+)
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d", int32(v))
+}
+
+// MinVersion returns the lowest of two versions.
+func MinVersion(a Version, b Version) Version {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Writeable is a message written in the transport format.
+type Writeable interface {
+	WriteTo(out *StreamOutput)
+}
+
+// ToBytes writes a message with the version of the node reading it.
+func ToBytes(message Writeable, version Version) []byte {
+	out := NewStreamOutput(version)
+	message.WriteTo(out)
+	return out.Bytes()
+}
+
+var errEndOfStream = errors.New("unexpected end of stream")
+
+// the types of the values written by WriteGenericValue
+const (
+	genericNil byte = iota
+	genericString
+	genericBool
+	genericInt
+	genericInt64
+	genericFloat64
+	genericBytes
+	genericList
+	genericMap
+	genericStringSlice
+	genericStringMap
+	genericUint64
+	// genericJson is any other value, it is read back the way encoding/json decodes it
+	genericJson
+)
+
+// StreamOutput writes a message in the transport format: integers are big endian, strings and byte arrays are
+// prefixed by their length. The fields written depend on the Version of the node reading the message.
+type StreamOutput struct {
+	Version Version
+	buf     []byte
+}
+
+func NewStreamOutput(version Version) *StreamOutput {
+	return &StreamOutput{Version: version}
+}
+
+func (o *StreamOutput) Bytes() []byte {
+	return o.buf
+}
+
+func (o *StreamOutput) WriteUint8(b byte) {
+	o.buf = append(o.buf, b)
+}
+
+func (o *StreamOutput) WriteBool(b bool) {
+	if b {
+		o.WriteUint8(1)
+	} else {
+		o.WriteUint8(0)
+	}
+}
+
+func (o *StreamOutput) WriteInt32(i int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(i))
+	o.buf = append(o.buf, b[:]...)
+}
+
+func (o *StreamOutput) WriteInt64(i int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	o.buf = append(o.buf, b[:]...)
+}
+
+// WriteInt writes an int in 8 bytes, whatever the size of an int on the node.
+func (o *StreamOutput) WriteInt(i int) {
+	o.WriteInt64(int64(i))
+}
+
+func (o *StreamOutput) WriteFloat64(f float64) {
+	o.WriteInt64(int64(math.Float64bits(f)))
+}
+
+// WriteVInt writes a non-negative integer in 1 to 10 bytes, the small ones take less.
+func (o *StreamOutput) WriteVInt(i uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], i)
+	o.buf = append(o.buf, b[:n]...)
+}
+
+func (o *StreamOutput) WriteBytes(b []byte) {
+	o.WriteVInt(uint64(len(b)))
+	o.buf = append(o.buf, b...)
+}
+
+func (o *StreamOutput) WriteString(s string) {
+	o.WriteVInt(uint64(len(s)))
+	o.buf = append(o.buf, s...)
+}
+
+func (o *StreamOutput) WriteDuration(d time.Duration) {
+	o.WriteInt64(int64(d))
+}
+
+// WriteTime writes a time with its zone offset, the zero time included.
+func (o *StreamOutput) WriteTime(t time.Time) {
+	b, err := t.MarshalBinary()
+	if err != nil {
+		// the year is out of the range of a time written in binary
+		b, _ = time.Time{}.MarshalBinary()
+	}
+	o.WriteBytes(b)
+}
+
+func (o *StreamOutput) WriteStringSlice(s []string) {
+	o.WriteVInt(uint64(len(s)))
+	for _, e := range s {
+		o.WriteString(e)
+	}
+}
+
+// WriteStringMap writes the entries of a map sorted by key, the same map is always written the same way.
+func (o *StreamOutput) WriteStringMap(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	o.WriteVInt(uint64(len(keys)))
+	for _, k := range keys {
+		o.WriteString(k)
+		o.WriteString(m[k])
+	}
+}
+
+// WriteMap writes the entries of a map sorted by key, the values are written by WriteGenericValue.
+func (o *StreamOutput) WriteMap(m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	o.WriteVInt(uint64(len(keys)))
+	for _, k := range keys {
+		o.WriteString(k)
+		o.WriteGenericValue(m[k])
+	}
+}
+
+// WriteGenericValue writes a value of a free form map, such as a document source, along with its type.
+func (o *StreamOutput) WriteGenericValue(value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		o.WriteUint8(genericNil)
+	case string:
+		o.WriteUint8(genericString)
+		o.WriteString(v)
+	case bool:
+		o.WriteUint8(genericBool)
+		o.WriteBool(v)
+	case int:
+		o.WriteUint8(genericInt)
+		o.WriteInt(v)
+	case int64:
+		o.WriteUint8(genericInt64)
+		o.WriteInt64(v)
+	case uint64:
+		o.WriteUint8(genericUint64)
+		o.WriteVInt(v)
+	case float64:
+		o.WriteUint8(genericFloat64)
+		o.WriteFloat64(v)
+	case []byte:
+		o.WriteUint8(genericBytes)
+		o.WriteBytes(v)
+	case []interface{}:
+		o.WriteUint8(genericList)
+		o.WriteVInt(uint64(len(v)))
+		for _, e := range v {
+			o.WriteGenericValue(e)
+		}
+	case map[string]interface{}:
+		o.WriteUint8(genericMap)
+		o.WriteMap(v)
+	case []string:
+		o.WriteUint8(genericStringSlice)
+		o.WriteStringSlice(v)
+	case map[string]string:
+		o.WriteUint8(genericStringMap)
+		o.WriteStringMap(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			o.WriteUint8(genericNil)
+			return
+		}
+		o.WriteUint8(genericJson)
+		o.WriteBytes(b)
+	}
+}
+
+// StreamInput reads a message written by a StreamOutput of the same Version. The first read past the end of the
+// stream or of a malformed value sets Err, the reads after it return zero values.
+type StreamInput struct {
+	Version Version
+	buf     []byte
+	err     error
+}
+
+func NewStreamInput(b []byte, version Version) *StreamInput {
+	return &StreamInput{Version: version, buf: b}
+}
+
+func (in *StreamInput) Err() error {
+	return in.err
+}
+
+// Remaining returns the bytes not read yet.
+func (in *StreamInput) Remaining() []byte {
+	return in.buf
+}
+
+func (in *StreamInput) fail(err error) {
+	if in.err == nil {
+		in.err = err
+	}
+}
+
+func (in *StreamInput) read(n int) []byte {
+	if in.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(in.buf) {
+		in.err = errEndOfStream
+		return nil
+	}
+	b := in.buf[:n]
+	in.buf = in.buf[n:]
+	return b
+}
+
+func (in *StreamInput) ReadUint8() byte {
+	b := in.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (in *StreamInput) ReadBool() bool {
+	return in.ReadUint8() == 1
+}
+
+func (in *StreamInput) ReadInt32() int32 {
+	b := in.read(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (in *StreamInput) ReadInt64() int64 {
+	b := in.read(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (in *StreamInput) ReadInt() int {
+	return int(in.ReadInt64())
+}
+
+func (in *StreamInput) ReadFloat64() float64 {
+	return math.Float64frombits(uint64(in.ReadInt64()))
+}
+
+func (in *StreamInput) ReadVInt() uint64 {
+	if in.err != nil {
+		return 0
+	}
+	i, n := binary.Uvarint(in.buf)
+	if n <= 0 {
+		in.err = fmt.Errorf("malformed variable length integer")
+		return 0
+	}
+	in.buf = in.buf[n:]
+	return i
+}
+
+// readLength reads the length of a value, it fails when the stream is shorter.
+func (in *StreamInput) readLength() int {
+	length := in.ReadVInt()
+	if length > uint64(len(in.buf)) {
+		in.fail(errEndOfStream)
+		return 0
+	}
+	return int(length)
+}
+
+// ReadCount reads the number of the elements of a collection, each of them takes at least a byte.
+func (in *StreamInput) ReadCount() int {
+	return in.readLength()
+}
+
+func (in *StreamInput) ReadBytes() []byte {
+	b := in.read(in.readLength())
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (in *StreamInput) ReadString() string {
+	return string(in.read(in.readLength()))
+}
+
+func (in *StreamInput) ReadDuration() time.Duration {
+	return time.Duration(in.ReadInt64())
+}
+
+func (in *StreamInput) ReadTime() time.Time {
+	var t time.Time
+	b := in.ReadBytes()
+	if in.err != nil {
+		return t
+	}
+	if err := t.UnmarshalBinary(b); err != nil {
+		in.fail(err)
+	}
+	return t
+}
+
+func (in *StreamInput) ReadStringSlice() []string {
+	length := in.readLength()
+	if length == 0 {
+		return nil
+	}
+	s := make([]string, 0, length)
+	for i := 0; i < length && in.err == nil; i++ {
+		s = append(s, in.ReadString())
+	}
+	return s
+}
+
+func (in *StreamInput) ReadStringMap() map[string]string {
+	length := in.readLength()
+	if length == 0 {
+		return nil
+	}
+	m := make(map[string]string, length)
+	for i := 0; i < length && in.err == nil; i++ {
+		k := in.ReadString()
+		m[k] = in.ReadString()
+	}
+	return m
+}
+
+func (in *StreamInput) ReadMap() map[string]interface{} {
+	length := in.readLength()
+	if length == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, length)
+	for i := 0; i < length && in.err == nil; i++ {
+		k := in.ReadString()
+		m[k] = in.ReadGenericValue()
+	}
+	return m
+}
+
+// ReadGenericValue reads a value written by WriteGenericValue. An empty map is read back as an empty map, unlike
+// ReadMap which returns nil.
+func (in *StreamInput) ReadGenericValue() interface{} {
+	switch t := in.ReadUint8(); t {
+	case genericNil:
+		return nil
+	case genericString:
+		return in.ReadString()
+	case genericBool:
+		return in.ReadBool()
+	case genericInt:
+		return in.ReadInt()
+	case genericInt64:
+		return in.ReadInt64()
+	case genericUint64:
+		return in.ReadVInt()
+	case genericFloat64:
+		return in.ReadFloat64()
+	case genericBytes:
+		return in.ReadBytes()
+	case genericList:
+		length := in.readLength()
+		list := make([]interface{}, 0, length)
+		for i := 0; i < length && in.err == nil; i++ {
+			list = append(list, in.ReadGenericValue())
+		}
+		return list
+	case genericMap:
+		if m := in.ReadMap(); m != nil {
+			return m
+		}
+		return map[string]interface{}{}
+	case genericStringSlice:
+		if s := in.ReadStringSlice(); s != nil {
+			return s
+		}
+		return []string{}
+	case genericStringMap:
+		if m := in.ReadStringMap(); m != nil {
+			return m
+		}
+		return map[string]string{}
+	case genericJson:
+		b := in.ReadBytes()
+		if in.err != nil {
+			return nil
+		}
+		var value interface{}
+		if err := json.Unmarshal(b, &value); err != nil {
+			in.fail(err)
+			return nil
+		}
+		return value
+	default:
+		in.fail(fmt.Errorf("unknown generic value type [%d]", t))
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStreamInput_Read(t *testing.T) {
+	// Arrange
+	out := NewStreamOutput(CurrentVersion)
+	out.WriteUint8(7)
+	out.WriteBool(true)
+	out.WriteInt32(-42)
+	out.WriteInt64(1 << 40)
+	out.WriteVInt(300)
+	out.WriteBytes([]byte{1, 2, 3})
+	out.WriteString("searchgoose")
+	out.WriteStringSlice([]string{"master", "data"})
+	out.WriteStringMap(map[string]string{"rack": "r1", "zone": "z1"})
+	written := out.Bytes()
+
+	// Action
+	in := NewStreamInput(written, CurrentVersion)
+	b := in.ReadUint8()
+	boolean := in.ReadBool()
+	i32 := in.ReadInt32()
+	i64 := in.ReadInt64()
+	vint := in.ReadVInt()
+	bytes := in.ReadBytes()
+	s := in.ReadString()
+	slice := in.ReadStringSlice()
+	m := in.ReadStringMap()
+	truncated := NewStreamInput(written[:len(written)-1], CurrentVersion)
+	truncated.read(len(written) - 3)
+	truncatedString := truncated.ReadString()
+
+	// Assert
+	assert.NoError(t, in.Err())
+	assert.Equal(t, byte(7), b)
+	assert.True(t, boolean)
+	assert.Equal(t, int32(-42), i32)
+	assert.Equal(t, int64(1<<40), i64)
+	assert.Equal(t, uint64(300), vint)
+	assert.Equal(t, []byte{1, 2, 3}, bytes)
+	assert.Equal(t, "searchgoose", s)
+	assert.Equal(t, []string{"master", "data"}, slice)
+	assert.Equal(t, map[string]string{"rack": "r1", "zone": "z1"}, m)
+	assert.Empty(t, in.Remaining())
+	assert.Equal(t, "", truncatedString)
+	assert.Equal(t, errEndOfStream, truncated.Err())
+}
+
+func TestStreamInput_ReadMap(t *testing.T) {
+	// Arrange
+	source := map[string]interface{}{
+		"name":   "searchgoose",
+		"count":  int64(3),
+		"bytes":  uint64(1 << 40),
+		"score":  1.5,
+		"tags":   []interface{}{"a", true, nil},
+		"nested": map[string]interface{}{"empty": map[string]interface{}{}},
+		"other":  int32(7),
+	}
+	written := ToBytes(writeableMap(source), CurrentVersion)
+
+	// Action
+	in := NewStreamInput(written, CurrentVersion)
+	read := in.ReadMap()
+
+	// Assert
+	assert.NoError(t, in.Err())
+	assert.Equal(t, "searchgoose", read["name"])
+	assert.Equal(t, int64(3), read["count"])
+	assert.Equal(t, uint64(1<<40), read["bytes"])
+	assert.Equal(t, 1.5, read["score"])
+	assert.Equal(t, []interface{}{"a", true, nil}, read["tags"])
+	assert.Equal(t, map[string]interface{}{"empty": map[string]interface{}{}}, read["nested"])
+	// the other types are read back the way encoding/json decodes them
+	assert.Equal(t, float64(7), read["other"])
+}
+
+type writeableMap map[string]interface{}
+
+func (m writeableMap) WriteTo(out *StreamOutput) {
+	out.WriteMap(m)
+}
@@ -26,6 +26,7 @@ require (
 	github.com/tinylib/msgp v1.1.2 // indirect
 	github.com/valyala/fasthttp v1.15.1
 	github.com/willf/bitset v1.1.11 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	golang.org/x/sys v0.0.0-20201018230417-eeed37f84f13 // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
 )
@@ -0,0 +1,245 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state/cluster"
+)
+
+// The actions the REST handlers run besides those sent to other nodes, a role grants them through its privileges.
+const (
+	MainAction                = "cluster:monitor/main"
+	XpackInfoAction           = "cluster:monitor/xpack/info"
+	ClusterHealthAction       = "cluster:monitor/health"
+	ClusterStateAction        = "cluster:monitor/state"
+	ClusterPendingTasksAction = "cluster:monitor/task"
+	AllocationExplainAction   = "cluster:monitor/allocation/explain"
+	ClusterRerouteAction      = "cluster:admin/reroute"
+	AddVotingConfigAction     = "cluster:admin/voting_config/add_exclusions"
+	ClearVotingConfigAction   = "cluster:admin/voting_config/clear_exclusions"
+	GetTemplatesAction        = "indices:admin/template/get"
+	GetIndexAction            = "indices:admin/get"
+	GetAliasesAction          = "indices:admin/aliases/get"
+	GetMappingsAction         = "indices:admin/mappings/get"
+	// SearchRequestAction is the search of a request, SearchAction the search of a shard
+	SearchRequestAction = "indices:data/read/search"
+	UpdateAction        = "indices:data/write/update"
+	// BulkAction is the bulk of a request, ShardBulkAction the bulk of a shard
+	BulkAction = "indices:data/write/bulk"
+)
+
+// ActionRequests returns the actions a REST request runs, its user has to be granted all of them.
+func ActionRequests(h RestHandler, r *RestRequest) ([]security.ActionRequest, error) {
+	index := r.PathParams["index"]
+	switch h.(type) {
+	case *RestMain:
+		return clusterActionRequest(MainAction), nil
+	case *RestXpack:
+		return clusterActionRequest(XpackInfoAction), nil
+	case *RestNodesInfo:
+		return clusterActionRequest(NodesInfoAction), nil
+	case *RestNodesStats, *RestCatNodes:
+		return clusterActionRequest(NodesStatsAction), nil
+	case *RestCatTemplates:
+		return clusterActionRequest(GetTemplatesAction), nil
+	case *RestClusterHealth:
+		return clusterActionRequest(ClusterHealthAction), nil
+	case *RestClusterState, *RestClusterGetSettings:
+		return clusterActionRequest(ClusterStateAction), nil
+	case *RestClusterStats:
+		return clusterActionRequest(ClusterStatsAction), nil
+	case *RestClusterPutSettings:
+		return clusterActionRequest(cluster.ClusterUpdateSettingsAction), nil
+	case *RestClusterReroute:
+		return clusterActionRequest(ClusterRerouteAction), nil
+	case *RestClusterPendingTasks:
+		return clusterActionRequest(ClusterPendingTasksAction), nil
+	case *RestAddVotingConfigExclusions:
+		return clusterActionRequest(AddVotingConfigAction), nil
+	case *RestClearVotingConfigExclusions:
+		return clusterActionRequest(ClearVotingConfigAction), nil
+	case *RestClusterAllocationExplain:
+		return clusterActionRequest(AllocationExplainAction), nil
+	case *RestListTasks:
+		return clusterActionRequest(ListTasksAction), nil
+	case *RestGetTask:
+		return clusterActionRequest(GetTaskAction), nil
+	case *RestCancelTask:
+		return clusterActionRequest(CancelTasksAction), nil
+
+	case *RestPutUser:
+		return clusterActionRequest(security.UserPutAction), nil
+	case *RestGetUsers:
+		return clusterActionRequest(security.UserGetAction), nil
+	case *RestDeleteUser:
+		return clusterActionRequest(security.UserDeleteAction), nil
+	case *RestPutRole:
+		return clusterActionRequest(security.RolePutAction), nil
+	case *RestGetRoles:
+		return clusterActionRequest(security.RoleGetAction), nil
+	case *RestDeleteRole:
+		return clusterActionRequest(security.RoleDeleteAction), nil
+	case *RestCreateApiKey:
+		return clusterActionRequest(security.ApiKeyCreateAction), nil
+	case *RestGetApiKeys:
+		if r.ParamAsBool("owner", false) {
+			return clusterActionRequest(security.OwnApiKeyGetAction), nil
+		}
+		return clusterActionRequest(security.ApiKeyGetAction), nil
+	case *RestInvalidateApiKeys:
+		body, err := parseInvalidateApiKeysBody(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		if body.Owner {
+			return clusterActionRequest(security.OwnApiKeyInvalidateAction), nil
+		}
+		return clusterActionRequest(security.ApiKeyInvalidateAction), nil
+	case *RestAuthenticate:
+		return clusterActionRequest(security.AuthenticateAction), nil
+
+	case *RestGetIndex, *RestHeadIndex:
+		return indexActionRequest(GetIndexAction, index), nil
+	case *RestPutIndex:
+		return indexActionRequest(cluster.CreateIndexAction, index), nil
+	case *RestDeleteIndex:
+		return indexActionRequest(cluster.DeleteIndexAction, index), nil
+	case *RestGetIndexAlias:
+		return indexActionRequest(GetAliasesAction, r.PathParams["name"]), nil
+	case *RestPostIndexAlias:
+		return aliasesActionRequests(r)
+	case *RestGetMappings:
+		return indexActionRequest(GetMappingsAction, index), nil
+	case *RestRefresh:
+		return indexActionRequest(RefreshAction, index), nil
+	case *RestFlush:
+		return indexActionRequest(FlushAction, index), nil
+	case *RestForceMerge:
+		return indexActionRequest(ForceMergeAction, index), nil
+	case *RestIndicesStatsAction, *RestCatIndices, *RestCatShards:
+		return indexActionRequest(IndicesStatsAction, index), nil
+	case *RestRecovery, *RestCatRecovery:
+		return indexActionRequest(RecoveryAction, index), nil
+	case *RestSearch:
+		return indexActionRequest(SearchRequestAction, index), nil
+	case *RestGetDoc, *RestGetSource:
+		return indexActionRequest(GetAction, index), nil
+	case *RestIndexDoc, *RestIndexDocId:
+		return indexActionRequest(IndexAction, index), nil
+	case *RestUpdateDoc:
+		return indexActionRequest(UpdateAction, index), nil
+	case *RestDeleteDoc:
+		return indexActionRequest(DeleteAction, index), nil
+	case *RestDeleteByQuery:
+		return indexActionRequest(DeleteByQueryAction, index), nil
+	case *RestUpdateByQuery:
+		return indexActionRequest(UpdateByQueryAction, index), nil
+	case *RestBulk:
+		return bulkActionRequests(r)
+	case *RestReindex:
+		return reindexActionRequests(r)
+	}
+	return nil, fmt.Errorf("no action is defined for the handler [%T]", h)
+}
+
+// SecurityErrorResponse replies the failure to authenticate or to authorize a request.
+func SecurityErrorResponse(err error) RestResponse {
+	switch err := err.(type) {
+	case *security.AuthenticationError:
+		return newErrorResponse(401, err.ErrorType(), err.Error())
+	case *security.AuthorizationError:
+		return newErrorResponse(403, err.ErrorType(), err.Error())
+	}
+	return newErrorResponse(400, "illegal_argument_exception", err.Error())
+}
+
+func clusterActionRequest(action string) []security.ActionRequest {
+	return []security.ActionRequest{security.ClusterAction(action)}
+}
+
+func indexActionRequest(action string, expressions ...string) []security.ActionRequest {
+	return []security.ActionRequest{security.IndexAction(action, expressions...)}
+}
+
+// bulkActionRequests returns the write action of every item, on the index of the item. A bulk without items
+// still needs the bulk action on the index of its path.
+func bulkActionRequests(r *RestRequest) ([]security.ActionRequest, error) {
+	items, err := parseBulkBody(r.Body, r.PathParams["index"], "")
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return indexActionRequest(BulkAction, r.PathParams["index"]), nil
+	}
+	var requests []security.ActionRequest
+	for _, item := range items {
+		action := IndexAction
+		switch item.OpType {
+		case "update":
+			action = UpdateAction
+		case "delete":
+			action = DeleteAction
+		}
+		requests = append(requests, security.IndexAction(action, item.Index))
+	}
+	return requests, nil
+}
+
+// reindexActionRequests returns a scroll of the source indices, unless they are remote, and an index of the
+// destination.
+func reindexActionRequests(r *RestRequest) ([]security.ActionRequest, error) {
+	body, err := parseBulkByScrollBody(r)
+	if err != nil {
+		return nil, err
+	}
+	source, _ := body["source"].(map[string]interface{})
+	dest, _ := body["dest"].(map[string]interface{})
+	destIndex, _ := dest["index"].(string)
+	requests := []security.ActionRequest{security.IndexAction(IndexAction, destIndex)}
+	if _, remote := source["remote"]; !remote {
+		requests = append(requests, security.IndexAction(ShardScrollAction, reindexSourceIndices(source)...))
+	}
+	return requests, nil
+}
+
+// aliasesActionRequests returns the alias action on the indices and the aliases of every add and remove action,
+// and the delete of the indices of every remove_index action.
+func aliasesActionRequests(r *RestRequest) ([]security.ActionRequest, error) {
+	var body struct {
+		Actions []map[string]struct {
+			Index   string   `json:"index"`
+			Indices []string `json:"indices"`
+			Alias   string   `json:"alias"`
+			Aliases []string `json:"aliases"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil, err
+	}
+	if len(body.Actions) == 0 {
+		return nil, fmt.Errorf("[actions] is required")
+	}
+	var requests []security.ActionRequest
+	for _, action := range body.Actions {
+		for actionType, target := range action {
+			if target.Index == "" && len(target.Indices) == 0 {
+				return nil, fmt.Errorf("One of [index] or [indices] is required")
+			}
+			indices := append([]string{target.Index}, target.Indices...)
+			switch actionType {
+			case "add", "remove":
+				if target.Alias == "" && len(target.Aliases) == 0 {
+					return nil, fmt.Errorf("One of [alias] or [aliases] is required")
+				}
+				expressions := append(append(indices, target.Alias), target.Aliases...)
+				requests = append(requests, security.IndexAction(cluster.IndicesAliasesAction, expressions...))
+			case "remove_index":
+				requests = append(requests, security.IndexAction(cluster.DeleteIndexAction, indices...))
+			default:
+				return nil, fmt.Errorf("Unsupported action [%s]", actionType)
+			}
+		}
+	}
+	return requests, nil
+}
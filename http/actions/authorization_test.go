@@ -0,0 +1,76 @@
+package actions
+
+import (
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestActionRequests(t *testing.T) {
+	// Arrange
+	search := &RestRequest{PathParams: map[string]string{"index": "logs-1,logs-2"}}
+	refreshAll := &RestRequest{PathParams: map[string]string{}}
+	bulk := &RestRequest{
+		PathParams: map[string]string{"index": "logs-1"},
+		Body: []byte(`{"index":{"_id":"1"}}
+{"message":"a"}
+{"delete":{"_index":"logs-2","_id":"2"}}
+{"update":{"_id":"3"}}
+{"doc":{"message":"c"}}
+`),
+	}
+	reindex := &RestRequest{Body: []byte(`{"source":{"index":["logs-1","logs-2"]},"dest":{"index":"logs-all"}}`)}
+	remoteReindex := &RestRequest{Body: []byte(`{"source":{"index":"logs","remote":{"host":"http://otherhost:9200"}},"dest":{"index":"logs-all"}}`)}
+	ownApiKeys := &RestRequest{QueryParams: map[string][]byte{"owner": []byte("true")}}
+	emptyBulk := &RestRequest{PathParams: map[string]string{"index": "logs-1"}}
+	aliases := &RestRequest{Body: []byte(`{"actions":[
+{"add":{"index":"logs-1","alias":"logs"}},
+{"remove":{"indices":["logs-2","logs-3"],"aliases":["logs","old-logs"]}},
+{"remove_index":{"index":"logs-4"}}
+]}`)}
+
+	// Action
+	searchRequests, searchErr := ActionRequests(&RestSearch{}, search)
+	refreshRequests, _ := ActionRequests(&RestRefresh{}, refreshAll)
+	healthRequests, _ := ActionRequests(&RestClusterHealth{}, search)
+	bulkRequests, bulkErr := ActionRequests(&RestBulk{}, bulk)
+	reindexRequests, _ := ActionRequests(&RestReindex{}, reindex)
+	remoteReindexRequests, _ := ActionRequests(&RestReindex{}, remoteReindex)
+	ownApiKeysRequests, _ := ActionRequests(&RestGetApiKeys{}, ownApiKeys)
+	_, malformedErr := ActionRequests(&RestBulk{}, &RestRequest{Body: []byte("{")})
+	emptyBulkRequests, emptyBulkErr := ActionRequests(&RestBulk{}, emptyBulk)
+	aliasesRequests, aliasesErr := ActionRequests(&RestPostIndexAlias{}, aliases)
+	_, unknownAliasActionErr := ActionRequests(&RestPostIndexAlias{}, &RestRequest{Body: []byte(`{"actions":[{"rename":{"index":"logs-1","alias":"logs"}}]}`)})
+	_, aliasWithoutIndexErr := ActionRequests(&RestPostIndexAlias{}, &RestRequest{Body: []byte(`{"actions":[{"add":{"alias":"logs"}}]}`)})
+
+	// Assert
+	assert.NoError(t, searchErr)
+	assert.Equal(t, []security.ActionRequest{{Action: SearchRequestAction, Indices: []string{"logs-1", "logs-2"}}}, searchRequests)
+	assert.Equal(t, []security.ActionRequest{{Action: RefreshAction, Indices: []string{"_all"}}}, refreshRequests)
+	// a cluster action has no indices whatever the path
+	assert.Equal(t, []security.ActionRequest{{Action: ClusterHealthAction}}, healthRequests)
+	assert.NoError(t, bulkErr)
+	assert.Equal(t, []security.ActionRequest{
+		{Action: IndexAction, Indices: []string{"logs-1"}},
+		{Action: DeleteAction, Indices: []string{"logs-2"}},
+		{Action: UpdateAction, Indices: []string{"logs-1"}},
+	}, bulkRequests)
+	assert.Equal(t, []security.ActionRequest{
+		{Action: IndexAction, Indices: []string{"logs-all"}},
+		{Action: ShardScrollAction, Indices: []string{"logs-1", "logs-2"}},
+	}, reindexRequests)
+	assert.Equal(t, []security.ActionRequest{{Action: IndexAction, Indices: []string{"logs-all"}}}, remoteReindexRequests)
+	assert.Equal(t, []security.ActionRequest{{Action: security.OwnApiKeyGetAction}}, ownApiKeysRequests)
+	assert.Error(t, malformedErr)
+	assert.NoError(t, emptyBulkErr)
+	assert.Equal(t, []security.ActionRequest{{Action: BulkAction, Indices: []string{"logs-1"}}}, emptyBulkRequests)
+	assert.NoError(t, aliasesErr)
+	assert.Equal(t, []security.ActionRequest{
+		{Action: cluster.IndicesAliasesAction, Indices: []string{"logs-1", "logs"}},
+		{Action: cluster.IndicesAliasesAction, Indices: []string{"logs-2", "logs-3", "logs", "old-logs"}},
+		{Action: cluster.DeleteIndexAction, Indices: []string{"logs-4"}},
+	}, aliasesRequests)
+	assert.EqualError(t, unknownAliasActionErr, "Unsupported action [rename]")
+	assert.EqualError(t, aliasWithoutIndexErr, "One of [index] or [indices] is required")
+}
@@ -0,0 +1,224 @@
+package actions
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"sync"
+)
+
+// broadcastShardRequest asks a node to run a broadcast operation, such as a refresh, on some of its shards.
+type broadcastShardRequest struct {
+	NodeId string
+	Shards []state.ShardRouting
+	Params map[string]string
+}
+
+func (r *broadcastShardRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.NodeId)
+	out.WriteVInt(uint64(len(r.Shards)))
+	for i := range r.Shards {
+		r.Shards[i].WriteTo(out)
+	}
+	out.WriteStringMap(r.Params)
+}
+
+func readBroadcastShardRequest(in *common.StreamInput) (*broadcastShardRequest, error) {
+	req := broadcastShardRequest{NodeId: in.ReadString()}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.Shards = append(req.Shards, state.ReadShardRouting(in))
+	}
+	req.Params = in.ReadStringMap()
+	return &req, in.Err()
+}
+
+type broadcastShardFailure struct {
+	Index  string
+	Shard  int
+	Reason string
+}
+
+type broadcastShardResponse struct {
+	Successful int
+	Failures   []broadcastShardFailure
+}
+
+func (r *broadcastShardResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteInt(r.Successful)
+	out.WriteVInt(uint64(len(r.Failures)))
+	for _, failure := range r.Failures {
+		out.WriteString(failure.Index)
+		out.WriteInt(failure.Shard)
+		out.WriteString(failure.Reason)
+	}
+}
+
+func readBroadcastShardResponse(in *common.StreamInput) (*broadcastShardResponse, error) {
+	res := broadcastShardResponse{Successful: in.ReadInt()}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.Failures = append(res.Failures, broadcastShardFailure{
+			Index:  in.ReadString(),
+			Shard:  in.ReadInt(),
+			Reason: in.ReadString(),
+		})
+	}
+	return &res, in.Err()
+}
+
+// registerBroadcastShardAction runs operation on every shard of a broadcastShardRequest and reports
+// the shards it failed on.
+func registerBroadcastShardAction(indicesService *indices.Service, transportService *transport.Service, action string, operation func(indexShard *index.Shard, params map[string]string) error) {
+	transportService.RegisterRequestHandler(action, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readBroadcastShardRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		res := broadcastShardResponse{}
+		for _, shardRouting := range request.Shards {
+			failure := broadcastShardFailure{
+				Index: shardRouting.ShardId.Index.Name,
+				Shard: shardRouting.ShardId.ShardId,
+			}
+			indexService, existing := indicesService.IndexService(shardRouting.ShardId.Index.Uuid)
+			if !existing {
+				failure.Reason = "no such index [" + shardRouting.ShardId.Index.Name + "]"
+				res.Failures = append(res.Failures, failure)
+				continue
+			}
+			indexShard, existing := indexService.Shard(shardRouting.ShardId.ShardId)
+			if !existing {
+				failure.Reason = fmt.Sprintf("no such shard [%d]", shardRouting.ShardId.ShardId)
+				res.Failures = append(res.Failures, failure)
+				continue
+			}
+			if err := operation(indexShard, request.Params); err != nil {
+				failure.Reason = err.Error()
+				res.Failures = append(res.Failures, failure)
+				continue
+			}
+			res.Successful++
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+}
+
+// resolveBroadcastIndices resolves the {index} of a broadcast request, every index when it is missing.
+// It replies with index_not_found_exception when an explicit expression matches nothing.
+func resolveBroadcastIndices(resolver *indices.NameExpressionResolver, clusterState *state.ClusterState, r *RestRequest, reply ResponseListener) ([]string, bool) {
+	indexExpression := r.PathParams["index"]
+	if indexExpression == "" {
+		indexExpression = "*"
+	}
+	concreteIndices := resolver.ConcreteIndexNames(*clusterState, indexExpression)
+	if len(concreteIndices) == 0 && indexExpression != "*" {
+		reply(newErrorResponse(404, "index_not_found_exception", "no such index ["+indexExpression+"]"))
+		return nil, false
+	}
+	return concreteIndices, true
+}
+
+// broadcastShardOperation sends action to the nodes holding the shards of the given indices and
+// returns the "_shards" section of the response, listing the shards the operation failed on. The
+// operation runs on every copy of the shards with allCopies, on the primaries only otherwise.
+func broadcastShardOperation(clusterState *state.ClusterState, transportService *transport.Service, action string, concreteIndices []string, allCopies bool, params map[string]string, failureType string) map[string]interface{} {
+	total := 0
+	nodeShards := map[string][]state.ShardRouting{}
+	for _, indexName := range concreteIndices {
+		for _, indexShardRoutingTable := range clusterState.RoutingTable.IndicesRouting[indexName].Shards {
+			shardRoutings := []state.ShardRouting{indexShardRoutingTable.Primary}
+			if allCopies {
+				shardRoutings = indexShardRoutingTable.Copies()
+			}
+			for _, shardRouting := range shardRoutings {
+				total++
+				// unassigned shards count towards the total but are neither successful nor failed
+				if _, assigned := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]; !assigned {
+					continue
+				}
+				nodeShards[shardRouting.CurrentNodeId] = append(nodeShards[shardRouting.CurrentNodeId], shardRouting)
+			}
+		}
+	}
+
+	successful := 0
+	var failures []interface{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(nodeShards))
+	for nodeId, shards := range nodeShards {
+		shards := shards
+		req := broadcastShardRequest{
+			NodeId: nodeId,
+			Shards: shards,
+			Params: params,
+		}
+		onFailure := func(err error) {
+			mux.Lock()
+			defer mux.Unlock()
+			for _, shard := range shards {
+				failures = append(failures, map[string]interface{}{
+					"index":  shard.ShardId.Index.Name,
+					"shard":  shard.ShardId.ShardId,
+					"status": "INTERNAL_SERVER_ERROR",
+					"reason": map[string]interface{}{
+						"type":   transport.ErrorType(err),
+						"reason": err.Error(),
+					},
+				})
+			}
+		}
+		node := clusterState.Nodes.Nodes[nodeId]
+		version := transportService.GetVersion(node)
+		transportService.SendRequestWithHandler(node, action, common.ToBytes(&req, version), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readBroadcastShardResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				mux.Lock()
+				defer mux.Unlock()
+				successful += res.Successful
+				for _, failure := range res.Failures {
+					failures = append(failures, map[string]interface{}{
+						"index":  failure.Index,
+						"shard":  failure.Shard,
+						"status": "INTERNAL_SERVER_ERROR",
+						"reason": map[string]interface{}{
+							"type":   failureType,
+							"reason": failure.Reason,
+						},
+					})
+				}
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
+		})
+	}
+	wg.Wait()
+
+	return shardsHeader(total, successful, failures)
+}
+
+// shardsHeader is the "_shards" section of a response, listing the shards that failed. The shards neither
+// successful nor failed were not assigned.
+func shardsHeader(total int, successful int, failures []interface{}) map[string]interface{} {
+	shards := map[string]interface{}{
+		"total":      total,
+		"successful": successful,
+		"failed":     len(failures),
+	}
+	if len(failures) > 0 {
+		shards["failures"] = failures
+	}
+	return shards
+}
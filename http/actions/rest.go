@@ -1,5 +1,14 @@
 package actions
 
+import (
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/transport"
+	"strconv"
+	"time"
+)
+
 type RestMethod int
 
 const (
@@ -20,6 +29,38 @@ type RestRequest struct {
 	QueryParams map[string][]byte
 	Header      map[string][]byte
 	Body        []byte
+	// Authentication is who sent the request, nil when security is disabled
+	Authentication *security.Authentication
+}
+
+func (r *RestRequest) Param(key string) string {
+	return string(r.QueryParams[key])
+}
+
+func (r *RestRequest) ParamAsBool(key string, defaultValue bool) bool {
+	value, existing := r.QueryParams[key]
+	if !existing {
+		return defaultValue
+	}
+	// a flag without value, e.g. "?pretty", counts as true
+	return len(value) == 0 || string(value) == "true"
+}
+
+func (r *RestRequest) ParamAsInt(key string, defaultValue int) (int, error) {
+	value, existing := r.QueryParams[key]
+	if !existing || len(value) == 0 {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(string(value))
+}
+
+// ParamAsDuration parses time values such as "30s", "1m" or "500ms".
+func (r *RestRequest) ParamAsDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value, existing := r.QueryParams[key]
+	if !existing || len(value) == 0 {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(string(value))
 }
 
 type RestResponse struct {
@@ -32,3 +73,98 @@ type ResponseListener func(response RestResponse)
 type RestHandler interface {
 	Handle(r *RestRequest, reply ResponseListener)
 }
+
+func newErrorResponse(statusCode int, errorType string, reason string) RestResponse {
+	return RestResponse{
+		StatusCode: statusCode,
+		Body: map[string]interface{}{
+			"error": map[string]interface{}{
+				"root_cause": []map[string]interface{}{
+					{
+						"type":   errorType,
+						"reason": reason,
+					},
+				},
+				"type":   errorType,
+				"reason": reason,
+			},
+			"status": statusCode,
+		},
+	}
+}
+
+// transportFailureResponse replies the failure of a request sent to a node, e.g. a timeout, a lost connection or
+// an error of its handler.
+func transportFailureResponse(err error) RestResponse {
+	return newErrorResponse(500, transport.ErrorType(err), err.Error())
+}
+
+// nodeFailure is the entry of a node that failed a nodes request.
+func nodeFailure(nodeId string, err error) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "failed_node_exception",
+		"reason":  "Failed node [" + nodeId + "]",
+		"node_id": nodeId,
+		"caused_by": map[string]interface{}{
+			"type":   transport.ErrorType(err),
+			"reason": err.Error(),
+		},
+	}
+}
+
+// nodesHeader is the "_nodes" section of a nodes response, listing the nodes that failed.
+func nodesHeader(total int, failures []interface{}) map[string]interface{} {
+	header := map[string]interface{}{
+		"total":      total,
+		"successful": total - len(failures),
+		"failed":     len(failures),
+	}
+	if len(failures) > 0 {
+		header["failures"] = failures
+	}
+	return header
+}
+
+// ackedRequest reads the timeout and master_timeout parameters of an API updating the cluster state.
+func ackedRequest(r *RestRequest) (cluster.AckedRequest, error) {
+	ackTimeout, err := r.ParamAsDuration("timeout", 30*time.Second)
+	if err != nil {
+		return cluster.AckedRequest{}, invalidParameter("timeout", r.Param("timeout"))
+	}
+	masterTimeout, err := r.ParamAsDuration("master_timeout", 30*time.Second)
+	if err != nil {
+		return cluster.AckedRequest{}, invalidParameter("master_timeout", r.Param("master_timeout"))
+	}
+	return cluster.AckedRequest{
+		AckTimeout:    ackTimeout,
+		MasterTimeout: masterTimeout,
+	}, nil
+}
+
+// clusterStateUpdateError replies the failure of a cluster state update, nil when the state was committed.
+func clusterStateUpdateError(err error) *RestResponse {
+	var response RestResponse
+	switch err := err.(type) {
+	case *state.FailedToCommitError:
+		response = newErrorResponse(500, "failed_to_commit_cluster_state_exception", err.Error())
+	case *state.ProcessClusterEventTimeoutError:
+		response = newErrorResponse(503, "process_cluster_event_timeout_exception", err.Error())
+	case *state.MasterNotDiscoveredError:
+		response = newErrorResponse(503, "master_not_discovered_exception", err.Error())
+	default:
+		return nil
+	}
+	return &response
+}
+
+// acknowledgedResponse replies the result of a cluster state update, acknowledged when every node applied the state.
+func acknowledgedResponse(err error, body map[string]interface{}) RestResponse {
+	if response := clusterStateUpdateError(err); response != nil {
+		return *response
+	}
+	body["acknowledged"] = err == nil
+	return RestResponse{
+		StatusCode: 200,
+		Body:       body,
+	}
+}
@@ -81,10 +81,17 @@ func (h *RestPostIndexAlias) Handle(r *RestRequest, reply ResponseListener) {
 		return
 	}
 
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
 	actions := body["actions"].([]interface{})
 
 	req := cluster.IndicesAliasesClusterStateUpdateRequest{
-		Actions: []cluster.AliasAction{},
+		AckedRequest: ackedReq,
+		Actions:      []cluster.AliasAction{},
 	}
 	for _, action := range actions {
 		action := action.(map[string]interface{})
@@ -105,12 +112,7 @@ func (h *RestPostIndexAlias) Handle(r *RestRequest, reply ResponseListener) {
 		}
 	}
 
-	h.indexAliasesService.IndicesAliases(req)
+	err = h.indexAliasesService.IndicesAliases(req)
 
-	reply(RestResponse{
-		StatusCode: 200,
-		Body: map[string]interface{}{
-			"acknowledged": true,
-		},
-	})
+	reply(acknowledgedResponse(err, map[string]interface{}{}))
 }
@@ -0,0 +1,292 @@
+package actions
+
+import (
+	"encoding/json"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"strconv"
+	"strings"
+)
+
+func decisionName(decision cluster.Decision) string {
+	switch decision {
+	case cluster.DecisionYes:
+		return "yes"
+	case cluster.DecisionThrottle:
+		return "throttled"
+	default:
+		return "no"
+	}
+}
+
+func deciderResultsBody(results []cluster.DeciderResult, includeYesDecisions bool) []map[string]interface{} {
+	deciders := []map[string]interface{}{}
+	for _, result := range results {
+		if result.Decision == cluster.DecisionYes && !includeYesDecisions {
+			continue
+		}
+		deciders = append(deciders, map[string]interface{}{
+			"decider":     result.Decider,
+			"decision":    result.Decision.String(),
+			"explanation": result.Explanation,
+		})
+	}
+	return deciders
+}
+
+func shardRoutingBody(shard state.ShardRouting) map[string]interface{} {
+	body := map[string]interface{}{
+		"index":           shard.ShardId.Index.Name,
+		"shard":           shard.ShardId.ShardId,
+		"primary":         shard.Primary,
+		"state":           string(shard.State),
+		"node":            nil,
+		"relocating_node": nil,
+	}
+	if shard.CurrentNodeId != "" {
+		body["node"] = shard.CurrentNodeId
+		body["allocation_id"] = map[string]interface{}{
+			"id": shard.AllocationId,
+		}
+	}
+	if shard.RelocatingNodeId != "" {
+		body["relocating_node"] = shard.RelocatingNodeId
+	}
+	if shard.State == state.ShardUnassigned || shard.State == state.ShardInitializing {
+		if info := shard.UnassignedInfo; info.Reason != "" {
+			body["unassigned_info"] = unassignedInfoBody(info)
+		}
+	}
+	return body
+}
+
+func unassignedInfoBody(info state.UnassignedInfo) map[string]interface{} {
+	body := map[string]interface{}{
+		"reason":  string(info.Reason),
+		"at":      info.At.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"details": info.Details,
+	}
+	if info.FailedAllocations > 0 {
+		body["failed_attempts"] = info.FailedAllocations
+	}
+	return body
+}
+
+// routingTableBody renders the routing table of the given indices as the cluster state API does.
+func routingTableBody(clusterState *state.ClusterState, concreteIndices []string) map[string]interface{} {
+	indicesBody := map[string]interface{}{}
+	for _, indexName := range concreteIndices {
+		shardsBody := map[string]interface{}{}
+		for shardId, shardRoutingTable := range clusterState.RoutingTable.IndicesRouting[indexName].Shards {
+			var copies []map[string]interface{}
+			for _, shardCopy := range shardRoutingTable.Copies() {
+				copies = append(copies, shardRoutingBody(shardCopy))
+			}
+			shardsBody[strconv.Itoa(shardId)] = copies
+		}
+		indicesBody[indexName] = map[string]interface{}{
+			"shards": shardsBody,
+		}
+	}
+	return map[string]interface{}{
+		"indices": indicesBody,
+	}
+}
+
+type RestClusterReroute struct {
+	clusterService    *cluster.Service
+	allocationService *cluster.AllocationService
+}
+
+func NewRestClusterReroute(clusterService *cluster.Service, allocationService *cluster.AllocationService) *RestClusterReroute {
+	return &RestClusterReroute{
+		clusterService:    clusterService,
+		allocationService: allocationService,
+	}
+}
+
+func (h *RestClusterReroute) Handle(r *RestRequest, reply ResponseListener) {
+	dryRun := r.ParamAsBool("dry_run", false)
+	explain := r.ParamAsBool("explain", false)
+	retryFailed := r.ParamAsBool("retry_failed", false)
+	commands, err := cluster.ParseAllocationCommands(r.Body)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	var newState state.ClusterState
+	var explanations []cluster.RerouteExplanation
+	var publishErr error
+	if dryRun {
+		newState, explanations, err = h.allocationService.RerouteWithCommands(*h.clusterService.State(), commands, explain, retryFailed)
+	} else {
+		config := state.TaskConfig{Priority: state.PriorityUrgent, MasterTimeout: ackedReq.MasterTimeout, AckTimeout: ackedReq.AckTimeout}
+		publishErr = h.clusterService.SubmitStateUpdateTask("cluster_reroute (api)", config, func(current state.ClusterState) state.ClusterState {
+			newState, explanations, err = h.allocationService.RerouteWithCommands(current, commands, explain, retryFailed)
+			if err != nil {
+				return current
+			}
+			return newState
+		})
+	}
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	if response := clusterStateUpdateError(publishErr); response != nil {
+		reply(*response)
+		return
+	}
+
+	var indexNames []string
+	for indexName := range newState.RoutingTable.IndicesRouting {
+		indexNames = append(indexNames, indexName)
+	}
+	nodesBody := map[string]interface{}{}
+	for _, node := range newState.Nodes.Nodes {
+		nodesBody[node.Id] = map[string]interface{}{
+			"name":              node.Name,
+			"transport_address": node.HostAddress,
+		}
+	}
+	body := map[string]interface{}{
+		"state": map[string]interface{}{
+			"cluster_uuid":  newState.StateUUID,
+			"version":       newState.Version,
+			"master_node":   newState.Nodes.MasterNodeId,
+			"nodes":         nodesBody,
+			"routing_table": routingTableBody(&newState, indexNames),
+		},
+	}
+	if explain {
+		explanationsBody := []map[string]interface{}{}
+		for _, explanation := range explanations {
+			explanationsBody = append(explanationsBody, map[string]interface{}{
+				"command":    explanation.Command.Name,
+				"parameters": explanation.Command.Parameters(),
+				"decisions":  deciderResultsBody(explanation.Results, true),
+			})
+		}
+		body["explanations"] = explanationsBody
+	}
+	reply(acknowledgedResponse(publishErr, body))
+}
+
+type RestClusterAllocationExplain struct {
+	clusterService    *cluster.Service
+	allocationService *cluster.AllocationService
+}
+
+func NewRestClusterAllocationExplain(clusterService *cluster.Service, allocationService *cluster.AllocationService) *RestClusterAllocationExplain {
+	return &RestClusterAllocationExplain{
+		clusterService:    clusterService,
+		allocationService: allocationService,
+	}
+}
+
+func (h *RestClusterAllocationExplain) Handle(r *RestRequest, reply ResponseListener) {
+	includeYesDecisions := r.ParamAsBool("include_yes_decisions", false)
+	var request struct {
+		Index       *string `json:"index"`
+		Shard       *int    `json:"shard"`
+		Primary     *bool   `json:"primary"`
+		CurrentNode string  `json:"current_node"`
+	}
+	if len(r.Body) > 0 {
+		if err := json.Unmarshal(r.Body, &request); err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", "failed to parse allocation explain request: "+err.Error()))
+			return
+		}
+	}
+	var index string
+	var shard int
+	var primary bool
+	if request.Index != nil || request.Shard != nil || request.Primary != nil {
+		if request.Index == nil || request.Shard == nil || request.Primary == nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", "the index, shard, and primary fields must all be specified to explain a shard, or none of them to explain the first unassigned shard"))
+			return
+		}
+		index, shard, primary = *request.Index, *request.Shard, *request.Primary
+	}
+
+	clusterState := h.clusterService.State()
+	shardRouting, err := cluster.FindShardToExplain(*clusterState, index, shard, primary, request.CurrentNode)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	explanation := h.allocationService.ExplainShardAllocation(*clusterState, shardRouting)
+
+	nodeDecisions := []map[string]interface{}{}
+	for _, nodeDecision := range explanation.NodeDecisions {
+		nodeBody := map[string]interface{}{
+			"node_id":           nodeDecision.Node.Id,
+			"node_name":         nodeDecision.Node.Name,
+			"transport_address": nodeDecision.Node.HostAddress,
+			"node_decision":     decisionName(nodeDecision.Decision),
+			"weight_ranking":    nodeDecision.WeightRanking,
+		}
+		if deciders := deciderResultsBody(nodeDecision.Results, includeYesDecisions); len(deciders) > 0 {
+			nodeBody["deciders"] = deciders
+		}
+		nodeDecisions = append(nodeDecisions, nodeBody)
+	}
+
+	body := map[string]interface{}{
+		"index":                     shardRouting.ShardId.Index.Name,
+		"shard":                     shardRouting.ShardId.ShardId,
+		"primary":                   shardRouting.Primary,
+		"current_state":             strings.ToLower(string(shardRouting.State)),
+		"node_allocation_decisions": nodeDecisions,
+	}
+	if shardRouting.UnassignedInfo.Reason != "" {
+		body["unassigned_info"] = unassignedInfoBody(shardRouting.UnassignedInfo)
+	}
+	if explanation.CurrentNode == nil {
+		body["can_allocate"] = decisionName(explanation.CanAllocate)
+		switch explanation.CanAllocate {
+		case cluster.DecisionYes:
+			body["allocate_explanation"] = "can allocate the shard"
+		case cluster.DecisionThrottle:
+			body["allocate_explanation"] = "allocation temporarily throttled"
+		default:
+			body["allocate_explanation"] = "cannot allocate because allocation is not permitted to any of the nodes"
+		}
+	} else {
+		body["current_node"] = map[string]interface{}{
+			"id":                explanation.CurrentNode.Id,
+			"name":              explanation.CurrentNode.Name,
+			"transport_address": explanation.CurrentNode.HostAddress,
+			"weight_ranking":    explanation.CurrentWeightRanking,
+		}
+		body["can_remain_on_current_node"] = decisionName(explanation.CanRemain)
+		if explanation.CanRemain != cluster.DecisionYes {
+			body["can_remain_decisions"] = deciderResultsBody(explanation.CanRemainResults, includeYesDecisions)
+			body["can_move_to_other_node"] = decisionName(explanation.CanAllocate)
+			body["move_explanation"] = "cannot move the shard to another node because allocation is not permitted to any of the other nodes"
+			if explanation.CanAllocate == cluster.DecisionYes {
+				body["move_explanation"] = "shard cannot remain on this node and is force-moved to another node"
+			}
+		}
+		body["can_rebalance_cluster"] = decisionName(explanation.CanRebalanceCluster)
+		body["can_rebalance_to_other_node"] = decisionName(explanation.CanRebalanceToOtherNode)
+		switch {
+		case explanation.CanRebalanceCluster != cluster.DecisionYes:
+			body["rebalance_explanation"] = "rebalancing is not allowed for this shard, cluster setting [" + cluster.RebalanceEnableSetting + "]"
+		case explanation.CanRebalanceToOtherNode == cluster.DecisionYes:
+			body["rebalance_explanation"] = "can rebalance the shard to a node that improves the cluster balance"
+		default:
+			body["rebalance_explanation"] = "cannot rebalance as no target node exists that can both allocate this shard and improve the cluster balance"
+		}
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       body,
+	})
+}
@@ -0,0 +1,429 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/errors"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	ShardBulkAction = "indices:data/write/bulk[s]"
+)
+
+type bulkItemRequest struct {
+	OpType          string
+	Index           string
+	Id              string
+	Routing         string
+	Source          []byte
+	IfVersion       int64
+	RetryOnConflict int
+}
+
+type shardBulkRequest struct {
+	ShardId state.ShardId
+	Items   []bulkItemRequest
+	Refresh string
+}
+
+func (r *shardBulkRequest) WriteTo(out *common.StreamOutput) {
+	r.ShardId.WriteTo(out)
+	out.WriteVInt(uint64(len(r.Items)))
+	for _, item := range r.Items {
+		out.WriteString(item.OpType)
+		out.WriteString(item.Index)
+		out.WriteString(item.Id)
+		out.WriteString(item.Routing)
+		out.WriteBytes(item.Source)
+		out.WriteInt64(item.IfVersion)
+		out.WriteInt(item.RetryOnConflict)
+	}
+	out.WriteString(r.Refresh)
+}
+
+func readShardBulkRequest(in *common.StreamInput) (*shardBulkRequest, error) {
+	req := shardBulkRequest{ShardId: state.ReadShardId(in)}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.Items = append(req.Items, bulkItemRequest{
+			OpType:          in.ReadString(),
+			Index:           in.ReadString(),
+			Id:              in.ReadString(),
+			Routing:         in.ReadString(),
+			Source:          in.ReadBytes(),
+			IfVersion:       in.ReadInt64(),
+			RetryOnConflict: in.ReadInt(),
+		})
+	}
+	req.Refresh = in.ReadString()
+	return &req, in.Err()
+}
+
+type bulkItemResponse struct {
+	OpType  string
+	Id      string
+	Version int64
+	SeqNo   int64
+	Result  string
+	Err     string
+}
+
+type shardBulkResponse struct {
+	Items         []bulkItemResponse
+	ForcedRefresh bool
+}
+
+func (r *shardBulkResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(uint64(len(r.Items)))
+	for _, item := range r.Items {
+		out.WriteString(item.OpType)
+		out.WriteString(item.Id)
+		out.WriteInt64(item.Version)
+		out.WriteInt64(item.SeqNo)
+		out.WriteString(item.Result)
+		out.WriteString(item.Err)
+	}
+	out.WriteBool(r.ForcedRefresh)
+}
+
+func readShardBulkResponse(in *common.StreamInput) (*shardBulkResponse, error) {
+	var res shardBulkResponse
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.Items = append(res.Items, bulkItemResponse{
+			OpType:  in.ReadString(),
+			Id:      in.ReadString(),
+			Version: in.ReadInt64(),
+			SeqNo:   in.ReadInt64(),
+			Result:  in.ReadString(),
+			Err:     in.ReadString(),
+		})
+	}
+	res.ForcedRefresh = in.ReadBool()
+	return &res, in.Err()
+}
+
+// RegisterShardBulkAction handles the writes of several documents of a single shard, for the bulk, update,
+// by-query and reindex requests. Each item is applied on its own, so a failing item does not fail the others.
+func RegisterShardBulkAction(indicesService *indices.Service, transportService *transport.Service) {
+	transportService.RegisterRequestHandler(ShardBulkAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readShardBulkRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		indexService, _ := indicesService.IndexService(request.ShardId.Index.Uuid)
+		indexShard, _ := indexService.Shard(request.ShardId.ShardId)
+
+		res := shardBulkResponse{
+			Items: make([]bulkItemResponse, len(request.Items)),
+		}
+		for i, item := range request.Items {
+			itemResponse := bulkItemResponse{
+				OpType: item.OpType,
+				Id:     item.Id,
+			}
+			switch item.OpType {
+			case "delete":
+				result, err := indexShard.Delete(item.Id, expectedVersion("", item.IfVersion))
+				itemResponse.Version, itemResponse.SeqNo, itemResponse.Result = result.Version, result.SeqNo, result.Result
+				if err != nil {
+					itemResponse.Err = err.Error()
+				}
+			case "update":
+				itemResponse = applyUpdate(indexShard, item)
+			default:
+				var body map[string]interface{}
+				if err := json.Unmarshal(item.Source, &body); err != nil {
+					itemResponse.Err = err.Error()
+					break
+				}
+				result, err := indexShard.Index(item.Id, item.Routing, body, expectedVersion(item.OpType, item.IfVersion))
+				itemResponse.Version, itemResponse.SeqNo, itemResponse.Result = result.Version, result.SeqNo, result.Result
+				if err != nil {
+					itemResponse.Err = err.Error()
+				}
+			}
+			res.Items[i] = itemResponse
+		}
+
+		maxSeqNo := int64(-1)
+		for _, item := range res.Items {
+			if item.SeqNo > maxSeqNo {
+				maxSeqNo = item.SeqNo
+			}
+		}
+		forcedRefresh, err := applyRefreshPolicy(indexShard, request.Refresh, maxSeqNo)
+		if err != nil {
+			logrus.Warn(err)
+		}
+		res.ForcedRefresh = forcedRefresh
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+}
+
+// bulkItemFailure describes the error of a failed item as its status, error type and reason.
+func bulkItemFailure(item bulkItemResponse) (int, string, string) {
+	switch item.Err {
+	case errors.ErrVersionConflict.Error():
+		return 409, "version_conflict_engine_exception", "[" + item.Id + "]: version conflict, current version [" + fmt.Sprint(item.Version) + "]"
+	case errors.ErrNotFound.Error():
+		return 404, "document_missing_exception", "[_doc][" + item.Id + "]: document missing"
+	}
+	return 400, "mapper_parsing_exception", item.Err
+}
+
+type RestBulk struct {
+	clusterService              *cluster.Service
+	createIndexService          *cluster.MetadataCreateIndexService
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
+}
+
+func NewRestBulk(clusterService *cluster.Service, createIndexService *cluster.MetadataCreateIndexService, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestBulk {
+	return &RestBulk{
+		clusterService:              clusterService,
+		createIndexService:          createIndexService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
+	}
+}
+
+// parseBulkBody reads the newline delimited action and source lines of a bulk request.
+// Items take the index and routing of the request path and parameters unless their action line sets them.
+func parseBulkBody(body []byte, defaultIndex string, defaultRouting string) ([]bulkItemRequest, error) {
+	var items []bulkItemRequest
+	lines := bytes.Split(body, []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, fmt.Errorf("Malformed action/metadata line [%d], expected a single action object", i+1)
+		}
+		for opType, meta := range action {
+			item := bulkItemRequest{
+				OpType:  opType,
+				Index:   defaultIndex,
+				Routing: defaultRouting,
+			}
+			if v, ok := meta["_index"].(string); ok {
+				item.Index = v
+			}
+			if v, ok := meta["_id"].(string); ok {
+				item.Id = v
+			}
+			if v, ok := meta["routing"].(string); ok {
+				item.Routing = v
+			}
+			if v, ok := meta["retry_on_conflict"].(float64); ok {
+				item.RetryOnConflict = int(v)
+			}
+			if v, ok := meta["if_version"].(float64); ok {
+				item.IfVersion = int64(v)
+			}
+			if item.Index == "" {
+				return nil, fmt.Errorf("Validation Failed: 1: index is missing for line [%d];", i+1)
+			}
+
+			switch opType {
+			case "index", "create", "update":
+				if i+1 >= len(lines) || len(bytes.TrimSpace(lines[i+1])) == 0 {
+					return nil, fmt.Errorf("Validation Failed: 1: source is missing for line [%d];", i+1)
+				}
+				i++
+				item.Source = bytes.TrimSpace(lines[i])
+			case "delete":
+			default:
+				return nil, fmt.Errorf("Malformed action/metadata line [%d], expected one of [create, delete, index, update] but found [%s]", i+1, opType)
+			}
+
+			if item.Id == "" {
+				if opType == "update" || opType == "delete" {
+					return nil, fmt.Errorf("Validation Failed: 1: id is missing for line [%d];", i+1)
+				}
+				item.Id = common.RandomBase64()
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (h *RestBulk) Handle(r *RestRequest, reply ResponseListener) {
+	start := time.Now()
+	items, err := parseBulkBody(r.Body, r.PathParams["index"], r.Param("routing"))
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	refresh, err := refreshPolicy(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	// resolve the indices, creating the missing ones documents are indexed into
+	clusterState := h.clusterService.State()
+	indexNames := map[string]string{}
+	for _, item := range items {
+		if indexName, resolved := indexNames[item.Index]; resolved && indexName != "" {
+			continue
+		}
+		indexName := h.indexNameExpressionResolver.ConcreteSingleIndex(*clusterState, item.Index).Name
+		if indexName == "" && (item.OpType == "index" || item.OpType == "create") {
+			req := cluster.CreateIndexClusterStateUpdateRequest{
+				Index:    item.Index,
+				Mappings: []byte(`{ "properties": {} }`),
+				Settings: map[string]interface{}{
+					"number_of_shards": 1.0,
+				},
+			}
+			h.createIndexService.CreateIndex(req)
+			indexName = item.Index
+			clusterState = h.clusterService.State()
+		}
+		indexNames[item.Index] = indexName
+	}
+
+	responses := make([]map[string]interface{}, len(items))
+	failed := false
+	bulkRequests := map[state.ShardId]*shardBulkRequest{}
+	positions := map[state.ShardId][]int{}
+	for i, item := range items {
+		indexName := indexNames[item.Index]
+		if indexName == "" {
+			responses[i] = bulkFailureResponse(item.Index, item.Id, 404, "index_not_found_exception", "no such index ["+item.Index+"]")
+			failed = true
+			continue
+		}
+		if routingMissing(clusterState, indexName, item.Routing) {
+			responses[i] = bulkFailureResponse(indexName, item.Id, 400, "routing_missing_exception", "routing is required for ["+indexName+"]/[_doc]/["+item.Id+"]")
+			failed = true
+			continue
+		}
+		if indexWriteBlocked(clusterState, indexName) {
+			responses[i] = bulkFailureResponse(indexName, item.Id, 429, "cluster_block_exception", indexWriteBlockedReason(indexName))
+			failed = true
+			continue
+		}
+		item.Index = indexName
+		shardId := cluster.IndexShard(*clusterState, indexName, item.Id, item.Routing).Primary.ShardId
+		if _, existing := bulkRequests[shardId]; !existing {
+			bulkRequests[shardId] = &shardBulkRequest{ShardId: shardId, Refresh: refresh}
+		}
+		bulkRequests[shardId].Items = append(bulkRequests[shardId].Items, item)
+		positions[shardId] = append(positions[shardId], i)
+	}
+
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(bulkRequests))
+	for shardId, bulkRequest := range bulkRequests {
+		shardId, bulkRequest := shardId, bulkRequest
+		shardRouting := clusterState.RoutingTable.IndicesRouting[shardId.Index.Name].Shards[shardId.ShardId].Primary
+		onFailure := func(err error) {
+			mux.Lock()
+			defer mux.Unlock()
+			for k, item := range bulkRequest.Items {
+				responses[positions[shardId][k]] = bulkFailureResponse(item.Index, item.Id, 500, transport.ErrorType(err), err.Error())
+			}
+			failed = true
+		}
+		node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, ShardBulkAction, common.ToBytes(bulkRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readShardBulkResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				mux.Lock()
+				defer mux.Unlock()
+				for k, itemResponse := range res.Items {
+					item := bulkRequest.Items[k]
+					if itemResponse.Err != "" {
+						status, errorType, reason := bulkItemFailure(itemResponse)
+						responses[positions[shardId][k]] = bulkFailureResponse(item.Index, item.Id, status, errorType, reason)
+						failed = true
+						continue
+					}
+					responses[positions[shardId][k]] = withForcedRefresh(bulkSuccessResponse(item, itemResponse), res.ForcedRefresh)
+				}
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
+		})
+	}
+	wg.Wait()
+
+	responseItems := make([]interface{}, len(responses))
+	for i, response := range responses {
+		responseItems[i] = map[string]interface{}{
+			items[i].OpType: response,
+		}
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"took":   time.Since(start).Milliseconds(),
+			"errors": failed,
+			"items":  responseItems,
+		},
+	})
+}
+
+func bulkSuccessResponse(item bulkItemRequest, res bulkItemResponse) map[string]interface{} {
+	status := 200
+	switch res.Result {
+	case "created":
+		status = 201
+	case "not_found":
+		status = 404
+	}
+	return withRouting(map[string]interface{}{
+		"_index":   item.Index,
+		"_type":    "_doc",
+		"_id":      item.Id,
+		"_version": res.Version,
+		"result":   res.Result,
+		"_shards": map[string]interface{}{
+			"total":      1,
+			"successful": 1,
+			"failed":     0,
+		},
+		"_seq_no":       res.SeqNo,
+		"_primary_term": 1,
+		"status":        status,
+	}, item.Routing)
+}
+
+func bulkFailureResponse(indexName string, id string, status int, errorType string, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"_index": indexName,
+		"_type":  "_doc",
+		"_id":    id,
+		"status": status,
+		"error": map[string]interface{}{
+			"type":   errorType,
+			"reason": reason,
+			"index":  indexName,
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package actions
+
+import (
+	"github.com/actumn/searchgoose/errors"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseBulkBody(t *testing.T) {
+	// Arrange
+	body := []byte(`{ "index": { "_id": "1", "routing": "user1" } }
+{ "field": "value" }
+{ "delete": { "_index": "other", "_id": "2" } }
+{ "update": { "_id": "3", "retry_on_conflict": 2 } }
+{ "doc": { "field": "value" } }
+{ "create": {} }
+{ "field": "value" }
+`)
+
+	// Action
+	items, err := parseBulkBody(body, "test", "")
+	_, missingIdErr := parseBulkBody([]byte(`{ "delete": { "_index": "test" } }`), "", "")
+	_, missingSourceErr := parseBulkBody([]byte(`{ "index": { "_index": "test" } }`), "", "")
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(items))
+	assert.Equal(t, "user1", items[0].Routing)
+	assert.Equal(t, `{ "field": "value" }`, string(items[0].Source))
+	assert.Equal(t, "other", items[1].Index)
+	assert.Nil(t, items[1].Source)
+	assert.Equal(t, 2, items[2].RetryOnConflict)
+	assert.Equal(t, "create", items[3].OpType)
+	assert.NotEqual(t, "", items[3].Id)
+	assert.NotNil(t, missingIdErr)
+	assert.NotNil(t, missingSourceErr)
+}
+
+func TestApplyUpdate(t *testing.T) {
+	// Arrange
+	path, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	s := index.NewShard(state.ShardRouting{Primary: true}, path, mapping.NewIndexMapping())
+	s.Index("1", "", map[string]interface{}{"likes": 1.0, "user": map[string]interface{}{"name": "kim"}}, index.VersionMatchAny)
+
+	// Action
+	updated := applyUpdate(s, bulkItemRequest{OpType: "update", Id: "1", Source: []byte(`{ "doc": { "user": { "age": 20 } } }`)})
+	noop := applyUpdate(s, bulkItemRequest{OpType: "update", Id: "1", Source: []byte(`{ "doc": { "likes": 1 } }`)})
+	scripted := applyUpdate(s, bulkItemRequest{OpType: "update", Id: "1", Source: []byte(`{ "script": "ctx._source.likes += 1" }`)})
+	missing := applyUpdate(s, bulkItemRequest{OpType: "update", Id: "2", Source: []byte(`{ "doc": { "likes": 1 } }`)})
+	upserted := applyUpdate(s, bulkItemRequest{OpType: "update", Id: "3", Source: []byte(`{ "doc": { "likes": 1 }, "doc_as_upsert": true }`)})
+
+	// Assert
+	assert.Equal(t, "", updated.Err)
+	assert.Equal(t, "updated", updated.Result)
+	assert.Equal(t, int64(2), updated.Version)
+	assert.Equal(t, "noop", noop.Result)
+	assert.Equal(t, int64(2), noop.Version)
+	assert.Equal(t, "updated", scripted.Result)
+	assert.Equal(t, errors.ErrNotFound.Error(), missing.Err)
+	assert.Equal(t, "created", upserted.Result)
+	doc, _ := s.Get("1")
+	assert.Equal(t, 2.0, doc["likes"])
+	assert.Equal(t, "kim", doc["user.name"])
+	assert.Equal(t, 20.0, doc["user.age"])
+}
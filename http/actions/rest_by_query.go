@@ -0,0 +1,763 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/errors"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/script"
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/actumn/searchgoose/tasks"
+	"github.com/nqd/flat"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ShardScrollAction   = "indices:data/read/scroll[s]"
+	DeleteByQueryAction = "indices:data/write/delete/byquery"
+	UpdateByQueryAction = "indices:data/write/update/byquery"
+
+	defaultScrollSize = 1000
+)
+
+type shardScrollRequest struct {
+	ShardId state.ShardId
+	Query   map[string]interface{}
+	Size    int
+	After   string
+	Slice   int
+	Slices  int
+}
+
+func (r *shardScrollRequest) WriteTo(out *common.StreamOutput) {
+	r.ShardId.WriteTo(out)
+	out.WriteMap(r.Query)
+	out.WriteInt(r.Size)
+	out.WriteString(r.After)
+	out.WriteInt(r.Slice)
+	out.WriteInt(r.Slices)
+}
+
+func readShardScrollRequest(in *common.StreamInput) (*shardScrollRequest, error) {
+	req := shardScrollRequest{
+		ShardId: state.ReadShardId(in),
+		Query:   in.ReadMap(),
+		Size:    in.ReadInt(),
+		After:   in.ReadString(),
+		Slice:   in.ReadInt(),
+		Slices:  in.ReadInt(),
+	}
+	return &req, in.Err()
+}
+
+type shardScrollResponse struct {
+	Hits  []index.ScrollHit
+	After string
+	Err   string
+}
+
+func (r *shardScrollResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(uint64(len(r.Hits)))
+	for _, hit := range r.Hits {
+		out.WriteString(hit.Id)
+		out.WriteString(hit.Routing)
+		out.WriteInt64(hit.Version)
+		out.WriteInt64(hit.SeqNo)
+		out.WriteMap(hit.Source)
+	}
+	out.WriteString(r.After)
+	out.WriteString(r.Err)
+}
+
+func readShardScrollResponse(in *common.StreamInput) (*shardScrollResponse, error) {
+	var res shardScrollResponse
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.Hits = append(res.Hits, index.ScrollHit{
+			Id:      in.ReadString(),
+			Routing: in.ReadString(),
+			Version: in.ReadInt64(),
+			SeqNo:   in.ReadInt64(),
+			Source:  in.ReadMap(),
+		})
+	}
+	res.After = in.ReadString()
+	res.Err = in.ReadString()
+	return &res, in.Err()
+}
+
+// RegisterShardScrollAction handles reading the next page of the documents of a shard matching a query, for the
+// by-query and reindex requests. A sliced request only reads the documents whose id hashes to its slice.
+func RegisterShardScrollAction(indicesService *indices.Service, transportService *transport.Service) {
+	transportService.RegisterRequestHandler(ShardScrollAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readShardScrollRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+
+		var res shardScrollResponse
+		var indexShard *index.Shard
+		indexService, existing := indicesService.IndexService(request.ShardId.Index.Uuid)
+		if existing {
+			indexShard, existing = indexService.Shard(request.ShardId.ShardId)
+		}
+		if !existing {
+			res.Err = fmt.Sprintf("no such shard [%s][%d]", request.ShardId.Index.Name, request.ShardId.ShardId)
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+			return
+		}
+		q, err := index.NewQuery(request.Query)
+		if err != nil {
+			res.Err = err.Error()
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+			return
+		}
+
+		var accept func(id string) bool
+		if request.Slices > 1 {
+			accept = func(id string) bool {
+				return common.MurMur3Hash(id)%request.Slices == request.Slice
+			}
+		}
+		hits, after, err := indexShard.Scroll(q, request.Size, request.After, accept)
+		if err != nil {
+			res.Err = err.Error()
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+			return
+		}
+		for i := range hits {
+			hits[i].Source, _ = flat.Unflatten(hits[i].Source, nil)
+		}
+		res.Hits = hits
+		res.After = after
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+}
+
+// bulkByScrollStatus is the progress of a by-query task, updated concurrently by its slices.
+type bulkByScrollStatus struct {
+	slices            int
+	requestsPerSecond float64
+	total             int64
+	updated           int64
+	created           int64
+	deleted           int64
+	batches           int64
+	versionConflicts  int64
+	noops             int64
+	throttledMillis   int64
+}
+
+func (s *bulkByScrollStatus) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"slices":            s.slices,
+		"total":             atomic.LoadInt64(&s.total),
+		"updated":           atomic.LoadInt64(&s.updated),
+		"created":           atomic.LoadInt64(&s.created),
+		"deleted":           atomic.LoadInt64(&s.deleted),
+		"batches":           atomic.LoadInt64(&s.batches),
+		"version_conflicts": atomic.LoadInt64(&s.versionConflicts),
+		"noops":             atomic.LoadInt64(&s.noops),
+		"retries": map[string]interface{}{
+			"bulk":   0,
+			"search": 0,
+		},
+		"throttled_millis":       atomic.LoadInt64(&s.throttledMillis),
+		"requests_per_second":    s.requestsPerSecond,
+		"throttled_until_millis": 0,
+	}
+}
+
+type bulkByScrollRequest struct {
+	indices            []string
+	remote             *remoteSource
+	query              map[string]interface{}
+	script             *script.Script
+	maxDocs            int64
+	proceedOnConflicts bool
+	scrollSize         int
+	slices             int
+	requestsPerSecond  float64
+	// authentication is the user of a request whose script may write a document to another index than the one
+	// it was authorized on, every write is then authorized on its own index
+	authentication *security.Authentication
+}
+
+func invalidParameter(name string, value string) error {
+	return fmt.Errorf("invalid value [%s] for parameter [%s]", value, name)
+}
+
+// bulkByScrollRequestFromRest reads the parameters shared by delete-by-query, update-by-query and reindex.
+func bulkByScrollRequestFromRest(r *RestRequest, body map[string]interface{}) (*bulkByScrollRequest, error) {
+	request := &bulkByScrollRequest{
+		maxDocs:           -1,
+		scrollSize:        defaultScrollSize,
+		slices:            1,
+		requestsPerSecond: -1,
+	}
+	if q, ok := body["query"].(map[string]interface{}); ok {
+		request.query = q
+	}
+
+	conflicts := r.Param("conflicts")
+	if c, ok := body["conflicts"].(string); ok && conflicts == "" {
+		conflicts = c
+	}
+	switch conflicts {
+	case "", "abort":
+	case "proceed":
+		request.proceedOnConflicts = true
+	default:
+		return nil, invalidParameter("conflicts", conflicts)
+	}
+
+	if v, ok := body["max_docs"].(float64); ok {
+		request.maxDocs = int64(v)
+	}
+	if maxDocs, err := r.ParamAsInt("max_docs", int(request.maxDocs)); err != nil {
+		return nil, invalidParameter("max_docs", r.Param("max_docs"))
+	} else {
+		request.maxDocs = int64(maxDocs)
+	}
+
+	scrollSize, err := r.ParamAsInt("scroll_size", defaultScrollSize)
+	if err != nil || scrollSize <= 0 {
+		return nil, invalidParameter("scroll_size", r.Param("scroll_size"))
+	}
+	request.setScrollSize(scrollSize)
+
+	// "auto" is resolved once the indices are known.
+	if slices := r.Param("slices"); slices == "auto" {
+		request.slices = 0
+	} else if request.slices, err = r.ParamAsInt("slices", 1); err != nil || request.slices < 1 {
+		return nil, invalidParameter("slices", slices)
+	}
+
+	// -1 disables throttling.
+	if rps := r.Param("requests_per_second"); rps != "" {
+		if request.requestsPerSecond, err = strconv.ParseFloat(rps, 64); err != nil || (request.requestsPerSecond <= 0 && request.requestsPerSecond != -1) {
+			return nil, invalidParameter("requests_per_second", rps)
+		}
+	}
+
+	if request.script, err = script.FromBody(body["script"]); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// setScrollSize sets the batch size, which never needs to exceed max_docs.
+func (r *bulkByScrollRequest) setScrollSize(scrollSize int) {
+	r.scrollSize = scrollSize
+	if r.maxDocs > 0 && r.maxDocs < int64(r.scrollSize) {
+		r.scrollSize = int(r.maxDocs)
+	}
+}
+
+// bulkByScrollPrepare turns a matched document into the write to apply, or returns false for a noop.
+type bulkByScrollPrepare func(indexName string, hit index.ScrollHit) (bulkItemRequest, bool, error)
+
+// scrollSource reads the documents to process page by page, handing each page to consume until it returns false.
+type scrollSource interface {
+	scroll(slice int, stopped func() bool, consume func(indexName string, hits []index.ScrollHit) bool) error
+}
+
+// localScrollSource reads the shards of local indices, each slice reading the documents whose id hashes to it.
+type localScrollSource struct {
+	executor     *bulkByScrollExecutor
+	clusterState *state.ClusterState
+	request      *bulkByScrollRequest
+}
+
+func (s *localScrollSource) scroll(slice int, stopped func() bool, consume func(indexName string, hits []index.ScrollHit) bool) error {
+	for _, indexName := range s.request.indices {
+		for _, indexShardRoutingTable := range s.clusterState.RoutingTable.IndicesRouting[indexName].Shards {
+			shardRouting := indexShardRoutingTable.Primary
+			node := s.clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+			after := ""
+			for !stopped() {
+				scrollRequest := shardScrollRequest{
+					ShardId: shardRouting.ShardId,
+					Query:   s.request.query,
+					Size:    s.request.scrollSize,
+					After:   after,
+					Slice:   slice,
+					Slices:  s.request.slices,
+				}
+				response, err := s.executor.sendRequest(node, ShardScrollAction, &scrollRequest)
+				if err != nil {
+					return err
+				}
+				res, err := readShardScrollResponse(response)
+				if err != nil {
+					return err
+				}
+				if res.Err != "" {
+					return fmt.Errorf("%s", res.Err)
+				}
+				if len(res.Hits) == 0 {
+					break
+				}
+				after = res.After
+
+				if !consume(indexName, res.Hits) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bulkByScrollExecutor scrolls the documents of a source and writes back each batch to the shards of the
+// destination, with a version check when documents are rewritten in place so that concurrent modifications
+// show up as conflicts.
+type bulkByScrollExecutor struct {
+	clusterService   *cluster.Service
+	transportService *transport.Service
+}
+
+func newBulkByScrollExecutor(clusterService *cluster.Service, transportService *transport.Service) *bulkByScrollExecutor {
+	return &bulkByScrollExecutor{
+		clusterService:   clusterService,
+		transportService: transportService,
+	}
+}
+
+type bulkByScrollWorker struct {
+	executor     *bulkByScrollExecutor
+	clusterState *state.ClusterState
+	task         *tasks.Task
+	request      *bulkByScrollRequest
+	status       *bulkByScrollStatus
+	prepare      bulkByScrollPrepare
+
+	docs     int64
+	aborted  int32
+	mux      sync.Mutex
+	failures []map[string]interface{}
+}
+
+func (e *bulkByScrollExecutor) execute(task *tasks.Task, request *bulkByScrollRequest, prepare bulkByScrollPrepare) map[string]interface{} {
+	start := time.Now()
+	clusterState := e.clusterService.State()
+
+	if request.slices == 0 {
+		request.slices = 1
+		for _, indexName := range request.indices {
+			if shards := clusterState.Metadata.Indices[indexName].NumberOfShards; shards > request.slices {
+				request.slices = shards
+			}
+		}
+	}
+
+	var source scrollSource = &localScrollSource{
+		executor:     e,
+		clusterState: clusterState,
+		request:      request,
+	}
+	if request.remote != nil {
+		source = request.remote
+	}
+
+	w := &bulkByScrollWorker{
+		executor:     e,
+		clusterState: clusterState,
+		task:         task,
+		request:      request,
+		status: &bulkByScrollStatus{
+			slices:            request.slices,
+			requestsPerSecond: request.requestsPerSecond,
+		},
+		prepare:  prepare,
+		failures: []map[string]interface{}{},
+	}
+	task.SetStatus(w.status.toMap)
+
+	wg := sync.WaitGroup{}
+	wg.Add(request.slices)
+	for slice := 0; slice < request.slices; slice++ {
+		go func(slice int) {
+			defer wg.Done()
+			if err := source.scroll(slice, w.stopped, w.processBatch); err != nil {
+				w.fail("", "", "search_phase_execution_exception", err.Error(), 400)
+			}
+		}(slice)
+	}
+	wg.Wait()
+
+	response := w.status.toMap()
+	delete(response, "slices")
+	response["took"] = time.Since(start).Milliseconds()
+	response["timed_out"] = false
+	response["failures"] = w.failures
+	if task.IsCancelled() {
+		response["canceled"] = task.CancelReason()
+	}
+	return response
+}
+
+func (w *bulkByScrollWorker) stopped() bool {
+	return w.task.IsCancelled() || atomic.LoadInt32(&w.aborted) == 1
+}
+
+// processBatch writes a page of documents and reports whether the slice should go on.
+func (w *bulkByScrollWorker) processBatch(indexName string, hits []index.ScrollHit) bool {
+	start := time.Now()
+
+	bulkRequests := map[state.ShardId]*shardBulkRequest{}
+	var shardIds []state.ShardId
+	docs := 0
+	for _, hit := range hits {
+		if w.request.maxDocs >= 0 && atomic.AddInt64(&w.docs, 1) > w.request.maxDocs {
+			break
+		}
+		atomic.AddInt64(&w.status.total, 1)
+		docs++
+
+		item, ok, err := w.prepare(indexName, hit)
+		if err != nil {
+			w.fail(indexName, hit.Id, "script_exception", err.Error(), 400)
+			return false
+		}
+		if !ok {
+			atomic.AddInt64(&w.status.noops, 1)
+			continue
+		}
+		if err := w.authorize(item); err != nil {
+			w.fail(item.Index, item.Id, "security_exception", err.Error(), 403)
+			return false
+		}
+
+		shardId := cluster.IndexShard(*w.clusterState, item.Index, item.Id, item.Routing).Primary.ShardId
+		bulkRequest, existing := bulkRequests[shardId]
+		if !existing {
+			bulkRequest = &shardBulkRequest{ShardId: shardId}
+			bulkRequests[shardId] = bulkRequest
+			shardIds = append(shardIds, shardId)
+		}
+		bulkRequest.Items = append(bulkRequest.Items, item)
+	}
+
+	if len(shardIds) > 0 {
+		atomic.AddInt64(&w.status.batches, 1)
+	}
+	for _, shardId := range shardIds {
+		if indexWriteBlocked(w.clusterState, shardId.Index.Name) {
+			w.fail(shardId.Index.Name, bulkRequests[shardId].Items[0].Id, "cluster_block_exception", indexWriteBlockedReason(shardId.Index.Name), 429)
+			return false
+		}
+		shardRouting := w.clusterState.RoutingTable.IndicesRouting[shardId.Index.Name].Shards[shardId.ShardId].Primary
+		node := w.clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+		response, err := w.executor.sendRequest(node, ShardBulkAction, bulkRequests[shardId])
+		var res *shardBulkResponse
+		if err == nil {
+			res, err = readShardBulkResponse(response)
+		}
+		if err != nil {
+			for _, item := range bulkRequests[shardId].Items {
+				w.fail(shardId.Index.Name, item.Id, transport.ErrorType(err), err.Error(), 500)
+			}
+			return false
+		}
+		for _, item := range res.Items {
+			switch {
+			case item.Err == errors.ErrVersionConflict.Error():
+				atomic.AddInt64(&w.status.versionConflicts, 1)
+				if !w.request.proceedOnConflicts {
+					w.fail(shardId.Index.Name, item.Id, "version_conflict_engine_exception", "["+item.Id+"]: version conflict, current version ["+strconv.FormatInt(item.Version, 10)+"]", 409)
+				}
+			case item.Err != "":
+				w.fail(shardId.Index.Name, item.Id, "exception", item.Err, 500)
+			case item.Result == "deleted":
+				atomic.AddInt64(&w.status.deleted, 1)
+			case item.Result == "created":
+				atomic.AddInt64(&w.status.created, 1)
+			case item.Result == "updated":
+				atomic.AddInt64(&w.status.updated, 1)
+			}
+		}
+	}
+
+	if w.request.maxDocs >= 0 && atomic.LoadInt64(&w.docs) >= w.request.maxDocs {
+		return false
+	}
+	w.throttle(start, docs)
+	return !w.stopped()
+}
+
+// authorize checks that the user of the request is granted the write of an item on its index.
+func (w *bulkByScrollWorker) authorize(item bulkItemRequest) error {
+	if w.request.authentication == nil {
+		return nil
+	}
+	action := IndexAction
+	if item.OpType == "delete" {
+		action = DeleteAction
+	}
+	return security.Authorize(w.request.authentication, []security.ActionRequest{security.IndexAction(action, item.Index)}, w.clusterState.Metadata)
+}
+
+// throttle delays the next batch of the slice so that it does not process more than its share of
+// requests_per_second. The delay is cut short when the task is stopped.
+func (w *bulkByScrollWorker) throttle(batchStart time.Time, docs int) {
+	if w.request.requestsPerSecond <= 0 || docs == 0 {
+		return
+	}
+	perSlice := w.request.requestsPerSecond / float64(w.request.slices)
+	wait := time.Duration(float64(docs)/perSlice*float64(time.Second)) - time.Since(batchStart)
+	if wait <= 0 {
+		return
+	}
+
+	start := time.Now()
+	for deadline := start.Add(wait); time.Now().Before(deadline) && !w.stopped(); {
+		if remaining := time.Until(deadline); remaining < 100*time.Millisecond {
+			time.Sleep(remaining)
+		} else {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	atomic.AddInt64(&w.status.throttledMillis, time.Since(start).Milliseconds())
+}
+
+func (w *bulkByScrollWorker) fail(indexName string, id string, errorType string, reason string, status int) {
+	atomic.StoreInt32(&w.aborted, 1)
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.failures = append(w.failures, map[string]interface{}{
+		"index": indexName,
+		"type":  "_doc",
+		"id":    id,
+		"cause": map[string]interface{}{
+			"type":   errorType,
+			"reason": reason,
+		},
+		"status": status,
+	})
+}
+
+// sendRequest sends a request to a node and waits for its response or its failure. The response is read with the
+// version the request was written with.
+func (e *bulkByScrollExecutor) sendRequest(node state.Node, action string, req common.Writeable) (*common.StreamInput, error) {
+	version := e.transportService.GetVersion(node)
+	responses := make(chan *common.StreamInput, 1)
+	failures := make(chan error, 1)
+	e.transportService.SendRequestWithHandler(node, action, common.ToBytes(req, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			responses <- common.NewStreamInput(response, version)
+		},
+		OnFailure: func(err error) {
+			failures <- err
+		},
+	})
+	select {
+	case response := <-responses:
+		return response, nil
+	case err := <-failures:
+		return nil, err
+	}
+}
+
+// bulkByScrollStatusCode is the status of the reply, the highest status among the failures.
+func bulkByScrollStatusCode(response map[string]interface{}) int {
+	statusCode := 200
+	for _, failure := range response["failures"].([]map[string]interface{}) {
+		if status := failure["status"].(int); status > statusCode {
+			statusCode = status
+		}
+	}
+	return statusCode
+}
+
+// runBulkByScroll executes the request as a task. Unless wait_for_completion is false, the reply waits for the
+// task to complete; otherwise it is the task id, and the response is kept for the get task API.
+func runBulkByScroll(r *RestRequest, reply ResponseListener, taskManager *tasks.Manager, executor *bulkByScrollExecutor, action string, description string, request *bulkByScrollRequest, prepare bulkByScrollPrepare) {
+	task := taskManager.Register("transport", action, description, true)
+
+	if r.ParamAsBool("wait_for_completion", true) {
+		response := executor.execute(task, request, prepare)
+		taskManager.Unregister(task)
+		reply(RestResponse{
+			StatusCode: bulkByScrollStatusCode(response),
+			Body:       response,
+		})
+		return
+	}
+
+	go func() {
+		response := executor.execute(task, request, prepare)
+		taskManager.StoreResult(task, response, nil)
+	}()
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"task": task.TaskId(),
+		},
+	})
+}
+
+func parseBulkByScrollBody(r *RestRequest) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	if len(r.Body) == 0 {
+		return body, nil
+	}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+type RestDeleteByQuery struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	taskManager                 *tasks.Manager
+	executor                    *bulkByScrollExecutor
+}
+
+func NewRestDeleteByQuery(clusterService *cluster.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service, taskManager *tasks.Manager) *RestDeleteByQuery {
+	return &RestDeleteByQuery{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		taskManager:                 taskManager,
+		executor:                    newBulkByScrollExecutor(clusterService, transportService),
+	}
+}
+
+func (h *RestDeleteByQuery) Handle(r *RestRequest, reply ResponseListener) {
+	indexExpression := r.PathParams["index"]
+	body, err := parseBulkByScrollBody(r)
+	if err != nil {
+		reply(newErrorResponse(400, "parse_exception", err.Error()))
+		return
+	}
+	if _, ok := body["query"]; !ok {
+		reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: query is missing;"))
+		return
+	}
+	request, err := bulkByScrollRequestFromRest(r, body)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	clusterState := h.clusterService.State()
+	request.indices = h.indexNameExpressionResolver.ConcreteIndexNames(*clusterState, indexExpression)
+	if len(request.indices) == 0 {
+		reply(newErrorResponse(404, "index_not_found_exception", "no such index ["+indexExpression+"]"))
+		return
+	}
+
+	runBulkByScroll(r, reply, h.taskManager, h.executor, DeleteByQueryAction, "delete-by-query ["+indexExpression+"]", request, func(indexName string, hit index.ScrollHit) (bulkItemRequest, bool, error) {
+		return bulkItemRequest{
+			OpType:    "delete",
+			Index:     indexName,
+			Id:        hit.Id,
+			Routing:   hit.Routing,
+			IfVersion: hit.Version,
+		}, true, nil
+	})
+}
+
+type RestUpdateByQuery struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	taskManager                 *tasks.Manager
+	executor                    *bulkByScrollExecutor
+}
+
+func NewRestUpdateByQuery(clusterService *cluster.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service, taskManager *tasks.Manager) *RestUpdateByQuery {
+	return &RestUpdateByQuery{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		taskManager:                 taskManager,
+		executor:                    newBulkByScrollExecutor(clusterService, transportService),
+	}
+}
+
+func (h *RestUpdateByQuery) Handle(r *RestRequest, reply ResponseListener) {
+	indexExpression := r.PathParams["index"]
+	body, err := parseBulkByScrollBody(r)
+	if err != nil {
+		reply(newErrorResponse(400, "parse_exception", err.Error()))
+		return
+	}
+	request, err := bulkByScrollRequestFromRest(r, body)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	clusterState := h.clusterService.State()
+	request.indices = h.indexNameExpressionResolver.ConcreteIndexNames(*clusterState, indexExpression)
+	if len(request.indices) == 0 {
+		reply(newErrorResponse(404, "index_not_found_exception", "no such index ["+indexExpression+"]"))
+		return
+	}
+
+	runBulkByScroll(r, reply, h.taskManager, h.executor, UpdateByQueryAction, "update-by-query ["+indexExpression+"]", request, func(indexName string, hit index.ScrollHit) (bulkItemRequest, bool, error) {
+		item, ok, err := prepareScriptedWrite(request.script, indexName, hit)
+		if err == nil && ok && item.Index != indexName {
+			err = fmt.Errorf("%w: modifying [_index] not allowed", script.ErrInvalidScript)
+		} else if err == nil && ok && item.Id != hit.Id {
+			err = fmt.Errorf("%w: modifying [_id] not allowed", script.ErrInvalidScript)
+		}
+		return item, ok, err
+	})
+}
+
+// prepareScriptedWrite runs the script of the request against the document and returns the resulting write.
+// The script may change ctx.op to "delete" or "noop", and ctx._index or ctx._id to write another document.
+func prepareScriptedWrite(s *script.Script, indexName string, hit index.ScrollHit) (bulkItemRequest, bool, error) {
+	ctx := map[string]interface{}{
+		"_index":   indexName,
+		"_id":      hit.Id,
+		"_version": hit.Version,
+		"_routing": hit.Routing,
+		"_source":  hit.Source,
+		"op":       "index",
+	}
+	if s != nil {
+		if err := s.Execute(ctx); err != nil {
+			return bulkItemRequest{}, false, err
+		}
+	}
+
+	item := bulkItemRequest{
+		IfVersion: hit.Version,
+	}
+	var ok bool
+	if item.Index, ok = ctx["_index"].(string); !ok {
+		return bulkItemRequest{}, false, fmt.Errorf("%w: ctx._index must be a string", script.ErrInvalidScript)
+	}
+	if item.Id, ok = ctx["_id"].(string); !ok {
+		return bulkItemRequest{}, false, fmt.Errorf("%w: ctx._id must be a string", script.ErrInvalidScript)
+	}
+	item.Routing, _ = ctx["_routing"].(string)
+
+	switch ctx["op"] {
+	case "noop":
+		return bulkItemRequest{}, false, nil
+	case "delete":
+		item.OpType = "delete"
+		return item, true, nil
+	case "index":
+		source, err := json.Marshal(ctx["_source"])
+		if err != nil {
+			return bulkItemRequest{}, false, err
+		}
+		item.OpType = "index"
+		item.Source = source
+		return item, true, nil
+	}
+	return bulkItemRequest{}, false, fmt.Errorf("%w: operation type [%v] not allowed", script.ErrInvalidScript, ctx["op"])
+}
@@ -0,0 +1,109 @@
+package actions
+
+import (
+	"encoding/json"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/script"
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBulkByScrollRequestFromRest(t *testing.T) {
+	// Arrange
+	req := &RestRequest{
+		QueryParams: map[string][]byte{
+			"conflicts": []byte("proceed"),
+			"slices":    []byte("auto"),
+		},
+	}
+	body := map[string]interface{}{
+		"query":    map[string]interface{}{"match_all": map[string]interface{}{}},
+		"max_docs": 10.0,
+	}
+
+	// Action
+	request, err := bulkByScrollRequestFromRest(req, body)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.True(t, request.proceedOnConflicts)
+	assert.Equal(t, int64(10), request.maxDocs)
+	assert.Equal(t, 10, request.scrollSize)
+	assert.Equal(t, 0, request.slices)
+
+	_, err = bulkByScrollRequestFromRest(&RestRequest{
+		QueryParams: map[string][]byte{"conflicts": []byte("ignore")},
+	}, body)
+	assert.NotNil(t, err)
+}
+
+func TestPrepareScriptedWrite(t *testing.T) {
+	// Arrange
+	s, _ := script.New("ctx._source.likes += 1", nil)
+	hit := index.ScrollHit{
+		Id:      "1",
+		Version: 3,
+		Source:  map[string]interface{}{"likes": 1.0},
+	}
+	noop, _ := script.New("ctx.op = 'noop'", nil)
+
+	// Action
+	item, ok, err := prepareScriptedWrite(s, "test", hit)
+	_, noopOk, noopErr := prepareScriptedWrite(noop, "test", hit)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), item.IfVersion)
+	var source map[string]interface{}
+	_ = json.Unmarshal(item.Source, &source)
+	assert.Equal(t, 2.0, source["likes"])
+	assert.Nil(t, noopErr)
+	assert.False(t, noopOk)
+}
+
+func TestBulkByScrollWorker_authorize(t *testing.T) {
+	// Arrange
+	clusterState := &state.ClusterState{
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{"logs": {}, "logs-all": {}, "secrets": {}},
+			Security: state.SecurityMetadata{
+				Roles: map[string]state.Role{
+					"reindexer": {
+						Name: "reindexer",
+						Indices: []state.IndicesPrivileges{
+							{Names: []string{"logs"}, Privileges: []string{"read"}},
+							{Names: []string{"logs-all"}, Privileges: []string{"index"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	authentication := &security.Authentication{User: state.User{Username: "alice", Roles: []string{"reindexer"}}, Realm: security.NativeRealm}
+	s, _ := script.New("ctx._index = 'secrets'", nil)
+	w := &bulkByScrollWorker{
+		clusterState: clusterState,
+		request:      &bulkByScrollRequest{maxDocs: -1, authentication: authentication},
+		status:       &bulkByScrollStatus{},
+		prepare: func(indexName string, hit index.ScrollHit) (bulkItemRequest, bool, error) {
+			return prepareScriptedWrite(s, indexName, hit)
+		},
+		failures: []map[string]interface{}{},
+	}
+
+	// Action
+	destErr := w.authorize(bulkItemRequest{OpType: "index", Index: "logs-all", Id: "1"})
+	deleteErr := w.authorize(bulkItemRequest{OpType: "delete", Index: "logs-all", Id: "1"})
+	goOn := w.processBatch("logs", []index.ScrollHit{{Id: "1", Source: map[string]interface{}{"message": "a"}}})
+
+	// Assert
+	assert.NoError(t, destErr)
+	assert.Error(t, deleteErr)
+	assert.False(t, goOn)
+	assert.Equal(t, 1, len(w.failures))
+	assert.Equal(t, "secrets", w.failures[0]["index"])
+	assert.Equal(t, 403, bulkByScrollStatusCode(map[string]interface{}{"failures": w.failures}))
+}
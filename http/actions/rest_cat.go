@@ -8,6 +8,7 @@ import (
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
 	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
 	"strconv"
 	"sync"
 )
@@ -44,10 +45,22 @@ func (h *RestCatNodes) Handle(r *RestRequest, reply ResponseListener) {
 	for _, node := range nodes {
 		idx += 1
 		currIdx := idx
-		h.transportService.SendRequest(node, NodesStatsAction, []byte(""), func(response []byte) {
-			nodeStatsRes := nodeStatsResponseFromBytes(response)
-			responses[currIdx] = *nodeStatsRes
-			wg.Done()
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, NodesStatsAction, []byte(""), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				nodeStatsRes, err := readNodeStatsResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					logrus.Warn(err)
+					return
+				}
+				responses[currIdx] = *nodeStatsRes
+			},
+			OnFailure: func(err error) {
+				// the stats of the node are left out
+				logrus.Warn(err)
+				wg.Done()
+			},
 		})
 	}
 	wg.Wait()
@@ -59,28 +72,33 @@ func (h *RestCatNodes) Handle(r *RestRequest, reply ResponseListener) {
 
 	var nodesList []map[string]interface{}
 	for _, node := range clusterState.Nodes.Nodes {
-		nodeStats := nodeStatsMap[node.Id]
-		heapPer := nodeStats.Runtime.HeapAlloc * 100 / nodeStats.Runtime.HeapSys
+		var heapPercent, diskAvailable interface{}
+		if nodeStats, existing := nodeStatsMap[node.Id]; existing {
+			heapPercent = strconv.FormatUint(nodeStats.Runtime.HeapAlloc*100/nodeStats.Runtime.HeapSys, 10)
+			diskAvailable = common.IBytes(nodeStats.Fs.Available)
+		}
 		var m string
 		if node.Id == clusterState.Nodes.MasterNodeId {
 			m = "*"
-		} else {
+		} else if node.IsMasterNode() {
 			m = "m"
+		} else {
+			m = "-"
 		}
 		nodesList = append(nodesList, map[string]interface{}{
 			"id":   node.Id,
 			"m":    m, // master
 			"n":    node.Name,
-			"u":    "44m",    // uptime
-			"role": "dilmrt", // node role
+			"u":    "44m",                    // uptime
+			"role": node.RoleAbbreviations(), // node role
 			//"hc":         "156.8mb", // heap current
 			//"hm":         "512mb",   // heap max
-			"hp": strconv.FormatUint(heapPer, 10), // heap percent
+			"hp": heapPercent, // heap percent
 			"ip": node.HostAddress,
 			//"dt":         "468.4gb", // disk total
 			//"du":         "267.4gb", // disk used
-			"disk.avail": common.IBytes(nodeStats.Fs.Available), // disk available
-			"l":          "-1",                                  //
+			"disk.avail": diskAvailable, // disk available
+			"l":          "-1",          //
 		})
 	}
 	reply(RestResponse{
@@ -106,15 +124,16 @@ func NewRestCatIndices(clusterService *cluster.Service, indexNameExpressionResol
 func (h *RestCatIndices) Handle(r *RestRequest, reply ResponseListener) {
 	clusterState := h.clusterService.State()
 	var indicesList []map[string]interface{}
-	for _, indexMetadata := range clusterState.Metadata.Indices {
+	for indexName, indexMetadata := range clusterState.Metadata.Indices {
+		indexHealth := cluster.NewIndexHealth(indexMetadata, clusterState.RoutingTable.IndicesRouting[indexName])
 		// TODO :: resolve indices information from broadcasting
 		indicesList = append(indicesList, map[string]interface{}{
-			"health": "green",
+			"health": indexHealth.Status.String(),
 			"status": "open",
 			"index":  indexMetadata.Index.Name,
 			"uuid":   indexMetadata.Index.Uuid,
-			//"pri":            "1",
-			//"rep":            "0",
+			"pri":    strconv.Itoa(indexHealth.NumberOfShards),
+			"rep":    strconv.Itoa(indexHealth.NumberOfReplicas),
 			//"docs.count":     "100",
 			//"docs.deleted":   "0",
 			//"store.size":     "208b",
@@ -162,61 +181,84 @@ func (h *RestCatShards) Handle(r *RestRequest, reply ResponseListener) {
 	for _, indexName := range concreteIndices {
 		indexRoutingTable := clusterState.RoutingTable.IndicesRouting[indexName]
 		for _, indexShardRoutingTable := range indexRoutingTable.Shards {
-			shard := indexShardRoutingTable.Primary
-
-			nodeId := shard.CurrentNodeId
-			if shardList, existing := nodeIds[nodeId]; existing {
-				nodeIds[nodeId] = append(shardList, shard)
-			} else {
-				nodeIds[nodeId] = []state.ShardRouting{shard}
+			for _, shard := range indexShardRoutingTable.Copies() {
+				if shard.CurrentNodeId == "" {
+					continue
+				}
+				nodeIds[shard.CurrentNodeId] = append(nodeIds[shard.CurrentNodeId], shard)
 			}
 		}
 	}
 
-	responses := make([]indicesStatsResponse, len(nodeIds))
+	// the same shard has copies on several nodes
+	shardsStats := map[string]map[state.ShardId]index.ShardStats{}
+	mux := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(nodeIds))
-	idx := -1
 	for nodeId, shards := range nodeIds {
-		idx += 1
 		node := clusterState.Nodes.Nodes[nodeId]
 		indicesStatsReq := indicesStatsRequest{
 			NodeId: nodeId,
 			Shards: shards,
 		}
-		currIdx := idx
-		h.transportService.SendRequest(node, IndicesStatsAction, indicesStatsReq.toBytes(), func(response []byte) {
-			indicesStatsRes := indicesStatsResponseFromBytes(response)
-			responses[currIdx] = *indicesStatsRes
-			wg.Done()
+		currNodeId := nodeId
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, IndicesStatsAction, common.ToBytes(&indicesStatsReq, version), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				indicesStatsRes, err := readIndicesStatsResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					logrus.Warn(err)
+					return
+				}
+				nodeShardsStats := map[state.ShardId]index.ShardStats{}
+				for _, shardStats := range indicesStatsRes.ShardStats {
+					nodeShardsStats[shardStats.ShardRouting.ShardId] = shardStats
+				}
+				mux.Lock()
+				shardsStats[currNodeId] = nodeShardsStats
+				mux.Unlock()
+			},
+			OnFailure: func(err error) {
+				// the stats of the shards of the node are left out
+				logrus.Warn(err)
+				wg.Done()
+			},
 		})
 	}
 	wg.Wait()
 
-	shardsStats := map[state.ShardRouting]index.ShardStats{}
-	for _, response := range responses {
-		for _, shardStats := range response.ShardStats {
-			shardsStats[shardStats.ShardRouting] = shardStats
-		}
-	}
-
 	var shardsInfo []map[string]interface{}
 	for _, indexName := range concreteIndices {
 		indexRouting := clusterState.RoutingTable.IndicesRouting[indexName]
-		for _, shardRouting := range indexRouting.Shards {
-			storeSize, existing := shardsStats[shardRouting.Primary].UserData["num_bytes_used_disk"]
-			if !existing {
-				storeSize = uint64(0)
+		for _, shardRoutingTable := range indexRouting.Shards {
+			for _, shard := range shardRoutingTable.Copies() {
+				prirep := "r"
+				if shard.Primary {
+					prirep = "p"
+				}
+				shardInfo := map[string]interface{}{
+					"index":  shard.ShardId.Index.Name,
+					"shard":  shard.ShardId.ShardId,
+					"prirep": prirep,
+					"state":  string(shard.State),
+					"docs":   nil,
+					"store":  nil,
+					"node":   nil,
+				}
+				if shard.CurrentNodeId != "" {
+					shardInfo["node"] = clusterState.Nodes.Nodes[shard.CurrentNodeId].Name
+				}
+				if shardStats, existing := shardsStats[shard.CurrentNodeId][shard.ShardId]; existing {
+					storeSize, _ := shardStats.UserData["num_bytes_used_disk"].(uint64)
+					shardInfo["docs"] = shardStats.NumDocs
+					shardInfo["store"] = common.IBytes(storeSize)
+				}
+				if shard.State == state.ShardUnassigned {
+					shardInfo["unassigned.reason"] = string(shard.UnassignedInfo.Reason)
+				}
+				shardsInfo = append(shardsInfo, shardInfo)
 			}
-			shardsInfo = append(shardsInfo, map[string]interface{}{
-				"index":  shardRouting.ShardId.Index.Name,
-				"shard":  shardRouting.ShardId.ShardId,
-				"prirep": "p",
-				"state":  "STARTED",
-				"docs":   shardsStats[shardRouting.Primary].NumDocs,
-				"store":  common.IBytes(storeSize.(uint64)),
-				"node":   shardRouting.Primary.CurrentNodeId,
-			})
 		}
 	}
 
@@ -1,17 +1,19 @@
 package actions
 
 import (
-	"bytes"
-	"encoding/gob"
 	"encoding/json"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/index"
 	"github.com/actumn/searchgoose/monitor"
+	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -31,40 +33,172 @@ func NewRestClusterHealth(clusterService *cluster.Service, indexNameExpressionRe
 }
 
 func (h *RestClusterHealth) Handle(r *RestRequest, reply ResponseListener) {
-	clusterState := h.clusterService.State()
-	indicesNames := h.indexNameExpressionResolver.ConcreteIndexNames(*clusterState, "*")
-	activePrimaryShards, activeShards := 0, 0
-	for _, indexName := range indicesNames {
-		//indexMetadata := clusterState.Metadata.Indices[indexName]
-		indexRoutingTable := clusterState.RoutingTable.IndicesRouting[indexName]
-
-		activePrimaryShards += len(indexRoutingTable.Shards)
-		activeShards += len(indexRoutingTable.Shards)
+	indexExpression := r.PathParams["index"]
+	if indexExpression == "" {
+		indexExpression = "*"
+	}
+	level := r.Param("level")
+	if level == "" {
+		level = "cluster"
+	}
+	if level != "cluster" && level != "indices" && level != "shards" {
+		reply(newErrorResponse(400, "illegal_argument_exception", "level must be one of [cluster, indices, shards] but was ["+level+"]"))
+		return
+	}
+	timeout, err := r.ParamAsDuration("timeout", 30*time.Second)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("timeout", r.Param("timeout")).Error()))
+		return
+	}
+	var accepts []func(clusterState *state.ClusterState) bool
+	if waitForStatus := r.Param("wait_for_status"); waitForStatus != "" {
+		status, ok := cluster.ParseHealthStatus(waitForStatus)
+		if !ok {
+			reply(newErrorResponse(400, "illegal_argument_exception", "unknown cluster health status ["+waitForStatus+"]"))
+			return
+		}
+		accepts = append(accepts, func(clusterState *state.ClusterState) bool {
+			return h.health(clusterState, indexExpression).Status <= status
+		})
+	}
+	if waitForNodes := r.Param("wait_for_nodes"); waitForNodes != "" {
+		nodesMatch, err := parseWaitForNodes(waitForNodes)
+		if err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+			return
+		}
+		accepts = append(accepts, func(clusterState *state.ClusterState) bool {
+			return nodesMatch(len(clusterState.Nodes.Nodes))
+		})
 	}
 
+	clusterState, timedOut := h.clusterService.State(), false
+	if len(accepts) > 0 {
+		var accepted bool
+		clusterState, accepted = h.clusterService.ApplierService.WaitForState(func(clusterState *state.ClusterState) bool {
+			for _, accept := range accepts {
+				if !accept(clusterState) {
+					return false
+				}
+			}
+			return true
+		}, timeout)
+		timedOut = !accepted
+	}
+
+	health := h.health(clusterState, indexExpression)
 	nodes := clusterState.Nodes
+	pendingTasks := h.clusterService.MasterService.PendingTasks()
+	var maxWaitingInQueue time.Duration
+	for _, pendingTask := range pendingTasks {
+		if !pendingTask.Executing && pendingTask.TimeInQueue > maxWaitingInQueue {
+			maxWaitingInQueue = pendingTask.TimeInQueue
+		}
+	}
+	body := map[string]interface{}{
+		"cluster_name":                     clusterState.Name,
+		"status":                           health.Status.String(),
+		"timed_out":                        timedOut,
+		"number_of_nodes":                  len(nodes.Nodes),
+		"number_of_data_nodes":             len(nodes.DataNodes),
+		"active_primary_shards":            health.ActivePrimaryShards,
+		"active_shards":                    health.ActiveShards,
+		"relocating_shards":                health.RelocatingShards,
+		"initializing_shards":              health.InitializingShards,
+		"unassigned_shards":                health.UnassignedShards,
+		"delayed_unassigned_shards":        0,
+		"number_of_pending_tasks":          len(pendingTasks),
+		"number_of_in_flight_fetch":        0,
+		"task_max_waiting_in_queue_millis": maxWaitingInQueue.Milliseconds(),
+		"active_shards_percent_as_number":  health.ActiveShardsPercent(),
+	}
+	if level != "cluster" {
+		indicesHealth := map[string]interface{}{}
+		for indexName, indexHealth := range health.Indices {
+			indexBody := map[string]interface{}{
+				"status":                indexHealth.Status.String(),
+				"number_of_shards":      indexHealth.NumberOfShards,
+				"number_of_replicas":    indexHealth.NumberOfReplicas,
+				"active_primary_shards": indexHealth.ActivePrimaryShards,
+				"active_shards":         indexHealth.ActiveShards,
+				"relocating_shards":     indexHealth.RelocatingShards,
+				"initializing_shards":   indexHealth.InitializingShards,
+				"unassigned_shards":     indexHealth.UnassignedShards,
+			}
+			if level == "shards" {
+				shardsHealth := map[string]interface{}{}
+				for shardId, shardHealth := range indexHealth.Shards {
+					shardsHealth[strconv.Itoa(shardId)] = map[string]interface{}{
+						"status":              shardHealth.Status.String(),
+						"primary_active":      shardHealth.PrimaryActive,
+						"active_shards":       shardHealth.ActiveShards,
+						"relocating_shards":   shardHealth.RelocatingShards,
+						"initializing_shards": shardHealth.InitializingShards,
+						"unassigned_shards":   shardHealth.UnassignedShards,
+					}
+				}
+				indexBody["shards"] = shardsHealth
+			}
+			indicesHealth[indexName] = indexBody
+		}
+		body["indices"] = indicesHealth
+	}
+
+	statusCode := 200
+	if timedOut {
+		statusCode = 408
+	}
 	reply(RestResponse{
-		StatusCode: 200,
-		Body: map[string]interface{}{
-			"cluster_name":                     clusterState.Name,
-			"status":                           "green",
-			"timed_out":                        false,
-			"number_of_nodes":                  len(nodes.Nodes),
-			"number_of_data_nodes":             len(nodes.DataNodes),
-			"active_primary_shards":            activePrimaryShards,
-			"active_shards":                    activeShards,
-			"relocating_shards":                0,
-			"initializing_shards":              0,
-			"unassigned_shards":                0,
-			"delayed_unassigned_shards":        0,
-			"number_of_pending_tasks":          0,
-			"number_of_in_flight_fetch":        0,
-			"task_max_waiting_in_queue_millis": 0,
-			"active_shards_percent_as_number":  100,
-		},
+		StatusCode: statusCode,
+		Body:       body,
 	})
 }
 
+// health computes the health of the indices matching indexExpression. An explicit expression that
+// matches no index is red, since the index may not have been created yet.
+func (h *RestClusterHealth) health(clusterState *state.ClusterState, indexExpression string) cluster.ClusterHealth {
+	concreteIndices := h.indexNameExpressionResolver.ConcreteIndexNames(*clusterState, indexExpression)
+	health := cluster.NewClusterHealth(*clusterState, concreteIndices)
+	if len(concreteIndices) == 0 && indexExpression != "*" {
+		health.Status = cluster.HealthRed
+	}
+	return health
+}
+
+// parseWaitForNodes parses wait_for_nodes, a number of nodes optionally preceded by
+// >=, <=, >, < or written ge(N), le(N), gt(N), lt(N).
+func parseWaitForNodes(value string) (func(nodes int) bool, error) {
+	operators := []struct {
+		prefix string
+		suffix string
+		match  func(nodes int, expected int) bool
+	}{
+		{">=", "", func(nodes int, expected int) bool { return nodes >= expected }},
+		{"<=", "", func(nodes int, expected int) bool { return nodes <= expected }},
+		{">", "", func(nodes int, expected int) bool { return nodes > expected }},
+		{"<", "", func(nodes int, expected int) bool { return nodes < expected }},
+		{"ge(", ")", func(nodes int, expected int) bool { return nodes >= expected }},
+		{"le(", ")", func(nodes int, expected int) bool { return nodes <= expected }},
+		{"gt(", ")", func(nodes int, expected int) bool { return nodes > expected }},
+		{"lt(", ")", func(nodes int, expected int) bool { return nodes < expected }},
+		{"", "", func(nodes int, expected int) bool { return nodes == expected }},
+	}
+	for _, operator := range operators {
+		if !strings.HasPrefix(value, operator.prefix) || !strings.HasSuffix(value, operator.suffix) {
+			continue
+		}
+		expected, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(value, operator.prefix), operator.suffix))
+		if err != nil {
+			break
+		}
+		match := operator.match
+		return func(nodes int) bool {
+			return match(nodes, expected)
+		}, nil
+	}
+	return nil, invalidParameter("wait_for_nodes", value)
+}
+
 type RestClusterState struct {
 	clusterService              *cluster.Service
 	indexNameExpressionResolver *indices.NameExpressionResolver
@@ -104,16 +238,16 @@ func (h *RestClusterState) Handle(r *RestRequest, reply ResponseListener) {
 			"aliases":  aliases,
 			"mappings": mappings,
 			"settings": map[string]interface{}{
-				"index": map[string]interface{}{
+				"index": withAllocationSettings(map[string]interface{}{
 					"creation_date":      "1597382566866",
 					"number_of_shards":   strconv.Itoa(indexMetadata.NumberOfShards),
-					"number_of_replicas": "0",
+					"number_of_replicas": strconv.Itoa(indexMetadata.NumberOfReplicas),
 					"uuid":               indexMetadata.Index.Uuid,
 					"version": map[string]interface{}{
 						"created": "7080299",
 					},
 					"provided_name": indexMetadata.Index.Name,
-				},
+				}, indexMetadata),
 			},
 		}
 	}
@@ -126,58 +260,38 @@ func (h *RestClusterState) Handle(r *RestRequest, reply ResponseListener) {
 			"metadata": map[string]interface{}{
 				"cluster_uuid":           clusterState.StateUUID,
 				"cluster_uuid_committed": true,
+				"cluster_coordination":   coordinationBody(clusterState.Metadata.Coordination),
 				"templates":              map[string]interface{}{},
 				"indices":                indicesInfo,
 				"index_lifecycle":        map[string]interface{}{},
 				"index-graveyard":        map[string]interface{}{},
 				"ingest":                 map[string]interface{}{},
 			},
+			"routing_table": routingTableBody(clusterState, concreteIndices),
 		},
 	})
 }
 
-type clusterStatsNodeRequest struct {
-}
-
-func (r *clusterStatsNodeRequest) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
-}
-func clusterStatsNodeRequestFromBytes(b []byte) *clusterStatsNodeRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req clusterStatsNodeRequest
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
-	}
-	return &req
-}
-
 type clusterStatsNodeResponse struct {
 	NodeStats  monitor.Stats
 	ShardStats []index.ShardStats
 }
 
-func (r *clusterStatsNodeResponse) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
+func (r *clusterStatsNodeResponse) WriteTo(out *common.StreamOutput) {
+	r.NodeStats.WriteTo(out)
+	out.WriteVInt(uint64(len(r.ShardStats)))
+	for i := range r.ShardStats {
+		r.ShardStats[i].WriteTo(out)
 	}
-	return buffer.Bytes()
 }
-func clusterStatsNodeResponseFromBytes(b []byte) *clusterStatsNodeResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req clusterStatsNodeResponse
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+
+func readClusterStatsNodeResponse(in *common.StreamInput) (*clusterStatsNodeResponse, error) {
+	res := clusterStatsNodeResponse{NodeStats: monitor.ReadStats(in)}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.ShardStats = append(res.ShardStats, index.ReadShardStats(in))
 	}
-	return &req
+	return &res, in.Err()
 }
 
 type RestClusterStats struct {
@@ -201,7 +315,7 @@ func NewRestClusterStats(clusterService *cluster.Service, transportService *tran
 			NodeStats:  nodeStats,
 			ShardStats: shardStats,
 		}
-		channel.SendMessage("", res.toBytes())
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
 	})
 
 	return &RestClusterStats{
@@ -214,21 +328,51 @@ func (h *RestClusterStats) Handle(r *RestRequest, reply ResponseListener) {
 	clusterState := h.clusterService.State()
 	nodes := clusterState.Nodes
 
-	responses := make([]clusterStatsNodeResponse, len(nodes.Nodes))
+	responses := make([]*clusterStatsNodeResponse, len(nodes.Nodes))
+	var failures []interface{}
+	mux := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(nodes.Nodes))
 	idx := -1
 	for _, node := range nodes.Nodes {
 		idx += 1
 		currIdx := idx
-		h.transportService.SendRequest(node, ClusterStatsAction, []byte(""), func(response []byte) {
-			res := clusterStatsNodeResponseFromBytes(response)
-			responses[currIdx] = *res
-			wg.Done()
+		nodeId := node.Id
+		onFailure := func(err error) {
+			mux.Lock()
+			failures = append(failures, nodeFailure(nodeId, err))
+			mux.Unlock()
+		}
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, ClusterStatsAction, []byte(""), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readClusterStatsNodeResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				responses[currIdx] = res
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
 		})
 	}
 	wg.Wait()
 
+	ingestNodes := 0
+	coordinatingOnlyNodes := 0
+	for _, node := range nodes.Nodes {
+		if node.IsIngestNode() {
+			ingestNodes += 1
+		}
+		if node.IsCoordinatingOnly() {
+			coordinatingOnlyNodes += 1
+		}
+	}
+
 	memTotal := uint64(0)
 	memFree := uint64(0)
 
@@ -243,6 +387,9 @@ func (h *RestClusterStats) Handle(r *RestRequest, reply ResponseListener) {
 	docsDeleted := uint64(0)
 	numBytesUsedDisk := uint64(0)
 	for _, response := range responses {
+		if response == nil {
+			continue
+		}
 		memTotal += response.NodeStats.Os.Mem.Total
 		memFree += response.NodeStats.Os.Mem.Free
 
@@ -263,14 +410,15 @@ func (h *RestClusterStats) Handle(r *RestRequest, reply ResponseListener) {
 		}
 	}
 
+	memFreePercent := uint64(0)
+	if memTotal > 0 {
+		memFreePercent = memFree * 100 / memTotal
+	}
+
 	reply(RestResponse{
 		StatusCode: 200,
 		Body: map[string]interface{}{
-			"_nodes": map[string]interface{}{
-				"total":      len(nodes.Nodes),
-				"successful": len(nodes.Nodes),
-				"failed":     0,
-			},
+			"_nodes":       nodesHeader(len(nodes.Nodes), failures),
 			"cluster_name": clusterState.Name,
 			"cluster_uuid": clusterState.StateUUID,
 			"status":       "green",
@@ -290,17 +438,19 @@ func (h *RestClusterStats) Handle(r *RestRequest, reply ResponseListener) {
 			},
 			"nodes": map[string]interface{}{
 				"count": map[string]interface{}{
-					"total":  len(nodes.Nodes),
-					"master": 1,
-					"data":   len(nodes.DataNodes),
+					"total":             len(nodes.Nodes),
+					"master":            len(nodes.MasterNodes),
+					"data":              len(nodes.DataNodes),
+					"ingest":            ingestNodes,
+					"coordinating_only": coordinatingOnlyNodes,
 				},
 				"os": map[string]interface{}{
 					"mem": map[string]interface{}{
 						"total_in_bytes": memTotal,
 						"free_in_bytes":  memFree,
 						"used_in_bytes":  memTotal - memFree,
-						"free_percent":   memFree * 100 / memTotal,
-						"used_percent":   100 - memFree*100/memTotal,
+						"free_percent":   memFreePercent,
+						"used_percent":   100 - memFreePercent,
 					},
 				},
 				"fs": map[string]interface{}{
@@ -312,3 +462,33 @@ func (h *RestClusterStats) Handle(r *RestRequest, reply ResponseListener) {
 		},
 	})
 }
+
+type RestClusterPendingTasks struct {
+	clusterService *cluster.Service
+}
+
+func NewRestClusterPendingTasks(clusterService *cluster.Service) *RestClusterPendingTasks {
+	return &RestClusterPendingTasks{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestClusterPendingTasks) Handle(r *RestRequest, reply ResponseListener) {
+	tasks := []map[string]interface{}{}
+	for _, pendingTask := range h.clusterService.MasterService.PendingTasks() {
+		tasks = append(tasks, map[string]interface{}{
+			"insert_order":         pendingTask.InsertOrder,
+			"priority":             pendingTask.Priority.String(),
+			"source":               pendingTask.Source,
+			"executing":            pendingTask.Executing,
+			"time_in_queue_millis": pendingTask.TimeInQueue.Milliseconds(),
+			"time_in_queue":        pendingTask.TimeInQueue.Round(time.Millisecond).String(),
+		})
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"tasks": tasks,
+		},
+	})
+}
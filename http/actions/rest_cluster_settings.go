@@ -0,0 +1,167 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/nqd/flat"
+	"strconv"
+	"strings"
+)
+
+type RestClusterGetSettings struct {
+	clusterService *cluster.Service
+}
+
+func NewRestClusterGetSettings(clusterService *cluster.Service) *RestClusterGetSettings {
+	return &RestClusterGetSettings{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestClusterGetSettings) Handle(r *RestRequest, reply ResponseListener) {
+	flatSettings := r.ParamAsBool("flat_settings", false)
+	metadata := h.clusterService.State().Metadata
+	body := map[string]interface{}{
+		"persistent": settingsBody(metadata.PersistentSettings, flatSettings),
+		"transient":  settingsBody(metadata.TransientSettings, flatSettings),
+	}
+	if r.ParamAsBool("include_defaults", false) {
+		defaults := h.clusterService.ClusterSettings.Defaults(metadata.Settings())
+		body["defaults"] = settingsBody(defaults, flatSettings)
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       body,
+	})
+}
+
+// settingsBody returns the settings keyed by their full names with flat_settings, nested objects otherwise.
+func settingsBody(settings map[string]string, flatSettings bool) map[string]interface{} {
+	body := map[string]interface{}{}
+	for key, value := range settings {
+		body[key] = value
+	}
+	if flatSettings {
+		return body
+	}
+	nested, err := flat.Unflatten(body, nil)
+	if err != nil {
+		return body
+	}
+	return nested
+}
+
+type RestClusterPutSettings struct {
+	clusterService        *cluster.Service
+	updateSettingsService *cluster.ClusterUpdateSettingsService
+}
+
+func NewRestClusterPutSettings(clusterService *cluster.Service, updateSettingsService *cluster.ClusterUpdateSettingsService) *RestClusterPutSettings {
+	return &RestClusterPutSettings{
+		clusterService:        clusterService,
+		updateSettingsService: updateSettingsService,
+	}
+}
+
+func (h *RestClusterPutSettings) Handle(r *RestRequest, reply ResponseListener) {
+	var body map[string]map[string]interface{}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		reply(newErrorResponse(400, "parse_exception", "failed to parse the cluster settings: "+err.Error()))
+		return
+	}
+	persistent, err := settingsUpdates(body["persistent"])
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	transient, err := settingsUpdates(body["transient"])
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	if len(persistent) == 0 && len(transient) == 0 {
+		reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: no settings to update;"))
+		return
+	}
+	if err := h.clusterService.ClusterSettings.Validate("persistent", persistent); err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	if err := h.clusterService.ClusterSettings.Validate("transient", transient); err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	err = h.updateSettingsService.UpdateSettings(cluster.ClusterUpdateSettingsRequest{
+		AckedRequest: ackedReq,
+		Persistent:   persistent,
+		Transient:    transient,
+	})
+
+	flatSettings := r.ParamAsBool("flat_settings", false)
+	reply(acknowledgedResponse(err, map[string]interface{}{
+		"persistent": settingsBody(updatedSettings(persistent), flatSettings),
+		"transient":  settingsBody(updatedSettings(transient), flatSettings),
+	}))
+}
+
+// settingsUpdates flattens a section of the request body to the settings values, a null resets a setting.
+func settingsUpdates(section map[string]interface{}) (map[string]*string, error) {
+	flattened, err := flat.Flatten(section, &flat.Options{Delimiter: ".", Safe: true})
+	if err != nil {
+		return nil, err
+	}
+	updates := map[string]*string{}
+	for key, value := range flattened {
+		if value == nil {
+			updates[key] = nil
+			continue
+		}
+		s, err := settingValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+		updates[key] = &s
+	}
+	return updates, nil
+}
+
+func settingValue(key string, value interface{}) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, err := settingValue(key, v)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, ","), nil
+	default:
+		return "", fmt.Errorf("failed to parse the value of setting [%s], expected a string, a number, a boolean or an array", key)
+	}
+}
+
+// updatedSettings returns the values set by the updates, the reset settings are left out.
+func updatedSettings(updates map[string]*string) map[string]string {
+	settings := map[string]string{}
+	for key, value := range updates {
+		if value != nil {
+			settings[key] = *value
+		}
+	}
+	return settings
+}
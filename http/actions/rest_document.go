@@ -1,11 +1,11 @@
 package actions
 
 import (
-	"bytes"
-	"encoding/gob"
 	"encoding/json"
-	"errors"
 	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/errors"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/security"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
@@ -20,33 +20,115 @@ const (
 )
 
 type indexRequest struct {
-	Index   string
-	Id      string
-	Source  []byte
-	ShardId state.ShardId
+	Index     string
+	Id        string
+	Source    []byte
+	ShardId   state.ShardId
+	Routing   string
+	OpType    string
+	IfVersion int64
+	Refresh   string
 }
 
-func (r *indexRequest) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
+// expectedVersion translates op_type and if_version of a write request into the version the shard should check.
+func expectedVersion(opType string, ifVersion int64) int64 {
+	if opType == "create" {
+		return index.VersionNotFound
+	}
+	if ifVersion > 0 {
+		return ifVersion
 	}
-	return buffer.Bytes()
+	return index.VersionMatchAny
 }
 
-func indexRequestFromBytes(b []byte) *indexRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req indexRequest
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func (r *indexRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Index)
+	out.WriteString(r.Id)
+	out.WriteBytes(r.Source)
+	r.ShardId.WriteTo(out)
+	out.WriteString(r.Routing)
+	out.WriteString(r.OpType)
+	out.WriteInt64(r.IfVersion)
+	out.WriteString(r.Refresh)
+}
+
+func readIndexRequest(in *common.StreamInput) (*indexRequest, error) {
+	req := indexRequest{
+		Index:     in.ReadString(),
+		Id:        in.ReadString(),
+		Source:    in.ReadBytes(),
+		ShardId:   state.ReadShardId(in),
+		Routing:   in.ReadString(),
+		OpType:    in.ReadString(),
+		IfVersion: in.ReadInt64(),
+		Refresh:   in.ReadString(),
 	}
-	return &req
+	return &req, in.Err()
 }
 
 type indexResponse struct {
-	Err string
+	Version       int64
+	SeqNo         int64
+	Result        string
+	ForcedRefresh bool
+	Err           string
+}
+
+func (r *indexResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(r.Version)
+	out.WriteInt64(r.SeqNo)
+	out.WriteString(r.Result)
+	out.WriteBool(r.ForcedRefresh)
+	out.WriteString(r.Err)
+}
+
+func readIndexResponse(in *common.StreamInput) (*indexResponse, error) {
+	res := indexResponse{
+		Version:       in.ReadInt64(),
+		SeqNo:         in.ReadInt64(),
+		Result:        in.ReadString(),
+		ForcedRefresh: in.ReadBool(),
+		Err:           in.ReadString(),
+	}
+	return &res, in.Err()
+}
+
+// routingMissing reports whether the index requires a routing value that the request does not provide.
+func routingMissing(clusterState *state.ClusterState, indexName string, routing string) bool {
+	return routing == "" && clusterState.Metadata.Indices[indexName].RoutingRequired
+}
+
+func routingMissingResponse(indexName string, documentId string) RestResponse {
+	return newErrorResponse(400, "routing_missing_exception", "routing is required for ["+indexName+"]/[_doc]/["+documentId+"]")
+}
+
+// indexWriteBlocked reports whether the index has the read-only-allow-delete block of the flood-stage disk watermark.
+func indexWriteBlocked(clusterState *state.ClusterState, indexName string) bool {
+	return clusterState.Metadata.Indices[indexName].ReadOnlyAllowDelete
+}
+
+func indexWriteBlockedReason(indexName string) string {
+	return "index [" + indexName + "] blocked by: [TOO_MANY_REQUESTS/12/disk usage exceeded flood-stage watermark, index has read-only-allow-delete block];"
+}
+
+func indexWriteBlockedResponse(indexName string) RestResponse {
+	return newErrorResponse(429, "cluster_block_exception", indexWriteBlockedReason(indexName))
+}
+
+// withRouting adds the _routing of a document to a response body when it has one.
+func withRouting(body map[string]interface{}, routing string) map[string]interface{} {
+	if routing != "" {
+		body["_routing"] = routing
+	}
+	return body
+}
+
+// writeFailure builds the error reply of a failed single document write.
+func writeFailure(documentId string, err string) RestResponse {
+	if err == errors.ErrVersionConflict.Error() {
+		return newErrorResponse(409, "version_conflict_engine_exception", "["+documentId+"]: version conflict")
+	}
+	return newErrorResponse(500, "exception", err)
 }
 
 type RestIndexDoc struct {
@@ -60,22 +142,36 @@ type RestIndexDoc struct {
 func NewRestIndexDoc(clusterService *cluster.Service, createIndexService *cluster.MetadataCreateIndexService, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestIndexDoc {
 	// Handle primary shard request
 	transportService.RegisterRequestHandler(IndexAction, func(channel transport.ReplyChannel, req []byte) {
-		request := indexRequestFromBytes(req)
+		request, err := readIndexRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
 		logrus.Info("indexAction on primary shard ", request.Id)
 
 		indexService, _ := indicesService.IndexService(request.ShardId.Index.Uuid)
 		indexShard, _ := indexService.Shard(request.ShardId.ShardId)
 
 		var body map[string]interface{}
-		// TODO :: json error handling
 		if err := json.Unmarshal(request.Source, &body); err != nil {
-			logrus.Fatal(err)
+			res := indexResponse{Err: err.Error()}
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+			return
 		}
-		// TODO :: how to handle error on distributed system?
-		if err := indexShard.Index(request.Id, body); err != nil {
-			logrus.Fatal(err)
+
+		result, err := indexShard.Index(request.Id, request.Routing, body, expectedVersion(request.OpType, request.IfVersion))
+		res := indexResponse{
+			Version: result.Version,
+			SeqNo:   result.SeqNo,
+			Result:  result.Result,
+		}
+		if err != nil {
+			logrus.Warn(err)
+			res.Err = err.Error()
+		} else if res.ForcedRefresh, err = applyRefreshPolicy(indexShard, request.Refresh, result.SeqNo); err != nil {
+			res.Err = err.Error()
 		}
-		channel.SendMessage("", []byte(request.Id))
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
 	})
 
 	return &RestIndexDoc{
@@ -118,33 +214,65 @@ func (h *RestIndexDoc) Handle(r *RestRequest, reply ResponseListener) {
 		indexName = indexExpression
 		clusterState = h.clusterService.State()
 	}
-	shardRouting := cluster.IndexShard(*clusterState, indexName, documentId).Primary
+	routing := r.Param("routing")
+	if routingMissing(clusterState, indexName, routing) {
+		reply(routingMissingResponse(indexName, documentId))
+		return
+	}
+	if indexWriteBlocked(clusterState, indexName) {
+		reply(indexWriteBlockedResponse(indexName))
+		return
+	}
+	refresh, err := refreshPolicy(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	shardRouting := cluster.IndexShard(*clusterState, indexName, documentId, routing).Primary
 	indexRequest := indexRequest{
 		Index:   indexName,
 		Id:      documentId,
 		Source:  r.Body,
 		ShardId: shardRouting.ShardId,
+		Routing: routing,
+		Refresh: refresh,
 	}
-	h.transportService.SendRequest(clusterState.Nodes.Nodes[shardRouting.CurrentNodeId], IndexAction, indexRequest.toBytes(), func(response []byte) {
-		logrus.Info("callback success ", string(response), ", req Id: ", r.ID)
-		reply(RestResponse{
-			StatusCode: 200,
-			Body: map[string]interface{}{
-				"_index":   indexName,
-				"_type":    "_doc",
-				"_id":      documentId,
-				"_version": 1,
-				"result":   "created",
-				"req_body": body,
-				"_shards": map[string]interface{}{
-					"total":      2,
-					"successful": 1,
-					"failed":     0,
-				},
-				"_seq_no":       0,
-				"_primary_term": 1,
-			},
-		})
+	node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, IndexAction, common.ToBytes(&indexRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readIndexResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			logrus.Info("callback success ", res.Result, ", req Id: ", r.ID)
+			if res.Err != "" {
+				reply(writeFailure(documentId, res.Err))
+				return
+			}
+			reply(RestResponse{
+				StatusCode: 201,
+				Body: withForcedRefresh(withRouting(map[string]interface{}{
+					"_index":   indexName,
+					"_type":    "_doc",
+					"_id":      documentId,
+					"_version": res.Version,
+					"result":   res.Result,
+					"req_body": body,
+					"_shards": map[string]interface{}{
+						"total":      2,
+						"successful": 1,
+						"failed":     0,
+					},
+					"_seq_no":       res.SeqNo,
+					"_primary_term": 1,
+				}, routing), res.ForcedRefresh),
+			})
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
 	})
 }
 
@@ -198,31 +326,67 @@ func (h *RestIndexDocId) Handle(r *RestRequest, reply ResponseListener) {
 		indexName = indexExpression
 		clusterState = h.clusterService.State()
 	}
-	shardRouting := cluster.IndexShard(*clusterState, indexExpression, documentId).Primary
+	routing := r.Param("routing")
+	if routingMissing(clusterState, indexName, routing) {
+		reply(routingMissingResponse(indexName, documentId))
+		return
+	}
+	if indexWriteBlocked(clusterState, indexName) {
+		reply(indexWriteBlockedResponse(indexName))
+		return
+	}
+	refresh, err := refreshPolicy(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	shardRouting := cluster.IndexShard(*clusterState, indexName, documentId, routing).Primary
 	indexRequest := indexRequest{
 		Index:   indexName,
 		Id:      documentId,
 		Source:  r.Body,
 		ShardId: shardRouting.ShardId,
+		Routing: routing,
+		Refresh: refresh,
 	}
-	h.transportService.SendRequest(clusterState.Nodes.Nodes[shardRouting.CurrentNodeId], IndexAction, indexRequest.toBytes(), func(response []byte) {
-		reply(RestResponse{
-			StatusCode: 200,
-			Body: map[string]interface{}{
-				"_index":   indexName,
-				"_type":    "_doc",
-				"_id":      documentId,
-				"_version": 1,
-				"result":   "created",
-				"_shards": map[string]interface{}{
-					"total":      2,
-					"successful": 1,
-					"failed":     0,
-				},
-				"_seq_no":       0,
-				"_primary_term": 1,
-			},
-		})
+	node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, IndexAction, common.ToBytes(&indexRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readIndexResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			if res.Err != "" {
+				reply(writeFailure(documentId, res.Err))
+				return
+			}
+			statusCode := 200
+			if res.Result == "created" {
+				statusCode = 201
+			}
+			reply(RestResponse{
+				StatusCode: statusCode,
+				Body: withForcedRefresh(withRouting(map[string]interface{}{
+					"_index":   indexName,
+					"_type":    "_doc",
+					"_id":      documentId,
+					"_version": res.Version,
+					"result":   res.Result,
+					"_shards": map[string]interface{}{
+						"total":      2,
+						"successful": 1,
+						"failed":     0,
+					},
+					"_seq_no":       res.SeqNo,
+					"_primary_term": 1,
+				}, routing), res.ForcedRefresh),
+			})
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
 	})
 }
 
@@ -230,25 +394,26 @@ type getRequest struct {
 	Index   string
 	Id      string
 	ShardId state.ShardId
+	// Authentication is the user of the request, the shard applies the document and field level security of its
+	// roles. It is nil when security is disabled.
+	Authentication *security.Authentication
 }
 
-func (r *getRequest) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
+func (r *getRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Index)
+	out.WriteString(r.Id)
+	r.ShardId.WriteTo(out)
+	security.WriteOptionalAuthentication(out, r.Authentication)
 }
 
-func getRequestFromBytes(b []byte) *getRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req getRequest
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func readGetRequest(in *common.StreamInput) (*getRequest, error) {
+	req := getRequest{
+		Index:          in.ReadString(),
+		Id:             in.ReadString(),
+		ShardId:        state.ReadShardId(in),
+		Authentication: security.ReadOptionalAuthentication(in),
 	}
-	return &req
+	return &req, in.Err()
 }
 
 type getResponse struct {
@@ -256,26 +421,54 @@ type getResponse struct {
 	Id      string
 	ShardId state.ShardId
 	Fields  map[string]interface{}
+	Routing string
+	Version int64
+	SeqNo   int64
 	Err     string
 }
 
-func (r *getResponse) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
+func (r *getResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Index)
+	out.WriteString(r.Id)
+	r.ShardId.WriteTo(out)
+	out.WriteMap(r.Fields)
+	out.WriteString(r.Routing)
+	out.WriteInt64(r.Version)
+	out.WriteInt64(r.SeqNo)
+	out.WriteString(r.Err)
+}
+
+func readGetResponse(in *common.StreamInput) (*getResponse, error) {
+	res := getResponse{
+		Index:   in.ReadString(),
+		Id:      in.ReadString(),
+		ShardId: state.ReadShardId(in),
+		Fields:  in.ReadMap(),
+		Routing: in.ReadString(),
+		Version: in.ReadInt64(),
+		SeqNo:   in.ReadInt64(),
+		Err:     in.ReadString(),
 	}
-	return buffer.Bytes()
+	return &res, in.Err()
 }
 
-func getResponseFromBytes(b []byte) *getResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var res getResponse
-	if err := decoder.Decode(&res); err != nil {
-		logrus.Fatal(err)
+// documentAccessible fails as a missing document when the document does not match the role queries of the user.
+func documentAccessible(indexShard *index.Shard, id string, accessControl security.IndexAccessControl) error {
+	documentQuery, err := accessControl.Query()
+	if err != nil {
+		return err
+	}
+	if documentQuery == nil {
+		return nil
+	}
+	matches, err := indexShard.Matches(id, documentQuery)
+	if err != nil {
+		return err
 	}
-	return &res
+	if !matches {
+		return errors.ErrNotFound
+	}
+	return nil
 }
 
 type RestGetDoc struct {
@@ -288,25 +481,40 @@ type RestGetDoc struct {
 func NewRestGetDoc(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestGetDoc {
 	transportService.RegisterRequestHandler(GetAction, func(channel transport.ReplyChannel, req []byte) {
 		logrus.Info("getAction on shard")
-		request := getRequestFromBytes(req)
+		request, err := readGetRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
 
 		indexService, _ := indicesService.IndexService(request.ShardId.Index.Uuid)
 		indexShard, _ := indexService.Shard(request.ShardId.ShardId)
 
-		if doc, err := indexShard.Get(request.Id); err != nil {
+		accessControl := security.AccessControl(request.Authentication, GetAction, request.Index, clusterService.State().Metadata.Security)
+		if err := documentAccessible(indexShard, request.Id, accessControl); err != nil {
+			logrus.Warn(err)
+			res := getResponse{
+				Err: err.Error(),
+			}
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+		} else if doc, err := indexShard.Get(request.Id); err != nil {
 			logrus.Warn(err)
 			res := getResponse{
 				Err: err.Error(),
 			}
-			channel.SendMessage("", res.toBytes())
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
 		} else {
+			version, seqNo := indexShard.Version(request.Id)
 			res := getResponse{
 				Index:   request.Index,
 				Id:      request.Id,
 				ShardId: request.ShardId,
-				Fields:  doc,
+				Fields:  accessControl.FilterFields(doc),
+				Routing: indexShard.Routing(request.Id),
+				Version: version,
+				SeqNo:   seqNo,
 			}
-			channel.SendMessage("", res.toBytes())
+			channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
 		}
 	})
 
@@ -351,70 +559,112 @@ func (h *RestGetDoc) Handle(r *RestRequest, reply ResponseListener) {
 		})
 		return
 	}
-	shardRouting := cluster.GetShards(*clusterState, indexName, documentId).Primary
+	routing := r.Param("routing")
+	if routingMissing(clusterState, indexName, routing) {
+		reply(routingMissingResponse(indexName, documentId))
+		return
+	}
+	shardRouting := cluster.GetShards(*clusterState, indexName, documentId, routing).Primary
 	getRequest := getRequest{
-		Index:   indexName,
-		Id:      documentId,
-		ShardId: shardRouting.ShardId,
+		Index:          indexName,
+		Id:             documentId,
+		ShardId:        shardRouting.ShardId,
+		Authentication: r.Authentication,
 	}
-	h.transportService.SendRequest(clusterState.Nodes.Nodes[shardRouting.CurrentNodeId], GetAction, getRequest.toBytes(), func(response []byte) {
-		res := getResponseFromBytes(response)
-		if res.Err != "" {
-			logrus.Warn(errors.New(res.Err))
-			reply(RestResponse{
-				StatusCode: 400,
-				Body: map[string]interface{}{
-					"_index": indexName,
-					"_type":  "_doc",
-					"_id":    documentId,
-					"found":  res.Err,
-				},
-			})
-		} else {
-			reply(RestResponse{
-				StatusCode: 200,
-				Body: map[string]interface{}{
-					"_index":        indexName,
-					"_type":         "_doc",
-					"_id":           documentId,
-					"_version":      1,
-					"_seq_no":       0,
-					"_primary_term": 1,
-					"found":         true,
-					"_source":       res.Fields,
-				},
-			})
-		}
+	node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, GetAction, common.ToBytes(&getRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readGetResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			if res.Err != "" {
+				logrus.Warn(res.Err)
+				reply(RestResponse{
+					StatusCode: 400,
+					Body: map[string]interface{}{
+						"_index": indexName,
+						"_type":  "_doc",
+						"_id":    documentId,
+						"found":  res.Err,
+					},
+				})
+			} else {
+				reply(RestResponse{
+					StatusCode: 200,
+					Body: withRouting(map[string]interface{}{
+						"_index":        indexName,
+						"_type":         "_doc",
+						"_id":           documentId,
+						"_version":      res.Version,
+						"_seq_no":       res.SeqNo,
+						"_primary_term": 1,
+						"found":         true,
+						"_source":       res.Fields,
+					}, res.Routing),
+				})
+			}
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
 	})
 }
 
 type deleteRequest struct {
-	Index   string
-	Id      string
-	ShardId state.ShardId
+	Index     string
+	Id        string
+	ShardId   state.ShardId
+	IfVersion int64
+	Refresh   string
 }
 
-func (r *deleteRequest) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
+func (r *deleteRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Index)
+	out.WriteString(r.Id)
+	r.ShardId.WriteTo(out)
+	out.WriteInt64(r.IfVersion)
+	out.WriteString(r.Refresh)
 }
 
-func deleteRequestFromBytes(b []byte) *deleteRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req deleteRequest
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func readDeleteRequest(in *common.StreamInput) (*deleteRequest, error) {
+	req := deleteRequest{
+		Index:     in.ReadString(),
+		Id:        in.ReadString(),
+		ShardId:   state.ReadShardId(in),
+		IfVersion: in.ReadInt64(),
+		Refresh:   in.ReadString(),
 	}
-	return &req
+	return &req, in.Err()
 }
 
 type deleteResponse struct {
-	Err string
+	Version       int64
+	SeqNo         int64
+	Result        string
+	ForcedRefresh bool
+	Err           string
+}
+
+func (r *deleteResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(r.Version)
+	out.WriteInt64(r.SeqNo)
+	out.WriteString(r.Result)
+	out.WriteBool(r.ForcedRefresh)
+	out.WriteString(r.Err)
+}
+
+func readDeleteResponse(in *common.StreamInput) (*deleteResponse, error) {
+	res := deleteResponse{
+		Version:       in.ReadInt64(),
+		SeqNo:         in.ReadInt64(),
+		Result:        in.ReadString(),
+		ForcedRefresh: in.ReadBool(),
+		Err:           in.ReadString(),
+	}
+	return &res, in.Err()
 }
 
 type RestDeleteDoc struct {
@@ -427,17 +677,28 @@ type RestDeleteDoc struct {
 func NewRestDeleteDoc(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestDeleteDoc {
 	transportService.RegisterRequestHandler(DeleteAction, func(channel transport.ReplyChannel, req []byte) {
 		logrus.Info("deleteAction on primary shard")
-		request := deleteRequestFromBytes(req)
+		request, err := readDeleteRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
 
 		indexService, _ := indicesService.IndexService(request.ShardId.Index.Uuid)
 		indexShard, _ := indexService.Shard(request.ShardId.ShardId)
 
-		// TODO :: how to handle error on distributed system?
-		if err := indexShard.Delete(request.Id); err != nil {
-			logrus.Fatal(err)
+		result, err := indexShard.Delete(request.Id, expectedVersion("", request.IfVersion))
+		res := deleteResponse{
+			Version: result.Version,
+			SeqNo:   result.SeqNo,
+			Result:  result.Result,
 		}
-
-		channel.SendMessage("", []byte("success"))
+		if err != nil {
+			logrus.Warn(err)
+			res.Err = err.Error()
+		} else if res.ForcedRefresh, err = applyRefreshPolicy(indexShard, request.Refresh, result.SeqNo); err != nil {
+			res.Err = err.Error()
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
 	})
 
 	return &RestDeleteDoc{
@@ -454,30 +715,65 @@ func (h *RestDeleteDoc) Handle(r *RestRequest, reply ResponseListener) {
 
 	clusterState := h.clusterService.State()
 	indexName := h.indexNameExpressionResolver.ConcreteSingleIndex(*clusterState, indexExpression).Name
-	shardRouting := cluster.IndexShard(*clusterState, indexName, documentId).Primary
+	routing := r.Param("routing")
+	if routingMissing(clusterState, indexName, routing) {
+		reply(routingMissingResponse(indexName, documentId))
+		return
+	}
+	if indexWriteBlocked(clusterState, indexName) {
+		reply(indexWriteBlockedResponse(indexName))
+		return
+	}
+	refresh, err := refreshPolicy(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	shardRouting := cluster.IndexShard(*clusterState, indexName, documentId, routing).Primary
 	deleteRequest := deleteRequest{
 		Index:   indexName,
 		Id:      documentId,
 		ShardId: shardRouting.ShardId,
+		Refresh: refresh,
 	}
 
-	h.transportService.SendRequest(clusterState.Nodes.Nodes[shardRouting.CurrentNodeId], DeleteAction, deleteRequest.toBytes(), func(response []byte) {
-		reply(RestResponse{
-			StatusCode: 200,
-			Body: map[string]interface{}{
-				"_index":   indexName,
-				"_type":    "_doc",
-				"_id":      documentId,
-				"_version": 2,
-				"result":   "deleted",
-				"_shards": map[string]interface{}{
-					"total":      2,
-					"successful": 1,
-					"failed":     0,
-				},
-				"_seq_no":       1,
-				"_primary_term": 1,
-			},
-		})
+	node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, DeleteAction, common.ToBytes(&deleteRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readDeleteResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			if res.Err != "" {
+				reply(writeFailure(documentId, res.Err))
+				return
+			}
+			statusCode := 200
+			if res.Result == "not_found" {
+				statusCode = 404
+			}
+			reply(RestResponse{
+				StatusCode: statusCode,
+				Body: withForcedRefresh(withRouting(map[string]interface{}{
+					"_index":   indexName,
+					"_type":    "_doc",
+					"_id":      documentId,
+					"_version": res.Version,
+					"result":   res.Result,
+					"_shards": map[string]interface{}{
+						"total":      2,
+						"successful": 1,
+						"failed":     0,
+					},
+					"_seq_no":       res.SeqNo,
+					"_primary_term": 1,
+				}, routing), res.ForcedRefresh),
+			})
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
 	})
 }
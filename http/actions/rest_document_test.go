@@ -2,12 +2,13 @@ package actions
 
 import (
 	"fmt"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
-func TestIndexRequest_ToBytes(t *testing.T) {
+func TestIndexRequest_WriteTo(t *testing.T) {
 	// Arrange
 	req := indexRequest{
 		Index:  "index",
@@ -23,11 +24,13 @@ func TestIndexRequest_ToBytes(t *testing.T) {
 	}
 
 	// Action
-	bytes := req.toBytes()
-	parsed := indexRequestFromBytes(bytes)
+	bytes := common.ToBytes(&req, common.CurrentVersion)
+	parsed, err := readIndexRequest(common.NewStreamInput(bytes, common.CurrentVersion))
 
 	// Assert
+	assert.Nil(t, err)
 	assert.Equal(t, req.Source, parsed.Source)
+	assert.Equal(t, req.ShardId, parsed.ShardId)
 }
 
 func TestRestGetDoc_Handle(t *testing.T) {
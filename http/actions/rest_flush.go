@@ -0,0 +1,101 @@
+package actions
+
+import (
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"strconv"
+)
+
+const (
+	FlushAction      = "indices:admin/flush"
+	ForceMergeAction = "indices:admin/forcemerge"
+)
+
+type RestFlush struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
+}
+
+func NewRestFlush(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestFlush {
+	registerBroadcastShardAction(indicesService, transportService, FlushAction, func(indexShard *index.Shard, params map[string]string) error {
+		return indexShard.Flush()
+	})
+
+	return &RestFlush{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
+	}
+}
+
+func (h *RestFlush) Handle(r *RestRequest, reply ResponseListener) {
+	clusterState := h.clusterService.State()
+	concreteIndices, ok := resolveBroadcastIndices(h.indexNameExpressionResolver, clusterState, r, reply)
+	if !ok {
+		return
+	}
+
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"_shards": broadcastShardOperation(clusterState, h.transportService, FlushAction, concreteIndices, true, nil, "flush_failed_engine_exception"),
+		},
+	})
+}
+
+type RestForceMerge struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
+}
+
+func NewRestForceMerge(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestForceMerge {
+	registerBroadcastShardAction(indicesService, transportService, ForceMergeAction, func(indexShard *index.Shard, params map[string]string) error {
+		maxNumSegments, err := strconv.Atoi(params["max_num_segments"])
+		if err != nil {
+			return err
+		}
+		return indexShard.ForceMerge(maxNumSegments, params["only_expunge_deletes"] == "true")
+	})
+
+	return &RestForceMerge{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
+	}
+}
+
+func (h *RestForceMerge) Handle(r *RestRequest, reply ResponseListener) {
+	// -1 lets the merge planner decide how many segments to keep
+	maxNumSegments, err := r.ParamAsInt("max_num_segments", -1)
+	if err != nil || maxNumSegments == 0 || maxNumSegments < -1 {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("max_num_segments", r.Param("max_num_segments")).Error()))
+		return
+	}
+	onlyExpungeDeletes := r.ParamAsBool("only_expunge_deletes", false)
+	if onlyExpungeDeletes && maxNumSegments != -1 {
+		reply(newErrorResponse(400, "action_request_validation_exception",
+			"Validation Failed: 1: cannot set only_expunge_deletes and max_num_segments at the same time;"))
+		return
+	}
+
+	clusterState := h.clusterService.State()
+	concreteIndices, ok := resolveBroadcastIndices(h.indexNameExpressionResolver, clusterState, r, reply)
+	if !ok {
+		return
+	}
+
+	params := map[string]string{
+		"max_num_segments":     strconv.Itoa(maxNumSegments),
+		"only_expunge_deletes": strconv.FormatBool(onlyExpungeDeletes),
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"_shards": broadcastShardOperation(clusterState, h.transportService, ForceMergeAction, concreteIndices, true, params, "force_merge_failed_engine_exception"),
+		},
+	})
+}
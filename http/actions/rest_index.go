@@ -75,16 +75,16 @@ func (h *RestGetIndex) Handle(r *RestRequest, reply ResponseListener) {
 			"aliases":  aliases,
 			"mappings": mappings,
 			"settings": map[string]interface{}{
-				"index": map[string]interface{}{
+				"index": withAllocationSettings(map[string]interface{}{
 					"creation_date":      "1597382566866",
 					"number_of_shards":   strconv.Itoa(index.NumberOfShards),
-					"number_of_replicas": "0",
+					"number_of_replicas": strconv.Itoa(index.NumberOfReplicas),
 					"uuid":               index.Index.Uuid,
 					"version": map[string]interface{}{
 						"created": "7080299",
 					},
 					"provided_name": index.Index.Name,
-				},
+				}, index),
 			},
 		}
 	}
@@ -94,16 +94,53 @@ func (h *RestGetIndex) Handle(r *RestRequest, reply ResponseListener) {
 	})
 }
 
+// withAllocationSettings adds the allocation filters and the read-only-allow-delete block of an index to its settings.
+func withAllocationSettings(settings map[string]interface{}, indexMetadata state.IndexMetadata) map[string]interface{} {
+	allocation := map[string]interface{}{}
+	for kind, filter := range map[string]map[string]string{
+		"require": indexMetadata.RoutingAllocationRequire,
+		"include": indexMetadata.RoutingAllocationInclude,
+		"exclude": indexMetadata.RoutingAllocationExclude,
+	} {
+		if len(filter) > 0 {
+			allocation[kind] = filter
+		}
+	}
+	if len(allocation) > 0 {
+		settings["routing"] = map[string]interface{}{
+			"allocation": allocation,
+		}
+	}
+	if indexMetadata.ReadOnlyAllowDelete {
+		settings["blocks"] = map[string]interface{}{
+			"read_only_allow_delete": "true",
+		}
+	}
+	return settings
+}
+
 type RestPutIndex struct {
+	clusterService     *cluster.Service
 	createIndexService *cluster.MetadataCreateIndexService
 }
 
-func NewRestPutIndex(clusterIndexService *cluster.MetadataCreateIndexService) *RestPutIndex {
+func NewRestPutIndex(clusterService *cluster.Service, clusterIndexService *cluster.MetadataCreateIndexService) *RestPutIndex {
 	return &RestPutIndex{
+		clusterService:     clusterService,
 		createIndexService: clusterIndexService,
 	}
 }
 
+// primariesActive tells whether every primary of the index is started.
+func primariesActive(clusterState *state.ClusterState, index string) bool {
+	indexMetadata, existing := clusterState.Metadata.Indices[index]
+	if !existing {
+		return false
+	}
+	health := cluster.NewIndexHealth(indexMetadata, clusterState.RoutingTable.IndicesRouting[index])
+	return health.ActivePrimaryShards == indexMetadata.NumberOfShards
+}
+
 func (h *RestPutIndex) Handle(r *RestRequest, reply ResponseListener) {
 	index := r.PathParams["index"]
 
@@ -129,21 +166,38 @@ func (h *RestPutIndex) Handle(r *RestRequest, reply ResponseListener) {
 		return
 	}
 
+	settings, _ := body["settings"].(map[string]interface{})
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
 	req := cluster.CreateIndexClusterStateUpdateRequest{
-		Index:    index,
-		Mappings: mapping,
-		Settings: body["settings"].(map[string]interface{}),
+		AckedRequest: ackedReq,
+		Index:        index,
+		Mappings:     mapping,
+		Settings:     settings,
+	}
+	if err := cluster.ValidateCreateIndex(req); err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	err = h.createIndexService.CreateIndex(req)
+	shardsAcknowledged := false
+	if err == nil {
+		// the primaries start once the master allocated them and the data nodes recovered them
+		_, shardsAcknowledged = h.clusterService.ApplierService.WaitForState(func(clusterState *state.ClusterState) bool {
+			return primariesActive(clusterState, index)
+		}, req.AckTimeout)
 	}
-	h.createIndexService.CreateIndex(req)
 
-	reply(RestResponse{
-		StatusCode: 200,
-		Body: map[string]interface{}{
-			"acknowledged":        true,
-			"shards_acknowledged": true,
-			"index":               index,
-		},
-	})
+	reply(acknowledgedResponse(err, map[string]interface{}{
+		"shards_acknowledged": shardsAcknowledged,
+		"index":               index,
+	}))
 }
 
 type RestDeleteIndex struct {
@@ -164,22 +218,23 @@ func (h *RestDeleteIndex) Handle(r *RestRequest, reply ResponseListener) {
 	indexExpression := r.PathParams["index"]
 	clusterState := h.clusterService.State()
 	indexNames := h.indexNameExpressionResolver.ConcreteIndexNames(*clusterState, indexExpression)
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
 
 	req := cluster.DeleteIndexClusterStateUpdateRequest{
-		Indices: []state.Index{},
+		AckedRequest: ackedReq,
+		Indices:      []state.Index{},
 	}
 	for _, indexName := range indexNames {
 		req.Indices = append(req.Indices, clusterState.Metadata.Indices[indexName].Index)
 	}
 
-	h.deleteIndexService.DeleteIndex(req)
+	err = h.deleteIndexService.DeleteIndex(req)
 
-	reply(RestResponse{
-		StatusCode: 200,
-		Body: map[string]interface{}{
-			"acknowledged": true,
-		},
-	})
+	reply(acknowledgedResponse(err, map[string]interface{}{}))
 }
 
 type RestHeadIndex struct {
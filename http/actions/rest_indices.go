@@ -1,9 +1,8 @@
 package actions
 
 import (
-	"bytes"
-	"encoding/gob"
 	"encoding/json"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/index"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
@@ -22,23 +21,21 @@ type indicesStatsRequest struct {
 	Shards []state.ShardRouting
 }
 
-func (r *indicesStatsRequest) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
+func (r *indicesStatsRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.NodeId)
+	out.WriteVInt(uint64(len(r.Shards)))
+	for i := range r.Shards {
+		r.Shards[i].WriteTo(out)
 	}
-	return buffer.Bytes()
 }
 
-func indicesStatsRequestFromBytes(b []byte) *indicesStatsRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req indicesStatsRequest
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func readIndicesStatsRequest(in *common.StreamInput) (*indicesStatsRequest, error) {
+	req := indicesStatsRequest{NodeId: in.ReadString()}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.Shards = append(req.Shards, state.ReadShardRouting(in))
 	}
-	return &req
+	return &req, in.Err()
 }
 
 type indicesStatsResponse struct {
@@ -46,23 +43,21 @@ type indicesStatsResponse struct {
 	ShardStats  []index.ShardStats
 }
 
-func (r *indicesStatsResponse) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
+func (r *indicesStatsResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteInt(r.TotalShards)
+	out.WriteVInt(uint64(len(r.ShardStats)))
+	for i := range r.ShardStats {
+		r.ShardStats[i].WriteTo(out)
 	}
-	return buffer.Bytes()
 }
 
-func indicesStatsResponseFromBytes(b []byte) *indicesStatsResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req indicesStatsResponse
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func readIndicesStatsResponse(in *common.StreamInput) (*indicesStatsResponse, error) {
+	res := indicesStatsResponse{TotalShards: in.ReadInt()}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.ShardStats = append(res.ShardStats, index.ReadShardStats(in))
 	}
-	return &req
+	return &res, in.Err()
 }
 
 type RestIndicesStatsAction struct {
@@ -74,12 +69,23 @@ type RestIndicesStatsAction struct {
 
 func NewRestIndicesStatsAction(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestIndicesStatsAction {
 	transportService.RegisterRequestHandler(IndicesStatsAction, func(channel transport.ReplyChannel, req []byte) {
-		indicesStatsReq := indicesStatsRequestFromBytes(req)
+		indicesStatsReq, err := readIndicesStatsRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
 		var shardStats []index.ShardStats
 
 		for _, shardRouting := range indicesStatsReq.Shards {
-			indexService := indicesService.Indices[shardRouting.ShardId.Index.Uuid]
-			indexShard, _ := indexService.Shard(shardRouting.ShardId.ShardId)
+			indexService, existing := indicesService.IndexService(shardRouting.ShardId.Index.Uuid)
+			if !existing {
+				continue
+			}
+			// a copy that is still recovering has no shard yet
+			indexShard, existing := indexService.Shard(shardRouting.ShardId.ShardId)
+			if !existing {
+				continue
+			}
 			shardStats = append(shardStats, indexShard.Stats())
 		}
 
@@ -88,7 +94,7 @@ func NewRestIndicesStatsAction(clusterService *cluster.Service, indicesService *
 			ShardStats:  shardStats,
 		}
 
-		channel.SendMessage(IndicesStatsAction, indicesStatsRes.toBytes())
+		channel.SendMessage(IndicesStatsAction, common.ToBytes(&indicesStatsRes, channel.GetVersion()))
 	})
 
 	return &RestIndicesStatsAction{
@@ -112,6 +118,9 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 		indexRoutingTable := clusterState.RoutingTable.IndicesRouting[indexName]
 		for _, indexShardRoutingTable := range indexRoutingTable.Shards {
 			shard := indexShardRoutingTable.Primary
+			if shard.CurrentNodeId == "" {
+				continue
+			}
 
 			nodeId := shard.CurrentNodeId
 			if shardList, existing := nodeIds[nodeId]; existing {
@@ -142,6 +151,8 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 	}
 
 	responses := make([]indicesStatsResponse, len(nodeIds))
+	var failures []interface{}
+	mux := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(nodeIds))
 	idx := -1
@@ -153,15 +164,42 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 			Shards: shards,
 		}
 		currIdx := idx
-		h.transportService.SendRequest(node, IndicesStatsAction, indicesStatsReq.toBytes(), func(response []byte) {
-			indicesStatsRes := indicesStatsResponseFromBytes(response)
-			responses[currIdx] = *indicesStatsRes
-			wg.Done()
+		nodeShards := shards
+		onFailure := func(err error) {
+			mux.Lock()
+			for _, shard := range nodeShards {
+				failures = append(failures, map[string]interface{}{
+					"index":  shard.ShardId.Index.Name,
+					"shard":  shard.ShardId.ShardId,
+					"status": "INTERNAL_SERVER_ERROR",
+					"reason": map[string]interface{}{
+						"type":   transport.ErrorType(err),
+						"reason": err.Error(),
+					},
+				})
+			}
+			mux.Unlock()
+		}
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, IndicesStatsAction, common.ToBytes(&indicesStatsReq, version), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				indicesStatsRes, err := readIndicesStatsResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				responses[currIdx] = *indicesStatsRes
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
 		})
 	}
 	wg.Wait()
 
-	totalShards := 0
+	totalShards := len(failures)
 	indicesStats := map[string]index.Stats{}
 	for _, response := range responses {
 		totalShards += response.TotalShards
@@ -187,18 +225,22 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 	allDocsCount := uint64(0)
 	allDocsDeleted := uint64(0)
 	allSizesInBytes := uint64(0)
+	allTranslog := index.TranslogStats{}
 	for indexName, indexStats := range indicesStats {
 		docsCount := uint64(0)
 		docsDeleted := uint64(0)
 		sizesInBytes := uint64(0)
+		translog := index.TranslogStats{}
 		for _, shardStats := range indexStats.ShardStats {
 			docsCount += shardStats.NumDocs
 			docsDeleted += shardStats.UserData["deletes"].(uint64)
 			sizesInBytes += shardStats.UserData["num_bytes_used_disk"].(uint64)
+			translog = addTranslogStats(translog, shardStats.Translog)
 		}
 		allDocsCount += docsCount
 		allDocsDeleted += docsDeleted
 		allSizesInBytes += sizesInBytes
+		allTranslog = addTranslogStats(allTranslog, translog)
 
 		indicesMap[indexName] = map[string]interface{}{
 			"uuid": indexStats.Uuid,
@@ -210,6 +252,7 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 				"store": map[string]interface{}{
 					"size_in_bytes": sizesInBytes,
 				},
+				"translog": translogStatsToMap(translog),
 				"indexing": map[string]interface{}{
 					"index_total":           docsCount,
 					"index_time_in_millis":  -1,
@@ -228,6 +271,7 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 				"store": map[string]interface{}{
 					"size_in_bytes": sizesInBytes,
 				},
+				"translog": translogStatsToMap(translog),
 				"indexing": map[string]interface{}{
 					"index_total":           docsCount,
 					"index_time_in_millis":  -1,
@@ -244,11 +288,7 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 	reply(RestResponse{
 		StatusCode: 200,
 		Body: map[string]interface{}{
-			"_shards": map[string]interface{}{
-				"total":      totalShards,
-				"successful": totalShards,
-				"failed":     0,
-			},
+			"_shards": shardsHeader(totalShards, totalShards-len(failures), failures),
 			"_all": map[string]interface{}{
 				"primaries": map[string]interface{}{
 					"docs": map[string]interface{}{
@@ -258,6 +298,7 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 					"store": map[string]interface{}{
 						"size_in_bytes": allSizesInBytes,
 					},
+					"translog": translogStatsToMap(allTranslog),
 					"indexing": map[string]interface{}{
 						"index_total":           allDocsCount,
 						"index_time_in_millis":  -1,
@@ -276,6 +317,7 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 					"store": map[string]interface{}{
 						"size_in_bytes": allSizesInBytes,
 					},
+					"translog": translogStatsToMap(allTranslog),
 					"indexing": map[string]interface{}{
 						"index_total":           allDocsCount,
 						"index_time_in_millis":  -1,
@@ -292,6 +334,24 @@ func (h *RestIndicesStatsAction) Handle(r *RestRequest, reply ResponseListener)
 	})
 }
 
+func addTranslogStats(a index.TranslogStats, b index.TranslogStats) index.TranslogStats {
+	return index.TranslogStats{
+		Operations:             a.Operations + b.Operations,
+		SizeInBytes:            a.SizeInBytes + b.SizeInBytes,
+		UncommittedOperations:  a.UncommittedOperations + b.UncommittedOperations,
+		UncommittedSizeInBytes: a.UncommittedSizeInBytes + b.UncommittedSizeInBytes,
+	}
+}
+
+func translogStatsToMap(stats index.TranslogStats) map[string]interface{} {
+	return map[string]interface{}{
+		"operations":                stats.Operations,
+		"size_in_bytes":             stats.SizeInBytes,
+		"uncommitted_operations":    stats.UncommittedOperations,
+		"uncommitted_size_in_bytes": stats.UncommittedSizeInBytes,
+	}
+}
+
 type RestGetMappings struct {
 	clusterService              *cluster.Service
 	indexNameExpressionResolver *indices.NameExpressionResolver
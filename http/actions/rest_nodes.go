@@ -1,14 +1,12 @@
 package actions
 
 import (
-	"bytes"
-	"encoding/gob"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/monitor"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
 	"github.com/actumn/searchgoose/state/transport"
-	"github.com/sirupsen/logrus"
 	"os"
 	"sync"
 )
@@ -23,23 +21,17 @@ type nodeInfoResponse struct {
 	NodeInfo monitor.Info
 }
 
-func (r *nodeInfoResponse) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
+func (r *nodeInfoResponse) WriteTo(out *common.StreamOutput) {
+	r.Node.WriteTo(out)
+	r.NodeInfo.WriteTo(out)
 }
 
-func nodeInfoResponseFromBytes(b []byte) *nodeInfoResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req nodeInfoResponse
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func readNodeInfoResponse(in *common.StreamInput) (*nodeInfoResponse, error) {
+	res := nodeInfoResponse{
+		Node:     state.ReadNode(in),
+		NodeInfo: monitor.ReadInfo(in),
 	}
-	return &req
+	return &res, in.Err()
 }
 
 type RestNodesInfo struct {
@@ -56,7 +48,7 @@ func NewRestNodesInfo(clusterService *cluster.Service, transportService *transpo
 			Node:     *transportService.LocalNode,
 			NodeInfo: info,
 		}
-		channel.SendMessage("", nodeRes.toBytes())
+		channel.SendMessage("", common.ToBytes(&nodeRes, channel.GetVersion()))
 	})
 
 	return &RestNodesInfo{
@@ -93,17 +85,37 @@ func (h *RestNodesInfo) Handle(r *RestRequest, reply ResponseListener) {
 		return
 	}
 
-	responses := make([]nodeInfoResponse, len(nodes))
+	// a node that failed has no response
+	responses := make([]*nodeInfoResponse, len(nodes))
+	var failures []interface{}
+	mux := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(nodes))
 	idx := -1
 	for _, node := range nodes {
 		idx += 1
 		currIdx := idx
-		h.transportService.SendRequest(node, NodesInfoAction, []byte(""), func(response []byte) {
-			nodeStatsRes := nodeInfoResponseFromBytes(response)
-			responses[currIdx] = *nodeStatsRes
-			wg.Done()
+		nodeId := node.Id
+		onFailure := func(err error) {
+			mux.Lock()
+			failures = append(failures, nodeFailure(nodeId, err))
+			mux.Unlock()
+		}
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, NodesInfoAction, []byte(""), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readNodeInfoResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				responses[currIdx] = res
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
 		})
 	}
 	wg.Wait()
@@ -111,16 +123,21 @@ func (h *RestNodesInfo) Handle(r *RestRequest, reply ResponseListener) {
 	wd, _ := os.Getwd()
 	nodesMap := map[string]interface{}{}
 	for _, response := range responses {
+		if response == nil {
+			continue
+		}
 		nodesMap[response.Node.Id] = map[string]interface{}{
 			"transport_address": response.Node.HostAddress,
 			"host":              response.Node.HostAddress,
 			"ip":                response.Node.HostAddress,
 			"version":           "7.8.1",
-			"roles":             []string{"master", "data"},
+			"roles":             nodeRoles(response.Node),
+			"attributes":        response.Node.Attributes,
 			"settings": map[string]interface{}{
 				"node": map[string]interface{}{
-					"master": true,
-					"data":   true,
+					"master": response.Node.IsMasterNode(),
+					"data":   response.Node.IsDataNode(),
+					"ingest": response.Node.IsIngestNode(),
 				},
 				"path": map[string]interface{}{
 					"data": []string{
@@ -151,11 +168,7 @@ func (h *RestNodesInfo) Handle(r *RestRequest, reply ResponseListener) {
 	reply(RestResponse{
 		StatusCode: 200,
 		Body: map[string]interface{}{
-			"_nodes": map[string]interface{}{
-				"total":      len(nodes),
-				"successful": len(nodes),
-				"failed":     0,
-			},
+			"_nodes":       nodesHeader(len(nodes), failures),
 			"cluster_name": clusterState.Name,
 			"nodes":        nodesMap,
 		},
@@ -163,28 +176,27 @@ func (h *RestNodesInfo) Handle(r *RestRequest, reply ResponseListener) {
 }
 
 type nodeStatsResponse struct {
-	Node         state.Node
-	NodeStats    monitor.Stats
-	IndicesStats indices.Stats
+	Node           state.Node
+	NodeStats      monitor.Stats
+	IndicesStats   indices.Stats
+	TransportStats transport.Stats
 }
 
-func (r *nodeStatsResponse) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
+func (r *nodeStatsResponse) WriteTo(out *common.StreamOutput) {
+	r.Node.WriteTo(out)
+	r.NodeStats.WriteTo(out)
+	r.IndicesStats.WriteTo(out)
+	r.TransportStats.WriteTo(out)
 }
 
-func nodeStatsResponseFromBytes(b []byte) *nodeStatsResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var req nodeStatsResponse
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func readNodeStatsResponse(in *common.StreamInput) (*nodeStatsResponse, error) {
+	res := nodeStatsResponse{
+		Node:           state.ReadNode(in),
+		NodeStats:      monitor.ReadStats(in),
+		IndicesStats:   indices.ReadStats(in),
+		TransportStats: transport.ReadStats(in),
 	}
-	return &req
+	return &res, in.Err()
 }
 
 type RestNodesStats struct {
@@ -214,11 +226,12 @@ func NewRestNodesStats(clusterService *cluster.Service, indicesService *indices.
 		}
 
 		nodeRes := nodeStatsResponse{
-			Node:         *transportService.LocalNode,
-			NodeStats:    stats,
-			IndicesStats: indicesStats,
+			Node:           *transportService.LocalNode,
+			NodeStats:      stats,
+			IndicesStats:   indicesStats,
+			TransportStats: transportService.Stats(),
 		}
-		channel.SendMessage("", nodeRes.toBytes())
+		channel.SendMessage("", common.ToBytes(&nodeRes, channel.GetVersion()))
 	})
 
 	return &RestNodesStats{
@@ -255,17 +268,37 @@ func (h *RestNodesStats) Handle(r *RestRequest, reply ResponseListener) {
 		return
 	}
 
-	responses := make([]nodeStatsResponse, len(nodes))
+	// a node that failed has no response
+	responses := make([]*nodeStatsResponse, len(nodes))
+	var failures []interface{}
+	mux := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(len(nodes))
 	idx := -1
 	for _, node := range nodes {
 		idx += 1
 		currIdx := idx
-		h.transportService.SendRequest(node, NodesStatsAction, []byte(""), func(response []byte) {
-			nodeStatsRes := nodeStatsResponseFromBytes(response)
-			responses[currIdx] = *nodeStatsRes
-			wg.Done()
+		nodeId := node.Id
+		onFailure := func(err error) {
+			mux.Lock()
+			failures = append(failures, nodeFailure(nodeId, err))
+			mux.Unlock()
+		}
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, NodesStatsAction, []byte(""), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readNodeStatsResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				responses[currIdx] = res
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
 		})
 	}
 	wg.Wait()
@@ -273,12 +306,15 @@ func (h *RestNodesStats) Handle(r *RestRequest, reply ResponseListener) {
 	wd, _ := os.Getwd()
 	nodeStatsMap := map[string]interface{}{}
 	for _, response := range responses {
+		if response == nil {
+			continue
+		}
 		nodeStatsMap[response.Node.Id] = map[string]interface{}{
 			"name":              response.Node.Name,
 			"transport_address": response.Node.HostAddress,
 			"host":              response.Node.HostAddress,
 			"ip":                response.Node.HostAddress,
-			"roles":             []string{"data", "master"},
+			"roles":             nodeRoles(response.Node),
 			"indices": map[string]interface{}{
 				"docs": map[string]interface{}{
 					"count":   response.IndicesStats.NumDocs,
@@ -288,6 +324,7 @@ func (h *RestNodesStats) Handle(r *RestRequest, reply ResponseListener) {
 					"size_in_bytes": response.IndicesStats.NumBytes,
 				},
 			},
+			"transport": transportStatsBody(response.TransportStats),
 			"jvm": map[string]interface{}{
 				"mem": map[string]interface{}{
 					"heap_used_in_bytes": response.NodeStats.Runtime.HeapAlloc,
@@ -343,13 +380,44 @@ func (h *RestNodesStats) Handle(r *RestRequest, reply ResponseListener) {
 	reply(RestResponse{
 		StatusCode: 200,
 		Body: map[string]interface{}{
-			"_nodes": map[string]interface{}{
-				"total":      len(nodes),
-				"successful": len(nodes),
-				"failed":     0,
-			},
+			"_nodes":       nodesHeader(len(nodes), failures),
 			"cluster_name": clusterState.Name,
 			"nodes":        nodeStatsMap,
 		},
 	})
 }
+
+// nodeRoles lists the roles of a node, empty for a coordinating-only node.
+func nodeRoles(node state.Node) []string {
+	if node.Roles == nil {
+		return []string{}
+	}
+	return node.Roles
+}
+
+func transportStatsBody(stats transport.Stats) map[string]interface{} {
+	connections := []map[string]interface{}{}
+	for _, connection := range stats.Connections {
+		connections = append(connections, map[string]interface{}{
+			"local_address":    connection.LocalAddress,
+			"remote_address":   connection.RemoteAddress,
+			"inbound":          connection.Inbound,
+			"version":          connection.Version,
+			"rx_count":         connection.RxCount,
+			"rx_size_in_bytes": connection.RxSize,
+			"tx_count":         connection.TxCount,
+			"tx_size_in_bytes": connection.TxSize,
+			"pending_requests": connection.PendingRequests,
+			"queued_messages":  connection.QueuedMessages,
+		})
+	}
+	return map[string]interface{}{
+		"server_open":      stats.ServerOpen,
+		"client_open":      stats.ClientOpen,
+		"rx_count":         stats.RxCount,
+		"rx_size_in_bytes": stats.RxSize,
+		"tx_count":         stats.TxCount,
+		"tx_size_in_bytes": stats.TxSize,
+		"connections":      connections,
+	}
+}
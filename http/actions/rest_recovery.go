@@ -0,0 +1,257 @@
+package actions
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	RecoveryAction = "indices:monitor/recovery"
+)
+
+type nodeRecoveryResponse struct {
+	RecoveryStates []indices.RecoveryState
+}
+
+func (r *nodeRecoveryResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(uint64(len(r.RecoveryStates)))
+	for i := range r.RecoveryStates {
+		r.RecoveryStates[i].WriteTo(out)
+	}
+}
+
+func readNodeRecoveryResponse(in *common.StreamInput) (*nodeRecoveryResponse, error) {
+	var res nodeRecoveryResponse
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.RecoveryStates = append(res.RecoveryStates, indices.ReadRecoveryState(in))
+	}
+	return &res, in.Err()
+}
+
+func collectRecoveryStates(clusterState *state.ClusterState, transportService *transport.Service, concreteIndices []string, activeOnly bool) []indices.RecoveryState {
+	indexNames := map[string]struct{}{}
+	for _, indexName := range concreteIndices {
+		indexNames[indexName] = struct{}{}
+	}
+
+	var recoveryStates []indices.RecoveryState
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(clusterState.Nodes.Nodes))
+	for _, node := range clusterState.Nodes.Nodes {
+		nodeId := node.Id
+		version := transportService.GetVersion(node)
+		transportService.SendRequestWithHandler(node, RecoveryAction, []byte(""), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readNodeRecoveryResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					logrus.Warnf("failed to get the recoveries of node [%s]: %v", nodeId, err)
+					return
+				}
+				mux.Lock()
+				defer mux.Unlock()
+				for _, recoveryState := range res.RecoveryStates {
+					if _, ok := indexNames[recoveryState.ShardId.Index.Name]; !ok {
+						continue
+					}
+					if activeOnly && recoveryState.Stage == indices.RecoveryStageDone {
+						continue
+					}
+					recoveryStates = append(recoveryStates, recoveryState)
+				}
+			},
+			OnFailure: func(err error) {
+				// the recoveries of the node are left out
+				logrus.Warnf("failed to get the recoveries of node [%s]: %v", nodeId, err)
+				wg.Done()
+			},
+		})
+	}
+	wg.Wait()
+
+	sort.Slice(recoveryStates, func(i, j int) bool {
+		if recoveryStates[i].ShardId.Index.Name != recoveryStates[j].ShardId.Index.Name {
+			return recoveryStates[i].ShardId.Index.Name < recoveryStates[j].ShardId.Index.Name
+		}
+		if recoveryStates[i].ShardId.ShardId != recoveryStates[j].ShardId.ShardId {
+			return recoveryStates[i].ShardId.ShardId < recoveryStates[j].ShardId.ShardId
+		}
+		return recoveryStates[i].Primary
+	})
+	return recoveryStates
+}
+
+func recoveryPercent(recovered int64, total int64) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(recovered)*100/float64(total))
+}
+
+func recoveryTime(recoveryState indices.RecoveryState) time.Duration {
+	if recoveryState.StopTime.IsZero() {
+		return time.Since(recoveryState.StartTime)
+	}
+	return recoveryState.StopTime.Sub(recoveryState.StartTime)
+}
+
+func recoveryNode(node state.Node) map[string]interface{} {
+	if node.Id == "" {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"id":                node.Id,
+		"host":              node.HostAddress,
+		"transport_address": node.HostAddress,
+		"name":              node.Name,
+	}
+}
+
+type RestRecovery struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
+}
+
+func NewRestRecovery(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestRecovery {
+	transportService.RegisterRequestHandler(RecoveryAction, func(channel transport.ReplyChannel, req []byte) {
+		res := nodeRecoveryResponse{
+			RecoveryStates: indicesService.RecoveryStates(),
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+
+	return &RestRecovery{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
+	}
+}
+
+func (h *RestRecovery) Handle(r *RestRequest, reply ResponseListener) {
+	clusterState := h.clusterService.State()
+	concreteIndices, ok := resolveBroadcastIndices(h.indexNameExpressionResolver, clusterState, r, reply)
+	if !ok {
+		return
+	}
+
+	body := map[string]interface{}{}
+	for _, recoveryState := range collectRecoveryStates(clusterState, h.transportService, concreteIndices, r.ParamAsBool("active_only", false)) {
+		shard := map[string]interface{}{
+			"id":                   recoveryState.ShardId.ShardId,
+			"type":                 recoveryState.Type,
+			"stage":                recoveryState.Stage,
+			"primary":              recoveryState.Primary,
+			"start_time_in_millis": recoveryState.StartTime.UnixNano() / int64(time.Millisecond),
+			"total_time_in_millis": recoveryTime(recoveryState).Milliseconds(),
+			"source":               recoveryNode(recoveryState.SourceNode),
+			"target":               recoveryNode(recoveryState.TargetNode),
+			"index": map[string]interface{}{
+				"size": map[string]interface{}{
+					"total_in_bytes":     recoveryState.TotalBytes,
+					"reused_in_bytes":    0,
+					"recovered_in_bytes": recoveryState.RecoveredBytes,
+					"percent":            recoveryPercent(recoveryState.RecoveredBytes, recoveryState.TotalBytes),
+				},
+				"files": map[string]interface{}{
+					"total":     recoveryState.TotalFiles,
+					"reused":    0,
+					"recovered": recoveryState.RecoveredFiles,
+					"percent":   recoveryPercent(int64(recoveryState.RecoveredFiles), int64(recoveryState.TotalFiles)),
+				},
+			},
+			"translog": map[string]interface{}{
+				"recovered": recoveryState.RecoveredTranslogOps,
+				"total":     recoveryState.TotalTranslogOps,
+				"percent":   recoveryPercent(int64(recoveryState.RecoveredTranslogOps), int64(recoveryState.TotalTranslogOps)),
+			},
+		}
+		if !recoveryState.StopTime.IsZero() {
+			shard["stop_time_in_millis"] = recoveryState.StopTime.UnixNano() / int64(time.Millisecond)
+		}
+
+		indexName := recoveryState.ShardId.Index.Name
+		indexRecovery, existing := body[indexName].(map[string]interface{})
+		if !existing {
+			indexRecovery = map[string]interface{}{
+				"shards": []interface{}{},
+			}
+			body[indexName] = indexRecovery
+		}
+		indexRecovery["shards"] = append(indexRecovery["shards"].([]interface{}), shard)
+	}
+
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       body,
+	})
+}
+
+type RestCatRecovery struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
+}
+
+func NewRestCatRecovery(clusterService *cluster.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestCatRecovery {
+	return &RestCatRecovery{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
+	}
+}
+
+func (h *RestCatRecovery) Handle(r *RestRequest, reply ResponseListener) {
+	clusterState := h.clusterService.State()
+	concreteIndices, ok := resolveBroadcastIndices(h.indexNameExpressionResolver, clusterState, r, reply)
+	if !ok {
+		return
+	}
+
+	recoveries := []map[string]interface{}{}
+	for _, recoveryState := range collectRecoveryStates(clusterState, h.transportService, concreteIndices, r.ParamAsBool("active_only", false)) {
+		sourceHost, sourceNode := "n/a", "n/a"
+		if recoveryState.SourceNode.Id != "" {
+			sourceHost, sourceNode = recoveryState.SourceNode.HostAddress, recoveryState.SourceNode.Name
+		}
+		recoveries = append(recoveries, map[string]interface{}{
+			"index":                  recoveryState.ShardId.Index.Name,
+			"shard":                  recoveryState.ShardId.ShardId,
+			"time":                   recoveryTime(recoveryState).String(),
+			"type":                   recoveryState.Type,
+			"stage":                  recoveryState.Stage,
+			"source_host":            sourceHost,
+			"source_node":            sourceNode,
+			"target_host":            recoveryState.TargetNode.HostAddress,
+			"target_node":            recoveryState.TargetNode.Name,
+			"repository":             "n/a",
+			"snapshot":               "n/a",
+			"files":                  recoveryState.TotalFiles,
+			"files_recovered":        recoveryState.RecoveredFiles,
+			"files_percent":          recoveryPercent(int64(recoveryState.RecoveredFiles), int64(recoveryState.TotalFiles)),
+			"files_total":            recoveryState.TotalFiles,
+			"bytes":                  recoveryState.TotalBytes,
+			"bytes_recovered":        recoveryState.RecoveredBytes,
+			"bytes_percent":          recoveryPercent(recoveryState.RecoveredBytes, recoveryState.TotalBytes),
+			"bytes_total":            recoveryState.TotalBytes,
+			"translog_ops":           recoveryState.TotalTranslogOps,
+			"translog_ops_recovered": recoveryState.RecoveredTranslogOps,
+			"translog_ops_percent":   recoveryPercent(int64(recoveryState.RecoveredTranslogOps), int64(recoveryState.TotalTranslogOps)),
+		})
+	}
+
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       recoveries,
+	})
+}
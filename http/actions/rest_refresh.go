@@ -1,30 +1,86 @@
 package actions
 
-import "github.com/actumn/searchgoose/state/cluster"
+import (
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+)
+
+const (
+	RefreshAction = "indices:admin/refresh"
+)
+
+const (
+	refreshFalse   = "false"
+	refreshTrue    = "true"
+	refreshWaitFor = "wait_for"
+)
+
+// refreshPolicy reads the refresh parameter of a write request. "?refresh" without a value means true.
+func refreshPolicy(r *RestRequest) (string, error) {
+	value, existing := r.QueryParams["refresh"]
+	if !existing {
+		return refreshFalse, nil
+	}
+	switch string(value) {
+	case "", refreshTrue:
+		return refreshTrue, nil
+	case refreshFalse, refreshWaitFor:
+		return string(value), nil
+	}
+	return "", invalidParameter("refresh", string(value))
+}
+
+// applyRefreshPolicy makes a write up to seqNo visible to searches as the refresh policy asks for.
+// It reports whether the shard has been refreshed for the request.
+func applyRefreshPolicy(indexShard *index.Shard, policy string, seqNo int64) (bool, error) {
+	switch policy {
+	case refreshTrue:
+		return true, indexShard.Refresh()
+	case refreshWaitFor:
+		return false, indexShard.WaitForRefresh(seqNo)
+	}
+	return false, nil
+}
+
+// withForcedRefresh adds forced_refresh to a write response when the write refreshed the shard.
+func withForcedRefresh(body map[string]interface{}, forcedRefresh bool) map[string]interface{} {
+	if forcedRefresh {
+		body["forced_refresh"] = true
+	}
+	return body
+}
 
 type RestRefresh struct {
-	clusterService *cluster.Service
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
 }
 
-func NewRestRefresh(clusterService *cluster.Service) *RestRefresh {
+func NewRestRefresh(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestRefresh {
+	registerBroadcastShardAction(indicesService, transportService, RefreshAction, func(indexShard *index.Shard, params map[string]string) error {
+		return indexShard.Refresh()
+	})
+
 	return &RestRefresh{
-		clusterService: clusterService,
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
 	}
 }
 
 func (h *RestRefresh) Handle(r *RestRequest, reply ResponseListener) {
-	// TODO:: broadcast request and reply appropriate response
-	index := r.PathParams["index"]
 	clusterState := h.clusterService.State()
-	shardCount := clusterState.Metadata.Indices[index].NumberOfShards
+	concreteIndices, ok := resolveBroadcastIndices(h.indexNameExpressionResolver, clusterState, r, reply)
+	if !ok {
+		return
+	}
+
 	reply(RestResponse{
 		StatusCode: 200,
 		Body: map[string]interface{}{
-			"_shard": map[string]interface{}{
-				"total":      shardCount,
-				"successful": shardCount,
-				"failed":     0,
-			},
+			"_shards": broadcastShardOperation(clusterState, h.transportService, RefreshAction, concreteIndices, false, nil, "refresh_failed_engine_exception"),
 		},
 	})
 }
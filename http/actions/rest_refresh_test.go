@@ -0,0 +1,20 @@
+package actions
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRefreshPolicy(t *testing.T) {
+	policy := func(params map[string][]byte) string {
+		p, _ := refreshPolicy(&RestRequest{QueryParams: params})
+		return p
+	}
+
+	assert.Equal(t, refreshFalse, policy(map[string][]byte{}))
+	assert.Equal(t, refreshTrue, policy(map[string][]byte{"refresh": []byte("")}))
+	assert.Equal(t, refreshWaitFor, policy(map[string][]byte{"refresh": []byte("wait_for")}))
+
+	_, err := refreshPolicy(&RestRequest{QueryParams: map[string][]byte{"refresh": []byte("later")}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,385 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/actumn/searchgoose/tasks"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	ReindexAction = "indices:data/write/reindex"
+
+	// defaultRemoteScroll is how long the remote cluster keeps the scroll of a reindex between two pages
+	defaultRemoteScroll = "5m"
+)
+
+// remoteSource reads the source documents of a remote elasticsearch cluster with its scroll API.
+type remoteSource struct {
+	host      string
+	index     string
+	query     map[string]interface{}
+	size      int
+	keepAlive string
+	username  string
+	password  string
+	headers   map[string]string
+	client    *http.Client
+}
+
+func remoteSourceFromBody(body map[string]interface{}, sourceIndex string, whitelist []string) (*remoteSource, error) {
+	host, _ := body["host"].(string)
+	u, err := url.Parse(host)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("[host] must be of the form [scheme]://[host]:[port] but was [%s]", host)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme [%s]", u.Scheme)
+	}
+	if !remoteWhitelisted(whitelist, u.Host) {
+		return nil, fmt.Errorf("[%s] not whitelisted in reindex.remote.whitelist", u.Host)
+	}
+
+	socketTimeout, connectTimeout := 30*time.Second, 30*time.Second
+	if v, ok := body["socket_timeout"].(string); ok {
+		if socketTimeout, err = time.ParseDuration(v); err != nil {
+			return nil, invalidParameter("socket_timeout", v)
+		}
+	}
+	if v, ok := body["connect_timeout"].(string); ok {
+		if connectTimeout, err = time.ParseDuration(v); err != nil {
+			return nil, invalidParameter("connect_timeout", v)
+		}
+	}
+
+	source := &remoteSource{
+		host:      strings.TrimSuffix(host, "/"),
+		index:     sourceIndex,
+		keepAlive: defaultRemoteScroll,
+		headers:   map[string]string{},
+		client: &http.Client{
+			Timeout: socketTimeout,
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{Timeout: connectTimeout}).DialContext,
+			},
+		},
+	}
+	source.username, _ = body["username"].(string)
+	source.password, _ = body["password"].(string)
+	if headers, ok := body["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			source.headers[k] = fmt.Sprint(v)
+		}
+	}
+	return source, nil
+}
+
+// remoteWhitelisted matches host:port against the patterns of reindex.remote.whitelist, e.g. "localhost:*".
+// An empty whitelist allows no host.
+func remoteWhitelisted(whitelist []string, host string) bool {
+	for _, pattern := range whitelist {
+		if matched, _ := path.Match(strings.TrimSpace(pattern), host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+type remoteSearchResponse struct {
+	ScrollId string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Index   string                 `json:"_index"`
+			Id      string                 `json:"_id"`
+			Routing string                 `json:"_routing"`
+			Version int64                  `json:"_version"`
+			Source  map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// do sends a request to the remote cluster and returns the body of its response, a status other than 200 is an error.
+func (s *remoteSource) do(method string, requestPath string, body interface{}) ([]byte, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, s.host+requestPath, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("remote request [%s %s] failed with status [%d]: %s", method, requestPath, resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+// search opens a scroll on the remote source indices when scrollId is empty, otherwise it reads the next page of it.
+func (s *remoteSource) search(scrollId string) (*remoteSearchResponse, error) {
+	var respBody []byte
+	var err error
+	if scrollId == "" {
+		query := s.query
+		if query == nil {
+			query = map[string]interface{}{"match_all": map[string]interface{}{}}
+		}
+		respBody, err = s.do("POST", "/"+url.PathEscape(s.index)+"/_search?scroll="+url.QueryEscape(s.keepAlive), map[string]interface{}{
+			"query":   query,
+			"size":    s.size,
+			"sort":    []interface{}{"_doc"},
+			"version": true,
+		})
+	} else {
+		respBody, err = s.do("POST", "/_search/scroll", map[string]interface{}{
+			"scroll":    s.keepAlive,
+			"scroll_id": scrollId,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res remoteSearchResponse
+	if err := json.Unmarshal(respBody, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// clearScroll releases the scroll on the remote cluster, the remote frees it anyway once the keep alive expires.
+func (s *remoteSource) clearScroll(scrollId string) {
+	if _, err := s.do("DELETE", "/_search/scroll", map[string]interface{}{"scroll_id": []string{scrollId}}); err != nil {
+		logrus.Warnf("failed to clear the remote scroll [%s]: %v", scrollId, err)
+	}
+}
+
+func (s *remoteSource) scroll(slice int, stopped func() bool, consume func(indexName string, hits []index.ScrollHit) bool) error {
+	var scrollId string
+	defer func() {
+		if scrollId != "" {
+			s.clearScroll(scrollId)
+		}
+	}()
+	for !stopped() {
+		res, err := s.search(scrollId)
+		if err != nil {
+			return err
+		}
+		if res.ScrollId == "" {
+			return fmt.Errorf("remote search did not return a scroll id")
+		}
+		scrollId = res.ScrollId
+		if len(res.Hits.Hits) == 0 {
+			return nil
+		}
+
+		// hand the page over in runs of documents of the same index
+		var hits []index.ScrollHit
+		indexName := res.Hits.Hits[0].Index
+		for _, hit := range res.Hits.Hits {
+			if hit.Index != indexName {
+				if !consume(indexName, hits) {
+					return nil
+				}
+				hits, indexName = nil, hit.Index
+			}
+			hits = append(hits, index.ScrollHit{
+				Id:      hit.Id,
+				Routing: hit.Routing,
+				Version: hit.Version,
+				SeqNo:   -1,
+				Source:  hit.Source,
+			})
+		}
+		if !consume(indexName, hits) {
+			return nil
+		}
+	}
+	return nil
+}
+
+type RestReindex struct {
+	clusterService              *cluster.Service
+	createIndexService          *cluster.MetadataCreateIndexService
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	taskManager                 *tasks.Manager
+	executor                    *bulkByScrollExecutor
+	remoteWhitelist             []string
+}
+
+func NewRestReindex(clusterService *cluster.Service, createIndexService *cluster.MetadataCreateIndexService, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service, taskManager *tasks.Manager, remoteWhitelist []string) *RestReindex {
+	return &RestReindex{
+		clusterService:              clusterService,
+		createIndexService:          createIndexService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		taskManager:                 taskManager,
+		executor:                    newBulkByScrollExecutor(clusterService, transportService),
+		remoteWhitelist:             remoteWhitelist,
+	}
+}
+
+func (h *RestReindex) Handle(r *RestRequest, reply ResponseListener) {
+	body, err := parseBulkByScrollBody(r)
+	if err != nil {
+		reply(newErrorResponse(400, "parse_exception", err.Error()))
+		return
+	}
+	source, _ := body["source"].(map[string]interface{})
+	dest, _ := body["dest"].(map[string]interface{})
+	sourceIndices := reindexSourceIndices(source)
+	destIndex, _ := dest["index"].(string)
+	if len(sourceIndices) == 0 || destIndex == "" {
+		reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: use _reindex with a source index and a dest index;"))
+		return
+	}
+	opType, _ := dest["op_type"].(string)
+	if opType != "" && opType != "index" && opType != "create" {
+		reply(newErrorResponse(400, "illegal_argument_exception", "invalid op_type ["+opType+"]"))
+		return
+	}
+	routing, _ := dest["routing"].(string)
+	if routing != "" && routing != "keep" && routing != "discard" && !strings.HasPrefix(routing, "=") {
+		reply(newErrorResponse(400, "illegal_argument_exception", "routing must be unset, [keep], [discard] or [=<some new value>]"))
+		return
+	}
+
+	request, err := bulkByScrollRequestFromRest(r, body)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	request.query, _ = source["query"].(map[string]interface{})
+	// the script may send a document to another index than the destination, or delete it
+	request.authentication = r.Authentication
+	if size, ok := source["size"].(float64); ok && size > 0 {
+		request.setScrollSize(int(size))
+	}
+
+	clusterState := h.clusterService.State()
+	if remote, ok := source["remote"].(map[string]interface{}); ok {
+		if request.slices != 1 {
+			reply(newErrorResponse(400, "illegal_argument_exception", "reindex from remote sources doesn't support slices"))
+			return
+		}
+		if request.remote, err = remoteSourceFromBody(remote, strings.Join(sourceIndices, ","), h.remoteWhitelist); err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+			return
+		}
+		request.remote.query = request.query
+		request.remote.size = request.scrollSize
+		if scroll := r.Param("scroll"); scroll != "" {
+			if _, err := time.ParseDuration(scroll); err != nil {
+				reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("scroll", scroll).Error()))
+				return
+			}
+			request.remote.keepAlive = scroll
+		}
+	} else {
+		for _, expression := range sourceIndices {
+			request.indices = append(request.indices, h.indexNameExpressionResolver.ConcreteIndexNames(*clusterState, expression)...)
+		}
+		if len(request.indices) == 0 {
+			reply(newErrorResponse(404, "index_not_found_exception", "no such index ["+strings.Join(sourceIndices, ",")+"]"))
+			return
+		}
+		for _, indexName := range request.indices {
+			if indexName == destIndex {
+				reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: reindex cannot write into an index its reading from ["+destIndex+"];"))
+				return
+			}
+		}
+	}
+
+	if h.indexNameExpressionResolver.ConcreteSingleIndex(*clusterState, destIndex).Name == "" {
+		req := cluster.CreateIndexClusterStateUpdateRequest{
+			Index:    destIndex,
+			Mappings: []byte(`{ "properties": {} }`),
+			Settings: map[string]interface{}{
+				"number_of_shards": 1.0,
+			},
+		}
+		if err := h.createIndexService.CreateIndex(req); err != nil {
+			if response := clusterStateUpdateError(err); response != nil {
+				reply(*response)
+				return
+			}
+			reply(newErrorResponse(500, "exception", "failed to create the dest index ["+destIndex+"]: "+err.Error()))
+			return
+		}
+	}
+
+	description := "reindex from [" + strings.Join(sourceIndices, ",") + "] to [" + destIndex + "]"
+	if request.remote != nil {
+		description = "reindex from [host=" + request.remote.host + "][" + request.remote.index + "] to [" + destIndex + "]"
+	}
+	runBulkByScroll(r, reply, h.taskManager, h.executor, ReindexAction, description, request, func(indexName string, hit index.ScrollHit) (bulkItemRequest, bool, error) {
+		item, ok, err := prepareScriptedWrite(request.script, indexName, hit)
+		if err != nil || !ok {
+			return item, ok, err
+		}
+		// the script may route the document to another index, otherwise it goes to the destination.
+		if item.Index == indexName {
+			item.Index = destIndex
+		}
+		// documents are written with the internal versioning of the destination.
+		item.IfVersion = 0
+		// dest.routing keeps the routing of the source document by default.
+		switch {
+		case routing == "discard":
+			item.Routing = ""
+		case strings.HasPrefix(routing, "="):
+			item.Routing = routing[1:]
+		}
+		if item.OpType == "index" && opType == "create" {
+			item.OpType = "create"
+		}
+		return item, true, nil
+	})
+}
+
+// reindexSourceIndices reads source.index, which is either an index name or a list of names.
+func reindexSourceIndices(source map[string]interface{}) []string {
+	switch v := source["index"].(type) {
+	case string:
+		return strings.Split(v, ",")
+	case []interface{}:
+		var names []string
+		for _, name := range v {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+		return names
+	}
+	return nil
+}
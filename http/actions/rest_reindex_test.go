@@ -0,0 +1,64 @@
+package actions
+
+import (
+	"encoding/json"
+	"github.com/actumn/searchgoose/index"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteSource_Scroll(t *testing.T) {
+	// Arrange
+	var paths []string
+	var requests []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var body map[string]interface{}
+		_ = json.Unmarshal(b, &body)
+		paths = append(paths, r.Method+" "+r.URL.RequestURI())
+		requests = append(requests, body)
+
+		hits := []interface{}{}
+		if r.URL.Path != "/_search/scroll" {
+			hits = append(hits, map[string]interface{}{
+				"_index": "remote", "_id": "1", "_version": 2, "_source": map[string]interface{}{"n": 1},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"_scroll_id": "scrollId1",
+			"hits":       map[string]interface{}{"hits": hits},
+		})
+	}))
+	defer server.Close()
+	source, err := remoteSourceFromBody(map[string]interface{}{"host": server.URL}, "remote", []string{"127.0.0.1:*"})
+	source.size = 10
+
+	// Action
+	var consumed []index.ScrollHit
+	scrollErr := source.scroll(0, func() bool { return false }, func(indexName string, hits []index.ScrollHit) bool {
+		consumed = append(consumed, hits...)
+		return true
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Nil(t, scrollErr)
+	assert.Equal(t, 1, len(consumed))
+	assert.Equal(t, "1", consumed[0].Id)
+	assert.Equal(t, int64(2), consumed[0].Version)
+	assert.Equal(t, []string{"POST /remote/_search?scroll=5m", "POST /_search/scroll", "DELETE /_search/scroll"}, paths)
+	assert.Equal(t, "scrollId1", requests[1]["scroll_id"])
+	assert.Equal(t, []interface{}{"scrollId1"}, requests[2]["scroll_id"])
+}
+
+func TestRemoteWhitelisted(t *testing.T) {
+	assert.False(t, remoteWhitelisted(nil, "10.0.0.1:9200"))
+	assert.True(t, remoteWhitelisted([]string{"localhost:*"}, "localhost:8081"))
+	assert.False(t, remoteWhitelisted([]string{"localhost:*"}, "10.0.0.1:9200"))
+
+	_, err := remoteSourceFromBody(map[string]interface{}{"host": "localhost:9200"}, "remote", nil)
+	assert.NotNil(t, err)
+}
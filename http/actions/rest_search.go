@@ -1,17 +1,22 @@
 package actions
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/security"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/blevesearch/bleve"
-	"github.com/blevesearch/bleve/search/query"
+	"github.com/blevesearch/bleve/search"
 	"github.com/nqd/flat"
 	"github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"strings"
 )
 
 const (
@@ -29,29 +34,30 @@ type SearchRequest struct {
 	SearchIndex string
 	ShardId     state.ShardId
 	SearchBody  map[string]interface{}
+	// Authentication is the user of the request, the shard applies the document and field level security of its
+	// roles. It is nil when security is disabled.
+	Authentication *security.Authentication
 }
 
-func (r *SearchRequest) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := json.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
+func (r *SearchRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.SearchIndex)
+	r.ShardId.WriteTo(out)
+	out.WriteMap(r.SearchBody)
+	security.WriteOptionalAuthentication(out, r.Authentication)
 }
 
-func SearchRequestFromBytes(b []byte) *SearchRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := json.NewDecoder(buffer)
-	var req SearchRequest
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func ReadSearchRequest(in *common.StreamInput) (*SearchRequest, error) {
+	req := SearchRequest{
+		SearchIndex:    in.ReadString(),
+		ShardId:        state.ReadShardId(in),
+		SearchBody:     in.ReadMap(),
+		Authentication: security.ReadOptionalAuthentication(in),
 	}
-	return &req
+	return &req, in.Err()
 }
 
 type SearchResultData struct {
-	Results  *bleve.SearchResult
+	Total    uint64
 	DocList  []interface{}
 	MaxScore float64
 	Took     int64
@@ -61,28 +67,35 @@ type SearchResponse struct {
 	SearchResult SearchResultData
 }
 
-func (r *SearchResponse) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := json.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatal(err)
+func (r *SearchResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(r.SearchResult.Total)
+	out.WriteVInt(uint64(len(r.SearchResult.DocList)))
+	for _, doc := range r.SearchResult.DocList {
+		out.WriteGenericValue(doc)
 	}
-	return buffer.Bytes()
+	out.WriteFloat64(r.SearchResult.MaxScore)
+	out.WriteInt64(r.SearchResult.Took)
 }
 
-func SearchResponseFromBytes(b []byte) *SearchResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := json.NewDecoder(buffer)
-	var req SearchResponse
-	if err := decoder.Decode(&req); err != nil {
-		logrus.Fatal(err)
+func ReadSearchResponse(in *common.StreamInput) (*SearchResponse, error) {
+	var res SearchResponse
+	res.SearchResult.Total = in.ReadVInt()
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.SearchResult.DocList = append(res.SearchResult.DocList, in.ReadGenericValue())
 	}
-	return &req
+	res.SearchResult.MaxScore = in.ReadFloat64()
+	res.SearchResult.Took = in.ReadInt64()
+	return &res, in.Err()
 }
 
 func NewRestSearch(clusterService *cluster.Service, indicesService *indices.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestSearch {
 	transportService.RegisterRequestHandler(SearchAction, func(channel transport.ReplyChannel, req []byte) {
-		request := SearchRequestFromBytes(req)
+		request, err := ReadSearchRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
 		indexName := request.SearchIndex
 		body := request.SearchBody
 
@@ -94,57 +107,77 @@ func NewRestSearch(clusterService *cluster.Service, indicesService *indices.Serv
 		indexService, _ := indicesService.IndexService(request.ShardId.Index.Uuid)
 		indexShard, _ := indexService.Shard(request.ShardId.ShardId)
 
-		var q query.Query
 		var data SearchResultData
 
-		if k, found := qType["match"]; found {
-			q = index.SearchTypeMatch(k)
-		} else if k, found := qType["match_phrase"]; found {
-			q = index.SearchTypeMatchPhrase(k)
-		} else if _, found := qType["match_all"]; found {
-			q = bleve.NewMatchAllQuery()
-		} else if k, found := qType["prefix"]; found {
-			q = index.SearchTypePrefix(k)
-		} else if k, found := qType["fuzzy"]; found {
-			q = index.SearchTypeFuzzy(k)
-		} else if k, found := qType["bool"]; found {
-			q = index.SearchTypeBool(k)
-		} else if k, found := qType["range"]; found {
-			q = index.SearchTypeNumericRange(k)
-		} else {
-			logrus.Fatal("search error")
+		accessControl := security.AccessControl(request.Authentication, SearchRequestAction, indexName, clusterService.State().Metadata.Security)
+		if accessControl.RestrictsFields() {
+			qType = index.RestrictQueryFields(qType, accessControl.FieldAllowed)
+		}
+		q, err := index.NewQuery(qType)
+		if err != nil {
+			channel.SendError(err)
 			return
 		}
+		documentQuery, err := accessControl.Query()
+		if err != nil {
+			logrus.Warn(err)
+			documentQuery = bleve.NewMatchNoneQuery()
+		}
+		if documentQuery != nil {
+			q = bleve.NewConjunctionQuery(q, documentQuery)
+		}
 
-		searchRequest := bleve.NewSearchRequest(q)
+		// every shard returns its first from+size hits, the coordinating node merges and pages them.
+		from, size := searchPage(body)
+		searchRequest := bleve.NewSearchRequestOptions(q, from+size, 0, false)
 		searchRequest.Highlight = bleve.NewHighlight()
-		//searchRequest.sort
-		r, err := indexShard.Search(searchRequest)
+		sortFields, _ := index.NewSort(body["sort"])
+		sortFields = allowedSortFields(sortFields, accessControl)
+		if sortFields != nil {
+			searchRequest.SortBy(sortFields)
+		}
+		if searchAfter, ok := body["search_after"].([]interface{}); ok {
+			after := make([]string, len(searchAfter))
+			for i, v := range searchAfter {
+				after[i] = fmt.Sprint(v)
+			}
+			searchRequest.SetSearchAfter(after)
+		}
+
+		results, err := indexShard.Search(searchRequest)
 		if err != nil {
-			logrus.Fatal(err)
+			channel.SendError(err)
+			return
 		}
-		data.Results = r
+		data.Total = results.Total
 
-		for _, hits := range data.Results.Hits {
+		for _, hits := range results.Hits {
 			doc, _ := indexShard.Get(hits.ID)
-			src, _ := flat.Unflatten(doc, nil)
+			src, _ := flat.Unflatten(accessControl.FilterFields(doc), nil)
 			hitJson := map[string]interface{}{
 				"_index":    indexName,
 				"_type":     "_doc",
 				"_id":       hits.ID,
 				"_score":    hits.Score,
 				"_source":   src,
-				"highlight": hits.Fragments,
+				"highlight": allowedFragments(hits.Fragments, accessControl),
+			}
+			if sortFields != nil {
+				sortValues := make([]interface{}, len(hits.Sort))
+				for i, v := range hits.Sort {
+					sortValues[i] = v
+				}
+				hitJson["sort"] = sortValues
 			}
 			if data.MaxScore < hits.Score {
 				data.MaxScore = hits.Score
 			}
 			data.DocList = append(data.DocList, hitJson)
 		}
-		data.Took += data.Results.Took.Microseconds()
+		data.Took += results.Took.Microseconds()
 
 		res := SearchResponse{data}
-		channel.SendMessage("", res.ToBytes())
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
 	})
 
 	return &RestSearch{
@@ -166,23 +199,55 @@ func (h *RestSearch) Handle(r *RestRequest, reply ResponseListener) {
 			},
 		}
 	} else if err := json.Unmarshal(r.Body, &body); err != nil {
-		logrus.Fatal(err)
+		reply(newErrorResponse(400, "parse_exception", err.Error()))
+		return
+	}
+
+	for _, param := range []string{"from", "size"} {
+		if v, err := r.ParamAsInt(param, -1); err == nil && v >= 0 {
+			body[param] = float64(v)
+		}
 	}
 
 	clusterState := h.clusterService.State()
 	indexName := h.indexNameExpressionResolver.ConcreteSingleIndex(*clusterState, indexExpression).Name
-	shardNum := clusterState.Metadata.Indices[indexName].NumberOfShards
+	shards := cluster.SearchShards(*clusterState, indexName, r.Param("routing"))
+	shardNum := len(shards)
+	shardCountLimit := cluster.Settings(clusterState.Metadata.Settings()).GetInt(cluster.SearchShardCountLimitSetting, math.MaxInt32)
+	if shardNum > shardCountLimit {
+		reply(newErrorResponse(400, "illegal_argument_exception", fmt.Sprintf("Trying to query %d shards, which is over the limit of %d. This limit exists because querying many shards at the same time can make the job of the coordinating node very CPU and/or memory intensive. It is usually a better idea to have a smaller number of larger shards. Update [%s] to a greater value if you really want to query that many shards at the same time.", shardNum, shardCountLimit, cluster.SearchShardCountLimitSetting)))
+		return
+	}
 
-	totalResults := make(chan SearchResultData, shardNum)
+	type shardResult struct {
+		shardId state.ShardId
+		data    SearchResultData
+		err     error
+	}
+	totalResults := make(chan shardResult, shardNum)
 
-	for _, shardRouting := range clusterState.RoutingTable.IndicesRouting[indexName].Shards {
+	for _, shardRouting := range shards {
+		shardId := shardRouting.ShardId
 		req := SearchRequest{
-			SearchIndex: indexName,
-			ShardId:     shardRouting.ShardId,
-			SearchBody:  body,
+			SearchIndex:    indexName,
+			ShardId:        shardRouting.ShardId,
+			SearchBody:     body,
+			Authentication: r.Authentication,
 		}
-		h.transportService.SendRequest(clusterState.Nodes.Nodes[shardRouting.Primary.CurrentNodeId], SearchAction, req.toBytes(), func(response []byte) {
-			totalResults <- SearchResponseFromBytes(response).SearchResult
+		node := clusterState.Nodes.Nodes[shardRouting.Primary.CurrentNodeId]
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, SearchAction, common.ToBytes(&req, version), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				res, err := ReadSearchResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					totalResults <- shardResult{shardId: shardId, err: err}
+					return
+				}
+				totalResults <- shardResult{shardId: shardId, data: res.SearchResult}
+			},
+			OnFailure: func(err error) {
+				totalResults <- shardResult{shardId: shardId, err: err}
+			},
 		})
 	}
 
@@ -190,10 +255,25 @@ func (h *RestSearch) Handle(r *RestRequest, reply ResponseListener) {
 		DocList  []interface{}
 		MaxScore float64
 		Took     int64
+		Total    uint64
 	}
+	var failures []interface{}
 	for i := 0; i < shardNum; i++ {
-		d := <-totalResults
+		result := <-totalResults
+		if result.err != nil {
+			failures = append(failures, map[string]interface{}{
+				"shard": result.shardId.ShardId,
+				"index": result.shardId.Index.Name,
+				"reason": map[string]interface{}{
+					"type":   transport.ErrorType(result.err),
+					"reason": result.err.Error(),
+				},
+			})
+			continue
+		}
+		d := result.data
 		data.Took += d.Took
+		data.Total += d.Total
 		if d.DocList != nil {
 			for _, doc := range d.DocList {
 				data.DocList = append(data.DocList, doc)
@@ -204,20 +284,37 @@ func (h *RestSearch) Handle(r *RestRequest, reply ResponseListener) {
 		}
 	}
 
+	if shardNum > 0 && len(failures) == shardNum {
+		reply(newErrorResponse(503, "search_phase_execution_exception", "all shards failed"))
+		return
+	}
+
+	sortFields, err := index.NewSort(body["sort"])
+	if err != nil {
+		reply(newErrorResponse(400, "parse_exception", err.Error()))
+		return
+	}
+	sortFields = allowedSortFields(sortFields, security.AccessControl(r.Authentication, SearchRequestAction, indexName, clusterState.Metadata.Security))
+	sortHits(data.DocList, sortFields)
+	from, size := searchPage(body)
+	if from > len(data.DocList) {
+		from = len(data.DocList)
+	}
+	if from+size < len(data.DocList) {
+		data.DocList = data.DocList[from : from+size]
+	} else {
+		data.DocList = data.DocList[from:]
+	}
+
 	reply(RestResponse{
 		StatusCode: 200,
 		Body: map[string]interface{}{
 			"took":      data.Took,
 			"timed_out": false,
-			"_shards": map[string]interface{}{
-				"total":      shardNum,
-				"successful": shardNum,
-				"skipped":    0,
-				"failed":     0,
-			},
+			"_shards":   searchShardsHeader(shardNum, failures),
 			"hits": map[string]interface{}{
 				"total": map[string]interface{}{
-					"value":    len(data.DocList),
+					"value":    data.Total,
 					"relation": "eq",
 				},
 				"max_score": data.MaxScore,
@@ -226,3 +323,85 @@ func (h *RestSearch) Handle(r *RestRequest, reply ResponseListener) {
 		},
 	})
 }
+
+// searchShardsHeader is the "_shards" section of a search response, listing the shards that failed.
+func searchShardsHeader(total int, failures []interface{}) map[string]interface{} {
+	header := map[string]interface{}{
+		"total":      total,
+		"successful": total - len(failures),
+		"skipped":    0,
+		"failed":     len(failures),
+	}
+	if len(failures) > 0 {
+		header["failures"] = failures
+	}
+	return header
+}
+
+// searchPage returns the "from" and "size" of a search request body, 0 and 10 by default.
+func searchPage(body map[string]interface{}) (int, int) {
+	from, size := 0, 10
+	if v, ok := body["from"].(float64); ok && v >= 0 {
+		from = int(v)
+	}
+	if v, ok := body["size"].(float64); ok && v >= 0 {
+		size = int(v)
+	}
+	return from, size
+}
+
+// allowedSortFields drops the sort fields the user does not read, their values would tell the fields. Without any
+// left, the hits are sorted by score.
+func allowedSortFields(sortFields []string, accessControl security.IndexAccessControl) []string {
+	if !accessControl.RestrictsFields() {
+		return sortFields
+	}
+	var allowed []string
+	for _, field := range sortFields {
+		name := strings.TrimPrefix(field, "-")
+		if name == "_id" || name == "_score" || accessControl.FieldAllowed(name) {
+			allowed = append(allowed, field)
+		}
+	}
+	return allowed
+}
+
+// allowedFragments returns the highlighted fragments of the fields the user reads.
+func allowedFragments(fragments search.FieldFragmentMap, accessControl security.IndexAccessControl) search.FieldFragmentMap {
+	if !accessControl.RestrictsFields() {
+		return fragments
+	}
+	allowed := search.FieldFragmentMap{}
+	for field, f := range fragments {
+		if accessControl.FieldAllowed(field) {
+			allowed[field] = f
+		}
+	}
+	return allowed
+}
+
+// sortHits orders the hits gathered from the shards by their sort values, or by score without sort fields.
+func sortHits(hits []interface{}, sortFields []string) {
+	sort.SliceStable(hits, func(i, j int) bool {
+		a, b := hits[i].(map[string]interface{}), hits[j].(map[string]interface{})
+		if sortFields == nil {
+			return a["_score"].(float64) > b["_score"].(float64)
+		}
+		aValues, _ := a["sort"].([]interface{})
+		bValues, _ := b["sort"].([]interface{})
+		for k, field := range sortFields {
+			if k >= len(aValues) || k >= len(bValues) {
+				break
+			}
+			aValue, bValue := fmt.Sprint(aValues[k]), fmt.Sprint(bValues[k])
+			if aValue == bValue {
+				continue
+			}
+			if strings.HasPrefix(field, "-") {
+				return aValue > bValue
+			}
+			return aValue < bValue
+		}
+		return false
+	})
+}
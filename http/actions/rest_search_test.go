@@ -2,6 +2,7 @@ package actions
 
 import (
 	"fmt"
+	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
@@ -71,3 +72,19 @@ func TestRestIndexSearch_Handle3(t *testing.T) {
 		},
 	)
 }
+
+func TestSortHits(t *testing.T) {
+	// Arrange
+	hits := []interface{}{
+		map[string]interface{}{"_id": "b", "_score": 1.0, "sort": []interface{}{"b"}},
+		map[string]interface{}{"_id": "a", "_score": 2.0, "sort": []interface{}{"a"}},
+	}
+
+	// Action
+	sortHits(hits, []string{"-_id"})
+
+	// Assert
+	assert.Equal(t, "b", hits[0].(map[string]interface{})["_id"])
+	sortHits(hits, nil)
+	assert.Equal(t, "a", hits[0].(map[string]interface{})["_id"])
+}
@@ -0,0 +1,783 @@
+package actions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const minPasswordLength = 6
+
+// securityNotEnabled replies to the APIs acting as the user authenticated when security is disabled.
+func securityNotEnabled() RestResponse {
+	return newErrorResponse(500, "exception", "Security must be explicitly enabled, set [security.enabled] to [true] in the configuration")
+}
+
+// securityUpdateError replies the failure of a change of the security metadata, nil when it was applied.
+func securityUpdateError(err error) *RestResponse {
+	if err == nil || err == state.ErrNotAcknowledged {
+		return nil
+	}
+	if response := clusterStateUpdateError(err); response != nil {
+		return response
+	}
+	response := newErrorResponse(400, "illegal_argument_exception", err.Error())
+	return &response
+}
+
+// splitNames splits a comma separated path parameter, none for an empty one.
+func splitNames(param string) []string {
+	var names []string
+	for _, name := range strings.Split(param, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// stringList reads a field holding a string or a list of strings.
+func stringList(value interface{}) ([]string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, false
+			}
+			list = append(list, s)
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+func userBody(user state.User) map[string]interface{} {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return map[string]interface{}{
+		"username":  user.Username,
+		"roles":     roles,
+		"full_name": user.FullName,
+		"email":     user.Email,
+		"metadata":  map[string]interface{}{},
+		"enabled":   user.Enabled,
+	}
+}
+
+type RestPutUser struct {
+	clusterService  *cluster.Service
+	securityService *cluster.MetadataSecurityService
+}
+
+func NewRestPutUser(clusterService *cluster.Service, securityService *cluster.MetadataSecurityService) *RestPutUser {
+	return &RestPutUser{
+		clusterService:  clusterService,
+		securityService: securityService,
+	}
+}
+
+func (h *RestPutUser) Handle(r *RestRequest, reply ResponseListener) {
+	username := r.PathParams["username"]
+	if security.IsReservedUser(username) {
+		reply(newErrorResponse(400, "illegal_argument_exception", "user ["+username+"] is reserved and may not be used"))
+		return
+	}
+	var body struct {
+		Password *string  `json:"password"`
+		Roles    []string `json:"roles"`
+		FullName string   `json:"full_name"`
+		Email    string   `json:"email"`
+		Enabled  *bool    `json:"enabled"`
+	}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		reply(newErrorResponse(400, "parse_exception", "failed to parse the user: "+err.Error()))
+		return
+	}
+	_, existing := h.clusterService.State().Metadata.Security.Users[username]
+	user := state.User{
+		Username: username,
+		Roles:    body.Roles,
+		FullName: body.FullName,
+		Email:    body.Email,
+		Enabled:  body.Enabled == nil || *body.Enabled,
+	}
+	if body.Password != nil {
+		if len(*body.Password) < minPasswordLength {
+			reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: passwords must be at least ["+strconv.Itoa(minPasswordLength)+"] characters long;"))
+			return
+		}
+		hash, err := security.HashPassword(*body.Password)
+		if err != nil {
+			reply(newErrorResponse(500, "exception", err.Error()))
+			return
+		}
+		user.PasswordHash = hash
+	} else if !existing {
+		reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: password must be specified unless you are updating an existing user;"))
+		return
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	err = h.securityService.UpdateSecurity(cluster.SecurityUpdateRequest{
+		AckedRequest: ackedReq,
+		PutUsers:     []state.User{user},
+	})
+	if response := securityUpdateError(err); response != nil {
+		reply(*response)
+		return
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"created": !existing,
+		},
+	})
+}
+
+type RestGetUsers struct {
+	clusterService *cluster.Service
+}
+
+func NewRestGetUsers(clusterService *cluster.Service) *RestGetUsers {
+	return &RestGetUsers{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestGetUsers) Handle(r *RestRequest, reply ResponseListener) {
+	users := h.clusterService.State().Metadata.Security.Users
+	body := map[string]interface{}{}
+	usernames := splitNames(r.PathParams["username"])
+	if len(usernames) == 0 {
+		body[security.ReservedUsername] = userBody(state.User{Username: security.ReservedUsername, Roles: []string{security.SuperuserRole}, Enabled: true})
+		for username, user := range users {
+			body[username] = userBody(user)
+		}
+	}
+	for _, username := range usernames {
+		if security.IsReservedUser(username) {
+			body[username] = userBody(state.User{Username: username, Roles: []string{security.SuperuserRole}, Enabled: true})
+		} else if user, existing := users[username]; existing {
+			body[username] = userBody(user)
+		}
+	}
+	statusCode := 200
+	if len(body) == 0 && len(usernames) > 0 {
+		statusCode = 404
+	}
+	reply(RestResponse{
+		StatusCode: statusCode,
+		Body:       body,
+	})
+}
+
+type RestDeleteUser struct {
+	clusterService  *cluster.Service
+	securityService *cluster.MetadataSecurityService
+}
+
+func NewRestDeleteUser(clusterService *cluster.Service, securityService *cluster.MetadataSecurityService) *RestDeleteUser {
+	return &RestDeleteUser{
+		clusterService:  clusterService,
+		securityService: securityService,
+	}
+}
+
+func (h *RestDeleteUser) Handle(r *RestRequest, reply ResponseListener) {
+	username := r.PathParams["username"]
+	if security.IsReservedUser(username) {
+		reply(newErrorResponse(400, "illegal_argument_exception", "user ["+username+"] is reserved and may not be deleted"))
+		return
+	}
+	if _, existing := h.clusterService.State().Metadata.Security.Users[username]; !existing {
+		reply(RestResponse{
+			StatusCode: 404,
+			Body:       map[string]interface{}{"found": false},
+		})
+		return
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	err = h.securityService.UpdateSecurity(cluster.SecurityUpdateRequest{
+		AckedRequest: ackedReq,
+		DeleteUsers:  []string{username},
+	})
+	if response := securityUpdateError(err); response != nil {
+		reply(*response)
+		return
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       map[string]interface{}{"found": true},
+	})
+}
+
+// roleFromBody reads a role descriptor, {"cluster": [...], "indices": [{"names": [...], "privileges": [...]}]}.
+func roleFromBody(name string, body map[string]interface{}) (state.Role, error) {
+	role := state.Role{Name: name}
+	clusterPrivileges, ok := stringList(body["cluster"])
+	if !ok {
+		return role, fmt.Errorf("failed to parse role [%s], [cluster] must be a list of privileges", name)
+	}
+	role.Cluster = clusterPrivileges
+	indices, ok := body["indices"].([]interface{})
+	if body["indices"] != nil && !ok {
+		return role, fmt.Errorf("failed to parse role [%s], [indices] must be a list of index privileges", name)
+	}
+	for _, entry := range indices {
+		entry, ok := entry.(map[string]interface{})
+		if !ok {
+			return role, fmt.Errorf("failed to parse role [%s], an entry of [indices] must be an object", name)
+		}
+		names, ok := stringList(entry["names"])
+		if !ok {
+			return role, fmt.Errorf("failed to parse role [%s], [names] must be an index name or a list of index names", name)
+		}
+		privileges, ok := stringList(entry["privileges"])
+		if !ok {
+			return role, fmt.Errorf("failed to parse role [%s], [privileges] must be a list of privileges", name)
+		}
+		indicesPrivileges := state.IndicesPrivileges{
+			Names:      names,
+			Privileges: privileges,
+		}
+		switch query := entry["query"].(type) {
+		case nil:
+		case string:
+			indicesPrivileges.Query = query
+		case map[string]interface{}:
+			b, _ := json.Marshal(query)
+			indicesPrivileges.Query = string(b)
+		default:
+			return role, fmt.Errorf("failed to parse role [%s], [query] must be an object or a string", name)
+		}
+		if entry["field_security"] != nil {
+			fieldSecurity, ok := entry["field_security"].(map[string]interface{})
+			if !ok {
+				return role, fmt.Errorf("failed to parse role [%s], [field_security] must be an object", name)
+			}
+			grant, ok := stringList(fieldSecurity["grant"])
+			if !ok || fieldSecurity["grant"] == nil {
+				return role, fmt.Errorf("failed to parse role [%s], [field_security.grant] must be a list of field names", name)
+			}
+			except, ok := stringList(fieldSecurity["except"])
+			if !ok {
+				return role, fmt.Errorf("failed to parse role [%s], [field_security.except] must be a list of field names", name)
+			}
+			indicesPrivileges.FieldSecurity = &state.FieldSecurity{Grant: grant, Except: except}
+		}
+		role.Indices = append(role.Indices, indicesPrivileges)
+	}
+	return role, security.ValidateRole(role)
+}
+
+func roleBody(role state.Role, reserved bool) map[string]interface{} {
+	clusterPrivileges := role.Cluster
+	if clusterPrivileges == nil {
+		clusterPrivileges = []string{}
+	}
+	indices := make([]map[string]interface{}, 0, len(role.Indices))
+	for _, i := range role.Indices {
+		entry := map[string]interface{}{
+			"names":      i.Names,
+			"privileges": i.Privileges,
+		}
+		if i.Query != "" {
+			entry["query"] = i.Query
+		}
+		if i.FieldSecurity != nil {
+			fieldSecurity := map[string]interface{}{"grant": i.FieldSecurity.Grant}
+			if len(i.FieldSecurity.Except) > 0 {
+				fieldSecurity["except"] = i.FieldSecurity.Except
+			}
+			entry["field_security"] = fieldSecurity
+		}
+		indices = append(indices, entry)
+	}
+	metadata := map[string]interface{}{}
+	if reserved {
+		metadata["_reserved"] = true
+	}
+	return map[string]interface{}{
+		"cluster":  clusterPrivileges,
+		"indices":  indices,
+		"metadata": metadata,
+	}
+}
+
+type RestPutRole struct {
+	clusterService  *cluster.Service
+	securityService *cluster.MetadataSecurityService
+}
+
+func NewRestPutRole(clusterService *cluster.Service, securityService *cluster.MetadataSecurityService) *RestPutRole {
+	return &RestPutRole{
+		clusterService:  clusterService,
+		securityService: securityService,
+	}
+}
+
+func (h *RestPutRole) Handle(r *RestRequest, reply ResponseListener) {
+	name := r.PathParams["name"]
+	if security.IsReservedRole(name) {
+		reply(newErrorResponse(400, "illegal_argument_exception", "role ["+name+"] is reserved and may not be used"))
+		return
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		reply(newErrorResponse(400, "parse_exception", "failed to parse the role: "+err.Error()))
+		return
+	}
+	role, err := roleFromBody(name, body)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	_, existing := h.clusterService.State().Metadata.Security.Roles[name]
+	err = h.securityService.UpdateSecurity(cluster.SecurityUpdateRequest{
+		AckedRequest: ackedReq,
+		PutRoles:     []state.Role{role},
+	})
+	if response := securityUpdateError(err); response != nil {
+		reply(*response)
+		return
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"role": map[string]interface{}{
+				"created": !existing,
+			},
+		},
+	})
+}
+
+type RestGetRoles struct {
+	clusterService *cluster.Service
+}
+
+func NewRestGetRoles(clusterService *cluster.Service) *RestGetRoles {
+	return &RestGetRoles{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestGetRoles) Handle(r *RestRequest, reply ResponseListener) {
+	metadata := h.clusterService.State().Metadata.Security
+	body := map[string]interface{}{}
+	names := splitNames(r.PathParams["name"])
+	if len(names) == 0 {
+		for _, role := range security.Roles([]string{security.SuperuserRole}, metadata) {
+			body[role.Name] = roleBody(role, true)
+		}
+		for name, role := range metadata.Roles {
+			body[name] = roleBody(role, false)
+		}
+	}
+	for _, role := range security.Roles(names, metadata) {
+		body[role.Name] = roleBody(role, security.IsReservedRole(role.Name))
+	}
+	statusCode := 200
+	if len(body) == 0 && len(names) > 0 {
+		statusCode = 404
+	}
+	reply(RestResponse{
+		StatusCode: statusCode,
+		Body:       body,
+	})
+}
+
+type RestDeleteRole struct {
+	clusterService  *cluster.Service
+	securityService *cluster.MetadataSecurityService
+}
+
+func NewRestDeleteRole(clusterService *cluster.Service, securityService *cluster.MetadataSecurityService) *RestDeleteRole {
+	return &RestDeleteRole{
+		clusterService:  clusterService,
+		securityService: securityService,
+	}
+}
+
+func (h *RestDeleteRole) Handle(r *RestRequest, reply ResponseListener) {
+	name := r.PathParams["name"]
+	if security.IsReservedRole(name) {
+		reply(newErrorResponse(400, "illegal_argument_exception", "role ["+name+"] is reserved and may not be deleted"))
+		return
+	}
+	if _, existing := h.clusterService.State().Metadata.Security.Roles[name]; !existing {
+		reply(RestResponse{
+			StatusCode: 404,
+			Body:       map[string]interface{}{"found": false},
+		})
+		return
+	}
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	err = h.securityService.UpdateSecurity(cluster.SecurityUpdateRequest{
+		AckedRequest: ackedReq,
+		DeleteRoles:  []string{name},
+	})
+	if response := securityUpdateError(err); response != nil {
+		reply(*response)
+		return
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       map[string]interface{}{"found": true},
+	})
+}
+
+// parseExpiration parses the expiration of an API key, a time value such as "30m" or "7d".
+func parseExpiration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("failed to parse expiration [%s]", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	expiration, err := time.ParseDuration(value)
+	if err != nil || expiration <= 0 {
+		return 0, fmt.Errorf("failed to parse expiration [%s]", value)
+	}
+	return expiration, nil
+}
+
+type RestCreateApiKey struct {
+	securityService *cluster.MetadataSecurityService
+}
+
+func NewRestCreateApiKey(securityService *cluster.MetadataSecurityService) *RestCreateApiKey {
+	return &RestCreateApiKey{
+		securityService: securityService,
+	}
+}
+
+func (h *RestCreateApiKey) Handle(r *RestRequest, reply ResponseListener) {
+	if r.Authentication == nil {
+		reply(securityNotEnabled())
+		return
+	}
+	if r.Authentication.ApiKey != nil {
+		// a key created with a key would not be limited by the role descriptors of the first one
+		reply(newErrorResponse(400, "illegal_argument_exception", "an API key cannot be created with an API key"))
+		return
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		reply(newErrorResponse(400, "parse_exception", "failed to parse the API key: "+err.Error()))
+		return
+	}
+	name, _ := body["name"].(string)
+	if name == "" {
+		reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: api key name is required;"))
+		return
+	}
+	now := time.Now()
+	apiKey := state.ApiKey{
+		Id:       common.RandomBase64(),
+		Name:     name,
+		Username: r.Authentication.User.Username,
+		Creation: now.UnixNano() / int64(time.Millisecond),
+	}
+	if value, ok := body["expiration"].(string); ok {
+		expiration, err := parseExpiration(value)
+		if err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+			return
+		}
+		apiKey.Expiration = now.Add(expiration).UnixNano() / int64(time.Millisecond)
+	}
+	descriptors, _ := body["role_descriptors"].(map[string]interface{})
+	descriptorNames := make([]string, 0, len(descriptors))
+	for descriptorName := range descriptors {
+		descriptorNames = append(descriptorNames, descriptorName)
+	}
+	sort.Strings(descriptorNames)
+	for _, descriptorName := range descriptorNames {
+		descriptor, _ := descriptors[descriptorName].(map[string]interface{})
+		role, err := roleFromBody(descriptorName, descriptor)
+		if err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+			return
+		}
+		apiKey.RoleDescriptors = append(apiKey.RoleDescriptors, role)
+	}
+	key, err := security.RandomSecret()
+	if err != nil {
+		reply(newErrorResponse(500, "exception", err.Error()))
+		return
+	}
+	hash, err := security.HashPassword(key)
+	if err != nil {
+		reply(newErrorResponse(500, "exception", err.Error()))
+		return
+	}
+	apiKey.KeyHash = hash
+	ackedReq, err := ackedRequest(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	err = h.securityService.UpdateSecurity(cluster.SecurityUpdateRequest{
+		AckedRequest: ackedReq,
+		PutApiKeys:   []state.ApiKey{apiKey},
+	})
+	if response := securityUpdateError(err); response != nil {
+		reply(*response)
+		return
+	}
+	responseBody := map[string]interface{}{
+		"id":      apiKey.Id,
+		"name":    apiKey.Name,
+		"api_key": key,
+		"encoded": base64.StdEncoding.EncodeToString([]byte(apiKey.Id + ":" + key)),
+	}
+	if apiKey.Expiration > 0 {
+		responseBody["expiration"] = apiKey.Expiration
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       responseBody,
+	})
+}
+
+// apiKeyFilter selects API keys by id, name or owner, the empty fields select any key.
+type apiKeyFilter struct {
+	ids      []string
+	name     string
+	username string
+}
+
+func (f apiKeyFilter) empty() bool {
+	return len(f.ids) == 0 && f.name == "" && f.username == ""
+}
+
+func (f apiKeyFilter) apply(apiKeys map[string]state.ApiKey) []state.ApiKey {
+	ids := map[string]bool{}
+	for _, id := range f.ids {
+		ids[id] = true
+	}
+	var selected []state.ApiKey
+	for _, apiKey := range apiKeys {
+		if len(ids) > 0 && !ids[apiKey.Id] {
+			continue
+		}
+		if f.name != "" && apiKey.Name != f.name {
+			continue
+		}
+		if f.username != "" && apiKey.Username != f.username {
+			continue
+		}
+		selected = append(selected, apiKey)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Creation != selected[j].Creation {
+			return selected[i].Creation < selected[j].Creation
+		}
+		return selected[i].Id < selected[j].Id
+	})
+	return selected
+}
+
+type RestGetApiKeys struct {
+	clusterService *cluster.Service
+}
+
+func NewRestGetApiKeys(clusterService *cluster.Service) *RestGetApiKeys {
+	return &RestGetApiKeys{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestGetApiKeys) Handle(r *RestRequest, reply ResponseListener) {
+	filter := apiKeyFilter{
+		ids:      splitNames(r.Param("id")),
+		name:     r.Param("name"),
+		username: r.Param("username"),
+	}
+	if r.ParamAsBool("owner", false) {
+		if r.Authentication == nil {
+			reply(securityNotEnabled())
+			return
+		}
+		filter.username = r.Authentication.User.Username
+	}
+	apiKeys := []map[string]interface{}{}
+	for _, apiKey := range filter.apply(h.clusterService.State().Metadata.Security.ApiKeys) {
+		body := map[string]interface{}{
+			"id":          apiKey.Id,
+			"name":        apiKey.Name,
+			"creation":    apiKey.Creation,
+			"invalidated": apiKey.Invalidated,
+			"username":    apiKey.Username,
+			"realm":       security.NativeRealm,
+		}
+		if security.IsReservedUser(apiKey.Username) {
+			body["realm"] = security.ReservedRealm
+		}
+		if apiKey.Expiration > 0 {
+			body["expiration"] = apiKey.Expiration
+		}
+		apiKeys = append(apiKeys, body)
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"api_keys": apiKeys,
+		},
+	})
+}
+
+// invalidateApiKeysBody is the body of an API key invalidation, {"ids": [...], "name": ..., "username": ...,
+// "owner": true}.
+type invalidateApiKeysBody struct {
+	Id       string   `json:"id"`
+	Ids      []string `json:"ids"`
+	Name     string   `json:"name"`
+	Username string   `json:"username"`
+	Owner    bool     `json:"owner"`
+}
+
+func parseInvalidateApiKeysBody(body []byte) (invalidateApiKeysBody, error) {
+	var b invalidateApiKeysBody
+	if err := json.Unmarshal(body, &b); err != nil {
+		return b, err
+	}
+	if b.Id != "" {
+		b.Ids = append(b.Ids, b.Id)
+	}
+	return b, nil
+}
+
+type RestInvalidateApiKeys struct {
+	clusterService  *cluster.Service
+	securityService *cluster.MetadataSecurityService
+}
+
+func NewRestInvalidateApiKeys(clusterService *cluster.Service, securityService *cluster.MetadataSecurityService) *RestInvalidateApiKeys {
+	return &RestInvalidateApiKeys{
+		clusterService:  clusterService,
+		securityService: securityService,
+	}
+}
+
+func (h *RestInvalidateApiKeys) Handle(r *RestRequest, reply ResponseListener) {
+	body, err := parseInvalidateApiKeysBody(r.Body)
+	if err != nil {
+		reply(newErrorResponse(400, "parse_exception", "failed to parse the API keys to invalidate: "+err.Error()))
+		return
+	}
+	filter := apiKeyFilter{
+		ids:      body.Ids,
+		name:     body.Name,
+		username: body.Username,
+	}
+	if body.Owner {
+		if r.Authentication == nil {
+			reply(securityNotEnabled())
+			return
+		}
+		filter.username = r.Authentication.User.Username
+	}
+	if filter.empty() {
+		reply(newErrorResponse(400, "action_request_validation_exception", "Validation Failed: 1: One of [api key id(s), api key name, username] must be specified if [owner] flag is false;"))
+		return
+	}
+
+	invalidated := []string{}
+	previouslyInvalidated := []string{}
+	for _, apiKey := range filter.apply(h.clusterService.State().Metadata.Security.ApiKeys) {
+		if apiKey.Invalidated {
+			previouslyInvalidated = append(previouslyInvalidated, apiKey.Id)
+		} else {
+			invalidated = append(invalidated, apiKey.Id)
+		}
+	}
+	if len(invalidated) > 0 {
+		ackedReq, err := ackedRequest(r)
+		if err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+			return
+		}
+		err = h.securityService.UpdateSecurity(cluster.SecurityUpdateRequest{
+			AckedRequest:      ackedReq,
+			InvalidateApiKeys: invalidated,
+		})
+		if response := securityUpdateError(err); response != nil {
+			reply(*response)
+			return
+		}
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body: map[string]interface{}{
+			"invalidated_api_keys":            invalidated,
+			"previously_invalidated_api_keys": previouslyInvalidated,
+			"error_count":                     0,
+		},
+	})
+}
+
+type RestAuthenticate struct{}
+
+func (h *RestAuthenticate) Handle(r *RestRequest, reply ResponseListener) {
+	if r.Authentication == nil {
+		reply(securityNotEnabled())
+		return
+	}
+	body := userBody(r.Authentication.User)
+	realm := map[string]interface{}{
+		"name": r.Authentication.Realm,
+		"type": r.Authentication.Realm,
+	}
+	body["authentication_realm"] = realm
+	body["lookup_realm"] = realm
+	body["authentication_type"] = r.Authentication.Type()
+	if apiKey := r.Authentication.ApiKey; apiKey != nil {
+		body["api_key"] = map[string]interface{}{
+			"id":   apiKey.Id,
+			"name": apiKey.Name,
+		}
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       body,
+	})
+}
@@ -2,6 +2,7 @@ package actions
 
 import (
 	"errors"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
 	"github.com/actumn/searchgoose/state/transport"
@@ -58,30 +59,47 @@ func (h *RestGetSource) Handle(r *RestRequest, reply ResponseListener) {
 		return
 	}
 
-	shardRouting := cluster.GetShards(*clusterState, indexName, documentId).Primary
+	routing := r.Param("routing")
+	if routingMissing(clusterState, indexName, routing) {
+		reply(routingMissingResponse(indexName, documentId))
+		return
+	}
+	shardRouting := cluster.GetShards(*clusterState, indexName, documentId, routing).Primary
 	getRequest := getRequest{
-		Index:   indexName,
-		Id:      documentId,
-		ShardId: shardRouting.ShardId,
+		Index:          indexName,
+		Id:             documentId,
+		ShardId:        shardRouting.ShardId,
+		Authentication: r.Authentication,
 	}
-	h.transportService.SendRequest(clusterState.Nodes.Nodes[shardRouting.CurrentNodeId], GetAction, getRequest.toBytes(), func(response []byte) {
-		res := getResponseFromBytes(response)
-		if res.Err != "" {
-			logrus.Warn(errors.New(res.Err))
-			reply(RestResponse{
-				StatusCode: 400,
-				Body: map[string]interface{}{
-					"_index": indexName,
-					"_type":  "_doc",
-					"_id":    documentId,
-					"found":  res.Err,
-				},
-			})
-		} else {
-			reply(RestResponse{
-				StatusCode: 200,
-				Body:       res.Fields,
-			})
-		}
+	node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, GetAction, common.ToBytes(&getRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readGetResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			if res.Err != "" {
+				logrus.Warn(errors.New(res.Err))
+				reply(RestResponse{
+					StatusCode: 400,
+					Body: map[string]interface{}{
+						"_index": indexName,
+						"_type":  "_doc",
+						"_id":    documentId,
+						"found":  res.Err,
+					},
+				})
+			} else {
+				reply(RestResponse{
+					StatusCode: 200,
+					Body:       res.Fields,
+				})
+			}
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
 	})
 }
@@ -0,0 +1,483 @@
+package actions
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/actumn/searchgoose/tasks"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ListTasksAction   = "cluster:monitor/tasks/lists"
+	GetTaskAction     = "cluster:monitor/task/get"
+	CancelTasksAction = "cluster:admin/tasks/cancel"
+)
+
+func taskInfoToMap(info tasks.Info) map[string]interface{} {
+	m := map[string]interface{}{
+		"node":                  info.Node,
+		"id":                    info.Id,
+		"type":                  info.Type,
+		"action":                info.Action,
+		"description":           info.Description,
+		"start_time_in_millis":  info.StartTime,
+		"running_time_in_nanos": info.RunningTime,
+		"cancellable":           info.Cancellable,
+		"cancelled":             info.Cancelled,
+		"headers":               map[string]interface{}{},
+	}
+	if info.Status != nil {
+		m["status"] = info.Status
+	}
+	if info.ParentTaskId != "" {
+		m["parent_task_id"] = info.ParentTaskId
+	}
+	return m
+}
+
+func nodeTasksToMap(node state.Node, infos []tasks.Info) map[string]interface{} {
+	tasksMap := map[string]interface{}{}
+	for _, info := range infos {
+		tasksMap[info.TaskId()] = taskInfoToMap(info)
+	}
+	return map[string]interface{}{
+		"name":              node.Name,
+		"transport_address": node.HostAddress,
+		"host":              node.HostAddress,
+		"ip":                node.HostAddress,
+		"tasks":             tasksMap,
+	}
+}
+
+// matchActions reports whether action matches one of the comma separated patterns of the "actions" parameter.
+func matchActions(patterns string, action string) bool {
+	if patterns == "" {
+		return true
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(action, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if pattern == action {
+			return true
+		}
+	}
+	return false
+}
+
+type listTasksRequest struct {
+	Actions string
+}
+
+func (r *listTasksRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Actions)
+}
+
+func readListTasksRequest(in *common.StreamInput) (*listTasksRequest, error) {
+	req := listTasksRequest{Actions: in.ReadString()}
+	return &req, in.Err()
+}
+
+type listTasksResponse struct {
+	Node  state.Node
+	Tasks []tasks.Info
+}
+
+func (r *listTasksResponse) WriteTo(out *common.StreamOutput) {
+	r.Node.WriteTo(out)
+	out.WriteVInt(uint64(len(r.Tasks)))
+	for i := range r.Tasks {
+		r.Tasks[i].WriteTo(out)
+	}
+}
+
+func readListTasksResponse(in *common.StreamInput) (*listTasksResponse, error) {
+	res := listTasksResponse{Node: state.ReadNode(in)}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		res.Tasks = append(res.Tasks, tasks.ReadInfo(in))
+	}
+	return &res, in.Err()
+}
+
+type getTaskRequest struct {
+	Id      int64
+	Timeout time.Duration
+}
+
+func (r *getTaskRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(r.Id)
+	out.WriteDuration(r.Timeout)
+}
+
+func readGetTaskRequest(in *common.StreamInput) (*getTaskRequest, error) {
+	req := getTaskRequest{
+		Id:      in.ReadInt64(),
+		Timeout: in.ReadDuration(),
+	}
+	return &req, in.Err()
+}
+
+type getTaskResponse struct {
+	Result *tasks.Result
+	Err    string
+}
+
+func (r *getTaskResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteBool(r.Result != nil)
+	if r.Result != nil {
+		r.Result.WriteTo(out)
+	}
+	out.WriteString(r.Err)
+}
+
+func readGetTaskResponse(in *common.StreamInput) (*getTaskResponse, error) {
+	var res getTaskResponse
+	if in.ReadBool() {
+		result := tasks.ReadResult(in)
+		res.Result = &result
+	}
+	res.Err = in.ReadString()
+	return &res, in.Err()
+}
+
+type cancelTaskRequest struct {
+	Id     int64
+	Reason string
+}
+
+func (r *cancelTaskRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(r.Id)
+	out.WriteString(r.Reason)
+}
+
+func readCancelTaskRequest(in *common.StreamInput) (*cancelTaskRequest, error) {
+	req := cancelTaskRequest{
+		Id:     in.ReadInt64(),
+		Reason: in.ReadString(),
+	}
+	return &req, in.Err()
+}
+
+type cancelTaskResponse struct {
+	Node state.Node
+	Task tasks.Info
+	Err  string
+}
+
+func (r *cancelTaskResponse) WriteTo(out *common.StreamOutput) {
+	r.Node.WriteTo(out)
+	r.Task.WriteTo(out)
+	out.WriteString(r.Err)
+}
+
+func readCancelTaskResponse(in *common.StreamInput) (*cancelTaskResponse, error) {
+	res := cancelTaskResponse{
+		Node: state.ReadNode(in),
+		Task: tasks.ReadInfo(in),
+		Err:  in.ReadString(),
+	}
+	return &res, in.Err()
+}
+
+type RestListTasks struct {
+	clusterService   *cluster.Service
+	transportService *transport.Service
+}
+
+func NewRestListTasks(clusterService *cluster.Service, transportService *transport.Service, taskManager *tasks.Manager) *RestListTasks {
+	transportService.RegisterRequestHandler(ListTasksAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readListTasksRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+
+		var infos []tasks.Info
+		for _, info := range taskManager.List() {
+			if matchActions(request.Actions, info.Action) {
+				infos = append(infos, info)
+			}
+		}
+		res := listTasksResponse{
+			Node:  *transportService.LocalNode,
+			Tasks: infos,
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+
+	return &RestListTasks{
+		clusterService:   clusterService,
+		transportService: transportService,
+	}
+}
+
+func (h *RestListTasks) Handle(r *RestRequest, reply ResponseListener) {
+	clusterState := h.clusterService.State()
+	nodes := clusterState.Nodes.Nodes
+	request := listTasksRequest{
+		Actions: r.Param("actions"),
+	}
+
+	responses := make([]*listTasksResponse, len(nodes))
+	var failures []interface{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	wg.Add(len(nodes))
+	idx := -1
+	for _, node := range nodes {
+		idx += 1
+		currIdx := idx
+		nodeId := node.Id
+		onFailure := func(err error) {
+			mux.Lock()
+			failures = append(failures, nodeFailure(nodeId, err))
+			mux.Unlock()
+		}
+		version := h.transportService.GetVersion(node)
+		h.transportService.SendRequestWithHandler(node, ListTasksAction, common.ToBytes(&request, version), transport.RequestOptions{}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				defer wg.Done()
+				res, err := readListTasksResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					onFailure(err)
+					return
+				}
+				responses[currIdx] = res
+			},
+			OnFailure: func(err error) {
+				defer wg.Done()
+				onFailure(err)
+			},
+		})
+	}
+	wg.Wait()
+
+	nodesMap := map[string]interface{}{}
+	for _, response := range responses {
+		if response == nil {
+			continue
+		}
+		nodesMap[response.Node.Id] = nodeTasksToMap(response.Node, response.Tasks)
+	}
+
+	body := map[string]interface{}{
+		"nodes": nodesMap,
+	}
+	if len(failures) > 0 {
+		body["node_failures"] = failures
+	}
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       body,
+	})
+}
+
+type RestGetTask struct {
+	clusterService   *cluster.Service
+	transportService *transport.Service
+}
+
+func NewRestGetTask(clusterService *cluster.Service, transportService *transport.Service, taskManager *tasks.Manager) *RestGetTask {
+	transportService.RegisterRequestHandler(GetTaskAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readGetTaskRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+
+		result, err := taskManager.Get(request.Id, request.Timeout)
+		res := getTaskResponse{
+			Result: result,
+		}
+		if err != nil {
+			res.Err = err.Error()
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+
+	return &RestGetTask{
+		clusterService:   clusterService,
+		transportService: transportService,
+	}
+}
+
+func (h *RestGetTask) Handle(r *RestRequest, reply ResponseListener) {
+	taskId := r.PathParams["task_id"]
+	nodeId, id, err := tasks.ParseTaskId(taskId)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	timeout := time.Duration(0)
+	if r.ParamAsBool("wait_for_completion", false) {
+		if timeout, err = r.ParamAsDuration("timeout", 30*time.Second); err != nil {
+			reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+			return
+		}
+	}
+
+	clusterState := h.clusterService.State()
+	node, existing := clusterState.Nodes.Nodes[nodeId]
+	if !existing {
+		reply(newErrorResponse(404, "resource_not_found_exception", "task ["+taskId+"] belongs to the node ["+nodeId+"] which isn't part of the cluster and there is no record of the task"))
+		return
+	}
+
+	request := getTaskRequest{
+		Id:      id,
+		Timeout: timeout,
+	}
+	// the node holds the response while waiting for the task
+	options := transport.RequestOptions{Timeout: timeout + transport.DefaultRequestTimeout}
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, GetTaskAction, common.ToBytes(&request, version), options, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readGetTaskResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			if res.Err != "" {
+				reply(newErrorResponse(404, "resource_not_found_exception", "task ["+taskId+"] isn't running and hasn't stored its results"))
+				return
+			}
+
+			body := map[string]interface{}{
+				"completed": res.Result.Completed,
+				"task":      taskInfoToMap(res.Result.Task),
+			}
+			if res.Result.Response != nil {
+				body["response"] = res.Result.Response
+			}
+			if res.Result.Error != nil {
+				body["error"] = res.Result.Error
+			}
+			reply(RestResponse{
+				StatusCode: 200,
+				Body:       body,
+			})
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
+	})
+}
+
+type RestCancelTask struct {
+	clusterService   *cluster.Service
+	transportService *transport.Service
+}
+
+func NewRestCancelTask(clusterService *cluster.Service, transportService *transport.Service, taskManager *tasks.Manager) *RestCancelTask {
+	transportService.RegisterRequestHandler(CancelTasksAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readCancelTaskRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+
+		res := cancelTaskResponse{
+			Node: *transportService.LocalNode,
+		}
+		if task, err := taskManager.Cancel(request.Id, request.Reason); err != nil {
+			res.Err = err.Error()
+		} else {
+			logrus.Info("Cancel task ", task.TaskId(), " ", request.Reason)
+			res.Task = task.Info()
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+
+	return &RestCancelTask{
+		clusterService:   clusterService,
+		transportService: transportService,
+	}
+}
+
+func (h *RestCancelTask) Handle(r *RestRequest, reply ResponseListener) {
+	taskId := r.PathParams["task_id"]
+	nodeId, id, err := tasks.ParseTaskId(taskId)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	clusterState := h.clusterService.State()
+	node, existing := clusterState.Nodes.Nodes[nodeId]
+	if !existing {
+		reply(RestResponse{
+			StatusCode: 200,
+			Body: map[string]interface{}{
+				"node_failures": []map[string]interface{}{
+					{
+						"type":    "failed_node_exception",
+						"reason":  "Failed node [" + nodeId + "]",
+						"node_id": nodeId,
+					},
+				},
+				"nodes": map[string]interface{}{},
+			},
+		})
+		return
+	}
+
+	request := cancelTaskRequest{
+		Id:     id,
+		Reason: "by user request",
+	}
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, CancelTasksAction, common.ToBytes(&request, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readCancelTaskResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			if res.Err != "" {
+				reply(RestResponse{
+					StatusCode: 200,
+					Body: map[string]interface{}{
+						"task_failures": []map[string]interface{}{
+							{
+								"task_id": id,
+								"node_id": nodeId,
+								"status":  "NOT_FOUND",
+								"reason": map[string]interface{}{
+									"type":   "resource_not_found_exception",
+									"reason": "task [" + taskId + "]: " + res.Err,
+								},
+							},
+						},
+						"nodes": map[string]interface{}{},
+					},
+				})
+				return
+			}
+
+			reply(RestResponse{
+				StatusCode: 200,
+				Body: map[string]interface{}{
+					"nodes": map[string]interface{}{
+						res.Node.Id: nodeTasksToMap(res.Node, []tasks.Info{res.Task}),
+					},
+				},
+			})
+		},
+		OnFailure: func(err error) {
+			reply(RestResponse{
+				StatusCode: 200,
+				Body: map[string]interface{}{
+					"node_failures": []interface{}{nodeFailure(nodeId, err)},
+					"nodes":         map[string]interface{}{},
+				},
+			})
+		},
+	})
+}
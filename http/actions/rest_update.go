@@ -0,0 +1,221 @@
+package actions
+
+import (
+	"encoding/json"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/errors"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/script"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/indices"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/nqd/flat"
+	"reflect"
+)
+
+// mergeSource merges a partial document into source, recursing into objects present in both.
+func mergeSource(source map[string]interface{}, doc map[string]interface{}) {
+	for k, v := range doc {
+		if docObject, ok := v.(map[string]interface{}); ok {
+			if sourceObject, ok := source[k].(map[string]interface{}); ok {
+				mergeSource(sourceObject, docObject)
+				continue
+			}
+		}
+		source[k] = v
+	}
+}
+
+// applyUpdate reads the current document, applies the partial document or the script of an update request
+// and writes the result with a version check, retrying retry_on_conflict times when the document changed meanwhile.
+func applyUpdate(indexShard *index.Shard, item bulkItemRequest) bulkItemResponse {
+	res := bulkItemResponse{
+		OpType: item.OpType,
+		Id:     item.Id,
+	}
+	var update struct {
+		Doc         map[string]interface{} `json:"doc"`
+		Upsert      map[string]interface{} `json:"upsert"`
+		DocAsUpsert bool                   `json:"doc_as_upsert"`
+		DetectNoop  *bool                  `json:"detect_noop"`
+		Script      interface{}            `json:"script"`
+	}
+	if err := json.Unmarshal(item.Source, &update); err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	s, err := script.FromBody(update.Script)
+	if err != nil {
+		res.Err = err.Error()
+		return res
+	}
+	if s == nil && update.Doc == nil {
+		res.Err = "Validation Failed: 1: script or doc is missing;"
+		return res
+	}
+
+	for attempt := 0; attempt <= item.RetryOnConflict; attempt++ {
+		res.Err = ""
+		fields, err := indexShard.Get(item.Id)
+		if err == errors.ErrNotFound {
+			upsert := update.Upsert
+			if upsert == nil && update.DocAsUpsert {
+				upsert = update.Doc
+			}
+			if upsert == nil {
+				res.Err = errors.ErrNotFound.Error()
+				return res
+			}
+			result, err := indexShard.Index(item.Id, item.Routing, upsert, index.VersionNotFound)
+			res.Version, res.SeqNo, res.Result = result.Version, result.SeqNo, result.Result
+			if err != nil {
+				res.Err = err.Error()
+				continue
+			}
+			return res
+		} else if err != nil {
+			res.Err = err.Error()
+			return res
+		}
+
+		version, seqNo := indexShard.Version(item.Id)
+		if item.IfVersion > 0 && item.IfVersion != version {
+			res.Version = version
+			res.Err = errors.ErrVersionConflict.Error()
+			return res
+		}
+		original, _ := flat.Unflatten(fields, nil)
+		source, _ := flat.Unflatten(fields, nil)
+
+		op := "index"
+		if s != nil {
+			ctx := map[string]interface{}{
+				"_index":   item.Index,
+				"_id":      item.Id,
+				"_version": version,
+				"_source":  source,
+				"op":       "index",
+			}
+			if err := s.Execute(ctx); err != nil {
+				res.Err = err.Error()
+				return res
+			}
+			op, _ = ctx["op"].(string)
+			source, _ = ctx["_source"].(map[string]interface{})
+		} else {
+			mergeSource(source, update.Doc)
+			if (update.DetectNoop == nil || *update.DetectNoop) && reflect.DeepEqual(original, source) {
+				op = "noop"
+			}
+		}
+
+		var result index.WriteResult
+		switch op {
+		case "noop":
+			res.Version, res.SeqNo, res.Result = version, seqNo, "noop"
+			return res
+		case "delete":
+			result, err = indexShard.Delete(item.Id, version)
+		case "index":
+			result, err = indexShard.Index(item.Id, item.Routing, source, version)
+		default:
+			res.Err = "operation [" + op + "] not allowed, only [noop, index, delete] are allowed"
+			return res
+		}
+		res.Version, res.SeqNo, res.Result = result.Version, result.SeqNo, result.Result
+		if err != nil {
+			res.Err = err.Error()
+			continue
+		}
+		return res
+	}
+	return res
+}
+
+type RestUpdateDoc struct {
+	clusterService              *cluster.Service
+	indexNameExpressionResolver *indices.NameExpressionResolver
+	transportService            *transport.Service
+}
+
+func NewRestUpdateDoc(clusterService *cluster.Service, indexNameExpressionResolver *indices.NameExpressionResolver, transportService *transport.Service) *RestUpdateDoc {
+	return &RestUpdateDoc{
+		clusterService:              clusterService,
+		indexNameExpressionResolver: indexNameExpressionResolver,
+		transportService:            transportService,
+	}
+}
+
+func (h *RestUpdateDoc) Handle(r *RestRequest, reply ResponseListener) {
+	indexExpression := r.PathParams["index"]
+	documentId := r.PathParams["id"]
+
+	clusterState := h.clusterService.State()
+	indexName := h.indexNameExpressionResolver.ConcreteSingleIndex(*clusterState, indexExpression).Name
+	if indexName == "" {
+		reply(newErrorResponse(404, "index_not_found_exception", "no such index ["+indexExpression+"]"))
+		return
+	}
+	routing := r.Param("routing")
+	if routingMissing(clusterState, indexName, routing) {
+		reply(routingMissingResponse(indexName, documentId))
+		return
+	}
+	if indexWriteBlocked(clusterState, indexName) {
+		reply(indexWriteBlockedResponse(indexName))
+		return
+	}
+	retryOnConflict, err := r.ParamAsInt("retry_on_conflict", 0)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("retry_on_conflict", r.Param("retry_on_conflict")).Error()))
+		return
+	}
+	refresh, err := refreshPolicy(r)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+
+	shardRouting := cluster.IndexShard(*clusterState, indexName, documentId, routing).Primary
+	bulkRequest := shardBulkRequest{
+		ShardId: shardRouting.ShardId,
+		Items: []bulkItemRequest{
+			{
+				OpType:          "update",
+				Index:           indexName,
+				Id:              documentId,
+				Routing:         routing,
+				Source:          r.Body,
+				RetryOnConflict: retryOnConflict,
+			},
+		},
+		Refresh: refresh,
+	}
+	node := clusterState.Nodes.Nodes[shardRouting.CurrentNodeId]
+	version := h.transportService.GetVersion(node)
+	h.transportService.SendRequestWithHandler(node, ShardBulkAction, common.ToBytes(&bulkRequest, version), transport.RequestOptions{}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			bulkResponse, err := readShardBulkResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				reply(transportFailureResponse(err))
+				return
+			}
+			res := bulkResponse.Items[0]
+			if res.Err != "" {
+				status, errorType, reason := bulkItemFailure(res)
+				reply(newErrorResponse(status, errorType, reason))
+				return
+			}
+			body := withForcedRefresh(bulkSuccessResponse(bulkRequest.Items[0], res), bulkResponse.ForcedRefresh)
+			statusCode := body["status"].(int)
+			delete(body, "status")
+			reply(RestResponse{
+				StatusCode: statusCode,
+				Body:       body,
+			})
+		},
+		OnFailure: func(err error) {
+			reply(transportFailureResponse(err))
+		},
+	})
+}
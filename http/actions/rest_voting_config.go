@@ -0,0 +1,163 @@
+package actions
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"strings"
+	"time"
+)
+
+type RestAddVotingConfigExclusions struct {
+	clusterService *cluster.Service
+}
+
+func NewRestAddVotingConfigExclusions(clusterService *cluster.Service) *RestAddVotingConfigExclusions {
+	return &RestAddVotingConfigExclusions{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestAddVotingConfigExclusions) Handle(r *RestRequest, reply ResponseListener) {
+	nodeIds := splitParam(r.Param("node_ids"))
+	nodeNames := splitParam(r.Param("node_names"))
+	if nodeName := r.PathParams["node_name"]; nodeName != "" {
+		nodeNames = append(nodeNames, splitParam(nodeName)...)
+	}
+	if (len(nodeIds) == 0) == (len(nodeNames) == 0) {
+		reply(newErrorResponse(400, "illegal_argument_exception", "Please set node identifiers correctly. One and only one of [node_name], [node_names] and [node_ids] has to be set"))
+		return
+	}
+	if _, err := r.ParamAsDuration("timeout", 30*time.Second); err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("timeout", r.Param("timeout")).Error()))
+		return
+	}
+	masterTimeout, err := r.ParamAsDuration("master_timeout", 30*time.Second)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("master_timeout", r.Param("master_timeout")).Error()))
+		return
+	}
+
+	config := state.TaskConfig{Priority: state.PriorityUrgent, MasterTimeout: masterTimeout}
+	publishErr := h.clusterService.SubmitStateUpdateTask("add-voting-config-exclusions", config, func(current state.ClusterState) state.ClusterState {
+		var newState state.ClusterState
+		newState, err = cluster.AddVotingConfigExclusions(current, nodeIds, nodeNames)
+		if err != nil {
+			return current
+		}
+		return newState
+	})
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", err.Error()))
+		return
+	}
+	if response := clusterStateUpdateError(publishErr); response != nil {
+		reply(*response)
+		return
+	}
+
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       map[string]interface{}{},
+	})
+}
+
+type RestClearVotingConfigExclusions struct {
+	clusterService *cluster.Service
+}
+
+func NewRestClearVotingConfigExclusions(clusterService *cluster.Service) *RestClearVotingConfigExclusions {
+	return &RestClearVotingConfigExclusions{
+		clusterService: clusterService,
+	}
+}
+
+func (h *RestClearVotingConfigExclusions) Handle(r *RestRequest, reply ResponseListener) {
+	waitForRemoval := r.ParamAsBool("wait_for_removal", true)
+	timeout, err := r.ParamAsDuration("timeout", 30*time.Second)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("timeout", r.Param("timeout")).Error()))
+		return
+	}
+	masterTimeout, err := r.ParamAsDuration("master_timeout", 30*time.Second)
+	if err != nil {
+		reply(newErrorResponse(400, "illegal_argument_exception", invalidParameter("master_timeout", r.Param("master_timeout")).Error()))
+		return
+	}
+
+	if waitForRemoval {
+		// the excluded nodes leave the cluster first, otherwise they would vote again
+		clusterState, removed := h.clusterService.ApplierService.WaitForState(func(clusterState *state.ClusterState) bool {
+			return len(excludedNodesInCluster(clusterState)) == 0
+		}, timeout)
+		if !removed {
+			reply(newErrorResponse(500, "elasticsearch_timeout_exception", "timed out waiting for removal of nodes; if nodes should not be removed, set waitForRemoval to false. "+strings.Join(excludedNodesInCluster(clusterState), ", ")))
+			return
+		}
+	}
+
+	config := state.TaskConfig{Priority: state.PriorityUrgent, MasterTimeout: masterTimeout}
+	publishErr := h.clusterService.SubmitStateUpdateTask("clear-voting-config-exclusions", config, func(current state.ClusterState) state.ClusterState {
+		return cluster.ClearVotingConfigExclusions(current)
+	})
+	if response := clusterStateUpdateError(publishErr); response != nil {
+		reply(*response)
+		return
+	}
+
+	reply(RestResponse{
+		StatusCode: 200,
+		Body:       map[string]interface{}{},
+	})
+}
+
+// excludedNodesInCluster lists the excluded nodes still in the cluster.
+func excludedNodesInCluster(clusterState *state.ClusterState) []string {
+	var nodes []string
+	for _, node := range clusterState.Nodes.Nodes {
+		if clusterState.Metadata.Coordination.IsExcluded(node) {
+			nodes = append(nodes, "{"+node.Name+"}{"+node.Id+"}")
+		}
+	}
+	return nodes
+}
+
+func splitParam(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// coordinationBody renders the voting configurations as the cluster state API does.
+func coordinationBody(coordination state.CoordinationMetadata) map[string]interface{} {
+	exclusions := []map[string]interface{}{}
+	for _, exclusion := range coordination.VotingConfigExclusions {
+		nodeId, nodeName := exclusion.NodeId, exclusion.NodeName
+		if nodeId == "" {
+			nodeId = "_absent_"
+		}
+		if nodeName == "" {
+			nodeName = "_absent_"
+		}
+		exclusions = append(exclusions, map[string]interface{}{
+			"node_id":   nodeId,
+			"node_name": nodeName,
+		})
+	}
+	return map[string]interface{}{
+		"term":                     coordination.Term,
+		"last_committed_config":    votingConfigurationBody(coordination.LastCommittedConfiguration),
+		"last_accepted_config":     votingConfigurationBody(coordination.LastAcceptedConfiguration),
+		"voting_config_exclusions": exclusions,
+	}
+}
+
+func votingConfigurationBody(configuration state.VotingConfiguration) []string {
+	if configuration.NodeIds == nil {
+		return []string{}
+	}
+	return configuration.NodeIds
+}
@@ -2,14 +2,20 @@ package http
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"github.com/actumn/searchgoose/http/actions"
+	"github.com/actumn/searchgoose/security"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/indices"
 	"github.com/actumn/searchgoose/state/transport"
+	"github.com/actumn/searchgoose/tasks"
 	"github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
+	"net"
+	"strings"
 	"sync"
+	"time"
 )
 
 func requestFromCtx(ctx *fasthttp.RequestCtx) actions.RestRequest {
@@ -42,7 +48,10 @@ func requestFromCtx(ctx *fasthttp.RequestCtx) actions.RestRequest {
 }
 
 type RequestController struct {
-	pathTrie *pathTrie
+	pathTrie       *pathTrie
+	clusterService *cluster.Service
+	// authenticator is nil when security is disabled, every request is then served
+	authenticator *security.Authenticator
 }
 
 func (c *RequestController) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
@@ -50,7 +59,21 @@ func (c *RequestController) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 	if request.Path == "/favicon.ico" {
 		return
 	}
-	logrus.Info(string(ctx.Method()), " ", string(ctx.Request.RequestURI()), " ", string(ctx.Request.Body()))
+	if strings.HasPrefix(request.Path, "/_security") {
+		// the bodies of the security APIs hold passwords
+		logrus.Info(string(ctx.Method()), " ", string(ctx.Request.RequestURI()))
+	} else {
+		logrus.Info(string(ctx.Method()), " ", string(ctx.Request.RequestURI()), " ", string(ctx.Request.Body()))
+	}
+	if c.authenticator != nil {
+		authentication, err := c.authenticator.Authenticate(string(ctx.Request.Header.Peek("Authorization")), request.Path, c.clusterService.State().Metadata.Security, time.Now())
+		if err != nil {
+			logrus.Warn(string(ctx.Method()), " ", request.Path, " ", err)
+			writeResponse(ctx, actions.SecurityErrorResponse(err))
+			return
+		}
+		request.Authentication = authentication
+	}
 	allHandlers := c.pathTrie.retrieveAll(request.Path)
 	for {
 		h, params, err := allHandlers()
@@ -76,6 +99,14 @@ func (c *RequestController) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 			continue
 		}
 
+		if request.Authentication != nil {
+			if err := c.authorize(handler, &request); err != nil {
+				logrus.Warn(string(ctx.Method()), " ", request.Path, " ", err)
+				writeResponse(ctx, actions.SecurityErrorResponse(err))
+				return
+			}
+		}
+
 		wg := sync.WaitGroup{}
 		wg.Add(1)
 		handler.Handle(&request, func(response actions.RestResponse) {
@@ -96,17 +127,34 @@ func (c *RequestController) HandleFastHTTP(ctx *fasthttp.RequestCtx) {
 				method = "UNKNOWN"
 			}
 			logrus.Debug("reply on ", method, " ", request.Path, " ", ctx.ID())
-			ctx.Response.SetStatusCode(response.StatusCode)
-			ctx.Response.Header.SetCanonical([]byte("Content-Type"), []byte("application/json"))
-			if err := json.NewEncoder(ctx.Response.BodyWriter()).Encode(response.Body); err != nil {
-				logrus.Error(err)
-			}
+			writeResponse(ctx, response)
 		})
 		wg.Wait()
 		return
 	}
 }
 
+// authorize checks the user of a request is granted the actions the handler runs.
+func (c *RequestController) authorize(handler actions.RestHandler, request *actions.RestRequest) error {
+	actionRequests, err := actions.ActionRequests(handler, request)
+	if err != nil {
+		return err
+	}
+	return security.Authorize(request.Authentication, actionRequests, c.clusterService.State().Metadata)
+}
+
+func writeResponse(ctx *fasthttp.RequestCtx, response actions.RestResponse) {
+	ctx.Response.SetStatusCode(response.StatusCode)
+	ctx.Response.Header.SetCanonical([]byte("Content-Type"), []byte("application/json"))
+	if response.StatusCode == 401 {
+		ctx.Response.Header.Add("WWW-Authenticate", `Basic realm="security" charset="UTF-8"`)
+		ctx.Response.Header.Add("WWW-Authenticate", "ApiKey")
+	}
+	if err := json.NewEncoder(ctx.Response.BodyWriter()).Encode(response.Body); err != nil {
+		logrus.Error(err)
+	}
+}
+
 type Bootstrap struct {
 	s *fasthttp.Server
 }
@@ -116,11 +164,24 @@ func New(
 	clusterMetadataCreateIndexService *cluster.MetadataCreateIndexService,
 	clusterMetadataDeleteIndexService *cluster.MetadataDeleteIndexService,
 	clusterMetadataIndexAliasService *cluster.MetadataIndexAliasService,
+	clusterUpdateSettingsService *cluster.ClusterUpdateSettingsService,
+	metadataSecurityService *cluster.MetadataSecurityService,
+	allocationService *cluster.AllocationService,
 	indicesService *indices.Service,
 	transportService *transport.Service,
 	indexNameExpressionResolver *indices.NameExpressionResolver,
+	taskManager *tasks.Manager,
+	reindexRemoteWhitelist []string,
+	authenticator *security.Authenticator,
 ) *Bootstrap {
-	c := RequestController{}
+	c := RequestController{
+		clusterService: clusterService,
+		authenticator:  authenticator,
+	}
+	// the shard actions shared by several REST actions
+	actions.RegisterShardBulkAction(indicesService, transportService)
+	actions.RegisterShardScrollAction(indicesService, transportService)
+
 	c.pathTrie = newPathTrie()
 	c.pathTrie.insert("/", actions.MethodHandlers{
 		actions.GET: actions.NewRestMain(clusterService),
@@ -174,10 +235,21 @@ func New(
 	c.pathTrie.insert("/_cat/shards/{index}", actions.MethodHandlers{
 		actions.GET: actions.NewRestCatShards(clusterService, indexNameExpressionResolver, transportService),
 	})
+	catRecoveryAction := actions.NewRestCatRecovery(clusterService, indexNameExpressionResolver, transportService)
+	c.pathTrie.insert("/_cat/recovery", actions.MethodHandlers{
+		actions.GET: catRecoveryAction,
+	})
+	c.pathTrie.insert("/_cat/recovery/{index}", actions.MethodHandlers{
+		actions.GET: catRecoveryAction,
+	})
 
 	//////////////////////////// cluster //////////////////////////////////
+	clusterHealthAction := actions.NewRestClusterHealth(clusterService, indexNameExpressionResolver)
 	c.pathTrie.insert("/_cluster/health", actions.MethodHandlers{
-		actions.GET: actions.NewRestClusterHealth(clusterService, indexNameExpressionResolver),
+		actions.GET: clusterHealthAction,
+	})
+	c.pathTrie.insert("/_cluster/health/{index}", actions.MethodHandlers{
+		actions.GET: clusterHealthAction,
 	})
 	clusterStateAction := actions.NewRestClusterState(clusterService, indexNameExpressionResolver)
 	c.pathTrie.insert("/_cluster/state/{metric}", actions.MethodHandlers{
@@ -189,11 +261,83 @@ func New(
 	c.pathTrie.insert("/_cluster/stats", actions.MethodHandlers{
 		actions.GET: actions.NewRestClusterStats(clusterService, transportService, indicesService),
 	})
+	c.pathTrie.insert("/_cluster/settings", actions.MethodHandlers{
+		actions.GET: actions.NewRestClusterGetSettings(clusterService),
+		actions.PUT: actions.NewRestClusterPutSettings(clusterService, clusterUpdateSettingsService),
+	})
+	c.pathTrie.insert("/_cluster/reroute", actions.MethodHandlers{
+		actions.POST: actions.NewRestClusterReroute(clusterService, allocationService),
+	})
+	c.pathTrie.insert("/_cluster/pending_tasks", actions.MethodHandlers{
+		actions.GET: actions.NewRestClusterPendingTasks(clusterService),
+	})
+	addVotingConfigExclusionsAction := actions.NewRestAddVotingConfigExclusions(clusterService)
+	c.pathTrie.insert("/_cluster/voting_config_exclusions", actions.MethodHandlers{
+		actions.POST:   addVotingConfigExclusionsAction,
+		actions.DELETE: actions.NewRestClearVotingConfigExclusions(clusterService),
+	})
+	c.pathTrie.insert("/_cluster/voting_config_exclusions/{node_name}", actions.MethodHandlers{
+		actions.POST: addVotingConfigExclusionsAction,
+	})
+	clusterAllocationExplainAction := actions.NewRestClusterAllocationExplain(clusterService, allocationService)
+	c.pathTrie.insert("/_cluster/allocation/explain", actions.MethodHandlers{
+		actions.GET:  clusterAllocationExplainAction,
+		actions.POST: clusterAllocationExplainAction,
+	})
+
+	//////////////////////////// tasks //////////////////////////////////
+	c.pathTrie.insert("/_tasks", actions.MethodHandlers{
+		actions.GET: actions.NewRestListTasks(clusterService, transportService, taskManager),
+	})
+	c.pathTrie.insert("/_tasks/{task_id}", actions.MethodHandlers{
+		actions.GET: actions.NewRestGetTask(clusterService, transportService, taskManager),
+	})
+	c.pathTrie.insert("/_tasks/{task_id}/_cancel", actions.MethodHandlers{
+		actions.POST: actions.NewRestCancelTask(clusterService, transportService, taskManager),
+	})
+
+	c.pathTrie.insert("/_reindex", actions.MethodHandlers{
+		actions.POST: actions.NewRestReindex(clusterService, clusterMetadataCreateIndexService, indexNameExpressionResolver, transportService, taskManager, reindexRemoteWhitelist),
+	})
+
+	//////////////////////////// security //////////////////////////////////
+	getUsersAction := actions.NewRestGetUsers(clusterService)
+	putUserAction := actions.NewRestPutUser(clusterService, metadataSecurityService)
+	c.pathTrie.insert("/_security/user", actions.MethodHandlers{
+		actions.GET: getUsersAction,
+	})
+	c.pathTrie.insert("/_security/user/{username}", actions.MethodHandlers{
+		actions.GET:    getUsersAction,
+		actions.PUT:    putUserAction,
+		actions.POST:   putUserAction,
+		actions.DELETE: actions.NewRestDeleteUser(clusterService, metadataSecurityService),
+	})
+	getRolesAction := actions.NewRestGetRoles(clusterService)
+	putRoleAction := actions.NewRestPutRole(clusterService, metadataSecurityService)
+	c.pathTrie.insert("/_security/role", actions.MethodHandlers{
+		actions.GET: getRolesAction,
+	})
+	c.pathTrie.insert("/_security/role/{name}", actions.MethodHandlers{
+		actions.GET:    getRolesAction,
+		actions.PUT:    putRoleAction,
+		actions.POST:   putRoleAction,
+		actions.DELETE: actions.NewRestDeleteRole(clusterService, metadataSecurityService),
+	})
+	createApiKeyAction := actions.NewRestCreateApiKey(metadataSecurityService)
+	c.pathTrie.insert("/_security/api_key", actions.MethodHandlers{
+		actions.GET:    actions.NewRestGetApiKeys(clusterService),
+		actions.PUT:    createApiKeyAction,
+		actions.POST:   createApiKeyAction,
+		actions.DELETE: actions.NewRestInvalidateApiKeys(clusterService, metadataSecurityService),
+	})
+	c.pathTrie.insert("/_security/_authenticate", actions.MethodHandlers{
+		actions.GET: &actions.RestAuthenticate{},
+	})
 
 	//////////////////////////// index ////////////////////////////////////
 	c.pathTrie.insert("/{index}", actions.MethodHandlers{
 		actions.GET:    actions.NewRestGetIndex(clusterService, indexNameExpressionResolver),
-		actions.PUT:    actions.NewRestPutIndex(clusterMetadataCreateIndexService),
+		actions.PUT:    actions.NewRestPutIndex(clusterService, clusterMetadataCreateIndexService),
 		actions.DELETE: actions.NewRestDeleteIndex(clusterService, indexNameExpressionResolver, clusterMetadataDeleteIndexService),
 		actions.HEAD:   actions.NewRestHeadIndex(clusterService, indexNameExpressionResolver),
 	})
@@ -206,6 +350,9 @@ func New(
 		actions.PUT:    actions.NewRestIndexDocId(clusterService, clusterMetadataCreateIndexService, indicesService, indexNameExpressionResolver, transportService),
 		actions.DELETE: actions.NewRestDeleteDoc(clusterService, indicesService, indexNameExpressionResolver, transportService),
 	})
+	c.pathTrie.insert("/{index}/_update/{id}", actions.MethodHandlers{
+		actions.POST: actions.NewRestUpdateDoc(clusterService, indexNameExpressionResolver, transportService),
+	})
 	c.pathTrie.insert("/{index}/{type}/{id}", actions.MethodHandlers{ // deprecated but just for elasticsearch-HQ
 		actions.GET:    actions.NewRestGetDoc(clusterService, indicesService, indexNameExpressionResolver, transportService),
 		actions.POST:   actions.NewRestIndexDocId(clusterService, clusterMetadataCreateIndexService, indicesService, indexNameExpressionResolver, transportService),
@@ -216,9 +363,44 @@ func New(
 		actions.GET:  actions.NewRestSearch(clusterService, indicesService, indexNameExpressionResolver, transportService),
 		actions.POST: actions.NewRestSearch(clusterService, indicesService, indexNameExpressionResolver, transportService),
 	})
+	c.pathTrie.insert("/{index}/_delete_by_query", actions.MethodHandlers{
+		actions.POST: actions.NewRestDeleteByQuery(clusterService, indexNameExpressionResolver, transportService, taskManager),
+	})
+	c.pathTrie.insert("/{index}/_update_by_query", actions.MethodHandlers{
+		actions.POST: actions.NewRestUpdateByQuery(clusterService, indexNameExpressionResolver, transportService, taskManager),
+	})
+	refreshAction := actions.NewRestRefresh(clusterService, indicesService, indexNameExpressionResolver, transportService)
+	c.pathTrie.insert("/_refresh", actions.MethodHandlers{
+		actions.GET:  refreshAction,
+		actions.POST: refreshAction,
+	})
 	c.pathTrie.insert("/{index}/_refresh", actions.MethodHandlers{
-		actions.GET:  actions.NewRestRefresh(clusterService),
-		actions.POST: actions.NewRestRefresh(clusterService),
+		actions.GET:  refreshAction,
+		actions.POST: refreshAction,
+	})
+	flushAction := actions.NewRestFlush(clusterService, indicesService, indexNameExpressionResolver, transportService)
+	c.pathTrie.insert("/_flush", actions.MethodHandlers{
+		actions.GET:  flushAction,
+		actions.POST: flushAction,
+	})
+	c.pathTrie.insert("/{index}/_flush", actions.MethodHandlers{
+		actions.GET:  flushAction,
+		actions.POST: flushAction,
+	})
+	forceMergeAction := actions.NewRestForceMerge(clusterService, indicesService, indexNameExpressionResolver, transportService)
+	c.pathTrie.insert("/_forcemerge", actions.MethodHandlers{
+		actions.POST: forceMergeAction,
+	})
+	c.pathTrie.insert("/{index}/_forcemerge", actions.MethodHandlers{
+		actions.POST: forceMergeAction,
+	})
+
+	recoveryAction := actions.NewRestRecovery(clusterService, indicesService, indexNameExpressionResolver, transportService)
+	c.pathTrie.insert("/_recovery", actions.MethodHandlers{
+		actions.GET: recoveryAction,
+	})
+	c.pathTrie.insert("/{index}/_recovery", actions.MethodHandlers{
+		actions.GET: recoveryAction,
 	})
 
 	indicesStatsAction := actions.NewRestIndicesStatsAction(clusterService, indicesService, indexNameExpressionResolver, transportService)
@@ -228,10 +410,15 @@ func New(
 	c.pathTrie.insert("/{index}/_stats", actions.MethodHandlers{
 		actions.GET: indicesStatsAction,
 	})
-	//c.pathTrie.insert("/{index}/_bulk", actions.MethodHandlers{
-	//	actions.POST: ,
-	//	actions.PUT: ,
-	//})
+	bulkAction := actions.NewRestBulk(clusterService, clusterMetadataCreateIndexService, indexNameExpressionResolver, transportService)
+	c.pathTrie.insert("/_bulk", actions.MethodHandlers{
+		actions.POST: bulkAction,
+		actions.PUT:  bulkAction,
+	})
+	c.pathTrie.insert("/{index}/_bulk", actions.MethodHandlers{
+		actions.POST: bulkAction,
+		actions.PUT:  bulkAction,
+	})
 	c.pathTrie.insert("/{index}/{type}/{id}/_source", actions.MethodHandlers{
 		actions.GET: actions.NewRestGetSource(clusterService, indicesService, indexNameExpressionResolver, transportService),
 	})
@@ -251,6 +438,14 @@ func New(
 	}
 }
 
-func (b *Bootstrap) Start(port string) error {
-	return b.s.ListenAndServe(port)
+// Start serves HTTP on port, HTTPS when tlsConfig is set.
+func (b *Bootstrap) Start(port string, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return b.s.ListenAndServe(port)
+	}
+	l, err := net.Listen("tcp", port)
+	if err != nil {
+		return err
+	}
+	return b.s.Serve(tls.NewListener(l, tlsConfig))
 }
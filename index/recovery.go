@@ -0,0 +1,196 @@
+package index
+
+import (
+	"fmt"
+	"github.com/blevesearch/bleve"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RecoveryFile is a file of a recovery snapshot, Name being relative to the snapshot directory.
+type RecoveryFile struct {
+	Name   string
+	Length int64
+}
+
+// RecoverySnapshot is a copy of the committed engine files of a shard, taken so that a peer recovery
+// can fetch them while the shard keeps taking writes.
+type RecoverySnapshot struct {
+	Path  string
+	SeqNo int64
+	Files []RecoveryFile
+}
+
+// EngineFailedError is returned when the engine of a shard could not be reopened, the shard can no longer be used
+// and has to be failed.
+type EngineFailedError struct {
+	Err error
+}
+
+func (e *EngineFailedError) Error() string {
+	return fmt.Sprintf("failed to reopen the engine: %v", e.Err)
+}
+
+func (s *Shard) recoverySnapshotPath(recoveryId string) string {
+	return s.path + ".recovery-" + recoveryId
+}
+
+// SnapshotForRecovery commits the shard and copies its engine files aside. The engine is closed
+// during the copy, since closing is what makes scorch persist its segments and it rewrites its
+// files while merging. The shard stalls meanwhile: writes, refreshes, gets and searches wait
+// until the engine is reopened. The segment files are hard linked, so the stall is about the
+// time to close and reopen the engine, longer on a file system without hard links where they
+// are copied. The translog operations after the snapshot are kept until the recovery is
+// finalized or cancelled. An *EngineFailedError is returned when the engine could not be reopened.
+func (s *Shard) SnapshotForRecovery(recoveryId string) (*RecoverySnapshot, error) {
+	if err := s.Refresh(); err != nil {
+		return nil, err
+	}
+	s.refreshMux.Lock()
+	defer s.refreshMux.Unlock()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.engineMux.Lock()
+	defer s.engineMux.Unlock()
+
+	// commit what was written since the refresh
+	if s.batch.Size() > 0 {
+		if err := s.engine.Batch(s.batch); err != nil {
+			return nil, err
+		}
+		s.batch = s.engine.NewBatch()
+	}
+	s.markRefreshed(s.maxSeqNo)
+
+	if err := s.engine.Close(); err != nil {
+		return nil, err
+	}
+	snapshot := &RecoverySnapshot{
+		Path:  s.recoverySnapshotPath(recoveryId),
+		SeqNo: s.maxSeqNo,
+	}
+	copyErr := copyEngineFiles(s.path, snapshot)
+
+	engine, err := bleve.Open(s.path)
+	if err != nil {
+		os.RemoveAll(snapshot.Path)
+		return nil, &EngineFailedError{Err: err}
+	}
+	s.engine = engine
+	s.batch = engine.NewBatch()
+
+	if copyErr != nil {
+		os.RemoveAll(snapshot.Path)
+		return nil, copyErr
+	}
+	s.historyRetention[recoveryId] = snapshot.SeqNo
+	return snapshot, nil
+}
+
+// copyEngineFiles copies the engine files of a shard, leaving out its translog. Segment files are
+// never modified once written, so they are hard linked when possible.
+func copyEngineFiles(shardPath string, snapshot *RecoverySnapshot) error {
+	if err := os.RemoveAll(snapshot.Path); err != nil {
+		return err
+	}
+	return filepath.Walk(shardPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(shardPath, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if name == "translog" {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(snapshot.Path, name), 0755)
+		}
+		target := filepath.Join(snapshot.Path, name)
+		if !strings.HasSuffix(name, ".zap") || os.Link(path, target) != nil {
+			if err := copyFile(path, target); err != nil {
+				return err
+			}
+		}
+		snapshot.Files = append(snapshot.Files, RecoveryFile{
+			Name:   filepath.ToSlash(name),
+			Length: info.Size(),
+		})
+		return nil
+	})
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// ReadRecoveryFile reads up to length bytes at offset of a file of a recovery snapshot.
+func (s *Shard) ReadRecoveryFile(recoveryId string, name string, offset int64, length int) ([]byte, error) {
+	root := filepath.Clean(s.recoverySnapshotPath(recoveryId))
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return nil, fmt.Errorf("invalid recovery file [%s]", name)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chunk := make([]byte, length)
+	n, err := f.ReadAt(chunk, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return chunk[:n], nil
+}
+
+// OperationsSince returns the translog operations above seqNo.
+func (s *Shard) OperationsSince(seqNo int64) ([]Operation, error) {
+	return s.translog.OperationsSince(seqNo)
+}
+
+// FinalizeRecovery returns the operations above seqNo while writes are blocked, then replicates the
+// following writes to the recovered copy on nodeId. Operations may reach the copy both ways, which
+// ApplyOperations tolerates. The snapshot of the recovery is released.
+func (s *Shard) FinalizeRecovery(recoveryId string, nodeId string, seqNo int64) ([]Operation, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	ops, err := s.translog.OperationsSince(seqNo)
+	if err != nil {
+		return nil, err
+	}
+	s.replicationTargets[nodeId] = struct{}{}
+	s.releaseRecovery(recoveryId)
+	return ops, nil
+}
+
+// CancelRecovery releases the snapshot and translog operations kept for a recovery.
+func (s *Shard) CancelRecovery(recoveryId string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.releaseRecovery(recoveryId)
+}
+
+func (s *Shard) releaseRecovery(recoveryId string) {
+	delete(s.historyRetention, recoveryId)
+	if err := os.RemoveAll(s.recoverySnapshotPath(recoveryId)); err != nil {
+		logrus.Warnf("failed to remove recovery snapshot [%s]: %v", recoveryId, err)
+	}
+}
@@ -5,20 +5,48 @@ import (
 	"github.com/actumn/searchgoose/state"
 	"github.com/blevesearch/bleve/mapping"
 	"github.com/sirupsen/logrus"
+	"os"
 	"strconv"
+	"time"
 )
 
 type Service struct {
-	uuid         string
-	Shards       map[int]*Shard
-	indexMapping *mapping.IndexMappingImpl
+	uuid            string
+	Shards          map[int]*Shard
+	indexMapping    *mapping.IndexMappingImpl
+	refreshInterval time.Duration
+
+	translogDurability   string
+	translogSyncInterval time.Duration
 }
 
 func NewService(uuid string) *Service {
 	return &Service{
-		uuid:         uuid,
-		Shards:       map[int]*Shard{},
-		indexMapping: mapping.NewIndexMapping(),
+		uuid:            uuid,
+		Shards:          map[int]*Shard{},
+		indexMapping:    mapping.NewIndexMapping(),
+		refreshInterval: time.Second,
+
+		translogDurability:   TranslogDurabilityRequest,
+		translogSyncInterval: 5 * time.Second,
+	}
+}
+
+// UpdateSettings applies the settings of the index metadata to the shards of the index.
+func (s *Service) UpdateSettings(metadata state.IndexMetadata) {
+	// indices created before these settings existed keep the defaults
+	if metadata.RefreshInterval != 0 {
+		s.refreshInterval = metadata.RefreshInterval
+	}
+	if metadata.TranslogDurability != "" {
+		s.translogDurability = metadata.TranslogDurability
+	}
+	if metadata.TranslogSyncInterval != 0 {
+		s.translogSyncInterval = metadata.TranslogSyncInterval
+	}
+	for _, shard := range s.Shards {
+		shard.SetRefreshInterval(s.refreshInterval)
+		shard.SetTranslogDurability(s.translogDurability, s.translogSyncInterval)
 	}
 }
 
@@ -60,9 +88,15 @@ func (s *Service) UpdateMapping(metadata state.IndexMetadata) {
 	}
 }
 
+// ShardPath returns the directory holding the data of a shard of the index.
+func (s *Service) ShardPath(shardId int) string {
+	return "./data/" + s.uuid + "/" + strconv.Itoa(shardId)
+}
+
 func (s *Service) CreateShard(shardRouting state.ShardRouting) {
-	path := "./data/" + s.uuid + "/" + strconv.Itoa(shardRouting.ShardId.ShardId)
-	shard := NewShard(shardRouting, path, s.indexMapping)
+	shard := NewShard(shardRouting, s.ShardPath(shardRouting.ShardId.ShardId), s.indexMapping)
+	shard.SetRefreshInterval(s.refreshInterval)
+	shard.SetTranslogDurability(s.translogDurability, s.translogSyncInterval)
 	s.Shards[shardRouting.ShardId.ShardId] = shard
 }
 
@@ -70,3 +104,25 @@ func (s *Service) Shard(shardId int) (*Shard, bool) {
 	shard, ok := s.Shards[shardId]
 	return shard, ok
 }
+
+// RemoveShard closes a shard and deletes its data.
+func (s *Service) RemoveShard(shardId int) {
+	if shard, ok := s.Shards[shardId]; ok {
+		if err := shard.Close(); err != nil {
+			logrus.Warnf("failed to close shard [%d] of index [%s]: %v", shardId, s.uuid, err)
+		}
+		delete(s.Shards, shardId)
+	}
+	if err := os.RemoveAll(s.ShardPath(shardId)); err != nil {
+		logrus.Warnf("failed to delete shard [%d] of index [%s]: %v", shardId, s.uuid, err)
+	}
+}
+
+// Close closes every shard of the index.
+func (s *Service) Close() {
+	for shardId, shard := range s.Shards {
+		if err := shard.Close(); err != nil {
+			logrus.Warnf("failed to close shard [%d] of index [%s]: %v", shardId, s.uuid, err)
+		}
+	}
+}
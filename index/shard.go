@@ -1,52 +1,471 @@
 package index
 
 import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/errors"
 	"github.com/actumn/searchgoose/state"
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/document"
 	"github.com/blevesearch/bleve/index/scorch"
+	"github.com/blevesearch/bleve/index/scorch/mergeplan"
 	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/nqd/flat"
 	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
+const (
+	// VersionNotFound as an expected version means the document must not exist yet (op_type=create).
+	VersionNotFound int64 = -1
+	// VersionMatchAny as an expected version disables the version check.
+	VersionMatchAny int64 = -3
+)
+
+const (
+	// flushThresholdSize is the size of the uncommitted translog that triggers a flush
+	flushThresholdSize int64 = 512 * 1024 * 1024
+	// persistTimeout bounds how long a flush waits for the engine to persist its segments
+	persistTimeout = 30 * time.Second
+)
+
+var (
+	maxSeqNoKey = []byte("_max_seq_no")
+)
+
+func versionKey(id string) []byte {
+	return []byte("_version/" + id)
+}
+
+func routingKey(id string) []byte {
+	return []byte("_routing/" + id)
+}
+
+// tombstoneKey holds the sequence number of the delete of a document, so an older operation
+// replicated out of order cannot bring the document back.
+func tombstoneKey(id string) []byte {
+	return []byte("_tombstone/" + id)
+}
+
+// pendingDoc is the latest write of a document that has not been refreshed yet.
+// fields is nil for a delete.
+type pendingDoc struct {
+	fields  map[string]interface{}
+	version int64
+	seqNo   int64
+	routing string
+}
+
+// Replicator sends operations written on a primary to the copies of the shard on the given nodes.
+type Replicator func(nodeIds []string, ops []Operation) error
+
+// Shard buffers writes until they are refreshed, so searches only see the documents of the last refresh
+// while gets and version checks read the latest writes.
 type Shard struct {
 	shardRouting state.ShardRouting
+	path         string
 	engine       bleve.Index
+	// engineMux guards the engine against being reopened while it is read, see SnapshotForRecovery
+	engineMux sync.RWMutex
+	mux       sync.Mutex
+	maxSeqNo  int64
+
+	batch          *bleve.Batch
+	pending        map[string]pendingDoc
+	refreshedSeqNo int64
+	refreshed      chan struct{}
+	refreshMux     sync.Mutex
+
+	refreshInterval time.Duration
+	stopRefresh     chan struct{}
+
+	translog           *Translog
+	translogDurability string
+	stopTranslogSync   chan struct{}
+
+	replicator         Replicator
+	replicationTargets map[string]struct{}
+	// historyRetention holds the sequence number of the snapshot of each ongoing recovery,
+	// the translog operations after it are kept until the recovery ends
+	historyRetention map[string]int64
 }
 
+// NewShard opens the shard stored at shardPath, creating it when missing, and replays the operations
+// of its translog that the engine had not committed yet.
 func NewShard(shardRouting state.ShardRouting, shardPath string, mapping mapping.IndexMapping) *Shard {
-	index, err := bleve.NewUsing(shardPath, mapping, scorch.Name, scorch.Name, map[string]interface{}{
-		"create_if_missing": true,
-		"error_if_exists":   false,
-	})
+	var index bleve.Index
+	var err error
+	if _, statErr := os.Stat(filepath.Join(shardPath, "index_meta.json")); statErr == nil {
+		index, err = bleve.Open(shardPath)
+	} else {
+		index, err = bleve.NewUsing(shardPath, mapping, scorch.Name, scorch.Name, map[string]interface{}{
+			"create_if_missing": true,
+			"error_if_exists":   false,
+		})
+	}
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	return &Shard{
-		shardRouting: shardRouting,
-		engine:       index,
+	maxSeqNo := int64(-1)
+	if b, err := index.GetInternal(maxSeqNoKey); err == nil && len(b) == 8 {
+		maxSeqNo = int64(binary.BigEndian.Uint64(b))
+	}
+
+	translog, operations, err := OpenTranslog(filepath.Join(shardPath, "translog"))
+	if err != nil {
+		logrus.Fatal(err)
 	}
+
+	s := &Shard{
+		shardRouting:       shardRouting,
+		path:               shardPath,
+		engine:             index,
+		maxSeqNo:           maxSeqNo,
+		batch:              index.NewBatch(),
+		pending:            map[string]pendingDoc{},
+		refreshedSeqNo:     maxSeqNo,
+		refreshed:          make(chan struct{}),
+		translog:           translog,
+		translogDurability: TranslogDurabilityRequest,
+		replicationTargets: map[string]struct{}{},
+		historyRetention:   map[string]int64{},
+	}
+	if err := s.recover(operations); err != nil {
+		logrus.Fatal(err)
+	}
+	return s
 }
 
-func (s *Shard) Index(id string, fields map[string]interface{}) error {
-	if err := s.engine.Index(id, fields); err != nil {
-		return err
+// recover replays the translog operations above the sequence number committed in the engine
+// and flushes them.
+func (s *Shard) recover(operations []Operation) error {
+	replayed := 0
+	s.mux.Lock()
+	for _, op := range operations {
+		if op.SeqNo <= s.maxSeqNo {
+			continue
+		}
+		if err := s.apply(op); err != nil {
+			logrus.Warnf("failed to replay operation [%d] on [%s]: %v", op.SeqNo, op.Id, err)
+			continue
+		}
+		replayed++
+	}
+	s.mux.Unlock()
+
+	if replayed > 0 {
+		logrus.Infof("Recovered %d operations from the translog of shard [%s][%d]", replayed, s.shardRouting.ShardId.Index.Name, s.shardRouting.ShardId.ShardId)
+	}
+	return s.Flush()
+}
+
+// apply buffers an operation for the next refresh.
+func (s *Shard) apply(op Operation) error {
+	switch op.OpType {
+	case "index":
+		if err := s.batch.Index(op.Id, op.Source); err != nil {
+			return err
+		}
+		s.batch.SetInternal(versionKey(op.Id), encodeVersion(op.Version, op.SeqNo))
+		if op.Routing != "" {
+			s.batch.SetInternal(routingKey(op.Id), []byte(op.Routing))
+		} else {
+			s.batch.DeleteInternal(routingKey(op.Id))
+		}
+		s.batch.DeleteInternal(tombstoneKey(op.Id))
+		s.pending[op.Id] = pendingDoc{
+			fields:  op.Source,
+			version: op.Version,
+			seqNo:   op.SeqNo,
+			routing: op.Routing,
+		}
+	case "delete":
+		s.batch.Delete(op.Id)
+		s.batch.DeleteInternal(versionKey(op.Id))
+		s.batch.DeleteInternal(routingKey(op.Id))
+		s.batch.SetInternal(tombstoneKey(op.Id), encodeSeqNo(op.SeqNo))
+		s.pending[op.Id] = pendingDoc{
+			seqNo: op.SeqNo,
+		}
+	}
+	// replicated operations may arrive out of order
+	if op.SeqNo > s.maxSeqNo {
+		s.batch.SetInternal(maxSeqNoKey, encodeSeqNo(op.SeqNo))
+		s.maxSeqNo = op.SeqNo
 	}
 	return nil
 }
 
-func (s *Shard) Delete(id string) error {
-	if err := s.engine.Delete(id); err != nil {
+// addToTranslogAndApply writes a new operation of the primary to the translog before applying it, an operation that
+// could not be made durable is not applied. An operation that fails to apply is followed by a noop in the translog,
+// so it is not replayed either.
+func (s *Shard) addToTranslogAndApply(op Operation) error {
+	if err := s.translog.Add(op); err != nil {
+		return err
+	}
+	if err := s.apply(op); err != nil {
+		if noopErr := s.translog.Add(Operation{OpType: NoopOpType, Id: op.Id, SeqNo: op.SeqNo}); noopErr != nil {
+			logrus.Warnf("failed to mark operation [%d] on [%s] as failed in the translog: %v", op.SeqNo, op.Id, noopErr)
+		}
+		// the translog holds the operation, its sequence number is not given to another one
+		s.maxSeqNo = op.SeqNo
 		return err
 	}
 	return nil
 }
 
+// WriteResult describes the outcome of a single index or delete operation on a shard.
+type WriteResult struct {
+	Version int64
+	SeqNo   int64
+	Result  string
+}
+
+func (s *Shard) Index(id string, routing string, fields map[string]interface{}, expectedVersion int64) (WriteResult, error) {
+	s.mux.Lock()
+	result, op, err := s.index(id, routing, fields, expectedVersion)
+	replicator, targets := s.replicator, s.replicationTargetIds()
+	s.mux.Unlock()
+	if err != nil {
+		return result, err
+	}
+	if err := s.syncTranslog(); err != nil {
+		return result, err
+	}
+	s.replicate(replicator, targets, op)
+	return result, nil
+}
+
+func (s *Shard) index(id string, routing string, fields map[string]interface{}, expectedVersion int64) (WriteResult, Operation, error) {
+	currentVersion, _ := s.version(id)
+	if expectedVersion != VersionMatchAny && expectedVersion != currentVersion {
+		return WriteResult{Version: currentVersion}, Operation{}, errors.ErrVersionConflict
+	}
+
+	result := "updated"
+	version := currentVersion + 1
+	if currentVersion == VersionNotFound {
+		result = "created"
+		version = 1
+	}
+	op := Operation{
+		OpType:  "index",
+		Id:      id,
+		Routing: routing,
+		Version: version,
+		SeqNo:   s.maxSeqNo + 1,
+		Source:  fields,
+	}
+	if err := s.addToTranslogAndApply(op); err != nil {
+		return WriteResult{}, op, err
+	}
+
+	return WriteResult{
+		Version: version,
+		SeqNo:   op.SeqNo,
+		Result:  result,
+	}, op, nil
+}
+
+func (s *Shard) Delete(id string, expectedVersion int64) (WriteResult, error) {
+	s.mux.Lock()
+	result, op, err := s.delete(id, expectedVersion)
+	replicator, targets := s.replicator, s.replicationTargetIds()
+	s.mux.Unlock()
+	if err != nil || result.Result == "not_found" {
+		return result, err
+	}
+	if err := s.syncTranslog(); err != nil {
+		return result, err
+	}
+	s.replicate(replicator, targets, op)
+	return result, nil
+}
+
+func (s *Shard) delete(id string, expectedVersion int64) (WriteResult, Operation, error) {
+	currentVersion, _ := s.version(id)
+	if expectedVersion != VersionMatchAny && expectedVersion != currentVersion {
+		return WriteResult{Version: currentVersion}, Operation{}, errors.ErrVersionConflict
+	}
+	if currentVersion == VersionNotFound {
+		return WriteResult{Version: VersionNotFound, SeqNo: -1, Result: "not_found"}, Operation{}, nil
+	}
+
+	op := Operation{
+		OpType:  "delete",
+		Id:      id,
+		Version: currentVersion + 1,
+		SeqNo:   s.maxSeqNo + 1,
+	}
+	if err := s.addToTranslogAndApply(op); err != nil {
+		return WriteResult{}, op, err
+	}
+
+	return WriteResult{
+		Version: op.Version,
+		SeqNo:   op.SeqNo,
+		Result:  "deleted",
+	}, op, nil
+}
+
+// ApplyOperations applies operations replicated from the primary or replayed by a peer recovery.
+// An operation older than the last one applied to its document is skipped, so operations may
+// arrive twice or out of order.
+func (s *Shard) ApplyOperations(ops []Operation) error {
+	s.mux.Lock()
+	for _, op := range ops {
+		if op.SeqNo <= s.seqNo(op.Id) {
+			continue
+		}
+		if err := s.translog.Add(op); err != nil {
+			s.mux.Unlock()
+			return err
+		}
+		if err := s.apply(op); err != nil {
+			s.mux.Unlock()
+			return err
+		}
+	}
+	s.mux.Unlock()
+	return s.syncTranslog()
+}
+
+// seqNo returns the sequence number of the last operation applied to a document, its delete included.
+func (s *Shard) seqNo(id string) int64 {
+	if doc, ok := s.pending[id]; ok {
+		return doc.seqNo
+	}
+	if _, seqNo := s.version(id); seqNo >= 0 {
+		return seqNo
+	}
+	b, err := s.engine.GetInternal(tombstoneKey(id))
+	if err != nil || len(b) != 8 {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// SetReplicator sets how the writes of a primary are sent to its replicas.
+func (s *Shard) SetReplicator(replicator Replicator) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.replicator = replicator
+}
+
+// UpdateReplicationTargets replicates the writes to the started copies and stops replicating to the
+// nodes that no longer hold a copy. Copies that are still recovering are added by FinalizeRecovery.
+func (s *Shard) UpdateReplicationTargets(startedNodeIds []string, assignedNodeIds []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, nodeId := range startedNodeIds {
+		s.replicationTargets[nodeId] = struct{}{}
+	}
+	assigned := map[string]struct{}{}
+	for _, nodeId := range assignedNodeIds {
+		assigned[nodeId] = struct{}{}
+	}
+	for nodeId := range s.replicationTargets {
+		if _, ok := assigned[nodeId]; !ok {
+			delete(s.replicationTargets, nodeId)
+		}
+	}
+}
+
+func (s *Shard) replicationTargetIds() []string {
+	nodeIds := make([]string, 0, len(s.replicationTargets))
+	for nodeId := range s.replicationTargets {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	return nodeIds
+}
+
+func (s *Shard) replicate(replicator Replicator, nodeIds []string, op Operation) {
+	if replicator == nil || len(nodeIds) == 0 {
+		return
+	}
+	if err := replicator(nodeIds, []Operation{op}); err != nil {
+		logrus.Warnf("failed to replicate operation [%d] of shard [%s][%d]: %v", op.SeqNo, s.shardRouting.ShardId.Index.Name, s.shardRouting.ShardId.ShardId, err)
+	}
+}
+
+// Version returns the current version and sequence number of a document, or VersionNotFound.
+func (s *Shard) Version(id string) (int64, int64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.version(id)
+}
+
+func (s *Shard) version(id string) (int64, int64) {
+	if doc, ok := s.pending[id]; ok {
+		if doc.fields == nil {
+			return VersionNotFound, -1
+		}
+		return doc.version, doc.seqNo
+	}
+	b, err := s.engine.GetInternal(versionKey(id))
+	if err != nil || len(b) != 16 {
+		return VersionNotFound, -1
+	}
+	return int64(binary.BigEndian.Uint64(b[:8])), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+// Routing returns the custom routing the document was indexed with, if any.
+func (s *Shard) Routing(id string) string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.routing(id)
+}
+
+func (s *Shard) routing(id string) string {
+	if doc, ok := s.pending[id]; ok {
+		return doc.routing
+	}
+	b, err := s.engine.GetInternal(routingKey(id))
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+func encodeVersion(version int64, seqNo int64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], uint64(version))
+	binary.BigEndian.PutUint64(b[8:], uint64(seqNo))
+	return b
+}
+
+func encodeSeqNo(seqNo int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(seqNo))
+	return b
+}
+
+// Get reads the latest version of a document, including writes that have not been refreshed yet.
 func (s *Shard) Get(id string) (map[string]interface{}, error) {
+	s.mux.Lock()
+	pending, ok := s.pending[id]
+	s.mux.Unlock()
+	if ok {
+		if pending.fields == nil {
+			return nil, errors.ErrNotFound
+		}
+		return flat.Flatten(pending.fields, &flat.Options{Delimiter: ".", Safe: true})
+	}
+	return s.document(id)
+}
+
+// document reads the stored fields of a refreshed document.
+func (s *Shard) document(id string) (map[string]interface{}, error) {
+	s.engineMux.RLock()
 	doc, err := s.engine.Document(id)
+	s.engineMux.RUnlock()
 	if err != nil {
 		return nil, err
 	}
@@ -90,7 +509,255 @@ func (s *Shard) Get(id string) (map[string]interface{}, error) {
 	return fields, nil
 }
 
+// Refresh makes the buffered writes visible to searches.
+func (s *Shard) Refresh() error {
+	s.refreshMux.Lock()
+	defer s.refreshMux.Unlock()
+
+	s.mux.Lock()
+	batch, seqNo := s.batch, s.maxSeqNo
+	s.batch = s.engine.NewBatch()
+	s.mux.Unlock()
+
+	if batch.Size() > 0 {
+		if err := s.engine.Batch(batch); err != nil {
+			return err
+		}
+	}
+
+	s.mux.Lock()
+	s.markRefreshed(seqNo)
+	s.mux.Unlock()
+	return nil
+}
+
+// markRefreshed drops the pending documents up to seqNo, which searches see now, and wakes up
+// the writes waiting for them.
+func (s *Shard) markRefreshed(seqNo int64) {
+	for id, doc := range s.pending {
+		// documents written again since the batch was taken stay pending
+		if doc.seqNo <= seqNo {
+			delete(s.pending, id)
+		}
+	}
+	s.refreshedSeqNo = seqNo
+	close(s.refreshed)
+	s.refreshed = make(chan struct{})
+}
+
+// WaitForRefresh blocks until a refresh has made the write with the given sequence number visible.
+// Without periodic refresh it refreshes the shard itself.
+func (s *Shard) WaitForRefresh(seqNo int64) error {
+	for {
+		s.mux.Lock()
+		if s.refreshedSeqNo >= seqNo {
+			s.mux.Unlock()
+			return nil
+		}
+		refreshed, interval := s.refreshed, s.refreshInterval
+		s.mux.Unlock()
+
+		if interval <= 0 {
+			if err := s.Refresh(); err != nil {
+				return err
+			}
+			continue
+		}
+		<-refreshed
+	}
+}
+
+// SetRefreshInterval schedules a refresh every interval. A non positive interval disables the periodic refresh.
+func (s *Shard) SetRefreshInterval(interval time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopRefresh != nil {
+		close(s.stopRefresh)
+		s.stopRefresh = nil
+	}
+	s.refreshInterval = interval
+	if interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stopRefresh = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Refresh(); err != nil {
+					logrus.Warn(err)
+				}
+				if s.translog.Stats().UncommittedSizeInBytes > flushThresholdSize {
+					if err := s.Flush(); err != nil {
+						logrus.Warn(err)
+					}
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// syncTranslog makes the operations written so far durable when the translog durability is "request".
+func (s *Shard) syncTranslog() error {
+	s.mux.Lock()
+	durability := s.translogDurability
+	s.mux.Unlock()
+	if durability != TranslogDurabilityRequest {
+		return nil
+	}
+	return s.translog.Sync()
+}
+
+// SetTranslogDurability sets index.translog.durability. With "async" the translog is synced every syncInterval.
+func (s *Shard) SetTranslogDurability(durability string, syncInterval time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopTranslogSync != nil {
+		close(s.stopTranslogSync)
+		s.stopTranslogSync = nil
+	}
+	s.translogDurability = durability
+	if durability != TranslogDurabilityAsync || syncInterval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stopTranslogSync = stop
+	go func() {
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.translog.Sync(); err != nil {
+					logrus.Warn(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Flush refreshes the shard, which commits the buffered writes to the engine, waits for the engine to persist
+// them and removes the translog generations the engine now holds.
+func (s *Shard) Flush() error {
+	if err := s.Refresh(); err != nil {
+		return err
+	}
+	if err := s.waitForPersistence(); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	committedSeqNo := s.refreshedSeqNo
+	for _, seqNo := range s.historyRetention {
+		if seqNo < committedSeqNo {
+			committedSeqNo = seqNo
+		}
+	}
+	s.mux.Unlock()
+
+	if err := s.translog.RollGeneration(); err != nil {
+		return err
+	}
+	return s.translog.TrimUpTo(committedSeqNo)
+}
+
+// waitForPersistence blocks until scorch has written the segments of the refreshes so far to disk, it may persist
+// a segment after the refresh introducing it returned.
+func (s *Shard) waitForPersistence() error {
+	s.engineMux.RLock()
+	defer s.engineMux.RUnlock()
+	engine, _, err := s.engine.Advanced()
+	if err != nil {
+		return err
+	}
+	scorchEngine, ok := engine.(*scorch.Scorch)
+	if !ok {
+		return fmt.Errorf("flush is not supported by the engine")
+	}
+
+	rootEpoch, _ := scorchEngine.StatsMap()["CurRootEpoch"].(uint64)
+	for deadline := time.Now().Add(persistTimeout); ; {
+		if persistedEpoch, _ := scorchEngine.StatsMap()["LastPersistedEpoch"].(uint64); persistedEpoch >= rootEpoch {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the engine to persist epoch [%d]", rootEpoch)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// ForceMerge flushes the shard and merges its segments down to maxNumSegments, or as the merge policy
+// sees fit when maxNumSegments is not positive. With onlyExpungeDeletes the planner favors the segments
+// holding deleted documents.
+func (s *Shard) ForceMerge(maxNumSegments int, onlyExpungeDeletes bool) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.engineMux.RLock()
+	defer s.engineMux.RUnlock()
+	engine, _, err := s.engine.Advanced()
+	if err != nil {
+		return err
+	}
+	scorchEngine, ok := engine.(*scorch.Scorch)
+	if !ok {
+		return fmt.Errorf("force merge is not supported by the engine")
+	}
+
+	options := mergeplan.DefaultMergePlanOptions
+	switch {
+	case onlyExpungeDeletes:
+		options.ReclaimDeletesWeight = 10.0
+	case maxNumSegments == 1:
+		options = mergeplan.SingleSegmentMergePlanOptions
+	case maxNumSegments > 1:
+		options = mergeplan.SingleSegmentMergePlanOptions
+		options.MaxSegmentsPerTier = maxNumSegments
+	}
+	return scorchEngine.ForceMerge(context.Background(), &options)
+}
+
+// Segments returns the number of segments of the last persisted engine snapshot.
+func (s *Shard) Segments() uint64 {
+	s.engineMux.RLock()
+	defer s.engineMux.RUnlock()
+	statsMap := s.engine.StatsMap()["index"].(map[string]interface{})
+	segments, _ := statsMap["num_root_filesegments"].(uint64)
+	return segments
+}
+
+// Close stops the background refresh and translog sync, flushes the shard and closes the engine.
+func (s *Shard) Close() error {
+	s.SetRefreshInterval(0)
+	s.SetTranslogDurability(TranslogDurabilityRequest, 0)
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if err := s.translog.Close(); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	for recoveryId := range s.historyRetention {
+		s.releaseRecovery(recoveryId)
+	}
+	s.mux.Unlock()
+	s.engineMux.Lock()
+	defer s.engineMux.Unlock()
+	return s.engine.Close()
+}
+
 func (s *Shard) Search(searchRequest *bleve.SearchRequest) (*bleve.SearchResult, error) {
+	s.engineMux.RLock()
+	defer s.engineMux.RUnlock()
 	searchResult, err := s.engine.Search(searchRequest)
 	if err != nil {
 		return nil, err
@@ -98,23 +765,195 @@ func (s *Shard) Search(searchRequest *bleve.SearchRequest) (*bleve.SearchResult,
 	return searchResult, nil
 }
 
+// Matches tells whether the latest write of a document matches q, as Get reads it. A document that has not
+// been refreshed yet is matched against an in-memory index of it alone.
+func (s *Shard) Matches(id string, q query.Query) (bool, error) {
+	searchRequest := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(bleve.NewDocIDQuery([]string{id}), q), 1, 0, false)
+
+	s.mux.Lock()
+	pending, ok := s.pending[id]
+	s.mux.Unlock()
+	if !ok {
+		result, err := s.Search(searchRequest)
+		if err != nil {
+			return false, err
+		}
+		return result.Total > 0, nil
+	}
+	if pending.fields == nil {
+		return false, nil
+	}
+	return s.pendingMatches(id, pending.fields, q)
+}
+
+// pendingMatches tells whether the fields of a write that has not been refreshed yet match q.
+func (s *Shard) pendingMatches(id string, fields map[string]interface{}, q query.Query) (bool, error) {
+	searchRequest := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(bleve.NewDocIDQuery([]string{id}), q), 1, 0, false)
+	s.engineMux.RLock()
+	indexMapping := s.engine.Mapping()
+	s.engineMux.RUnlock()
+	memory, err := bleve.NewMemOnly(indexMapping)
+	if err != nil {
+		return false, err
+	}
+	defer memory.Close()
+	if err := memory.Index(id, fields); err != nil {
+		return false, err
+	}
+	result, err := memory.Search(searchRequest)
+	if err != nil {
+		return false, err
+	}
+	return result.Total > 0, nil
+}
+
+// ScrollHit is a document matched by Scroll along with the version it had when it was read.
+type ScrollHit struct {
+	Id      string
+	Routing string
+	Version int64
+	SeqNo   int64
+	Source  map[string]interface{}
+}
+
+// Scroll returns up to size documents matching q in _id order, starting after the given id.
+// Documents rejected by accept are skipped. The last id read is returned so the caller can
+// continue the scroll even when every document of a page has been skipped. A document written
+// since the last refresh is returned as written, when it still matches q.
+func (s *Shard) Scroll(q query.Query, size int, after string, accept func(id string) bool) ([]ScrollHit, string, error) {
+	var hits []ScrollHit
+	for len(hits) < size {
+		searchRequest := bleve.NewSearchRequestOptions(q, size, 0, false)
+		searchRequest.SortBy([]string{"_id"})
+		if after != "" {
+			searchRequest.SetSearchAfter([]string{after})
+		}
+		result, err := s.Search(searchRequest)
+		if err != nil {
+			return nil, after, err
+		}
+		if len(result.Hits) == 0 {
+			break
+		}
+
+		for _, hit := range result.Hits {
+			after = hit.ID
+			if accept != nil && !accept(hit.ID) {
+				continue
+			}
+			scrollHit, ok, err := s.scrollHit(hit.ID, q)
+			if err != nil {
+				return nil, after, err
+			}
+			if !ok {
+				// deleted or no longer matching since the search was executed
+				continue
+			}
+			hits = append(hits, scrollHit)
+			if len(hits) == size {
+				break
+			}
+		}
+		if len(result.Hits) < size {
+			break
+		}
+	}
+	return hits, after, nil
+}
+
+// scrollHit reads the source, version, sequence number and routing of a document together, so that they all
+// belong to the same write.
+func (s *Shard) scrollHit(id string, q query.Query) (ScrollHit, bool, error) {
+	s.mux.Lock()
+	pending, isPending := s.pending[id]
+	if !isPending {
+		defer s.mux.Unlock()
+		doc, err := s.document(id)
+		if err != nil {
+			return ScrollHit{}, false, nil
+		}
+		version, seqNo := s.version(id)
+		return ScrollHit{Id: id, Routing: s.routing(id), Version: version, SeqNo: seqNo, Source: doc}, true, nil
+	}
+	s.mux.Unlock()
+
+	// a pending write is a snapshot of the document, it is matched outside the lock
+	if pending.fields == nil {
+		return ScrollHit{}, false, nil
+	}
+	matches, err := s.pendingMatches(id, pending.fields, q)
+	if err != nil || !matches {
+		return ScrollHit{}, false, err
+	}
+	doc, err := flat.Flatten(pending.fields, &flat.Options{Delimiter: ".", Safe: true})
+	if err != nil {
+		return ScrollHit{}, false, err
+	}
+	return ScrollHit{Id: id, Routing: pending.routing, Version: pending.version, SeqNo: pending.seqNo, Source: doc}, true, nil
+}
+
 func (s *Shard) Stats() ShardStats {
+	s.engineMux.RLock()
 	statsMap := s.engine.StatsMap()["index"].(map[string]interface{})
 	numDocs, err := s.engine.DocCount()
+	s.engineMux.RUnlock()
 	if err != nil {
 		logrus.Fatalln(err)
 	}
+	s.mux.Lock()
+	shardRouting := s.shardRouting
+	s.mux.Unlock()
 	return ShardStats{
 		UserData:     statsMap,
 		NumDocs:      numDocs,
-		ShardRouting: s.shardRouting,
+		ShardRouting: shardRouting,
+		Translog:     s.translog.Stats(),
 	}
 }
 
+// ShardRouting returns the routing of the shard in the latest cluster state.
+func (s *Shard) ShardRouting() state.ShardRouting {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.shardRouting
+}
+
+// UpdateShardRouting records the routing of the shard in the latest cluster state.
+func (s *Shard) UpdateShardRouting(shardRouting state.ShardRouting) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.shardRouting = shardRouting
+}
+
 type ShardStats struct {
 	UserData     map[string]interface{}
 	NumDocs      uint64
 	ShardRouting state.ShardRouting
+	Translog     TranslogStats
+}
+
+func (s *ShardStats) WriteTo(out *common.StreamOutput) {
+	out.WriteMap(s.UserData)
+	out.WriteVInt(s.NumDocs)
+	s.ShardRouting.WriteTo(out)
+	out.WriteInt(s.Translog.Operations)
+	out.WriteInt64(s.Translog.SizeInBytes)
+	out.WriteInt(s.Translog.UncommittedOperations)
+	out.WriteInt64(s.Translog.UncommittedSizeInBytes)
+}
+
+func ReadShardStats(in *common.StreamInput) ShardStats {
+	return ShardStats{
+		UserData:     in.ReadMap(),
+		NumDocs:      in.ReadVInt(),
+		ShardRouting: state.ReadShardRouting(in),
+		Translog: TranslogStats{
+			Operations:             in.ReadInt(),
+			SizeInBytes:            in.ReadInt64(),
+			UncommittedOperations:  in.ReadInt(),
+			UncommittedSizeInBytes: in.ReadInt64(),
+		},
+	}
 }
 
 type Stats struct {
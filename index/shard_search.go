@@ -1,12 +1,84 @@
 package index
 
 import (
+	"errors"
 	"fmt"
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/search/query"
 	"strings"
 )
 
+// NewQuery builds a bleve query from the "query" object of a search request body.
+// An empty query matches all documents.
+func NewQuery(qType map[string]interface{}) (query.Query, error) {
+	if len(qType) == 0 {
+		return bleve.NewMatchAllQuery(), nil
+	}
+
+	if k, found := qType["match"]; found {
+		return SearchTypeMatch(k), nil
+	} else if k, found := qType["match_phrase"]; found {
+		return SearchTypeMatchPhrase(k), nil
+	} else if _, found := qType["match_all"]; found {
+		return bleve.NewMatchAllQuery(), nil
+	} else if _, found := qType["match_none"]; found {
+		return bleve.NewMatchNoneQuery(), nil
+	} else if k, found := qType["prefix"]; found {
+		return SearchTypePrefix(k), nil
+	} else if k, found := qType["fuzzy"]; found {
+		return SearchTypeFuzzy(k), nil
+	} else if k, found := qType["bool"]; found {
+		return SearchTypeBool(k), nil
+	} else if k, found := qType["range"]; found {
+		return SearchTypeNumericRange(k), nil
+	}
+	return nil, errors.New("unsupported query")
+}
+
+// NewSort converts the "sort" of a search request body into bleve sort fields, e.g.
+// ["_id", {"age": "desc"}, {"name": {"order": "asc"}}] becomes ["_id", "-age", "name"].
+func NewSort(sort interface{}) ([]string, error) {
+	var sorts []interface{}
+	switch v := sort.(type) {
+	case nil:
+		return nil, nil
+	case string, map[string]interface{}:
+		sorts = []interface{}{v}
+	case []interface{}:
+		sorts = v
+	default:
+		return nil, errors.New("unsupported sort")
+	}
+
+	var fields []string
+	for _, s := range sorts {
+		switch v := s.(type) {
+		case string:
+			if v == "_score" {
+				v = "-_score"
+			}
+			fields = append(fields, v)
+		case map[string]interface{}:
+			for field, order := range v {
+				if o, ok := order.(map[string]interface{}); ok {
+					order = o["order"]
+				}
+				switch order {
+				case "desc":
+					fields = append(fields, "-"+field)
+				case "asc", nil:
+					fields = append(fields, field)
+				default:
+					return nil, fmt.Errorf("unsupported sort order [%v]", order)
+				}
+			}
+		default:
+			return nil, errors.New("unsupported sort")
+		}
+	}
+	return fields, nil
+}
+
 func SearchTypeMatch(searchType interface{}) *query.MatchQuery {
 	m := searchType.(map[string]interface{})
 	var field, message string
@@ -44,29 +116,42 @@ func SearchTypeMatchPhrase(searchType interface{}) *query.PhraseQuery {
 
 func SearchTypePrefix(searchType interface{}) *query.PrefixQuery {
 	m := searchType.(map[string]interface{})
-	var _, message string
+	var field, message string
 	for key, value := range m {
-		_ = key
+		field = key
 		switch v := value.(type) {
 		case string:
 			message = v
 		case map[string]interface{}:
-			message = v["query"].(string)
+			if value, ok := v["value"].(string); ok {
+				message = value
+			} else {
+				message = v["query"].(string)
+			}
 		}
 	}
 
-	return bleve.NewPrefixQuery(strings.ToLower(message))
+	q := bleve.NewPrefixQuery(strings.ToLower(message))
+	q.SetField(field)
+	return q
 }
 
 func SearchTypeFuzzy(searchType interface{}) *query.FuzzyQuery {
 	m := searchType.(map[string]interface{})
-	var _, message string
+	var field, message string
 	for key, value := range m {
-		_ = key
-		message = value.(string)
+		field = key
+		switch v := value.(type) {
+		case string:
+			message = v
+		case map[string]interface{}:
+			message = v["value"].(string)
+		}
 	}
 
-	return bleve.NewFuzzyQuery(strings.ToLower(message))
+	q := bleve.NewFuzzyQuery(strings.ToLower(message))
+	q.SetField(field)
+	return q
 }
 
 func SearchTypeNumericRange(searchType interface{}) *query.ConjunctionQuery {
@@ -166,6 +251,8 @@ func SearchTypeBool(searchType interface{}) *query.BooleanQuery {
 			searchQuery.AddMust(SearchTypeBool(value))
 		case "simple_query_string":
 			searchQuery.AddMust(SearchTypeSimpleQueryString(value))
+		case "match_none":
+			searchQuery.AddMust(bleve.NewMatchNoneQuery())
 		}
 	}
 	for key, value := range mustNotSearch {
@@ -184,6 +271,8 @@ func SearchTypeBool(searchType interface{}) *query.BooleanQuery {
 			searchQuery.AddMustNot(SearchTypeBool(value))
 		case "simple_query_string":
 			searchQuery.AddMustNot(SearchTypeSimpleQueryString(value))
+		case "match_none":
+			searchQuery.AddMustNot(bleve.NewMatchNoneQuery())
 		}
 	}
 	for key, value := range shouldSearch {
@@ -202,7 +291,69 @@ func SearchTypeBool(searchType interface{}) *query.BooleanQuery {
 			searchQuery.AddShould(SearchTypeBool(value))
 		case "simple_query_string":
 			searchQuery.AddShould(SearchTypeSimpleQueryString(value))
+		case "match_none":
+			searchQuery.AddShould(bleve.NewMatchNoneQuery())
 		}
 	}
 	return searchQuery
 }
+
+// fieldQueries are the queries on the single field they are keyed by, e.g. {"match": {"title": "goose"}}.
+var fieldQueries = map[string]bool{
+	"match":        true,
+	"term":         true,
+	"match_phrase": true,
+	"prefix":       true,
+	"fuzzy":        true,
+	"range":        true,
+}
+
+// allFieldsQueries are the queries reading every field.
+var allFieldsQueries = map[string]bool{
+	"simple_query_string": true,
+}
+
+// RestrictQueryFields rewrites the "query" object of a search request body so that it only reads the fields
+// allowed. A query on another field matches nothing, as does a query reading every field.
+func RestrictQueryFields(qType map[string]interface{}, allowed func(field string) bool) map[string]interface{} {
+	restricted := make(map[string]interface{}, len(qType))
+	for key, value := range qType {
+		switch {
+		case fieldQueries[key]:
+			m, _ := value.(map[string]interface{})
+			for field := range m {
+				if !allowed(field) {
+					return map[string]interface{}{"match_none": map[string]interface{}{}}
+				}
+			}
+			restricted[key] = value
+		case allFieldsQueries[key]:
+			return map[string]interface{}{"match_none": map[string]interface{}{}}
+		case key == "bool":
+			m, _ := value.(map[string]interface{})
+			clauses := make(map[string]interface{}, len(m))
+			for clause, queries := range m {
+				switch queries := queries.(type) {
+				case map[string]interface{}:
+					clauses[clause] = RestrictQueryFields(queries, allowed)
+				case []interface{}:
+					list := make([]interface{}, len(queries))
+					for i, q := range queries {
+						if q, ok := q.(map[string]interface{}); ok {
+							list[i] = RestrictQueryFields(q, allowed)
+						} else {
+							list[i] = q
+						}
+					}
+					clauses[clause] = list
+				default:
+					clauses[clause] = queries
+				}
+			}
+			restricted[key] = clauses
+		default:
+			restricted[key] = value
+		}
+	}
+	return restricted
+}
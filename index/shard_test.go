@@ -1,37 +1,487 @@
 package index
 
 import (
+	"github.com/actumn/searchgoose/errors"
+	"github.com/actumn/searchgoose/state"
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/index/scorch"
 	"github.com/blevesearch/bleve/mapping"
-	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 )
 
-func TestIndex_Get(t *testing.T) {
-	indexMapping := mapping.NewIndexMapping()
-	s := NewShard("/examples", indexMapping)
-	id := "test"
-	if doc, err := s.Get(id); err != nil {
-		logrus.Fatal(err)
-	} else {
-		logrus.Info(doc)
+func newTestShard(t *testing.T) (*Shard, string) {
+	path, err := ioutil.TempDir("", "shard")
+	if err != nil {
+		t.Fatal(err)
 	}
+	return NewShard(state.ShardRouting{Primary: true}, path, mapping.NewIndexMapping()), path
+}
+
+func TestIndex_Get(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("test", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+
+	// Action
+	doc, err := s.Get("test")
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "value", doc["field1"])
 }
 
 func TestIndex_Index(t *testing.T) {
-	indexMapping := mapping.NewIndexMapping()
-	s := NewShard("/examples", indexMapping)
-	id := "test"
-	doc := map[string]interface{}{}
-	if err := s.Index(id, doc); err != nil {
-		logrus.Fatal(err)
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	doc := map[string]interface{}{"field1": "value"}
+
+	// Action
+	created, err := s.Index("test", "", doc, VersionMatchAny)
+	updated, _ := s.Index("test", "", doc, VersionMatchAny)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "created", created.Result)
+	assert.Equal(t, int64(1), created.Version)
+	assert.Equal(t, "updated", updated.Result)
+	assert.Equal(t, int64(2), updated.Version)
+	assert.Equal(t, created.SeqNo+1, updated.SeqNo)
+}
+
+func TestIndex_IndexVersionConflict(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	doc := map[string]interface{}{"field1": "value"}
+	s.Index("test", "", doc, VersionMatchAny)
+
+	// Action
+	_, createErr := s.Index("test", "", doc, VersionNotFound)
+	_, staleErr := s.Index("test", "", doc, 2)
+	_, err := s.Index("test", "", doc, 1)
+
+	// Assert
+	assert.Equal(t, errors.ErrVersionConflict, createErr)
+	assert.Equal(t, errors.ErrVersionConflict, staleErr)
+	assert.Nil(t, err)
+}
+
+func TestIndex_TranslogFailure(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("test", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	s.translog.Close()
+
+	// Action
+	_, indexErr := s.Index("other", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	_, deleteErr := s.Delete("test", VersionMatchAny)
+
+	// Assert
+	assert.NotNil(t, indexErr)
+	assert.NotNil(t, deleteErr)
+	_, err := s.Get("other")
+	assert.Equal(t, errors.ErrNotFound, err)
+	doc, _ := s.Get("test")
+	assert.Equal(t, "value", doc["field1"])
+}
+
+func TestIndex_FailedApplyNotReplayed(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("1", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+
+	// Action
+	_, indexErr := s.Index("", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	result, _ := s.Index("2", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	operations, err := s.translog.OperationsSince(-1)
+	// crash before the writes are refreshed
+	s.translog.Close()
+	s.engine.Close()
+	recovered := NewShard(state.ShardRouting{Primary: true}, path, mapping.NewIndexMapping())
+	defer recovered.Close()
+
+	// Assert
+	assert.NotNil(t, indexErr)
+	assert.Equal(t, int64(2), result.SeqNo)
+	assert.Nil(t, err)
+	assert.Len(t, operations, 2)
+	for _, op := range operations {
+		assert.NotEqual(t, int64(1), op.SeqNo)
 	}
+	doc, err := recovered.Get("2")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", doc["field1"])
+	_, seqNo := recovered.Version("2")
+	assert.Equal(t, int64(2), seqNo)
 }
 
 func TestIndex_Delete(t *testing.T) {
-	indexMapping := mapping.NewIndexMapping()
-	s := NewShard("/examples", indexMapping)
-	id := "test"
-	if err := s.Delete(id); err != nil {
-		logrus.Fatal(err)
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("test", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+
+	// Action
+	deleted, err := s.Delete("test", VersionMatchAny)
+	notFound, _ := s.Delete("test", VersionMatchAny)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "deleted", deleted.Result)
+	assert.Equal(t, "not_found", notFound.Result)
+	_, err = s.Get("test")
+	assert.Equal(t, errors.ErrNotFound, err)
+}
+
+func TestIndex_Routing(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+
+	// Action
+	s.Index("test", "user1", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	routed := s.Routing("test")
+	s.Delete("test", VersionMatchAny)
+
+	// Assert
+	assert.Equal(t, "user1", routed)
+	assert.Equal(t, "", s.Routing("test"))
+}
+
+func TestIndex_Scroll(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		s.Index(id, "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	}
+	s.Refresh()
+
+	// Action
+	first, after, err := s.Scroll(bleve.NewMatchAllQuery(), 2, "", nil)
+	second, _, _ := s.Scroll(bleve.NewMatchAllQuery(), 10, after, func(id string) bool {
+		return id != "d"
+	})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(first))
+	assert.Equal(t, "a", first[0].Id)
+	assert.Equal(t, "b", after)
+	assert.Equal(t, 2, len(second))
+	assert.Equal(t, "c", second[0].Id)
+	assert.Equal(t, "e", second[1].Id)
+	assert.Equal(t, int64(1), second[1].Version)
+}
+
+func TestIndex_ScrollPendingWrites(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	for _, id := range []string{"a", "b", "c"} {
+		s.Index(id, "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	}
+	s.Refresh()
+	s.Delete("a", VersionMatchAny)
+	s.Index("b", "", map[string]interface{}{"field1": "changed"}, VersionMatchAny)
+	s.Index("c", "user1", map[string]interface{}{"field1": "value", "field2": "new"}, VersionMatchAny)
+	q := bleve.NewMatchQuery("value")
+	q.SetField("field1")
+
+	// Action
+	hits, _, err := s.Scroll(q, 10, "", nil)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(hits))
+	assert.Equal(t, "c", hits[0].Id)
+	assert.Equal(t, int64(2), hits[0].Version)
+	assert.Equal(t, "user1", hits[0].Routing)
+	assert.Equal(t, "new", hits[0].Source["field2"])
+}
+
+func TestNewSort(t *testing.T) {
+	fields, err := NewSort([]interface{}{"_id", map[string]interface{}{"age": "desc"}, map[string]interface{}{"name": map[string]interface{}{"order": "asc"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"_id", "-age", "name"}, fields)
+
+	_, err = NewSort([]interface{}{map[string]interface{}{"age": "sideways"}})
+	assert.NotNil(t, err)
+}
+
+func TestIndex_SearchPrefixAndFuzzy(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("goose", "", map[string]interface{}{"name": "goose", "note": "duck"}, VersionMatchAny)
+	s.Index("duck", "", map[string]interface{}{"name": "duck", "note": "goose"}, VersionMatchAny)
+	s.Refresh()
+	search := func(qType map[string]interface{}) []string {
+		q, err := NewQuery(qType)
+		assert.Nil(t, err)
+		result, err := s.Search(bleve.NewSearchRequest(q))
+		assert.Nil(t, err)
+		var ids []string
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.ID)
+		}
+		return ids
+	}
+
+	// Action
+	prefix := search(map[string]interface{}{"prefix": map[string]interface{}{"name": "goo"}})
+	prefixValue := search(map[string]interface{}{"prefix": map[string]interface{}{"name": map[string]interface{}{"value": "Goo"}}})
+	fuzzy := search(map[string]interface{}{"fuzzy": map[string]interface{}{"name": "goosr"}})
+	fuzzyValue := search(map[string]interface{}{"fuzzy": map[string]interface{}{"note": map[string]interface{}{"value": "goosr"}}})
+
+	// Assert
+	assert.Equal(t, []string{"goose"}, prefix)
+	assert.Equal(t, []string{"goose"}, prefixValue)
+	assert.Equal(t, []string{"goose"}, fuzzy)
+	assert.Equal(t, []string{"duck"}, fuzzyValue)
+}
+
+func TestIndex_Matches(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("refreshed", "", map[string]interface{}{"tenant": "acme"}, VersionMatchAny)
+	s.Refresh()
+	s.Index("pending", "", map[string]interface{}{"tenant": "acme"}, VersionMatchAny)
+	s.Index("other", "", map[string]interface{}{"tenant": "initech"}, VersionMatchAny)
+	acme, _ := NewQuery(map[string]interface{}{"match": map[string]interface{}{"tenant": "acme"}})
+
+	// Action
+	refreshed, err := s.Matches("refreshed", acme)
+	pending, _ := s.Matches("pending", acme)
+	other, _ := s.Matches("other", acme)
+	missing, _ := s.Matches("missing", acme)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.True(t, refreshed)
+	assert.True(t, pending)
+	assert.False(t, other)
+	assert.False(t, missing)
+}
+
+func TestRestrictQueryFields(t *testing.T) {
+	// Arrange
+	allowed := func(field string) bool {
+		return field != "ssn"
+	}
+	matchNone := map[string]interface{}{"match_none": map[string]interface{}{}}
+	match := func(field string) map[string]interface{} {
+		return map[string]interface{}{"match": map[string]interface{}{field: "x"}}
+	}
+
+	// Action
+	allowedQuery := RestrictQueryFields(match("name"), allowed)
+	deniedQuery := RestrictQueryFields(match("ssn"), allowed)
+	boolQuery := RestrictQueryFields(map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":     []interface{}{match("ssn")},
+			"must_not": match("name"),
+		},
+	}, allowed)
+	simpleQuery := RestrictQueryFields(map[string]interface{}{"simple_query_string": map[string]interface{}{"query": "x"}}, allowed)
+	prefixQuery := RestrictQueryFields(map[string]interface{}{"prefix": map[string]interface{}{"ssn": "x"}}, allowed)
+
+	// Assert
+	assert.Equal(t, match("name"), allowedQuery)
+	assert.Equal(t, matchNone, deniedQuery)
+	assert.Equal(t, map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must":     []interface{}{matchNone},
+			"must_not": match("name"),
+		},
+	}, boolQuery)
+	assert.Equal(t, matchNone, simpleQuery)
+	assert.Equal(t, matchNone, prefixQuery)
+}
+
+func TestIndex_Refresh(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("test", "", map[string]interface{}{"user": map[string]interface{}{"name": "kim"}}, VersionMatchAny)
+	search := func() uint64 {
+		result, _ := s.Search(bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+		return result.Total
+	}
+
+	// Action
+	before := search()
+	doc, err := s.Get("test")
+	refreshErr := s.Refresh()
+	after := search()
+	s.Delete("test", VersionMatchAny)
+	_, deletedErr := s.Get("test")
+
+	// Assert
+	assert.Equal(t, uint64(0), before)
+	assert.Nil(t, err)
+	assert.Equal(t, "kim", doc["user.name"])
+	assert.Nil(t, refreshErr)
+	assert.Equal(t, uint64(1), after)
+	assert.Equal(t, errors.ErrNotFound, deletedErr)
+	assert.Equal(t, uint64(1), search())
+}
+
+func TestIndex_WaitForRefresh(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.SetRefreshInterval(10 * time.Millisecond)
+	defer s.SetRefreshInterval(0)
+	result, _ := s.Index("test", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+
+	// Action
+	err := s.WaitForRefresh(result.SeqNo)
+	searchResult, _ := s.Search(bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), searchResult.Total)
+}
+
+func TestNewShard_RecoverFromTranslog(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("1", "user1", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	s.Index("2", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	s.Refresh()
+	s.Delete("2", VersionMatchAny)
+	s.Index("3", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	// crash before the last writes are refreshed
+	s.translog.Close()
+	s.engine.Close()
+
+	// Action
+	recovered := NewShard(state.ShardRouting{Primary: true}, path, mapping.NewIndexMapping())
+	defer recovered.Close()
+
+	// Assert
+	doc, err := recovered.Get("3")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", doc["field1"])
+	_, err = recovered.Get("2")
+	assert.Equal(t, errors.ErrNotFound, err)
+	assert.Equal(t, "user1", recovered.Routing("1"))
+	version, seqNo := recovered.Version("3")
+	assert.Equal(t, int64(1), version)
+	assert.Equal(t, int64(3), seqNo)
+	result, _ := recovered.Search(bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+	assert.Equal(t, uint64(2), result.Total)
+	assert.Equal(t, 0, recovered.Stats().Translog.Operations)
+}
+
+func TestIndex_FlushPersists(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	s.Index("1", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+
+	// Action
+	err := s.Flush()
+	engine, _, _ := s.engine.Advanced()
+	stats := engine.(*scorch.Scorch).StatsMap()
+	// crash right after the flush trimmed the translog
+	s.translog.Close()
+	s.engine.Close()
+	recovered := NewShard(state.ShardRouting{Primary: true}, path, mapping.NewIndexMapping())
+	defer recovered.Close()
+
+	// Assert
+	assert.Nil(t, err)
+	assert.True(t, stats["LastPersistedEpoch"].(uint64) >= stats["CurRootEpoch"].(uint64))
+	doc, err := recovered.Get("1")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", doc["field1"])
+}
+
+func TestIndex_ForceMerge(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.Index(id, "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+		s.Refresh()
 	}
+
+	// Action
+	err := s.ForceMerge(1, false)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), s.Segments())
+	result, _ := s.Search(bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+	assert.Equal(t, uint64(4), result.Total)
+}
+
+func TestIndex_ApplyOperations(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	ops := []Operation{
+		{OpType: "index", Id: "1", Version: 1, SeqNo: 0, Source: map[string]interface{}{"field1": "value"}},
+		{OpType: "delete", Id: "1", Version: 2, SeqNo: 2},
+		{OpType: "index", Id: "2", Version: 1, SeqNo: 1, Source: map[string]interface{}{"field1": "value"}},
+	}
+
+	// Action
+	err := s.ApplyOperations(ops)
+	s.Refresh()
+	// replayed twice and out of order
+	s.ApplyOperations([]Operation{ops[0], ops[2]})
+
+	// Assert
+	assert.Nil(t, err)
+	_, err = s.Get("1")
+	assert.Equal(t, errors.ErrNotFound, err)
+	doc, err := s.Get("2")
+	assert.Nil(t, err)
+	assert.Equal(t, "value", doc["field1"])
+	assert.Equal(t, 3, s.Stats().Translog.Operations)
+}
+
+func TestIndex_SnapshotForRecovery(t *testing.T) {
+	// Arrange
+	s, path := newTestShard(t)
+	defer os.RemoveAll(path)
+	defer s.Close()
+	s.Index("1", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	s.Index("2", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+
+	// Action
+	snapshot, err := s.SnapshotForRecovery("test")
+	s.Index("3", "", map[string]interface{}{"field1": "value"}, VersionMatchAny)
+	s.Flush()
+	ops, _ := s.OperationsSince(snapshot.SeqNo)
+	recovered := NewShard(state.ShardRouting{}, snapshot.Path, mapping.NewIndexMapping())
+	recovered.ApplyOperations(ops)
+	recovered.Refresh()
+	result, _ := recovered.Search(bleve.NewSearchRequest(bleve.NewMatchAllQuery()))
+	recovered.Close()
+	finalOps, _ := s.FinalizeRecovery("test", "node", snapshot.SeqNo)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), snapshot.SeqNo)
+	assert.NotEmpty(t, snapshot.Files)
+	assert.Len(t, ops, 1)
+	assert.Len(t, finalOps, 1)
+	assert.Equal(t, uint64(3), result.Total)
+	assert.Equal(t, []string{"node"}, s.replicationTargetIds())
+	_, err = os.Stat(snapshot.Path)
+	assert.True(t, os.IsNotExist(err))
 }
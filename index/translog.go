@@ -0,0 +1,350 @@
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// TranslogDurabilityRequest syncs the translog before a write is acknowledged.
+	TranslogDurabilityRequest = "request"
+	// TranslogDurabilityAsync syncs the translog in the background every sync interval.
+	TranslogDurabilityAsync = "async"
+
+	translogFilePrefix = "translog-"
+	translogFileSuffix = ".tlog"
+	// each record is written as the length and the crc32 of the payload followed by the payload
+	translogHeaderSize = 8
+
+	// NoopOpType marks the operation recorded before it with the same sequence number as failed, neither is
+	// replayed nor sent to a recovering copy.
+	NoopOpType = "noop"
+)
+
+// Operation is an index or delete operation recorded in the translog.
+type Operation struct {
+	OpType  string                 `json:"op"`
+	Id      string                 `json:"id"`
+	Routing string                 `json:"routing,omitempty"`
+	Version int64                  `json:"version"`
+	SeqNo   int64                  `json:"seq_no"`
+	Source  map[string]interface{} `json:"source,omitempty"`
+}
+
+// WriteTo writes an operation sent to a replica or a recovering copy.
+func (o *Operation) WriteTo(out *common.StreamOutput) {
+	out.WriteString(o.OpType)
+	out.WriteString(o.Id)
+	out.WriteString(o.Routing)
+	out.WriteInt64(o.Version)
+	out.WriteInt64(o.SeqNo)
+	out.WriteMap(o.Source)
+}
+
+func ReadOperation(in *common.StreamInput) Operation {
+	return Operation{
+		OpType:  in.ReadString(),
+		Id:      in.ReadString(),
+		Routing: in.ReadString(),
+		Version: in.ReadInt64(),
+		SeqNo:   in.ReadInt64(),
+		Source:  in.ReadMap(),
+	}
+}
+
+type translogGeneration struct {
+	generation  int64
+	maxSeqNo    int64
+	operations  int
+	sizeInBytes int64
+}
+
+// Translog is the write-ahead log of a shard. Operations are appended to the current generation file,
+// older generations are removed once every operation they hold has been committed to the engine.
+type Translog struct {
+	path        string
+	mux         sync.Mutex
+	file        *os.File
+	current     translogGeneration
+	generations []translogGeneration
+	dirty       bool
+}
+
+func translogFileName(generation int64) string {
+	return translogFilePrefix + strconv.FormatInt(generation, 10) + translogFileSuffix
+}
+
+// OpenTranslog opens the translog in the given directory and returns the operations of its existing
+// generations so they can be replayed. Writing continues in a new generation.
+func OpenTranslog(path string) (*Translog, []Operation, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, nil, err
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var generationNumbers []int64
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, translogFilePrefix) || !strings.HasSuffix(name, translogFileSuffix) {
+			continue
+		}
+		generation, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, translogFilePrefix), translogFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		generationNumbers = append(generationNumbers, generation)
+	}
+	sort.Slice(generationNumbers, func(i, j int) bool {
+		return generationNumbers[i] < generationNumbers[j]
+	})
+
+	t := &Translog{
+		path: path,
+	}
+	var operations []Operation
+	next := int64(1)
+	for _, generation := range generationNumbers {
+		ops, size, err := readTranslogFile(filepath.Join(path, translogFileName(generation)))
+		if err != nil {
+			return nil, nil, err
+		}
+		g := translogGeneration{
+			generation:  generation,
+			maxSeqNo:    -1,
+			operations:  len(ops),
+			sizeInBytes: size,
+		}
+		for _, op := range ops {
+			if op.SeqNo > g.maxSeqNo {
+				g.maxSeqNo = op.SeqNo
+			}
+		}
+		t.generations = append(t.generations, g)
+		operations = append(operations, ops...)
+		next = generation + 1
+	}
+
+	if err := t.openGeneration(next); err != nil {
+		return nil, nil, err
+	}
+	return t, withoutFailedOperations(operations), nil
+}
+
+// withoutFailedOperations drops the noops and the operations they mark as failed. A sequence number of a failed
+// operation may be given out again after a restart, an operation recorded after the noop is kept.
+func withoutFailedOperations(operations []Operation) []Operation {
+	failed := map[int64]bool{}
+	kept := make([]Operation, 0, len(operations))
+	for i := len(operations) - 1; i >= 0; i-- {
+		op := operations[i]
+		if op.OpType == NoopOpType {
+			failed[op.SeqNo] = true
+			continue
+		}
+		if failed[op.SeqNo] {
+			delete(failed, op.SeqNo)
+			continue
+		}
+		kept = append(kept, op)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return kept
+}
+
+// readTranslogFile reads the operations of a generation. A torn record at the end of the file,
+// left by a crash in the middle of a write, ends the generation.
+func readTranslogFile(path string) ([]Operation, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var operations []Operation
+	var size int64
+	reader := bufio.NewReader(f)
+	header := make([]byte, translogHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[:4]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		var op Operation
+		if err := json.Unmarshal(payload, &op); err != nil {
+			break
+		}
+		operations = append(operations, op)
+		size += int64(translogHeaderSize + len(payload))
+	}
+	return operations, size, nil
+}
+
+func (t *Translog) openGeneration(generation int64) error {
+	file, err := os.OpenFile(filepath.Join(t.path, translogFileName(generation)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	t.file = file
+	t.current = translogGeneration{
+		generation: generation,
+		maxSeqNo:   -1,
+	}
+	return nil
+}
+
+// Add appends an operation to the current generation. It is durable once Sync returns.
+func (t *Translog) Add(op Operation) error {
+	payload, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, translogHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[translogHeaderSize:], payload)
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if _, err := t.file.Write(record); err != nil {
+		return err
+	}
+	t.dirty = true
+	t.current.operations++
+	t.current.sizeInBytes += int64(len(record))
+	if op.SeqNo > t.current.maxSeqNo {
+		t.current.maxSeqNo = op.SeqNo
+	}
+	return nil
+}
+
+// Sync fsyncs the operations added since the last sync.
+func (t *Translog) Sync() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.sync()
+}
+
+func (t *Translog) sync() error {
+	if !t.dirty {
+		return nil
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	t.dirty = false
+	return nil
+}
+
+// RollGeneration syncs and closes the current generation and starts a new one.
+func (t *Translog) RollGeneration() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if err := t.sync(); err != nil {
+		return err
+	}
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+	t.generations = append(t.generations, t.current)
+	return t.openGeneration(t.current.generation + 1)
+}
+
+// TrimUpTo removes the older generations whose operations all have a sequence number up to seqNo.
+func (t *Translog) TrimUpTo(seqNo int64) error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	var kept []translogGeneration
+	for i, g := range t.generations {
+		if g.maxSeqNo > seqNo {
+			kept = append(kept, t.generations[i:]...)
+			break
+		}
+		if err := os.Remove(filepath.Join(t.path, translogFileName(g.generation))); err != nil && !os.IsNotExist(err) {
+			kept = append(kept, t.generations[i:]...)
+			t.generations = kept
+			return fmt.Errorf("failed to trim translog generation [%d]: %w", g.generation, err)
+		}
+	}
+	t.generations = kept
+	return nil
+}
+
+// OperationsSince reads back the operations with a sequence number above seqNo, in the order they were added.
+func (t *Translog) OperationsSince(seqNo int64) ([]Operation, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	generations := append(append([]translogGeneration{}, t.generations...), t.current)
+	var operations []Operation
+	for _, g := range generations {
+		if g.maxSeqNo <= seqNo {
+			continue
+		}
+		ops, _, err := readTranslogFile(filepath.Join(t.path, translogFileName(g.generation)))
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			if op.SeqNo > seqNo {
+				operations = append(operations, op)
+			}
+		}
+	}
+	return withoutFailedOperations(operations), nil
+}
+
+// TranslogStats describes the size of a translog. The uncommitted part is what has been written
+// since the last flush.
+type TranslogStats struct {
+	Operations             int
+	SizeInBytes            int64
+	UncommittedOperations  int
+	UncommittedSizeInBytes int64
+}
+
+func (t *Translog) Stats() TranslogStats {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	stats := TranslogStats{
+		Operations:             t.current.operations,
+		SizeInBytes:            t.current.sizeInBytes,
+		UncommittedOperations:  t.current.operations,
+		UncommittedSizeInBytes: t.current.sizeInBytes,
+	}
+	for _, g := range t.generations {
+		stats.Operations += g.operations
+		stats.SizeInBytes += g.sizeInBytes
+	}
+	return stats
+}
+
+func (t *Translog) Close() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if err := t.sync(); err != nil {
+		return err
+	}
+	return t.file.Close()
+}
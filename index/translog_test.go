@@ -0,0 +1,93 @@
+package index
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTranslog_Reopen(t *testing.T) {
+	// Arrange
+	path, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	translog, _, _ := OpenTranslog(path)
+	translog.Add(Operation{OpType: "index", Id: "1", Version: 1, SeqNo: 0, Source: map[string]interface{}{"field1": "value"}})
+	translog.Add(Operation{OpType: "delete", Id: "1", Version: 2, SeqNo: 1})
+	translog.Close()
+
+	// a crash in the middle of a write leaves a torn record
+	f, _ := os.OpenFile(filepath.Join(path, translogFileName(1)), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 1})
+	f.Close()
+
+	// Action
+	reopened, operations, err := OpenTranslog(path)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(operations))
+	assert.Equal(t, "value", operations[0].Source["field1"])
+	assert.Equal(t, "delete", operations[1].OpType)
+	assert.Equal(t, 2, reopened.Stats().Operations)
+	assert.Equal(t, 0, reopened.Stats().UncommittedOperations)
+	reopened.Close()
+}
+
+func TestTranslog_TrimUpTo(t *testing.T) {
+	// Arrange
+	path, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	translog, _, _ := OpenTranslog(path)
+	defer translog.Close()
+	translog.Add(Operation{OpType: "index", Id: "1", SeqNo: 0})
+	translog.RollGeneration()
+	translog.Add(Operation{OpType: "index", Id: "2", SeqNo: 1})
+	translog.RollGeneration()
+
+	// Action
+	err = translog.TrimUpTo(0)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 1, translog.Stats().Operations)
+	_, statErr := os.Stat(filepath.Join(path, translogFileName(1)))
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestTranslog_Noop(t *testing.T) {
+	// Arrange
+	path, err := ioutil.TempDir("", "translog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	translog, _, _ := OpenTranslog(path)
+	translog.Add(Operation{OpType: "index", Id: "1", SeqNo: 0})
+	translog.Add(Operation{OpType: "index", Id: "", SeqNo: 1})
+	translog.Add(Operation{OpType: NoopOpType, Id: "", SeqNo: 1})
+	// the sequence number of the failed operation is given out again after a restart
+	translog.Add(Operation{OpType: "index", Id: "2", SeqNo: 1})
+	translog.Close()
+
+	// Action
+	reopened, operations, err := OpenTranslog(path)
+	defer reopened.Close()
+	since, sinceErr := reopened.OperationsSince(0)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(operations))
+	assert.Equal(t, "1", operations[0].Id)
+	assert.Equal(t, "2", operations[1].Id)
+	assert.Nil(t, sinceErr)
+	assert.Equal(t, 1, len(since))
+	assert.Equal(t, "2", since[0].Id)
+}
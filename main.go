@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/http"
+	"github.com/actumn/searchgoose/security"
+	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/discovery"
 	"github.com/actumn/searchgoose/state/indices"
@@ -11,6 +15,7 @@ import (
 	"github.com/actumn/searchgoose/state/persist"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/actumn/searchgoose/state/transport/tcp"
+	"github.com/actumn/searchgoose/tasks"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"runtime"
@@ -43,11 +48,23 @@ func init() {
 		logrus.Warn("error finding config file: searchgoose", err)
 	}
 
+	// the node roles of the config file are the defaults of their flags
+	viper.SetDefault("node.master", true)
+	viper.SetDefault("node.data", true)
+	viper.SetDefault("node.ingest", true)
+	viper.SetDefault("transport.ssl.verification_mode", security.VerificationModeFull)
+	viper.SetDefault("http.ssl.client_authentication", security.ClientAuthenticationNone)
+
 	seedHosts := flag.String("seed_hosts", "", "연결할 노드들")
 	host := flag.String("host_address", "0.0.0.0", "호스트 주소")
 	tcpPort := flag.Int("transport.port", 8180, "Transport 연결 노드")
 	httpPort := flag.Int("http.port", 8080, "HTTP 연결 노드")
 	nodeName := flag.String("node.name", "", "노드 이름")
+	nodeAttributes := flag.String("node.attr", "", "노드 속성, 예: rack=r1,zone=z1")
+	nodeMaster := flag.Bool("node.master", viper.GetBool("node.master"), "마스터 노드 후보 여부")
+	nodeData := flag.Bool("node.data", viper.GetBool("node.data"), "데이터 노드 여부")
+	nodeIngest := flag.Bool("node.ingest", viper.GetBool("node.ingest"), "인제스트 노드 여부")
+	initialMasterNodes := flag.String("cluster.initial_master_nodes", strings.Join(viper.GetStringSlice("cluster.initial_master_nodes"), ","), "첫 선거의 마스터 후보 노드들, 예: node-1,node-2,node-3")
 
 	flag.Parse()
 
@@ -56,6 +73,21 @@ func init() {
 	viper.Set("transport.port", *tcpPort)
 	viper.Set("http.port", *httpPort)
 	viper.Set("node.name", *nodeName)
+	viper.Set("node.master", *nodeMaster)
+	viper.Set("node.data", *nodeData)
+	viper.Set("node.ingest", *nodeIngest)
+	if *initialMasterNodes != "" {
+		viper.Set("cluster.initial_master_nodes", strings.Split(*initialMasterNodes, ","))
+	}
+	if *nodeAttributes != "" {
+		attributes := map[string]string{}
+		for _, attribute := range strings.Split(*nodeAttributes, ",") {
+			if kv := strings.SplitN(attribute, "=", 2); len(kv) == 2 {
+				attributes[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+		viper.Set("node.attr", attributes)
+	}
 
 	nodeId := cluster.GenerateNodeId()
 	logrus.Info("[Node Id]: ", nodeId)
@@ -70,19 +102,27 @@ func start() {
 	var count, length int
 	outer = make(chan int, 1)
 	done := func() {
-		outer <- 1
+		// the states published before the server started do not wait for it
+		select {
+		case outer <- 1:
+		default:
+		}
 	}
 
-	var tcpTransport transport.Transport
-
 	tcpPort := viper.GetInt("transport.port")
 	seedHost := viper.GetString("discovery.seed_hosts")
 	id := viper.GetString("node.id")
 	name := viper.GetString("node.name")
 
-	tcpTransport = tcp.NewTransport(tcpPort, seedHost, id)
+	tcpTransport := tcp.NewTransport(tcpPort, seedHost, id)
+	if viper.GetBool("transport.ssl.enabled") {
+		// the nodes authenticate each other with their certificates
+		tcpTransport.TLS = newSSLService("transport.ssl", security.ClientAuthenticationRequired)
+	}
 	length = len(tcpTransport.GetSeedHosts())
 	transportService := transport.NewService(tcpTransport, name)
+	transportService.LocalNode.Attributes = viper.GetStringMapString("node.attr")
+	transportService.LocalNode.Roles = state.NodeRoles(viper.GetBool("node.master"), viper.GetBool("node.data"), viper.GetBool("node.ingest"))
 	transportService.Start(tcpPort)
 
 	clusterService := cluster.NewService()
@@ -93,39 +133,91 @@ func start() {
 
 	coordinator := discovery.NewCoordinator(transportService, clusterService.ApplierService, clusterService.MasterService, gateway.PersistedState)
 	coordinator.Done = done
+	coordinator.ClusterBootstrapService.InitialMasterNodes = viper.GetStringSlice("cluster.initial_master_nodes")
+
+	allocationService := cluster.NewAllocationService()
+	coordinator.AllocationService = allocationService
+	clusterInfoService := cluster.NewClusterInfoService(clusterService, transportService)
+	allocationService.ClusterInfoService = clusterInfoService
+	diskThresholdMonitor := cluster.NewDiskThresholdMonitor(clusterService, allocationService)
+	clusterInfoService.AddListener(diskThresholdMonitor.OnNewInfo)
+	shardStateAction := cluster.NewShardStateAction(clusterService, allocationService, transportService)
 
 	indicesService := indices.NewService()
-	indicesClusterStateService := indices.NewClusterStateService(indicesService)
+	recoveryService := indices.NewRecoveryService(indicesService, clusterService, transportService, shardStateAction)
+	indicesClusterStateService := indices.NewClusterStateService(indicesService, recoveryService, shardStateAction)
+	clusterService.ClusterSettings.AddSettingsUpdateConsumer(cluster.RecoveryMaxBytesPerSecSetting, func(value string) {
+		maxBytesPerSec, _ := common.ParseBytes(value)
+		recoveryService.SetMaxBytesPerSec(int64(maxBytesPerSec))
+	})
+	clusterService.ClusterSettings.AddSettingsUpdateConsumer(cluster.LoggerLevelSetting, func(value string) {
+		if level, err := logrus.ParseLevel(value); err == nil {
+			logrus.SetLevel(level)
+		}
+	})
 
 	clusterService.ApplierService.AddApplier(indicesClusterStateService.ApplyClusterState)
 	clusterService.MasterService.ClusterStatePublish = coordinator.Publish
 
-	allocationService := cluster.NewAllocationService()
-	clusterMetadataCreateIndexService := cluster.NewMetadataCreateIndexService(clusterService, allocationService)
-	clusterMetadataDeleteIndexService := cluster.NewMetadataDeleteIndexService(clusterService, allocationService)
-	clusterMetadataIndexAliasService := cluster.NewMetadataIndexAliasService(clusterService)
+	clusterMetadataCreateIndexService := cluster.NewMetadataCreateIndexService(clusterService, allocationService, transportService)
+	clusterMetadataDeleteIndexService := cluster.NewMetadataDeleteIndexService(clusterService, allocationService, transportService)
+	clusterMetadataIndexAliasService := cluster.NewMetadataIndexAliasService(clusterService, transportService)
+	clusterUpdateSettingsService := cluster.NewClusterUpdateSettingsService(clusterService, allocationService, transportService)
+	clusterMetadataSecurityService := cluster.NewMetadataSecurityService(clusterService, transportService)
 
 	gateway.Start(transportService, clusterService, persistClusterStateService)
 
 	coordinator.Start()
 	coordinator.StartInitialJoin()
+	clusterInfoService.Start()
 
-	for i := 0; i < length; i++ {
+	// a node with seed hosts serves once it joined a cluster
+	if length > 0 {
 		<-outer
-		count++
 	}
+	count = length
 
 	indexNameExpressionResolver := indices.NewNameExpressionResolver()
+	taskManager := tasks.NewManager(id)
+
+	var authenticator *security.Authenticator
+	if viper.GetBool("security.enabled") {
+		var err error
+		if authenticator, err = security.NewAuthenticator(viper.GetString("security.bootstrap.password")); err != nil {
+			logrus.Fatalf("Invalid [security] settings; err: %v", err)
+		}
+	}
 
-	b := http.New(clusterService, clusterMetadataCreateIndexService, clusterMetadataDeleteIndexService, clusterMetadataIndexAliasService, indicesService, transportService, indexNameExpressionResolver)
+	b := http.New(clusterService, clusterMetadataCreateIndexService, clusterMetadataDeleteIndexService, clusterMetadataIndexAliasService, clusterUpdateSettingsService, clusterMetadataSecurityService, allocationService, indicesService, transportService, indexNameExpressionResolver, taskManager, viper.GetStringSlice("reindex.remote.whitelist"), authenticator)
 	httpPort := ":" + viper.GetString("http.port")
+	var httpTLSConfig *tls.Config
+	if viper.GetBool("http.ssl.enabled") {
+		httpTLSConfig = newSSLService("http.ssl", viper.GetString("http.ssl.client_authentication")).ServerConfig()
+	}
 
 	if count == length {
 		logrus.Printf("124 leader=%v")
 		logrus.Info("start server...")
 		coordinator.Started = true
-		if err := b.Start(httpPort); err != nil {
+		if err := b.Start(httpPort, httpTLSConfig); err != nil {
 			panic(err)
 		}
 	}
 }
+
+// newSSLService loads the certificates of the ssl settings under prefix, e.g. transport.ssl, and reloads them once
+// they change.
+func newSSLService(prefix string, clientAuthentication string) *security.SSLService {
+	sslService, err := security.NewSSLService(security.SSLConfig{
+		Certificate:            viper.GetString(prefix + ".certificate"),
+		Key:                    viper.GetString(prefix + ".key"),
+		CertificateAuthorities: viper.GetStringSlice(prefix + ".certificate_authorities"),
+		VerificationMode:       viper.GetString(prefix + ".verification_mode"),
+		ClientAuthentication:   clientAuthentication,
+	})
+	if err != nil {
+		logrus.Fatalf("Invalid [%s] settings; err: %v", prefix, err)
+	}
+	sslService.Start(security.DefaultReloadInterval)
+	return sslService
+}
@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"github.com/actumn/searchgoose/common"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/host"
 	"os"
@@ -25,6 +26,32 @@ type OsInfo struct {
 	Processors int
 }
 
+func (i *Info) WriteTo(out *common.StreamOutput) {
+	out.WriteInt(i.Runtime.Pid)
+	out.WriteString(i.Runtime.Version)
+	out.WriteString(i.Os.Name)
+	out.WriteString(i.Os.Platform)
+	out.WriteString(i.Os.Arch)
+	out.WriteString(i.Os.Version)
+	out.WriteInt(i.Os.Processors)
+}
+
+func ReadInfo(in *common.StreamInput) Info {
+	return Info{
+		Runtime: RuntimeInfo{
+			Pid:     in.ReadInt(),
+			Version: in.ReadString(),
+		},
+		Os: OsInfo{
+			Name:       in.ReadString(),
+			Platform:   in.ReadString(),
+			Arch:       in.ReadString(),
+			Version:    in.ReadString(),
+			Processors: in.ReadInt(),
+		},
+	}
+}
+
 func (s *Service) Info() Info {
 	hostInfo, _ := host.Info()
 	processors, _ := cpu.Counts(true)
@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"github.com/actumn/searchgoose/common"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/load"
@@ -52,6 +53,56 @@ type ProcStats struct {
 	NumFDs          int32
 }
 
+func (s *Stats) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(s.Runtime.HeapAlloc)
+	out.WriteVInt(s.Runtime.HeapSys)
+	out.WriteFloat64(s.Os.Cpu.Percent)
+	out.WriteFloat64(s.Os.Cpu.LoadAverage.Load1)
+	out.WriteFloat64(s.Os.Cpu.LoadAverage.Load5)
+	out.WriteFloat64(s.Os.Cpu.LoadAverage.Load15)
+	out.WriteVInt(s.Os.Mem.Total)
+	out.WriteVInt(s.Os.Mem.Free)
+	out.WriteVInt(s.Fs.Total)
+	out.WriteVInt(s.Fs.Free)
+	out.WriteVInt(s.Fs.Available)
+	out.WriteFloat64(s.Proc.CpuPercent)
+	out.WriteVInt(s.Proc.MemTotalVirtual)
+	out.WriteInt32(s.Proc.NumFDs)
+}
+
+func ReadStats(in *common.StreamInput) Stats {
+	return Stats{
+		Runtime: RuntimeStats{
+			HeapAlloc: in.ReadVInt(),
+			HeapSys:   in.ReadVInt(),
+		},
+		Os: OsStats{
+			Cpu: OsCpuStats{
+				Percent: in.ReadFloat64(),
+				LoadAverage: OsCpuLoad{
+					Load1:  in.ReadFloat64(),
+					Load5:  in.ReadFloat64(),
+					Load15: in.ReadFloat64(),
+				},
+			},
+			Mem: OsMemStats{
+				Total: in.ReadVInt(),
+				Free:  in.ReadVInt(),
+			},
+		},
+		Fs: FsStats{
+			Total:     in.ReadVInt(),
+			Free:      in.ReadVInt(),
+			Available: in.ReadVInt(),
+		},
+		Proc: ProcStats{
+			CpuPercent:      in.ReadFloat64(),
+			MemTotalVirtual: in.ReadVInt(),
+			NumFDs:          in.ReadInt32(),
+		},
+	}
+}
+
 func (s *Service) Stats() Stats {
 	//cpuinfo, _ := cpu.Info()
 	//fmt.Println(cpuinfo)
@@ -70,9 +121,6 @@ func (s *Service) Stats() Stats {
 	memstats, _ := mem.VirtualMemory()
 	//fmt.Println(memstats)
 
-	diskStats, _ := disk.Usage("./data")
-	//fmt.Println(diskStats)
-
 	proc, _ := process.NewProcess(int32(os.Getpid()))
 	procFd, _ := proc.NumFDs()
 	procPercent, _ := proc.Percent(0)
@@ -96,11 +144,7 @@ func (s *Service) Stats() Stats {
 				Free:  memstats.Free,
 			},
 		},
-		Fs: FsStats{
-			Total:     diskStats.Total,
-			Free:      diskStats.Total - diskStats.Used,
-			Available: diskStats.Free,
-		},
+		Fs: s.FsStats(),
 		Proc: ProcStats{
 			NumFDs:          procFd,
 			CpuPercent:      procPercent,
@@ -108,3 +152,16 @@ func (s *Service) Stats() Stats {
 		},
 	}
 }
+
+// FsStats is the disk usage of the data path.
+func (s *Service) FsStats() FsStats {
+	diskStats, err := disk.Usage("./data")
+	if err != nil {
+		return FsStats{}
+	}
+	return FsStats{
+		Total:     diskStats.Total,
+		Free:      diskStats.Total - diskStats.Used,
+		Available: diskStats.Free,
+	}
+}
@@ -0,0 +1,276 @@
+package script
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokenIdent tokenType = iota
+	tokenNumber
+	tokenString
+	tokenOperator
+	tokenEOF
+)
+
+type token struct {
+	typ   tokenType
+	value string
+}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i])})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i])})
+		case c == '\'' || c == '"':
+			start := i + 1
+			i++
+			for i < len(runes) && runes[i] != c {
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidScript)
+			}
+			tokens = append(tokens, token{tokenString, string(runes[start:i])})
+			i++
+		case strings.ContainsRune("+-*/", c) && i+1 < len(runes) && runes[i+1] == '=':
+			tokens = append(tokens, token{tokenOperator, string(runes[i : i+2])})
+			i += 2
+		case strings.ContainsRune("+-*/=.;()[]", c):
+			tokens = append(tokens, token{tokenOperator, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("%w: unexpected character [%c]", ErrInvalidScript, c)
+		}
+	}
+	return append(tokens, token{typ: tokenEOF}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(value string) bool {
+	if t := p.peek(); t.typ == tokenOperator && t.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(value string) error {
+	if !p.accept(value) {
+		return fmt.Errorf("%w: expected [%s] but found [%s]", ErrInvalidScript, value, p.peek().value)
+	}
+	return nil
+}
+
+func (p *parser) parseStatements() ([]statement, error) {
+	var statements []statement
+	for p.peek().typ != tokenEOF {
+		if p.accept(";") {
+			continue
+		}
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, stmt)
+		if p.peek().typ != tokenEOF {
+			if err := p.expect(";"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return statements, nil
+}
+
+func (p *parser) parseStatement() (statement, error) {
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+
+	if path[len(path)-1] == "remove" && p.accept("(") {
+		field, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &removeStatement{target: path[:len(path)-1], field: field}, nil
+	}
+
+	t := p.next()
+	switch t.value {
+	case "=", "+=", "-=", "*=", "/=":
+		value, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return &assignStatement{target: path, operator: t.value, value: value}, nil
+	}
+	return nil, fmt.Errorf("%w: expected assignment but found [%s]", ErrInvalidScript, t.value)
+}
+
+func (p *parser) parsePath() ([]string, error) {
+	t := p.next()
+	if t.typ != tokenIdent {
+		return nil, fmt.Errorf("%w: expected identifier but found [%s]", ErrInvalidScript, t.value)
+	}
+	path := []string{t.value}
+	for {
+		if p.accept(".") {
+			t := p.next()
+			if t.typ != tokenIdent {
+				return nil, fmt.Errorf("%w: expected identifier but found [%s]", ErrInvalidScript, t.value)
+			}
+			path = append(path, t.value)
+		} else if p.accept("[") {
+			t := p.next()
+			if t.typ != tokenString {
+				return nil, fmt.Errorf("%w: expected field name but found [%s]", ErrInvalidScript, t.value)
+			}
+			path = append(path, t.value)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+		} else {
+			return path, nil
+		}
+	}
+}
+
+func (p *parser) parseExpression() (expression, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.accept("+") {
+			right, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			left = &binaryExpression{operator: "+", left: left, right: right}
+		} else if p.accept("-") {
+			right, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			left = &binaryExpression{operator: "-", left: left, right: right}
+		} else {
+			return left, nil
+		}
+	}
+}
+
+func (p *parser) parseTerm() (expression, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if p.accept("*") {
+			right, err := p.parseFactor()
+			if err != nil {
+				return nil, err
+			}
+			left = &binaryExpression{operator: "*", left: left, right: right}
+		} else if p.accept("/") {
+			right, err := p.parseFactor()
+			if err != nil {
+				return nil, err
+			}
+			left = &binaryExpression{operator: "/", left: left, right: right}
+		} else {
+			return left, nil
+		}
+	}
+}
+
+func (p *parser) parseFactor() (expression, error) {
+	if p.accept("(") {
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	}
+	if p.accept("-") {
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryExpression{operator: "-", left: &literal{0.0}, right: operand}, nil
+	}
+
+	t := p.peek()
+	switch t.typ {
+	case tokenNumber:
+		p.next()
+		n, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number [%s]", ErrInvalidScript, t.value)
+		}
+		return &literal{n}, nil
+	case tokenString:
+		p.next()
+		return &literal{t.value}, nil
+	case tokenIdent:
+		switch t.value {
+		case "true":
+			p.next()
+			return &literal{true}, nil
+		case "false":
+			p.next()
+			return &literal{false}, nil
+		case "null":
+			p.next()
+			return &literal{nil}, nil
+		}
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if path[0] != "ctx" && path[0] != "params" {
+			return nil, fmt.Errorf("%w: unknown variable [%s]", ErrInvalidScript, path[0])
+		}
+		return &pathExpression{path}, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected token [%s]", ErrInvalidScript, t.value)
+}
@@ -0,0 +1,273 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Script is a small painless-like script executed against a document context.
+// It supports a sequence of statements separated by ';':
+//
+//	ctx._source.counter += params.count
+//	ctx._source.tags = 'red'
+//	ctx._source.remove('obsolete')
+//	ctx.op = 'delete'
+//
+// Expressions are literals (numbers, quoted strings, true, false, null), paths
+// rooted at ctx or params, parentheses and the arithmetic operators + - * /.
+type Script struct {
+	Source     string
+	Params     map[string]interface{}
+	statements []statement
+}
+
+var (
+	ErrInvalidScript = errors.New("invalid script")
+)
+
+// New compiles the source of a script.
+func New(source string, params map[string]interface{}) (*Script, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	statements, err := p.parseStatements()
+	if err != nil {
+		return nil, err
+	}
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+	return &Script{
+		Source:     source,
+		Params:     params,
+		statements: statements,
+	}, nil
+}
+
+// FromBody compiles the "script" field of a request body, which is either the
+// script source or an object with "source" (or "inline") and "params".
+func FromBody(body interface{}) (*Script, error) {
+	switch v := body.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return New(v, nil)
+	case map[string]interface{}:
+		if lang, ok := v["lang"].(string); ok && lang != "painless" {
+			return nil, fmt.Errorf("%w: unsupported lang [%s]", ErrInvalidScript, lang)
+		}
+		source, ok := v["source"].(string)
+		if !ok {
+			source, ok = v["inline"].(string)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: must specify source", ErrInvalidScript)
+		}
+		params, _ := v["params"].(map[string]interface{})
+		return New(source, params)
+	}
+	return nil, fmt.Errorf("%w: unexpected script body", ErrInvalidScript)
+}
+
+// Execute runs the script against ctx, which typically holds _source, _id, _index and op.
+func (s *Script) Execute(ctx map[string]interface{}) error {
+	scope := map[string]interface{}{
+		"ctx":    ctx,
+		"params": s.Params,
+	}
+	for _, stmt := range s.statements {
+		if err := stmt.execute(scope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// statements
+
+type statement interface {
+	execute(scope map[string]interface{}) error
+}
+
+type assignStatement struct {
+	target   []string
+	operator string
+	value    expression
+}
+
+func (a *assignStatement) execute(scope map[string]interface{}) error {
+	if a.target[0] != "ctx" {
+		return fmt.Errorf("%w: cannot assign to [%s]", ErrInvalidScript, strings.Join(a.target, "."))
+	}
+	value, err := a.value.evaluate(scope)
+	if err != nil {
+		return err
+	}
+
+	parent, err := resolveParent(scope, a.target, true)
+	if err != nil {
+		return err
+	}
+	name := a.target[len(a.target)-1]
+	if a.operator != "=" {
+		value, err = arithmetic(a.operator[:1], parent[name], value)
+		if err != nil {
+			return err
+		}
+	}
+	parent[name] = value
+	return nil
+}
+
+type removeStatement struct {
+	target []string
+	field  expression
+}
+
+func (r *removeStatement) execute(scope map[string]interface{}) error {
+	field, err := r.field.evaluate(scope)
+	if err != nil {
+		return err
+	}
+	name, ok := field.(string)
+	if !ok {
+		return fmt.Errorf("%w: remove expects a field name", ErrInvalidScript)
+	}
+	target, err := resolve(scope, r.target)
+	if err != nil {
+		return err
+	}
+	if m, ok := target.(map[string]interface{}); ok {
+		delete(m, name)
+	}
+	return nil
+}
+
+// expressions
+
+type expression interface {
+	evaluate(scope map[string]interface{}) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l *literal) evaluate(scope map[string]interface{}) (interface{}, error) {
+	return l.value, nil
+}
+
+type pathExpression struct {
+	path []string
+}
+
+func (p *pathExpression) evaluate(scope map[string]interface{}) (interface{}, error) {
+	return resolve(scope, p.path)
+}
+
+type binaryExpression struct {
+	operator    string
+	left, right expression
+}
+
+func (b *binaryExpression) evaluate(scope map[string]interface{}) (interface{}, error) {
+	left, err := b.left.evaluate(scope)
+	if err != nil {
+		return nil, err
+	}
+	right, err := b.right.evaluate(scope)
+	if err != nil {
+		return nil, err
+	}
+	return arithmetic(b.operator, left, right)
+}
+
+func arithmetic(operator string, left interface{}, right interface{}) (interface{}, error) {
+	if operator == "+" {
+		if l, ok := left.(string); ok {
+			return l + toString(right), nil
+		}
+		if r, ok := right.(string); ok {
+			return toString(left) + r, nil
+		}
+	}
+	l, lok := toNumber(left)
+	r, rok := toNumber(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%w: cannot apply [%s] to [%v] and [%v]", ErrInvalidScript, operator, left, right)
+	}
+	switch operator {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("%w: division by zero", ErrInvalidScript)
+		}
+		return l / r, nil
+	}
+	return nil, fmt.Errorf("%w: unknown operator [%s]", ErrInvalidScript, operator)
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case nil:
+		return 0, true
+	}
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case float64:
+		return strconv.FormatFloat(s, 'f', -1, 64)
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func resolve(scope map[string]interface{}, path []string) (interface{}, error) {
+	var current interface{} = scope
+	for _, name := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: cannot access [%s] of [%s]", ErrInvalidScript, name, strings.Join(path, "."))
+		}
+		current = m[name]
+	}
+	return current, nil
+}
+
+func resolveParent(scope map[string]interface{}, path []string, create bool) (map[string]interface{}, error) {
+	current := scope
+	for _, name := range path[:len(path)-1] {
+		next, ok := current[name].(map[string]interface{})
+		if !ok {
+			if current[name] != nil || !create {
+				return nil, fmt.Errorf("%w: cannot access [%s] of [%s]", ErrInvalidScript, name, strings.Join(path, "."))
+			}
+			next = map[string]interface{}{}
+			current[name] = next
+		}
+		current = next
+	}
+	return current, nil
+}
@@ -0,0 +1,64 @@
+package script
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestScript_Execute(t *testing.T) {
+	// Arrange
+	s, err := New("ctx._source.likes += params.count; ctx._source.user.name = 'goose' + '!'; ctx._source.remove('tmp')", map[string]interface{}{
+		"count": 2.0,
+	})
+	ctx := map[string]interface{}{
+		"_source": map[string]interface{}{
+			"likes": 1.0,
+			"tmp":   "x",
+		},
+		"op": "index",
+	}
+
+	// Action
+	execErr := s.Execute(ctx)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Nil(t, execErr)
+	source := ctx["_source"].(map[string]interface{})
+	assert.Equal(t, 3.0, source["likes"])
+	assert.Equal(t, "goose!", source["user"].(map[string]interface{})["name"])
+	_, existing := source["tmp"]
+	assert.False(t, existing)
+}
+
+func TestScript_ExecuteOp(t *testing.T) {
+	// Arrange
+	s, _ := FromBody(map[string]interface{}{
+		"source": "ctx.op = 'delete'",
+		"lang":   "painless",
+	})
+	ctx := map[string]interface{}{
+		"_source": map[string]interface{}{},
+		"op":      "index",
+	}
+
+	// Action
+	err := s.Execute(ctx)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, "delete", ctx["op"])
+}
+
+func TestScript_Invalid(t *testing.T) {
+	_, err := New("ctx._source.a = ", nil)
+	assert.NotNil(t, err)
+
+	_, err = New("foo.bar = 1", nil)
+	assert.Nil(t, err)
+	s, _ := New("params.a = 1", nil)
+	assert.NotNil(t, s.Execute(map[string]interface{}{}))
+
+	_, err = FromBody(map[string]interface{}{"source": "ctx.op = 'noop'", "lang": "expression"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,187 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state"
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// matchNoneQuery is the role query of an index no role grants the action on.
+const matchNoneQuery = `{"match_none":{}}`
+
+// accessControlledActions read the documents of an index without document and field level security, they are
+// denied on the indices a user only reads part of, whatever privilege grants the action itself.
+var accessControlledActions = map[string]bool{
+	"indices:data/write/update":         true,
+	"indices:data/write/update/byquery": true,
+	"indices:data/write/delete/byquery": true,
+	"indices:data/read/scroll[s]":       true,
+}
+
+// readAction is the read whose document and field level security tells what part of an index a user reads.
+const readAction = "indices:data/read/search"
+
+// IndexAccessControl is what document and field level security let a user read of an index. A permission limited
+// by another, e.g. an API key by its owner, adds its own restrictions.
+type IndexAccessControl struct {
+	// queries are the role queries of every permission, a document is read when it matches one of each
+	queries [][]string
+	// fields are the field grants of every permission, a field is read when one grant of each allows it
+	fields [][]state.FieldSecurity
+}
+
+// AccessControl returns the restrictions the roles granting an action on an index put on what a user reads of
+// it. A role granting the action without a query or without field security lifts that restriction, nothing is
+// restricted when security is disabled.
+func AccessControl(authentication *Authentication, action string, index string, metadata state.SecurityMetadata) IndexAccessControl {
+	if authentication == nil {
+		return IndexAccessControl{}
+	}
+	return permissionsOf(authentication, metadata).accessControl(action, index)
+}
+
+func (p permission) accessControl(action string, index string) IndexAccessControl {
+	var queries []string
+	var fields []state.FieldSecurity
+	granted, allDocuments, allFields := false, false, false
+	for _, ip := range p.indices {
+		if !ip.matches(index) || !ip.grants(action) {
+			continue
+		}
+		granted = true
+		if ip.query == "" {
+			allDocuments = true
+		} else {
+			queries = append(queries, ip.query)
+		}
+		if ip.fieldSecurity == nil {
+			allFields = true
+		} else {
+			fields = append(fields, *ip.fieldSecurity)
+		}
+	}
+
+	if !granted {
+		return IndexAccessControl{
+			queries: [][]string{{matchNoneQuery}},
+			fields:  [][]state.FieldSecurity{{}},
+		}
+	}
+	var a IndexAccessControl
+	if !allDocuments {
+		a.queries = append(a.queries, queries)
+	}
+	if !allFields {
+		a.fields = append(a.fields, fields)
+	}
+	return a
+}
+
+func (l limitedPermission) accessControl(action string, index string) IndexAccessControl {
+	var a IndexAccessControl
+	for _, p := range l {
+		limit := p.accessControl(action, index)
+		a.queries = append(a.queries, limit.queries...)
+		a.fields = append(a.fields, limit.fields...)
+	}
+	return a
+}
+
+// Restricted tells whether the user reads part of the index only.
+func (a IndexAccessControl) Restricted() bool {
+	return a.RestrictsDocuments() || a.RestrictsFields()
+}
+
+func (a IndexAccessControl) RestrictsDocuments() bool {
+	return len(a.queries) > 0
+}
+
+func (a IndexAccessControl) RestrictsFields() bool {
+	return len(a.fields) > 0
+}
+
+// Query returns the query the documents read have to match, nil when every document is read.
+func (a IndexAccessControl) Query() (query.Query, error) {
+	if !a.RestrictsDocuments() {
+		return nil, nil
+	}
+	conjuncts := make([]query.Query, 0, len(a.queries))
+	for _, queries := range a.queries {
+		disjuncts := make([]query.Query, 0, len(queries))
+		for _, q := range queries {
+			parsed, err := parseRoleQuery(q)
+			if err != nil {
+				return nil, err
+			}
+			disjuncts = append(disjuncts, parsed)
+		}
+		conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(disjuncts...))
+	}
+	return bleve.NewConjunctionQuery(conjuncts...), nil
+}
+
+// FieldAllowed tells whether the user reads a field, a flattened name, e.g. "user.name".
+func (a IndexAccessControl) FieldAllowed(field string) bool {
+	for _, grants := range a.fields {
+		allowed := false
+		for _, grant := range grants {
+			if fieldGranted(grant, field) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterFields returns the fields of a flattened document the user reads.
+func (a IndexAccessControl) FilterFields(fields map[string]interface{}) map[string]interface{} {
+	if !a.RestrictsFields() {
+		return fields
+	}
+	filtered := make(map[string]interface{}, len(fields))
+	for field, value := range fields {
+		if a.FieldAllowed(field) {
+			filtered[field] = value
+		}
+	}
+	return filtered
+}
+
+func fieldGranted(grant state.FieldSecurity, field string) bool {
+	for _, pattern := range grant.Except {
+		if simpleMatch(pattern, field) {
+			return false
+		}
+	}
+	for _, pattern := range grant.Grant {
+		if simpleMatch(pattern, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRoleQuery builds the query of a role, failing on a query the search API does not support rather than
+// panicking on a malformed one.
+func parseRoleQuery(source string) (q query.Query, err error) {
+	var qType map[string]interface{}
+	if err := json.Unmarshal([]byte(source), &qType); err != nil {
+		return nil, fmt.Errorf("failed to parse role query [%s]: %v", source, err)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			q, err = nil, fmt.Errorf("failed to parse role query [%s]: %v", source, r)
+		}
+	}()
+	if q, err = index.NewQuery(qType); err != nil {
+		return nil, fmt.Errorf("failed to parse role query [%s]: %v", source, err)
+	}
+	return q, nil
+}
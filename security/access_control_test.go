@@ -0,0 +1,143 @@
+package security
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAccessControl(t *testing.T) {
+	// Arrange
+	metadata := state.SecurityMetadata{
+		Roles: map[string]state.Role{
+			"acme_reader": {
+				Name: "acme_reader",
+				Indices: []state.IndicesPrivileges{{
+					Names:         []string{"customers"},
+					Privileges:    []string{"read"},
+					Query:         `{"match":{"tenant":"acme"}}`,
+					FieldSecurity: &state.FieldSecurity{Grant: []string{"*"}, Except: []string{"ssn", "card.*"}},
+				}},
+			},
+			"initech_reader": {
+				Name: "initech_reader",
+				Indices: []state.IndicesPrivileges{{
+					Names:         []string{"customers"},
+					Privileges:    []string{"read"},
+					Query:         `{"match":{"tenant":"initech"}}`,
+					FieldSecurity: &state.FieldSecurity{Grant: []string{"name", "tenant"}},
+				}},
+			},
+			"customers_admin": {
+				Name:    "customers_admin",
+				Indices: []state.IndicesPrivileges{{Names: []string{"customers"}, Privileges: []string{"all"}}},
+			},
+			"customers_writer": {
+				Name:    "customers_writer",
+				Indices: []state.IndicesPrivileges{{Names: []string{"customers"}, Privileges: []string{"write"}}},
+			},
+		},
+	}
+	authentication := func(roles ...string) *Authentication {
+		return &Authentication{User: state.User{Username: "alice", Roles: roles}, Realm: NativeRealm}
+	}
+	accessControl := func(authentication *Authentication) IndexAccessControl {
+		return AccessControl(authentication, "indices:data/read/search", "customers", metadata)
+	}
+	// the key of an admin limited to a tenant
+	tenantKey := authentication("customers_admin")
+	tenantKey.ApiKey = &state.ApiKey{
+		Id: "key-1",
+		RoleDescriptors: []state.Role{{
+			Indices: []state.IndicesPrivileges{{
+				Names:         []string{"*"},
+				Privileges:    []string{"read"},
+				Query:         `{"match":{"tenant":"acme"}}`,
+				FieldSecurity: &state.FieldSecurity{Grant: []string{"name"}},
+			}},
+		}},
+	}
+
+	// Action
+	disabled := AccessControl(nil, "indices:data/read/search", "customers", metadata)
+	acme := accessControl(authentication("acme_reader"))
+	acmeQuery, acmeQueryErr := acme.Query()
+	both := accessControl(authentication("acme_reader", "initech_reader"))
+	admin := accessControl(authentication("acme_reader", "customers_admin"))
+	// the writer role does not grant the search, it lifts no restriction
+	writer := accessControl(authentication("acme_reader", "customers_writer"))
+	none := accessControl(authentication("customers_writer"))
+	key := accessControl(tenantKey)
+	superuser := accessControl(authentication(SuperuserRole))
+
+	// Assert
+	assert.False(t, disabled.Restricted())
+	assert.True(t, acme.RestrictsDocuments())
+	assert.NoError(t, acmeQueryErr)
+	assert.NotNil(t, acmeQuery)
+	assert.True(t, acme.FieldAllowed("name"))
+	assert.False(t, acme.FieldAllowed("ssn"))
+	assert.False(t, acme.FieldAllowed("card.number"))
+	assert.Equal(t, map[string]interface{}{"name": "kim"}, acme.FilterFields(map[string]interface{}{"name": "kim", "ssn": "123", "card.number": "4111"}))
+	// the roles grant the union of their documents and fields
+	assert.Equal(t, [][]string{{`{"match":{"tenant":"acme"}}`, `{"match":{"tenant":"initech"}}`}}, both.queries)
+	assert.True(t, both.FieldAllowed("email"))
+	assert.False(t, both.FieldAllowed("ssn"))
+	assert.False(t, admin.Restricted())
+	assert.True(t, writer.RestrictsDocuments())
+	assert.True(t, none.RestrictsDocuments())
+	assert.False(t, none.FieldAllowed("name"))
+	// the key is limited by its descriptors only, its owner reads everything
+	assert.Equal(t, [][]string{{`{"match":{"tenant":"acme"}}`}}, key.queries)
+	assert.True(t, key.FieldAllowed("name"))
+	assert.False(t, key.FieldAllowed("tenant"))
+	assert.False(t, superuser.Restricted())
+}
+
+func TestAuthorize_accessControlledActions(t *testing.T) {
+	// Arrange
+	metadata := state.Metadata{
+		Indices: map[string]state.IndexMetadata{
+			"customers": {},
+			"logs":      {},
+		},
+		Security: state.SecurityMetadata{
+			Roles: map[string]state.Role{
+				"acme": {
+					Name: "acme",
+					Indices: []state.IndicesPrivileges{
+						{Names: []string{"customers"}, Privileges: []string{"all"}, Query: `{"match":{"tenant":"acme"}}`},
+						{Names: []string{"logs"}, Privileges: []string{"all"}},
+					},
+				},
+				"acme_reader": {
+					Name:    "acme_reader",
+					Indices: []state.IndicesPrivileges{{Names: []string{"customers"}, Privileges: []string{"read"}, Query: `{"match":{"tenant":"acme"}}`}},
+				},
+				"customers_writer": {
+					Name:    "customers_writer",
+					Indices: []state.IndicesPrivileges{{Names: []string{"customers"}, Privileges: []string{"write"}}},
+				},
+			},
+		},
+	}
+	authentication := &Authentication{User: state.User{Username: "alice", Roles: []string{"acme"}}, Realm: NativeRealm}
+	// the writer role grants the delete without restriction, the reader role restricts what is read
+	mixed := &Authentication{User: state.User{Username: "bob", Roles: []string{"acme_reader", "customers_writer"}}, Realm: NativeRealm}
+
+	// Action
+	searchErr := Authorize(authentication, []ActionRequest{IndexAction("indices:data/read/search", "customers")}, metadata)
+	updateErr := Authorize(authentication, []ActionRequest{IndexAction("indices:data/write/update", "customers")}, metadata)
+	scrollErr := Authorize(authentication, []ActionRequest{IndexAction("indices:data/read/scroll[s]", "*")}, metadata)
+	unrestrictedErr := Authorize(authentication, []ActionRequest{IndexAction("indices:data/write/delete/byquery", "logs")}, metadata)
+	mixedErr := Authorize(mixed, []ActionRequest{IndexAction("indices:data/write/delete/byquery", "customers")}, metadata)
+	mixedWriteErr := Authorize(mixed, []ActionRequest{IndexAction("indices:data/write/index", "customers")}, metadata)
+
+	// Assert
+	assert.NoError(t, searchErr)
+	assert.EqualError(t, updateErr, "action [indices:data/write/update] is not supported on index [customers] when field or document level security is enabled")
+	assert.Error(t, scrollErr)
+	assert.NoError(t, unrestrictedErr)
+	assert.EqualError(t, mixedErr, "action [indices:data/write/delete/byquery] is not supported on index [customers] when field or document level security is enabled")
+	assert.NoError(t, mixedWriteErr)
+}
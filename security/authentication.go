@@ -0,0 +1,209 @@
+package security
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"strings"
+	"time"
+)
+
+const (
+	// ReservedUsername is the superuser whose password is the bootstrap password of the configuration, it cannot
+	// be changed through the API
+	ReservedUsername = "elastic"
+	// SuperuserRole grants every privilege
+	SuperuserRole = "superuser"
+
+	ReservedRealm = "reserved"
+	NativeRealm   = "native"
+	ApiKeyRealm   = "_es_api_key"
+)
+
+// reservedRoles are the built-in roles, they cannot be changed through the API.
+var reservedRoles = map[string]state.Role{
+	SuperuserRole: {
+		Name:    SuperuserRole,
+		Cluster: []string{"all"},
+		Indices: []state.IndicesPrivileges{
+			{Names: []string{"*"}, Privileges: []string{"all"}},
+		},
+	},
+}
+
+// IsReservedUser tells whether a username is reserved.
+func IsReservedUser(username string) bool {
+	return username == ReservedUsername
+}
+
+// IsReservedRole tells whether a role name is reserved.
+func IsReservedRole(name string) bool {
+	_, reserved := reservedRoles[name]
+	return reserved
+}
+
+// Authentication is who a request authenticated as.
+type Authentication struct {
+	User state.User
+	// ApiKey is the key the request authenticated with, nil for a user authenticated with a password
+	ApiKey *state.ApiKey
+	Realm  string
+}
+
+// WriteTo writes the authentication a shard request carries, the shard applies the roles of its user.
+func (a *Authentication) WriteTo(out *common.StreamOutput) {
+	a.User.WriteTo(out)
+	out.WriteBool(a.ApiKey != nil)
+	if a.ApiKey != nil {
+		a.ApiKey.WriteTo(out)
+	}
+	out.WriteString(a.Realm)
+}
+
+func ReadAuthentication(in *common.StreamInput) *Authentication {
+	authentication := Authentication{User: state.ReadUser(in)}
+	if in.ReadBool() {
+		apiKey := state.ReadApiKey(in)
+		authentication.ApiKey = &apiKey
+	}
+	authentication.Realm = in.ReadString()
+	return &authentication
+}
+
+// WriteOptionalAuthentication writes the authentication of a request, nil when security is disabled.
+func WriteOptionalAuthentication(out *common.StreamOutput, authentication *Authentication) {
+	out.WriteBool(authentication != nil)
+	if authentication != nil {
+		authentication.WriteTo(out)
+	}
+}
+
+func ReadOptionalAuthentication(in *common.StreamInput) *Authentication {
+	if !in.ReadBool() {
+		return nil
+	}
+	return ReadAuthentication(in)
+}
+
+// Type returns how the request authenticated, "realm" with a password or "api_key".
+func (a *Authentication) Type() string {
+	if a.ApiKey != nil {
+		return "api_key"
+	}
+	return "realm"
+}
+
+// AuthenticationError fails a request without credentials or with invalid ones.
+type AuthenticationError struct {
+	Reason string
+}
+
+func (e *AuthenticationError) Error() string {
+	return e.Reason
+}
+
+func (e *AuthenticationError) ErrorType() string {
+	return "security_exception"
+}
+
+// Authenticator authenticates the requests against the users and the API keys of the security metadata.
+type Authenticator struct {
+	bootstrapPasswordHash string
+	hashes                *hashCache
+}
+
+// NewAuthenticator returns an authenticator, the reserved user authenticates with bootstrapPassword, it cannot
+// authenticate when bootstrapPassword is empty.
+func NewAuthenticator(bootstrapPassword string) (*Authenticator, error) {
+	a := &Authenticator{
+		hashes: newHashCache(),
+	}
+	if bootstrapPassword != "" {
+		hash, err := HashPassword(bootstrapPassword)
+		if err != nil {
+			return nil, err
+		}
+		a.bootstrapPasswordHash = hash
+	}
+	return a, nil
+}
+
+// Authenticate authenticates the Authorization header of a request to path, "Basic base64(username:password)"
+// or "ApiKey base64(id:key)".
+func (a *Authenticator) Authenticate(authorization string, path string, metadata state.SecurityMetadata, now time.Time) (*Authentication, error) {
+	scheme, credentials := authorization, ""
+	if i := strings.IndexByte(authorization, ' '); i >= 0 {
+		scheme, credentials = authorization[:i], strings.TrimSpace(authorization[i+1:])
+	}
+	if authorization == "" || credentials == "" {
+		return nil, &AuthenticationError{Reason: fmt.Sprintf("missing authentication credentials for REST request [%s]", path)}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	colon := strings.IndexByte(string(decoded), ':')
+	if err != nil || colon < 0 {
+		return nil, &AuthenticationError{Reason: fmt.Sprintf("invalid %s authentication header value for REST request [%s]", scheme, path)}
+	}
+	principal, secret := string(decoded[:colon]), string(decoded[colon+1:])
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if authentication := a.authenticateUser(principal, secret, metadata); authentication != nil {
+			return authentication, nil
+		}
+		return nil, &AuthenticationError{Reason: fmt.Sprintf("unable to authenticate user [%s] for REST request [%s]", principal, path)}
+	case "apikey":
+		if authentication := a.authenticateApiKey(principal, secret, metadata, now); authentication != nil {
+			return authentication, nil
+		}
+		return nil, &AuthenticationError{Reason: fmt.Sprintf("unable to authenticate with provided credentials for REST request [%s]", path)}
+	}
+	return nil, &AuthenticationError{Reason: fmt.Sprintf("unsupported authentication scheme [%s] for REST request [%s]", scheme, path)}
+}
+
+func (a *Authenticator) authenticateUser(username string, password string, metadata state.SecurityMetadata) *Authentication {
+	if IsReservedUser(username) {
+		if a.bootstrapPasswordHash == "" || !a.hashes.verify(a.bootstrapPasswordHash, password) {
+			return nil
+		}
+		return &Authentication{User: reservedUser(), Realm: ReservedRealm}
+	}
+	user, existing := metadata.Users[username]
+	if !existing || !user.Enabled || !a.hashes.verify(user.PasswordHash, password) {
+		return nil
+	}
+	user.PasswordHash = ""
+	return &Authentication{User: user, Realm: NativeRealm}
+}
+
+func (a *Authenticator) authenticateApiKey(id string, key string, metadata state.SecurityMetadata, now time.Time) *Authentication {
+	apiKey, existing := metadata.ApiKeys[id]
+	if !existing || apiKey.Invalidated || (apiKey.Expiration > 0 && apiKey.Expiration <= now.UnixNano()/int64(time.Millisecond)) {
+		return nil
+	}
+	if !a.hashes.verify(apiKey.KeyHash, key) {
+		return nil
+	}
+	// the key acts as its owner, who has to be still enabled
+	var owner state.User
+	if IsReservedUser(apiKey.Username) {
+		owner = reservedUser()
+	} else {
+		user, existing := metadata.Users[apiKey.Username]
+		if !existing || !user.Enabled {
+			return nil
+		}
+		owner = user
+		owner.PasswordHash = ""
+	}
+	apiKey.KeyHash = ""
+	return &Authentication{User: owner, ApiKey: &apiKey, Realm: ApiKeyRealm}
+}
+
+func reservedUser() state.User {
+	return state.User{
+		Username: ReservedUsername,
+		Roles:    []string{SuperuserRole},
+		Enabled:  true,
+	}
+}
@@ -0,0 +1,126 @@
+package security
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	// Arrange
+	salt := base64.StdEncoding.EncodeToString([]byte("salt"))
+	key, _ := hex.DecodeString("e1d9c16aa681708a45f5c7c4e215ceb66e011a2e9f0040713f18aefdb866d53c")
+	// the PBKDF2-HMAC-SHA512 of "password" and "salt" in two iterations
+	hash := hashPrefix + "2$" + salt + "$" + base64.StdEncoding.EncodeToString(key)
+
+	// Action
+	verified := verifyPassword(hash, "password")
+	wrong := verifyPassword(hash, "wrong-password")
+
+	// Assert
+	assert.True(t, verified)
+	assert.False(t, wrong)
+}
+
+func TestHashPassword(t *testing.T) {
+	// Arrange
+	cache := newHashCache()
+
+	// Action
+	hash, err := HashPassword("s3cr3t-password")
+	other, _ := HashPassword("s3cr3t-password")
+
+	// Assert
+	assert.NoError(t, err)
+	assert.Contains(t, hash, "{PBKDF2}10000$")
+	// salted, the same password hashes differently
+	assert.NotEqual(t, hash, other)
+	assert.True(t, verifyPassword(hash, "s3cr3t-password"))
+	assert.False(t, verifyPassword(hash, "wrong-password"))
+	assert.False(t, verifyPassword("s3cr3t-password", "s3cr3t-password"))
+	assert.True(t, cache.verify(hash, "s3cr3t-password"))
+	assert.True(t, cache.verify(hash, "s3cr3t-password"))
+	assert.False(t, cache.verify(hash, "wrong-password"))
+}
+
+func basic(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	// Arrange
+	authenticator, _ := NewAuthenticator("bootstrap-password")
+	now := time.Now()
+	passwordHash, _ := HashPassword("alice-password")
+	keyHash, _ := HashPassword("key")
+	metadata := state.SecurityMetadata{
+		Users: map[string]state.User{
+			"alice": {Username: "alice", PasswordHash: passwordHash, Roles: []string{"reader"}, Enabled: true},
+			"bob":   {Username: "bob", PasswordHash: passwordHash, Enabled: false},
+		},
+		ApiKeys: map[string]state.ApiKey{
+			"valid":       {Id: "valid", Name: "ci", KeyHash: keyHash, Username: "alice"},
+			"expired":     {Id: "expired", KeyHash: keyHash, Username: "alice", Expiration: now.Add(-time.Minute).UnixNano() / int64(time.Millisecond)},
+			"invalidated": {Id: "invalidated", KeyHash: keyHash, Username: "alice", Invalidated: true},
+			"orphan":      {Id: "orphan", KeyHash: keyHash, Username: "carol"},
+		},
+	}
+	authenticate := func(authorization string) (*Authentication, error) {
+		return authenticator.Authenticate(authorization, "/_search", metadata, now)
+	}
+	apiKey := func(id string, key string) string {
+		return "ApiKey " + base64.StdEncoding.EncodeToString([]byte(id+":"+key))
+	}
+
+	// Action
+	user, userErr := authenticate(basic("alice", "alice-password"))
+	_, wrongPasswordErr := authenticate(basic("alice", "wrong-password"))
+	_, disabledErr := authenticate(basic("bob", "alice-password"))
+	reserved, reservedErr := authenticate(basic(ReservedUsername, "bootstrap-password"))
+	_, missingErr := authenticate("")
+	key, keyErr := authenticate(apiKey("valid", "key"))
+	_, wrongKeyErr := authenticate(apiKey("valid", "wrong"))
+	_, expiredErr := authenticate(apiKey("expired", "key"))
+	_, invalidatedErr := authenticate(apiKey("invalidated", "key"))
+	_, orphanErr := authenticate(apiKey("orphan", "key"))
+	_, schemeErr := authenticate("Bearer token")
+
+	// Assert
+	assert.NoError(t, userErr)
+	assert.Equal(t, "alice", user.User.Username)
+	assert.Equal(t, []string{"reader"}, user.User.Roles)
+	assert.Empty(t, user.User.PasswordHash)
+	assert.Equal(t, "realm", user.Type())
+	assert.Equal(t, NativeRealm, user.Realm)
+	assert.EqualError(t, wrongPasswordErr, "unable to authenticate user [alice] for REST request [/_search]")
+	assert.Error(t, disabledErr)
+	assert.NoError(t, reservedErr)
+	assert.Equal(t, []string{SuperuserRole}, reserved.User.Roles)
+	assert.Equal(t, ReservedRealm, reserved.Realm)
+	assert.EqualError(t, missingErr, "missing authentication credentials for REST request [/_search]")
+	assert.NoError(t, keyErr)
+	assert.Equal(t, "api_key", key.Type())
+	assert.Equal(t, "alice", key.User.Username)
+	assert.Equal(t, "ci", key.ApiKey.Name)
+	assert.Empty(t, key.ApiKey.KeyHash)
+	assert.EqualError(t, wrongKeyErr, "unable to authenticate with provided credentials for REST request [/_search]")
+	assert.Error(t, expiredErr)
+	assert.Error(t, invalidatedErr)
+	// the owner of the key no longer exists
+	assert.Error(t, orphanErr)
+	assert.Error(t, schemeErr)
+}
+
+func TestAuthenticator_Authenticate_withoutBootstrapPassword(t *testing.T) {
+	// Arrange
+	authenticator, _ := NewAuthenticator("")
+
+	// Action
+	_, err := authenticator.Authenticate(basic(ReservedUsername, ""), "/", state.SecurityMetadata{}, time.Now())
+
+	// Assert
+	assert.Error(t, err)
+}
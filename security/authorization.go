@@ -0,0 +1,319 @@
+package security
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/state"
+	"sort"
+	"strings"
+)
+
+// The actions of the security APIs.
+const (
+	UserPutAction      = "cluster:admin/xpack/security/user/put"
+	UserGetAction      = "cluster:admin/xpack/security/user/get"
+	UserDeleteAction   = "cluster:admin/xpack/security/user/delete"
+	AuthenticateAction = "cluster:admin/xpack/security/user/authenticate"
+	RolePutAction      = "cluster:admin/xpack/security/role/put"
+	RoleGetAction      = "cluster:admin/xpack/security/role/get"
+	RoleDeleteAction   = "cluster:admin/xpack/security/role/delete"
+	ApiKeyCreateAction = "cluster:admin/xpack/security/api_key/create"
+	// ApiKeyGetAction and ApiKeyInvalidateAction run on the keys of any user, the own ones on the keys of the
+	// user authenticated only
+	ApiKeyGetAction           = "cluster:admin/xpack/security/api_key/get"
+	ApiKeyInvalidateAction    = "cluster:admin/xpack/security/api_key/invalidate"
+	OwnApiKeyGetAction        = "cluster:admin/xpack/security/api_key/own/get"
+	OwnApiKeyInvalidateAction = "cluster:admin/xpack/security/api_key/own/invalidate"
+)
+
+// ActionRequest is an action a request runs. An index action runs on the indices of index expressions, index
+// names, alias names or wildcard patterns, a cluster action has no Indices.
+type ActionRequest struct {
+	Action  string
+	Indices []string
+}
+
+func ClusterAction(action string) ActionRequest {
+	return ActionRequest{Action: action}
+}
+
+// IndexAction returns an index action on the indices of expressions, every index without any.
+func IndexAction(action string, expressions ...string) ActionRequest {
+	var indices []string
+	for _, expression := range expressions {
+		for _, e := range strings.Split(expression, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				indices = append(indices, e)
+			}
+		}
+	}
+	if len(indices) == 0 {
+		indices = []string{"_all"}
+	}
+	return ActionRequest{Action: action, Indices: indices}
+}
+
+// AuthorizationError fails a request running an action the user is not granted.
+type AuthorizationError struct {
+	Action    string
+	Principal string
+	// Indices are those the action is not granted on, none for a cluster action
+	Indices  []string
+	Granting []string
+}
+
+func (e *AuthorizationError) Error() string {
+	if e.Indices == nil {
+		return fmt.Sprintf("action [%s] is unauthorized for %s, this action is granted by the cluster privileges [%s]",
+			e.Action, e.Principal, strings.Join(e.Granting, ","))
+	}
+	return fmt.Sprintf("action [%s] is unauthorized for %s on indices [%s], this action is granted by the index privileges [%s]",
+		e.Action, e.Principal, strings.Join(e.Indices, ","), strings.Join(e.Granting, ","))
+}
+
+func (e *AuthorizationError) ErrorType() string {
+	return "security_exception"
+}
+
+// Authorize checks that the roles of an authentication grant every action request. The index expressions are
+// resolved against the metadata, a wildcard needs the privilege on every index it matches. The actions reading
+// documents around document and field level security are denied on the indices they restrict.
+func Authorize(authentication *Authentication, requests []ActionRequest, metadata state.Metadata) error {
+	permissions := permissionsOf(authentication, metadata.Security)
+	for _, request := range requests {
+		// every user may tell who it is
+		if request.Action == AuthenticateAction {
+			continue
+		}
+		if request.Indices == nil {
+			if !permissions.grantsCluster(request.Action) {
+				return &AuthorizationError{
+					Action:    request.Action,
+					Principal: principal(authentication),
+					Granting:  grantingPrivileges(clusterPrivileges, request.Action),
+				}
+			}
+			continue
+		}
+		var denied []string
+		for _, index := range ResolveIndices(request.Indices, metadata) {
+			if !permissions.grantsIndex(request.Action, index) {
+				denied = append(denied, index)
+			}
+		}
+		if len(denied) > 0 {
+			return &AuthorizationError{
+				Action:    request.Action,
+				Principal: principal(authentication),
+				Indices:   denied,
+				Granting:  grantingPrivileges(indexPrivileges, request.Action),
+			}
+		}
+		if accessControlledActions[request.Action] {
+			for _, index := range ResolveIndices(request.Indices, metadata) {
+				if permissions.accessControl(request.Action, index).Restricted() || permissions.accessControl(readAction, index).Restricted() {
+					return fmt.Errorf("action [%s] is not supported on index [%s] when field or document level security is enabled", request.Action, index)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func principal(authentication *Authentication) string {
+	if authentication.ApiKey != nil {
+		return fmt.Sprintf("API key id [%s] of user [%s]", authentication.ApiKey.Id, authentication.User.Username)
+	}
+	return fmt.Sprintf("user [%s]", authentication.User.Username)
+}
+
+// ResolveIndices returns the sorted names of the indices of index expressions. A wildcard matches the indices and
+// the aliases, an alias stands for its indices, an expression matching nothing stays as it is, e.g. the name of an
+// index to create.
+func ResolveIndices(expressions []string, metadata state.Metadata) []string {
+	aliases := map[string][]string{}
+	for name, indexMetadata := range metadata.Indices {
+		for alias := range indexMetadata.Aliases {
+			aliases[alias] = append(aliases[alias], name)
+		}
+	}
+
+	resolved := map[string]bool{}
+	for _, expression := range expressions {
+		switch {
+		case expression == "_all" || expression == "*":
+			for name := range metadata.Indices {
+				resolved[name] = true
+			}
+		case strings.Contains(expression, "*"):
+			for name := range metadata.Indices {
+				if simpleMatch(expression, name) {
+					resolved[name] = true
+				}
+			}
+			for alias, names := range aliases {
+				if simpleMatch(expression, alias) {
+					for _, name := range names {
+						resolved[name] = true
+					}
+				}
+			}
+		default:
+			if names, existing := aliases[expression]; existing {
+				if _, index := metadata.Indices[expression]; !index {
+					for _, name := range names {
+						resolved[name] = true
+					}
+					continue
+				}
+			}
+			resolved[expression] = true
+		}
+	}
+
+	indices := make([]string, 0, len(resolved))
+	for name := range resolved {
+		indices = append(indices, name)
+	}
+	sort.Strings(indices)
+	return indices
+}
+
+// permission is what the roles of a user grant.
+type permission struct {
+	cluster []privilege
+	indices []indexPermission
+}
+
+type indexPermission struct {
+	names         []string
+	privileges    []privilege
+	query         string
+	fieldSecurity *state.FieldSecurity
+}
+
+func newPermission(roles []state.Role) permission {
+	var p permission
+	for _, role := range roles {
+		for _, name := range role.Cluster {
+			if privilege, ok := resolvePrivilege(clusterPrivileges, name); ok {
+				p.cluster = append(p.cluster, privilege)
+			}
+		}
+		for _, indices := range role.Indices {
+			ip := indexPermission{names: indices.Names, query: indices.Query, fieldSecurity: indices.FieldSecurity}
+			for _, name := range indices.Privileges {
+				if privilege, ok := resolvePrivilege(indexPrivileges, name); ok {
+					ip.privileges = append(ip.privileges, privilege)
+				}
+			}
+			p.indices = append(p.indices, ip)
+		}
+	}
+	return p
+}
+
+func (p permission) grantsCluster(action string) bool {
+	for _, privilege := range p.cluster {
+		if privilege.grants(action) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p permission) grantsIndex(action string, index string) bool {
+	for _, ip := range p.indices {
+		if ip.matches(index) && ip.grants(action) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ip indexPermission) grants(action string) bool {
+	for _, privilege := range ip.privileges {
+		if privilege.grants(action) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ip indexPermission) matches(index string) bool {
+	for _, pattern := range ip.names {
+		if simpleMatch(pattern, index) {
+			return true
+		}
+	}
+	return false
+}
+
+// limitedPermission grants what every one of its permissions grants, an API key is limited by its owner.
+type limitedPermission []permission
+
+func (l limitedPermission) grantsCluster(action string) bool {
+	for _, p := range l {
+		if !p.grantsCluster(action) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l limitedPermission) grantsIndex(action string, index string) bool {
+	for _, p := range l {
+		if !p.grantsIndex(action, index) {
+			return false
+		}
+	}
+	return true
+}
+
+// Roles returns the roles of names, the reserved ones and those of the metadata, the unknown names are skipped.
+func Roles(names []string, metadata state.SecurityMetadata) []state.Role {
+	var roles []state.Role
+	for _, name := range names {
+		if role, reserved := reservedRoles[name]; reserved {
+			roles = append(roles, role)
+		} else if role, existing := metadata.Roles[name]; existing {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func permissionsOf(authentication *Authentication, metadata state.SecurityMetadata) limitedPermission {
+	permissions := limitedPermission{newPermission(Roles(authentication.User.Roles, metadata))}
+	if authentication.ApiKey != nil && len(authentication.ApiKey.RoleDescriptors) > 0 {
+		permissions = append(permissions, newPermission(authentication.ApiKey.RoleDescriptors))
+	}
+	return permissions
+}
+
+// ValidateRole checks the privileges of a role are known and its queries are supported.
+func ValidateRole(role state.Role) error {
+	for _, name := range role.Cluster {
+		if err := validateClusterPrivilege(name); err != nil {
+			return err
+		}
+	}
+	for _, indices := range role.Indices {
+		if len(indices.Names) == 0 {
+			return fmt.Errorf("indices privileges of role [%s] must refer to at least one index name or index name pattern", role.Name)
+		}
+		if len(indices.Privileges) == 0 {
+			return fmt.Errorf("indices privileges of role [%s] must define at least one privilege", role.Name)
+		}
+		for _, name := range indices.Privileges {
+			if err := validateIndexPrivilege(name); err != nil {
+				return err
+			}
+		}
+		if indices.Query != "" {
+			if _, err := parseRoleQuery(indices.Query); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package security
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSimpleMatch(t *testing.T) {
+	// Arrange
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"logs", "logs", true},
+		{"logs", "logs-1", false},
+		{"logs-*", "logs-1", true},
+		{"logs-*", "metrics-1", false},
+		{"*", "", true},
+		{"*-2020", "logs-2020", true},
+		{"cluster:monitor/*", "cluster:monitor/nodes/info", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"*b*", "abc", true},
+	}
+
+	for _, c := range cases {
+		// Action
+		match := simpleMatch(c.pattern, c.s)
+
+		// Assert
+		assert.Equal(t, c.match, match, "%s matches %s", c.pattern, c.s)
+	}
+}
+
+func TestResolveIndices(t *testing.T) {
+	// Arrange
+	metadata := state.Metadata{
+		Indices: map[string]state.IndexMetadata{
+			"logs-1":    {Aliases: map[string]state.AliasMetadata{"logs": {}}},
+			"logs-2":    {Aliases: map[string]state.AliasMetadata{"logs": {}}},
+			"metrics-1": {},
+		},
+	}
+
+	// Action
+	all := ResolveIndices([]string{"_all"}, metadata)
+	wildcard := ResolveIndices([]string{"log*"}, metadata)
+	alias := ResolveIndices([]string{"logs"}, metadata)
+	missing := ResolveIndices([]string{"new-index", "metrics-1"}, metadata)
+	nothing := ResolveIndices([]string{"traces-*"}, metadata)
+
+	// Assert
+	assert.Equal(t, []string{"logs-1", "logs-2", "metrics-1"}, all)
+	assert.Equal(t, []string{"logs-1", "logs-2"}, wildcard)
+	assert.Equal(t, []string{"logs-1", "logs-2"}, alias)
+	assert.Equal(t, []string{"metrics-1", "new-index"}, missing)
+	assert.Empty(t, nothing)
+}
+
+func TestAuthorize(t *testing.T) {
+	// Arrange
+	metadata := state.Metadata{
+		Indices: map[string]state.IndexMetadata{
+			"logs-1":    {},
+			"secrets-1": {},
+		},
+		Security: state.SecurityMetadata{
+			Roles: map[string]state.Role{
+				"logs_reader": {
+					Name:    "logs_reader",
+					Cluster: []string{"monitor"},
+					Indices: []state.IndicesPrivileges{
+						{Names: []string{"logs-*"}, Privileges: []string{"read", "view_index_metadata"}},
+					},
+				},
+				"logs_writer": {
+					Name: "logs_writer",
+					Indices: []state.IndicesPrivileges{
+						{Names: []string{"logs-*"}, Privileges: []string{"write", "create_index"}},
+					},
+				},
+				"admin": {
+					Name:    "admin",
+					Cluster: []string{"manage"},
+				},
+			},
+		},
+	}
+	authentication := func(roles ...string) *Authentication {
+		return &Authentication{User: state.User{Username: "alice", Roles: roles}, Realm: NativeRealm}
+	}
+	reader := authentication("logs_reader", "unknown_role")
+	readerWriter := authentication("logs_reader", "logs_writer")
+	// the key of a reader and writer limited to reads
+	readOnlyKey := authentication("logs_reader", "logs_writer")
+	readOnlyKey.ApiKey = &state.ApiKey{
+		Id: "key-1",
+		RoleDescriptors: []state.Role{{
+			Indices: []state.IndicesPrivileges{{Names: []string{"*"}, Privileges: []string{"read"}}},
+		}},
+	}
+
+	// Action
+	monitorErr := Authorize(reader, []ActionRequest{ClusterAction("cluster:monitor/health")}, metadata)
+	searchErr := Authorize(reader, []ActionRequest{IndexAction("indices:data/read/search", "logs-1")}, metadata)
+	wildcardErr := Authorize(reader, []ActionRequest{IndexAction("indices:data/read/search", "*")}, metadata)
+	writeErr := Authorize(reader, []ActionRequest{IndexAction("indices:data/write/index", "logs-1")}, metadata)
+	putUserErr := Authorize(reader, []ActionRequest{ClusterAction(UserPutAction)}, metadata)
+	authenticateErr := Authorize(reader, []ActionRequest{ClusterAction(AuthenticateAction)}, metadata)
+	createErr := Authorize(readerWriter, []ActionRequest{IndexAction("indices:admin/create", "logs-2")}, metadata)
+	keyReadErr := Authorize(readOnlyKey, []ActionRequest{IndexAction("indices:data/read/get", "logs-1")}, metadata)
+	keyWriteErr := Authorize(readOnlyKey, []ActionRequest{IndexAction("indices:data/write/index", "logs-1")}, metadata)
+	keySecretsErr := Authorize(readOnlyKey, []ActionRequest{IndexAction("indices:data/read/get", "secrets-1")}, metadata)
+	manageErr := Authorize(authentication("admin"), []ActionRequest{ClusterAction("cluster:admin/settings/update")}, metadata)
+	manageSecurityErr := Authorize(authentication("admin"), []ActionRequest{ClusterAction(RolePutAction)}, metadata)
+	superuserErr := Authorize(authentication(SuperuserRole), []ActionRequest{
+		ClusterAction(RolePutAction),
+		IndexAction("indices:admin/delete", "_all"),
+	}, metadata)
+
+	// Assert
+	assert.NoError(t, monitorErr)
+	assert.NoError(t, searchErr)
+	assert.EqualError(t, wildcardErr, "action [indices:data/read/search] is unauthorized for user [alice] on indices [secrets-1], this action is granted by the index privileges [read,all]")
+	assert.EqualError(t, writeErr, "action [indices:data/write/index] is unauthorized for user [alice] on indices [logs-1], this action is granted by the index privileges [index,write,all]")
+	assert.EqualError(t, putUserErr, "action [cluster:admin/xpack/security/user/put] is unauthorized for user [alice], this action is granted by the cluster privileges [manage_security,all]")
+	assert.NoError(t, authenticateErr)
+	assert.NoError(t, createErr)
+	assert.NoError(t, keyReadErr)
+	assert.EqualError(t, keyWriteErr, "action [indices:data/write/index] is unauthorized for API key id [key-1] of user [alice] on indices [logs-1], this action is granted by the index privileges [index,write,all]")
+	// the key does not extend the privileges of its owner
+	assert.Error(t, keySecretsErr)
+	assert.NoError(t, manageErr)
+	assert.Error(t, manageSecurityErr)
+	assert.NoError(t, superuserErr)
+}
+
+func TestValidateRole(t *testing.T) {
+	// Arrange
+	valid := state.Role{
+		Name:    "valid",
+		Cluster: []string{"monitor", "cluster:admin/reroute"},
+		Indices: []state.IndicesPrivileges{{Names: []string{"logs-*"}, Privileges: []string{"read", "indices:admin/refresh"}}},
+	}
+	unknownCluster := state.Role{Name: "unknown", Cluster: []string{"read"}}
+	unknownIndex := state.Role{Name: "unknown", Indices: []state.IndicesPrivileges{{Names: []string{"logs"}, Privileges: []string{"monitor", "reed"}}}}
+	noNames := state.Role{Name: "no_names", Indices: []state.IndicesPrivileges{{Privileges: []string{"read"}}}}
+	unsupportedQuery := state.Role{Name: "unsupported", Indices: []state.IndicesPrivileges{{Names: []string{"logs"}, Privileges: []string{"read"}, Query: `{"geo_shape":{}}`}}}
+	malformedQuery := state.Role{Name: "malformed", Indices: []state.IndicesPrivileges{{Names: []string{"logs"}, Privileges: []string{"read"}, Query: `{"match":"tenant"}`}}}
+
+	// Action
+	validErr := ValidateRole(valid)
+	unknownClusterErr := ValidateRole(unknownCluster)
+	unknownIndexErr := ValidateRole(unknownIndex)
+	noNamesErr := ValidateRole(noNames)
+	unsupportedQueryErr := ValidateRole(unsupportedQuery)
+	malformedQueryErr := ValidateRole(malformedQuery)
+
+	// Assert
+	assert.NoError(t, validErr)
+	assert.Contains(t, unknownClusterErr.Error(), "unknown cluster privilege [read]")
+	assert.Contains(t, unknownIndexErr.Error(), "unknown index privilege [reed]")
+	assert.EqualError(t, noNamesErr, "indices privileges of role [no_names] must refer to at least one index name or index name pattern")
+	assert.EqualError(t, unsupportedQueryErr, `failed to parse role query [{"geo_shape":{}}]: unsupported query`)
+	assert.Error(t, malformedQueryErr)
+}
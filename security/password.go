@@ -0,0 +1,99 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"golang.org/x/crypto/pbkdf2"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	hashPrefix = "{PBKDF2}"
+	// hashIterations makes guessing a password from its hash expensive
+	hashIterations = 10000
+	hashSaltLength = 32
+	hashKeyLength  = 32
+	// maxCachedHashes bounds the cache of the verified passwords, it is emptied when full
+	maxCachedHashes = 10000
+)
+
+// HashPassword returns the salted PBKDF2-HMAC-SHA512 hash of a password, "{PBKDF2}<iterations>$<salt>$<key>".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, hashSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2.Key([]byte(password), salt, hashIterations, hashKeyLength, sha512.New)
+	return hashPrefix + strconv.Itoa(hashIterations) + "$" + base64.StdEncoding.EncodeToString(salt) + "$" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// RandomSecret returns a random URL safe secret, e.g. the key of an API key.
+func RandomSecret() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// verifyPassword tells whether the password is the one hashed.
+func verifyPassword(hash string, password string) bool {
+	if !strings.HasPrefix(hash, hashPrefix) {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(hash, hashPrefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	key, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2.Key([]byte(password), salt, iterations, len(key), sha512.New), key) == 1
+}
+
+// hashCache remembers the passwords verified against a hash, a request authenticates without deriving the key
+// again. It keeps a SHA-256 of the passwords, not the passwords themselves.
+type hashCache struct {
+	mux      sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{
+		verified: map[string][sha256.Size]byte{},
+	}
+}
+
+func (c *hashCache) verify(hash string, password string) bool {
+	digest := sha256.Sum256([]byte(password))
+	c.mux.Lock()
+	cached, existing := c.verified[hash]
+	c.mux.Unlock()
+	if existing {
+		return subtle.ConstantTimeCompare(cached[:], digest[:]) == 1
+	}
+	if !verifyPassword(hash, password) {
+		return false
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if len(c.verified) >= maxCachedHashes {
+		c.verified = map[string][sha256.Size]byte{}
+	}
+	c.verified[hash] = digest
+	return true
+}
@@ -0,0 +1,133 @@
+package security
+
+import (
+	"fmt"
+	"strings"
+)
+
+// privilege is a named set of actions, the patterns of actions it grants minus those it excludes.
+type privilege struct {
+	name     string
+	actions  []string
+	excluded []string
+}
+
+func (p privilege) grants(action string) bool {
+	for _, pattern := range p.excluded {
+		if simpleMatch(pattern, action) {
+			return false
+		}
+	}
+	for _, pattern := range p.actions {
+		if simpleMatch(pattern, action) {
+			return true
+		}
+	}
+	return false
+}
+
+const securityActions = "cluster:admin/xpack/security/*"
+
+// clusterPrivileges are the privileges a role grants on the cluster, from the narrowest to the broadest.
+var clusterPrivileges = []privilege{
+	{name: "manage_own_api_key", actions: []string{ApiKeyCreateAction, "cluster:admin/xpack/security/api_key/own/*"}},
+	{name: "manage_api_key", actions: []string{"cluster:admin/xpack/security/api_key/*"}},
+	{name: "monitor", actions: []string{"cluster:monitor/*", "indices:admin/template/get"}},
+	{name: "manage_security", actions: []string{securityActions}},
+	{name: "manage", actions: []string{"cluster:*", "indices:admin/template/*"}, excluded: []string{securityActions}},
+	{name: "all", actions: []string{"cluster:*", "indices:admin/template/*"}},
+}
+
+// indexPrivileges are the privileges a role grants on indices, from the narrowest to the broadest.
+var indexPrivileges = []privilege{
+	{name: "create_index", actions: []string{"indices:admin/create"}},
+	{name: "delete_index", actions: []string{"indices:admin/delete"}},
+	{name: "view_index_metadata", actions: []string{"indices:admin/get", "indices:admin/aliases/get", "indices:admin/mappings/get"}},
+	{name: "maintenance", actions: []string{"indices:admin/refresh", "indices:admin/flush", "indices:admin/forcemerge"}},
+	{name: "monitor", actions: []string{"indices:monitor/*"}},
+	{name: "read", actions: []string{"indices:data/read/*"}},
+	{name: "index", actions: []string{"indices:data/write/index", "indices:data/write/update"}},
+	{name: "delete", actions: []string{"indices:data/write/delete"}},
+	{name: "write", actions: []string{"indices:data/write/*"}},
+	{name: "manage", actions: []string{"indices:admin/*", "indices:monitor/*"}},
+	{name: "all", actions: []string{"indices:*"}},
+}
+
+// resolvePrivilege returns the privilege of a name, a name with a colon is a pattern of actions, e.g.
+// "indices:data/read/*".
+func resolvePrivilege(privileges []privilege, name string) (privilege, bool) {
+	if strings.Contains(name, ":") {
+		return privilege{name: name, actions: []string{name}}, true
+	}
+	for _, p := range privileges {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return privilege{}, false
+}
+
+func privilegeNames(privileges []privilege) []string {
+	names := make([]string, len(privileges))
+	for i, p := range privileges {
+		names[i] = p.name
+	}
+	return names
+}
+
+// grantingPrivileges returns the names of the privileges granting an action, for the error of a denied request.
+func grantingPrivileges(privileges []privilege, action string) []string {
+	var names []string
+	for _, p := range privileges {
+		if p.grants(action) {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+func validateClusterPrivilege(name string) error {
+	if _, ok := resolvePrivilege(clusterPrivileges, name); !ok {
+		return fmt.Errorf("unknown cluster privilege [%s]. a privilege must be either one of the predefined cluster privilege names [%s] or a pattern over one of the available cluster actions",
+			name, strings.Join(privilegeNames(clusterPrivileges), ","))
+	}
+	return nil
+}
+
+func validateIndexPrivilege(name string) error {
+	if _, ok := resolvePrivilege(indexPrivileges, name); !ok {
+		return fmt.Errorf("unknown index privilege [%s]. a privilege must be either one of the predefined index privilege names [%s] or a pattern over one of the available index actions",
+			name, strings.Join(privilegeNames(indexPrivileges), ","))
+	}
+	return nil
+}
+
+// simpleMatch matches a string against a pattern where "*" stands for any sequence of characters.
+func simpleMatch(pattern string, s string) bool {
+	for {
+		star := strings.IndexByte(pattern, '*')
+		if star < 0 {
+			return pattern == s
+		}
+		if !strings.HasPrefix(s, pattern[:star]) {
+			return false
+		}
+		s = s[star:]
+		pattern = pattern[star+1:]
+		if pattern == "" {
+			return true
+		}
+		next := strings.IndexByte(pattern, '*')
+		if next < 0 {
+			return strings.HasSuffix(s, pattern)
+		}
+		// the shortest match of the literal up to the next star leaves the most for the rest of the pattern
+		literal := pattern[:next]
+		i := strings.Index(s, literal)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(literal):]
+		pattern = pattern[next:]
+	}
+}
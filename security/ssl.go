@@ -0,0 +1,253 @@
+package security
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// VerificationModeFull verifies the certificate of the remote node and that it names the address connected to
+	VerificationModeFull = "full"
+	// VerificationModeCertificate verifies the certificate of the remote node only
+	VerificationModeCertificate = "certificate"
+
+	ClientAuthenticationNone     = "none"
+	ClientAuthenticationOptional = "optional"
+	ClientAuthenticationRequired = "required"
+
+	// DefaultReloadInterval is how often the certificate files are checked for changes
+	DefaultReloadInterval = 5 * time.Second
+)
+
+// SSLConfig is the TLS configuration of the transport or the HTTP layer, the files are in PEM format.
+type SSLConfig struct {
+	Certificate            string
+	Key                    string
+	CertificateAuthorities []string
+	// VerificationMode is how the certificate of the node connected to is verified, full or certificate
+	VerificationMode string
+	// ClientAuthentication is whether the clients send a certificate, none, optional or required
+	ClientAuthentication string
+}
+
+func (c SSLConfig) Validate() error {
+	if c.Certificate == "" || c.Key == "" {
+		return errors.New("ssl requires a certificate and a key")
+	}
+	switch c.VerificationMode {
+	case "", VerificationModeFull, VerificationModeCertificate:
+	default:
+		return fmt.Errorf("unknown verification mode [%s], expected one of [%s, %s]", c.VerificationMode, VerificationModeFull, VerificationModeCertificate)
+	}
+	switch c.ClientAuthentication {
+	case "", ClientAuthenticationNone, ClientAuthenticationOptional, ClientAuthenticationRequired:
+	default:
+		return fmt.Errorf("unknown client authentication [%s], expected one of [%s, %s, %s]", c.ClientAuthentication, ClientAuthenticationNone, ClientAuthenticationOptional, ClientAuthenticationRequired)
+	}
+	if c.clientAuthentication() != ClientAuthenticationNone && len(c.CertificateAuthorities) == 0 {
+		return errors.New("ssl requires certificate authorities to verify the client certificates")
+	}
+	return nil
+}
+
+func (c SSLConfig) clientAuthentication() string {
+	if c.ClientAuthentication == "" {
+		return ClientAuthenticationRequired
+	}
+	return c.ClientAuthentication
+}
+
+// SSLService serves the certificate and the certificate authorities of an SSLConfig. The TLS configurations it
+// returns use the files loaded last, the files changed on disk are loaded again by Start without a restart.
+type SSLService struct {
+	config SSLConfig
+
+	mux         sync.RWMutex
+	certificate *tls.Certificate
+	// caPool is nil without certificate authorities, the system ones are used then
+	caPool   *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func NewSSLService(config SSLConfig) (*SSLService, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s := &SSLService{
+		config: config,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SSLService) files() []string {
+	return append([]string{s.config.Certificate, s.config.Key}, s.config.CertificateAuthorities...)
+}
+
+func (s *SSLService) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(s.config.Certificate, s.config.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load the certificate [%s] and the key [%s]: %v", s.config.Certificate, s.config.Key, err)
+	}
+	var caPool *x509.CertPool
+	if len(s.config.CertificateAuthorities) > 0 {
+		caPool = x509.NewCertPool()
+		for _, file := range s.config.CertificateAuthorities {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if !caPool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificate found in the certificate authority [%s]", file)
+			}
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.certificate = &certificate
+	s.caPool = caPool
+	s.modTimes = modTimes
+	return nil
+}
+
+// changed tells whether a file changed since it was loaded.
+func (s *SSLService) changed() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, file := range s.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(s.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reload loads the files again once one of them changed. The files loaded last stay in use when the new ones
+// are invalid, e.g. while they are being written.
+func (s *SSLService) reload() {
+	if !s.changed() {
+		return
+	}
+	if err := s.load(); err != nil {
+		logrus.Errorf("SSLService: failed to reload the certificates, keeping the previous ones; err: %v", err)
+		return
+	}
+	logrus.Infof("SSLService: reloaded the certificate [%s]", s.config.Certificate)
+}
+
+// Start checks the files for changes every interval.
+func (s *SSLService) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.reload()
+		}
+	}()
+}
+
+func (s *SSLService) current() (*tls.Certificate, *x509.CertPool) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.certificate, s.caPool
+}
+
+// ServerConfig returns the configuration of a listener, the clients authenticate as the ClientAuthentication
+// of the config tells.
+func (s *SSLService) ServerConfig() *tls.Config {
+	var clientAuth tls.ClientAuthType
+	switch s.config.clientAuthentication() {
+	case ClientAuthenticationNone:
+		clientAuth = tls.NoClientCert
+	case ClientAuthenticationOptional:
+		clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			certificate, caPool := s.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*certificate},
+				ClientAuth:   clientAuth,
+				ClientCAs:    caPool,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig returns the configuration of a connection to address. The certificate of the remote node is
+// verified against the certificate authorities, in full verification mode it also has to name the host of address.
+func (s *SSLService) ClientConfig(address string) *tls.Config {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			certificate, _ := s.current()
+			return certificate, nil
+		},
+		// the certificate is verified below with the certificate authorities loaded last
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return s.verifyServerCertificate(rawCerts, host)
+		},
+	}
+}
+
+func (s *SSLService) verifyServerCertificate(rawCerts [][]byte, host string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("the remote node sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	_, caPool := s.current()
+	options := x509.VerifyOptions{
+		Roots:         caPool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		options.Intermediates.AddCert(cert)
+	}
+	if s.config.VerificationMode != VerificationModeCertificate {
+		options.DNSName = host
+	}
+	if _, err := certs[0].Verify(options); err != nil {
+		return fmt.Errorf("the certificate of [%s] is not trusted: %v", host, err)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/actumn/searchgoose/state/transport/tcp"
+	"github.com/actumn/searchgoose/state/transport/tcp/tcptest"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64
+
+// newTestCertificate returns a certificate of the hosts signed by issuer, a certificate authority without issuer.
+func newTestCertificate(t *testing.T, issuer *testCertificate, hosts ...string) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: "searchgoose-test-" + strconv.FormatInt(testSerial, 10)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	parent, parentKey := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key}
+}
+
+// write writes the certificate and the key in PEM files of dir, it returns their paths.
+func (c *testCertificate) write(t *testing.T, dir string, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func newTestSSLService(t *testing.T, dir string, name string, cert *testCertificate, ca *testCertificate, verificationMode string) *SSLService {
+	certFile, keyFile := cert.write(t, dir, name)
+	caFile, _ := ca.write(t, dir, name+"-ca")
+	s, err := NewSSLService(SSLConfig{
+		Certificate:            certFile,
+		Key:                    keyFile,
+		CertificateAuthorities: []string{caFile},
+		VerificationMode:       verificationMode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func openTestConnection(client *tcp.Transport, address string) transport.Connection {
+	var conn transport.Connection
+	client.OpenConnection(address, func(c transport.Connection) {
+		conn = c
+	})
+	return conn
+}
+
+func TestSSLConfig_Validate(t *testing.T) {
+	// Arrange
+	valid := SSLConfig{Certificate: "node.crt", Key: "node.key", CertificateAuthorities: []string{"ca.crt"}}
+	noKey := SSLConfig{Certificate: "node.crt"}
+	noCA := SSLConfig{Certificate: "node.crt", Key: "node.key"}
+	noClientAuthentication := SSLConfig{Certificate: "node.crt", Key: "node.key", ClientAuthentication: ClientAuthenticationNone}
+	unknownMode := valid
+	unknownMode.VerificationMode = "strict"
+
+	// Action
+	validErr := valid.Validate()
+	noKeyErr := noKey.Validate()
+	noCAErr := noCA.Validate()
+	noClientAuthenticationErr := noClientAuthentication.Validate()
+	unknownModeErr := unknownMode.Validate()
+
+	// Assert
+	assert.NoError(t, validErr)
+	assert.EqualError(t, noKeyErr, "ssl requires a certificate and a key")
+	assert.EqualError(t, noCAErr, "ssl requires certificate authorities to verify the client certificates")
+	assert.NoError(t, noClientAuthenticationErr)
+	assert.EqualError(t, unknownModeErr, "unknown verification mode [strict], expected one of [full, certificate]")
+}
+
+func TestSSLService_Transport(t *testing.T) {
+	// Arrange
+	dir, err := ioutil.TempDir("", "searchgoose-ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCertificate(t, nil)
+	otherCA := newTestCertificate(t, nil)
+	startServer := func(cert *testCertificate) string {
+		port := tcptest.FreePort(t)
+		server := tcp.NewTransport(port, "", "server")
+		server.TLS = newTestSSLService(t, dir, "server"+strconv.Itoa(port), cert, ca, VerificationModeFull)
+		server.Register("echo", func(channel transport.ReplyChannel, req []byte) {
+			channel.SendMessage("", req)
+		})
+		server.Start(port)
+		return "127.0.0.1:" + strconv.Itoa(port)
+	}
+	address := startServer(newTestCertificate(t, ca, "127.0.0.1"))
+	otherHostAddress := startServer(newTestCertificate(t, ca, "node2.example"))
+	time.Sleep(50 * time.Millisecond)
+	newClient := func(name string, cert *testCertificate, ca *testCertificate, verificationMode string) *tcp.Transport {
+		client := tcp.NewTransport(0, "", name)
+		client.TLS = newTestSSLService(t, dir, name, cert, ca, verificationMode)
+		return client
+	}
+	client := newClient("client", newTestCertificate(t, ca, "127.0.0.1"), ca, VerificationModeFull)
+	untrustedClient := newClient("untrusted", newTestCertificate(t, otherCA, "127.0.0.1"), ca, VerificationModeFull)
+	distrustingClient := newClient("distrusting", newTestCertificate(t, ca, "127.0.0.1"), otherCA, VerificationModeFull)
+	certificateModeClient := newClient("certificateMode", newTestCertificate(t, ca, "127.0.0.1"), ca, VerificationModeCertificate)
+
+	// Action
+	conn := openTestConnection(client, address)
+	var echo []byte
+	echoed := make(chan struct{})
+	conn.SendRequest("echo", []byte("echo"), transport.RequestOptions{Timeout: time.Second}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			echo = response
+			close(echoed)
+		},
+		OnFailure: func(err error) {
+			close(echoed)
+		},
+	})
+	<-echoed
+	untrustedConn := openTestConnection(untrustedClient, address)
+	distrustingConn := openTestConnection(distrustingClient, address)
+	otherHostConn := openTestConnection(client, otherHostAddress)
+	certificateModeConn := openTestConnection(certificateModeClient, otherHostAddress)
+
+	// Assert
+	assert.Empty(t, conn.GetMessage())
+	assert.Equal(t, "echo", string(echo))
+	// the server rejects a client certificate of another certificate authority
+	assert.NotEmpty(t, untrustedConn.GetMessage())
+	assert.Contains(t, distrustingConn.GetMessage(), "Failed the TLS handshake with "+distrustingConn.GetDestAddress())
+	assert.Contains(t, distrustingConn.GetMessage(), "is not trusted")
+	// the certificate of the server does not name the address connected to
+	assert.Contains(t, otherHostConn.GetMessage(), "is not trusted")
+	assert.Empty(t, certificateModeConn.GetMessage())
+}
+
+func TestSSLService_reload(t *testing.T) {
+	// Arrange
+	dir, err := ioutil.TempDir("", "searchgoose-ssl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCertificate(t, nil)
+	s := newTestSSLService(t, dir, "node", newTestCertificate(t, ca, "127.0.0.1"), ca, VerificationModeFull)
+	loaded, _ := s.current()
+	renewed := newTestCertificate(t, ca, "127.0.0.1")
+	touch := func(files ...string) {
+		later := time.Now().Add(time.Minute)
+		for _, file := range files {
+			os.Chtimes(file, later, later)
+		}
+	}
+
+	// Action
+	s.reload()
+	unchanged, _ := s.current()
+	certFile, keyFile := renewed.write(t, dir, "node")
+	touch(certFile, keyFile)
+	s.reload()
+	reloaded, _ := s.current()
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+	touch(certFile)
+	s.reload()
+	invalid, _ := s.current()
+
+	// Assert
+	assert.Equal(t, loaded, unchanged)
+	assert.NotEqual(t, loaded.Certificate[0], reloaded.Certificate[0])
+	assert.Equal(t, renewed.cert.Raw, reloaded.Certificate[0])
+	// an invalid file keeps the certificate loaded last
+	assert.Equal(t, reloaded, invalid)
+}
@@ -1,8 +1,73 @@
 package state
 
+import (
+	"errors"
+	"time"
+)
+
 type ClusterService interface {
 	State() *ClusterState
-	SubmitStateUpdateTask(task ClusterStateUpdateTask)
+	// SubmitStateUpdateTask queues the task on the master and waits until its state is published, the error tells
+	// whether it was committed and applied by every node.
+	SubmitStateUpdateTask(source string, config TaskConfig, task ClusterStateUpdateTask) error
+}
+
+// Priority orders the cluster state update tasks queued on the master, the most urgent first.
+type Priority int
+
+const (
+	PriorityImmediate Priority = iota
+	PriorityUrgent
+	PriorityHigh
+	PriorityNormal
+	PriorityLow
+	PriorityLanguid
+)
+
+func (p Priority) String() string {
+	return [...]string{"IMMEDIATE", "URGENT", "HIGH", "NORMAL", "LOW", "LANGUID"}[p]
+}
+
+// TaskConfig tells how a cluster state update task is run, e.g. the timeout and master_timeout parameters.
+type TaskConfig struct {
+	Priority Priority
+	// MasterTimeout fails the task still queued after it, zero waits as long as it takes
+	MasterTimeout time.Duration
+	// AckTimeout is how long the nodes have to apply the state before the task is not acknowledged, zero waits
+	// for the publication to end
+	AckTimeout time.Duration
+}
+
+// ErrNotAcknowledged is returned when a cluster state was committed but some nodes did not apply it in time.
+var ErrNotAcknowledged = errors.New("the cluster state was not applied by every node within the publish timeout")
+
+// FailedToCommitError is returned when a cluster state was not accepted by a quorum of master-eligible nodes,
+// no node applies it.
+type FailedToCommitError struct {
+	Reason string
+}
+
+func (e *FailedToCommitError) Error() string {
+	return "failed to commit cluster state: " + e.Reason
+}
+
+// ProcessClusterEventTimeoutError is returned when a task was still queued on the master after its master timeout.
+type ProcessClusterEventTimeoutError struct {
+	Source  string
+	Timeout time.Duration
+}
+
+func (e *ProcessClusterEventTimeoutError) Error() string {
+	return "failed to process cluster event (" + e.Source + ") within " + e.Timeout.String()
+}
+
+// MasterNotDiscoveredError is returned when a request for the master found no elected master within its master timeout.
+type MasterNotDiscoveredError struct {
+	Timeout time.Duration
+}
+
+func (e *MasterNotDiscoveredError) Error() string {
+	return "no master node was discovered within " + e.Timeout.String()
 }
 
 type ClusterStateUpdateTask func(s ClusterState) ClusterState
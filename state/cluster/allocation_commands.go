@@ -0,0 +1,334 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"strings"
+	"time"
+)
+
+const (
+	MoveAllocationCommand       = "move"
+	CancelAllocationCommand     = "cancel"
+	AllocateReplicaCommand      = "allocate_replica"
+	AllocateEmptyPrimaryCommand = "allocate_empty_primary"
+)
+
+// AllocationCommand is a command of the cluster reroute API. Nodes are given by id or by name.
+type AllocationCommand struct {
+	Name  string
+	Index string
+	Shard int
+	// Node is the node of cancel, allocate_replica and allocate_empty_primary
+	Node string
+	// FromNode and ToNode are the nodes of move
+	FromNode       string
+	ToNode         string
+	AllowPrimary   bool
+	AcceptDataLoss bool
+}
+
+// Parameters returns the parameters of the command as given in the request.
+func (c AllocationCommand) Parameters() map[string]interface{} {
+	parameters := map[string]interface{}{
+		"index": c.Index,
+		"shard": c.Shard,
+	}
+	switch c.Name {
+	case MoveAllocationCommand:
+		parameters["from_node"] = c.FromNode
+		parameters["to_node"] = c.ToNode
+	case CancelAllocationCommand:
+		parameters["node"] = c.Node
+		parameters["allow_primary"] = c.AllowPrimary
+	case AllocateEmptyPrimaryCommand:
+		parameters["node"] = c.Node
+		parameters["accept_data_loss"] = c.AcceptDataLoss
+	default:
+		parameters["node"] = c.Node
+	}
+	return parameters
+}
+
+// RerouteExplanation is the decision taken for a command of a reroute request.
+type RerouteExplanation struct {
+	Command  AllocationCommand
+	Decision Decision
+	Results  []DeciderResult
+}
+
+// ParseAllocationCommands reads the commands of a reroute request body, e.g.
+// {"commands": [{"move": {"index": "test", "shard": 0, "from_node": "node1", "to_node": "node2"}}]}
+func ParseAllocationCommands(body []byte) ([]AllocationCommand, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	var request struct {
+		Commands []map[string]json.RawMessage `json:"commands"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, fmt.Errorf("failed to parse reroute request: %v", err)
+	}
+
+	var commands []AllocationCommand
+	for _, entry := range request.Commands {
+		if len(entry) != 1 {
+			return nil, fmt.Errorf("a command must hold exactly one of [%s, %s, %s, %s]", MoveAllocationCommand, CancelAllocationCommand, AllocateReplicaCommand, AllocateEmptyPrimaryCommand)
+		}
+		for name, raw := range entry {
+			var parameters struct {
+				Index          *string `json:"index"`
+				Shard          *int    `json:"shard"`
+				Node           string  `json:"node"`
+				FromNode       string  `json:"from_node"`
+				ToNode         string  `json:"to_node"`
+				AllowPrimary   bool    `json:"allow_primary"`
+				AcceptDataLoss bool    `json:"accept_data_loss"`
+			}
+			if err := json.Unmarshal(raw, &parameters); err != nil {
+				return nil, fmt.Errorf("[%s] failed to parse command: %v", name, err)
+			}
+			if parameters.Index == nil || parameters.Shard == nil {
+				return nil, fmt.Errorf("[%s] index and shard must be set", name)
+			}
+			command := AllocationCommand{
+				Name:           name,
+				Index:          *parameters.Index,
+				Shard:          *parameters.Shard,
+				Node:           parameters.Node,
+				FromNode:       parameters.FromNode,
+				ToNode:         parameters.ToNode,
+				AllowPrimary:   parameters.AllowPrimary,
+				AcceptDataLoss: parameters.AcceptDataLoss,
+			}
+			switch name {
+			case MoveAllocationCommand:
+				if command.FromNode == "" || command.ToNode == "" {
+					return nil, fmt.Errorf("[%s] from_node and to_node must be set", name)
+				}
+			case CancelAllocationCommand, AllocateReplicaCommand, AllocateEmptyPrimaryCommand:
+				if command.Node == "" {
+					return nil, fmt.Errorf("[%s] node must be set", name)
+				}
+			default:
+				return nil, fmt.Errorf("unknown allocation command [%s]", name)
+			}
+			commands = append(commands, command)
+		}
+	}
+	return commands, nil
+}
+
+// RerouteWithCommands applies the commands on top of the cluster state, then reroutes. With explain, a command
+// that cannot be applied is reported in its explanation instead of failing the whole request.
+func (s *AllocationService) RerouteWithCommands(clusterState state.ClusterState, commands []AllocationCommand, explain bool, retryFailed bool) (state.ClusterState, []RerouteExplanation, error) {
+	allocation := s.newRoutingAllocation(clusterState)
+	if retryFailed {
+		for _, shard := range allocation.RoutingNodes.UnassignedShards {
+			shard.UnassignedInfo.FailedAllocations = 0
+		}
+	}
+
+	var explanations []RerouteExplanation
+	for _, command := range commands {
+		explanation, err := s.execute(command, allocation)
+		if err != nil {
+			if !explain {
+				return clusterState, nil, err
+			}
+			explanation = RerouteExplanation{
+				Command:  command,
+				Decision: DecisionNo,
+				Results: []DeciderResult{
+					{Decider: command.Name, Decision: DecisionNo, Explanation: err.Error()},
+				},
+			}
+		}
+		explanations = append(explanations, explanation)
+	}
+	return s.allocate(clusterState, allocation), explanations, nil
+}
+
+func (s *AllocationService) execute(command AllocationCommand, allocation *RoutingAllocation) (RerouteExplanation, error) {
+	switch command.Name {
+	case MoveAllocationCommand:
+		return s.move(command, allocation)
+	case CancelAllocationCommand:
+		return s.cancel(command, allocation)
+	case AllocateReplicaCommand:
+		return s.allocateReplica(command, allocation)
+	case AllocateEmptyPrimaryCommand:
+		return s.allocateEmptyPrimary(command, allocation)
+	}
+	return RerouteExplanation{}, fmt.Errorf("unknown allocation command [%s]", command.Name)
+}
+
+// routingNode finds a data node by id or by name.
+func routingNode(allocation *RoutingAllocation, commandName string, nodeIdOrName string) (*state.RoutingNode, error) {
+	if node, existing := allocation.RoutingNodes.NodesToShards[nodeIdOrName]; existing {
+		return node, nil
+	}
+	for _, node := range allocation.RoutingNodes.NodesToShards {
+		if node.Node().Name == nodeIdOrName {
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("[%s] failed to resolve [%s], no matching data node", commandName, nodeIdOrName)
+}
+
+func commandShardId(command AllocationCommand) string {
+	return fmt.Sprintf("[%s][%d]", command.Index, command.Shard)
+}
+
+func matchesCommand(shard state.ShardRouting, command AllocationCommand) bool {
+	return shard.ShardId.Index.Name == command.Index && shard.ShardId.ShardId == command.Shard
+}
+
+func deciderExplanation(results []DeciderResult) string {
+	var reasons []string
+	for _, result := range results {
+		if result.Decision != DecisionYes {
+			reasons = append(reasons, "["+result.Decider+"]: "+result.Explanation)
+		}
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// move relocates a started copy from one node to another.
+func (s *AllocationService) move(command AllocationCommand, allocation *RoutingAllocation) (RerouteExplanation, error) {
+	fromNode, err := routingNode(allocation, command.Name, command.FromNode)
+	if err != nil {
+		return RerouteExplanation{}, err
+	}
+	toNode, err := routingNode(allocation, command.Name, command.ToNode)
+	if err != nil {
+		return RerouteExplanation{}, err
+	}
+	for _, shard := range fromNode.Shards {
+		if !matchesCommand(shard, command) {
+			continue
+		}
+		if shard.State != state.ShardStarted {
+			return RerouteExplanation{}, fmt.Errorf("[%s] can't move %s, shard is not started (state = %s)", command.Name, commandShardId(command), shard.State)
+		}
+		decision, results := s.deciders.CanAllocate(shard, toNode, allocation)
+		if decision == DecisionNo {
+			return RerouteExplanation{}, fmt.Errorf("[%s] can't move %s, from %s, to %s, since its not allowed, reason: %s", command.Name, commandShardId(command), command.FromNode, command.ToNode, deciderExplanation(results))
+		}
+		relocating := shard.Relocate(toNode.NodeId, common.RandomBase64())
+		fromNode.Remove(shard)
+		fromNode.Add(relocating)
+		toNode.Add(relocating.RelocationTarget())
+		return RerouteExplanation{Command: command, Decision: decision, Results: results}, nil
+	}
+	return RerouteExplanation{}, fmt.Errorf("[%s] can't move %s, failed to find it on node [%s]", command.Name, commandShardId(command), command.FromNode)
+}
+
+// cancel cancels the recovery or relocation of a copy on a node, or unassigns a started copy.
+func (s *AllocationService) cancel(command AllocationCommand, allocation *RoutingAllocation) (RerouteExplanation, error) {
+	node, err := routingNode(allocation, command.Name, command.Node)
+	if err != nil {
+		return RerouteExplanation{}, err
+	}
+	explanation := RerouteExplanation{
+		Command:  command,
+		Decision: DecisionYes,
+		Results: []DeciderResult{
+			{Decider: command.Name, Decision: DecisionYes, Explanation: fmt.Sprintf("shard %s allocation on node [%s] was cancelled", commandShardId(command), command.Node)},
+		},
+	}
+	for _, shard := range node.Shards {
+		if !matchesCommand(shard, command) {
+			continue
+		}
+		switch {
+		case shard.IsRelocationTarget():
+			source := allocation.RoutingNodes.NodesToShards[shard.RelocatingNodeId]
+			relocating := source.Shards[shard.ShardId]
+			source.Remove(relocating)
+			source.Add(relocating.CancelRelocation())
+			node.Remove(shard)
+		case shard.State == state.ShardRelocating:
+			target := allocation.RoutingNodes.NodesToShards[shard.RelocatingNodeId]
+			target.Remove(shard.RelocationTarget())
+			node.Remove(shard)
+			node.Add(shard.CancelRelocation())
+		default:
+			if shard.Primary && !command.AllowPrimary {
+				return RerouteExplanation{}, fmt.Errorf("[%s] can't cancel %s on node [%s], shard is primary and %s", command.Name, commandShardId(command), command.Node, strings.ToLower(string(shard.State)))
+			}
+			node.Remove(shard)
+			unassigned := shard.Unassigned(state.UnassignedRerouteCancelled, "failed shard on node ["+node.NodeId+"]: manually cancelled")
+			allocation.RoutingNodes.UnassignedShards = append(allocation.RoutingNodes.UnassignedShards, &unassigned)
+		}
+		return explanation, nil
+	}
+	return RerouteExplanation{}, fmt.Errorf("[%s] can't cancel %s, failed to find it on node [%s]", command.Name, commandShardId(command), command.Node)
+}
+
+// allocateReplica allocates an unassigned replica to a node, it recovers from the active primary.
+func (s *AllocationService) allocateReplica(command AllocationCommand, allocation *RoutingAllocation) (RerouteExplanation, error) {
+	node, err := routingNode(allocation, command.Name, command.Node)
+	if err != nil {
+		return RerouteExplanation{}, err
+	}
+	var replica *state.ShardRouting
+	for _, shard := range allocation.RoutingNodes.UnassignedShards {
+		if shard.CurrentNodeId != "" || !matchesCommand(*shard, command) {
+			continue
+		}
+		if shard.Primary {
+			return RerouteExplanation{}, fmt.Errorf("[%s] trying to allocate a replica shard %s, while corresponding primary shard is still unassigned", command.Name, commandShardId(command))
+		}
+		if replica == nil {
+			replica = shard
+		}
+	}
+	if replica == nil {
+		return RerouteExplanation{}, fmt.Errorf("[%s] all copies of %s are already assigned. Use the move allocation command instead", command.Name, commandShardId(command))
+	}
+
+	decision, results := s.deciders.CanAllocate(*replica, node, allocation)
+	if decision == DecisionNo {
+		return RerouteExplanation{}, fmt.Errorf("[%s] allocation of %s on node [%s] is not allowed, reason: %s", command.Name, commandShardId(command), command.Node, deciderExplanation(results))
+	}
+	replica.CurrentNodeId = node.NodeId
+	replica.State = state.ShardInitializing
+	replica.AllocationId = common.RandomBase64()
+	node.Add(*replica)
+	return RerouteExplanation{Command: command, Decision: decision, Results: results}, nil
+}
+
+// allocateEmptyPrimary allocates an unassigned primary to a node with an empty store, the data of the shard is lost.
+func (s *AllocationService) allocateEmptyPrimary(command AllocationCommand, allocation *RoutingAllocation) (RerouteExplanation, error) {
+	if !command.AcceptDataLoss {
+		return RerouteExplanation{}, fmt.Errorf("[%s] allocating an empty primary for %s can result in data loss. Please confirm by setting the accept_data_loss parameter to true", command.Name, commandShardId(command))
+	}
+	node, err := routingNode(allocation, command.Name, command.Node)
+	if err != nil {
+		return RerouteExplanation{}, err
+	}
+	for _, shard := range allocation.RoutingNodes.UnassignedShards {
+		if shard.CurrentNodeId != "" || !shard.Primary || !matchesCommand(*shard, command) {
+			continue
+		}
+		// the deciders are bypassed, only a second copy on the node is refused
+		result := sameShardDecider{}.CanAllocate(*shard, node, allocation)
+		if result.Decision == DecisionNo {
+			return RerouteExplanation{}, fmt.Errorf("[%s] allocation of %s on node [%s] is not allowed, reason: [%s]: %s", command.Name, commandShardId(command), command.Node, result.Decider, result.Explanation)
+		}
+		shard.CurrentNodeId = node.NodeId
+		shard.State = state.ShardInitializing
+		shard.AllocationId = common.RandomBase64()
+		shard.UnassignedInfo = state.UnassignedInfo{
+			Reason:  state.UnassignedForcedEmptyPrimary,
+			At:      time.Now(),
+			Details: "allocated an empty primary on node [" + node.NodeId + "]",
+		}
+		node.Add(*shard)
+		return RerouteExplanation{Command: command, Decision: DecisionYes, Results: []DeciderResult{result}}, nil
+	}
+	return RerouteExplanation{}, fmt.Errorf("[%s] primary %s is already assigned", command.Name, commandShardId(command))
+}
@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func rerouteTestClusterState() state.ClusterState {
+	index := state.Index{
+		Name: "test",
+		Uuid: "testUuid",
+	}
+	shardId := state.ShardId{Index: index, ShardId: 0}
+	node1 := state.Node{Name: "node1", Id: "testNodeId1"}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2"}
+	node3 := state.Node{Name: "node3", Id: "testNodeId3"}
+	nodes := map[string]state.Node{node1.Id: node1, node2.Id: node2, node3.Id: node3}
+	return state.ClusterState{
+		Nodes: &state.Nodes{
+			Nodes:       nodes,
+			DataNodes:   nodes,
+			MasterNodes: nodes,
+		},
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {Index: index, NumberOfShards: 1, NumberOfReplicas: 1},
+			},
+			// keep the replica unassigned unless a command allocates it
+			PersistentSettings: map[string]string{NodeConcurrentRecoveriesSetting: "0"},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": {
+					Index: index,
+					Shards: map[int]state.IndexShardRoutingTable{
+						0: {
+							ShardId: shardId,
+							Primary: state.ShardRouting{ShardId: shardId, CurrentNodeId: node1.Id, Primary: true, State: state.ShardStarted, AllocationId: "a"},
+							Replicas: []state.ShardRouting{
+								{ShardId: shardId, State: state.ShardUnassigned, UnassignedInfo: state.UnassignedInfo{Reason: state.UnassignedIndexCreated}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestParseAllocationCommands(t *testing.T) {
+	// Action
+	commands, err := ParseAllocationCommands([]byte(`{"commands":[{"move":{"index":"test","shard":0,"from_node":"node1","to_node":"node2"}},{"allocate_empty_primary":{"index":"test","shard":1,"node":"node3","accept_data_loss":true}}]}`))
+	_, unknownErr := ParseAllocationCommands([]byte(`{"commands":[{"unknown":{"index":"test","shard":0}}]}`))
+	_, missingErr := ParseAllocationCommands([]byte(`{"commands":[{"move":{"index":"test","shard":0,"from_node":"node1"}}]}`))
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, []AllocationCommand{
+		{Name: MoveAllocationCommand, Index: "test", Shard: 0, FromNode: "node1", ToNode: "node2"},
+		{Name: AllocateEmptyPrimaryCommand, Index: "test", Shard: 1, Node: "node3", AcceptDataLoss: true},
+	}, commands)
+	assert.NotNil(t, unknownErr)
+	assert.NotNil(t, missingErr)
+}
+
+func TestAllocationService_RerouteWithCommands(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	clusterState := rerouteTestClusterState()
+
+	// Action
+	rerouted, explanations, err := allocationService.RerouteWithCommands(clusterState, []AllocationCommand{
+		{Name: MoveAllocationCommand, Index: "test", Shard: 0, FromNode: "node1", ToNode: "testNodeId3"},
+		{Name: AllocateReplicaCommand, Index: "test", Shard: 0, Node: "node2"},
+	}, true, false)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(explanations))
+	// a throttled command is still applied, only a NO decision rejects it
+	assert.Equal(t, DecisionThrottle, explanations[0].Decision)
+	shardRoutingTable := rerouted.RoutingTable.IndicesRouting["test"].Shards[0]
+	assert.Equal(t, state.ShardRelocating, shardRoutingTable.Primary.State)
+	assert.Equal(t, "testNodeId1", shardRoutingTable.Primary.CurrentNodeId)
+	assert.Equal(t, "testNodeId3", shardRoutingTable.Primary.RelocatingNodeId)
+	assert.Equal(t, state.ShardInitializing, shardRoutingTable.Replicas[0].State)
+	assert.Equal(t, "testNodeId2", shardRoutingTable.Replicas[0].CurrentNodeId)
+
+	// Action
+	cancelled, _, err := allocationService.RerouteWithCommands(rerouted, []AllocationCommand{
+		{Name: CancelAllocationCommand, Index: "test", Shard: 0, Node: "node3"},
+		{Name: CancelAllocationCommand, Index: "test", Shard: 0, Node: "node2"},
+	}, false, false)
+
+	// Assert
+	assert.Nil(t, err)
+	shardRoutingTable = cancelled.RoutingTable.IndicesRouting["test"].Shards[0]
+	assert.Equal(t, state.ShardStarted, shardRoutingTable.Primary.State)
+	assert.Equal(t, "", shardRoutingTable.Primary.RelocatingNodeId)
+	assert.Equal(t, state.ShardUnassigned, shardRoutingTable.Replicas[0].State)
+	assert.Equal(t, state.UnassignedRerouteCancelled, shardRoutingTable.Replicas[0].UnassignedInfo.Reason)
+}
+
+func TestAllocationService_RerouteWithCommandsRejected(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	clusterState := rerouteTestClusterState()
+	commands := []AllocationCommand{
+		{Name: CancelAllocationCommand, Index: "test", Shard: 0, Node: "node1"},
+		{Name: MoveAllocationCommand, Index: "test", Shard: 0, FromNode: "node2", ToNode: "node3"},
+		{Name: AllocateEmptyPrimaryCommand, Index: "test", Shard: 0, Node: "node2"},
+	}
+
+	// Action
+	unchanged, _, err := allocationService.RerouteWithCommands(clusterState, commands, false, false)
+	explained, explanations, explainErr := allocationService.RerouteWithCommands(clusterState, commands, true, false)
+
+	// Assert
+	assert.NotNil(t, err)
+	assert.Equal(t, clusterState, unchanged)
+	assert.Nil(t, explainErr)
+	assert.Equal(t, 3, len(explanations))
+	for _, explanation := range explanations {
+		assert.Equal(t, DecisionNo, explanation.Decision)
+	}
+	assert.Equal(t, state.ShardStarted, explained.RoutingTable.IndicesRouting["test"].Shards[0].Primary.State)
+}
+
+func TestAllocationService_ExplainShardAllocation(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	clusterState := rerouteTestClusterState()
+
+	// Action
+	replica, err := FindShardToExplain(clusterState, "", 0, false, "")
+	replicaExplanation := allocationService.ExplainShardAllocation(clusterState, replica)
+	primary, primaryErr := FindShardToExplain(clusterState, "test", 0, true, "")
+	primaryExplanation := allocationService.ExplainShardAllocation(clusterState, primary)
+	_, missingErr := FindShardToExplain(clusterState, "missing", 0, true, "")
+
+	// Assert
+	assert.Nil(t, err)
+	assert.False(t, replica.Primary)
+	assert.Nil(t, replicaExplanation.CurrentNode)
+	assert.Equal(t, DecisionThrottle, replicaExplanation.CanAllocate)
+	assert.Equal(t, 3, len(replicaExplanation.NodeDecisions))
+	for _, nodeDecision := range replicaExplanation.NodeDecisions {
+		if nodeDecision.Node.Id == "testNodeId1" {
+			assert.Equal(t, DecisionNo, nodeDecision.Decision)
+		} else {
+			assert.Equal(t, DecisionThrottle, nodeDecision.Decision)
+		}
+	}
+
+	assert.Nil(t, primaryErr)
+	assert.Equal(t, "testNodeId1", primaryExplanation.CurrentNode.Id)
+	assert.Equal(t, 2, len(primaryExplanation.NodeDecisions))
+	assert.Equal(t, DecisionYes, primaryExplanation.CanRebalanceCluster)
+	assert.NotNil(t, missingErr)
+}
@@ -0,0 +1,385 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/state"
+	"sort"
+	"strings"
+)
+
+type Decision int
+
+const (
+	DecisionYes Decision = iota
+	DecisionThrottle
+	DecisionNo
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionYes:
+		return "YES"
+	case DecisionThrottle:
+		return "THROTTLE"
+	default:
+		return "NO"
+	}
+}
+
+// DeciderResult is the decision of a single decider with the reason for it.
+type DeciderResult struct {
+	Decider     string
+	Decision    Decision
+	Explanation string
+}
+
+// RoutingAllocation is the allocation in progress the deciders look at.
+type RoutingAllocation struct {
+	RoutingNodes *state.RoutingNodes
+	Metadata     state.Metadata
+	Settings     Settings
+	ClusterInfo  ClusterInfo
+}
+
+func (s *AllocationService) newRoutingAllocation(clusterState state.ClusterState) *RoutingAllocation {
+	allocation := &RoutingAllocation{
+		RoutingNodes: state.NewRoutingNodes(clusterState),
+		Metadata:     clusterState.Metadata,
+		Settings:     Settings(clusterState.Metadata.Settings()),
+	}
+	if s.ClusterInfoService != nil {
+		allocation.ClusterInfo = s.ClusterInfoService.ClusterInfo()
+	}
+	return allocation
+}
+
+// AllocationDecider tells whether a shard copy may be allocated to a node, and whether an allocated copy may
+// remain on its node.
+type AllocationDecider interface {
+	CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult
+	CanRemain(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult
+}
+
+// AllocationDeciders is the combination of deciders, the most restrictive decision wins.
+type AllocationDeciders []AllocationDecider
+
+func (d AllocationDeciders) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) (Decision, []DeciderResult) {
+	decision := DecisionYes
+	var results []DeciderResult
+	for _, decider := range d {
+		result := decider.CanAllocate(shard, node, allocation)
+		results = append(results, result)
+		if result.Decision > decision {
+			decision = result.Decision
+		}
+	}
+	return decision, results
+}
+
+func (d AllocationDeciders) CanRemain(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) (Decision, []DeciderResult) {
+	decision := DecisionYes
+	var results []DeciderResult
+	for _, decider := range d {
+		result := decider.CanRemain(shard, node, allocation)
+		// a decider only deciding on allocation has nothing to report
+		if result.Decider == "" {
+			continue
+		}
+		results = append(results, result)
+		if result.Decision > decision {
+			decision = result.Decision
+		}
+	}
+	return decision, results
+}
+
+// alwaysRemain is embedded by the deciders that never move an allocated copy.
+type alwaysRemain struct{}
+
+func (alwaysRemain) CanRemain(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	return DeciderResult{Decision: DecisionYes}
+}
+
+// sameShardDecider keeps two copies of a shard off the same node.
+// With cluster.routing.allocation.same_shard.host, it keeps them off the nodes of the same host as well.
+type sameShardDecider struct {
+	alwaysRemain
+}
+
+func (sameShardDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "same_shard"}
+	if _, existing := node.Shards[shard.ShardId]; existing {
+		result.Decision = DecisionNo
+		result.Explanation = fmt.Sprintf("a copy of this shard is already allocated to this node [%s]", node.NodeId)
+		return result
+	}
+	if allocation.Settings.GetBool(SameShardHostSetting, false) {
+		host := nodeHost(node.Node())
+		for _, other := range allocation.RoutingNodes.NodesToShards {
+			if _, existing := other.Shards[shard.ShardId]; !existing || other.NodeId == node.NodeId || nodeHost(other.Node()) != host {
+				continue
+			}
+			result.Decision = DecisionNo
+			result.Explanation = fmt.Sprintf("a copy of this shard is already allocated to host address [%s], on node [%s], and [%s] is [true] which forbids more than one node on this host from holding a copy of this shard", host, other.NodeId, SameShardHostSetting)
+			return result
+		}
+	}
+	result.Explanation = "this node does not hold a copy of this shard"
+	return result
+}
+
+// replicaAfterPrimaryActiveDecider waits for the primary a replica recovers from.
+type replicaAfterPrimaryActiveDecider struct {
+	alwaysRemain
+}
+
+func (replicaAfterPrimaryActiveDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "replica_after_primary_active"}
+	if shard.Primary {
+		result.Explanation = "shard is primary and can be allocated"
+		return result
+	}
+	if !primaryActive(allocation.RoutingNodes, shard.ShardId) {
+		result.Decision = DecisionNo
+		result.Explanation = "primary shard for this replica is not yet active"
+		return result
+	}
+	result.Explanation = "primary shard for this replica is already active"
+	return result
+}
+
+// maxRetryDecider stops allocating a copy that failed too many times in a row.
+type maxRetryDecider struct {
+	alwaysRemain
+}
+
+func (maxRetryDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "max_retry"}
+	failedAllocations := shard.UnassignedInfo.FailedAllocations
+	if failedAllocations >= maxAllocationRetries {
+		result.Decision = DecisionNo
+		result.Explanation = fmt.Sprintf("shard has exceeded the maximum number of retries [%d] on failed allocation attempts - manually call [/_cluster/reroute?retry_failed=true] to retry, [%s]", maxAllocationRetries, shard.UnassignedInfo.Details)
+		return result
+	}
+	result.Explanation = fmt.Sprintf("shard has failed allocating [%d] times but [%d] retries are allowed", failedAllocations, maxAllocationRetries)
+	return result
+}
+
+// throttlingDecider limits the peer recoveries targeting a node. A primary allocated from its store is not throttled.
+type throttlingDecider struct {
+	alwaysRemain
+}
+
+func (throttlingDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "throttling"}
+	if shard.Primary && shard.State == state.ShardUnassigned {
+		result.Explanation = "primary shard is recovered from the store of the node"
+		return result
+	}
+	limit := allocation.Settings.GetInt(NodeConcurrentRecoveriesSetting, defaultNodeConcurrentRecoveries)
+	if recoveries := node.Initializing(); recoveries >= limit {
+		result.Decision = DecisionThrottle
+		result.Explanation = fmt.Sprintf("reached the limit of incoming shard recoveries [%d], cluster setting [%s=%d]", recoveries, NodeConcurrentRecoveriesSetting, limit)
+		return result
+	}
+	result.Explanation = "below shard recovery limit of incoming recoveries"
+	return result
+}
+
+// nodeHost is the host part of the address of a node.
+func nodeHost(node state.Node) string {
+	if i := strings.LastIndex(node.HostAddress, ":"); i >= 0 {
+		return node.HostAddress[:i]
+	}
+	return node.HostAddress
+}
+
+// nodeAttribute returns the value of a node for a filter attribute: _name, _id, _host, _ip or a node.attr.* attribute.
+func nodeAttribute(node state.Node, attribute string) (string, bool) {
+	switch attribute {
+	case "_name":
+		return node.Name, true
+	case "_id":
+		return node.Id, true
+	case "_host", "_ip":
+		return nodeHost(node), true
+	}
+	value, existing := node.Attributes[attribute]
+	return value, existing
+}
+
+// matchAttributeValues reports whether value matches one of the comma separated values of a filter, a value
+// ending with "*" matches as a prefix.
+func matchAttributeValues(values string, value string) bool {
+	for _, pattern := range strings.Split(values, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if strings.HasSuffix(pattern, "*") && strings.HasPrefix(value, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+		if pattern == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilter reports whether the node matches all the attributes of the filter, or any of them.
+func matchFilter(filter map[string]string, node state.Node, all bool) bool {
+	for attribute, values := range filter {
+		value, existing := nodeAttribute(node, attribute)
+		matched := existing && matchAttributeValues(values, value)
+		if matched && !all {
+			return true
+		}
+		if !matched && all {
+			return false
+		}
+	}
+	return all
+}
+
+func filterString(filter map[string]string) string {
+	var attributes []string
+	for attribute, values := range filter {
+		attributes = append(attributes, attribute+":\""+values+"\"")
+	}
+	sort.Strings(attributes)
+	return strings.Join(attributes, ", ")
+}
+
+// filterDecider applies the index.routing.allocation.{require,include,exclude}.* filters of the index and
+// the cluster.routing.allocation.{require,include,exclude}.* filters. A copy on a node no longer matching
+// them has to move.
+type filterDecider struct{}
+
+func (d filterDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	return d.decide(shard, node, allocation)
+}
+
+func (d filterDecider) CanRemain(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	return d.decide(shard, node, allocation)
+}
+
+func (filterDecider) decide(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "filter"}
+	indexMetadata := allocation.Metadata.Indices[shard.ShardId.Index.Name]
+	filters := []struct {
+		setting string
+		filter  map[string]string
+		kind    string
+	}{
+		{"index.routing.allocation.require", indexMetadata.RoutingAllocationRequire, "require"},
+		{"index.routing.allocation.include", indexMetadata.RoutingAllocationInclude, "include"},
+		{"index.routing.allocation.exclude", indexMetadata.RoutingAllocationExclude, "exclude"},
+		{strings.TrimSuffix(ClusterRoutingRequireSettingPrefix, "."), allocation.Settings.ByPrefix(ClusterRoutingRequireSettingPrefix), "require"},
+		{strings.TrimSuffix(ClusterRoutingIncludeSettingPrefix, "."), allocation.Settings.ByPrefix(ClusterRoutingIncludeSettingPrefix), "include"},
+		{strings.TrimSuffix(ClusterRoutingExcludeSettingPrefix, "."), allocation.Settings.ByPrefix(ClusterRoutingExcludeSettingPrefix), "exclude"},
+	}
+	for _, f := range filters {
+		if len(f.filter) == 0 {
+			continue
+		}
+		var rejected bool
+		switch f.kind {
+		case "require":
+			rejected = !matchFilter(f.filter, node.Node(), true)
+		case "include":
+			rejected = !matchFilter(f.filter, node.Node(), false)
+		case "exclude":
+			rejected = matchFilter(f.filter, node.Node(), false)
+		}
+		if rejected {
+			result.Decision = DecisionNo
+			if f.kind == "exclude" {
+				result.Explanation = fmt.Sprintf("node matches %s setting [%s] filters [%s]", settingScope(f.setting), f.setting, filterString(f.filter))
+			} else {
+				result.Explanation = fmt.Sprintf("node does not match %s setting [%s] filters [%s]", settingScope(f.setting), f.setting, filterString(f.filter))
+			}
+			return result
+		}
+	}
+	result.Explanation = "node passes include/exclude/require filters"
+	return result
+}
+
+func settingScope(setting string) string {
+	if strings.HasPrefix(setting, "index.") {
+		return "index"
+	}
+	return "cluster"
+}
+
+// awarenessDecider spreads the copies of a shard over the values of the awareness attributes, e.g. racks,
+// so that no value holds more than its share of the copies.
+type awarenessDecider struct{}
+
+func (d awarenessDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	return d.decide(shard, node, allocation, true)
+}
+
+func (d awarenessDecider) CanRemain(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	return d.decide(shard, node, allocation, false)
+}
+
+func (awarenessDecider) decide(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation, moveToNode bool) DeciderResult {
+	result := DeciderResult{Decider: "awareness"}
+	awarenessAttributes := allocation.Settings.Get(AwarenessAttributesSetting, "")
+	if awarenessAttributes == "" {
+		result.Explanation = fmt.Sprintf("allocation awareness is not enabled, set cluster setting [%s] to enable it", AwarenessAttributesSetting)
+		return result
+	}
+
+	shardCount := allocation.Metadata.Indices[shard.ShardId.Index.Name].NumberOfReplicas + 1
+	for _, attribute := range strings.Split(awarenessAttributes, ",") {
+		attribute = strings.TrimSpace(attribute)
+		value, existing := node.Node().Attributes[attribute]
+		if !existing {
+			result.Decision = DecisionNo
+			result.Explanation = fmt.Sprintf("node does not contain the awareness attribute [%s]; required attributes cluster setting [%s=%s]", attribute, AwarenessAttributesSetting, awarenessAttributes)
+			return result
+		}
+
+		values := map[string]struct{}{}
+		for _, forced := range strings.Split(allocation.Settings.Get(AwarenessForceSettingPrefix+attribute+".values", ""), ",") {
+			if forced = strings.TrimSpace(forced); forced != "" {
+				values[forced] = struct{}{}
+			}
+		}
+		copies := 0
+		for _, other := range allocation.RoutingNodes.NodesToShards {
+			otherValue, existing := other.Node().Attributes[attribute]
+			if !existing {
+				continue
+			}
+			values[otherValue] = struct{}{}
+			shardCopy, existing := other.Shards[shard.ShardId]
+			// a relocating copy counts on its target only
+			if !existing || otherValue != value || shardCopy.State == state.ShardRelocating {
+				continue
+			}
+			copies++
+		}
+		if moveToNode {
+			copies++
+			// a copy moved from a node of the same value does not add to it
+			if source, existing := allocation.RoutingNodes.NodesToShards[shard.CurrentNodeId]; existing && shard.State != state.ShardUnassigned && source.Node().Attributes[attribute] == value {
+				copies--
+			}
+		}
+
+		averagePerValue := shardCount / len(values)
+		maximum := averagePerValue
+		if averagePerValue == 0 {
+			maximum = 1
+		} else if shardCount%len(values) > 0 {
+			maximum++
+		}
+		if copies > maximum {
+			result.Decision = DecisionNo
+			result.Explanation = fmt.Sprintf("there are [%d] copies of this shard and [%d] values for attribute [%s] so there may be at most [%d] copies of this shard allocated to nodes with each value, but (including this copy) there would be [%d] copies allocated to nodes with [node.attr.%s: %s]", shardCount, len(values), attribute, maximum, copies, attribute, value)
+			return result
+		}
+	}
+	result.Explanation = "node meets all awareness attribute requirements"
+	return result
+}
@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// decidersTestClusterState is the state of the reroute tests with the nodes and the index settings of a decider
+// test, the primary started on the first node.
+func decidersTestClusterState(indexMetadata state.IndexMetadata, nodes ...state.Node) state.ClusterState {
+	clusterState := rerouteTestClusterState()
+	nodesMap := map[string]state.Node{}
+	for _, node := range nodes {
+		nodesMap[node.Id] = node
+	}
+	clusterState.Nodes = &state.Nodes{
+		Nodes:       nodesMap,
+		DataNodes:   nodesMap,
+		MasterNodes: nodesMap,
+	}
+	indexMetadata.Index = clusterState.Metadata.Indices["test"].Index
+	indexMetadata.NumberOfShards = 1
+	indexMetadata.NumberOfReplicas = 1
+	clusterState.Metadata.Indices["test"] = indexMetadata
+	clusterState.Metadata.PersistentSettings = map[string]string{}
+	shardRoutingTable := clusterState.RoutingTable.IndicesRouting["test"].Shards[0]
+	shardRoutingTable.Primary.CurrentNodeId = nodes[0].Id
+	clusterState.RoutingTable.IndicesRouting["test"].Shards[0] = shardRoutingTable
+	return clusterState
+}
+
+func TestAllocationService_filterDecider(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	node1 := state.Node{Name: "node1", Id: "testNodeId1", HostAddress: "10.0.0.1:8180"}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2", HostAddress: "10.0.0.2:8180", Attributes: map[string]string{"box": "warm"}}
+	node3 := state.Node{Name: "node3", Id: "testNodeId3", HostAddress: "10.0.0.3:8180", Attributes: map[string]string{"box": "hot"}}
+	excluded := decidersTestClusterState(state.IndexMetadata{RoutingAllocationExclude: map[string]string{"_name": "node1"}}, node1, node2, node3)
+	required := decidersTestClusterState(state.IndexMetadata{RoutingAllocationRequire: map[string]string{"box": "*"}}, node1, node2, node3)
+	clusterIncluded := decidersTestClusterState(state.IndexMetadata{}, node1, node2, node3)
+	clusterIncluded.Metadata.PersistentSettings[ClusterRoutingIncludeSettingPrefix+"_ip"] = "10.0.0.2,10.0.0.3"
+	hotOnly := decidersTestClusterState(state.IndexMetadata{RoutingAllocationRequire: map[string]string{"box": "h*"}}, node1, node2, node3)
+	hotOnlyAllocation := allocationService.newRoutingAllocation(hotOnly)
+
+	// Action
+	excluded = allocationService.reroute(excluded)
+	required = allocationService.reroute(required)
+	clusterIncluded = allocationService.reroute(clusterIncluded)
+	warmDecision, _ := allocationService.deciders.CanAllocate(hotOnly.RoutingTable.IndicesRouting["test"].Shards[0].Replicas[0], hotOnlyAllocation.RoutingNodes.NodesToShards[node2.Id], hotOnlyAllocation)
+	hotDecision, _ := allocationService.deciders.CanAllocate(hotOnly.RoutingTable.IndicesRouting["test"].Shards[0].Replicas[0], hotOnlyAllocation.RoutingNodes.NodesToShards[node3.Id], hotOnlyAllocation)
+
+	// Assert
+	for _, clusterState := range []state.ClusterState{excluded, required, clusterIncluded} {
+		shardRoutingTable := clusterState.RoutingTable.IndicesRouting["test"].Shards[0]
+		// the primary moves off node1 to the node not taking the replica
+		assert.Equal(t, state.ShardRelocating, shardRoutingTable.Primary.State)
+		assert.NotEqual(t, node1.Id, shardRoutingTable.Primary.RelocatingNodeId)
+		assert.Equal(t, state.ShardInitializing, shardRoutingTable.Replicas[0].State)
+		assert.NotEqual(t, node1.Id, shardRoutingTable.Replicas[0].CurrentNodeId)
+		assert.NotEqual(t, shardRoutingTable.Primary.RelocatingNodeId, shardRoutingTable.Replicas[0].CurrentNodeId)
+	}
+	assert.Equal(t, DecisionNo, warmDecision)
+	assert.Equal(t, DecisionYes, hotDecision)
+}
+
+func TestAllocationService_awarenessDecider(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	node1 := state.Node{Name: "node1", Id: "testNodeId1", Attributes: map[string]string{"rack": "r1"}}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2", Attributes: map[string]string{"rack": "r1"}}
+	node3 := state.Node{Name: "node3", Id: "testNodeId3", Attributes: map[string]string{"rack": "r2"}}
+	node4 := state.Node{Name: "node4", Id: "testNodeId4"}
+	clusterState := decidersTestClusterState(state.IndexMetadata{}, node1, node2, node4, node3)
+	clusterState.Metadata.PersistentSettings[AwarenessAttributesSetting] = "rack"
+	clusterState.Metadata.PersistentSettings[BalanceThresholdSetting] = "100"
+	forced := decidersTestClusterState(state.IndexMetadata{}, node1, node2)
+	forced.Metadata.PersistentSettings[AwarenessAttributesSetting] = "rack"
+	forced.Metadata.PersistentSettings[AwarenessForceSettingPrefix+"rack.values"] = "r1,r2"
+
+	// Action
+	clusterState = allocationService.reroute(clusterState)
+	forced = allocationService.reroute(forced)
+
+	// Assert
+	replica := clusterState.RoutingTable.IndicesRouting["test"].Shards[0].Replicas[0]
+	assert.Equal(t, state.ShardInitializing, replica.State)
+	assert.Equal(t, node3.Id, replica.CurrentNodeId)
+	replica = forced.RoutingTable.IndicesRouting["test"].Shards[0].Replicas[0]
+	assert.Equal(t, state.ShardUnassigned, replica.State)
+}
+
+func TestAllocationService_sameShardHost(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	node1 := state.Node{Name: "node1", Id: "testNodeId1", HostAddress: "10.0.0.1:8180"}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2", HostAddress: "10.0.0.1:8181"}
+	clusterState := decidersTestClusterState(state.IndexMetadata{}, node1, node2)
+	sameHost := decidersTestClusterState(state.IndexMetadata{}, node1, node2)
+	sameHost.Metadata.PersistentSettings[SameShardHostSetting] = "true"
+
+	// Action
+	clusterState = allocationService.reroute(clusterState)
+	sameHost = allocationService.reroute(sameHost)
+
+	// Assert
+	assert.Equal(t, node2.Id, clusterState.RoutingTable.IndicesRouting["test"].Shards[0].Replicas[0].CurrentNodeId)
+	assert.Equal(t, state.ShardUnassigned, sameHost.RoutingTable.IndicesRouting["test"].Shards[0].Replicas[0].State)
+}
@@ -0,0 +1,140 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/state"
+	"sort"
+)
+
+// NodeAllocationDecision is whether a shard copy can be allocated to a node.
+type NodeAllocationDecision struct {
+	Node          state.Node
+	Decision      Decision
+	WeightRanking int
+	Results       []DeciderResult
+}
+
+// ShardAllocationExplanation tells why a shard copy is or is not allocated where it is.
+type ShardAllocationExplanation struct {
+	Shard state.ShardRouting
+	// CurrentNode is the node of an assigned copy, nil for an unassigned one
+	CurrentNode          *state.Node
+	CurrentWeightRanking int
+	// CanRemain tells whether an assigned copy may stay on its node
+	CanRemain        Decision
+	CanRemainResults []DeciderResult
+	// CanAllocate is the best decision over the nodes for an unassigned copy
+	CanAllocate             Decision
+	CanRebalanceCluster     Decision
+	CanRebalanceToOtherNode Decision
+	NodeDecisions           []NodeAllocationDecision
+}
+
+// FindShardToExplain returns the copy of a shard to explain. Without index, it is the first unassigned copy found.
+// A replica is looked up on currentNode, given by id or by name, when it is set.
+func FindShardToExplain(clusterState state.ClusterState, index string, shard int, primary bool, currentNode string) (state.ShardRouting, error) {
+	if index == "" {
+		var indexNames []string
+		for indexName := range clusterState.RoutingTable.IndicesRouting {
+			indexNames = append(indexNames, indexName)
+		}
+		sort.Strings(indexNames)
+		for _, indexName := range indexNames {
+			shards := clusterState.RoutingTable.IndicesRouting[indexName].Shards
+			for shardId := 0; shardId < len(shards); shardId++ {
+				for _, shardCopy := range shards[shardId].Copies() {
+					if shardCopy.State == state.ShardUnassigned {
+						return shardCopy, nil
+					}
+				}
+			}
+		}
+		return state.ShardRouting{}, fmt.Errorf("unable to find any unassigned shards to explain")
+	}
+
+	indexRoutingTable, existing := clusterState.RoutingTable.IndicesRouting[index]
+	if !existing {
+		return state.ShardRouting{}, fmt.Errorf("no such index [%s]", index)
+	}
+	shardRoutingTable, existing := indexRoutingTable.Shards[shard]
+	if !existing {
+		return state.ShardRouting{}, fmt.Errorf("shard [%s][%d] does not exist", index, shard)
+	}
+	if primary {
+		return shardRoutingTable.Primary, nil
+	}
+	if len(shardRoutingTable.Replicas) == 0 {
+		return state.ShardRouting{}, fmt.Errorf("unable to find a replica shard of [%s][%d]", index, shard)
+	}
+	if currentNode == "" {
+		return shardRoutingTable.Replicas[0], nil
+	}
+	for _, replica := range shardRoutingTable.Replicas {
+		if node, existing := clusterState.Nodes.Nodes[replica.CurrentNodeId]; existing && (node.Id == currentNode || node.Name == currentNode) {
+			return replica, nil
+		}
+	}
+	return state.ShardRouting{}, fmt.Errorf("unable to find a replica shard of [%s][%d] assigned to node [%s]", index, shard, currentNode)
+}
+
+// ExplainShardAllocation runs the deciders for the copy against every node of the cluster.
+func (s *AllocationService) ExplainShardAllocation(clusterState state.ClusterState, shard state.ShardRouting) ShardAllocationExplanation {
+	allocation := s.newRoutingAllocation(clusterState)
+	indexName := shard.ShardId.Index.Name
+
+	var nodes []*state.RoutingNode
+	for _, node := range allocation.RoutingNodes.NodesToShards {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		wi, wj := weight(*nodes[i], indexName), weight(*nodes[j], indexName)
+		if wi != wj {
+			return wi < wj
+		}
+		return nodes[i].NodeId < nodes[j].NodeId
+	})
+
+	explanation := ShardAllocationExplanation{
+		Shard:                   shard,
+		CanAllocate:             DecisionNo,
+		CanRebalanceCluster:     DecisionNo,
+		CanRebalanceToOtherNode: DecisionNo,
+	}
+	var currentNode *state.RoutingNode
+	for i, node := range nodes {
+		if node.NodeId == shard.CurrentNodeId {
+			currentNode = node
+			explanation.CurrentWeightRanking = i + 1
+			continue
+		}
+		decision, results := s.deciders.CanAllocate(shard, node, allocation)
+		explanation.NodeDecisions = append(explanation.NodeDecisions, NodeAllocationDecision{
+			Node:          node.Node(),
+			Decision:      decision,
+			WeightRanking: i + 1,
+			Results:       results,
+		})
+		if decision < explanation.CanAllocate {
+			explanation.CanAllocate = decision
+		}
+	}
+	if currentNode == nil {
+		return explanation
+	}
+
+	node := currentNode.Node()
+	explanation.CurrentNode = &node
+	explanation.CanRemain, explanation.CanRemainResults = s.deciders.CanRemain(shard, currentNode, allocation)
+	enable := allocation.Settings.Get(RebalanceEnableSetting, RebalanceAll)
+	if rebalanceAllowed(shard, enable) {
+		explanation.CanRebalanceCluster = DecisionYes
+	}
+	threshold := allocation.Settings.GetFloat(BalanceThresholdSetting, defaultBalanceThreshold)
+	for _, nodeDecision := range explanation.NodeDecisions {
+		delta := weight(*currentNode, indexName) - weight(*allocation.RoutingNodes.NodesToShards[nodeDecision.Node.Id], indexName)
+		if nodeDecision.Decision == DecisionYes && delta > threshold && delta > 1 {
+			explanation.CanRebalanceToOtherNode = DecisionYes
+		}
+	}
+	return explanation
+}
@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const defaultSlowTaskLoggingThreshold = 30 * time.Second
+
+type applyTask struct {
+	source       string
+	clusterState *state.ClusterState
+	onApplied    func()
+}
+
+// ApplierService applies the committed cluster states one at a time on its own goroutine, in the order they were
+// committed. The appliers run before the state is visible, e.g. to create the shards of the new indices, the
+// listeners run once it is.
+type ApplierService struct {
+	ClusterState          *state.ClusterState
+	ClusterStateAppliers  []func(event state.ClusterChangedEvent)
+	ClusterStateListeners []func(event state.ClusterChangedEvent)
+	// SlowTaskLoggingThreshold is how long applying a state takes before it is logged as slow
+	SlowTaskLoggingThreshold time.Duration
+
+	queue     []*applyTask
+	queueMux  sync.Mutex
+	queueCond *sync.Cond
+
+	// stateApplied is closed and replaced every time a cluster state is applied
+	stateApplied chan struct{}
+	stateMux     sync.Mutex
+}
+
+func newApplierService() *ApplierService {
+	s := &ApplierService{
+		SlowTaskLoggingThreshold: defaultSlowTaskLoggingThreshold,
+		stateApplied:             make(chan struct{}),
+	}
+	s.queueCond = sync.NewCond(&s.queueMux)
+	go s.run()
+	return s
+}
+
+func (s *ApplierService) AddApplier(applier func(event state.ClusterChangedEvent)) {
+	s.ClusterStateAppliers = append(s.ClusterStateAppliers, applier)
+}
+
+// AddListener registers a listener called with every state once it is applied.
+func (s *ApplierService) AddListener(listener func(event state.ClusterChangedEvent)) {
+	s.ClusterStateListeners = append(s.ClusterStateListeners, listener)
+}
+
+// OnNewState queues a committed state, onApplied is called once it is applied.
+func (s *ApplierService) OnNewState(source string, clusterState *state.ClusterState, onApplied func()) {
+	s.queueMux.Lock()
+	defer s.queueMux.Unlock()
+	s.queue = append(s.queue, &applyTask{
+		source:       source,
+		clusterState: clusterState,
+		onApplied:    onApplied,
+	})
+	s.queueCond.Signal()
+}
+
+func (s *ApplierService) run() {
+	for {
+		s.queueMux.Lock()
+		for len(s.queue) == 0 {
+			s.queueCond.Wait()
+		}
+		task := s.queue[0]
+		s.queue = s.queue[1:]
+		s.queueMux.Unlock()
+
+		s.apply(task)
+		if task.onApplied != nil {
+			task.onApplied()
+		}
+	}
+}
+
+func (s *ApplierService) apply(task *applyTask) {
+	previousState, _ := s.appliedState()
+	if isOlderState(task.clusterState, previousState) {
+		logrus.Warnf("ApplierService: skipping [%s], the state of version {%d} is older than the applied version {%d}", task.source, task.clusterState.Version, previousState.Version)
+		return
+	}
+
+	startTime := time.Now()
+	changedEvent := state.ClusterChangedEvent{
+		State: *task.clusterState,
+	}
+	if previousState != nil {
+		changedEvent.PrevState = *previousState
+	}
+	for _, applier := range s.ClusterStateAppliers {
+		s.runTimed(task.source, "applier", func() {
+			applier(changedEvent)
+		})
+	}
+
+	s.stateMux.Lock()
+	s.ClusterState = task.clusterState
+	close(s.stateApplied)
+	s.stateApplied = make(chan struct{})
+	s.stateMux.Unlock()
+
+	for _, listener := range s.ClusterStateListeners {
+		s.runTimed(task.source, "listener", func() {
+			listener(changedEvent)
+		})
+	}
+	if took := time.Since(startTime); took > s.SlowTaskLoggingThreshold {
+		logrus.Warnf("ApplierService: took [%v] to apply the state of version {%d} for [%s], above the warn threshold of [%v]", took, task.clusterState.Version, task.source, s.SlowTaskLoggingThreshold)
+	}
+}
+
+func (s *ApplierService) runTimed(source string, kind string, run func()) {
+	startTime := time.Now()
+	run()
+	if took := time.Since(startTime); took > s.SlowTaskLoggingThreshold {
+		logrus.Warnf("ApplierService: a cluster state %s took [%v] to apply [%s], above the warn threshold of [%v]", kind, took, source, s.SlowTaskLoggingThreshold)
+	}
+}
+
+// isOlderState tells whether a state was committed before the applied one, by an older master or earlier in the term.
+func isOlderState(clusterState *state.ClusterState, applied *state.ClusterState) bool {
+	if applied == nil {
+		return false
+	}
+	term, appliedTerm := clusterState.Metadata.Coordination.Term, applied.Metadata.Coordination.Term
+	return term < appliedTerm || (term == appliedTerm && clusterState.Version < applied.Version)
+}
+
+// WaitForState blocks until the applied cluster state is accepted or the timeout expires. It returns
+// the last applied state and whether it was accepted.
+func (s *ApplierService) WaitForState(accept func(clusterState *state.ClusterState) bool, timeout time.Duration) (*state.ClusterState, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		clusterState, stateApplied := s.appliedState()
+		if accept(clusterState) {
+			return clusterState, true
+		}
+		select {
+		case <-stateApplied:
+		case <-timer.C:
+			return clusterState, false
+		}
+	}
+}
+
+// WaitForVersion blocks until a state of the version, or a newer one, is applied or the timeout expires.
+func (s *ApplierService) WaitForVersion(version int64, timeout time.Duration) (*state.ClusterState, bool) {
+	return s.WaitForState(func(clusterState *state.ClusterState) bool {
+		return clusterState != nil && clusterState.Version >= version
+	}, timeout)
+}
+
+// appliedState returns the applied cluster state with a channel closed once the next one is applied.
+func (s *ApplierService) appliedState() (*state.ClusterState, <-chan struct{}) {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+	return s.ClusterState, s.stateApplied
+}
@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestApplierService_OnNewState(t *testing.T) {
+	// Arrange
+	applierService := newApplierService()
+	applierService.ClusterState = &state.ClusterState{Version: 1}
+	var applied []string
+	applierService.AddApplier(func(event state.ClusterChangedEvent) {
+		// the state is visible once the appliers ran
+		visible, _ := applierService.appliedState()
+		applied = append(applied, fmt.Sprintf("applier %d, visible %d", event.State.Version, visible.Version))
+	})
+	applierService.AddListener(func(event state.ClusterChangedEvent) {
+		visible, _ := applierService.appliedState()
+		applied = append(applied, fmt.Sprintf("listener %d, visible %d", event.State.Version, visible.Version))
+	})
+	release := make(chan struct{})
+	applierService.AddApplier(func(event state.ClusterChangedEvent) {
+		if event.State.Version == 2 {
+			<-release
+		}
+	})
+	notified := make(chan int64, 3)
+
+	// Action
+	for _, version := range []int64{2, 3, 1} {
+		version := version
+		applierService.OnNewState("test", &state.ClusterState{Version: version}, func() {
+			notified <- version
+		})
+	}
+	_, appliedBeforeRelease := applierService.WaitForVersion(2, 10*time.Millisecond)
+	close(release)
+	clusterState, appliedAfterRelease := applierService.WaitForVersion(3, time.Second)
+	var notifications []int64
+	for i := 0; i < 3; i++ {
+		notifications = append(notifications, <-notified)
+	}
+
+	// Assert
+	assert.False(t, appliedBeforeRelease)
+	assert.True(t, appliedAfterRelease)
+	assert.Equal(t, int64(3), clusterState.Version)
+	// the states are applied in order, the older one is skipped
+	assert.Equal(t, []int64{2, 3, 1}, notifications)
+	assert.Equal(t, []string{
+		"applier 2, visible 1", "listener 2, visible 2",
+		"applier 3, visible 2", "listener 3, visible 3",
+	}, applied)
+	assert.Equal(t, int64(3), applierService.ClusterState.Version)
+}
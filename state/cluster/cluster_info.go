@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/monitor"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	NodeDiskUsageAction = "cluster:monitor/nodes/fs"
+
+	defaultClusterInfoUpdateInterval = 30 * time.Second
+	clusterInfoTimeout               = 15 * time.Second
+)
+
+// DiskUsage is the disk usage of the data path of a node.
+type DiskUsage struct {
+	NodeId    string
+	NodeName  string
+	Total     uint64
+	Available uint64
+}
+
+// UsedPercent is the used part of the disk in percent.
+func (u DiskUsage) UsedPercent() float64 {
+	if u.Total == 0 {
+		return 0
+	}
+	return 100 * float64(u.Total-u.Available) / float64(u.Total)
+}
+
+func (u *DiskUsage) WriteTo(out *common.StreamOutput) {
+	out.WriteString(u.NodeId)
+	out.WriteString(u.NodeName)
+	out.WriteVInt(u.Total)
+	out.WriteVInt(u.Available)
+}
+
+func readDiskUsage(in *common.StreamInput) (*DiskUsage, error) {
+	usage := DiskUsage{
+		NodeId:    in.ReadString(),
+		NodeName:  in.ReadString(),
+		Total:     in.ReadVInt(),
+		Available: in.ReadVInt(),
+	}
+	return &usage, in.Err()
+}
+
+// ClusterInfo is what the master knows of the nodes besides the cluster state.
+type ClusterInfo struct {
+	// DiskUsages are keyed by node id, a node missing did not answer yet
+	DiskUsages map[string]DiskUsage
+}
+
+// ClusterInfoService collects the disk usage of every node on the elected master, every
+// cluster.info.update.interval.
+type ClusterInfoService struct {
+	clusterService   *Service
+	transportService *transport.Service
+
+	// listeners are called with every cluster info collected, e.g. the disk threshold monitor
+	listeners []func(info ClusterInfo)
+
+	info ClusterInfo
+	mux  sync.RWMutex
+}
+
+func NewClusterInfoService(clusterService *Service, transportService *transport.Service) *ClusterInfoService {
+	s := &ClusterInfoService{
+		clusterService:   clusterService,
+		transportService: transportService,
+		info: ClusterInfo{
+			DiskUsages: map[string]DiskUsage{},
+		},
+	}
+	monitorService := monitor.NewService()
+	transportService.RegisterRequestHandler(NodeDiskUsageAction, func(channel transport.ReplyChannel, req []byte) {
+		fsStats := monitorService.FsStats()
+		usage := DiskUsage{
+			NodeId:    transportService.LocalNode.Id,
+			NodeName:  transportService.LocalNode.Name,
+			Total:     fsStats.Total,
+			Available: fsStats.Available,
+		}
+		channel.SendMessage("", common.ToBytes(&usage, channel.GetVersion()))
+	})
+	return s
+}
+
+func (s *ClusterInfoService) AddListener(listener func(info ClusterInfo)) {
+	s.listeners = append(s.listeners, listener)
+}
+
+// ClusterInfo returns the last collected cluster info.
+func (s *ClusterInfoService) ClusterInfo() ClusterInfo {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.info
+}
+
+func (s *ClusterInfoService) Start() {
+	go s.run()
+}
+
+func (s *ClusterInfoService) run() {
+	for {
+		interval := defaultClusterInfoUpdateInterval
+		clusterState := s.clusterService.State()
+		if clusterState != nil {
+			interval = Settings(clusterState.Metadata.Settings()).GetDuration(ClusterInfoUpdateIntervalSetting, defaultClusterInfoUpdateInterval)
+		}
+		time.Sleep(interval)
+
+		clusterState = s.clusterService.State()
+		if clusterState == nil || clusterState.Nodes == nil || clusterState.Nodes.MasterNodeId != s.transportService.LocalNode.Id {
+			continue
+		}
+		info := s.refresh(clusterState.Nodes)
+		for _, listener := range s.listeners {
+			listener(info)
+		}
+	}
+}
+
+// refresh asks every node of the cluster for its disk usage. A node not answering in time keeps its last usage.
+func (s *ClusterInfoService) refresh(nodes *state.Nodes) ClusterInfo {
+	responses := make(chan DiskUsage, len(nodes.Nodes))
+	for _, node := range nodes.Nodes {
+		version := s.transportService.GetVersion(node)
+		go s.transportService.SendRequest(node, NodeDiskUsageAction, []byte{}, func(response []byte) {
+			usage, err := readDiskUsage(common.NewStreamInput(response, version))
+			if err != nil {
+				logrus.Warnf("ClusterInfoService: failed to read the disk usage of [%s]: %v", node.Name, err)
+				return
+			}
+			responses <- *usage
+		})
+	}
+
+	usages := map[string]DiskUsage{}
+	previous := s.ClusterInfo()
+	for nodeId := range nodes.Nodes {
+		if usage, existing := previous.DiskUsages[nodeId]; existing {
+			usages[nodeId] = usage
+		}
+	}
+	timer := time.NewTimer(clusterInfoTimeout)
+	defer timer.Stop()
+	for received := 0; received < len(nodes.Nodes); received++ {
+		select {
+		case usage := <-responses:
+			usages[usage.NodeId] = usage
+			continue
+		case <-timer.C:
+			logrus.Warnf("ClusterInfoService: %d nodes did not report their disk usage in time", len(nodes.Nodes)-received)
+		}
+		break
+	}
+
+	info := ClusterInfo{
+		DiskUsages: usages,
+	}
+	s.mux.Lock()
+	s.info = info
+	s.mux.Unlock()
+	return info
+}
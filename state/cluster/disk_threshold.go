@@ -0,0 +1,255 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDiskWatermarkLow        = "85%"
+	defaultDiskWatermarkHigh       = "90%"
+	defaultDiskWatermarkFloodStage = "95%"
+)
+
+// diskWatermark is a disk usage threshold, given either as a used percentage or ratio, e.g. "85%" or "0.85",
+// or as the free space left, e.g. "500mb".
+type diskWatermark struct {
+	value       string
+	usedPercent float64
+	freeBytes   uint64
+	absolute    bool
+}
+
+func parseDiskWatermark(value string) (diskWatermark, error) {
+	watermark := diskWatermark{value: value}
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return watermark, fmt.Errorf("failed to parse watermark [%s]", value)
+		}
+		watermark.usedPercent = percent
+		return watermark, nil
+	}
+	if ratio, err := strconv.ParseFloat(value, 64); err == nil {
+		if ratio < 0 || ratio > 1 {
+			return watermark, fmt.Errorf("failed to parse watermark [%s], a ratio must be between 0 and 1", value)
+		}
+		watermark.usedPercent = ratio * 100
+		return watermark, nil
+	}
+	freeBytes, err := common.ParseBytes(value)
+	if err != nil {
+		return watermark, fmt.Errorf("failed to parse watermark [%s]: %v", value, err)
+	}
+	watermark.freeBytes = freeBytes
+	watermark.absolute = true
+	return watermark, nil
+}
+
+// diskWatermarkSetting reads a watermark of the cluster settings, the default when it is missing or invalid.
+func diskWatermarkSetting(settings Settings, key string, defaultValue string) diskWatermark {
+	if watermark, err := parseDiskWatermark(settings.Get(key, defaultValue)); err == nil {
+		return watermark
+	}
+	watermark, _ := parseDiskWatermark(defaultValue)
+	return watermark
+}
+
+// exceeded tells whether the usage of a node is above the watermark.
+func (w diskWatermark) exceeded(usage DiskUsage) bool {
+	if w.absolute {
+		return usage.Available < w.freeBytes
+	}
+	return usage.UsedPercent() > w.usedPercent
+}
+
+func diskUsageString(usage DiskUsage) string {
+	return fmt.Sprintf("free: [%s], used: [%.1f%%]", common.IBytes(usage.Available), usage.UsedPercent())
+}
+
+// diskThresholdDecider keeps shards off the nodes above the low watermark and moves them away from the nodes
+// above the high watermark. The new primaries of an index may still go to a node below the high watermark.
+type diskThresholdDecider struct{}
+
+func (diskThresholdDecider) CanAllocate(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "disk_threshold"}
+	if !allocation.Settings.GetBool(DiskThresholdEnabledSetting, true) {
+		result.Explanation = "the disk threshold decider is disabled"
+		return result
+	}
+	usage, existing := allocation.ClusterInfo.DiskUsages[node.NodeId]
+	if !existing {
+		result.Explanation = "the disk usage of the node is unknown, allocation is allowed"
+		return result
+	}
+
+	low := diskWatermarkSetting(allocation.Settings, DiskWatermarkLowSetting, defaultDiskWatermarkLow)
+	high := diskWatermarkSetting(allocation.Settings, DiskWatermarkHighSetting, defaultDiskWatermarkHigh)
+	newPrimary := shard.Primary && shard.State == state.ShardUnassigned && shard.UnassignedInfo.Reason == state.UnassignedIndexCreated
+	if high.exceeded(usage) {
+		result.Decision = DecisionNo
+		result.Explanation = fmt.Sprintf("the node is above the high watermark cluster setting [%s=%s], %s", DiskWatermarkHighSetting, high.value, diskUsageString(usage))
+		return result
+	}
+	if low.exceeded(usage) && !newPrimary {
+		result.Decision = DecisionNo
+		result.Explanation = fmt.Sprintf("the node is above the low watermark cluster setting [%s=%s], %s", DiskWatermarkLowSetting, low.value, diskUsageString(usage))
+		return result
+	}
+	result.Explanation = "enough disk for shard on node, " + diskUsageString(usage)
+	return result
+}
+
+func (diskThresholdDecider) CanRemain(shard state.ShardRouting, node *state.RoutingNode, allocation *RoutingAllocation) DeciderResult {
+	result := DeciderResult{Decider: "disk_threshold"}
+	if !allocation.Settings.GetBool(DiskThresholdEnabledSetting, true) {
+		result.Explanation = "the disk threshold decider is disabled"
+		return result
+	}
+	usage, existing := allocation.ClusterInfo.DiskUsages[node.NodeId]
+	if !existing {
+		result.Explanation = "the disk usage of the node is unknown, the shard can remain"
+		return result
+	}
+
+	high := diskWatermarkSetting(allocation.Settings, DiskWatermarkHighSetting, defaultDiskWatermarkHigh)
+	if high.exceeded(usage) {
+		result.Decision = DecisionNo
+		result.Explanation = fmt.Sprintf("the shard cannot remain on this node because it is above the high watermark cluster setting [%s=%s], %s", DiskWatermarkHighSetting, high.value, diskUsageString(usage))
+		return result
+	}
+	result.Explanation = "there is enough disk on this node for the shard to remain, " + diskUsageString(usage)
+	return result
+}
+
+// DiskThresholdMonitor reacts to the disk usage collected by the master. The indices with a copy on a node
+// above the flood-stage watermark get the read-only-allow-delete block, which is released once all their nodes
+// are back below the high watermark. A reroute moves the shards away from the nodes above the high watermark.
+type DiskThresholdMonitor struct {
+	clusterService    state.ClusterService
+	allocationService *AllocationService
+
+	// nodesOverLow are the nodes above the low watermark at the last check
+	nodesOverLow map[string]struct{}
+}
+
+func NewDiskThresholdMonitor(clusterService state.ClusterService, allocationService *AllocationService) *DiskThresholdMonitor {
+	return &DiskThresholdMonitor{
+		clusterService:    clusterService,
+		allocationService: allocationService,
+		nodesOverLow:      map[string]struct{}{},
+	}
+}
+
+func (m *DiskThresholdMonitor) OnNewInfo(info ClusterInfo) {
+	clusterState := m.clusterService.State()
+	settings := Settings(clusterState.Metadata.Settings())
+	if !settings.GetBool(DiskThresholdEnabledSetting, true) {
+		return
+	}
+	low := diskWatermarkSetting(settings, DiskWatermarkLowSetting, defaultDiskWatermarkLow)
+	high := diskWatermarkSetting(settings, DiskWatermarkHighSetting, defaultDiskWatermarkHigh)
+	floodStage := diskWatermarkSetting(settings, DiskWatermarkFloodStageSetting, defaultDiskWatermarkFloodStage)
+
+	nodesOverLow := map[string]struct{}{}
+	nodesOverHigh := map[string]struct{}{}
+	nodesOverFloodStage := map[string]struct{}{}
+	for nodeId, usage := range info.DiskUsages {
+		if floodStage.exceeded(usage) {
+			logrus.Warnf("flood stage disk watermark [%s] exceeded on node [%s], all indices on this node will be marked read-only", floodStage.value, nodeId)
+			nodesOverFloodStage[nodeId] = struct{}{}
+		}
+		if high.exceeded(usage) {
+			nodesOverHigh[nodeId] = struct{}{}
+		}
+		if low.exceeded(usage) {
+			nodesOverLow[nodeId] = struct{}{}
+		}
+	}
+
+	// a node back below the low watermark may take the shards that could not be allocated
+	reroute := len(nodesOverHigh) > 0
+	for nodeId := range m.nodesOverLow {
+		if _, existing := nodesOverLow[nodeId]; !existing {
+			reroute = true
+		}
+	}
+	m.nodesOverLow = nodesOverLow
+
+	blocks := indicesToBlock(*clusterState, nodesOverFloodStage, nodesOverHigh)
+	if len(blocks) == 0 && !reroute {
+		return
+	}
+	m.clusterService.SubmitStateUpdateTask("disk-threshold-monitor", state.TaskConfig{Priority: state.PriorityHigh}, func(current state.ClusterState) state.ClusterState {
+		newState := current
+		if blocks := indicesToBlock(current, nodesOverFloodStage, nodesOverHigh); len(blocks) > 0 {
+			newState.Metadata = setReadOnlyAllowDelete(current.Metadata, blocks)
+		}
+		if reroute {
+			return m.allocationService.reroute(newState)
+		}
+		return newState
+	})
+}
+
+// indicesToBlock returns the indices whose read-only-allow-delete block changes, true when it is put. An index
+// with a copy on a node above the flood-stage watermark is blocked, a blocked index is released once none of
+// its copies is on a node above the high watermark.
+func indicesToBlock(clusterState state.ClusterState, nodesOverFloodStage map[string]struct{}, nodesOverHigh map[string]struct{}) map[string]bool {
+	blocks := map[string]bool{}
+	for indexName, indexRoutingTable := range clusterState.RoutingTable.IndicesRouting {
+		overFloodStage, overHigh := false, false
+		for _, shardRoutingTable := range indexRoutingTable.Shards {
+			for _, shard := range shardRoutingTable.Copies() {
+				for _, nodeId := range []string{shard.CurrentNodeId, shard.RelocatingNodeId} {
+					if _, existing := nodesOverFloodStage[nodeId]; existing {
+						overFloodStage = true
+					}
+					if _, existing := nodesOverHigh[nodeId]; existing {
+						overHigh = true
+					}
+				}
+			}
+		}
+		blocked := clusterState.Metadata.Indices[indexName].ReadOnlyAllowDelete
+		if overFloodStage && !blocked {
+			blocks[indexName] = true
+		}
+		if !overHigh && blocked {
+			blocks[indexName] = false
+		}
+	}
+	return blocks
+}
+
+func setReadOnlyAllowDelete(metadata state.Metadata, blocks map[string]bool) state.Metadata {
+	indices := map[string]state.IndexMetadata{}
+	for indexName, indexMetadata := range metadata.Indices {
+		indices[indexName] = indexMetadata
+	}
+	var indexNames []string
+	for indexName := range blocks {
+		indexNames = append(indexNames, indexName)
+	}
+	sort.Strings(indexNames)
+	for _, indexName := range indexNames {
+		indexMetadata, existing := indices[indexName]
+		if !existing {
+			continue
+		}
+		if blocks[indexName] {
+			logrus.Warnf("index [%s] is marked read-only, a node holding it exceeded the flood stage disk watermark", indexName)
+		} else {
+			logrus.Infof("releasing the read-only block of index [%s], its nodes are below the high disk watermark", indexName)
+		}
+		indexMetadata.ReadOnlyAllowDelete = blocks[indexName]
+		indices[indexName] = indexMetadata
+	}
+	metadata.Indices = indices
+	return metadata
+}
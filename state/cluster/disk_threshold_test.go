@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseDiskWatermark(t *testing.T) {
+	// Action
+	percent, percentErr := parseDiskWatermark("85%")
+	ratio, ratioErr := parseDiskWatermark("0.9")
+	absolute, absoluteErr := parseDiskWatermark("500mb")
+	_, invalidErr := parseDiskWatermark("120%")
+
+	// Assert
+	assert.Nil(t, percentErr)
+	assert.Nil(t, ratioErr)
+	assert.Nil(t, absoluteErr)
+	assert.NotNil(t, invalidErr)
+	usage := DiskUsage{Total: 1000 * common.MB, Available: 120 * common.MB}
+	assert.True(t, percent.exceeded(usage))
+	assert.False(t, ratio.exceeded(usage))
+	assert.True(t, absolute.exceeded(usage))
+}
+
+func TestAllocationService_diskThresholdDecider(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	allocationService.ClusterInfoService = &ClusterInfoService{
+		info: ClusterInfo{
+			DiskUsages: map[string]DiskUsage{
+				// above the high watermark
+				"testNodeId1": {NodeId: "testNodeId1", Total: 100, Available: 5},
+				// above the low watermark
+				"testNodeId2": {NodeId: "testNodeId2", Total: 100, Available: 12},
+				"testNodeId3": {NodeId: "testNodeId3", Total: 100, Available: 50},
+				"testNodeId4": {NodeId: "testNodeId4", Total: 100, Available: 50},
+			},
+		},
+	}
+	node1 := state.Node{Name: "node1", Id: "testNodeId1"}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2"}
+	node3 := state.Node{Name: "node3", Id: "testNodeId3"}
+	node4 := state.Node{Name: "node4", Id: "testNodeId4"}
+	clusterState := decidersTestClusterState(state.IndexMetadata{}, node1, node2, node3, node4)
+	disabled := decidersTestClusterState(state.IndexMetadata{}, node1, node2)
+	disabled.Metadata.PersistentSettings[DiskThresholdEnabledSetting] = "false"
+
+	// Action
+	clusterState = allocationService.reroute(clusterState)
+	disabled = allocationService.reroute(disabled)
+
+	// Assert
+	shardRoutingTable := clusterState.RoutingTable.IndicesRouting["test"].Shards[0]
+	// node1 is above the high watermark and node2 above the low one, the copies go to node3 and node4
+	assert.Equal(t, state.ShardRelocating, shardRoutingTable.Primary.State)
+	assert.Contains(t, []string{node3.Id, node4.Id}, shardRoutingTable.Primary.RelocatingNodeId)
+	assert.Contains(t, []string{node3.Id, node4.Id}, shardRoutingTable.Replicas[0].CurrentNodeId)
+	shardRoutingTable = disabled.RoutingTable.IndicesRouting["test"].Shards[0]
+	assert.Equal(t, state.ShardStarted, shardRoutingTable.Primary.State)
+	assert.Equal(t, node2.Id, shardRoutingTable.Replicas[0].CurrentNodeId)
+}
+
+func TestIndicesToBlock(t *testing.T) {
+	// Arrange
+	node1 := state.Node{Name: "node1", Id: "testNodeId1"}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2"}
+	clusterState := decidersTestClusterState(state.IndexMetadata{}, node1, node2)
+	overFloodStage := map[string]struct{}{node1.Id: {}}
+
+	// Action
+	blocks := indicesToBlock(clusterState, overFloodStage, overFloodStage)
+	clusterState.Metadata = setReadOnlyAllowDelete(clusterState.Metadata, blocks)
+	kept := indicesToBlock(clusterState, map[string]struct{}{}, overFloodStage)
+	released := indicesToBlock(clusterState, map[string]struct{}{}, map[string]struct{}{})
+
+	// Assert
+	assert.Equal(t, map[string]bool{"test": true}, blocks)
+	assert.True(t, clusterState.Metadata.Indices["test"].ReadOnlyAllowDelete)
+	assert.Equal(t, 0, len(kept))
+	assert.Equal(t, map[string]bool{"test": false}, released)
+}
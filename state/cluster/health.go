@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+)
+
+type HealthStatus int
+
+const (
+	HealthGreen HealthStatus = iota
+	HealthYellow
+	HealthRed
+)
+
+func (s HealthStatus) String() string {
+	switch s {
+	case HealthGreen:
+		return "green"
+	case HealthYellow:
+		return "yellow"
+	default:
+		return "red"
+	}
+}
+
+// ParseHealthStatus parses a health status name, it returns false for an unknown name.
+func ParseHealthStatus(name string) (HealthStatus, bool) {
+	switch name {
+	case "green":
+		return HealthGreen, true
+	case "yellow":
+		return HealthYellow, true
+	case "red":
+		return HealthRed, true
+	}
+	return HealthRed, false
+}
+
+type ShardHealth struct {
+	Status             HealthStatus
+	PrimaryActive      bool
+	ActiveShards       int
+	RelocatingShards   int
+	InitializingShards int
+	UnassignedShards   int
+}
+
+type IndexHealth struct {
+	Status              HealthStatus
+	NumberOfShards      int
+	NumberOfReplicas    int
+	ActivePrimaryShards int
+	ActiveShards        int
+	RelocatingShards    int
+	InitializingShards  int
+	UnassignedShards    int
+	Shards              map[int]ShardHealth
+}
+
+type ClusterHealth struct {
+	Status              HealthStatus
+	ActivePrimaryShards int
+	ActiveShards        int
+	RelocatingShards    int
+	InitializingShards  int
+	UnassignedShards    int
+	Indices             map[string]IndexHealth
+}
+
+// ActiveShardsPercent is the share of the shard copies that are active, 100 without any shard.
+func (h ClusterHealth) ActiveShardsPercent() float64 {
+	total := h.ActiveShards + h.InitializingShards + h.UnassignedShards
+	if total == 0 {
+		return 100
+	}
+	return float64(h.ActiveShards) * 100 / float64(total)
+}
+
+// NewShardHealth is red when the primary is not active, yellow when a replica is not, green otherwise.
+// The primary of a newly created index is only yellow until it starts for the first time.
+func NewShardHealth(shardRoutingTable state.IndexShardRoutingTable) ShardHealth {
+	health := ShardHealth{
+		PrimaryActive: shardRoutingTable.Primary.Active(),
+	}
+	for _, shard := range shardRoutingTable.Copies() {
+		switch shard.State {
+		case state.ShardStarted:
+			health.ActiveShards++
+		case state.ShardRelocating:
+			health.ActiveShards++
+			health.RelocatingShards++
+		case state.ShardInitializing:
+			health.InitializingShards++
+		default:
+			health.UnassignedShards++
+		}
+	}
+
+	switch {
+	case health.PrimaryActive && health.ActiveShards == len(shardRoutingTable.Copies()):
+		health.Status = HealthGreen
+	case health.PrimaryActive || shardRoutingTable.Primary.UnassignedInfo.Reason == state.UnassignedIndexCreated:
+		health.Status = HealthYellow
+	default:
+		health.Status = HealthRed
+	}
+	return health
+}
+
+// NewIndexHealth is the worst health of the shards of the index.
+func NewIndexHealth(indexMetadata state.IndexMetadata, indexRoutingTable state.IndexRoutingTable) IndexHealth {
+	health := IndexHealth{
+		Status:           HealthGreen,
+		NumberOfShards:   indexMetadata.NumberOfShards,
+		NumberOfReplicas: indexMetadata.NumberOfReplicas,
+		Shards:           map[int]ShardHealth{},
+	}
+	for shardId, shardRoutingTable := range indexRoutingTable.Shards {
+		shardHealth := NewShardHealth(shardRoutingTable)
+		health.Shards[shardId] = shardHealth
+		if shardHealth.PrimaryActive {
+			health.ActivePrimaryShards++
+		}
+		health.ActiveShards += shardHealth.ActiveShards
+		health.RelocatingShards += shardHealth.RelocatingShards
+		health.InitializingShards += shardHealth.InitializingShards
+		health.UnassignedShards += shardHealth.UnassignedShards
+		if shardHealth.Status > health.Status {
+			health.Status = shardHealth.Status
+		}
+	}
+	// an index without a routing table yet has no active primary
+	if len(indexRoutingTable.Shards) < indexMetadata.NumberOfShards {
+		health.Status = HealthRed
+	}
+	return health
+}
+
+// NewClusterHealth is the worst health of the given indices, green when there is none.
+func NewClusterHealth(clusterState state.ClusterState, concreteIndices []string) ClusterHealth {
+	health := ClusterHealth{
+		Status:  HealthGreen,
+		Indices: map[string]IndexHealth{},
+	}
+	for _, indexName := range concreteIndices {
+		indexHealth := NewIndexHealth(clusterState.Metadata.Indices[indexName], clusterState.RoutingTable.IndicesRouting[indexName])
+		health.Indices[indexName] = indexHealth
+		health.ActivePrimaryShards += indexHealth.ActivePrimaryShards
+		health.ActiveShards += indexHealth.ActiveShards
+		health.RelocatingShards += indexHealth.RelocatingShards
+		health.InitializingShards += indexHealth.InitializingShards
+		health.UnassignedShards += indexHealth.UnassignedShards
+		if indexHealth.Status > health.Status {
+			health.Status = indexHealth.Status
+		}
+	}
+	return health
+}
@@ -0,0 +1,34 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewShardHealth(t *testing.T) {
+	// Arrange
+	shardId := state.ShardId{Index: state.Index{Name: "test", Uuid: "testUuid"}}
+	started := state.ShardRouting{ShardId: shardId, CurrentNodeId: "node1", Primary: true, State: state.ShardStarted}
+	replica := state.ShardRouting{ShardId: shardId, CurrentNodeId: "node2", State: state.ShardStarted}
+	unassignedReplica := state.ShardRouting{ShardId: shardId, State: state.ShardUnassigned}
+	created := state.ShardRouting{ShardId: shardId, Primary: true, State: state.ShardUnassigned,
+		UnassignedInfo: state.UnassignedInfo{Reason: state.UnassignedIndexCreated}}
+	lost := state.ShardRouting{ShardId: shardId, Primary: true, State: state.ShardUnassigned,
+		UnassignedInfo: state.UnassignedInfo{Reason: state.UnassignedNodeLeft}}
+
+	// Action
+	green := NewShardHealth(state.IndexShardRoutingTable{ShardId: shardId, Primary: started, Replicas: []state.ShardRouting{replica}})
+	yellow := NewShardHealth(state.IndexShardRoutingTable{ShardId: shardId, Primary: started, Replicas: []state.ShardRouting{unassignedReplica}})
+	newIndex := NewShardHealth(state.IndexShardRoutingTable{ShardId: shardId, Primary: created})
+	red := NewShardHealth(state.IndexShardRoutingTable{ShardId: shardId, Primary: lost, Replicas: []state.ShardRouting{unassignedReplica}})
+
+	// Assert
+	assert.Equal(t, HealthGreen, green.Status)
+	assert.Equal(t, 2, green.ActiveShards)
+	assert.Equal(t, HealthYellow, yellow.Status)
+	assert.Equal(t, 1, yellow.UnassignedShards)
+	assert.Equal(t, HealthYellow, newIndex.Status)
+	assert.Equal(t, HealthRed, red.Status)
+	assert.False(t, red.PrimaryActive)
+}
@@ -1,7 +1,9 @@
 package cluster
 
 import (
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
 )
 
@@ -12,21 +14,62 @@ type AliasAction struct {
 }
 
 type IndicesAliasesClusterStateUpdateRequest struct {
+	AckedRequest
 	Actions []AliasAction
 }
 
+func (r *IndicesAliasesClusterStateUpdateRequest) WriteTo(out *common.StreamOutput) {
+	r.AckedRequest.WriteTo(out)
+	out.WriteVInt(uint64(len(r.Actions)))
+	for _, action := range r.Actions {
+		out.WriteString(action.Type)
+		out.WriteString(action.Index)
+		out.WriteString(action.Alias)
+	}
+}
+
+func readIndicesAliasesClusterStateUpdateRequest(in *common.StreamInput) (*IndicesAliasesClusterStateUpdateRequest, error) {
+	req := IndicesAliasesClusterStateUpdateRequest{AckedRequest: readAckedRequest(in)}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.Actions = append(req.Actions, AliasAction{
+			Type:  in.ReadString(),
+			Index: in.ReadString(),
+			Alias: in.ReadString(),
+		})
+	}
+	return &req, in.Err()
+}
+
+const IndicesAliasesAction = "indices:admin/aliases"
+
 type MetadataIndexAliasService struct {
-	clusterService state.ClusterService
+	clusterService       state.ClusterService
+	indicesAliasesAction *MasterNodeAction
 }
 
-func NewMetadataIndexAliasService(clusterService state.ClusterService) *MetadataIndexAliasService {
-	return &MetadataIndexAliasService{
+func NewMetadataIndexAliasService(clusterService *Service, transportService *transport.Service) *MetadataIndexAliasService {
+	s := &MetadataIndexAliasService{
 		clusterService: clusterService,
 	}
+	s.indicesAliasesAction = NewMasterNodeAction(IndicesAliasesAction, clusterService, transportService, func(in *common.StreamInput) error {
+		req, err := readIndicesAliasesClusterStateUpdateRequest(in)
+		if err != nil {
+			return err
+		}
+		return s.indicesAliases(*req)
+	})
+	return s
+}
+
+// IndicesAliases applies the alias actions on the elected master, the request is forwarded when the local node is
+// not the master.
+func (s *MetadataIndexAliasService) IndicesAliases(req IndicesAliasesClusterStateUpdateRequest) error {
+	return s.indicesAliasesAction.Execute(&req, req.MasterTimeout)
 }
 
-func (s *MetadataIndexAliasService) IndicesAliases(req IndicesAliasesClusterStateUpdateRequest) {
-	s.clusterService.SubmitStateUpdateTask(func(current state.ClusterState) state.ClusterState {
+func (s *MetadataIndexAliasService) indicesAliases(req IndicesAliasesClusterStateUpdateRequest) error {
+	return s.clusterService.SubmitStateUpdateTask("index-aliases", req.taskConfig(state.PriorityUrgent), func(current state.ClusterState) state.ClusterState {
 		return s.applyAliasesAction(current, req.Actions)
 	})
 }
@@ -1,38 +1,93 @@
 package cluster
 
 import (
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"math"
+	"sort"
+)
+
+const (
+	// maxAllocationRetries is how many times in a row a copy may fail before it is left unassigned
+	maxAllocationRetries = 5
+
+	defaultClusterConcurrentRebalance = 2
+	defaultNodeConcurrentRecoveries   = 2
+	defaultBalanceThreshold           = 1.0
 )
 
 func weight(node state.RoutingNode, index string) float64 {
 	theta0 := 0.55
 	theta1 := 0.45
 
-	weightShard := float64(node.NumShards())             // - avgShardsPerNode
-	weightIndex := float64(node.NumShardsOfIndex(index)) // - avgShardsPerNodeOfIndex
+	// a relocating copy only counts on its target node
+	weightShard := float64(node.NumShards() - node.NumRelocatingShards())                         // - avgShardsPerNode
+	weightIndex := float64(node.NumShardsOfIndex(index) - node.NumRelocatingShardsOfIndex(index)) // - avgShardsPerNodeOfIndex
 	return theta0*weightShard + theta1*weightIndex
 }
 
 type AllocationService struct {
+	deciders AllocationDeciders
+	// ClusterInfoService gives the disk usage of the nodes to the deciders, without it disk usage is ignored
+	ClusterInfoService *ClusterInfoService
 }
 
 func NewAllocationService() *AllocationService {
-	return &AllocationService{}
+	return &AllocationService{
+		deciders: AllocationDeciders{
+			sameShardDecider{},
+			replicaAfterPrimaryActiveDecider{},
+			maxRetryDecider{},
+			filterDecider{},
+			awarenessDecider{},
+			diskThresholdDecider{},
+			throttlingDecider{},
+		},
+	}
 }
 
 // shard 마다 node 별 weight 계산, 앎맞는 data node id 를 할당.
 func (s *AllocationService) reroute(clusterState state.ClusterState) state.ClusterState {
-	routingNodes := state.NewRoutingNodes(clusterState)
+	return s.allocate(clusterState, s.newRoutingAllocation(clusterState))
+}
+
+// allocate assigns the unassigned copies of the allocation and rebalances, then builds the resulting cluster state.
+func (s *AllocationService) allocate(clusterState state.ClusterState, allocation *RoutingAllocation) state.ClusterState {
+	routingNodes := allocation.RoutingNodes
+
+	// an active replica takes over from a primary that is gone
+	for _, shard := range routingNodes.UnassignedShards {
+		if !shard.Primary || shard.CurrentNodeId != "" {
+			continue
+		}
+		for _, node := range routingNodes.NodesToShards {
+			replica, existing := node.Shards[shard.ShardId]
+			if !existing || !replica.Active() {
+				continue
+			}
+			node.Remove(replica)
+			replica.Primary = true
+			node.Add(replica)
+			shard.Primary = false
+			break
+		}
+	}
 
 	//nodes := len(clusterState.Nodes.DataNodes)
 	//avgShardsPerNode := float64(0) / float64(nodes)
 	for _, shard := range routingNodes.UnassignedShards {
+		if shard.CurrentNodeId != "" {
+			continue
+		}
+
 		// decide to allocate unassigned
 		var minNode *state.RoutingNode = nil
 
 		minWeight := math.MaxFloat64
 		for _, node := range routingNodes.NodesToShards {
+			if decision, _ := s.deciders.CanAllocate(*shard, node, allocation); decision != DecisionYes {
+				continue
+			}
 			indexName := shard.ShardId.Index.Name
 			//avgShardsPerNodeOfIndex := float64(clusterState.Metadata.Indices[indexName].NumberOfShards / nodes)
 			currentWeight := weight(*node, indexName)
@@ -47,28 +102,93 @@ func (s *AllocationService) reroute(clusterState state.ClusterState) state.Clust
 
 		if minNode != nil {
 			shard.CurrentNodeId = minNode.NodeId
+			shard.State = state.ShardInitializing
+			shard.AllocationId = common.RandomBase64()
 			minNode.Add(*shard)
 		}
 	}
 
-	// generate routing table based on routing nodes
-	newRoutingTable := state.RoutingTable{
-		IndicesRouting: map[string]state.IndexRoutingTable{},
+	s.moveShards(allocation)
+	s.rebalance(allocation)
+
+	return buildClusterState(clusterState, routingNodes)
+}
+
+// moveShards relocates the started copies that cannot remain on their node, e.g. on a node above the high
+// disk watermark or excluded by a filter, to the lightest node accepting them.
+func (s *AllocationService) moveShards(allocation *RoutingAllocation) {
+	var nodeIds []string
+	for nodeId := range allocation.RoutingNodes.NodesToShards {
+		nodeIds = append(nodeIds, nodeId)
 	}
-	for _, node := range routingNodes.NodesToShards {
+	sort.Strings(nodeIds)
+	for _, nodeId := range nodeIds {
+		node := allocation.RoutingNodes.NodesToShards[nodeId]
+		var shards []state.ShardRouting
 		for _, shard := range node.Shards {
-			indexName := shard.ShardId.Index.Name
-			if _, ok := newRoutingTable.IndicesRouting[indexName]; !ok {
-				newRoutingTable.IndicesRouting[indexName] = state.IndexRoutingTable{
-					Index:  shard.ShardId.Index,
-					Shards: map[int]state.IndexShardRoutingTable{},
+			if shard.State != state.ShardStarted {
+				continue
+			}
+			if decision, _ := s.deciders.CanRemain(shard, node, allocation); decision == DecisionNo {
+				shards = append(shards, shard)
+			}
+		}
+		sort.Slice(shards, func(i, j int) bool {
+			if shards[i].ShardId.Index.Name != shards[j].ShardId.Index.Name {
+				return shards[i].ShardId.Index.Name < shards[j].ShardId.Index.Name
+			}
+			return shards[i].ShardId.ShardId < shards[j].ShardId.ShardId
+		})
+
+		for _, shard := range shards {
+			var target *state.RoutingNode
+			minWeight := math.MaxFloat64
+			for _, other := range allocation.RoutingNodes.NodesToShards {
+				if other.NodeId == node.NodeId {
+					continue
+				}
+				if decision, _ := s.deciders.CanAllocate(shard, other, allocation); decision != DecisionYes {
+					continue
 				}
+				if currentWeight := weight(*other, shard.ShardId.Index.Name); currentWeight < minWeight || (currentWeight == minWeight && other.NodeId < target.NodeId) {
+					target = other
+					minWeight = currentWeight
+				}
+			}
+			if target == nil {
+				continue
 			}
+			relocating := shard.Relocate(target.NodeId, common.RandomBase64())
+			node.Remove(shard)
+			node.Add(relocating)
+			target.Add(relocating.RelocationTarget())
+		}
+	}
+}
 
-			newRoutingTable.IndicesRouting[indexName].Shards[shard.ShardId.ShardId] = state.IndexShardRoutingTable{
-				ShardId: shard.ShardId,
-				Primary: shard,
+// buildClusterState generates the routing table of the cluster state from the routing nodes.
+func buildClusterState(clusterState state.ClusterState, routingNodes *state.RoutingNodes) state.ClusterState {
+	newRoutingTable := state.RoutingTable{
+		IndicesRouting: map[string]state.IndexRoutingTable{},
+	}
+	for indexName, indexRoutingTable := range clusterState.RoutingTable.IndicesRouting {
+		newRoutingTable.IndicesRouting[indexName] = state.IndexRoutingTable{
+			Index:  indexRoutingTable.Index,
+			Shards: map[int]state.IndexShardRoutingTable{},
+		}
+	}
+	for _, node := range routingNodes.NodesToShards {
+		for _, shard := range node.Shards {
+			// a relocation target is kept on its relocating copy
+			if shard.IsRelocationTarget() {
+				continue
 			}
+			addShardRouting(newRoutingTable, shard)
+		}
+	}
+	for _, shard := range routingNodes.UnassignedShards {
+		if shard.CurrentNodeId == "" {
+			addShardRouting(newRoutingTable, *shard)
 		}
 	}
 
@@ -81,3 +201,207 @@ func (s *AllocationService) reroute(clusterState state.ClusterState) state.Clust
 		RoutingTable: newRoutingTable,
 	}
 }
+
+// rebalance relocates started copies from the heaviest to the lightest nodes of every index, as long as
+// the weight delta between them is above the threshold and the relocation limits allow it.
+func (s *AllocationService) rebalance(allocation *RoutingAllocation) {
+	routingNodes, settings := allocation.RoutingNodes, allocation.Settings
+	enable := settings.Get(RebalanceEnableSetting, RebalanceAll)
+	if enable == RebalanceNone {
+		return
+	}
+	concurrentRebalance := settings.GetInt(ClusterConcurrentRebalanceSetting, defaultClusterConcurrentRebalance)
+	threshold := settings.GetFloat(BalanceThresholdSetting, defaultBalanceThreshold)
+
+	// the targets recover from the primaries, so every primary has to be active first
+	for _, shard := range routingNodes.UnassignedShards {
+		if shard.Primary && shard.CurrentNodeId == "" {
+			return
+		}
+	}
+	relocations := 0
+	indexNames := map[string]struct{}{}
+	for _, node := range routingNodes.NodesToShards {
+		for _, shard := range node.Shards {
+			if shard.Primary && shard.State == state.ShardInitializing && !shard.IsRelocationTarget() {
+				return
+			}
+			if shard.State == state.ShardRelocating {
+				relocations++
+			}
+			indexNames[shard.ShardId.Index.Name] = struct{}{}
+		}
+	}
+
+	var sortedIndexNames []string
+	for indexName := range indexNames {
+		sortedIndexNames = append(sortedIndexNames, indexName)
+	}
+	sort.Strings(sortedIndexNames)
+	for _, indexName := range sortedIndexNames {
+		for relocations < concurrentRebalance && s.relocateShard(allocation, indexName, enable, threshold) {
+			relocations++
+		}
+	}
+}
+
+// relocateShard starts the relocation of a copy of the index from a heavier to a lighter node, it returns
+// false when no copy can be moved.
+func (s *AllocationService) relocateShard(allocation *RoutingAllocation, indexName string, enable string, threshold float64) bool {
+	var nodes []*state.RoutingNode
+	for _, node := range allocation.RoutingNodes.NodesToShards {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		wi, wj := weight(*nodes[i], indexName), weight(*nodes[j], indexName)
+		if wi != wj {
+			return wi < wj
+		}
+		return nodes[i].NodeId < nodes[j].NodeId
+	})
+
+	for i := len(nodes) - 1; i > 0; i-- {
+		high := nodes[i]
+		for _, low := range nodes[:i] {
+			// a relocation changes both weights by one, it only improves a delta above one
+			delta := weight(*high, indexName) - weight(*low, indexName)
+			if delta <= threshold || delta <= 1 {
+				break
+			}
+			var shards []state.ShardRouting
+			for shard := range high.ShardsByIndex[indexName] {
+				shards = append(shards, shard)
+			}
+			sort.Slice(shards, func(i, j int) bool {
+				return shards[i].ShardId.ShardId < shards[j].ShardId.ShardId
+			})
+			for _, shard := range shards {
+				if shard.State != state.ShardStarted || !rebalanceAllowed(shard, enable) {
+					continue
+				}
+				if decision, _ := s.deciders.CanAllocate(shard, low, allocation); decision != DecisionYes {
+					continue
+				}
+				relocating := shard.Relocate(low.NodeId, common.RandomBase64())
+				high.Remove(shard)
+				high.Add(relocating)
+				low.Add(relocating.RelocationTarget())
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func rebalanceAllowed(shard state.ShardRouting, enable string) bool {
+	switch enable {
+	case RebalancePrimaries:
+		return shard.Primary
+	case RebalanceReplicas:
+		return !shard.Primary
+	case RebalanceNone:
+		return false
+	default:
+		return true
+	}
+}
+
+func addShardRouting(routingTable state.RoutingTable, shard state.ShardRouting) {
+	indexName := shard.ShardId.Index.Name
+	if _, ok := routingTable.IndicesRouting[indexName]; !ok {
+		routingTable.IndicesRouting[indexName] = state.IndexRoutingTable{
+			Index:  shard.ShardId.Index,
+			Shards: map[int]state.IndexShardRoutingTable{},
+		}
+	}
+
+	shardRoutingTable := routingTable.IndicesRouting[indexName].Shards[shard.ShardId.ShardId]
+	shardRoutingTable.ShardId = shard.ShardId
+	if shard.Primary {
+		shardRoutingTable.Primary = shard
+	} else {
+		shardRoutingTable.Replicas = append(shardRoutingTable.Replicas, shard)
+	}
+	routingTable.IndicesRouting[indexName].Shards[shard.ShardId.ShardId] = shardRoutingTable
+}
+
+func primaryActive(routingNodes *state.RoutingNodes, shardId state.ShardId) bool {
+	for _, node := range routingNodes.NodesToShards {
+		if shard, existing := node.Shards[shardId]; existing && shard.Primary && shard.Active() {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAllocation tells whether shard is the allocation of a copy reported by a data node.
+func sameAllocation(shard state.ShardRouting, reported state.ShardRouting) bool {
+	return shard.ShardId == reported.ShardId && shard.AllocationId != "" && shard.AllocationId == reported.AllocationId
+}
+
+// relocationTargetOf tells whether a copy reported by a data node is the relocation target of shard.
+func relocationTargetOf(shard state.ShardRouting, reported state.ShardRouting) bool {
+	return shard.State == state.ShardRelocating && shard.ShardId == reported.ShardId && shard.RelocationAllocationId == reported.AllocationId
+}
+
+// updateShardRoutings rebuilds the routing table with every shard copy passed through update, then reroutes.
+func (s *AllocationService) updateShardRoutings(clusterState state.ClusterState, update func(shardRoutingTable state.IndexShardRoutingTable, shard state.ShardRouting) state.ShardRouting) state.ClusterState {
+	routingTable := state.RoutingTable{
+		IndicesRouting: map[string]state.IndexRoutingTable{},
+	}
+	for indexName, indexRoutingTable := range clusterState.RoutingTable.IndicesRouting {
+		routingTable.IndicesRouting[indexName] = state.IndexRoutingTable{
+			Index:  indexRoutingTable.Index,
+			Shards: map[int]state.IndexShardRoutingTable{},
+		}
+		for _, shardRoutingTable := range indexRoutingTable.Shards {
+			for _, shard := range shardRoutingTable.Copies() {
+				addShardRouting(routingTable, update(shardRoutingTable, shard))
+			}
+		}
+	}
+
+	return s.reroute(state.ClusterState{
+		Version:      clusterState.Version,
+		StateUUID:    clusterState.StateUUID,
+		Name:         clusterState.Name,
+		Nodes:        clusterState.Nodes,
+		Metadata:     clusterState.Metadata,
+		RoutingTable: routingTable,
+	})
+}
+
+// applyStartedShard marks the initializing copy reported by a data node as started, or completes the
+// relocation it was the target of, then allocates the replicas that were waiting for it.
+func (s *AllocationService) applyStartedShard(clusterState state.ClusterState, started state.ShardRouting) state.ClusterState {
+	return s.updateShardRoutings(clusterState, func(shardRoutingTable state.IndexShardRoutingTable, shard state.ShardRouting) state.ShardRouting {
+		if sameAllocation(shard, started) && shard.State == state.ShardInitializing {
+			shard.State = state.ShardStarted
+			shard.UnassignedInfo = state.UnassignedInfo{}
+		}
+		if relocationTargetOf(shard, started) {
+			// the target has recovered, the copy moves to it
+			shard.CurrentNodeId = shard.RelocatingNodeId
+			shard.AllocationId = shard.RelocationAllocationId
+			shard = shard.CancelRelocation()
+		}
+		return shard
+	})
+}
+
+// applyFailedShard unassigns the copy reported as failed by a data node, or cancels the relocation it was
+// the target of. When it is a primary, the replicas recovering from it fail too and an active replica is promoted.
+func (s *AllocationService) applyFailedShard(clusterState state.ClusterState, failed state.ShardRouting, message string) state.ClusterState {
+	return s.updateShardRoutings(clusterState, func(shardRoutingTable state.IndexShardRoutingTable, shard state.ShardRouting) state.ShardRouting {
+		if relocationTargetOf(shard, failed) {
+			return shard.CancelRelocation()
+		}
+		if sameAllocation(shard, failed) {
+			return shard.Unassigned(state.UnassignedAllocationFailed, "failed shard on node ["+shard.CurrentNodeId+"]: "+message)
+		}
+		if !shard.Primary && shard.State == state.ShardInitializing && sameAllocation(shardRoutingTable.Primary, failed) {
+			return shard.Unassigned(state.UnassignedPrimaryFailed, "primary failed while replica initializing")
+		}
+		return shard
+	})
+}
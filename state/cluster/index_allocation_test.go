@@ -15,7 +15,7 @@ func TestAllocationService_reroute(t *testing.T) {
 		StateUUID: "testUUID",
 		Name:      "test",
 		Nodes: &state.Nodes{
-			DataNodes: map[string]*state.Node{
+			DataNodes: map[string]state.Node{
 				"testNodeId1": {
 					Name:        "node1",
 					Id:          "testNodeId1",
@@ -126,3 +126,296 @@ func TestAllocationService_reroute(t *testing.T) {
 	fmt.Println(result.RoutingTable.IndicesRouting)
 	assert.NotEqual(t, "", result.RoutingTable.IndicesRouting["test"].Shards[0].Primary.CurrentNodeId)
 }
+
+func TestAllocationService_rerouteReplicas(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	index := state.Index{
+		Name: "test",
+		Uuid: "testUuid",
+	}
+	shardId := state.ShardId{
+		Index:   index,
+		ShardId: 0,
+	}
+	clusterState := state.ClusterState{
+		Nodes: &state.Nodes{
+			DataNodes: map[string]state.Node{
+				"testNodeId1": {Name: "node1", Id: "testNodeId1"},
+				"testNodeId2": {Name: "node2", Id: "testNodeId2"},
+			},
+		},
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {Index: index, NumberOfShards: 1, NumberOfReplicas: 2},
+			},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": {
+					Index: index,
+					Shards: map[int]state.IndexShardRoutingTable{
+						0: {
+							ShardId: shardId,
+							Primary: state.ShardRouting{ShardId: shardId, Primary: true, State: state.ShardUnassigned},
+							Replicas: []state.ShardRouting{
+								{ShardId: shardId, State: state.ShardUnassigned},
+								{ShardId: shardId, State: state.ShardUnassigned},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Action
+	allocated := allocationService.reroute(clusterState)
+	primary := allocated.RoutingTable.IndicesRouting["test"].Shards[0].Primary
+	started := allocationService.applyStartedShard(allocated, primary)
+
+	// Assert
+	assert.Equal(t, state.ShardInitializing, primary.State)
+	for _, replica := range allocated.RoutingTable.IndicesRouting["test"].Shards[0].Replicas {
+		assert.Equal(t, "", replica.CurrentNodeId)
+	}
+	shardRoutingTable := started.RoutingTable.IndicesRouting["test"].Shards[0]
+	assert.Equal(t, state.ShardStarted, shardRoutingTable.Primary.State)
+	var assigned, unassigned int
+	for _, replica := range shardRoutingTable.Replicas {
+		if replica.CurrentNodeId == "" {
+			unassigned++
+			continue
+		}
+		assigned++
+		assert.NotEqual(t, primary.CurrentNodeId, replica.CurrentNodeId)
+		assert.Equal(t, state.ShardInitializing, replica.State)
+	}
+	assert.Equal(t, 1, assigned)
+	assert.Equal(t, 1, unassigned)
+}
+
+func TestAllocationService_applyFailedShard(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	index := state.Index{Name: "test", Uuid: "testUuid"}
+	shardId := state.ShardId{Index: index}
+	primary := state.ShardRouting{ShardId: shardId, CurrentNodeId: "testNodeId1", Primary: true, State: state.ShardStarted, AllocationId: "a1"}
+	replica := state.ShardRouting{ShardId: shardId, CurrentNodeId: "testNodeId2", State: state.ShardStarted, AllocationId: "a2"}
+	clusterState := state.ClusterState{
+		Nodes: &state.Nodes{
+			DataNodes: map[string]state.Node{
+				"testNodeId1": {Name: "node1", Id: "testNodeId1"},
+				"testNodeId2": {Name: "node2", Id: "testNodeId2"},
+			},
+		},
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {Index: index, NumberOfShards: 1, NumberOfReplicas: 1},
+			},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": {
+					Index: index,
+					Shards: map[int]state.IndexShardRoutingTable{
+						0: {ShardId: shardId, Primary: primary, Replicas: []state.ShardRouting{replica}},
+					},
+				},
+			},
+		},
+	}
+
+	// Action
+	result := allocationService.applyFailedShard(clusterState, primary, "test failure")
+
+	// Assert
+	shardRoutingTable := result.RoutingTable.IndicesRouting["test"].Shards[0]
+	assert.Equal(t, "testNodeId2", shardRoutingTable.Primary.CurrentNodeId)
+	assert.Equal(t, state.ShardStarted, shardRoutingTable.Primary.State)
+	assert.Len(t, shardRoutingTable.Replicas, 1)
+	// the failed copy is allocated again, on the node that just lost it
+	failed := shardRoutingTable.Replicas[0]
+	assert.Equal(t, "testNodeId1", failed.CurrentNodeId)
+	assert.Equal(t, state.ShardInitializing, failed.State)
+	assert.Equal(t, state.UnassignedAllocationFailed, failed.UnassignedInfo.Reason)
+	assert.Equal(t, 1, failed.UnassignedInfo.FailedAllocations)
+}
+
+func TestAllocationService_AddNodes(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	index := state.Index{
+		Name: "test",
+		Uuid: "testUuid",
+	}
+	node1 := state.Node{Name: "node1", Id: "testNodeId1", Roles: []string{state.DataRole, state.MasterRole}}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2", Roles: []string{state.DataRole, state.MasterRole}}
+	shards := map[int]state.IndexShardRoutingTable{}
+	for i := 0; i < 4; i++ {
+		shardId := state.ShardId{Index: index, ShardId: i}
+		shards[i] = state.IndexShardRoutingTable{
+			ShardId: shardId,
+			Primary: state.ShardRouting{ShardId: shardId, CurrentNodeId: node1.Id, Primary: true, State: state.ShardStarted, AllocationId: fmt.Sprint(i)},
+		}
+	}
+	clusterState := state.ClusterState{
+		Nodes: &state.Nodes{
+			Nodes:       map[string]state.Node{node1.Id: node1},
+			DataNodes:   map[string]state.Node{node1.Id: node1},
+			MasterNodes: map[string]state.Node{node1.Id: node1},
+		},
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {Index: index, NumberOfShards: 4},
+			},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": {Index: index, Shards: shards},
+			},
+		},
+	}
+	disabled := clusterState
+	disabled.Metadata.PersistentSettings = map[string]string{RebalanceEnableSetting: RebalanceNone}
+
+	// Action
+	joined := allocationService.AddNodes(clusterState, []state.Node{node2})
+	joinedDisabled := allocationService.AddNodes(disabled, []state.Node{node2})
+
+	// Assert
+	assert.Equal(t, 1, len(clusterState.Nodes.DataNodes))
+	assert.Equal(t, 2, len(joined.Nodes.DataNodes))
+	var relocating []state.ShardRouting
+	for _, shardRoutingTable := range joined.RoutingTable.IndicesRouting["test"].Shards {
+		assert.Equal(t, 0, len(shardRoutingTable.Replicas))
+		if shardRoutingTable.Primary.State == state.ShardRelocating {
+			relocating = append(relocating, shardRoutingTable.Primary)
+			assert.Equal(t, node1.Id, shardRoutingTable.Primary.CurrentNodeId)
+			assert.Equal(t, node2.Id, shardRoutingTable.Primary.RelocatingNodeId)
+		}
+	}
+	assert.Equal(t, 2, len(relocating))
+	for _, shardRoutingTable := range joinedDisabled.RoutingTable.IndicesRouting["test"].Shards {
+		assert.Equal(t, state.ShardStarted, shardRoutingTable.Primary.State)
+	}
+
+	// Action
+	relocated := allocationService.applyStartedShard(joined, relocating[0].RelocationTarget())
+	cancelled := allocationService.applyFailedShard(relocated, relocating[1].RelocationTarget(), "test")
+
+	// Assert
+	moved := relocated.RoutingTable.IndicesRouting["test"].Shards[relocating[0].ShardId.ShardId].Primary
+	assert.Equal(t, state.ShardStarted, moved.State)
+	assert.Equal(t, node2.Id, moved.CurrentNodeId)
+	assert.Equal(t, relocating[0].RelocationAllocationId, moved.AllocationId)
+	assert.Equal(t, "", moved.RelocatingNodeId)
+	// the failed target is dropped, the copy stays on its node
+	retried := cancelled.RoutingTable.IndicesRouting["test"].Shards[relocating[1].ShardId.ShardId].Primary
+	assert.Equal(t, node1.Id, retried.CurrentNodeId)
+	assert.NotEqual(t, relocating[1].RelocationAllocationId, retried.RelocationAllocationId)
+}
+
+func TestAllocationService_AddNodesRoles(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	index := state.Index{
+		Name: "test",
+		Uuid: "testUuid",
+	}
+	dataNode := state.Node{Name: "node1", Id: "testNodeId1", Roles: state.NodeRoles(false, true, false)}
+	masterNode := state.Node{Name: "node2", Id: "testNodeId2", Roles: state.NodeRoles(true, false, false)}
+	coordinatingNode := state.Node{Name: "node3", Id: "testNodeId3", Roles: state.NodeRoles(false, false, false)}
+	shardId := state.ShardId{Index: index, ShardId: 0}
+	clusterState := state.ClusterState{
+		Nodes: &state.Nodes{
+			Nodes:       map[string]state.Node{},
+			DataNodes:   map[string]state.Node{},
+			MasterNodes: map[string]state.Node{},
+		},
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {Index: index, NumberOfShards: 1},
+			},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": {Index: index, Shards: map[int]state.IndexShardRoutingTable{
+					0: {
+						ShardId: shardId,
+						Primary: state.ShardRouting{ShardId: shardId, Primary: true, State: state.ShardUnassigned, UnassignedInfo: state.UnassignedInfo{Reason: state.UnassignedIndexCreated}},
+					},
+				}},
+			},
+		},
+	}
+
+	// Action
+	withoutData := allocationService.AddNodes(clusterState, []state.Node{masterNode, coordinatingNode})
+	withData := allocationService.AddNodes(withoutData, []state.Node{dataNode})
+
+	// Assert
+	assert.Equal(t, 2, len(withoutData.Nodes.Nodes))
+	assert.Equal(t, []string{masterNode.Id}, withoutData.Nodes.MasterNodeIds())
+	assert.Equal(t, 0, len(withoutData.Nodes.DataNodes))
+	assert.Equal(t, state.ShardUnassigned, withoutData.RoutingTable.IndicesRouting["test"].Shards[0].Primary.State)
+	assert.Equal(t, 1, len(withData.Nodes.DataNodes))
+	assert.Equal(t, dataNode.Id, withData.RoutingTable.IndicesRouting["test"].Shards[0].Primary.CurrentNodeId)
+	assert.Equal(t, "d", dataNode.RoleAbbreviations())
+	assert.Equal(t, "-", coordinatingNode.RoleAbbreviations())
+}
+
+func TestAllocationService_RemoveNodes(t *testing.T) {
+	// Arrange
+	allocationService := NewAllocationService()
+	index := state.Index{
+		Name: "test",
+		Uuid: "testUuid",
+	}
+	shardId := state.ShardId{Index: index, ShardId: 0}
+	node1 := state.Node{Name: "node1", Id: "testNodeId1"}
+	node2 := state.Node{Name: "node2", Id: "testNodeId2"}
+	node3 := state.Node{Name: "node3", Id: "testNodeId3"}
+	nodes := map[string]state.Node{node1.Id: node1, node2.Id: node2, node3.Id: node3}
+	clusterState := state.ClusterState{
+		Nodes: &state.Nodes{
+			Nodes:       nodes,
+			DataNodes:   nodes,
+			MasterNodes: nodes,
+		},
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {Index: index, NumberOfShards: 1, NumberOfReplicas: 1},
+			},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": {
+					Index: index,
+					Shards: map[int]state.IndexShardRoutingTable{
+						0: {
+							ShardId: shardId,
+							Primary: state.ShardRouting{ShardId: shardId, CurrentNodeId: node1.Id, Primary: true, State: state.ShardStarted, AllocationId: "a"},
+							Replicas: []state.ShardRouting{
+								state.ShardRouting{ShardId: shardId, CurrentNodeId: node2.Id, State: state.ShardStarted, AllocationId: "b"}.Relocate(node3.Id, "c"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Action
+	removed := allocationService.RemoveNodes(clusterState, []string{node1.Id, node3.Id})
+
+	// Assert
+	assert.Equal(t, 3, len(clusterState.Nodes.DataNodes))
+	assert.Equal(t, 1, len(removed.Nodes.DataNodes))
+	shardRoutingTable := removed.RoutingTable.IndicesRouting["test"].Shards[0]
+	assert.Equal(t, node2.Id, shardRoutingTable.Primary.CurrentNodeId)
+	assert.Equal(t, state.ShardStarted, shardRoutingTable.Primary.State)
+	assert.Equal(t, "", shardRoutingTable.Primary.RelocatingNodeId)
+	assert.Equal(t, "", shardRoutingTable.Replicas[0].CurrentNodeId)
+	assert.Equal(t, state.UnassignedNodeLeft, shardRoutingTable.Replicas[0].UnassignedInfo.Reason)
+}
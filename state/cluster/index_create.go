@@ -1,46 +1,233 @@
 package cluster
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/nqd/flat"
 	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
 type CreateIndexClusterStateUpdateRequest struct {
+	AckedRequest
 	Index    string
 	Mappings []byte
 	Settings map[string]interface{}
 }
 
+func (r *CreateIndexClusterStateUpdateRequest) WriteTo(out *common.StreamOutput) {
+	r.AckedRequest.WriteTo(out)
+	out.WriteString(r.Index)
+	out.WriteBytes(r.Mappings)
+	out.WriteMap(r.Settings)
+}
+
+func readCreateIndexClusterStateUpdateRequest(in *common.StreamInput) (*CreateIndexClusterStateUpdateRequest, error) {
+	req := CreateIndexClusterStateUpdateRequest{
+		AckedRequest: readAckedRequest(in),
+		Index:        in.ReadString(),
+		Mappings:     in.ReadBytes(),
+		Settings:     in.ReadMap(),
+	}
+	return &req, in.Err()
+}
+
+const CreateIndexAction = "indices:admin/create"
+
 type MetadataCreateIndexService struct {
 	clusterService    state.ClusterService
 	allocationService *AllocationService
+	createIndexAction *MasterNodeAction
 }
 
-func NewMetadataCreateIndexService(clusterService state.ClusterService, allocationService *AllocationService) *MetadataCreateIndexService {
-	return &MetadataCreateIndexService{
+func NewMetadataCreateIndexService(clusterService *Service, allocationService *AllocationService, transportService *transport.Service) *MetadataCreateIndexService {
+	s := &MetadataCreateIndexService{
 		clusterService:    clusterService,
 		allocationService: allocationService,
 	}
+	s.createIndexAction = NewMasterNodeAction(CreateIndexAction, clusterService, transportService, func(in *common.StreamInput) error {
+		req, err := readCreateIndexClusterStateUpdateRequest(in)
+		if err != nil {
+			return err
+		}
+		return s.createIndex(*req)
+	})
+	return s
+}
+
+// settingValue reads a setting given either as "name" or as "index.name".
+func settingValue(settings map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := settings[name]; ok {
+		return v, true
+	}
+	v, ok := settings["index."+name]
+	return v, ok
+}
+
+func numberOfShards(settings map[string]interface{}) int {
+	if num, ok := settingValue(settings, "number_of_shards"); ok {
+		if n, ok := num.(float64); ok {
+			return int(n)
+		}
+	}
+	return 3
+}
+
+// numberOfReplicas reads index.number_of_replicas, 0 by default.
+func numberOfReplicas(settings map[string]interface{}) int {
+	if num, ok := settingValue(settings, "number_of_replicas"); ok {
+		if n, ok := num.(float64); ok {
+			return int(n)
+		}
+	}
+	return 0
+}
+
+func routingPartitionSize(settings map[string]interface{}) int {
+	if size, ok := settingValue(settings, "routing_partition_size"); ok {
+		if n, ok := size.(float64); ok {
+			return int(n)
+		}
+	}
+	return 1
+}
+
+// refreshInterval reads index.refresh_interval, "1s" by default and -1 to disable the periodic refresh.
+func refreshInterval(settings map[string]interface{}) (time.Duration, error) {
+	v, ok := settingValue(settings, "refresh_interval")
+	if !ok {
+		return time.Second, nil
+	}
+	switch interval := v.(type) {
+	case float64:
+		if interval == -1 {
+			return -1, nil
+		}
+	case string:
+		if interval == "-1" {
+			return -1, nil
+		}
+		if d, err := time.ParseDuration(interval); err == nil && d > 0 {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to parse setting [index.refresh_interval] with value [%v] as a time value", v)
+}
+
+// translogDurability reads index.translog.durability, "request" by default.
+func translogDurability(settings map[string]interface{}) (string, error) {
+	v, ok := settingValue(settings, "translog.durability")
+	if !ok {
+		return "request", nil
+	}
+	if durability, ok := v.(string); ok && (durability == "request" || durability == "async") {
+		return durability, nil
+	}
+	return "", fmt.Errorf("unknown value for [index.translog.durability] must be one of [request, async] but was [%v]", v)
 }
 
-func (s *MetadataCreateIndexService) CreateIndex(req CreateIndexClusterStateUpdateRequest) {
+// translogSyncInterval reads index.translog.sync_interval, "5s" by default and at least "100ms".
+func translogSyncInterval(settings map[string]interface{}) (time.Duration, error) {
+	v, ok := settingValue(settings, "translog.sync_interval")
+	if !ok {
+		return 5 * time.Second, nil
+	}
+	if interval, ok := v.(string); ok {
+		if d, err := time.ParseDuration(interval); err == nil && d >= 100*time.Millisecond {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to parse value [%v] for setting [index.translog.sync_interval] must be >= 100ms", v)
+}
+
+// routingAllocationFilter reads the index.routing.allocation.{kind}.* settings, kind is require, include or
+// exclude. The settings are keyed by node attribute, given flat or nested.
+func routingAllocationFilter(settings map[string]interface{}, kind string) map[string]string {
+	flattened, err := flat.Flatten(settings, &flat.Options{Delimiter: "."})
+	if err != nil {
+		return nil
+	}
+	prefix := "routing.allocation." + kind + "."
+	filter := map[string]string{}
+	for key, value := range flattened {
+		key = strings.TrimPrefix(key, "index.")
+		if strings.HasPrefix(key, prefix) {
+			filter[strings.TrimPrefix(key, prefix)] = fmt.Sprint(value)
+		}
+	}
+	if len(filter) == 0 {
+		return nil
+	}
+	return filter
+}
+
+// routingRequired reads _routing.required of a mapping.
+func routingRequired(mappings []byte) bool {
+	var mapping struct {
+		Routing struct {
+			Required bool `json:"required"`
+		} `json:"_routing"`
+	}
+	if err := json.Unmarshal(mappings, &mapping); err != nil {
+		return false
+	}
+	return mapping.Routing.Required
+}
+
+// ValidateCreateIndex checks the settings of a create index request before it is submitted.
+func ValidateCreateIndex(req CreateIndexClusterStateUpdateRequest) error {
+	shards := numberOfShards(req.Settings)
+	if shards < 1 {
+		return fmt.Errorf("Failed to parse value [%d] for setting [index.number_of_shards] must be >= 1", shards)
+	}
+	if replicas := numberOfReplicas(req.Settings); replicas < 0 {
+		return fmt.Errorf("Failed to parse value [%d] for setting [index.number_of_replicas] must be >= 0", replicas)
+	}
+	if _, err := refreshInterval(req.Settings); err != nil {
+		return err
+	}
+	if _, err := translogDurability(req.Settings); err != nil {
+		return err
+	}
+	if _, err := translogSyncInterval(req.Settings); err != nil {
+		return err
+	}
+	partitionSize := routingPartitionSize(req.Settings)
+	if partitionSize < 1 {
+		return fmt.Errorf("Failed to parse value [%d] for setting [index.routing_partition_size] must be >= 1", partitionSize)
+	}
+	if partitionSize > 1 {
+		if partitionSize >= shards {
+			return fmt.Errorf("routing partition size [%d] should be a positive number less than the number of shards [%d] for [%s]", partitionSize, shards, req.Index)
+		}
+		if !routingRequired(req.Mappings) {
+			return fmt.Errorf("routing_partition_size requires _routing.required to be true for [%s]", req.Index)
+		}
+	}
+	return nil
+}
+
+// CreateIndex creates the index on the elected master, the request is forwarded when the local node is not the master.
+func (s *MetadataCreateIndexService) CreateIndex(req CreateIndexClusterStateUpdateRequest) error {
+	return s.createIndexAction.Execute(&req, req.MasterTimeout)
+}
+
+func (s *MetadataCreateIndexService) createIndex(req CreateIndexClusterStateUpdateRequest) error {
 	logrus.Infof("Create index - index name: %s, mapping: %s", req.Index, string(req.Mappings))
 
-	s.clusterService.SubmitStateUpdateTask(func(current state.ClusterState) state.ClusterState {
+	source := "create-index [" + req.Index + "], cause [api]"
+	return s.clusterService.SubmitStateUpdateTask(source, req.taskConfig(state.PriorityUrgent), func(current state.ClusterState) state.ClusterState {
 		return s.applyCreateIndex(current, req)
 	})
 }
 
 func (s *MetadataCreateIndexService) applyCreateIndex(current state.ClusterState, req CreateIndexClusterStateUpdateRequest) state.ClusterState {
 	// prepare Settings
-	settings := req.Settings
-	var routingNumShards int
-	if num, ok := settings["number_of_shards"]; ok {
-		routingNumShards = int(num.(float64))
-	} else {
-		routingNumShards = 3
-	}
+	routingNumShards := numberOfShards(req.Settings)
 
 	// prepare indexMetadata
 	indexMetadata := state.IndexMetadata{
@@ -48,21 +235,34 @@ func (s *MetadataCreateIndexService) applyCreateIndex(current state.ClusterState
 			Name: req.Index,
 			Uuid: common.RandomBase64(),
 		},
-		NumberOfShards: routingNumShards,
-		Aliases:        map[string]state.AliasMetadata{},
+		NumberOfShards:   routingNumShards,
+		NumberOfReplicas: numberOfReplicas(req.Settings),
+		Aliases:          map[string]state.AliasMetadata{},
 		Mapping: map[string]state.MappingMetadata{
 			"_doc": {
 				Type:   "_doc",
 				Source: req.Mappings,
 			},
 		},
+		RoutingPartitionSize: routingPartitionSize(req.Settings),
+		RoutingRequired:      routingRequired(req.Mappings),
 	}
+	indexMetadata.RefreshInterval, _ = refreshInterval(req.Settings)
+	indexMetadata.TranslogDurability, _ = translogDurability(req.Settings)
+	indexMetadata.TranslogSyncInterval, _ = translogSyncInterval(req.Settings)
+	indexMetadata.RoutingAllocationRequire = routingAllocationFilter(req.Settings, "require")
+	indexMetadata.RoutingAllocationInclude = routingAllocationFilter(req.Settings, "include")
+	indexMetadata.RoutingAllocationExclude = routingAllocationFilter(req.Settings, "exclude")
 
 	metadata := state.Metadata{
 		Indices: map[string]state.IndexMetadata{
 			indexMetadata.Index.Name: indexMetadata,
 		},
-		IndicesLookup: map[string]state.IndexAbstractionAlias{},
+		IndicesLookup:      map[string]state.IndexAbstractionAlias{},
+		PersistentSettings: current.Metadata.PersistentSettings,
+		TransientSettings:  current.Metadata.TransientSettings,
+		Coordination:       current.Metadata.Coordination,
+		Security:           current.Metadata.Security,
 	}
 	for k, v := range current.Metadata.Indices {
 		metadata.Indices[k] = v
@@ -71,20 +271,33 @@ func (s *MetadataCreateIndexService) applyCreateIndex(current state.ClusterState
 	// regenerate routing table using indexMetadata
 	shards := map[int]state.IndexShardRoutingTable{}
 	for shardNumber := 0; shardNumber < indexMetadata.NumberOfShards; shardNumber++ {
+		shardId := state.ShardId{
+			Index:   indexMetadata.Index,
+			ShardId: shardNumber,
+		}
+		unassignedInfo := state.UnassignedInfo{
+			Reason: state.UnassignedIndexCreated,
+			At:     time.Now(),
+		}
+		replicas := make([]state.ShardRouting, indexMetadata.NumberOfReplicas)
+		for i := range replicas {
+			replicas[i] = state.ShardRouting{
+				ShardId:        shardId,
+				State:          state.ShardUnassigned,
+				UnassignedInfo: unassignedInfo,
+			}
+		}
 		shards[shardNumber] = state.IndexShardRoutingTable{
-			ShardId: state.ShardId{
-				Index:   indexMetadata.Index,
-				ShardId: shardNumber,
-			},
+			ShardId: shardId,
 			Primary: state.ShardRouting{
-				ShardId: state.ShardId{
-					Index:   indexMetadata.Index,
-					ShardId: shardNumber,
-				},
+				ShardId:       shardId,
 				CurrentNodeId: "",
 				//RelocatingNodeId: "",
-				Primary: true,
+				Primary:        true,
+				State:          state.ShardUnassigned,
+				UnassignedInfo: unassignedInfo,
 			},
+			Replicas: replicas,
 		}
 	}
 
@@ -1,30 +1,72 @@
 package cluster
 
 import (
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
+	"strings"
 )
 
 type DeleteIndexClusterStateUpdateRequest struct {
+	AckedRequest
 	Indices []state.Index
 }
 
+func (r *DeleteIndexClusterStateUpdateRequest) WriteTo(out *common.StreamOutput) {
+	r.AckedRequest.WriteTo(out)
+	out.WriteVInt(uint64(len(r.Indices)))
+	for i := range r.Indices {
+		r.Indices[i].WriteTo(out)
+	}
+}
+
+func readDeleteIndexClusterStateUpdateRequest(in *common.StreamInput) (*DeleteIndexClusterStateUpdateRequest, error) {
+	req := DeleteIndexClusterStateUpdateRequest{AckedRequest: readAckedRequest(in)}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.Indices = append(req.Indices, state.ReadIndex(in))
+	}
+	return &req, in.Err()
+}
+
+const DeleteIndexAction = "indices:admin/delete"
+
 type MetadataDeleteIndexService struct {
 	clusterService    state.ClusterService
 	allocationService *AllocationService
+	deleteIndexAction *MasterNodeAction
 }
 
-func NewMetadataDeleteIndexService(clusterService state.ClusterService, allocationService *AllocationService) *MetadataDeleteIndexService {
-	return &MetadataDeleteIndexService{
+func NewMetadataDeleteIndexService(clusterService *Service, allocationService *AllocationService, transportService *transport.Service) *MetadataDeleteIndexService {
+	s := &MetadataDeleteIndexService{
 		clusterService:    clusterService,
 		allocationService: allocationService,
 	}
+	s.deleteIndexAction = NewMasterNodeAction(DeleteIndexAction, clusterService, transportService, func(in *common.StreamInput) error {
+		req, err := readDeleteIndexClusterStateUpdateRequest(in)
+		if err != nil {
+			return err
+		}
+		return s.deleteIndex(*req)
+	})
+	return s
 }
 
-func (s *MetadataDeleteIndexService) DeleteIndex(req DeleteIndexClusterStateUpdateRequest) {
+// DeleteIndex deletes the indices on the elected master, the request is forwarded when the local node is not the master.
+func (s *MetadataDeleteIndexService) DeleteIndex(req DeleteIndexClusterStateUpdateRequest) error {
+	return s.deleteIndexAction.Execute(&req, req.MasterTimeout)
+}
+
+func (s *MetadataDeleteIndexService) deleteIndex(req DeleteIndexClusterStateUpdateRequest) error {
 	logrus.Infof("Delete index - index name: %s", req.Indices)
 
-	s.clusterService.SubmitStateUpdateTask(func(current state.ClusterState) state.ClusterState {
+	var names []string
+	for _, index := range req.Indices {
+		names = append(names, index.Name)
+	}
+	source := "delete-index [" + strings.Join(names, ", ") + "]"
+	return s.clusterService.SubmitStateUpdateTask(source, req.taskConfig(state.PriorityUrgent), func(current state.ClusterState) state.ClusterState {
 		indices := map[state.Index]struct{}{}
 		for _, index := range req.Indices {
 			indices[index] = struct{}{}
@@ -44,7 +86,11 @@ func (s *MetadataDeleteIndexService) deleteIndices(current state.ClusterState, i
 		routingTable.IndicesRouting[k] = v
 	}
 	metadata := state.Metadata{
-		Indices: map[string]state.IndexMetadata{},
+		Indices:            map[string]state.IndexMetadata{},
+		PersistentSettings: meta.PersistentSettings,
+		TransientSettings:  meta.TransientSettings,
+		Coordination:       meta.Coordination,
+		Security:           meta.Security,
 	}
 	for k, v := range meta.Indices {
 		metadata.Indices[k] = v
@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const defaultMasterTimeout = 30 * time.Second
+
+// masterNodeResponse is the outcome of a request run on the master.
+type masterNodeResponse struct {
+	// NotMaster is set when the node receiving the request is no longer the master, it is sent again to the new one
+	NotMaster                  bool
+	NotAcknowledged            bool
+	FailedToCommit             *state.FailedToCommitError
+	ProcessClusterEventTimeout *state.ProcessClusterEventTimeoutError
+	Error                      string
+}
+
+func newMasterNodeResponse(err error) *masterNodeResponse {
+	response := &masterNodeResponse{}
+	switch e := err.(type) {
+	case nil:
+	case *state.FailedToCommitError:
+		response.FailedToCommit = e
+	case *state.ProcessClusterEventTimeoutError:
+		response.ProcessClusterEventTimeout = e
+	default:
+		if err == state.ErrNotAcknowledged {
+			response.NotAcknowledged = true
+		} else {
+			response.Error = err.Error()
+		}
+	}
+	return response
+}
+
+func (r *masterNodeResponse) err() error {
+	switch {
+	case r.NotAcknowledged:
+		return state.ErrNotAcknowledged
+	case r.FailedToCommit != nil:
+		return r.FailedToCommit
+	case r.ProcessClusterEventTimeout != nil:
+		return r.ProcessClusterEventTimeout
+	case r.Error != "":
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+func (r *masterNodeResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteBool(r.NotMaster)
+	out.WriteBool(r.NotAcknowledged)
+	out.WriteBool(r.FailedToCommit != nil)
+	if r.FailedToCommit != nil {
+		out.WriteString(r.FailedToCommit.Reason)
+	}
+	out.WriteBool(r.ProcessClusterEventTimeout != nil)
+	if r.ProcessClusterEventTimeout != nil {
+		out.WriteString(r.ProcessClusterEventTimeout.Source)
+		out.WriteDuration(r.ProcessClusterEventTimeout.Timeout)
+	}
+	out.WriteString(r.Error)
+}
+
+func readMasterNodeResponse(in *common.StreamInput) (*masterNodeResponse, error) {
+	response := masterNodeResponse{
+		NotMaster:       in.ReadBool(),
+		NotAcknowledged: in.ReadBool(),
+	}
+	if in.ReadBool() {
+		response.FailedToCommit = &state.FailedToCommitError{Reason: in.ReadString()}
+	}
+	if in.ReadBool() {
+		response.ProcessClusterEventTimeout = &state.ProcessClusterEventTimeoutError{
+			Source:  in.ReadString(),
+			Timeout: in.ReadDuration(),
+		}
+	}
+	response.Error = in.ReadString()
+	return &response, in.Err()
+}
+
+// MasterNodeAction runs a request on the elected master. A node that is not the master forwards the request to it,
+// and sends it again to the new master when the master changes before replying.
+type MasterNodeAction struct {
+	name             string
+	clusterService   *Service
+	transportService *transport.Service
+	masterOperation  func(in *common.StreamInput) error
+}
+
+// NewMasterNodeAction registers the action, masterOperation reads the request from the stream and runs it.
+func NewMasterNodeAction(name string, clusterService *Service, transportService *transport.Service, masterOperation func(in *common.StreamInput) error) *MasterNodeAction {
+	a := &MasterNodeAction{
+		name:             name,
+		clusterService:   clusterService,
+		transportService: transportService,
+		masterOperation:  masterOperation,
+	}
+	transportService.RegisterRequestHandler(name, func(channel transport.ReplyChannel, req []byte) {
+		if !a.isLocalNodeMaster(clusterService.State()) {
+			channel.SendMessage("", common.ToBytes(&masterNodeResponse{NotMaster: true}, channel.GetVersion()))
+			return
+		}
+		err := a.masterOperation(common.NewStreamInput(req, channel.GetVersion()))
+		channel.SendMessage("", common.ToBytes(newMasterNodeResponse(err), channel.GetVersion()))
+	})
+	return a
+}
+
+func (a *MasterNodeAction) isLocalNodeMaster(clusterState *state.ClusterState) bool {
+	return clusterState != nil && clusterState.Nodes != nil && clusterState.Nodes.MasterNodeId == a.transportService.LocalNode.Id
+}
+
+func hasMaster(clusterState *state.ClusterState) bool {
+	if clusterState == nil || clusterState.Nodes == nil {
+		return false
+	}
+	_, existing := clusterState.Nodes.Nodes[clusterState.Nodes.MasterNodeId]
+	return existing
+}
+
+// Execute runs the request on the master and returns the error of the operation, or a MasterNotDiscoveredError when
+// no master could run it within the master timeout, 30s when zero.
+func (a *MasterNodeAction) Execute(request common.Writeable, masterTimeout time.Duration) error {
+	if masterTimeout <= 0 {
+		masterTimeout = defaultMasterTimeout
+	}
+	deadline := time.Now().Add(masterTimeout)
+	for {
+		clusterState, found := a.clusterService.ApplierService.WaitForState(hasMaster, time.Until(deadline))
+		if !found {
+			return &state.MasterNotDiscoveredError{Timeout: masterTimeout}
+		}
+		if a.isLocalNodeMaster(clusterState) {
+			return a.masterOperation(common.NewStreamInput(common.ToBytes(request, common.CurrentVersion), common.CurrentVersion))
+		}
+
+		master := clusterState.Nodes.MasterNode()
+		if response := a.sendToMaster(master, request, time.Until(deadline)); response != nil && !response.NotMaster {
+			return response.err()
+		}
+		logrus.Warnf("MasterNodeAction: [%s] was not run by the master [%s], waiting for a new master", a.name, master.Name)
+		if _, changed := a.clusterService.ApplierService.WaitForState(func(newState *state.ClusterState) bool {
+			return newState != clusterState
+		}, time.Until(deadline)); !changed {
+			return &state.MasterNotDiscoveredError{Timeout: masterTimeout}
+		}
+	}
+}
+
+// sendToMaster forwards the request to the master, it returns nil when the master could not be reached within the
+// timeout or another master was elected before it replied.
+func (a *MasterNodeAction) sendToMaster(master state.Node, request common.Writeable, timeout time.Duration) *masterNodeResponse {
+	responses := make(chan *masterNodeResponse, 1)
+	a.transportService.ConnectToRemoteNode(master.HostAddress, func(node *state.Node) {
+		if node == nil {
+			responses <- nil
+			return
+		}
+		version := a.transportService.GetVersion(*node)
+		a.transportService.SendRequestWithHandler(*node, a.name, common.ToBytes(request, version), transport.RequestOptions{Timeout: timeout}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				masterResponse, err := readMasterNodeResponse(common.NewStreamInput(response, version))
+				if err != nil {
+					masterResponse = &masterNodeResponse{Error: err.Error()}
+				}
+				responses <- masterResponse
+			},
+			OnFailure: func(err error) {
+				if transport.IsRetryable(err) {
+					logrus.Warnf("MasterNodeAction: failed to send [%s] to the master [%s]: %v", a.name, master.Name, err)
+					responses <- nil
+					return
+				}
+				responses <- &masterNodeResponse{Error: err.Error()}
+			},
+		})
+	})
+	for {
+		clusterState, stateApplied := a.clusterService.ApplierService.appliedState()
+		if !hasMaster(clusterState) || clusterState.Nodes.MasterNodeId != master.Id {
+			return nil
+		}
+		select {
+		case response := <-responses:
+			return response
+		case <-stateApplied:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// testTransport delivers the requests to the transports of the same network in memory.
+type testTransport struct {
+	address  string
+	nodeId   string
+	handlers map[string]transport.RequestHandler
+	network  map[string]*testTransport
+}
+
+func (t *testTransport) OpenConnection(address string, callback func(conn transport.Connection)) {
+	remote, existing := t.network[address]
+	if !existing {
+		callback(&testConnection{err: "Failed to connect to " + address})
+		return
+	}
+	callback(&testConnection{local: t, remote: remote})
+}
+func (t *testTransport) Start(port int) {}
+func (t *testTransport) Register(action string, handler transport.RequestHandler) {
+	t.handlers[action] = handler
+}
+func (t *testTransport) GetLocalAddress() string                           { return t.address }
+func (t *testTransport) GetSeedHosts() []string                            { return nil }
+func (t *testTransport) GetNodeId() string                                 { return t.nodeId }
+func (t *testTransport) GetHandler(action string) transport.RequestHandler { return t.handlers[action] }
+func (t *testTransport) Stats() transport.Stats                            { return transport.Stats{} }
+
+type testConnection struct {
+	local  *testTransport
+	remote *testTransport
+	err    string
+}
+
+func (c *testConnection) SendRequest(action string, req []byte, options transport.RequestOptions, handler transport.ResponseHandler) {
+	go c.remote.handlers[action](&testReplyChannel{handler: handler}, req)
+}
+func (c *testConnection) GetSourceAddress() string   { return c.local.address }
+func (c *testConnection) GetDestAddress() string     { return c.remote.address }
+func (c *testConnection) GetMessage() string         { return c.err }
+func (c *testConnection) GetVersion() common.Version { return common.CurrentVersion }
+
+type testReplyChannel struct {
+	handler transport.ResponseHandler
+}
+
+func (c *testReplyChannel) SendMessage(action string, content []byte) (int, error) {
+	c.handler.OnResponse(content)
+	return len(content), nil
+}
+func (c *testReplyChannel) SendError(err error) error {
+	c.handler.OnFailure(err)
+	return nil
+}
+func (c *testReplyChannel) GetSourceAddress() string   { return "" }
+func (c *testReplyChannel) GetDestAddress() string     { return "" }
+func (c *testReplyChannel) GetVersion() common.Version { return common.CurrentVersion }
+
+type masterNodeActionTestRequest string
+
+func (r masterNodeActionTestRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(string(r))
+}
+
+func masterNodeActionTestState(masterNodeId string, localNodeId string, nodes ...state.Node) *state.ClusterState {
+	clusterState := &state.ClusterState{
+		Nodes: &state.Nodes{
+			Nodes:        map[string]state.Node{},
+			DataNodes:    map[string]state.Node{},
+			MasterNodes:  map[string]state.Node{},
+			MasterNodeId: masterNodeId,
+			LocalNodeId:  localNodeId,
+		},
+	}
+	for _, node := range nodes {
+		clusterState.Nodes.Add(node)
+	}
+	return clusterState
+}
+
+func TestMasterNodeAction_Execute(t *testing.T) {
+	// Arrange
+	network := map[string]*testTransport{}
+	var nodes []state.Node
+	var clusterServices []*Service
+	var actions []*MasterNodeAction
+	operations := make(chan string, 3)
+	for _, name := range []string{"node1", "node2", "node3"} {
+		name := name
+		address := name + ":8180"
+		network[address] = &testTransport{
+			address:  address,
+			nodeId:   name + "Id",
+			handlers: map[string]transport.RequestHandler{},
+			network:  network,
+		}
+		transportService := transport.NewService(network[address], name)
+		clusterService := NewService()
+		action := NewMasterNodeAction("test", clusterService, transportService, func(in *common.StreamInput) error {
+			operations <- name + " " + in.ReadString()
+			return errors.New("failed on " + name)
+		})
+		nodes = append(nodes, *transportService.LocalNode)
+		clusterServices = append(clusterServices, clusterService)
+		actions = append(actions, action)
+	}
+	clusterServices[0].ApplierService.ClusterState = masterNodeActionTestState("node2Id", "node1Id", nodes...)
+	clusterServices[1].ApplierService.ClusterState = masterNodeActionTestState("node2Id", "node2Id", nodes...)
+	// node3 still follows node1 which is no longer the master
+	clusterServices[2].ApplierService.ClusterState = masterNodeActionTestState("node1Id", "node3Id", nodes...)
+	noMaster := NewService()
+	noMaster.ApplierService.ClusterState = masterNodeActionTestState("", "node4Id", nodes...)
+	noMasterAction := &MasterNodeAction{clusterService: noMaster, transportService: actions[2].transportService}
+
+	// Action
+	forwardedErr := actions[0].Execute(masterNodeActionTestRequest("forwarded"), time.Second)
+	forwarded := <-operations
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		clusterServices[2].ApplierService.OnNewState("test", masterNodeActionTestState("node2Id", "node3Id", nodes...), nil)
+	}()
+	retriedErr := actions[2].Execute(masterNodeActionTestRequest("retried"), time.Second)
+	retried := <-operations
+	notDiscoveredErr := noMasterAction.Execute(masterNodeActionTestRequest("not discovered"), 10*time.Millisecond)
+
+	// Assert
+	assert.Equal(t, "node2 forwarded", forwarded)
+	assert.EqualError(t, forwardedErr, "failed on node2")
+	// node1 tells it is not the master, node3 waits until it learns node2 was elected
+	assert.Equal(t, "node2 retried", retried)
+	assert.EqualError(t, retriedErr, "failed on node2")
+	assert.IsType(t, &state.MasterNotDiscoveredError{}, notDiscoveredErr)
+	assert.Len(t, operations, 0)
+}
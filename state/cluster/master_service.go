@@ -0,0 +1,325 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TaskExecutor computes the state of a batch of tasks, the queued tasks submitted with the same executor run
+// together and their state is published once. It returns an error for every task it did not apply, or nil when
+// it applied all of them.
+type TaskExecutor struct {
+	Execute func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error)
+}
+
+// TaskListener is told the outcome of a task, exactly once.
+type TaskListener struct {
+	// OnSuccess is called once the state of the task is committed, acknowledged when every node applied it in time
+	OnSuccess func(acknowledged bool)
+	// OnFailure is called when the task failed, timed out in the queue or its state was not committed
+	OnFailure func(err error)
+}
+
+type queuedTask struct {
+	insertOrder int64
+	source      string
+	task        interface{}
+	config      state.TaskConfig
+	executor    *TaskExecutor
+	listener    TaskListener
+	queuedAt    time.Time
+	// masterTimeout fails the task while it is queued
+	masterTimeout *time.Timer
+	// notified tells the listener once, e.g. the ack timeout races the end of the publication
+	notified sync.Once
+}
+
+func (t *queuedTask) onSuccess(acknowledged bool) {
+	t.notified.Do(func() {
+		if t.listener.OnSuccess != nil {
+			t.listener.OnSuccess(acknowledged)
+		}
+	})
+}
+
+func (t *queuedTask) onFailure(err error) {
+	t.notified.Do(func() {
+		if t.listener.OnFailure != nil {
+			t.listener.OnFailure(err)
+		}
+	})
+}
+
+// PendingTask is a task queued or executing on the master, as listed by the pending tasks API.
+type PendingTask struct {
+	InsertOrder int64
+	Priority    state.Priority
+	Source      string
+	Executing   bool
+	TimeInQueue time.Duration
+}
+
+// MasterService runs the cluster state update tasks one batch at a time on its own goroutine, the most urgent
+// first and in submission order within a priority.
+type MasterService struct {
+	ClusterStatePublish func(event state.ClusterChangedEvent) error
+
+	// clusterState is the last state committed, the tasks run on it
+	clusterState *state.ClusterState
+	stateMux     sync.RWMutex
+
+	// stateUpdateExecutor runs the state update tasks queued together in submission order
+	stateUpdateExecutor *TaskExecutor
+
+	queue       []*queuedTask
+	executing   []*queuedTask
+	insertOrder int64
+	queueMux    sync.Mutex
+	queueCond   *sync.Cond
+}
+
+func newMasterService() *MasterService {
+	s := &MasterService{
+		stateUpdateExecutor: &TaskExecutor{
+			Execute: func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error) {
+				for _, task := range tasks {
+					current = task.(state.ClusterStateUpdateTask)(current)
+				}
+				return current, nil
+			},
+		},
+	}
+	s.queueCond = sync.NewCond(&s.queueMux)
+	go s.run()
+	return s
+}
+
+// State returns the last state committed.
+func (s *MasterService) State() *state.ClusterState {
+	s.stateMux.RLock()
+	defer s.stateMux.RUnlock()
+	return s.clusterState
+}
+
+// SetState sets the state the next tasks run on, once it is committed.
+func (s *MasterService) SetState(clusterState *state.ClusterState) {
+	s.stateMux.Lock()
+	s.clusterState = clusterState
+	s.stateMux.Unlock()
+}
+
+// SubmitTask queues a task, the listener is told its outcome.
+func (s *MasterService) SubmitTask(source string, task interface{}, config state.TaskConfig, executor *TaskExecutor, listener TaskListener) {
+	s.queueMux.Lock()
+	defer s.queueMux.Unlock()
+
+	s.insertOrder++
+	queued := &queuedTask{
+		insertOrder: s.insertOrder,
+		source:      source,
+		task:        task,
+		config:      config,
+		executor:    executor,
+		listener:    listener,
+		queuedAt:    time.Now(),
+	}
+	if config.MasterTimeout > 0 {
+		queued.masterTimeout = time.AfterFunc(config.MasterTimeout, func() {
+			if s.remove(queued) {
+				logrus.Warnf("MasterService: task [%s] timed out after %v in the queue", source, config.MasterTimeout)
+				queued.onFailure(&state.ProcessClusterEventTimeoutError{Source: source, Timeout: config.MasterTimeout})
+			}
+		})
+	}
+	s.queue = append(s.queue, queued)
+	s.queueCond.Signal()
+}
+
+// SubmitStateUpdateTask queues the task and waits until its state is published, along with the other state update
+// tasks queued meanwhile.
+func (s *MasterService) SubmitStateUpdateTask(source string, config state.TaskConfig, task state.ClusterStateUpdateTask) error {
+	result := make(chan error, 1)
+	s.SubmitTask(source, task, config, s.stateUpdateExecutor, TaskListener{
+		OnSuccess: func(acknowledged bool) {
+			if !acknowledged {
+				result <- state.ErrNotAcknowledged
+				return
+			}
+			result <- nil
+		},
+		OnFailure: func(err error) {
+			result <- err
+		},
+	})
+	return <-result
+}
+
+// PendingTasks lists the executing tasks and the queued ones in the order they will run.
+func (s *MasterService) PendingTasks() []PendingTask {
+	s.queueMux.Lock()
+	defer s.queueMux.Unlock()
+
+	now := time.Now()
+	var pendingTasks []PendingTask
+	for _, queued := range s.executing {
+		pendingTasks = append(pendingTasks, queued.pendingTask(now, true))
+	}
+	queue := append([]*queuedTask{}, s.queue...)
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].config.Priority < queue[j].config.Priority
+	})
+	for _, queued := range queue {
+		pendingTasks = append(pendingTasks, queued.pendingTask(now, false))
+	}
+	return pendingTasks
+}
+
+func (t *queuedTask) pendingTask(now time.Time, executing bool) PendingTask {
+	return PendingTask{
+		InsertOrder: t.insertOrder,
+		Priority:    t.config.Priority,
+		Source:      t.source,
+		Executing:   executing,
+		TimeInQueue: now.Sub(t.queuedAt),
+	}
+}
+
+func (s *MasterService) remove(queued *queuedTask) bool {
+	s.queueMux.Lock()
+	defer s.queueMux.Unlock()
+	for i, t := range s.queue {
+		if t == queued {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MasterService) run() {
+	for {
+		s.queueMux.Lock()
+		for len(s.queue) == 0 {
+			s.queueCond.Wait()
+		}
+		batch := s.nextBatch()
+		s.executing = batch
+		s.queueMux.Unlock()
+
+		s.runBatch(batch)
+
+		s.queueMux.Lock()
+		s.executing = nil
+		s.queueMux.Unlock()
+	}
+}
+
+// nextBatch takes the most urgent task queued first, with the other queued tasks of its executor.
+func (s *MasterService) nextBatch() []*queuedTask {
+	next := s.queue[0]
+	for _, queued := range s.queue[1:] {
+		if queued.config.Priority < next.config.Priority {
+			next = queued
+		}
+	}
+	var batch, rest []*queuedTask
+	for _, queued := range s.queue {
+		if queued.executor != next.executor {
+			rest = append(rest, queued)
+			continue
+		}
+		if queued.masterTimeout != nil {
+			queued.masterTimeout.Stop()
+		}
+		batch = append(batch, queued)
+	}
+	s.queue = rest
+	return batch
+}
+
+func (s *MasterService) runBatch(batch []*queuedTask) {
+	tasks := make([]interface{}, len(batch))
+	for i, queued := range batch {
+		tasks[i] = queued.task
+	}
+	previousState := *s.State()
+	newState, errs := batch[0].executor.Execute(previousState, tasks)
+	if errs != nil && len(errs) != len(batch) {
+		err := fmt.Errorf("the executor of [%s] returned %d results for %d tasks", batch[0].source, len(errs), len(batch))
+		logrus.Error(err)
+		for _, queued := range batch {
+			queued.onFailure(err)
+		}
+		return
+	}
+
+	var applied []*queuedTask
+	for i, queued := range batch {
+		if errs != nil && errs[i] != nil {
+			queued.onFailure(errs[i])
+			continue
+		}
+		applied = append(applied, queued)
+	}
+	if len(applied) == 0 {
+		return
+	}
+
+	for _, queued := range applied {
+		if queued.config.AckTimeout > 0 {
+			queued := queued
+			ackTimeout := time.AfterFunc(queued.config.AckTimeout, func() {
+				queued.onSuccess(false)
+			})
+			defer ackTimeout.Stop()
+		}
+	}
+
+	startTime := time.Now()
+	err := s.ClusterStatePublish(state.ClusterChangedEvent{
+		State:     newState,
+		PrevState: previousState,
+	})
+	logrus.Infof("MasterService: published the state of [%s] and %d other tasks in %v", batch[0].source, len(batch)-1, time.Since(startTime))
+	for _, queued := range applied {
+		switch err {
+		case nil:
+			queued.onSuccess(true)
+		case state.ErrNotAcknowledged:
+			queued.onSuccess(false)
+		default:
+			queued.onFailure(err)
+		}
+	}
+}
+
+// AckedRequest carries the timeout and master_timeout parameters of an API updating the cluster state.
+type AckedRequest struct {
+	AckTimeout    time.Duration
+	MasterTimeout time.Duration
+}
+
+func (r *AckedRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteDuration(r.AckTimeout)
+	out.WriteDuration(r.MasterTimeout)
+}
+
+func readAckedRequest(in *common.StreamInput) AckedRequest {
+	return AckedRequest{
+		AckTimeout:    in.ReadDuration(),
+		MasterTimeout: in.ReadDuration(),
+	}
+}
+
+func (r AckedRequest) taskConfig(priority state.Priority) state.TaskConfig {
+	return state.TaskConfig{
+		Priority:      priority,
+		MasterTimeout: r.MasterTimeout,
+		AckTimeout:    r.AckTimeout,
+	}
+}
@@ -0,0 +1,177 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMasterService_SubmitTask(t *testing.T) {
+	// Arrange
+	masterService := newMasterService()
+	masterService.SetState(&state.ClusterState{})
+	release := make(chan struct{})
+	publications := 0
+	masterService.ClusterStatePublish = func(event state.ClusterChangedEvent) error {
+		<-release
+		publications++
+		masterService.SetState(&event.State)
+		return nil
+	}
+	var batches [][]interface{}
+	newExecutor := func() *TaskExecutor {
+		return &TaskExecutor{
+			Execute: func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error) {
+				batches = append(batches, tasks)
+				return current, nil
+			},
+		}
+	}
+	results := make(chan string, 5)
+	listener := func(name string) TaskListener {
+		return TaskListener{
+			OnSuccess: func(acknowledged bool) {
+				results <- name
+			},
+			OnFailure: func(err error) {
+				results <- name + " " + err.Error()
+			},
+		}
+	}
+	urgentExecutor := newExecutor()
+
+	// Action
+	masterService.SubmitTask("first", "first", state.TaskConfig{Priority: state.PriorityNormal}, newExecutor(), listener("first"))
+	time.Sleep(50 * time.Millisecond)
+	masterService.SubmitTask("low", "low", state.TaskConfig{Priority: state.PriorityLow}, newExecutor(), listener("low"))
+	masterService.SubmitTask("urgent-1", "urgent-1", state.TaskConfig{Priority: state.PriorityUrgent}, urgentExecutor, listener("urgent-1"))
+	masterService.SubmitTask("urgent-2", "urgent-2", state.TaskConfig{Priority: state.PriorityUrgent}, urgentExecutor, listener("urgent-2"))
+	masterService.SubmitTask("timed-out", "timed-out", state.TaskConfig{Priority: state.PriorityNormal, MasterTimeout: 10 * time.Millisecond}, newExecutor(), listener("timed-out"))
+	time.Sleep(50 * time.Millisecond)
+	pendingTasks := masterService.PendingTasks()
+	close(release)
+	var outcomes []string
+	for i := 0; i < 5; i++ {
+		outcomes = append(outcomes, <-results)
+	}
+
+	// Assert
+	assert.Equal(t, "timed-out failed to process cluster event (timed-out) within 10ms", outcomes[0])
+	assert.Equal(t, []string{"first", "urgent-1", "urgent-2", "low"}, outcomes[1:])
+	if assert.Len(t, pendingTasks, 4) {
+		assert.True(t, pendingTasks[0].Executing)
+		assert.Equal(t, "urgent-1", pendingTasks[1].Source)
+		assert.Equal(t, state.PriorityUrgent, pendingTasks[2].Priority)
+		assert.Equal(t, "low", pendingTasks[3].Source)
+	}
+	// the tasks of the same executor are published once
+	assert.Equal(t, [][]interface{}{{"first"}, {"urgent-1", "urgent-2"}, {"low"}}, batches)
+	assert.Equal(t, 3, publications)
+}
+
+func TestMasterService_SubmitStateUpdateTask(t *testing.T) {
+	// Arrange
+	masterService := newMasterService()
+	masterService.SetState(&state.ClusterState{})
+	masterService.ClusterStatePublish = func(event state.ClusterChangedEvent) error {
+		if event.State.Name == "not-committed" {
+			return &state.FailedToCommitError{Reason: "test"}
+		}
+		return state.ErrNotAcknowledged
+	}
+
+	// Action
+	notAcknowledged := masterService.SubmitStateUpdateTask("test", state.TaskConfig{}, func(current state.ClusterState) state.ClusterState {
+		return current
+	})
+	notCommitted := masterService.SubmitStateUpdateTask("test", state.TaskConfig{}, func(current state.ClusterState) state.ClusterState {
+		current.Name = "not-committed"
+		return current
+	})
+
+	// Assert
+	assert.Equal(t, state.ErrNotAcknowledged, notAcknowledged)
+	assert.IsType(t, &state.FailedToCommitError{}, notCommitted)
+}
+
+func TestMasterService_SubmitStateUpdateTaskBatched(t *testing.T) {
+	// Arrange
+	masterService := newMasterService()
+	masterService.SetState(&state.ClusterState{})
+	release := make(chan struct{})
+	var published []string
+	masterService.ClusterStatePublish = func(event state.ClusterChangedEvent) error {
+		<-release
+		published = append(published, event.State.Name)
+		masterService.SetState(&event.State)
+		return nil
+	}
+	blocking := &TaskExecutor{
+		Execute: func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error) {
+			return current, nil
+		},
+	}
+	appendName := func(name string) state.ClusterStateUpdateTask {
+		return func(current state.ClusterState) state.ClusterState {
+			current.Name += name
+			return current
+		}
+	}
+	masterService.SubmitTask("blocking", "blocking", state.TaskConfig{}, blocking, TaskListener{})
+	time.Sleep(50 * time.Millisecond)
+
+	// Action
+	errs := make(chan error, 2)
+	go func() {
+		errs <- masterService.SubmitStateUpdateTask("a", state.TaskConfig{}, appendName("a"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		errs <- masterService.SubmitStateUpdateTask("b", state.TaskConfig{}, appendName("b"))
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	// Assert
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+	// the tasks queued while the blocking one was published run in one batch, in submission order
+	assert.Equal(t, []string{"", "ab"}, published)
+}
+
+func TestMasterService_runBatchResultsMismatch(t *testing.T) {
+	// Arrange
+	masterService := newMasterService()
+	masterService.SetState(&state.ClusterState{})
+	publications := 0
+	masterService.ClusterStatePublish = func(event state.ClusterChangedEvent) error {
+		publications++
+		return nil
+	}
+	executor := &TaskExecutor{
+		Execute: func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error) {
+			return current, []error{nil}
+		},
+	}
+	results := make(chan error, 2)
+	listener := TaskListener{
+		OnSuccess: func(acknowledged bool) {
+			results <- nil
+		},
+		OnFailure: func(err error) {
+			results <- err
+		},
+	}
+
+	// Action
+	masterService.runBatch([]*queuedTask{
+		{source: "first", task: "first", executor: executor, listener: listener},
+		{source: "second", task: "second", executor: executor, listener: listener},
+	})
+
+	// Assert
+	assert.EqualError(t, <-results, "the executor of [first] returned 1 results for 2 tasks")
+	assert.NotNil(t, <-results)
+	assert.Equal(t, 0, publications)
+}
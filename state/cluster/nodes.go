@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+)
+
+// AddNodes adds the nodes joining a running cluster, then moves shards to them.
+func (s *AllocationService) AddNodes(clusterState state.ClusterState, nodes []state.Node) state.ClusterState {
+	newNodes := copyNodes(clusterState.Nodes)
+	for _, node := range nodes {
+		newNodes.Add(node)
+	}
+	clusterState.Nodes = newNodes
+	return s.reroute(clusterState)
+}
+
+// RemoveNodes removes the nodes that left the cluster, then reassigns their shards.
+func (s *AllocationService) RemoveNodes(clusterState state.ClusterState, nodeIds []string) state.ClusterState {
+	newNodes := copyNodes(clusterState.Nodes)
+	for _, nodeId := range nodeIds {
+		newNodes.Remove(nodeId)
+	}
+	clusterState.Nodes = newNodes
+	return s.reroute(clusterState)
+}
+
+func copyNodes(nodes *state.Nodes) *state.Nodes {
+	newNodes := &state.Nodes{
+		Nodes:        map[string]state.Node{},
+		DataNodes:    map[string]state.Node{},
+		MasterNodes:  map[string]state.Node{},
+		MasterNodeId: nodes.MasterNodeId,
+		LocalNodeId:  nodes.LocalNodeId,
+	}
+	for id, node := range nodes.Nodes {
+		newNodes.Nodes[id] = node
+	}
+	for id, node := range nodes.DataNodes {
+		newNodes.DataNodes[id] = node
+	}
+	for id, node := range nodes.MasterNodes {
+		newNodes.MasterNodes[id] = node
+	}
+	return newNodes
+}
@@ -3,14 +3,71 @@ package cluster
 import (
 	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
+	"sort"
+	"strings"
 )
 
-func IndexShard(clusterState state.ClusterState, index string, id string) state.IndexShardRoutingTable {
+// ShardId computes the shard of a document. The routing value replaces the id in the computation when given,
+// and with a routing partition size the id picks one of the shards of the routing partition.
+func ShardId(indexMetadata state.IndexMetadata, id string, routing string) int {
+	if routing == "" {
+		return common.MurMur3Hash(id) % indexMetadata.NumberOfShards
+	}
+	partitionOffset := 0
+	if indexMetadata.RoutingPartitionSize > 1 {
+		partitionOffset = common.MurMur3Hash(id) % indexMetadata.RoutingPartitionSize
+	}
+	return (common.MurMur3Hash(routing) + partitionOffset) % indexMetadata.NumberOfShards
+}
+
+func IndexShard(clusterState state.ClusterState, index string, id string, routing string) state.IndexShardRoutingTable {
 	indexMetadata := clusterState.Metadata.Indices[index]
-	shardId := common.MurMur3Hash(id) % indexMetadata.NumberOfShards
+	shardId := ShardId(indexMetadata, id, routing)
 	return clusterState.RoutingTable.IndicesRouting[index].Shards[shardId]
 }
 
-func GetShards(clusterState state.ClusterState, index string, id string) state.IndexShardRoutingTable {
-	return IndexShard(clusterState, index, id)
+func GetShards(clusterState state.ClusterState, index string, id string, routing string) state.IndexShardRoutingTable {
+	return IndexShard(clusterState, index, id, routing)
+}
+
+// SearchShards returns the shards a search has to visit. Without routing that is every shard of the index,
+// otherwise only the shards the comma separated routing values can send documents to.
+func SearchShards(clusterState state.ClusterState, index string, routing string) []state.IndexShardRoutingTable {
+	indexMetadata := clusterState.Metadata.Indices[index]
+	indexRoutingTable := clusterState.RoutingTable.IndicesRouting[index]
+
+	// empty routing values, e.g. the trailing one of "a,", are ignored
+	var routings []string
+	for _, r := range strings.Split(routing, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			routings = append(routings, r)
+		}
+	}
+
+	shardIds := map[int]bool{}
+	if len(routings) == 0 {
+		for shardId := range indexRoutingTable.Shards {
+			shardIds[shardId] = true
+		}
+	} else {
+		partitionSize := indexMetadata.RoutingPartitionSize
+		if partitionSize < 1 {
+			partitionSize = 1
+		}
+		for _, r := range routings {
+			hash := common.MurMur3Hash(r)
+			for offset := 0; offset < partitionSize; offset++ {
+				shardIds[(hash+offset)%indexMetadata.NumberOfShards] = true
+			}
+		}
+	}
+
+	shards := make([]state.IndexShardRoutingTable, 0, len(shardIds))
+	for shardId := range shardIds {
+		shards = append(shards, indexRoutingTable.Shards[shardId])
+	}
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].ShardId.ShardId < shards[j].ShardId.ShardId
+	})
+	return shards
 }
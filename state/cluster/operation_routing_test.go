@@ -1 +1,126 @@
 package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newRoutingTestState(shards int, partitionSize int) state.ClusterState {
+	index := state.Index{Name: "test", Uuid: "test-uuid"}
+	indexRoutingTable := state.IndexRoutingTable{
+		Index:  index,
+		Shards: map[int]state.IndexShardRoutingTable{},
+	}
+	for i := 0; i < shards; i++ {
+		indexRoutingTable.Shards[i] = state.IndexShardRoutingTable{
+			ShardId: state.ShardId{Index: index, ShardId: i},
+		}
+	}
+	return state.ClusterState{
+		Metadata: state.Metadata{
+			Indices: map[string]state.IndexMetadata{
+				"test": {
+					Index:                index,
+					NumberOfShards:       shards,
+					RoutingPartitionSize: partitionSize,
+				},
+			},
+		},
+		RoutingTable: state.RoutingTable{
+			IndicesRouting: map[string]state.IndexRoutingTable{
+				"test": indexRoutingTable,
+			},
+		},
+	}
+}
+
+func TestIndexShard_Routing(t *testing.T) {
+	// Arrange
+	clusterState := newRoutingTestState(8, 1)
+
+	// Action
+	shards := map[int]bool{}
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		shards[IndexShard(clusterState, "test", id, "user1").ShardId.ShardId] = true
+	}
+
+	// Assert
+	assert.Equal(t, 1, len(shards))
+	assert.Equal(t, 1, len(SearchShards(clusterState, "test", "user1")))
+	assert.Equal(t, 8, len(SearchShards(clusterState, "test", "")))
+	assert.Equal(t, SearchShards(clusterState, "test", "user1"), SearchShards(clusterState, "test", "user1,"))
+	assert.Equal(t, 8, len(SearchShards(clusterState, "test", ",")))
+}
+
+func TestIndexShard_RoutingPartition(t *testing.T) {
+	// Arrange
+	clusterState := newRoutingTestState(8, 3)
+	searchShards := map[int]bool{}
+	for _, shard := range SearchShards(clusterState, "test", "user1") {
+		searchShards[shard.ShardId.ShardId] = true
+	}
+
+	// Action
+	shards := map[int]bool{}
+	for _, id := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"} {
+		shards[IndexShard(clusterState, "test", id, "user1").ShardId.ShardId] = true
+	}
+
+	// Assert
+	assert.Equal(t, 3, len(searchShards))
+	for shard := range shards {
+		assert.True(t, searchShards[shard])
+	}
+}
+
+func TestValidateCreateIndex(t *testing.T) {
+	assert.Nil(t, ValidateCreateIndex(CreateIndexClusterStateUpdateRequest{
+		Index:    "test",
+		Mappings: []byte(`{"_routing": {"required": true}}`),
+		Settings: map[string]interface{}{"number_of_shards": 4.0, "routing_partition_size": 2.0},
+	}))
+	assert.NotNil(t, ValidateCreateIndex(CreateIndexClusterStateUpdateRequest{
+		Index:    "test",
+		Mappings: []byte(`{}`),
+		Settings: map[string]interface{}{"number_of_shards": 4.0, "routing_partition_size": 2.0},
+	}))
+	assert.NotNil(t, ValidateCreateIndex(CreateIndexClusterStateUpdateRequest{
+		Index:    "test",
+		Mappings: []byte(`{"_routing": {"required": true}}`),
+		Settings: map[string]interface{}{"number_of_shards": 2.0, "routing_partition_size": 2.0},
+	}))
+}
+
+func TestRefreshInterval(t *testing.T) {
+	interval, err := refreshInterval(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, interval)
+
+	interval, _ = refreshInterval(map[string]interface{}{"index.refresh_interval": "30s"})
+	assert.Equal(t, 30*time.Second, interval)
+	interval, _ = refreshInterval(map[string]interface{}{"refresh_interval": "-1"})
+	assert.Equal(t, time.Duration(-1), interval)
+
+	assert.NotNil(t, ValidateCreateIndex(CreateIndexClusterStateUpdateRequest{
+		Index:    "test",
+		Settings: map[string]interface{}{"refresh_interval": "soon"},
+	}))
+}
+
+func TestTranslogSettings(t *testing.T) {
+	durability, _ := translogDurability(map[string]interface{}{})
+	assert.Equal(t, "request", durability)
+	interval, _ := translogSyncInterval(map[string]interface{}{"index.translog.sync_interval": "1s"})
+	assert.Equal(t, time.Second, interval)
+
+	assert.NotNil(t, ValidateCreateIndex(CreateIndexClusterStateUpdateRequest{
+		Index:    "test",
+		Settings: map[string]interface{}{"translog.durability": "never"},
+	}))
+	assert.NotNil(t, ValidateCreateIndex(CreateIndexClusterStateUpdateRequest{
+		Index:    "test",
+		Settings: map[string]interface{}{"translog.sync_interval": "10ms"},
+	}))
+}
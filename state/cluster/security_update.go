@@ -0,0 +1,134 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+)
+
+// SecurityUpdateRequest changes the users, the roles and the API keys of the security metadata.
+type SecurityUpdateRequest struct {
+	AckedRequest
+	// PutUsers creates or replaces users, a user without PasswordHash keeps the password it has
+	PutUsers          []state.User
+	DeleteUsers       []string
+	PutRoles          []state.Role
+	DeleteRoles       []string
+	PutApiKeys        []state.ApiKey
+	InvalidateApiKeys []string
+}
+
+func (r *SecurityUpdateRequest) WriteTo(out *common.StreamOutput) {
+	r.AckedRequest.WriteTo(out)
+	out.WriteVInt(uint64(len(r.PutUsers)))
+	for i := range r.PutUsers {
+		r.PutUsers[i].WriteTo(out)
+	}
+	out.WriteStringSlice(r.DeleteUsers)
+	out.WriteVInt(uint64(len(r.PutRoles)))
+	for i := range r.PutRoles {
+		r.PutRoles[i].WriteTo(out)
+	}
+	out.WriteStringSlice(r.DeleteRoles)
+	out.WriteVInt(uint64(len(r.PutApiKeys)))
+	for i := range r.PutApiKeys {
+		r.PutApiKeys[i].WriteTo(out)
+	}
+	out.WriteStringSlice(r.InvalidateApiKeys)
+}
+
+func readSecurityUpdateRequest(in *common.StreamInput) (*SecurityUpdateRequest, error) {
+	req := SecurityUpdateRequest{AckedRequest: readAckedRequest(in)}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.PutUsers = append(req.PutUsers, state.ReadUser(in))
+	}
+	req.DeleteUsers = in.ReadStringSlice()
+	count = in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.PutRoles = append(req.PutRoles, state.ReadRole(in))
+	}
+	req.DeleteRoles = in.ReadStringSlice()
+	count = in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		req.PutApiKeys = append(req.PutApiKeys, state.ReadApiKey(in))
+	}
+	req.InvalidateApiKeys = in.ReadStringSlice()
+	return &req, in.Err()
+}
+
+const SecurityUpdateAction = "cluster:admin/xpack/security/update"
+
+type MetadataSecurityService struct {
+	clusterService       *Service
+	updateSecurityAction *MasterNodeAction
+}
+
+func NewMetadataSecurityService(clusterService *Service, transportService *transport.Service) *MetadataSecurityService {
+	s := &MetadataSecurityService{
+		clusterService: clusterService,
+	}
+	s.updateSecurityAction = NewMasterNodeAction(SecurityUpdateAction, clusterService, transportService, func(in *common.StreamInput) error {
+		req, err := readSecurityUpdateRequest(in)
+		if err != nil {
+			return err
+		}
+		return s.updateSecurity(*req)
+	})
+	return s
+}
+
+// UpdateSecurity applies the changes on the elected master.
+func (s *MetadataSecurityService) UpdateSecurity(req SecurityUpdateRequest) error {
+	return s.updateSecurityAction.Execute(&req, req.MasterTimeout)
+}
+
+func (s *MetadataSecurityService) updateSecurity(req SecurityUpdateRequest) error {
+	// a new user without password fails the request rather than the task
+	current := s.clusterService.State().Metadata.Security
+	for _, user := range req.PutUsers {
+		if _, existing := current.Users[user.Username]; !existing && user.PasswordHash == "" {
+			return fmt.Errorf("the password of the new user [%s] is missing", user.Username)
+		}
+	}
+	return s.clusterService.SubmitStateUpdateTask("update-security", req.taskConfig(state.PriorityImmediate), func(current state.ClusterState) state.ClusterState {
+		newState := current
+		newState.Metadata.Security = ApplySecurityUpdates(current.Metadata.Security, req)
+		return newState
+	})
+}
+
+// ApplySecurityUpdates returns the security metadata with the changes of a request.
+func ApplySecurityUpdates(current state.SecurityMetadata, req SecurityUpdateRequest) state.SecurityMetadata {
+	security := current.Copy()
+	for _, user := range req.PutUsers {
+		if user.PasswordHash == "" {
+			existing, ok := security.Users[user.Username]
+			if !ok {
+				continue
+			}
+			user.PasswordHash = existing.PasswordHash
+		}
+		security.Users[user.Username] = user
+	}
+	for _, username := range req.DeleteUsers {
+		delete(security.Users, username)
+	}
+	for _, role := range req.PutRoles {
+		security.Roles[role.Name] = role
+	}
+	for _, name := range req.DeleteRoles {
+		delete(security.Roles, name)
+	}
+	for _, apiKey := range req.PutApiKeys {
+		security.ApiKeys[apiKey.Id] = apiKey
+	}
+	for _, id := range req.InvalidateApiKeys {
+		if apiKey, existing := security.ApiKeys[id]; existing {
+			apiKey.Invalidated = true
+			security.ApiKeys[id] = apiKey
+		}
+	}
+	return security
+}
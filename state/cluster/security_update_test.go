@@ -0,0 +1,61 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestApplySecurityUpdates(t *testing.T) {
+	// Arrange
+	current := state.SecurityMetadata{
+		Users: map[string]state.User{
+			"alice": {Username: "alice", PasswordHash: "alice-hash", Roles: []string{"reader"}, Enabled: true},
+			"bob":   {Username: "bob", PasswordHash: "bob-hash", Enabled: true},
+		},
+		Roles: map[string]state.Role{
+			"reader": {Name: "reader", Cluster: []string{"monitor"}},
+		},
+		ApiKeys: map[string]state.ApiKey{
+			"key-1": {Id: "key-1", Username: "alice"},
+		},
+	}
+
+	// Action
+	updated := ApplySecurityUpdates(current, SecurityUpdateRequest{
+		PutUsers: []state.User{
+			// an update without password keeps the password
+			{Username: "alice", Roles: []string{"reader", "writer"}, Enabled: true},
+			{Username: "carol", PasswordHash: "carol-hash", Enabled: true},
+			// a new user without password is skipped
+			{Username: "dave", Enabled: true},
+		},
+		DeleteUsers:       []string{"bob"},
+		PutRoles:          []state.Role{{Name: "writer", Cluster: []string{"manage"}}},
+		DeleteRoles:       []string{"reader"},
+		PutApiKeys:        []state.ApiKey{{Id: "key-2", Username: "carol"}},
+		InvalidateApiKeys: []string{"key-1", "unknown"},
+	})
+
+	// Assert
+	assert.Equal(t, "alice-hash", updated.Users["alice"].PasswordHash)
+	assert.Equal(t, []string{"reader", "writer"}, updated.Users["alice"].Roles)
+	assert.Contains(t, updated.Users, "carol")
+	assert.NotContains(t, updated.Users, "bob")
+	assert.NotContains(t, updated.Users, "dave")
+	assert.Equal(t, []string{"writer"}, roleNames(updated.Roles))
+	assert.True(t, updated.ApiKeys["key-1"].Invalidated)
+	assert.False(t, updated.ApiKeys["key-2"].Invalidated)
+	assert.NotContains(t, updated.ApiKeys, "unknown")
+	// the current metadata is left as it is
+	assert.Contains(t, current.Users, "bob")
+	assert.False(t, current.ApiKeys["key-1"].Invalidated)
+}
+
+func roleNames(roles map[string]state.Role) []string {
+	var names []string
+	for name := range roles {
+		names = append(names, name)
+	}
+	return names
+}
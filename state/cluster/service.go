@@ -1,75 +1,41 @@
 package cluster
 
-import "github.com/actumn/searchgoose/state"
+import (
+	"github.com/actumn/searchgoose/state"
+	"time"
+)
 
 type Service struct {
-	//Settings       Settings
-	ApplierService *ApplierService
-	MasterService  *MasterService
+	ClusterSettings *ClusterSettings
+	ApplierService  *ApplierService
+	MasterService   *MasterService
 }
 
 func NewService() *Service {
-	return &Service{
-		ApplierService: newApplierService(),
-		MasterService:  newMasterService(),
+	s := &Service{
+		ClusterSettings: NewClusterSettings(),
+		ApplierService:  newApplierService(),
+		MasterService:   newMasterService(),
 	}
+	// the settings are applied first, the other appliers see their new values
+	s.ApplierService.AddApplier(s.ClusterSettings.applySettings)
+	// the consumers run on the applier goroutine, the one reading the threshold
+	s.ClusterSettings.AddSettingsUpdateConsumer(SlowTaskLoggingThresholdSetting, func(value string) {
+		s.ApplierService.SlowTaskLoggingThreshold, _ = time.ParseDuration(value)
+	})
+	return s
 }
 
 func (s *Service) State() *state.ClusterState {
-	return s.ApplierService.ClusterState
+	clusterState, _ := s.ApplierService.appliedState()
+	return clusterState
 }
 
-func (s *Service) SubmitStateUpdateTask(task state.ClusterStateUpdateTask) {
-	s.MasterService.submitStateUpdateTask(task)
+func (s *Service) SubmitStateUpdateTask(source string, config state.TaskConfig, task state.ClusterStateUpdateTask) error {
+	return s.MasterService.SubmitStateUpdateTask(source, config, task)
 }
 
-type ApplierService struct {
-	ClusterState         *state.ClusterState
-	ClusterStateAppliers []func(event state.ClusterChangedEvent)
-}
-
-func newApplierService() *ApplierService {
-	return &ApplierService{}
-}
-
-func (s *ApplierService) AddApplier(applier func(event state.ClusterChangedEvent)) {
-	s.ClusterStateAppliers = append(s.ClusterStateAppliers, applier)
-}
-
-func (s *ApplierService) OnNewState(clusterState *state.ClusterState) {
-	// TODO:: goroutine 으로 구현하면 좋을 것 같다. (s.start() 해서)
-	changedEvent := state.ClusterChangedEvent{
-		State:     *clusterState,
-		PrevState: *s.ClusterState,
-	}
-
-	for _, applier := range s.ClusterStateAppliers {
-		applier(changedEvent)
-	}
-
-	s.ClusterState = clusterState
-
-}
-
-type MasterService struct {
-	ClusterState        *state.ClusterState
-	ClusterStatePublish func(event state.ClusterChangedEvent)
-	// Publisher func
-}
-
-func newMasterService() *MasterService {
-	return &MasterService{}
-}
-
-func (s *MasterService) submitStateUpdateTask(task state.ClusterStateUpdateTask) {
-	// TODO:: goroutine 으로 구현하면 좋을 것 같다. (s.start() 해서)
-	newState := task(*s.ClusterState)
-
-	clusterChangedEvent := state.ClusterChangedEvent{
-		State:     newState,
-		PrevState: *s.ClusterState,
-	}
-
-	// publish ... 어떻게하지?
-	s.ClusterStatePublish(clusterChangedEvent)
+// SubmitTask queues a task run in a batch with the other tasks of its executor.
+func (s *Service) SubmitTask(source string, task interface{}, config state.TaskConfig, executor *TaskExecutor, listener TaskListener) {
+	s.MasterService.SubmitTask(source, task, config, executor, listener)
 }
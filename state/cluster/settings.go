@@ -1,4 +1,379 @@
 package cluster
 
-type Settings struct {
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/sirupsen/logrus"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RebalanceEnableSetting tells which copies the balancer moves: all, primaries, replicas or none.
+	RebalanceEnableSetting = "cluster.routing.rebalance.enable"
+	// ClusterConcurrentRebalanceSetting is how many relocations may run in the cluster at once.
+	ClusterConcurrentRebalanceSetting = "cluster.routing.allocation.cluster_concurrent_rebalance"
+	// NodeConcurrentRecoveriesSetting is how many peer recoveries may target a node at once.
+	NodeConcurrentRecoveriesSetting = "cluster.routing.allocation.node_concurrent_recoveries"
+	// BalanceThresholdSetting is the weight delta between two nodes above which shards are moved.
+	BalanceThresholdSetting = "cluster.routing.allocation.balance.threshold"
+
+	// DiskThresholdEnabledSetting turns the disk watermarks on or off.
+	DiskThresholdEnabledSetting = "cluster.routing.allocation.disk.threshold_enabled"
+	// DiskWatermarkLowSetting is the disk usage above which no more shards are allocated to a node.
+	DiskWatermarkLowSetting = "cluster.routing.allocation.disk.watermark.low"
+	// DiskWatermarkHighSetting is the disk usage above which shards are moved away from a node.
+	DiskWatermarkHighSetting = "cluster.routing.allocation.disk.watermark.high"
+	// DiskWatermarkFloodStageSetting is the disk usage above which the indices with a shard on a node become read-only.
+	DiskWatermarkFloodStageSetting = "cluster.routing.allocation.disk.watermark.flood_stage"
+	// ClusterInfoUpdateIntervalSetting is how often the master collects the disk usage of the nodes.
+	ClusterInfoUpdateIntervalSetting = "cluster.info.update.interval"
+
+	// AwarenessAttributesSetting are the node attributes, comma separated, the copies of a shard are spread over.
+	AwarenessAttributesSetting = "cluster.routing.allocation.awareness.attributes"
+	// AwarenessForceSettingPrefix is followed by "{attribute}.values", the values of an attribute expected even
+	// without a node having them.
+	AwarenessForceSettingPrefix = "cluster.routing.allocation.awareness.force."
+	// SameShardHostSetting keeps the copies of a shard off nodes of the same host.
+	SameShardHostSetting = "cluster.routing.allocation.same_shard.host"
+
+	// ClusterRoutingRequireSettingPrefix, ClusterRoutingIncludeSettingPrefix and ClusterRoutingExcludeSettingPrefix
+	// are followed by a node attribute, they filter the nodes of every index.
+	ClusterRoutingRequireSettingPrefix = "cluster.routing.allocation.require."
+	ClusterRoutingIncludeSettingPrefix = "cluster.routing.allocation.include."
+	ClusterRoutingExcludeSettingPrefix = "cluster.routing.allocation.exclude."
+
+	// MaxVotingConfigExclusionsSetting is how many nodes may be withdrawn from the voting configuration at once.
+	MaxVotingConfigExclusionsSetting = "cluster.max_voting_config_exclusions"
+
+	// PublishCommitTimeoutSetting is how long the master waits for a quorum of master-eligible nodes to accept a
+	// cluster state before the publication fails.
+	PublishCommitTimeoutSetting = "cluster.publish.commit_timeout"
+	// PublishTimeoutSetting is how long the master waits for every node to apply a cluster state.
+	PublishTimeoutSetting = "cluster.publish.timeout"
+	// FollowerLagTimeoutSetting is how long a node may take to apply a committed cluster state before it is removed.
+	FollowerLagTimeoutSetting = "cluster.follower_lag.timeout"
+	// SlowTaskLoggingThresholdSetting is how long applying a cluster state takes before it is logged as slow.
+	SlowTaskLoggingThresholdSetting = "cluster.service.slow_task_logging_threshold"
+
+	// RecoveryMaxBytesPerSecSetting limits the bytes a node copies per second to recover its shards, 0 does not.
+	RecoveryMaxBytesPerSecSetting = "indices.recovery.max_bytes_per_sec"
+	// SearchShardCountLimitSetting is how many shards a search may query.
+	SearchShardCountLimitSetting = "action.search.shard_count.limit"
+	// LoggerLevelSetting is the level of the logs, e.g. info or debug.
+	LoggerLevelSetting = "logger.level"
+)
+
+const (
+	RebalanceAll       = "all"
+	RebalancePrimaries = "primaries"
+	RebalanceReplicas  = "replicas"
+	RebalanceNone      = "none"
+)
+
+// Settings are the cluster settings keyed by their dotted names.
+type Settings map[string]string
+
+func (s Settings) Get(key string, defaultValue string) string {
+	if value, ok := s[key]; ok {
+		return value
+	}
+	return defaultValue
+}
+
+// GetInt returns the setting as an int, the default when it is missing or not a number.
+func (s Settings) GetInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(s[key])
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetFloat returns the setting as a float, the default when it is missing or not a number.
+func (s Settings) GetFloat(key string, defaultValue float64) float64 {
+	value, err := strconv.ParseFloat(s[key], 64)
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetBool returns the setting as a bool, the default when it is missing or not a bool.
+func (s Settings) GetBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(s[key])
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// GetDuration returns the setting as a duration such as "30s", the default when it is missing or invalid.
+func (s Settings) GetDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(s[key])
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// ByPrefix returns the settings starting with prefix, keyed by the rest of their names.
+func (s Settings) ByPrefix(prefix string) map[string]string {
+	settings := map[string]string{}
+	for key, value := range s {
+		if strings.HasPrefix(key, prefix) {
+			settings[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	return settings
+}
+
+// Setting is a cluster setting known to the settings API, with its default and how its values are checked.
+type Setting struct {
+	Key string
+	// Prefix tells that the key is followed by a name, e.g. cluster.routing.allocation.require.{attribute}
+	Prefix  bool
+	Default string
+	// parse returns why a value is invalid, nil accepts any value
+	parse func(value string) error
+}
+
+func (s Setting) validate(key string, value string) error {
+	if s.parse == nil {
+		return nil
+	}
+	if err := s.parse(value); err != nil {
+		return fmt.Errorf("failed to parse value [%s] for setting [%s]: %v", value, key, err)
+	}
+	return nil
+}
+
+func stringSetting(key string, defaultValue string) Setting {
+	return Setting{Key: key, Default: defaultValue}
+}
+
+func prefixSetting(prefix string) Setting {
+	return Setting{Key: prefix, Prefix: true}
+}
+
+func boolSetting(key string, defaultValue bool) Setting {
+	return Setting{Key: key, Default: strconv.FormatBool(defaultValue), parse: func(value string) error {
+		_, err := strconv.ParseBool(value)
+		return err
+	}}
+}
+
+func intSetting(key string, defaultValue int, minValue int) Setting {
+	return Setting{Key: key, Default: strconv.Itoa(defaultValue), parse: func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if n < minValue {
+			return fmt.Errorf("must be >= %d", minValue)
+		}
+		return nil
+	}}
+}
+
+func floatSetting(key string, defaultValue float64, minValue float64) Setting {
+	return Setting{Key: key, Default: strconv.FormatFloat(defaultValue, 'f', -1, 64), parse: func(value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		if f < minValue {
+			return fmt.Errorf("must be >= %v", minValue)
+		}
+		return nil
+	}}
+}
+
+func durationSetting(key string, defaultValue string) Setting {
+	return Setting{Key: key, Default: defaultValue, parse: func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		if d < 0 {
+			return fmt.Errorf("must be >= 0s")
+		}
+		return nil
+	}}
+}
+
+func bytesSetting(key string, defaultValue string) Setting {
+	return Setting{Key: key, Default: defaultValue, parse: func(value string) error {
+		_, err := common.ParseBytes(value)
+		return err
+	}}
+}
+
+func enumSetting(key string, defaultValue string, values ...string) Setting {
+	return Setting{Key: key, Default: defaultValue, parse: func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of [%s]", strings.Join(values, ", "))
+	}}
+}
+
+func watermarkSetting(key string, defaultValue string) Setting {
+	return Setting{Key: key, Default: defaultValue, parse: func(value string) error {
+		_, err := parseDiskWatermark(value)
+		return err
+	}}
+}
+
+func builtInClusterSettings() []Setting {
+	return []Setting{
+		enumSetting(RebalanceEnableSetting, RebalanceAll, RebalanceAll, RebalancePrimaries, RebalanceReplicas, RebalanceNone),
+		intSetting(ClusterConcurrentRebalanceSetting, defaultClusterConcurrentRebalance, 0),
+		intSetting(NodeConcurrentRecoveriesSetting, defaultNodeConcurrentRecoveries, 0),
+		floatSetting(BalanceThresholdSetting, defaultBalanceThreshold, 0),
+		boolSetting(DiskThresholdEnabledSetting, true),
+		watermarkSetting(DiskWatermarkLowSetting, defaultDiskWatermarkLow),
+		watermarkSetting(DiskWatermarkHighSetting, defaultDiskWatermarkHigh),
+		watermarkSetting(DiskWatermarkFloodStageSetting, defaultDiskWatermarkFloodStage),
+		durationSetting(ClusterInfoUpdateIntervalSetting, defaultClusterInfoUpdateInterval.String()),
+		stringSetting(AwarenessAttributesSetting, ""),
+		prefixSetting(AwarenessForceSettingPrefix),
+		boolSetting(SameShardHostSetting, false),
+		prefixSetting(ClusterRoutingRequireSettingPrefix),
+		prefixSetting(ClusterRoutingIncludeSettingPrefix),
+		prefixSetting(ClusterRoutingExcludeSettingPrefix),
+		intSetting(MaxVotingConfigExclusionsSetting, defaultMaxVotingConfigExclusions, 1),
+		durationSetting(PublishCommitTimeoutSetting, "30s"),
+		durationSetting(PublishTimeoutSetting, "30s"),
+		durationSetting(FollowerLagTimeoutSetting, "90s"),
+		durationSetting(SlowTaskLoggingThresholdSetting, defaultSlowTaskLoggingThreshold.String()),
+		bytesSetting(RecoveryMaxBytesPerSecSetting, "40mb"),
+		intSetting(SearchShardCountLimitSetting, math.MaxInt32, 1),
+		enumSetting(LoggerLevelSetting, logrus.GetLevel().String(), "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace"),
+	}
+}
+
+type settingsUpdateConsumer struct {
+	setting  Setting
+	consumer func(value string)
+}
+
+// ClusterSettings checks the updates of the cluster settings, and tells the consumers registered for a setting
+// when its value in effect changes so that the subsystems follow it without a restart.
+type ClusterSettings struct {
+	settings  map[string]Setting
+	prefixes  []Setting
+	consumers []settingsUpdateConsumer
+	mux       sync.Mutex
+}
+
+func NewClusterSettings() *ClusterSettings {
+	s := &ClusterSettings{
+		settings: map[string]Setting{},
+	}
+	for _, setting := range builtInClusterSettings() {
+		if setting.Prefix {
+			s.prefixes = append(s.prefixes, setting)
+		} else {
+			s.settings[setting.Key] = setting
+		}
+	}
+	return s
+}
+
+// Get returns the setting of a key, a prefix setting for the keys it starts.
+func (s *ClusterSettings) Get(key string) (Setting, bool) {
+	if setting, existing := s.settings[key]; existing {
+		return setting, true
+	}
+	for _, setting := range s.prefixes {
+		if strings.HasPrefix(key, setting.Key) && len(key) > len(setting.Key) {
+			return setting, true
+		}
+	}
+	return Setting{}, false
+}
+
+// Validate checks the updates of the persistent or transient settings, a nil value resets a setting.
+func (s *ClusterSettings) Validate(scope string, updates map[string]*string) error {
+	keys := make([]string, 0, len(updates))
+	for key := range updates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		setting, existing := s.Get(key)
+		if !existing {
+			return fmt.Errorf("%s setting [%s], not recognized", scope, key)
+		}
+		if value := updates[key]; value != nil {
+			if err := setting.validate(key, *value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Defaults returns the defaults of the settings that are not set.
+func (s *ClusterSettings) Defaults(settings map[string]string) map[string]string {
+	defaults := map[string]string{}
+	for key, setting := range s.settings {
+		if _, existing := settings[key]; !existing {
+			defaults[key] = setting.Default
+		}
+	}
+	return defaults
+}
+
+// AddSettingsUpdateConsumer registers a consumer called with the value in effect of a setting, its default when
+// it is reset, every time an applied cluster state changes it.
+func (s *ClusterSettings) AddSettingsUpdateConsumer(key string, consumer func(value string)) {
+	setting, existing := s.settings[key]
+	if !existing {
+		logrus.Fatalf("ClusterSettings: no setting [%s] to consume", key)
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.consumers = append(s.consumers, settingsUpdateConsumer{setting: setting, consumer: consumer})
+}
+
+// applySettings is the cluster state applier calling the consumers of the settings that changed.
+func (s *ClusterSettings) applySettings(event state.ClusterChangedEvent) {
+	previous := Settings(event.PrevState.Metadata.Settings())
+	current := Settings(event.State.Metadata.Settings())
+	s.mux.Lock()
+	consumers := s.consumers
+	s.mux.Unlock()
+	for _, c := range consumers {
+		value := current.Get(c.setting.Key, c.setting.Default)
+		if previous.Get(c.setting.Key, c.setting.Default) == value {
+			continue
+		}
+		logrus.Infof("ClusterSettings: updating [%s] to [%s]", c.setting.Key, value)
+		c.consumer(value)
+	}
+}
+
+// ApplySettingsUpdates returns the settings with the updates, a nil value removes a setting.
+func ApplySettingsUpdates(settings map[string]string, updates map[string]*string) map[string]string {
+	updated := map[string]string{}
+	for key, value := range settings {
+		updated[key] = value
+	}
+	for key, value := range updates {
+		if value == nil {
+			delete(updated, key)
+		} else {
+			updated[key] = *value
+		}
+	}
+	return updated
 }
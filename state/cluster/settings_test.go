@@ -0,0 +1,102 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClusterSettings_Validate(t *testing.T) {
+	// Arrange
+	clusterSettings := NewClusterSettings()
+	value := func(v string) *string {
+		return &v
+	}
+
+	// Action
+	validErr := clusterSettings.Validate("persistent", map[string]*string{
+		RebalanceEnableSetting:                   value("primaries"),
+		DiskWatermarkLowSetting:                  value("500mb"),
+		"cluster.routing.allocation.exclude._ip": value("10.0.0.1"),
+		RecoveryMaxBytesPerSecSetting:            nil,
+	})
+	unknownErr := clusterSettings.Validate("transient", map[string]*string{
+		"cluster.routing.allocation.unknown": value("true"),
+	})
+	invalidErr := clusterSettings.Validate("persistent", map[string]*string{
+		SearchShardCountLimitSetting: value("0"),
+	})
+
+	// Assert
+	assert.NoError(t, validErr)
+	assert.EqualError(t, unknownErr, "transient setting [cluster.routing.allocation.unknown], not recognized")
+	assert.Error(t, invalidErr)
+}
+
+func TestReadClusterUpdateSettingsRequest(t *testing.T) {
+	// Arrange
+	value := "none"
+	req := ClusterUpdateSettingsRequest{
+		AckedRequest: AckedRequest{AckTimeout: 1, MasterTimeout: 2},
+		Persistent:   map[string]*string{RebalanceEnableSetting: &value, RecoveryMaxBytesPerSecSetting: nil},
+	}
+
+	// Action
+	read, err := readClusterUpdateSettingsRequest(common.NewStreamInput(common.ToBytes(&req, common.CurrentVersion), common.CurrentVersion))
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, req, *read)
+}
+
+func TestClusterSettings_applySettings(t *testing.T) {
+	// Arrange
+	clusterSettings := NewClusterSettings()
+	var consumed []string
+	clusterSettings.AddSettingsUpdateConsumer(RecoveryMaxBytesPerSecSetting, func(value string) {
+		consumed = append(consumed, value)
+	})
+	metadata := func(persistent map[string]string, transient map[string]string) state.Metadata {
+		return state.Metadata{PersistentSettings: persistent, TransientSettings: transient}
+	}
+	states := []state.Metadata{
+		metadata(nil, nil),
+		metadata(map[string]string{RecoveryMaxBytesPerSecSetting: "100mb"}, nil),
+		// a transient setting takes precedence
+		metadata(map[string]string{RecoveryMaxBytesPerSecSetting: "100mb"}, map[string]string{RecoveryMaxBytesPerSecSetting: "10mb"}),
+		metadata(map[string]string{RecoveryMaxBytesPerSecSetting: "100mb", RebalanceEnableSetting: "none"}, map[string]string{RecoveryMaxBytesPerSecSetting: "10mb"}),
+		// reset to its default
+		metadata(nil, nil),
+	}
+
+	// Action
+	for i := 1; i < len(states); i++ {
+		clusterSettings.applySettings(state.ClusterChangedEvent{
+			PrevState: state.ClusterState{Metadata: states[i-1]},
+			State:     state.ClusterState{Metadata: states[i]},
+		})
+	}
+
+	// Assert
+	assert.Equal(t, []string{"100mb", "10mb", "40mb"}, consumed)
+}
+
+func TestApplySettingsUpdates(t *testing.T) {
+	// Arrange
+	settings := map[string]string{
+		RebalanceEnableSetting:        "none",
+		RecoveryMaxBytesPerSecSetting: "10mb",
+	}
+	value := "20mb"
+
+	// Action
+	updated := ApplySettingsUpdates(settings, map[string]*string{
+		RebalanceEnableSetting:        nil,
+		RecoveryMaxBytesPerSecSetting: &value,
+	})
+
+	// Assert
+	assert.Equal(t, map[string]string{RecoveryMaxBytesPerSecSetting: "20mb"}, updated)
+	assert.Equal(t, "none", settings[RebalanceEnableSetting])
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+)
+
+// ClusterUpdateSettingsRequest updates the persistent and transient cluster settings, a nil value resets a setting.
+type ClusterUpdateSettingsRequest struct {
+	AckedRequest
+	Persistent map[string]*string
+	Transient  map[string]*string
+}
+
+func (r *ClusterUpdateSettingsRequest) WriteTo(out *common.StreamOutput) {
+	r.AckedRequest.WriteTo(out)
+	writeSettingUpdates(out, r.Persistent)
+	writeSettingUpdates(out, r.Transient)
+}
+
+func readClusterUpdateSettingsRequest(in *common.StreamInput) (*ClusterUpdateSettingsRequest, error) {
+	req := ClusterUpdateSettingsRequest{
+		AckedRequest: readAckedRequest(in),
+		Persistent:   readSettingUpdates(in),
+		Transient:    readSettingUpdates(in),
+	}
+	return &req, in.Err()
+}
+
+func writeSettingUpdates(out *common.StreamOutput, updates map[string]*string) {
+	out.WriteVInt(uint64(len(updates)))
+	for key, value := range updates {
+		out.WriteString(key)
+		out.WriteBool(value != nil)
+		if value != nil {
+			out.WriteString(*value)
+		}
+	}
+}
+
+func readSettingUpdates(in *common.StreamInput) map[string]*string {
+	count := in.ReadCount()
+	if count == 0 {
+		return nil
+	}
+	updates := make(map[string]*string, count)
+	for i := 0; i < count && in.Err() == nil; i++ {
+		key := in.ReadString()
+		updates[key] = nil
+		if in.ReadBool() {
+			value := in.ReadString()
+			updates[key] = &value
+		}
+	}
+	return updates
+}
+
+const ClusterUpdateSettingsAction = "cluster:admin/settings/update"
+
+type ClusterUpdateSettingsService struct {
+	clusterService       *Service
+	allocationService    *AllocationService
+	updateSettingsAction *MasterNodeAction
+}
+
+func NewClusterUpdateSettingsService(clusterService *Service, allocationService *AllocationService, transportService *transport.Service) *ClusterUpdateSettingsService {
+	s := &ClusterUpdateSettingsService{
+		clusterService:    clusterService,
+		allocationService: allocationService,
+	}
+	s.updateSettingsAction = NewMasterNodeAction(ClusterUpdateSettingsAction, clusterService, transportService, func(in *common.StreamInput) error {
+		req, err := readClusterUpdateSettingsRequest(in)
+		if err != nil {
+			return err
+		}
+		return s.updateSettings(*req)
+	})
+	return s
+}
+
+// UpdateSettings validates the updates and applies them on the elected master.
+func (s *ClusterUpdateSettingsService) UpdateSettings(req ClusterUpdateSettingsRequest) error {
+	if err := s.clusterService.ClusterSettings.Validate("persistent", req.Persistent); err != nil {
+		return err
+	}
+	if err := s.clusterService.ClusterSettings.Validate("transient", req.Transient); err != nil {
+		return err
+	}
+	return s.updateSettingsAction.Execute(&req, req.MasterTimeout)
+}
+
+func (s *ClusterUpdateSettingsService) updateSettings(req ClusterUpdateSettingsRequest) error {
+	return s.clusterService.SubmitStateUpdateTask("cluster_update_settings", req.taskConfig(state.PriorityImmediate), func(current state.ClusterState) state.ClusterState {
+		newState := current
+		newState.Metadata.PersistentSettings = ApplySettingsUpdates(current.Metadata.PersistentSettings, req.Persistent)
+		newState.Metadata.TransientSettings = ApplySettingsUpdates(current.Metadata.TransientSettings, req.Transient)
+		// the allocation settings may have changed
+		return s.allocationService.reroute(newState)
+	})
+}
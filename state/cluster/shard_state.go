@@ -0,0 +1,122 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ShardStartedAction = "internal:cluster/shard/started"
+	ShardFailedAction  = "internal:cluster/shard/failure"
+)
+
+type shardEntry struct {
+	ShardRouting state.ShardRouting
+	Message      string
+}
+
+func (e *shardEntry) WriteTo(out *common.StreamOutput) {
+	e.ShardRouting.WriteTo(out)
+	out.WriteString(e.Message)
+}
+
+func (e *shardEntry) String() string {
+	return fmt.Sprintf("[%s][%d] on node [%s]", e.ShardRouting.ShardId.Index.Name, e.ShardRouting.ShardId.ShardId, e.ShardRouting.CurrentNodeId)
+}
+
+func readShardEntry(in *common.StreamInput) (*shardEntry, error) {
+	entry := shardEntry{
+		ShardRouting: state.ReadShardRouting(in),
+		Message:      in.ReadString(),
+	}
+	return &entry, in.Err()
+}
+
+// ShardStateAction lets the data nodes report the shard copies they have started or failed to the master. The
+// reports queued on the master are applied in one batch.
+type ShardStateAction struct {
+	clusterService    *Service
+	allocationService *AllocationService
+	transportService  *transport.Service
+
+	shardStartedExecutor *TaskExecutor
+	shardFailedExecutor  *TaskExecutor
+}
+
+func NewShardStateAction(clusterService *Service, allocationService *AllocationService, transportService *transport.Service) *ShardStateAction {
+	a := &ShardStateAction{
+		clusterService:    clusterService,
+		allocationService: allocationService,
+		transportService:  transportService,
+	}
+	a.shardStartedExecutor = &TaskExecutor{
+		Execute: func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error) {
+			for _, task := range tasks {
+				current = a.allocationService.applyStartedShard(current, task.(*shardEntry).ShardRouting)
+			}
+			return current, nil
+		},
+	}
+	a.shardFailedExecutor = &TaskExecutor{
+		Execute: func(current state.ClusterState, tasks []interface{}) (state.ClusterState, []error) {
+			for _, task := range tasks {
+				entry := task.(*shardEntry)
+				current = a.allocationService.applyFailedShard(current, entry.ShardRouting, entry.Message)
+			}
+			return current, nil
+		},
+	}
+	transportService.RegisterRequestHandler(ShardStartedAction, func(channel transport.ReplyChannel, req []byte) {
+		entry, err := readShardEntry(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		logrus.Infof("Shard started - index name: %s, shard number: %d, node: %s", entry.ShardRouting.ShardId.Index.Name, entry.ShardRouting.ShardId.ShardId, entry.ShardRouting.CurrentNodeId)
+		channel.SendMessage("", []byte{})
+
+		a.clusterService.SubmitTask("shard-started "+entry.String(), entry, state.TaskConfig{Priority: state.PriorityUrgent}, a.shardStartedExecutor, TaskListener{
+			OnFailure: func(err error) {
+				logrus.Warnf("Shard started - failed to apply %s: %v", entry.String(), err)
+			},
+		})
+	})
+	transportService.RegisterRequestHandler(ShardFailedAction, func(channel transport.ReplyChannel, req []byte) {
+		entry, err := readShardEntry(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		logrus.Warnf("Shard failed - index name: %s, shard number: %d, node: %s, message: %s", entry.ShardRouting.ShardId.Index.Name, entry.ShardRouting.ShardId.ShardId, entry.ShardRouting.CurrentNodeId, entry.Message)
+		channel.SendMessage("", []byte{})
+
+		a.clusterService.SubmitTask("shard-failed "+entry.String(), entry, state.TaskConfig{Priority: state.PriorityHigh}, a.shardFailedExecutor, TaskListener{
+			OnFailure: func(err error) {
+				logrus.Warnf("Shard failed - failed to apply %s: %v", entry.String(), err)
+			},
+		})
+	})
+	return a
+}
+
+// ShardStarted tells the master that the local copy of a shard has been created or recovered.
+func (a *ShardStateAction) ShardStarted(shardRouting state.ShardRouting) {
+	entry := shardEntry{
+		ShardRouting: shardRouting,
+	}
+	master := a.clusterService.State().Nodes.MasterNode()
+	a.transportService.SendRequest(master, ShardStartedAction, common.ToBytes(&entry, a.transportService.GetVersion(master)), func(response []byte) {})
+}
+
+// ShardFailed tells the master that the local copy of a shard failed, so that it is allocated again.
+func (a *ShardStateAction) ShardFailed(shardRouting state.ShardRouting, message string) {
+	entry := shardEntry{
+		ShardRouting: shardRouting,
+		Message:      message,
+	}
+	master := a.clusterService.State().Nodes.MasterNode()
+	a.transportService.SendRequest(master, ShardFailedAction, common.ToBytes(&entry, a.transportService.GetVersion(master)), func(response []byte) {})
+}
@@ -0,0 +1,140 @@
+package cluster
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/state"
+	"sort"
+)
+
+const defaultMaxVotingConfigExclusions = 10
+
+// Reconfigure updates the last accepted voting configuration to the master-eligible nodes of the cluster.
+// The configuration keeps an odd size, it does not shrink below three nodes once it has three, so that losing
+// one node does not lose the quorum. The excluded nodes are always withdrawn.
+func Reconfigure(clusterState state.ClusterState) state.ClusterState {
+	coordination := clusterState.Metadata.Coordination
+	current := coordination.LastAcceptedConfiguration
+	if current.IsEmpty() || clusterState.Nodes == nil {
+		// the cluster is not bootstrapped yet
+		return clusterState
+	}
+
+	var live []string
+	for _, nodeId := range clusterState.Nodes.MasterNodeIds() {
+		if !coordination.IsExcluded(clusterState.Nodes.MasterNodes[nodeId]) {
+			live = append(live, nodeId)
+		}
+	}
+	excluded := map[string]struct{}{}
+	for _, exclusion := range coordination.VotingConfigExclusions {
+		excluded[exclusion.NodeId] = struct{}{}
+	}
+
+	minimumSize := 1
+	if len(current.NodeIds) >= 3 {
+		minimumSize = 3
+	}
+	targetSize := len(live)
+	if targetSize%2 == 0 && targetSize > 0 {
+		targetSize -= 1
+	}
+	if targetSize < minimumSize {
+		targetSize = minimumSize
+	}
+
+	// the master first, then the live nodes already voting, the other live nodes and the nodes that left
+	masterNodeId := clusterState.Nodes.MasterNodeId
+	added := map[string]struct{}{}
+	var candidates []string
+	add := func(nodeId string) {
+		if _, existing := added[nodeId]; existing {
+			return
+		}
+		added[nodeId] = struct{}{}
+		candidates = append(candidates, nodeId)
+	}
+	for _, nodeId := range live {
+		if nodeId == masterNodeId {
+			add(nodeId)
+		}
+	}
+	for _, nodeId := range live {
+		if current.Contains(nodeId) {
+			add(nodeId)
+		}
+	}
+	for _, nodeId := range live {
+		add(nodeId)
+	}
+	for _, nodeId := range current.NodeIds {
+		if _, existing := excluded[nodeId]; existing {
+			continue
+		}
+		if _, existing := clusterState.Nodes.Nodes[nodeId]; !existing {
+			add(nodeId)
+		}
+	}
+	if len(candidates) > targetSize {
+		candidates = candidates[:targetSize]
+	}
+	if len(candidates) == 0 {
+		return clusterState
+	}
+	sort.Strings(candidates)
+
+	coordination.LastAcceptedConfiguration = state.VotingConfiguration{NodeIds: candidates}
+	clusterState.Metadata.Coordination = coordination
+	return clusterState
+}
+
+// AddVotingConfigExclusions withdraws the nodes given by id or by name from the voting configuration.
+func AddVotingConfigExclusions(clusterState state.ClusterState, nodeIds []string, nodeNames []string) (state.ClusterState, error) {
+	coordination := clusterState.Metadata.Coordination
+	exclusions := append([]state.VotingConfigExclusion{}, coordination.VotingConfigExclusions...)
+	exists := func(exclusion state.VotingConfigExclusion) bool {
+		for _, e := range exclusions {
+			if e == exclusion {
+				return true
+			}
+		}
+		return false
+	}
+
+	var added []state.VotingConfigExclusion
+	for _, nodeId := range nodeIds {
+		exclusion := state.VotingConfigExclusion{NodeId: nodeId}
+		if node, existing := clusterState.Nodes.Nodes[nodeId]; existing {
+			exclusion.NodeName = node.Name
+		}
+		added = append(added, exclusion)
+	}
+	for _, nodeName := range nodeNames {
+		exclusion := state.VotingConfigExclusion{NodeName: nodeName}
+		for _, node := range clusterState.Nodes.Nodes {
+			if node.Name == nodeName {
+				exclusion.NodeId = node.Id
+			}
+		}
+		added = append(added, exclusion)
+	}
+	for _, exclusion := range added {
+		if !exists(exclusion) {
+			exclusions = append(exclusions, exclusion)
+		}
+	}
+
+	maxExclusions := Settings(clusterState.Metadata.Settings()).GetInt(MaxVotingConfigExclusionsSetting, defaultMaxVotingConfigExclusions)
+	if len(exclusions) > maxExclusions {
+		return clusterState, fmt.Errorf("cannot add %d exclusions, the number of voting config exclusions would exceed the limit [%d] of cluster setting [%s]", len(added), maxExclusions, MaxVotingConfigExclusionsSetting)
+	}
+
+	coordination.VotingConfigExclusions = exclusions
+	clusterState.Metadata.Coordination = coordination
+	return Reconfigure(clusterState), nil
+}
+
+// ClearVotingConfigExclusions removes every voting config exclusion, the nodes still in the cluster may vote again.
+func ClearVotingConfigExclusions(clusterState state.ClusterState) state.ClusterState {
+	clusterState.Metadata.Coordination.VotingConfigExclusions = nil
+	return Reconfigure(clusterState)
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func votingConfigTestClusterState(configuration []string, nodes ...state.Node) state.ClusterState {
+	clusterState := state.ClusterState{
+		Nodes: &state.Nodes{
+			Nodes:        map[string]state.Node{},
+			DataNodes:    map[string]state.Node{},
+			MasterNodes:  map[string]state.Node{},
+			MasterNodeId: nodes[0].Id,
+		},
+		Metadata: state.Metadata{
+			PersistentSettings: map[string]string{},
+		},
+	}
+	for _, node := range nodes {
+		clusterState.Nodes.Add(node)
+	}
+	clusterState.Metadata.Coordination.LastAcceptedConfiguration = state.VotingConfiguration{NodeIds: configuration}
+	return clusterState
+}
+
+func votingConfigTestNodes(count int) []state.Node {
+	var nodes []state.Node
+	for i := 1; i <= count; i++ {
+		nodes = append(nodes, state.Node{
+			Name:  "node" + strconv.Itoa(i),
+			Id:    "testNodeId" + strconv.Itoa(i),
+			Roles: state.NodeRoles(true, true, true),
+		})
+	}
+	return nodes
+}
+
+func TestReconfigure(t *testing.T) {
+	// Arrange
+	nodes := votingConfigTestNodes(4)
+	coordinatingOnly := state.Node{Name: "coordinating", Id: "testNodeIdC"}
+	notBootstrapped := votingConfigTestClusterState(nil, nodes[0], nodes[1])
+	joined := votingConfigTestClusterState([]string{"testNodeId1"}, nodes[0], nodes[1], nodes[2], coordinatingOnly)
+	even := votingConfigTestClusterState([]string{"testNodeId1", "testNodeId2", "testNodeId3"}, nodes...)
+	left := votingConfigTestClusterState([]string{"testNodeId1", "testNodeId2", "testNodeId3"}, nodes[0], nodes[1])
+	placeholder := votingConfigTestClusterState([]string{"testNodeId1", "testNodeId2", "{bootstrap-placeholder}-node3"}, nodes[0], nodes[1], nodes[2])
+
+	// Action
+	notBootstrapped = Reconfigure(notBootstrapped)
+	joined = Reconfigure(joined)
+	even = Reconfigure(even)
+	left = Reconfigure(left)
+	placeholder = Reconfigure(placeholder)
+
+	// Assert
+	assert.Empty(t, notBootstrapped.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+	// the coordinating-only node does not vote
+	assert.Equal(t, []string{"testNodeId1", "testNodeId2", "testNodeId3"}, joined.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+	// an odd number of nodes, the nodes already voting are kept
+	assert.Equal(t, []string{"testNodeId1", "testNodeId2", "testNodeId3"}, even.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+	// the configuration does not shrink below three nodes
+	assert.Equal(t, []string{"testNodeId1", "testNodeId2", "testNodeId3"}, left.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+	// the placeholder is replaced by the node that joined
+	assert.Equal(t, []string{"testNodeId1", "testNodeId2", "testNodeId3"}, placeholder.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+}
+
+func TestAddVotingConfigExclusions(t *testing.T) {
+	// Arrange
+	nodes := votingConfigTestNodes(4)
+	clusterState := votingConfigTestClusterState([]string{"testNodeId1", "testNodeId2", "testNodeId3"}, nodes...)
+	limited := votingConfigTestClusterState([]string{"testNodeId1"}, nodes[0])
+	limited.Metadata.PersistentSettings[MaxVotingConfigExclusionsSetting] = "1"
+
+	// Action
+	excluded, err := AddVotingConfigExclusions(clusterState, []string{"testNodeId2"}, nil)
+	excludedByName, byNameErr := AddVotingConfigExclusions(excluded, nil, []string{"node3", "node9"})
+	cleared := ClearVotingConfigExclusions(excludedByName)
+	_, limitErr := AddVotingConfigExclusions(limited, nil, []string{"node2", "node3"})
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, []state.VotingConfigExclusion{{NodeId: "testNodeId2", NodeName: "node2"}}, excluded.Metadata.Coordination.VotingConfigExclusions)
+	assert.Equal(t, []string{"testNodeId1", "testNodeId3", "testNodeId4"}, excluded.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+	assert.Nil(t, byNameErr)
+	assert.Len(t, excludedByName.Metadata.Coordination.VotingConfigExclusions, 3)
+	assert.Contains(t, excludedByName.Metadata.Coordination.VotingConfigExclusions, state.VotingConfigExclusion{NodeName: "node9"})
+	// the excluded nodes are withdrawn even below three nodes
+	assert.Equal(t, []string{"testNodeId1", "testNodeId4"}, excludedByName.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+	assert.Empty(t, cleared.Metadata.Coordination.VotingConfigExclusions)
+	assert.NotNil(t, limitErr)
+}
@@ -0,0 +1,239 @@
+package state
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"reflect"
+)
+
+// ClusterStateDiff is the change from a cluster state to the next one, the nodes, the index metadata and the index
+// routing tables that changed. It applies only to the state of the term and version it was computed from.
+type ClusterStateDiff struct {
+	FromTerm    int64
+	FromVersion int64
+
+	Version   int64
+	StateUUID string
+	Name      string
+
+	MasterNodeId  string
+	UpsertedNodes map[string]Node
+	RemovedNodes  []string
+
+	Coordination       CoordinationMetadata
+	PersistentSettings map[string]string
+	TransientSettings  map[string]string
+	Security           SecurityMetadata
+	IndicesLookup      map[string]IndexAbstractionAlias
+	UpsertedIndices    map[string]IndexMetadata
+	RemovedIndices     []string
+
+	UpsertedIndicesRouting map[string]IndexRoutingTable
+	RemovedIndicesRouting  []string
+}
+
+// DiffClusterState computes the change from the previous state to the current one.
+func DiffClusterState(previous ClusterState, current ClusterState) *ClusterStateDiff {
+	diff := &ClusterStateDiff{
+		FromTerm:           previous.Metadata.Coordination.Term,
+		FromVersion:        previous.Version,
+		Version:            current.Version,
+		StateUUID:          current.StateUUID,
+		Name:               current.Name,
+		MasterNodeId:       current.Nodes.MasterNodeId,
+		UpsertedNodes:      map[string]Node{},
+		Coordination:       current.Metadata.Coordination,
+		PersistentSettings: current.Metadata.PersistentSettings,
+		TransientSettings:  current.Metadata.TransientSettings,
+		Security:           current.Metadata.Security,
+		IndicesLookup:      current.Metadata.IndicesLookup,
+		UpsertedIndices:    map[string]IndexMetadata{},
+
+		UpsertedIndicesRouting: map[string]IndexRoutingTable{},
+	}
+
+	for id, node := range current.Nodes.Nodes {
+		if previousNode, existing := previous.Nodes.Nodes[id]; !existing || !reflect.DeepEqual(previousNode, node) {
+			diff.UpsertedNodes[id] = node
+		}
+	}
+	for id := range previous.Nodes.Nodes {
+		if _, existing := current.Nodes.Nodes[id]; !existing {
+			diff.RemovedNodes = append(diff.RemovedNodes, id)
+		}
+	}
+
+	for name, indexMetadata := range current.Metadata.Indices {
+		if previousMetadata, existing := previous.Metadata.Indices[name]; !existing || !reflect.DeepEqual(previousMetadata, indexMetadata) {
+			diff.UpsertedIndices[name] = indexMetadata
+		}
+	}
+	for name := range previous.Metadata.Indices {
+		if _, existing := current.Metadata.Indices[name]; !existing {
+			diff.RemovedIndices = append(diff.RemovedIndices, name)
+		}
+	}
+
+	for name, indexRoutingTable := range current.RoutingTable.IndicesRouting {
+		if previousRoutingTable, existing := previous.RoutingTable.IndicesRouting[name]; !existing || !reflect.DeepEqual(previousRoutingTable, indexRoutingTable) {
+			diff.UpsertedIndicesRouting[name] = indexRoutingTable
+		}
+	}
+	for name := range previous.RoutingTable.IndicesRouting {
+		if _, existing := current.RoutingTable.IndicesRouting[name]; !existing {
+			diff.RemovedIndicesRouting = append(diff.RemovedIndicesRouting, name)
+		}
+	}
+
+	return diff
+}
+
+// Apply returns the state the diff leads to from the previous state, the previous state is left unchanged. It fails
+// when the previous state is not the one the diff was computed from.
+func (d *ClusterStateDiff) Apply(previous ClusterState, localNode Node) (*ClusterState, error) {
+	if previous.Nodes == nil || previous.Metadata.Coordination.Term != d.FromTerm || previous.Version != d.FromVersion {
+		return nil, fmt.Errorf("the diff applies to version {%d} in term {%d}, the state is version {%d} in term {%d}",
+			d.FromVersion, d.FromTerm, previous.Version, previous.Metadata.Coordination.Term)
+	}
+
+	nodes := &Nodes{
+		Nodes:        map[string]Node{},
+		DataNodes:    map[string]Node{},
+		MasterNodes:  map[string]Node{},
+		MasterNodeId: d.MasterNodeId,
+	}
+	for id, node := range previous.Nodes.Nodes {
+		if _, upserted := d.UpsertedNodes[id]; !upserted {
+			nodes.Add(node)
+		}
+	}
+	for _, node := range d.UpsertedNodes {
+		nodes.Add(node)
+	}
+	for _, id := range d.RemovedNodes {
+		nodes.Remove(id)
+	}
+
+	indices := map[string]IndexMetadata{}
+	for name, indexMetadata := range previous.Metadata.Indices {
+		indices[name] = indexMetadata
+	}
+	for name, indexMetadata := range d.UpsertedIndices {
+		indices[name] = indexMetadata
+	}
+	for _, name := range d.RemovedIndices {
+		delete(indices, name)
+	}
+
+	indicesRouting := map[string]IndexRoutingTable{}
+	for name, indexRoutingTable := range previous.RoutingTable.IndicesRouting {
+		indicesRouting[name] = indexRoutingTable
+	}
+	for name, indexRoutingTable := range d.UpsertedIndicesRouting {
+		indicesRouting[name] = indexRoutingTable
+	}
+	for _, name := range d.RemovedIndicesRouting {
+		delete(indicesRouting, name)
+	}
+
+	clusterState := &ClusterState{
+		Version:   d.Version,
+		StateUUID: d.StateUUID,
+		Name:      d.Name,
+		Nodes:     nodes,
+		Metadata: Metadata{
+			Coordination:       d.Coordination,
+			Indices:            indices,
+			IndicesLookup:      d.IndicesLookup,
+			PersistentSettings: d.PersistentSettings,
+			TransientSettings:  d.TransientSettings,
+			Security:           d.Security,
+		},
+		RoutingTable: RoutingTable{
+			IndicesRouting: indicesRouting,
+		},
+	}
+	clusterState.setLocalNode(localNode)
+	return clusterState, nil
+}
+
+func (d *ClusterStateDiff) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(d.FromTerm)
+	out.WriteInt64(d.FromVersion)
+	out.WriteInt64(d.Version)
+	out.WriteString(d.StateUUID)
+	out.WriteString(d.Name)
+	out.WriteString(d.MasterNodeId)
+	out.WriteVInt(uint64(len(d.UpsertedNodes)))
+	for _, node := range d.UpsertedNodes {
+		node.WriteTo(out)
+	}
+	out.WriteStringSlice(d.RemovedNodes)
+	d.Coordination.WriteTo(out)
+	out.WriteStringMap(d.PersistentSettings)
+	out.WriteStringMap(d.TransientSettings)
+	d.Security.WriteTo(out)
+	out.WriteVInt(uint64(len(d.IndicesLookup)))
+	for name, alias := range d.IndicesLookup {
+		out.WriteString(name)
+		out.WriteString(alias.AliasName)
+		alias.WriteIndex.WriteTo(out)
+	}
+	out.WriteVInt(uint64(len(d.UpsertedIndices)))
+	for name, indexMetadata := range d.UpsertedIndices {
+		out.WriteString(name)
+		indexMetadata.WriteTo(out)
+	}
+	out.WriteStringSlice(d.RemovedIndices)
+	out.WriteVInt(uint64(len(d.UpsertedIndicesRouting)))
+	for name, indexRoutingTable := range d.UpsertedIndicesRouting {
+		out.WriteString(name)
+		indexRoutingTable.WriteTo(out)
+	}
+	out.WriteStringSlice(d.RemovedIndicesRouting)
+}
+
+func ReadClusterStateDiff(in *common.StreamInput) (*ClusterStateDiff, error) {
+	d := ClusterStateDiff{
+		FromTerm:               in.ReadInt64(),
+		FromVersion:            in.ReadInt64(),
+		Version:                in.ReadInt64(),
+		StateUUID:              in.ReadString(),
+		Name:                   in.ReadString(),
+		MasterNodeId:           in.ReadString(),
+		UpsertedNodes:          map[string]Node{},
+		IndicesLookup:          map[string]IndexAbstractionAlias{},
+		UpsertedIndices:        map[string]IndexMetadata{},
+		UpsertedIndicesRouting: map[string]IndexRoutingTable{},
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		node := ReadNode(in)
+		d.UpsertedNodes[node.Id] = node
+	}
+	d.RemovedNodes = in.ReadStringSlice()
+	d.Coordination = ReadCoordinationMetadata(in)
+	d.PersistentSettings = in.ReadStringMap()
+	d.TransientSettings = in.ReadStringMap()
+	d.Security = ReadSecurityMetadata(in)
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		name := in.ReadString()
+		d.IndicesLookup[name] = IndexAbstractionAlias{
+			AliasName:  in.ReadString(),
+			WriteIndex: ReadIndexMetadata(in),
+		}
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		name := in.ReadString()
+		d.UpsertedIndices[name] = ReadIndexMetadata(in)
+	}
+	d.RemovedIndices = in.ReadStringSlice()
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		name := in.ReadString()
+		d.UpsertedIndicesRouting[name] = ReadIndexRoutingTable(in)
+	}
+	d.RemovedIndicesRouting = in.ReadStringSlice()
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
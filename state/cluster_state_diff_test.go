@@ -0,0 +1,83 @@
+package state
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func diffTestClusterState(version int64, nodes []Node, indices ...string) ClusterState {
+	clusterState := ClusterState{
+		Version: version,
+		Name:    "searchgoose-testCluster",
+		Nodes: &Nodes{
+			Nodes:        map[string]Node{},
+			DataNodes:    map[string]Node{},
+			MasterNodes:  map[string]Node{},
+			MasterNodeId: nodes[0].Id,
+		},
+		Metadata: Metadata{
+			Coordination: CoordinationMetadata{Term: 2},
+			Indices:      map[string]IndexMetadata{},
+		},
+		RoutingTable: RoutingTable{
+			IndicesRouting: map[string]IndexRoutingTable{},
+		},
+	}
+	for _, node := range nodes {
+		clusterState.Nodes.Add(node)
+	}
+	for _, name := range indices {
+		index := Index{Name: name, Uuid: name + "-uuid"}
+		clusterState.Metadata.Indices[name] = IndexMetadata{Index: index, NumberOfShards: 1}
+		clusterState.RoutingTable.IndicesRouting[name] = IndexRoutingTable{
+			Index: index,
+			Shards: map[int]IndexShardRoutingTable{
+				0: {
+					ShardId: ShardId{Index: index},
+					Primary: ShardRouting{ShardId: ShardId{Index: index}, Primary: true, State: ShardUnassigned},
+				},
+			},
+		}
+	}
+	return clusterState
+}
+
+func TestClusterStateDiff_Apply(t *testing.T) {
+	// Arrange
+	node1 := Node{Name: "node1", Id: "testNodeId1", Roles: NodeRoles(true, true, true)}
+	node2 := Node{Name: "node2", Id: "testNodeId2", Roles: NodeRoles(true, true, true)}
+	node3 := Node{Name: "node3", Id: "testNodeId3", Roles: NodeRoles(false, true, false)}
+	previous := diffTestClusterState(5, []Node{node1, node2}, "index1", "index2", "index3")
+	current := diffTestClusterState(6, []Node{node1, node3}, "index1", "index2", "index4")
+	started := current.RoutingTable.IndicesRouting["index2"].Shards[0]
+	started.Primary.State = ShardStarted
+	started.Primary.CurrentNodeId = "testNodeId3"
+	current.RoutingTable.IndicesRouting["index2"].Shards[0] = started
+	stale := diffTestClusterState(4, []Node{node1, node2}, "index1")
+
+	// Action
+	diff, readErr := ReadClusterStateDiff(common.NewStreamInput(common.ToBytes(DiffClusterState(previous, current), common.CurrentVersion), common.CurrentVersion))
+	applied, err := diff.Apply(previous, node3)
+	_, staleErr := diff.Apply(stale, node3)
+
+	// Assert
+	assert.Nil(t, readErr)
+	assert.Nil(t, err)
+	// only what changed is sent
+	assert.Len(t, diff.UpsertedNodes, 1)
+	assert.Equal(t, []string{"testNodeId2"}, diff.RemovedNodes)
+	assert.Len(t, diff.UpsertedIndices, 1)
+	assert.Equal(t, []string{"index3"}, diff.RemovedIndices)
+	assert.Len(t, diff.UpsertedIndicesRouting, 2)
+	assert.Equal(t, int64(6), applied.Version)
+	assert.Equal(t, "testNodeId3", applied.Nodes.LocalNodeId)
+	assert.Equal(t, current.Nodes.Nodes, applied.Nodes.Nodes)
+	assert.Equal(t, current.Nodes.MasterNodes, applied.Nodes.MasterNodes)
+	assert.Equal(t, current.Metadata.Indices, applied.Metadata.Indices)
+	assert.Equal(t, current.RoutingTable.IndicesRouting, applied.RoutingTable.IndicesRouting)
+	// the previous state is left unchanged
+	assert.Len(t, previous.Nodes.Nodes, 2)
+	assert.Contains(t, previous.Metadata.Indices, "index3")
+	assert.NotNil(t, staleErr)
+}
@@ -1,7 +1,298 @@
 package discovery
 
+import (
+	"errors"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	followerCheckInterval   = time.Second
+	followerCheckTimeout    = 10 * time.Second
+	followerCheckRetryCount = 3
+
+	leaderCheckInterval   = time.Second
+	leaderCheckTimeout    = 10 * time.Second
+	leaderCheckRetryCount = 3
+)
+
+// LeaderChecker runs on the followers, it checks the leader and reports it once it failed leaderCheckRetryCount
+// checks in a row, or answered that it is no longer the leader of the follower.
 type LeaderChecker struct {
+	transportService *transport.Service
+
+	// functions from coordinator
+	nodesSupplier   func() *state.Nodes // the nodes of the cluster when the local node leads it, nil otherwise
+	onLeaderFailure func(leader state.Node)
+
+	leader state.Node
+	mux    sync.Mutex
+	stop   chan struct{}
+}
+
+func NewLeaderChecker(transportService *transport.Service, nodesSupplier func() *state.Nodes, onLeaderFailure func(leader state.Node)) *LeaderChecker {
+	c := &LeaderChecker{
+		transportService: transportService,
+		nodesSupplier:    nodesSupplier,
+		onLeaderFailure:  onLeaderFailure,
+	}
+	transportService.RegisterRequestHandler(transport.LEADER_CHECK_REQ, c.handleLeaderCheck)
+	return c
+}
+
+func (c *LeaderChecker) activate(leader state.Node) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.stop != nil {
+		if c.leader.Id == leader.Id {
+			return
+		}
+		close(c.stop)
+	}
+	c.leader = leader
+	c.stop = make(chan struct{})
+	go c.run(c.stop, leader)
+}
+
+func (c *LeaderChecker) deactivate() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
+
+func (c *LeaderChecker) run(stop chan struct{}, leader state.Node) {
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if c.check(leader) {
+			failures = 0
+			continue
+		}
+		failures += 1
+		if failures < leaderCheckRetryCount {
+			continue
+		}
+		logrus.Warnf("LeaderChecker: leader %v failed %d checks in a row", leader, failures)
+		select {
+		case <-stop:
+		default:
+			c.onLeaderFailure(leader)
+		}
+		return
+	}
+}
+
+// check sends a leader check to the leader and waits for its response, an error response when it no longer leads.
+func (c *LeaderChecker) check(leader state.Node) bool {
+	done := make(chan bool, 1)
+	go c.transportService.ConnectToRemoteNode(leader.HostAddress, func(remoteNode *state.Node) {
+		if remoteNode == nil || remoteNode.Id != leader.Id {
+			done <- false
+			return
+		}
+		request := LeaderCheckRequest{SourceNodeId: c.transportService.LocalNode.Id}
+		content := common.ToBytes(&request, c.transportService.GetVersion(leader))
+		c.transportService.SendRequestWithHandler(leader, transport.LEADER_CHECK_REQ, content, transport.RequestOptions{Timeout: leaderCheckTimeout}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				done <- true
+			},
+			OnFailure: func(err error) {
+				done <- false
+			},
+		})
+	})
+
+	timer := time.NewTimer(leaderCheckTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *LeaderChecker) handleLeaderCheck(channel transport.ReplyChannel, req []byte) {
+	request, err := ReadLeaderCheckRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
+	nodes := c.nodesSupplier()
+	if nodes == nil {
+		channel.SendError(errors.New("the node is no longer the leader"))
+		return
+	}
+	// a follower removed from the cluster joins it again
+	if _, existing := nodes.Nodes[request.SourceNodeId]; !existing {
+		channel.SendError(errors.New("the node is not in the cluster"))
+		return
+	}
+	channel.SendMessage(transport.LEADER_CHECK_ACK, []byte{})
+}
+
+// LeaderCheckRequest asks the leader whether the follower is still in the cluster.
+type LeaderCheckRequest struct {
+	SourceNodeId string
+}
+
+func (r *LeaderCheckRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.SourceNodeId)
+}
+
+func ReadLeaderCheckRequest(in *common.StreamInput) (*LeaderCheckRequest, error) {
+	request := LeaderCheckRequest{SourceNodeId: in.ReadString()}
+	return &request, in.Err()
 }
 
+// FollowersChecker runs on the leader, it checks every other node of the cluster and reports the nodes
+// failing followerCheckRetryCount checks in a row.
 type FollowersChecker struct {
+	transportService *transport.Service
+
+	// functions from coordinator
+	nodesSupplier func() *state.Nodes
+	onNodesFailed func(nodeIds []string)
+
+	failures map[string]int
+	mux      sync.Mutex
+	stop     chan struct{}
+}
+
+func NewFollowersChecker(transportService *transport.Service, nodesSupplier func() *state.Nodes, onNodesFailed func(nodeIds []string)) *FollowersChecker {
+	c := &FollowersChecker{
+		transportService: transportService,
+		nodesSupplier:    nodesSupplier,
+		onNodesFailed:    onNodesFailed,
+		failures:         map[string]int{},
+	}
+	transportService.RegisterRequestHandler(transport.FOLLOWER_CHECK_REQ, c.handleFollowerCheck)
+	return c
+}
+
+func (c *FollowersChecker) activate() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+	go c.run(c.stop)
+}
+
+func (c *FollowersChecker) deactivate() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.failures = map[string]int{}
+}
+
+func (c *FollowersChecker) run(stop chan struct{}) {
+	ticker := time.NewTicker(followerCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		nodes := c.nodesSupplier()
+		if nodes == nil {
+			continue
+		}
+		wg := sync.WaitGroup{}
+		var failedLock sync.Mutex
+		var failed []string
+		for _, node := range nodes.Nodes {
+			if node.Id == c.transportService.LocalNode.Id {
+				continue
+			}
+			wg.Add(1)
+			go func(node state.Node) {
+				defer wg.Done()
+				if c.check(node) {
+					return
+				}
+				failedLock.Lock()
+				failed = append(failed, node.Id)
+				failedLock.Unlock()
+			}(node)
+		}
+		wg.Wait()
+
+		if nodeIds := c.updateFailures(nodes, failed); len(nodeIds) > 0 {
+			c.onNodesFailed(nodeIds)
+		}
+	}
+}
+
+// check sends a follower check to the node and waits for its response.
+func (c *FollowersChecker) check(node state.Node) bool {
+	done := make(chan bool, 1)
+	go c.transportService.ConnectToRemoteNode(node.HostAddress, func(remoteNode *state.Node) {
+		if remoteNode == nil || remoteNode.Id != node.Id {
+			done <- false
+			return
+		}
+		c.transportService.SendRequestWithHandler(node, transport.FOLLOWER_CHECK_REQ, []byte{}, transport.RequestOptions{Timeout: followerCheckTimeout}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				done <- true
+			},
+			OnFailure: func(err error) {
+				done <- false
+			},
+		})
+	})
+
+	timer := time.NewTimer(followerCheckTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-done:
+		return ok
+	case <-timer.C:
+		return false
+	}
+}
+
+// updateFailures counts the consecutive failures of the nodes, it returns the nodes to remove.
+func (c *FollowersChecker) updateFailures(nodes *state.Nodes, failed []string) []string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	failures := map[string]int{}
+	var removed []string
+	for _, nodeId := range failed {
+		if _, existing := nodes.Nodes[nodeId]; !existing {
+			continue
+		}
+		failures[nodeId] = c.failures[nodeId] + 1
+		if failures[nodeId] >= followerCheckRetryCount {
+			logrus.Warnf("FollowersChecker: node [%s] failed %d checks in a row", nodeId, failures[nodeId])
+			removed = append(removed, nodeId)
+			delete(failures, nodeId)
+		}
+	}
+	c.failures = failures
+	return removed
+}
+
+func (c *FollowersChecker) handleFollowerCheck(channel transport.ReplyChannel, req []byte) {
+	channel.SendMessage(transport.FOLLOWER_CHECK_ACK, []byte{})
 }
@@ -3,20 +3,40 @@ package discovery
 import (
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
 )
 
+// bootstrapPlaceholderPrefix marks the initial master nodes not discovered at bootstrap, they count in the quorum
+// of the first voting configuration until a reconfiguration replaces them.
+const bootstrapPlaceholderPrefix = "{bootstrap-placeholder}-"
+
+// ClusterBootstrapService sets the first voting configuration of a cluster that never formed.
 type ClusterBootstrapService struct {
 	TransportService *transport.Service
+	// InitialMasterNodes are the cluster.initial_master_nodes setting, the names, ids or addresses of the
+	// master-eligible nodes of the first election. Without it a node with no seed hosts bootstraps a cluster
+	// of its own, and a node with seed hosts waits to join an elected master.
+	InitialMasterNodes []string
+
+	// functions from coordinator
+	isBootstrapped          func() bool
+	setInitialConfiguration func(configuration state.VotingConfiguration)
 }
 
-func NewClusterBootstrapService(service *transport.Service) *ClusterBootstrapService {
+func NewClusterBootstrapService(service *transport.Service, isBootstrapped func() bool, setInitialConfiguration func(configuration state.VotingConfiguration)) *ClusterBootstrapService {
 	return &ClusterBootstrapService{
-		TransportService: service,
+		TransportService:        service,
+		isBootstrapped:          isBootstrapped,
+		setInitialConfiguration: setInitialConfiguration,
 	}
 }
 
-func (s *ClusterBootstrapService) onFoundPeersUpdated() {
-	s.startBootstrap()
+// onFoundPeersUpdated bootstraps the cluster if it can, it tells whether the cluster is bootstrapped.
+func (s *ClusterBootstrapService) onFoundPeersUpdated(peers []state.Node) bool {
+	if s.isBootstrapped() {
+		return true
+	}
+	return s.startBootstrap(peers)
 }
 
 /*
@@ -26,8 +46,51 @@ func (s *ClusterBootstrapService) ScheduleUnconfiguredBootstrap() {
 */
 
 func (s *ClusterBootstrapService) doBootstrap(configuration state.VotingConfiguration) {
-
+	logrus.Infof("ClusterBootstrapService: bootstrapping the cluster with voting configuration %v", configuration.NodeIds)
+	s.setInitialConfiguration(configuration)
 }
 
-func (s *ClusterBootstrapService) startBootstrap() {
+func (s *ClusterBootstrapService) startBootstrap(peers []state.Node) bool {
+	localNode := s.TransportService.GetLocalNode()
+	if !localNode.IsMasterNode() {
+		return false
+	}
+	nodes := []state.Node{localNode}
+	for _, peer := range peers {
+		if peer.IsMasterNode() && peer.Id != localNode.Id {
+			nodes = append(nodes, peer)
+		}
+	}
+
+	if len(s.InitialMasterNodes) == 0 {
+		if len(s.TransportService.GetSeedHosts()) > 0 {
+			return false
+		}
+		configuration := state.VotingConfiguration{}
+		for _, node := range nodes {
+			configuration.NodeIds = append(configuration.NodeIds, node.Id)
+		}
+		s.doBootstrap(configuration)
+		return true
+	}
+
+	configuration := state.VotingConfiguration{}
+	matched := 0
+	for _, requirement := range s.InitialMasterNodes {
+		nodeId := bootstrapPlaceholderPrefix + requirement
+		for _, node := range nodes {
+			if node.Name == requirement || node.Id == requirement || node.HostAddress == requirement {
+				nodeId = node.Id
+				matched += 1
+				break
+			}
+		}
+		configuration.NodeIds = append(configuration.NodeIds, nodeId)
+	}
+	if matched*2 <= len(s.InitialMasterNodes) {
+		logrus.Infof("ClusterBootstrapService: waiting for a majority of the initial master nodes %v, found %d", s.InitialMasterNodes, matched)
+		return false
+	}
+	s.doBootstrap(configuration)
+	return true
 }
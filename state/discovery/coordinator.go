@@ -1,14 +1,20 @@
 package discovery
 
 import (
+	"fmt"
 	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type Mode int
+type Mode int32
 
 const (
 	INIT Mode = iota
@@ -18,6 +24,12 @@ const (
 	PREVOTING
 )
 
+const (
+	electionInitialTimeout = 100 * time.Millisecond
+	electionBackOffTime    = 100 * time.Millisecond
+	electionMaxTimeout     = 10 * time.Second
+)
+
 // Coordinator
 type Coordinator struct {
 	TransportService *transport.Service
@@ -29,6 +41,9 @@ type Coordinator struct {
 	ClusterApplierService   *cluster.ApplierService
 	MasterService           *cluster.MasterService
 	ClusterBootstrapService *ClusterBootstrapService
+	AllocationService       *cluster.AllocationService
+	FollowersChecker        *FollowersChecker
+	LeaderChecker           *LeaderChecker
 
 	PreVoteCollector *PreVoteCollector
 
@@ -38,7 +53,14 @@ type Coordinator struct {
 
 	maxTermSeen int64
 
+	// mode is read by the checkers and the publications concurrently, it is accessed atomically through getMode and
+	// setMode
 	mode Mode
+	// electionMux guards the term and the join votes, joins are handled concurrently
+	electionMux sync.Mutex
+	// electionScheduler stops the election attempts of a candidate
+	electionScheduler chan struct{}
+	schedulerMux      sync.Mutex
 
 	Done    func()
 	active  bool
@@ -55,14 +77,30 @@ func NewCoordinator(transportService *transport.Service, clusterApplierService *
 	}
 
 	c.TransportService.RegisterRequestHandler(transport.PUBLISH_REQ, c.handlePublish)
+	c.TransportService.RegisterRequestHandler(transport.COMMIT_REQ, c.handleCommit)
+	c.ClusterApplierService.AddListener(c.connectToNodes)
 
-	c.PreVoteCollector = NewPreVoteCollector(transportService, c.startElection, c.updateMaxTermSeen)
+	c.PreVoteCollector = NewPreVoteCollector(transportService, c.startElection, c.updateMaxTermSeen, func(votes *state.VoteCollection) bool {
+		return c.CoordinationState.IsElectionQuorum(votes)
+	})
 	c.TransportService.RegisterRequestHandler(transport.PREVOTE_REQ, c.PreVoteCollector.handlePreVoteRequest)
 
 	c.JoinHelper = NewJoinHelper(transportService, c.joinLeaderInTerm, c.getCurrentTerm, c.handleJoinRequest)
 	c.TransportService.RegisterRequestHandler(transport.START_JOIN_REQ, c.JoinHelper.handleStartJoinRequest)
 	c.TransportService.RegisterRequestHandler(transport.JOIN_REQ, c.handleJoinRequest)
 
+	c.ClusterBootstrapService = NewClusterBootstrapService(transportService, c.isBootstrapped, c.setInitialConfiguration)
+
+	c.FollowersChecker = NewFollowersChecker(transportService, func() *state.Nodes {
+		return c.MasterService.State().Nodes
+	}, c.removeNodes)
+	c.LeaderChecker = NewLeaderChecker(transportService, func() *state.Nodes {
+		if c.getMode() != LEADER {
+			return nil
+		}
+		return c.MasterService.State().Nodes
+	}, c.onLeaderFailure)
+
 	return c
 }
 
@@ -75,33 +113,36 @@ func (c *Coordinator) Start() {
 	}
 
 	c.ApplierState = c.PersistedState.GetLastAcceptedState()
+	// there is no master until one wins an election and publishes its state
 	c.ApplierState = &state.ClusterState{
 		Name: "searchgoose-testClusters",
 		Nodes: &state.Nodes{
-			Nodes: map[string]state.Node{
-				c.TransportService.LocalNode.Id: c.TransportService.GetLocalNode(),
-			},
+			Nodes:       map[string]state.Node{},
 			LocalNodeId: c.TransportService.LocalNode.Id,
-			DataNodes: map[string]state.Node{
-				c.TransportService.LocalNode.Id: c.TransportService.GetLocalNode(),
-			},
-			MasterNodes: map[string]state.Node{
-				c.TransportService.LocalNode.Id: c.TransportService.GetLocalNode(),
-			},
-			MasterNodeId: c.TransportService.LocalNode.Id,
+			DataNodes:   map[string]state.Node{},
+			MasterNodes: map[string]state.Node{},
 		},
 		Metadata: state.Metadata{
 			Indices:       map[string]state.IndexMetadata{},
 			IndicesLookup: map[string]state.IndexAbstractionAlias{},
 		},
 	}
+	c.ApplierState.Nodes.Add(c.TransportService.GetLocalNode())
 	c.PeerFinder = NewCoordinatorPeerFinder(c)
-	c.PeerFinder.currentTerm = c.getCurrentTerm()
+	c.PeerFinder.setCurrentTerm(c.getCurrentTerm())
 
 	// c.PreVoteCollector.state[state.Node{}] = NewPreVoteResponse(c.getCurrentTerm())
 
 	c.ClusterApplierService.ClusterState = c.ApplierState
-	c.MasterService.ClusterState = c.ApplierState
+	c.MasterService.SetState(c.ApplierState)
+}
+
+func (c *Coordinator) getMode() Mode {
+	return Mode(atomic.LoadInt32((*int32)(&c.mode)))
+}
+
+func (c *Coordinator) setMode(mode Mode) {
+	atomic.StoreInt32((*int32)(&c.mode), int32(mode))
 }
 
 func (c *Coordinator) StartInitialJoin() {
@@ -109,60 +150,105 @@ func (c *Coordinator) StartInitialJoin() {
 }
 
 func (c *Coordinator) becomeCandidate(method string) {
-	if c.mode != CANDIDATE {
-		c.mode = CANDIDATE
-		c.PeerFinder.activate(c.CoordinationState.PersistedState.GetLastAcceptedState().Nodes)
+	if mode := c.getMode(); mode == CANDIDATE || mode == PREVOTING {
+		return
 	}
+	logrus.Infof("%v: Coordinator becoming CANDIDATE in term {%d}", method, c.getCurrentTerm())
+	c.setMode(CANDIDATE)
+	c.active = false
+	c.lastKnownLeader = nil
+	c.FollowersChecker.deactivate()
+	c.LeaderChecker.deactivate()
+	c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), state.Node{})
+	go c.PeerFinder.activate(c.CoordinationState.PersistedState.GetLastAcceptedState().Nodes)
+	c.startElectionScheduler()
 }
 
 func (c *Coordinator) becomeLeader(method string) {
+	if !c.TransportService.LocalNode.IsMasterNode() {
+		logrus.Warnf("%v: not becoming LEADER, the local node is not master-eligible", method)
+		return
+	}
 
 	c.active = true
 
 	logrus.Infof("%v: Coordinator becoming LEADER in term {%d}\n", method, c.getCurrentTerm())
 	localNode := c.TransportService.GetLocalNode()
-	c.mode = LEADER
+	c.setMode(LEADER)
+	c.lastKnownLeader = &localNode
+	c.stopElectionScheduler()
+	c.LeaderChecker.deactivate()
 	c.PeerFinder.deactivate(localNode)
-	c.updateCurrentTerm()
 	c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), localNode)
 
-	// make new cluster state
-	newClusterState := &state.ClusterState{
-		Name: "searchgoose-testClusters",
-		Nodes: &state.Nodes{
-			LocalNodeId:  c.TransportService.LocalNode.Id,
-			MasterNodeId: c.TransportService.LocalNode.Id,
-			Nodes: map[string]state.Node{
-				c.TransportService.LocalNode.Id: c.TransportService.GetLocalNode(),
-			},
-			DataNodes: map[string]state.Node{},
-			MasterNodes: map[string]state.Node{
-				c.TransportService.LocalNode.Id: c.TransportService.GetLocalNode(),
-			},
-		},
-		Metadata: state.Metadata{
-			Indices:       map[string]state.IndexMetadata{},
-			IndicesLookup: map[string]state.IndexAbstractionAlias{},
-		},
-	}
-
-	_, nodes := c.TransportService.GetConnectedPeers()
-	nodes = append(nodes, c.TransportService.GetLocalNode())
-	for _, node := range nodes {
-		newClusterState.Nodes.Nodes[node.Id] = node
-		newClusterState.Nodes.DataNodes[node.Id] = node
-		newClusterState.Nodes.MasterNodes[node.Id] = node
-	}
+	c.MasterService.SubmitStateUpdateTask("elected-as-master", state.TaskConfig{Priority: state.PriorityUrgent}, func(current state.ClusterState) state.ClusterState {
+		// the new leader carries on from the last state it accepted, with the nodes it is connected to
+		newClusterState := *c.PersistedState.GetLastAcceptedState()
+		if newClusterState.Metadata.Indices == nil {
+			newClusterState.Metadata.Indices = map[string]state.IndexMetadata{}
+		}
+		if newClusterState.Metadata.IndicesLookup == nil {
+			newClusterState.Metadata.IndicesLookup = map[string]state.IndexAbstractionAlias{}
+		}
+		lastNodes := newClusterState.Nodes
+		newClusterState.Nodes = &state.Nodes{
+			LocalNodeId:  localNode.Id,
+			MasterNodeId: localNode.Id,
+			Nodes:        map[string]state.Node{},
+			DataNodes:    map[string]state.Node{},
+			MasterNodes:  map[string]state.Node{},
+		}
 
-	c.Publish(state.ClusterChangedEvent{
-		State:     *newClusterState,
-		PrevState: *(c.ApplierState),
+		_, nodes := c.TransportService.GetConnectedPeers()
+		nodes = append(nodes, localNode)
+		var joining []state.Node
+		for _, node := range nodes {
+			if _, existing := lastNodes.Nodes[node.Id]; existing {
+				newClusterState.Nodes.Add(node)
+			} else {
+				joining = append(joining, node)
+			}
+		}
+		var departed []string
+		for nodeId := range lastNodes.Nodes {
+			if _, existing := newClusterState.Nodes.Nodes[nodeId]; !existing {
+				departed = append(departed, nodeId)
+			}
+		}
+		if len(departed) > 0 {
+			newClusterState = c.AllocationService.RemoveNodes(newClusterState, departed)
+		}
+		if len(joining) > 0 {
+			newClusterState = c.AllocationService.AddNodes(newClusterState, joining)
+		}
+		return cluster.Reconfigure(newClusterState)
 	})
-
+	c.FollowersChecker.activate()
 }
 
 func (c *Coordinator) becomeFollower(method string, leaderNode state.Node) {
+	if c.getMode() == FOLLOWER && c.lastKnownLeader != nil && c.lastKnownLeader.Id == leaderNode.Id {
+		return
+	}
+	logrus.Infof("%v: Coordinator becoming FOLLOWER of %v in term {%d}", method, leaderNode, c.getCurrentTerm())
+	c.setMode(FOLLOWER)
+	c.active = false
+	c.lastKnownLeader = &leaderNode
+	c.electionMux.Lock()
+	c.CoordinationState.ElectionWon = false
+	c.electionMux.Unlock()
+	c.stopElectionScheduler()
+	c.FollowersChecker.deactivate()
+	c.PeerFinder.deactivate(leaderNode)
+	c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), leaderNode)
+	c.LeaderChecker.activate(leaderNode)
+}
 
+// onLeaderFailure starts an election once the leader stopped answering the leader checks.
+func (c *Coordinator) onLeaderFailure(leader state.Node) {
+	logrus.Warnf("onLeaderFailure: leader %v failed", leader)
+	c.TransportService.DisconnectFromNode(leader.Id)
+	c.becomeCandidate("onLeaderFailure")
 }
 
 func (c *Coordinator) updateMaxTermSeen(term int64) {
@@ -170,18 +256,100 @@ func (c *Coordinator) updateMaxTermSeen(term int64) {
 	c.maxTermSeen = common.GetMaxInt(c.maxTermSeen, term)
 	currentTerm := c.getCurrentTerm()
 
-	if c.mode == LEADER && c.maxTermSeen > currentTerm {
-		// leader exit
+	if c.getMode() == LEADER && c.maxTermSeen > currentTerm {
+		// another node started an election in a later term, the leader joins it
+		logrus.Infof("updateMaxTermSeen: leader stepping down, term {%d} is greater than the current term {%d}", c.maxTermSeen, currentTerm)
+		c.becomeCandidate("updateMaxTermSeen")
+	}
+}
+
+// isBootstrapped tells whether the cluster has a voting configuration.
+func (c *Coordinator) isBootstrapped() bool {
+	return !c.PersistedState.GetLastAcceptedState().Metadata.Coordination.LastAcceptedConfiguration.IsEmpty()
+}
+
+// setInitialConfiguration sets the first voting configuration of the cluster, both committed and accepted.
+func (c *Coordinator) setInitialConfiguration(configuration state.VotingConfiguration) {
+	lastAcceptedState := *c.PersistedState.GetLastAcceptedState()
+	coordination := lastAcceptedState.Metadata.Coordination
+	if !coordination.LastAcceptedConfiguration.IsEmpty() {
+		logrus.Infof("setInitialConfiguration: the cluster is already bootstrapped with %v", coordination.LastAcceptedConfiguration.NodeIds)
+		return
+	}
+	coordination.LastCommittedConfiguration = configuration
+	coordination.LastAcceptedConfiguration = configuration
+	lastAcceptedState.Metadata.Coordination = coordination
+	c.PersistedState.SetLastAcceptedState(&lastAcceptedState)
+}
+
+// startElectionOrBootstrap starts an election of a candidate, once the cluster has a voting configuration.
+func (c *Coordinator) startElectionOrBootstrap(method string) {
+	if !c.TransportService.LocalNode.IsMasterNode() {
+		return
+	}
+	if mode := c.getMode(); mode != CANDIDATE && mode != PREVOTING {
+		return
+	}
+	_, peers := c.TransportService.GetConnectedPeers()
+	if !c.ClusterBootstrapService.onFoundPeersUpdated(peers) {
+		return
+	}
+	c.startPreVote(method)
+}
+
+// startElectionScheduler retries the election of a candidate after a random delay growing with every attempt,
+// so that the candidates do not keep splitting the votes.
+func (c *Coordinator) startElectionScheduler() {
+	c.schedulerMux.Lock()
+	defer c.schedulerMux.Unlock()
+	if c.electionScheduler != nil {
+		return
+	}
+	c.electionScheduler = make(chan struct{})
+	go c.runElectionScheduler(c.electionScheduler)
+}
+
+func (c *Coordinator) stopElectionScheduler() {
+	c.schedulerMux.Lock()
+	defer c.schedulerMux.Unlock()
+	if c.electionScheduler != nil {
+		close(c.electionScheduler)
+		c.electionScheduler = nil
+	}
+}
+
+func (c *Coordinator) runElectionScheduler(stop chan struct{}) {
+	for attempt := 0; ; attempt++ {
+		maxDelay := electionInitialTimeout + time.Duration(attempt)*electionBackOffTime
+		if maxDelay > electionMaxTimeout {
+			maxDelay = electionMaxTimeout
+		}
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(maxDelay))) + 1)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if mode := c.getMode(); mode != CANDIDATE && mode != PREVOTING {
+			continue
+		}
+		c.PeerFinder.probePeers()
+		c.startElectionOrBootstrap("electionScheduler")
 	}
 }
 
 func (c *Coordinator) startElection() {
 	localNode := c.TransportService.GetLocalNode()
 
-	if c.mode == PREVOTING {
+	if c.getMode() == PREVOTING {
+		lastAcceptedTerm, lastAcceptedVersion := c.getLastAccepted()
 		startJoinRequest := StartJoinRequest{
-			SourceNode: localNode,
-			Term:       common.GetMaxInt(c.maxTermSeen, 1) + 1,
+			SourceNode:          localNode,
+			Term:                common.GetMaxInt(c.maxTermSeen, c.getCurrentTerm()) + 1,
+			LastAcceptedTerm:    lastAcceptedTerm,
+			LastAcceptedVersion: lastAcceptedVersion,
 		}
 
 		logrus.Infof("Start election with %v\n", startJoinRequest)
@@ -190,6 +358,10 @@ func (c *Coordinator) startElection() {
 		_, discoveredNodes := c.TransportService.GetConnectedPeers()
 		discoveredNodes = append(discoveredNodes, c.TransportService.GetLocalNode())
 		for _, node := range discoveredNodes {
+			// only the master-eligible nodes vote
+			if !node.IsMasterNode() {
+				continue
+			}
 			go c.JoinHelper.SendStartJoinRequest(startJoinRequest, node)
 		}
 	}
@@ -199,71 +371,146 @@ func (c *Coordinator) joinLeaderInTerm(request *StartJoinRequest) *state.Join {
 	localNode := c.TransportService.GetLocalNode()
 
 	logrus.Infof("joinLeaderInTerm: for %v with term={%d}\n", request.SourceNode, request.Term)
+	c.electionMux.Lock()
 	if request.Term <= c.getCurrentTerm() {
+		c.electionMux.Unlock()
 		logrus.Infof("handleStartJoin: ignoring as term provided is not greater than current term \n")
+		return nil
 	}
 
 	logrus.Infof("handleStartJoin: leaving term [%d] due to %v", c.getCurrentTerm(), request)
 
 	c.CoordinationState.Term = request.Term
 	c.CoordinationState.JoinVotes = state.NewVoteCollection()
+	c.CoordinationState.ElectionWon = false
 	//c.CoordinationState.PublishVotes = state.NewVoteCollection()
 
-	join := state.NewJoin(localNode, request.SourceNode, c.getCurrentTerm())
-	c.lastJoin = join
+	c.PeerFinder.setCurrentTerm(c.getCurrentTerm())
 
-	c.PeerFinder.currentTerm = c.getCurrentTerm()
+	// the term is raised either way, but a candidate missing a state the local node accepted does not get its vote
+	var join *state.Join
+	lastAcceptedTerm, lastAcceptedVersion := c.getLastAccepted()
+	if isOlderState(request.LastAcceptedTerm, request.LastAcceptedVersion, lastAcceptedTerm, lastAcceptedVersion) {
+		logrus.Infof("handleStartJoin: not voting for %v, its last accepted state of version {%d} in term {%d} is older than version {%d} in term {%d}",
+			request.SourceNode, request.LastAcceptedVersion, request.LastAcceptedTerm, lastAcceptedVersion, lastAcceptedTerm)
+	} else {
+		join = state.NewJoin(localNode, request.SourceNode, c.getCurrentTerm())
+		join.LastAcceptedTerm = lastAcceptedTerm
+		join.LastAcceptedVersion = lastAcceptedVersion
+		c.lastJoin = join
+	}
+	c.electionMux.Unlock()
 
-	if c.mode != PREVOTING {
-		//c.becomeCandidate("joinLeaderInTerm")
+	if mode := c.getMode(); mode == LEADER || mode == FOLLOWER {
+		c.becomeCandidate("joinLeaderInTerm")
 	} else {
 		// followersChecker.updateFastResponseState(getCurrentTerm(), mode);
-		c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), c.ApplierState.Nodes.MasterNode())
-		//c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), state.Node{})
+		c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), state.Node{})
 	}
 
 	return join
 }
 
 func (c *Coordinator) handleJoinRequest(channel transport.ReplyChannel, req []byte) {
-	c.TransportService.ConnectToRemoteNode(channel.GetDestAddress(), func(remoteNode *state.Node) {
-		joinReqData := JoinRequestFromBytes(req)
-		logrus.Infof("handleJoinRequest: as {%d}, handling %v\n", c.mode, joinReqData)
-		c.updateMaxTermSeen(joinReqData.GetTerm())
-		if joinReqData.Join != (state.Join{}) {
-			c.handleJoin(joinReqData.Join)
-		}
-		if c.CoordinationState.ElectionWon == true {
-			c.becomeLeader("handleJoinRequest")
+	joinReqData, err := ReadJoinRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
+	logrus.Infof("handleJoinRequest: as {%d}, handling %v\n", c.getMode(), joinReqData)
+	c.updateMaxTermSeen(joinReqData.GetTerm())
+	if joinReqData.Join.SourceNode.Id != "" {
+		c.handleJoin(joinReqData.Join)
+	}
+
+	sourceNode := joinReqData.SourceNode
+	if c.getMode() == LEADER && sourceNode.Id != c.TransportService.LocalNode.Id {
+		// a node joining the running cluster is added to its state
+		go c.TransportService.ConnectToRemoteNode(sourceNode.HostAddress, func(remoteNode *state.Node) {
+			if remoteNode == nil {
+				logrus.Warnf("handleJoinRequest: failed to connect back to %v", sourceNode)
+				return
+			}
+			c.addNode(*remoteNode)
+		})
+	}
+	channel.SendMessage(transport.JOIN_ACK, []byte{})
+}
+
+func (c *Coordinator) addNode(node state.Node) {
+	c.MasterService.SubmitStateUpdateTask("node-join "+node.Name, state.TaskConfig{Priority: state.PriorityUrgent}, func(current state.ClusterState) state.ClusterState {
+		if _, existing := current.Nodes.Nodes[node.Id]; existing {
+			// the state is published to the node again, e.g. it restarted its election after missing leader checks
+			return current
 		}
+		logrus.Infof("addNode: node %v joined the cluster", node)
+		return cluster.Reconfigure(c.AllocationService.AddNodes(current, []state.Node{node}))
+	})
+}
+
+// removeNodes removes the nodes failing the follower checks, their shards are reassigned. The leader steps down
+// when the removal is not committed, or once the remaining master-eligible nodes are no longer a quorum of the
+// voting configuration.
+func (c *Coordinator) removeNodes(nodeIds []string) {
+	err := c.MasterService.SubmitStateUpdateTask("node-left "+strings.Join(nodeIds, ","), state.TaskConfig{Priority: state.PriorityImmediate}, func(current state.ClusterState) state.ClusterState {
+		logrus.Warnf("removeNodes: nodes %v left the cluster", nodeIds)
+		return cluster.Reconfigure(c.AllocationService.RemoveNodes(current, nodeIds))
 	})
+	for _, nodeId := range nodeIds {
+		c.TransportService.DisconnectFromNode(nodeId)
+	}
+	// a state not applied by every node is committed all the same
+	if err != nil && err != state.ErrNotAcknowledged {
+		logrus.Warnf("removeNodes: failed to remove nodes %v, %v", nodeIds, err)
+		if _, failed := err.(*state.FailedToCommitError); failed && c.getMode() == LEADER {
+			c.becomeCandidate("removeNodes")
+		}
+		return
+	}
+
+	clusterState := c.MasterService.State()
+	configuration := clusterState.Metadata.Coordination.LastCommittedConfiguration
+	if c.getMode() == LEADER && !configuration.HasQuorum(clusterState.Nodes.MasterNodeIds()) {
+		logrus.Warnf("removeNodes: the master-eligible nodes %v are no longer a quorum of %v", clusterState.Nodes.MasterNodeIds(), configuration.NodeIds)
+		c.becomeCandidate("removeNodes")
+	}
 }
 
 func (c *Coordinator) handleJoin(join state.Join) {
+	if !join.SourceNode.IsMasterNode() {
+		logrus.Infof("handleJoin: ignoring the vote of %v, it is not master-eligible", join.SourceNode)
+		return
+	}
 	localNode := c.TransportService.GetLocalNode()
 	localJoin := c.ensureTermAtLeast(localNode, join.Term)
 	if localJoin != nil {
 		c.handleJoin(*localJoin)
 	}
 
-	if c.CoordinationState.ElectionWon == false {
-		//if c.getCurrentTerm() != join.Term {
-		//	logrus.Infof("handleJoin: ignored join due to term mismatch current={%d} term={%d}", c.getCurrentTerm(), join.Term)
-		//	return
-		//}
-
+	c.electionMux.Lock()
+	if c.getCurrentTerm() != join.Term || join.TargetNode.Id != localNode.Id {
+		c.electionMux.Unlock()
+		logrus.Infof("handleJoin: ignored join due to term mismatch current={%d} term={%d}", c.getCurrentTerm(), join.Term)
+		return
+	}
+	lastAcceptedTerm, lastAcceptedVersion := c.getLastAccepted()
+	if isOlderState(lastAcceptedTerm, lastAcceptedVersion, join.LastAcceptedTerm, join.LastAcceptedVersion) {
+		c.electionMux.Unlock()
+		logrus.Infof("handleJoin: ignored join of %v, its last accepted state of version {%d} in term {%d} is newer than version {%d} in term {%d}",
+			join.SourceNode, join.LastAcceptedVersion, join.LastAcceptedTerm, lastAcceptedVersion, lastAcceptedTerm)
+		return
+	}
+	c.CoordinationState.JoinVotes.AddJoinVote(join)
+	electionWon := false
+	if c.CoordinationState.ElectionWon == false && c.CoordinationState.IsElectionQuorum(c.CoordinationState.JoinVotes) {
 		c.CoordinationState.ElectionWon = true
+		electionWon = true
 		logrus.Infof("handleJoin: election won in term={%d} with %v\n", c.getCurrentTerm(), c.CoordinationState.JoinVotes)
+	}
+	c.electionMux.Unlock()
 
-		//c.CoordinationState.JoinVotes.AddJoinVote(join)
-		//
-		//nodeIds, _ := c.TransportService.GetConnectedPeers()
-		//nodeIds = append(nodeIds, localNode.Id)
-		//c.CoordinationState.ElectionWon = c.CoordinationState.IsElectionQuorum(nodeIds)
-		//
-		//if c.CoordinationState.ElectionWon {
-		//	logrus.Infof("handleJoin: election won in term={%d} with %v\n", c.getCurrentTerm(), c.CoordinationState.JoinVotes)
-		//}
+	if electionWon {
+		c.becomeLeader("handleJoin")
 	}
 }
 
@@ -271,70 +518,177 @@ func (c *Coordinator) getCurrentTerm() int64 {
 	return c.CoordinationState.Term
 }
 
-func (c *Coordinator) updateCurrentTerm() {
-	c.CoordinationState.Term += 1
+// getLastAccepted returns the term and the version of the last accepted state.
+func (c *Coordinator) getLastAccepted() (int64, int64) {
+	lastAcceptedState := c.PersistedState.GetLastAcceptedState()
+	return lastAcceptedState.Metadata.Coordination.Term, lastAcceptedState.Version
+}
+
+// isOlderState tells whether the state of the term and version is older than the other one, a state of a later term
+// is newer whatever its version.
+func isOlderState(term int64, version int64, otherTerm int64, otherVersion int64) bool {
+	return term < otherTerm || (term == otherTerm && version < otherVersion)
 }
 
 func (c *Coordinator) ensureTermAtLeast(sourceNode state.Node, targetTerm int64) *state.Join {
 	if c.getCurrentTerm() < targetTerm {
+		lastAcceptedTerm, lastAcceptedVersion := c.getLastAccepted()
 		request := &StartJoinRequest{
-			SourceNode: sourceNode,
-			Term:       targetTerm,
+			SourceNode:          sourceNode,
+			Term:                targetTerm,
+			LastAcceptedTerm:    lastAcceptedTerm,
+			LastAcceptedVersion: lastAcceptedVersion,
 		}
 		return c.joinLeaderInTerm(request)
 	}
 	return nil
 }
 
-func (c *Coordinator) Publish(event state.ClusterChangedEvent) {
-	//if c.mode != LEADER {
-	//	return
-	//}
+// Publish publishes the state in two phases, see Publication. The leader steps down when the state was not committed.
+func (c *Coordinator) Publish(event state.ClusterChangedEvent) error {
+	lastAcceptedState := c.PersistedState.GetLastAcceptedState()
 
 	newState := event.State
-	nodes := newState.Nodes.Nodes
-	for _, node := range nodes {
-		logrus.Infof("Publish: leader=%v publish to DestNode=%v", c.TransportService.LocalNode, node)
-		c.TransportService.SendRequest(node, transport.PUBLISH_REQ, newState.ToBytes(), func(response []byte) {
-
-		})
+	newState.Version = common.GetMaxInt(lastAcceptedState.Version, event.PrevState.Version) + 1
+	// the state carries the term of its leader
+	newState.Metadata.Coordination.Term = c.getCurrentTerm()
+
+	logrus.Infof("Publish: leader=%v publishing state of version {%d} to %d nodes", c.TransportService.LocalNode, newState.Version, len(newState.Nodes.Nodes))
+	publication := newPublication(c, newState, *lastAcceptedState)
+	err := publication.run()
+	if _, failed := err.(*state.FailedToCommitError); failed {
+		logrus.Warnf("Publish: %v", err)
+		if c.getMode() == LEADER {
+			c.becomeCandidate("Publish")
+		}
+		return err
 	}
-	logrus.Info("publish ended successfully")
+	logrus.Infof("Publish: state of version {%d} published, err=%v", newState.Version, err)
+	return err
 }
 
+// handlePublish accepts a state of the current term or a later one, it is applied once committed.
 func (c *Coordinator) handlePublish(channel transport.ReplyChannel, req []byte) {
-	// handle publish
-	acceptedState := state.ClusterStateFromBytes(req, c.TransportService.GetLocalNode())
-	//localState := c.CoordinationState.PersistedState.GetLastAcceptedState()
+	request, err := ReadPublishRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
+	content, err := common.Decompress(request.Content)
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
+	in := common.NewStreamInput(content, channel.GetVersion())
+
+	c.electionMux.Lock()
+	lastAcceptedState := c.PersistedState.GetLastAcceptedState()
+	var acceptedState *state.ClusterState
+	if request.Diff {
+		var diff *state.ClusterStateDiff
+		if diff, err = state.ReadClusterStateDiff(in); err == nil {
+			acceptedState, err = diff.Apply(*lastAcceptedState, c.TransportService.GetLocalNode())
+		}
+		if err != nil {
+			c.electionMux.Unlock()
+			logrus.Infof("handlePublish: asking for the full state, %v", err)
+			response := PublishResponse{Term: c.getCurrentTerm(), Err: err.Error(), FullStateRequired: true}
+			channel.SendMessage(transport.PUBLISH_ACK, common.ToBytes(&response, channel.GetVersion()))
+			return
+		}
+	} else if acceptedState, err = state.ReadClusterState(in, c.TransportService.GetLocalNode()); err != nil {
+		c.electionMux.Unlock()
+		channel.SendError(err)
+		return
+	}
 	leader := acceptedState.Nodes.MasterNode()
-	logrus.Info("accept new state from leader=%v", leader)
+	term := acceptedState.Metadata.Coordination.Term
+
+	if term < c.getCurrentTerm() {
+		currentTerm := c.getCurrentTerm()
+		c.electionMux.Unlock()
+		logrus.Warnf("handlePublish: ignoring the state of leader=%v, its term {%d} is older than the current term {%d}", leader, term, currentTerm)
+		response := PublishResponse{Term: currentTerm, Err: "the term of the state is older than the current term"}
+		channel.SendMessage(transport.PUBLISH_ACK, common.ToBytes(&response, channel.GetVersion()))
+		return
+	}
+	if term == lastAcceptedState.Metadata.Coordination.Term && acceptedState.Version <= lastAcceptedState.Version {
+		c.electionMux.Unlock()
+		logrus.Warnf("handlePublish: ignoring the state of version {%d} from leader=%v, version {%d} is already accepted", acceptedState.Version, leader, lastAcceptedState.Version)
+		response := PublishResponse{Term: term, Err: "the version of the state is not newer than the accepted one"}
+		channel.SendMessage(transport.PUBLISH_ACK, common.ToBytes(&response, channel.GetVersion()))
+		return
+	}
+	if term > c.getCurrentTerm() {
+		c.CoordinationState.Term = term
+		c.CoordinationState.JoinVotes = state.NewVoteCollection()
+		c.PeerFinder.setCurrentTerm(term)
+	}
 	c.CoordinationState.PersistedState.SetLastAcceptedState(acceptedState)
+	c.electionMux.Unlock()
+	c.updateMaxTermSeen(term)
 
-	if c.TransportService.GetLocalNode() != leader {
-		c.mode = FOLLOWER
-		c.PeerFinder.deactivate(leader)
-		c.PreVoteCollector.update(NewPreVoteResponse(c.getCurrentTerm()), leader)
+	logrus.Infof("handlePublish: accepted state of version {%d} from leader=%v", acceptedState.Version, leader)
+	if c.TransportService.LocalNode.Id != leader.Id {
+		c.becomeFollower("handlePublish", leader)
 	}
 
-	// handle commit
-	c.ApplierState = acceptedState
-	c.MasterService.ClusterState = acceptedState
-	c.ClusterApplierService.OnNewState(acceptedState)
+	response := PublishResponse{Term: term}
+	channel.SendMessage(transport.PUBLISH_ACK, common.ToBytes(&response, channel.GetVersion()))
+}
 
-	for _, node := range acceptedState.Nodes.Nodes {
-		go c.TransportService.ConnectToRemoteNode(node.HostAddress, func(node *state.Node) {})
+// handleCommit applies the accepted state the leader committed.
+func (c *Coordinator) handleCommit(channel transport.ReplyChannel, req []byte) {
+	request, err := ReadApplyCommitRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
+
+	c.electionMux.Lock()
+	lastAcceptedState := *c.PersistedState.GetLastAcceptedState()
+	if lastAcceptedState.Metadata.Coordination.Term != request.Term || lastAcceptedState.Version != request.Version {
+		c.electionMux.Unlock()
+		logrus.Warnf("handleCommit: ignoring commit of version {%d} in term {%d}, the accepted state is version {%d} in term {%d}",
+			request.Version, request.Term, lastAcceptedState.Version, lastAcceptedState.Metadata.Coordination.Term)
+		response := ApplyCommitResponse("no accepted state matches the commit")
+		channel.SendMessage(transport.COMMIT_ACK, common.ToBytes(response, channel.GetVersion()))
+		return
 	}
+	// the configuration of a committed state is committed as well
+	lastAcceptedState.Metadata.Coordination.LastCommittedConfiguration = lastAcceptedState.Metadata.Coordination.LastAcceptedConfiguration
+	c.PersistedState.SetLastAcceptedState(&lastAcceptedState)
+	c.electionMux.Unlock()
+
+	committedState := &lastAcceptedState
+	c.ApplierState = committedState
+	c.MasterService.SetState(committedState)
+	// the commit is acknowledged once the state is applied, the connection serves the other requests meanwhile
+	source := fmt.Sprintf("apply cluster state (from master [%s] committed version [%d])", request.SourceNode.Name, request.Version)
+	c.ClusterApplierService.OnNewState(source, committedState, func() {
+		if c.Started == false {
+			c.Done()
+		}
+		logrus.Infof("handleCommit: applied state of version {%d} in term {%d}", committedState.Version, request.Term)
+		channel.SendMessage(transport.COMMIT_ACK, common.ToBytes(ApplyCommitResponse(""), channel.GetVersion()))
+	})
+}
 
-	if c.Started == false {
-		c.Done()
+// connectToNodes connects to the nodes of an applied state.
+func (c *Coordinator) connectToNodes(event state.ClusterChangedEvent) {
+	for _, node := range event.State.Nodes.Nodes {
+		go c.TransportService.ConnectToRemoteNode(node.HostAddress, func(node *state.Node) {})
 	}
-	logrus.Printf("324 currentTerm={%d}", c.getCurrentTerm())
-	channel.SendMessage(transport.PUBLISH_ACK, []byte{})
 }
 
-func (c *Coordinator) startPreVote() {
-	if c.mode != CANDIDATE {
-		c.mode = PREVOTING
+func (c *Coordinator) startPreVote(method string) {
+	// a node that is not master-eligible waits for an elected master to publish to it
+	if !c.TransportService.LocalNode.IsMasterNode() {
+		return
+	}
+	if mode := c.getMode(); mode == CANDIDATE || mode == PREVOTING {
+		logrus.Infof("%v: starting pre-voting in term {%d}", method, c.getCurrentTerm())
+		c.setMode(PREVOTING)
 		c.PreVoteCollector.Start()
 	}
 }
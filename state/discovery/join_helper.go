@@ -1,8 +1,6 @@
 package discovery
 
 import (
-	"bytes"
-	"encoding/gob"
 	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/transport"
@@ -32,19 +30,24 @@ func NewJoinHelper(
 }
 
 func (h *JoinHelper) SendStartJoinRequest(startJoinRequest StartJoinRequest, destination state.Node) {
-	request := startJoinRequest.ToBytes()
+	request := common.ToBytes(&startJoinRequest, h.transportService.GetVersion(destination))
 	h.transportService.SendRequest(destination, transport.START_JOIN_REQ, request, func(res []byte) {
 		logrus.Infof("StartJoinRequest : successful response=%v from %v\n", startJoinRequest, destination)
 	})
 }
 
 func (h *JoinHelper) handleStartJoinRequest(channel transport.ReplyChannel, req []byte) {
-	startJoinReqData := StartJoinRequestFromBytes(req)
+	startJoinReqData, err := ReadStartJoinRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
 	destination := startJoinReqData.SourceNode
 
-	join := h.joinLeaderInTerm(startJoinReqData)
-
-	h.SendJoinRequest(destination, h.currentTermSupplier(), join)
+	// no vote for a term not greater than the current one, or for a candidate with an older state
+	if join := h.joinLeaderInTerm(startJoinReqData); join != nil {
+		h.SendJoinRequest(destination, h.currentTermSupplier(), join)
+	}
 
 	channel.SendMessage(transport.START_JOIN_ACK, []byte("Send START_JOIN_ACK"))
 }
@@ -68,11 +71,21 @@ func (h *JoinHelper) SendJoinRequest(destination state.Node, term int64, join *s
 
 	logrus.Infof("SendJoinRequest: Attempting to join=%v with joinRequest=%v\n", destination, joinRequest)
 
-	request := joinRequest.ToBytes()
+	if destination.Id == h.transportService.LocalNode.Id {
+		// the candidate votes for itself
+		request := common.ToBytes(&joinRequest, common.CurrentVersion)
+		h.transportService.SendRequest(destination, transport.JOIN_REQ, request, func(res []byte) {})
+		return
+	}
 
 	remoteAddress := destination.HostAddress
 
 	h.transportService.ConnectToRemoteNode(remoteAddress, func(node *state.Node) {
+		if node == nil {
+			logrus.Warnf("SendJoinRequest: failed to connect to %v", destination)
+			return
+		}
+		request := common.ToBytes(&joinRequest, h.transportService.GetVersion(*node))
 		h.transportService.SendRequest(*node, transport.JOIN_REQ, request, func(res []byte) {
 			logrus.Infof("Successfully joined %v with %v\n", destination, joinRequest)
 		})
@@ -97,25 +110,32 @@ type CandidateJoinAccumulator struct {
 type StartJoinRequest struct {
 	SourceNode state.Node
 	Term       int64
-}
-
-func (r *StartJoinRequest) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatalln(err)
+	// the term and version of the last state the candidate accepted
+	LastAcceptedTerm    int64
+	LastAcceptedVersion int64
+}
+
+// WriteTo writes the last accepted state of the candidate to the nodes of V_2 onwards, the older ones do not
+// compare it.
+func (r *StartJoinRequest) WriteTo(out *common.StreamOutput) {
+	r.SourceNode.WriteTo(out)
+	out.WriteInt64(r.Term)
+	if out.Version >= common.V_2 {
+		out.WriteInt64(r.LastAcceptedTerm)
+		out.WriteInt64(r.LastAcceptedVersion)
 	}
-	return buffer.Bytes()
 }
 
-func StartJoinRequestFromBytes(b []byte) *StartJoinRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data StartJoinRequest
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadStartJoinRequest(in *common.StreamInput) (*StartJoinRequest, error) {
+	request := StartJoinRequest{
+		SourceNode: state.ReadNode(in),
+		Term:       in.ReadInt64(),
 	}
-	return &data
+	if in.Version >= common.V_2 {
+		request.LastAcceptedTerm = in.ReadInt64()
+		request.LastAcceptedVersion = in.ReadInt64()
+	}
+	return &request, in.Err()
 }
 
 type JoinRequest struct {
@@ -124,25 +144,21 @@ type JoinRequest struct {
 	Join        state.Join
 }
 
-func (r *JoinRequest) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
+func (r *JoinRequest) WriteTo(out *common.StreamOutput) {
+	r.SourceNode.WriteTo(out)
+	out.WriteInt64(r.MinimumTerm)
+	r.Join.WriteTo(out)
 }
 
 func (r *JoinRequest) GetTerm() int64 {
 	return common.GetMaxInt(r.MinimumTerm, r.Join.Term)
 }
 
-func JoinRequestFromBytes(b []byte) *JoinRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data JoinRequest
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadJoinRequest(in *common.StreamInput) (*JoinRequest, error) {
+	request := JoinRequest{
+		SourceNode:  state.ReadNode(in),
+		MinimumTerm: in.ReadInt64(),
+		Join:        state.ReadJoin(in),
 	}
-	return &data
+	return &request, in.Err()
 }
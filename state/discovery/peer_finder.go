@@ -1,12 +1,12 @@
 package discovery
 
 import (
-	"bytes"
-	"encoding/gob"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
 	"sync"
+	"sync/atomic"
 )
 
 // public static final String REQUEST_PEERS_ACTION_NAME = "internal:discovery/request_peers";
@@ -16,11 +16,14 @@ type CoordinatorPeerFinder struct {
 	transportService *transport.Service
 
 	//mode        *Mode
+	// currentTerm is set by the coordinator while the peers requests are handled, it is accessed atomically through
+	// getCurrentTerm and setCurrentTerm
 	currentTerm       int64
 	LastAcceptedNodes *state.Nodes
 
 	//TODO: 얘가 과연 *state.Node여야 할까?
 	PeersByAddress       map[string]*state.Node
+	peersLock            sync.RWMutex
 	active               bool
 	leader               *state.Node
 	peersRequestInFlight bool
@@ -37,9 +40,18 @@ func NewCoordinatorPeerFinder(coordinator *Coordinator) *CoordinatorPeerFinder {
 	return f
 }
 
+func (f *CoordinatorPeerFinder) getCurrentTerm() int64 {
+	return atomic.LoadInt64(&f.currentTerm)
+}
+
+func (f *CoordinatorPeerFinder) setCurrentTerm(term int64) {
+	atomic.StoreInt64(&f.currentTerm, term)
+}
+
 func (f *CoordinatorPeerFinder) activate(lastAcceptedNodes *state.Nodes) {
 	f.LastAcceptedNodes = lastAcceptedNodes
 	f.active = true
+	f.leader = nil
 	f.handleWakeUp()
 }
 
@@ -75,7 +87,7 @@ func (f *CoordinatorPeerFinder) handleWakeUp() {
 	//
 
 	if len(providedAddr) == 0 {
-		f.Coordinator.becomeLeader("handleWakeUp")
+		f.Coordinator.startElectionOrBootstrap("handleWakeUp")
 	}
 
 	//if f.Coordinator.Started == false {
@@ -84,7 +96,10 @@ func (f *CoordinatorPeerFinder) handleWakeUp() {
 }
 
 func (f *CoordinatorPeerFinder) startProbe(address string) {
-	if _, ok := f.PeersByAddress[address]; !ok {
+	f.peersLock.RLock()
+	_, ok := f.PeersByAddress[address]
+	f.peersLock.RUnlock()
+	if !ok {
 		f.createConnection(address)
 	}
 }
@@ -92,16 +107,66 @@ func (f *CoordinatorPeerFinder) startProbe(address string) {
 func (f *CoordinatorPeerFinder) createConnection(address string) {
 	f.transportService.ConnectToRemoteNode(address, func(remoteNode *state.Node) {
 		if remoteNode == nil {
-			if f.Coordinator.active == false {
-				f.Coordinator.becomeLeader("createConnection")
-			}
+			f.removePeer(address)
 			return
 		}
+		f.peersLock.Lock()
 		f.PeersByAddress[address] = remoteNode
-		f.requestPeers(*remoteNode, f.Coordinator.startPreVote)
+		f.peersLock.Unlock()
+		f.requestPeers(*remoteNode, f.onNoMasterFound)
 	})
 }
 
+// probePeers connects again to the seed hosts, the found peers and the nodes of the last accepted state, the
+// peers that cannot be reached are forgotten. The election scheduler probes before every election attempt.
+func (f *CoordinatorPeerFinder) probePeers() {
+	addresses := map[string]struct{}{}
+	for _, address := range f.getSeedHosts() {
+		addresses[address] = struct{}{}
+	}
+	for _, peer := range f.getFoundPeers() {
+		addresses[peer.HostAddress] = struct{}{}
+	}
+	if lastAccepted := f.Coordinator.PersistedState.GetLastAcceptedState(); lastAccepted.Nodes != nil {
+		for _, node := range lastAccepted.Nodes.Nodes {
+			addresses[node.HostAddress] = struct{}{}
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for address := range addresses {
+		if len(address) <= 0 || address == f.transportService.LocalNode.HostAddress {
+			continue
+		}
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			f.transportService.ConnectToRemoteNode(address, func(remoteNode *state.Node) {
+				if remoteNode == nil {
+					f.removePeer(address)
+					return
+				}
+				f.peersLock.Lock()
+				f.PeersByAddress[address] = remoteNode
+				f.peersLock.Unlock()
+				f.requestPeers(*remoteNode, func() {})
+			})
+		}(address)
+	}
+	wg.Wait()
+}
+
+func (f *CoordinatorPeerFinder) removePeer(address string) {
+	f.peersLock.Lock()
+	delete(f.PeersByAddress, address)
+	f.peersLock.Unlock()
+}
+
+// onNoMasterFound starts the election, or bootstraps the cluster first.
+func (f *CoordinatorPeerFinder) onNoMasterFound() {
+	f.Coordinator.startElectionOrBootstrap("onNoMasterFound")
+}
+
 func (f *CoordinatorPeerFinder) requestPeers(destNode state.Node, next func()) {
 	nowNode := f.getLocalNode()
 	foundPeers := f.getFoundPeers()
@@ -115,8 +180,14 @@ func (f *CoordinatorPeerFinder) requestPeers(destNode state.Node, next func()) {
 
 	logrus.Infof("RequestPeers: Peer=%v requesting peers %s\n", nowNode, foundPeers)
 
-	f.transportService.SendRequest(destNode, transport.PEERFIND_REQ, request.ToBytes(), func(res []byte) {
-		data := PeersResponseFromBytes(res)
+	version := f.transportService.GetVersion(destNode)
+	f.transportService.SendRequest(destNode, transport.PEERFIND_REQ, common.ToBytes(&request, version), func(res []byte) {
+		data, err := ReadPeersResponse(common.NewStreamInput(res, version))
+		if err != nil {
+			logrus.Warnf("RequestPeers: failed to read the response of %v: %v", destNode, err)
+			f.peersRequestInFlight = false
+			return
+		}
 		master := data.MasterNode
 		peers := data.KnownPeers
 		term := data.Term
@@ -129,8 +200,8 @@ func (f *CoordinatorPeerFinder) requestPeers(destNode state.Node, next func()) {
 
 		f.peersRequestInFlight = false
 
-		if master != (state.Node{}) {
-			if master == destNode {
+		if master.Id != "" {
+			if master.Id == destNode.Id {
 				f.onActiveMasterFound(destNode, term)
 			} else {
 				f.startProbe(master.HostAddress)
@@ -139,10 +210,9 @@ func (f *CoordinatorPeerFinder) requestPeers(destNode state.Node, next func()) {
 			return
 		}
 
+		// only the new peers are asked for their peers in turn
 		for _, peer := range peers {
-			f.transportService.ConnectToRemoteNode(peer.HostAddress, func(remoteNode *state.Node) {
-				f.requestPeers(*remoteNode, func() {})
-			})
+			f.startProbe(peer.HostAddress)
 		}
 
 		// start election
@@ -153,7 +223,11 @@ func (f *CoordinatorPeerFinder) requestPeers(destNode state.Node, next func()) {
 }
 
 func (f *CoordinatorPeerFinder) handlePeersRequest(channel transport.ReplyChannel, req []byte) {
-	request := PeersRequestFromBytes(req)
+	request, err := ReadPeersRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
 	peers := request.KnownPeers
 	logrus.Infof("Receive Peer Finding REQ from %s; %s\n", channel.GetDestAddress(), peers)
 
@@ -168,6 +242,8 @@ func (f *CoordinatorPeerFinder) handlePeersRequest(channel transport.ReplyChanne
 		response.MasterNode = *(f.leader)
 	}
 
+	// the requesting node is a peer as well
+	peers = append(peers, request.SourceNode)
 	wg := sync.WaitGroup{}
 	wg.Add(len(peers))
 	for _, peer := range peers {
@@ -181,9 +257,9 @@ func (f *CoordinatorPeerFinder) handlePeersRequest(channel transport.ReplyChanne
 	knownPeers := f.getFoundPeers()
 	logrus.Infof("Send Peer Finding RES to %s; %s\n", channel.GetDestAddress(), knownPeers)
 	response.KnownPeers = knownPeers
-	response.Term = f.Coordinator.getCurrentTerm()
+	response.Term = f.getCurrentTerm()
 
-	channel.SendMessage(transport.PEERFIND_ACK, response.ToBytes())
+	channel.SendMessage(transport.PEERFIND_ACK, common.ToBytes(&response, channel.GetVersion()))
 }
 
 func (f *CoordinatorPeerFinder) onActiveMasterFound(leader state.Node, term int64) {
@@ -192,6 +268,8 @@ func (f *CoordinatorPeerFinder) onActiveMasterFound(leader state.Node, term int6
 }
 
 func (f *CoordinatorPeerFinder) getFoundPeers() []state.Node {
+	f.peersLock.RLock()
+	defer f.peersLock.RUnlock()
 	//ids := make([]string, 0, len(f.PeersByAddress))
 	values := make([]state.Node, 0, len(f.PeersByAddress))
 
@@ -216,23 +294,17 @@ type PeersRequest struct {
 	KnownPeers []state.Node
 }
 
-func (r *PeersRequest) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
+func (r *PeersRequest) WriteTo(out *common.StreamOutput) {
+	r.SourceNode.WriteTo(out)
+	writeNodeList(out, r.KnownPeers)
 }
 
-func PeersRequestFromBytes(b []byte) *PeersRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data PeersRequest
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadPeersRequest(in *common.StreamInput) (*PeersRequest, error) {
+	request := PeersRequest{
+		SourceNode: state.ReadNode(in),
+		KnownPeers: readNodeList(in),
 	}
-	return &data
+	return &request, in.Err()
 }
 
 type PeersResponse struct {
@@ -241,21 +313,33 @@ type PeersResponse struct {
 	Term       int64
 }
 
-func (r *PeersResponse) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(r); err != nil {
-		logrus.Fatalln(err)
+func (r *PeersResponse) WriteTo(out *common.StreamOutput) {
+	r.MasterNode.WriteTo(out)
+	writeNodeList(out, r.KnownPeers)
+	out.WriteInt64(r.Term)
+}
+
+func ReadPeersResponse(in *common.StreamInput) (*PeersResponse, error) {
+	response := PeersResponse{
+		MasterNode: state.ReadNode(in),
+		KnownPeers: readNodeList(in),
+		Term:       in.ReadInt64(),
+	}
+	return &response, in.Err()
+}
+
+func writeNodeList(out *common.StreamOutput, nodes []state.Node) {
+	out.WriteVInt(uint64(len(nodes)))
+	for i := range nodes {
+		nodes[i].WriteTo(out)
 	}
-	return buffer.Bytes()
 }
 
-func PeersResponseFromBytes(b []byte) *PeersResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data PeersResponse
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func readNodeList(in *common.StreamInput) []state.Node {
+	count := in.ReadCount()
+	nodes := make([]state.Node, 0, count)
+	for i := 0; i < count && in.Err() == nil; i++ {
+		nodes = append(nodes, state.ReadNode(in))
 	}
-	return &data
+	return nodes
 }
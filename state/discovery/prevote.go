@@ -1,8 +1,7 @@
 package discovery
 
 import (
-	"bytes"
-	"encoding/gob"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
@@ -10,7 +9,8 @@ import (
 )
 
 type PreVoteCollector struct {
-	preVotes map[state.Node]*PreVoteResponse
+	// preVotes are keyed by the id of the voting node
+	preVotes map[string]preVote
 
 	leader          state.Node
 	response        PreVoteResponse
@@ -19,17 +19,20 @@ type PreVoteCollector struct {
 	transportService  *transport.Service
 	startElection     func()
 	updateMaxTermSeen func(term int64)
+	// isElectionQuorum tells whether the votes are a majority of the voting configurations
+	isElectionQuorum func(votes *state.VoteCollection) bool
 
 	Lock sync.RWMutex
 }
 
-func NewPreVoteCollector(transportService *transport.Service, startElection func(), updateMaxTermSeen func(term int64)) *PreVoteCollector {
+func NewPreVoteCollector(transportService *transport.Service, startElection func(), updateMaxTermSeen func(term int64), isElectionQuorum func(votes *state.VoteCollection) bool) *PreVoteCollector {
 
 	p := &PreVoteCollector{
-		preVotes:          make(map[state.Node]*PreVoteResponse),
+		preVotes:          make(map[string]preVote),
 		transportService:  transportService,
 		startElection:     startElection,
 		updateMaxTermSeen: updateMaxTermSeen,
+		isElectionQuorum:  isElectionQuorum,
 		Lock:              sync.RWMutex{},
 	}
 
@@ -39,13 +42,17 @@ func NewPreVoteCollector(transportService *transport.Service, startElection func
 func (p *PreVoteCollector) Start() {
 	localNode := p.transportService.GetLocalNode()
 
+	// every round collects its own pre-votes
+	p.Lock.Lock()
+	p.preVotes = make(map[string]preVote)
+	p.electionStarted = false
 	request := PreVoteRequest{
 		SourceNode: localNode,
 		Term:       p.response.CurrentTerm,
 	}
+	p.Lock.Unlock()
 
-	_, broadcastNodes := p.transportService.GetConnectedPeers()
-	broadcastNodes = append(broadcastNodes, localNode)
+	broadcastNodes := p.masterEligiblePeers()
 
 	logrus.Infof("PreVoteCollector: SourceNode=%v requesting pre-votes from %s\n", localNode, broadcastNodes)
 
@@ -53,9 +60,13 @@ func (p *PreVoteCollector) Start() {
 		remoteNode := node
 		logrus.Infof("PreVoteRequest=%v to DestNode=%v\n", request, remoteNode)
 		// 이게 고루틴이어야 할까?
-		p.transportService.SendRequest(node, transport.PREVOTE_REQ, request.ToBytes(), func(res []byte) {
-			logrus.Info(56, res)
-			data := PreVoteResponseFromBytes(res)
+		version := p.transportService.GetVersion(node)
+		p.transportService.SendRequest(node, transport.PREVOTE_REQ, common.ToBytes(&request, version), func(res []byte) {
+			data, err := ReadPreVoteResponse(common.NewStreamInput(res, version))
+			if err != nil {
+				logrus.Warnf("PreVoteCollector: failed to read the response of %v: %v", remoteNode, err)
+				return
+			}
 			logrus.Infof("PreVoteResponse%v from DestNode=%v\n", data, remoteNode)
 			p.handlePreVoteResponse(data, remoteNode)
 		})
@@ -64,40 +75,49 @@ func (p *PreVoteCollector) Start() {
 
 func (p *PreVoteCollector) handlePreVoteRequest(channel transport.ReplyChannel, req []byte) {
 
-	request := PreVoteRequestFromBytes(req)
+	request, err := ReadPreVoteRequest(common.NewStreamInput(req, channel.GetVersion()))
+	if err != nil {
+		channel.SendError(err)
+		return
+	}
 	logrus.Infof("PreVoteRequest=%v from DestNode={%s}\n", request, channel.GetDestAddress())
 
 	p.updateMaxTermSeen(request.Term)
 
-	response := p.response
+	p.Lock.RLock()
+	response, leader := p.response, p.leader
+	p.Lock.RUnlock()
 
-	if p.leader != (state.Node{}) {
-		logrus.Infof("Election already finished, won leader=%v", p.leader)
+	if leader.Id != "" {
+		logrus.Infof("Election already finished, won leader=%v", leader)
 		response.Err = "Election already finished"
 	}
 
 	logrus.Infof("PreVoteResponse%v to DestNode={%s}", response, channel.GetDestAddress())
 
-	channel.SendMessage(transport.PREVOTE_RES, response.ToBytes())
+	channel.SendMessage(transport.PREVOTE_RES, common.ToBytes(&response, channel.GetVersion()))
 }
 
 func (p *PreVoteCollector) handlePreVoteResponse(response *PreVoteResponse, sender state.Node) {
 	p.updateMaxTermSeen(response.CurrentTerm)
+	if response.Err != "" {
+		logrus.Infof("PreVoteResponse rejected by %v: %s", sender, response.Err)
+		return
+	}
 	p.SetVote(sender, response)
 
 	voteCollection := state.NewVoteCollection()
 	localNode := p.transportService.GetLocalNode()
 	// localPreVoteResponse := p.PreVoteCollector.stateResponse
 
-	for node, response := range p.preVotes {
-		join := state.NewJoin(node, localNode, response.CurrentTerm)
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
+	for _, vote := range p.preVotes {
+		join := state.NewJoin(vote.node, localNode, vote.response.CurrentTerm)
 		voteCollection.AddJoinVote(*join)
 	}
 
-	nodeIds, _ := p.transportService.GetConnectedPeers()
-	nodeIds = append(nodeIds, localNode.Id)
-
-	if voteCollection.IsQuorum(nodeIds) == false {
+	if p.isElectionQuorum(voteCollection) == false {
 		logrus.Infof("No quorum yet")
 		return
 	}
@@ -107,7 +127,7 @@ func (p *PreVoteCollector) handlePreVoteResponse(response *PreVoteResponse, send
 		return
 	}
 
-	if p.leader != (state.Node{}) {
+	if p.leader.Id != "" {
 		logrus.Infof("Already elected leader=%v", p.leader)
 		return
 	}
@@ -116,12 +136,29 @@ func (p *PreVoteCollector) handlePreVoteResponse(response *PreVoteResponse, send
 	logrus.Infof("%v add %v from PrevoteResponse=%v\n, starting election\n", p.transportService.LocalNode, response, sender)
 
 	//
-	p.startElection()
+	go p.startElection()
 }
 
-func (p *PreVoteCollector) update(preVoteResponse *PreVoteResponse, leader state.Node) {
+// masterEligiblePeers are the connected master-eligible nodes and the local node, the nodes voting in elections.
+func (p *PreVoteCollector) masterEligiblePeers() []state.Node {
+	_, peers := p.transportService.GetConnectedPeers()
+	peers = append(peers, p.transportService.GetLocalNode())
+	var nodes []state.Node
+	for _, node := range peers {
+		if node.IsMasterNode() {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
 
+// update sets the response to the pre-vote requests and the known leader, the coordinator updates them while the
+// requests are handled.
+func (p *PreVoteCollector) update(preVoteResponse *PreVoteResponse, leader state.Node) {
+	p.Lock.Lock()
+	defer p.Lock.Unlock()
 	p.leader = leader
+	p.response = *preVoteResponse
 	/*
 		mutex := sync.RWMutex{}
 		if leader == (state.Node{}) {
@@ -139,9 +176,14 @@ func (p *PreVoteCollector) update(preVoteResponse *PreVoteResponse, leader state
 
 }
 
+type preVote struct {
+	node     state.Node
+	response *PreVoteResponse
+}
+
 func (p *PreVoteCollector) SetVote(key state.Node, value *PreVoteResponse) {
 	p.Lock.Lock()
-	p.preVotes[key] = value
+	p.preVotes[key.Id] = preVote{node: key, response: value}
 	p.Lock.Unlock()
 }
 
@@ -157,23 +199,17 @@ func NewPreVoteRequest(sourceNode state.Node, term int64) *PreVoteRequest {
 	}
 }
 
-func (p *PreVoteRequest) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(p); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
+func (p *PreVoteRequest) WriteTo(out *common.StreamOutput) {
+	p.SourceNode.WriteTo(out)
+	out.WriteInt64(p.Term)
 }
 
-func PreVoteRequestFromBytes(b []byte) *PreVoteRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data PreVoteRequest
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadPreVoteRequest(in *common.StreamInput) (*PreVoteRequest, error) {
+	request := PreVoteRequest{
+		SourceNode: state.ReadNode(in),
+		Term:       in.ReadInt64(),
 	}
-	return &data
+	return &request, in.Err()
 }
 
 type PreVoteResponse struct {
@@ -187,21 +223,15 @@ func NewPreVoteResponse(currentTerm int64) *PreVoteResponse {
 	}
 }
 
-func (p *PreVoteResponse) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(p); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
+func (p *PreVoteResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(p.CurrentTerm)
+	out.WriteString(p.Err)
 }
 
-func PreVoteResponseFromBytes(b []byte) *PreVoteResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data PreVoteResponse
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadPreVoteResponse(in *common.StreamInput) (*PreVoteResponse, error) {
+	response := PreVoteResponse{
+		CurrentTerm: in.ReadInt64(),
+		Err:         in.ReadString(),
 	}
-	return &data
+	return &response, in.Err()
 }
@@ -0,0 +1,368 @@
+package discovery
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPublishCommitTimeout = 30 * time.Second
+	defaultPublishTimeout       = 30 * time.Second
+	defaultFollowerLagTimeout   = 90 * time.Second
+)
+
+// Publication sends a cluster state in two phases. The nodes accept the state first, once a quorum of the
+// master-eligible nodes accepted it the leader commits it and the nodes apply it.
+// The nodes of the previous state receive a diff against it, the others and those missing the previous state
+// receive the full state.
+type Publication struct {
+	coordinator   *Coordinator
+	state         state.ClusterState
+	previousState state.ClusterState
+	diff          *state.ClusterStateDiff
+	// contents are the compressed diffs and full states, written once for each version of the nodes
+	contents     map[publishContentKey][]byte
+	contentsLock sync.Mutex
+	// committedConfiguration is the voting configuration committed before this state
+	committedConfiguration state.VotingConfiguration
+
+	commitTimeout      time.Duration
+	publishTimeout     time.Duration
+	followerLagTimeout time.Duration
+
+	publishResponses chan publishResponseEvent
+	applied          chan string
+}
+
+type publishContentKey struct {
+	version common.Version
+	diff    bool
+}
+
+type publishResponseEvent struct {
+	node     state.Node
+	response *PublishResponse
+}
+
+func newPublication(coordinator *Coordinator, clusterState state.ClusterState, previousState state.ClusterState) *Publication {
+	settings := cluster.Settings(clusterState.Metadata.Settings())
+	nodeCount := len(clusterState.Nodes.Nodes)
+	return &Publication{
+		coordinator:            coordinator,
+		state:                  clusterState,
+		previousState:          previousState,
+		diff:                   state.DiffClusterState(previousState, clusterState),
+		contents:               map[publishContentKey][]byte{},
+		committedConfiguration: previousState.Metadata.Coordination.LastCommittedConfiguration,
+		commitTimeout:          settings.GetDuration(cluster.PublishCommitTimeoutSetting, defaultPublishCommitTimeout),
+		publishTimeout:         settings.GetDuration(cluster.PublishTimeoutSetting, defaultPublishTimeout),
+		followerLagTimeout:     settings.GetDuration(cluster.FollowerLagTimeoutSetting, defaultFollowerLagTimeout),
+		// every node responds once to each phase, the responses never block
+		publishResponses: make(chan publishResponseEvent, nodeCount),
+		applied:          make(chan string, nodeCount),
+	}
+}
+
+// run publishes the state and waits for the nodes to apply it. It fails when the state was not committed in
+// time, and returns state.ErrNotAcknowledged when it was committed but some nodes did not apply it in time.
+func (p *Publication) run() error {
+	startTime := time.Now()
+	commitTimer := time.NewTimer(p.commitTimeout)
+	defer commitTimer.Stop()
+	publishTimer := time.NewTimer(p.publishTimeout)
+	defer publishTimer.Stop()
+
+	localNode := p.coordinator.TransportService.GetLocalNode()
+	pending := map[string]state.Node{}
+	for _, node := range p.state.Nodes.Nodes {
+		pending[node.Id] = node
+		if node.Id == localNode.Id {
+			// the leader accepts the state first, synchronously
+			p.sendPublish(node)
+		} else {
+			go p.sendPublish(node)
+		}
+	}
+
+	votes := state.NewVoteCollection()
+	var accepted []state.Node
+	committed := false
+	for !committed || len(pending) > 0 {
+		select {
+		case event := <-p.publishResponses:
+			if event.response == nil || event.response.Err != "" {
+				if event.response != nil {
+					logrus.Warnf("Publication: node %v rejected the state of version {%d}: %s", event.node, p.state.Version, event.response.Err)
+					p.coordinator.updateMaxTermSeen(event.response.Term)
+				}
+				continue
+			}
+			if committed {
+				// the state is already committed, the node applies it right away
+				p.sendCommit(event.node)
+				continue
+			}
+			accepted = append(accepted, event.node)
+			if event.node.IsMasterNode() {
+				votes.AddVote(&event.node)
+			}
+			if p.isPublishQuorum(votes) {
+				committed = true
+				logrus.Infof("Publication: state of version {%d} committed in term {%d}", p.state.Version, p.state.Metadata.Coordination.Term)
+				for _, node := range accepted {
+					p.sendCommit(node)
+				}
+			}
+		case nodeId := <-p.applied:
+			delete(pending, nodeId)
+		case <-commitTimer.C:
+			if !committed {
+				return &state.FailedToCommitError{Reason: "no quorum of master-eligible nodes accepted the state within " + p.commitTimeout.String()}
+			}
+		case <-publishTimer.C:
+			if !committed {
+				return &state.FailedToCommitError{Reason: "no quorum of master-eligible nodes accepted the state within " + p.publishTimeout.String()}
+			}
+			logrus.Warnf("Publication: nodes %v did not apply the state of version {%d} within %v", nodeIds(pending), p.state.Version, p.publishTimeout)
+			go p.removeLaggingNodes(pending, p.followerLagTimeout-time.Since(startTime))
+			return state.ErrNotAcknowledged
+		}
+	}
+	return nil
+}
+
+// isPublishQuorum tells whether the votes are a majority of both the configuration committed before the state and
+// the configuration the state carries.
+func (p *Publication) isPublishQuorum(votes *state.VoteCollection) bool {
+	return votes.IsQuorum(p.committedConfiguration.NodeIds) && votes.IsQuorum(p.state.Metadata.Coordination.LastAcceptedConfiguration.NodeIds)
+}
+
+func (p *Publication) sendPublish(node state.Node) {
+	if _, existing := p.previousState.Nodes.Nodes[node.Id]; existing {
+		p.sendPublishRequest(node, true)
+	} else {
+		p.sendPublishRequest(node, false)
+	}
+}
+
+func (p *Publication) sendPublishRequest(node state.Node, diff bool) {
+	request := func(version common.Version) []byte {
+		return common.ToBytes(&PublishRequest{Diff: diff, Content: p.content(version, diff)}, version)
+	}
+	p.sendRequest(node, transport.PUBLISH_REQ, request, p.commitTimeout, func(response *common.StreamInput, reachable bool) {
+		if !reachable {
+			p.publishResponses <- publishResponseEvent{node: node}
+			return
+		}
+		publishResponse, err := ReadPublishResponse(response)
+		if err != nil {
+			logrus.Warnf("Publication: failed to read the response of node %v: %v", node, err)
+			p.publishResponses <- publishResponseEvent{node: node}
+			return
+		}
+		if diff && publishResponse.FullStateRequired {
+			logrus.Infof("Publication: node %v cannot apply the diff, sending the full state of version {%d}", node, p.state.Version)
+			p.sendPublishRequest(node, false)
+			return
+		}
+		p.publishResponses <- publishResponseEvent{node: node, response: publishResponse}
+	})
+}
+
+// content returns the compressed diff or full state written with the version of a node.
+func (p *Publication) content(version common.Version, diff bool) []byte {
+	p.contentsLock.Lock()
+	defer p.contentsLock.Unlock()
+	key := publishContentKey{version: version, diff: diff}
+	if content, existing := p.contents[key]; existing {
+		return content
+	}
+	var content []byte
+	if diff {
+		content = common.Compress(common.ToBytes(p.diff, version))
+	} else {
+		content = common.Compress(common.ToBytes(&p.state, version))
+		logrus.Infof("Publication: full state of version {%d} is %d bytes in protocol version %v", p.state.Version, len(content), version)
+	}
+	p.contents[key] = content
+	return content
+}
+
+func (p *Publication) sendCommit(node state.Node) {
+	request := ApplyCommitRequest{
+		SourceNode: p.coordinator.TransportService.GetLocalNode(),
+		Term:       p.state.Metadata.Coordination.Term,
+		Version:    p.state.Version,
+	}
+	send := func() {
+		write := func(version common.Version) []byte {
+			return common.ToBytes(&request, version)
+		}
+		p.sendRequest(node, transport.COMMIT_REQ, write, p.followerLagTimeout, func(response *common.StreamInput, reachable bool) {
+			if !reachable {
+				logrus.Warnf("Publication: node %v failed to apply the state of version {%d}", node, p.state.Version)
+				return
+			}
+			if reason := ReadApplyCommitResponse(response); reason != "" {
+				logrus.Warnf("Publication: node %v failed to apply the state of version {%d}: %s", node, p.state.Version, reason)
+				return
+			}
+			p.applied <- node.Id
+		})
+	}
+	if node.Id == p.coordinator.TransportService.LocalNode.Id {
+		// the leader applies the state before the next one is computed
+		send()
+	} else {
+		go send()
+	}
+}
+
+// sendRequest sends a request to a node of the state, written with the version negotiated once the node is
+// connected. The callback reads the response with the same version and tells whether the node replied within the
+// timeout.
+func (p *Publication) sendRequest(node state.Node, action string, request func(version common.Version) []byte, timeout time.Duration, callback func(response *common.StreamInput, reachable bool)) {
+	transportService := p.coordinator.TransportService
+	options := transport.RequestOptions{Timeout: timeout}
+	send := func() {
+		version := transportService.GetVersion(node)
+		transportService.SendRequestWithHandler(node, action, request(version), options, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				callback(common.NewStreamInput(response, version), true)
+			},
+			OnFailure: func(err error) {
+				logrus.Warnf("Publication: failed to send %s to %s: %v", action, node.Name, err)
+				callback(nil, false)
+			},
+		})
+	}
+	if node.Id == transportService.LocalNode.Id {
+		send()
+		return
+	}
+	transportService.ConnectToRemoteNode(node.HostAddress, func(remoteNode *state.Node) {
+		if remoteNode == nil || remoteNode.Id != node.Id {
+			callback(nil, false)
+			return
+		}
+		send()
+	})
+}
+
+// removeLaggingNodes removes the nodes still not applying the committed state once the follower lag timeout expires.
+func (p *Publication) removeLaggingNodes(pending map[string]state.Node, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case nodeId := <-p.applied:
+			delete(pending, nodeId)
+		case <-timer.C:
+			if p.coordinator.getMode() != LEADER {
+				return
+			}
+			var lagging []string
+			for nodeId := range pending {
+				if _, existing := p.coordinator.MasterService.State().Nodes.Nodes[nodeId]; existing {
+					lagging = append(lagging, nodeId)
+				}
+			}
+			if len(lagging) > 0 {
+				logrus.Warnf("Publication: removing nodes %v, they did not apply the state of version {%d} within %v", lagging, p.state.Version, p.followerLagTimeout)
+				p.coordinator.removeNodes(lagging)
+			}
+			return
+		}
+	}
+}
+
+func nodeIds(nodes map[string]state.Node) []string {
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// PublishRequest carries the full cluster state or a diff against the state accepted last, compressed on the wire.
+type PublishRequest struct {
+	Diff    bool
+	Content []byte
+}
+
+func (r *PublishRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteBool(r.Diff)
+	out.WriteBytes(r.Content)
+}
+
+func ReadPublishRequest(in *common.StreamInput) (*PublishRequest, error) {
+	request := PublishRequest{
+		Diff:    in.ReadBool(),
+		Content: in.ReadBytes(),
+	}
+	return &request, in.Err()
+}
+
+type PublishResponse struct {
+	Term int64
+	Err  string
+	// FullStateRequired tells that the node does not have the state a diff applies to
+	FullStateRequired bool
+}
+
+func (r *PublishResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(r.Term)
+	out.WriteString(r.Err)
+	out.WriteBool(r.FullStateRequired)
+}
+
+func ReadPublishResponse(in *common.StreamInput) (*PublishResponse, error) {
+	response := PublishResponse{
+		Term:              in.ReadInt64(),
+		Err:               in.ReadString(),
+		FullStateRequired: in.ReadBool(),
+	}
+	return &response, in.Err()
+}
+
+type ApplyCommitRequest struct {
+	SourceNode state.Node
+	Term       int64
+	Version    int64
+}
+
+func (r *ApplyCommitRequest) WriteTo(out *common.StreamOutput) {
+	r.SourceNode.WriteTo(out)
+	out.WriteInt64(r.Term)
+	out.WriteInt64(r.Version)
+}
+
+func ReadApplyCommitRequest(in *common.StreamInput) (*ApplyCommitRequest, error) {
+	request := ApplyCommitRequest{
+		SourceNode: state.ReadNode(in),
+		Term:       in.ReadInt64(),
+		Version:    in.ReadInt64(),
+	}
+	return &request, in.Err()
+}
+
+// ApplyCommitResponse is the reason a node did not apply a committed state, empty once applied.
+type ApplyCommitResponse string
+
+func (r ApplyCommitResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteString(string(r))
+}
+
+// ReadApplyCommitResponse reads the reason a node did not apply the state, a malformed response is a failure too.
+func ReadApplyCommitResponse(in *common.StreamInput) string {
+	reason := in.ReadString()
+	if err := in.Err(); err != nil {
+		return err.Error()
+	}
+	return reason
+}
@@ -1,9 +1,16 @@
 package state
 
 import (
-	"bytes"
-	"encoding/gob"
-	"github.com/sirupsen/logrus"
+	"github.com/actumn/searchgoose/common"
+	"sort"
+	"strings"
+)
+
+// node roles, a node without any role is coordinating-only
+const (
+	MasterRole = "master"
+	DataRole   = "data"
+	IngestRole = "ingest"
 )
 
 type Node struct {
@@ -13,9 +20,11 @@ type Node struct {
 	//HostName    string
 	HostAddress string
 	//Address     Address
-	//Attributes map[string]string
+	// Attributes are the node.attr.* settings of the node, e.g. rack, used by the allocation filters and awareness
+	Attributes map[string]string
 	//version Version
-	//roles map[DiscoveryNodeRole]struct{}
+	// Roles are the node.master, node.data and node.ingest settings of the node
+	Roles []string
 }
 
 func CreateLocalNode(id string, address string, name string) *Node {
@@ -29,31 +38,79 @@ func CreateLocalNode(id string, address string, name string) *Node {
 	}
 }
 
-func (n *Node) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(n); err != nil {
-		logrus.Fatalln(err)
+func (n *Node) WriteTo(out *common.StreamOutput) {
+	out.WriteString(n.Name)
+	out.WriteString(n.Id)
+	out.WriteString(n.HostAddress)
+	out.WriteStringMap(n.Attributes)
+	out.WriteStringSlice(n.Roles)
+}
+
+func ReadNode(in *common.StreamInput) Node {
+	return Node{
+		Name:        in.ReadString(),
+		Id:          in.ReadString(),
+		HostAddress: in.ReadString(),
+		Attributes:  in.ReadStringMap(),
+		Roles:       in.ReadStringSlice(),
+	}
+}
+
+// NodeRoles lists the roles of the node settings.
+func NodeRoles(master bool, data bool, ingest bool) []string {
+	roles := []string{}
+	if data {
+		roles = append(roles, DataRole)
+	}
+	if ingest {
+		roles = append(roles, IngestRole)
+	}
+	if master {
+		roles = append(roles, MasterRole)
 	}
-	return buffer.Bytes()
+	return roles
 }
 
-func NodeFromBytes(b []byte) *Node {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var node Node
-	if err := decoder.Decode(&node); err != nil {
-		logrus.Fatalln(err)
+func (n Node) HasRole(role string) bool {
+	for _, r := range n.Roles {
+		if r == role {
+			return true
+		}
 	}
-	return &node
+	return false
 }
 
-func isMasterNode() bool {
-	return true
+// IsMasterNode tells whether the node is master-eligible, only those vote in elections.
+func (n Node) IsMasterNode() bool {
+	return n.HasRole(MasterRole)
 }
 
-func isDataNode() bool {
-	return true
+// IsDataNode tells whether the node holds shards.
+func (n Node) IsDataNode() bool {
+	return n.HasRole(DataRole)
+}
+
+func (n Node) IsIngestNode() bool {
+	return n.HasRole(IngestRole)
+}
+
+// IsCoordinatingOnly tells whether the node has no role, it only routes requests.
+func (n Node) IsCoordinatingOnly() bool {
+	return len(n.Roles) == 0
+}
+
+// RoleAbbreviations are the first letters of the roles as shown by _cat/nodes, e.g. "dim", or "-" for a
+// coordinating-only node.
+func (n Node) RoleAbbreviations() string {
+	if n.IsCoordinatingOnly() {
+		return "-"
+	}
+	var abbreviations []string
+	for _, role := range n.Roles {
+		abbreviations = append(abbreviations, role[:1])
+	}
+	sort.Strings(abbreviations)
+	return strings.Join(abbreviations, "")
 }
 
 type Nodes struct {
@@ -67,3 +124,54 @@ type Nodes struct {
 func (n *Nodes) MasterNode() Node {
 	return n.Nodes[n.MasterNodeId]
 }
+
+// Add puts a node in the nodes, and in the master and data nodes according to its roles.
+func (n *Nodes) Add(node Node) {
+	n.Nodes[node.Id] = node
+	if node.IsMasterNode() {
+		n.MasterNodes[node.Id] = node
+	}
+	if node.IsDataNode() {
+		n.DataNodes[node.Id] = node
+	}
+}
+
+func (n *Nodes) Remove(nodeId string) {
+	delete(n.Nodes, nodeId)
+	delete(n.DataNodes, nodeId)
+	delete(n.MasterNodes, nodeId)
+}
+
+// WriteTo writes the nodes, the master and data nodes are put back by their roles when read.
+func (n *Nodes) WriteTo(out *common.StreamOutput) {
+	out.WriteString(n.MasterNodeId)
+	out.WriteString(n.LocalNodeId)
+	out.WriteVInt(uint64(len(n.Nodes)))
+	for _, node := range n.Nodes {
+		node.WriteTo(out)
+	}
+}
+
+func ReadNodes(in *common.StreamInput) *Nodes {
+	nodes := &Nodes{
+		MasterNodeId: in.ReadString(),
+		LocalNodeId:  in.ReadString(),
+		Nodes:        map[string]Node{},
+		DataNodes:    map[string]Node{},
+		MasterNodes:  map[string]Node{},
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		nodes.Add(ReadNode(in))
+	}
+	return nodes
+}
+
+// MasterNodeIds are the ids of the master-eligible nodes, the voting configuration of the elections.
+func (n *Nodes) MasterNodeIds() []string {
+	ids := make([]string, 0, len(n.MasterNodes))
+	for id := range n.MasterNodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
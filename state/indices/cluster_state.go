@@ -1,25 +1,38 @@
 package indices
 
 import (
+	"fmt"
+	"github.com/actumn/searchgoose/index"
 	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
 	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
 type ClusterStateService struct {
-	IndicesService *Service
-	mux            sync.Mutex
+	IndicesService   *Service
+	recoveryService  *RecoveryService
+	shardStateAction *cluster.ShardStateAction
+	mux              sync.Mutex
 }
 
-func NewClusterStateService(indices *Service) *ClusterStateService {
-	return &ClusterStateService{
-		IndicesService: indices,
+func NewClusterStateService(indices *Service, recoveryService *RecoveryService, shardStateAction *cluster.ShardStateAction) *ClusterStateService {
+	s := &ClusterStateService{
+		IndicesService:   indices,
+		recoveryService:  recoveryService,
+		shardStateAction: shardStateAction,
 	}
+	recoveryService.clusterStateService = s
+	return s
 }
 
 func (s *ClusterStateService) ApplyClusterState(event state.ClusterChangedEvent) {
 	s.deleteIndices(event)
 
+	s.removeShards(event)
+
 	s.createIndices(event)
 }
 
@@ -35,29 +48,136 @@ func (s *ClusterStateService) deleteIndices(event state.ClusterChangedEvent) {
 	}
 }
 
+// removeShards deletes the local copies that are no longer allocated to this node, e.g. once they have relocated.
+func (s *ClusterStateService) removeShards(event state.ClusterChangedEvent) {
+	clusterState := event.State
+	localNode, existing := state.NewRoutingNodes(clusterState).NodesToShards[clusterState.Nodes.LocalNodeId]
+	if !existing {
+		return
+	}
+	assigned := map[string]map[int]struct{}{}
+	for shardId := range localNode.Shards {
+		if _, ok := assigned[shardId.Index.Uuid]; !ok {
+			assigned[shardId.Index.Uuid] = map[int]struct{}{}
+		}
+		assigned[shardId.Index.Uuid][shardId.ShardId] = struct{}{}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for uuid, indexService := range s.IndicesService.Indices {
+		for shardId := range indexService.Shards {
+			if _, ok := assigned[uuid][shardId]; ok {
+				continue
+			}
+			logrus.Infof("Remove index shard - index uuid: %s, shard number: %d", uuid, shardId)
+			indexService.RemoveShard(shardId)
+		}
+	}
+}
+
 func (s *ClusterStateService) createIndices(event state.ClusterChangedEvent) {
 	clusterState := event.State
 
 	routingNodes := state.NewRoutingNodes(clusterState)
-	localNode := routingNodes.NodesToShards[clusterState.Nodes.LocalNodeId]
+	localNode, existing := routingNodes.NodesToShards[clusterState.Nodes.LocalNodeId]
+	if !existing {
+		// not a data node, it holds no shards
+		return
+	}
 
 	// TODO:: migrate to channel from mutex
 	s.mux.Lock()
 	for _, shardRouting := range localNode.Shards {
 		index := shardRouting.ShardId.Index
 
-		if indexService, exists := s.IndicesService.IndexService(index.Uuid); !exists {
+		indexService, exists := s.IndicesService.IndexService(index.Uuid)
+		if !exists {
 			indexService = s.IndicesService.CreateIndexService(index.Uuid)
 			indexMetadata := clusterState.Metadata.Indices[index.Name]
 			indexService.UpdateMapping(indexMetadata)
-			logrus.Infof("Create new index shard - index name: %s, index uuid: %s, shard number: %d", index.Name, index.Uuid, shardRouting.ShardId.ShardId)
+			indexService.UpdateSettings(indexMetadata)
+		}
+
+		if indexShard, exists := indexService.Shard(shardRouting.ShardId.ShardId); exists {
+			s.updateShard(clusterState, indexShard, shardRouting)
+			continue
+		}
+
+		if shardRouting.Primary && !shardRouting.IsRelocationTarget() {
+			if shardRouting.UnassignedInfo.Reason == state.UnassignedForcedEmptyPrimary {
+				// the reroute API asked for an empty store, whatever is left on disk goes away
+				indexService.RemoveShard(shardRouting.ShardId.ShardId)
+			}
+			_, statErr := os.Stat(filepath.Join(indexService.ShardPath(shardRouting.ShardId.ShardId), "index_meta.json"))
+			logrus.Infof("Create index shard - index name: %s, index uuid: %s, shard number: %d", index.Name, index.Uuid, shardRouting.ShardId.ShardId)
 			indexService.CreateShard(shardRouting)
-		} else {
-			if _, exists := indexService.Shard(shardRouting.ShardId.ShardId); !exists {
-				logrus.Infof("Create existing index shard - index name: %s, index uuid: %s, shard number: %d", index.Name, index.Uuid, shardRouting.ShardId.ShardId)
-				indexService.CreateShard(shardRouting)
+			indexShard, _ := indexService.Shard(shardRouting.ShardId.ShardId)
+			indexShard.SetReplicator(s.recoveryService.Replicator(shardRouting.ShardId))
+			s.recoveryService.recordStoreRecovery(shardRouting, statErr == nil)
+			if shardRouting.State == state.ShardInitializing {
+				// the master may be applying this very state, report once it is done
+				go s.shardStateAction.ShardStarted(shardRouting)
 			}
+		} else if !s.recoveryService.Recovering(shardRouting.ShardId) && !s.recoveryService.Failed(shardRouting) {
+			primary := clusterState.RoutingTable.IndicesRouting[index.Name].Shards[shardRouting.ShardId.ShardId].Primary
+			sourceNode, exists := clusterState.Nodes.Nodes[primary.CurrentNodeId]
+			if !exists {
+				continue
+			}
+			logrus.Infof("Recover index shard - index name: %s, index uuid: %s, shard number: %d, from: %s", index.Name, index.Uuid, shardRouting.ShardId.ShardId, sourceNode.Name)
+			s.recoveryService.StartRecovery(shardRouting, sourceNode)
 		}
 	}
 	s.mux.Unlock()
 }
+
+// updateShard applies the routing of the cluster state to a shard already on this node.
+func (s *ClusterStateService) updateShard(clusterState state.ClusterState, indexShard *index.Shard, shardRouting state.ShardRouting) {
+	indexShard.UpdateShardRouting(shardRouting)
+	if shardRouting.Primary {
+		// a replica promoted to primary starts replicating
+		indexShard.SetReplicator(s.recoveryService.Replicator(shardRouting.ShardId))
+		var started, assigned []string
+		for _, shardCopy := range clusterState.RoutingTable.IndicesRouting[shardRouting.ShardId.Index.Name].Shards[shardRouting.ShardId.ShardId].Copies() {
+			// relocation targets receive the writes while they recover
+			if shardCopy.State == state.ShardRelocating {
+				assigned = append(assigned, shardCopy.RelocatingNodeId)
+			}
+			if shardCopy.Primary || shardCopy.CurrentNodeId == "" {
+				continue
+			}
+			assigned = append(assigned, shardCopy.CurrentNodeId)
+			if shardCopy.Active() {
+				started = append(started, shardCopy.CurrentNodeId)
+			}
+		}
+		indexShard.UpdateReplicationTargets(started, assigned)
+	}
+	// the master may have missed the report of a started copy
+	if shardRouting.State == state.ShardInitializing && !s.recoveryService.Recovering(shardRouting.ShardId) {
+		go s.shardStateAction.ShardStarted(shardRouting)
+	}
+}
+
+// createShard opens a shard whose files have been recovered from a peer.
+func (s *ClusterStateService) createShard(shardRouting state.ShardRouting) (*index.Shard, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	indexService, exists := s.IndicesService.IndexService(shardRouting.ShardId.Index.Uuid)
+	if !exists {
+		return nil, fmt.Errorf("no such index [%s]", shardRouting.ShardId.Index.Name)
+	}
+	indexService.CreateShard(shardRouting)
+	indexShard, _ := indexService.Shard(shardRouting.ShardId.ShardId)
+	return indexShard, nil
+}
+
+// removeShard deletes the copy of a shard whose recovery failed.
+func (s *ClusterStateService) removeShard(shardId state.ShardId) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if indexService, exists := s.IndicesService.IndexService(shardId.Index.Uuid); exists {
+		indexService.RemoveShard(shardId.ShardId)
+	}
+}
@@ -1,19 +1,25 @@
 package indices
 
 import (
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/env"
 	"github.com/actumn/searchgoose/index"
 	"github.com/actumn/searchgoose/state"
 	"github.com/sirupsen/logrus"
+	"sync"
 )
 
 type Service struct {
 	Indices map[string]*index.Service
+
+	recoveryStates map[state.ShardId]RecoveryState
+	recoveryMux    sync.Mutex
 }
 
 func NewService() *Service {
 	return &Service{
-		Indices: map[string]*index.Service{},
+		Indices:        map[string]*index.Service{},
+		recoveryStates: map[state.ShardId]RecoveryState{},
 	}
 }
 
@@ -30,12 +36,14 @@ func (s *Service) IndexService(uuid string) (*index.Service, bool) {
 
 func (s *Service) RemoveIndex(idx state.Index) {
 	//indexName := idx.Name
-	_, existing := s.Indices[idx.Uuid]
+	indexService, existing := s.Indices[idx.Uuid]
 	if !existing {
 		return
 	}
 
 	delete(s.Indices, idx.Uuid)
+	indexService.Close()
+	s.removeRecoveryStates(idx)
 	s.deleteIndexStore(idx)
 }
 
@@ -46,8 +54,58 @@ func (s *Service) deleteIndexStore(idx state.Index) {
 	}
 }
 
+// RecoveryStates returns the recoveries of the shards on this node, ongoing or done.
+func (s *Service) RecoveryStates() []RecoveryState {
+	s.recoveryMux.Lock()
+	defer s.recoveryMux.Unlock()
+	recoveryStates := make([]RecoveryState, 0, len(s.recoveryStates))
+	for _, recoveryState := range s.recoveryStates {
+		recoveryStates = append(recoveryStates, recoveryState)
+	}
+	return recoveryStates
+}
+
+func (s *Service) putRecoveryState(recoveryState RecoveryState) {
+	s.recoveryMux.Lock()
+	defer s.recoveryMux.Unlock()
+	s.recoveryStates[recoveryState.ShardId] = recoveryState
+}
+
+func (s *Service) updateRecoveryState(shardId state.ShardId, update func(recoveryState *RecoveryState)) {
+	s.recoveryMux.Lock()
+	defer s.recoveryMux.Unlock()
+	if recoveryState, ok := s.recoveryStates[shardId]; ok {
+		update(&recoveryState)
+		s.recoveryStates[shardId] = recoveryState
+	}
+}
+
+func (s *Service) removeRecoveryStates(index state.Index) {
+	s.recoveryMux.Lock()
+	defer s.recoveryMux.Unlock()
+	for shardId := range s.recoveryStates {
+		if shardId.Index.Uuid == index.Uuid {
+			delete(s.recoveryStates, shardId)
+		}
+	}
+}
+
 type Stats struct {
 	NumDocs    uint64
 	NumDeleted uint64
 	NumBytes   uint64
 }
+
+func (s *Stats) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(s.NumDocs)
+	out.WriteVInt(s.NumDeleted)
+	out.WriteVInt(s.NumBytes)
+}
+
+func ReadStats(in *common.StreamInput) Stats {
+	return Stats{
+		NumDocs:    in.ReadVInt(),
+		NumDeleted: in.ReadVInt(),
+		NumBytes:   in.ReadVInt(),
+	}
+}
@@ -0,0 +1,654 @@
+package indices
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/index"
+	"github.com/actumn/searchgoose/state"
+	"github.com/actumn/searchgoose/state/cluster"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RecoveryStartAction       = "internal:index/shard/recovery/start"
+	RecoveryFileChunkAction   = "internal:index/shard/recovery/file_chunk"
+	RecoveryTranslogOpsAction = "internal:index/shard/recovery/translog_ops"
+	RecoveryFinalizeAction    = "internal:index/shard/recovery/finalize"
+	RecoveryCancelAction      = "internal:index/shard/recovery/cancel"
+	ReplicaWriteAction        = "indices:data/write/replica"
+)
+
+const (
+	RecoveryTypeEmptyStore    = "EMPTY_STORE"
+	RecoveryTypeExistingStore = "EXISTING_STORE"
+	RecoveryTypePeer          = "PEER"
+
+	RecoveryStageInit        = "INIT"
+	RecoveryStageIndex       = "INDEX"
+	RecoveryStageVerifyIndex = "VERIFY_INDEX"
+	RecoveryStageTranslog    = "TRANSLOG"
+	RecoveryStageFinalize    = "FINALIZE"
+	RecoveryStageDone        = "DONE"
+)
+
+const (
+	recoveryChunkSize       = 512 * 1024
+	maxConcurrentRecoveries = 2
+	// defaultRecoveryMaxBytesPerSec is the default of the indices.recovery.max_bytes_per_sec setting, 40mb
+	defaultRecoveryMaxBytesPerSec = 40 * 1024 * 1024
+)
+
+// RecoveryState describes how a shard copy on this node was created, from its store or from a peer.
+type RecoveryState struct {
+	ShardId    state.ShardId
+	Primary    bool
+	Type       string
+	Stage      string
+	SourceNode state.Node
+	TargetNode state.Node
+	StartTime  time.Time
+	StopTime   time.Time
+
+	TotalFiles           int
+	RecoveredFiles       int
+	TotalBytes           int64
+	RecoveredBytes       int64
+	TotalTranslogOps     int
+	RecoveredTranslogOps int
+}
+
+func (r *RecoveryState) WriteTo(out *common.StreamOutput) {
+	r.ShardId.WriteTo(out)
+	out.WriteBool(r.Primary)
+	out.WriteString(r.Type)
+	out.WriteString(r.Stage)
+	r.SourceNode.WriteTo(out)
+	r.TargetNode.WriteTo(out)
+	out.WriteTime(r.StartTime)
+	out.WriteTime(r.StopTime)
+	out.WriteInt(r.TotalFiles)
+	out.WriteInt(r.RecoveredFiles)
+	out.WriteInt64(r.TotalBytes)
+	out.WriteInt64(r.RecoveredBytes)
+	out.WriteInt(r.TotalTranslogOps)
+	out.WriteInt(r.RecoveredTranslogOps)
+}
+
+func ReadRecoveryState(in *common.StreamInput) RecoveryState {
+	return RecoveryState{
+		ShardId:              state.ReadShardId(in),
+		Primary:              in.ReadBool(),
+		Type:                 in.ReadString(),
+		Stage:                in.ReadString(),
+		SourceNode:           state.ReadNode(in),
+		TargetNode:           state.ReadNode(in),
+		StartTime:            in.ReadTime(),
+		StopTime:             in.ReadTime(),
+		TotalFiles:           in.ReadInt(),
+		RecoveredFiles:       in.ReadInt(),
+		TotalBytes:           in.ReadInt64(),
+		RecoveredBytes:       in.ReadInt64(),
+		TotalTranslogOps:     in.ReadInt(),
+		RecoveredTranslogOps: in.ReadInt(),
+	}
+}
+
+// recoveryRequest is sent by the node recovering a shard copy to the node holding the primary.
+type recoveryRequest struct {
+	RecoveryId   string
+	ShardId      state.ShardId
+	TargetNodeId string
+	SeqNo        int64
+	FileName     string
+	Offset       int64
+	Length       int
+}
+
+func (r *recoveryRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.RecoveryId)
+	r.ShardId.WriteTo(out)
+	out.WriteString(r.TargetNodeId)
+	out.WriteInt64(r.SeqNo)
+	out.WriteString(r.FileName)
+	out.WriteInt64(r.Offset)
+	out.WriteInt(r.Length)
+}
+
+func readRecoveryRequest(in *common.StreamInput) (*recoveryRequest, error) {
+	req := recoveryRequest{
+		RecoveryId:   in.ReadString(),
+		ShardId:      state.ReadShardId(in),
+		TargetNodeId: in.ReadString(),
+		SeqNo:        in.ReadInt64(),
+		FileName:     in.ReadString(),
+		Offset:       in.ReadInt64(),
+		Length:       in.ReadInt(),
+	}
+	return &req, in.Err()
+}
+
+// replicaRequest carries operations written on a primary to one of its replicas.
+type replicaRequest struct {
+	ShardId    state.ShardId
+	Operations []index.Operation
+}
+
+func (r *replicaRequest) WriteTo(out *common.StreamOutput) {
+	r.ShardId.WriteTo(out)
+	writeOperations(out, r.Operations)
+}
+
+func readReplicaRequest(in *common.StreamInput) (*replicaRequest, error) {
+	req := replicaRequest{
+		ShardId:    state.ReadShardId(in),
+		Operations: readOperations(in),
+	}
+	return &req, in.Err()
+}
+
+type shardActionResponse struct {
+	Error      string
+	SeqNo      int64
+	Files      []index.RecoveryFile
+	Chunk      []byte
+	Operations []index.Operation
+}
+
+func (r *shardActionResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Error)
+	out.WriteInt64(r.SeqNo)
+	out.WriteVInt(uint64(len(r.Files)))
+	for _, file := range r.Files {
+		out.WriteString(file.Name)
+		out.WriteInt64(file.Length)
+	}
+	out.WriteBytes(r.Chunk)
+	writeOperations(out, r.Operations)
+}
+
+func readShardActionResponse(in *common.StreamInput) (*shardActionResponse, error) {
+	res := shardActionResponse{
+		Error: in.ReadString(),
+		SeqNo: in.ReadInt64(),
+	}
+	if count := in.ReadCount(); count > 0 {
+		res.Files = make([]index.RecoveryFile, 0, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			res.Files = append(res.Files, index.RecoveryFile{Name: in.ReadString(), Length: in.ReadInt64()})
+		}
+	}
+	res.Chunk = in.ReadBytes()
+	res.Operations = readOperations(in)
+	return &res, in.Err()
+}
+
+func writeOperations(out *common.StreamOutput, ops []index.Operation) {
+	out.WriteVInt(uint64(len(ops)))
+	for i := range ops {
+		ops[i].WriteTo(out)
+	}
+}
+
+func readOperations(in *common.StreamInput) []index.Operation {
+	count := in.ReadCount()
+	if count == 0 {
+		return nil
+	}
+	ops := make([]index.Operation, 0, count)
+	for i := 0; i < count && in.Err() == nil; i++ {
+		ops = append(ops, index.ReadOperation(in))
+	}
+	return ops
+}
+
+// RecoveryService recovers replicas from their primary and replicates the writes of the local primaries.
+// A recovering node pulls a snapshot of the primary's files, then the translog operations written
+// since the snapshot, and finally the operations written meanwhile, after which the primary
+// replicates its writes to the new copy.
+type RecoveryService struct {
+	indicesService      *Service
+	clusterService      state.ClusterService
+	transportService    *transport.Service
+	shardStateAction    *cluster.ShardStateAction
+	clusterStateService *ClusterStateService
+
+	mux        sync.Mutex
+	recovering map[state.ShardId]struct{}
+	// failed holds the allocation ids of the copies whose recovery failed, they are not recovered again
+	failed  map[string]struct{}
+	limiter chan struct{}
+	// maxBytesPerSec throttles the files copied by the recoveries, 0 disables the throttling
+	maxBytesPerSec int64
+}
+
+func NewRecoveryService(indicesService *Service, clusterService state.ClusterService, transportService *transport.Service, shardStateAction *cluster.ShardStateAction) *RecoveryService {
+	s := &RecoveryService{
+		indicesService:   indicesService,
+		clusterService:   clusterService,
+		transportService: transportService,
+		shardStateAction: shardStateAction,
+		recovering:       map[state.ShardId]struct{}{},
+		failed:           map[string]struct{}{},
+		limiter:          make(chan struct{}, maxConcurrentRecoveries),
+		maxBytesPerSec:   defaultRecoveryMaxBytesPerSec,
+	}
+
+	transportService.RegisterRequestHandler(RecoveryStartAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readRecoveryRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		res := shardActionResponse{}
+		if indexShard, err := s.localShard(request.ShardId); err != nil {
+			res.Error = err.Error()
+		} else if snapshot, err := indexShard.SnapshotForRecovery(request.RecoveryId); err != nil {
+			if _, failed := err.(*index.EngineFailedError); failed {
+				logrus.Errorf("Failed shard [%s][%d]: %v", request.ShardId.Index.Name, request.ShardId.ShardId, err)
+				s.shardStateAction.ShardFailed(indexShard.ShardRouting(), err.Error())
+			}
+			res.Error = err.Error()
+		} else {
+			res.SeqNo = snapshot.SeqNo
+			res.Files = snapshot.Files
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+	transportService.RegisterRequestHandler(RecoveryFileChunkAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readRecoveryRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		res := shardActionResponse{}
+		if indexShard, err := s.localShard(request.ShardId); err != nil {
+			res.Error = err.Error()
+		} else if chunk, err := indexShard.ReadRecoveryFile(request.RecoveryId, request.FileName, request.Offset, request.Length); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Chunk = chunk
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+	transportService.RegisterRequestHandler(RecoveryTranslogOpsAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readRecoveryRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		res := shardActionResponse{}
+		if indexShard, err := s.localShard(request.ShardId); err != nil {
+			res.Error = err.Error()
+		} else if ops, err := indexShard.OperationsSince(request.SeqNo); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Operations = ops
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+	transportService.RegisterRequestHandler(RecoveryFinalizeAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readRecoveryRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		res := shardActionResponse{}
+		if indexShard, err := s.localShard(request.ShardId); err != nil {
+			res.Error = err.Error()
+		} else if ops, err := indexShard.FinalizeRecovery(request.RecoveryId, request.TargetNodeId, request.SeqNo); err != nil {
+			res.Error = err.Error()
+		} else {
+			res.Operations = ops
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+	transportService.RegisterRequestHandler(RecoveryCancelAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readRecoveryRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		if indexShard, err := s.localShard(request.ShardId); err == nil {
+			indexShard.CancelRecovery(request.RecoveryId)
+		}
+		channel.SendMessage("", common.ToBytes(&shardActionResponse{}, channel.GetVersion()))
+	})
+	transportService.RegisterRequestHandler(ReplicaWriteAction, func(channel transport.ReplyChannel, req []byte) {
+		request, err := readReplicaRequest(common.NewStreamInput(req, channel.GetVersion()))
+		if err != nil {
+			channel.SendError(err)
+			return
+		}
+		res := shardActionResponse{}
+		if indexShard, err := s.localShard(request.ShardId); err != nil {
+			res.Error = err.Error()
+		} else if err := indexShard.ApplyOperations(request.Operations); err != nil {
+			res.Error = err.Error()
+		}
+		channel.SendMessage("", common.ToBytes(&res, channel.GetVersion()))
+	})
+
+	return s
+}
+
+func (s *RecoveryService) localShard(shardId state.ShardId) (*index.Shard, error) {
+	indexService, existing := s.indicesService.IndexService(shardId.Index.Uuid)
+	if !existing {
+		return nil, fmt.Errorf("no such index [%s]", shardId.Index.Name)
+	}
+	indexShard, existing := indexService.Shard(shardId.ShardId)
+	if !existing {
+		return nil, fmt.Errorf("no such shard [%s][%d]", shardId.Index.Name, shardId.ShardId)
+	}
+	return indexShard, nil
+}
+
+// sendRequest sends a request and waits for its response.
+// recoveryRetryPolicy sends a request again when the node does not reply in time or the connection is lost.
+var recoveryRetryPolicy = transport.RetryPolicy{
+	MaxRetries: 3,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 5 * time.Second,
+}
+
+// sendRequest returns the response of a node, a failed request is returned as the error of the response.
+func (s *RecoveryService) sendRequest(node state.Node, action string, req common.Writeable) *shardActionResponse {
+	policy := recoveryRetryPolicy
+	if action == ReplicaWriteAction {
+		// a replica missing a write is recovered again instead
+		policy = transport.RetryPolicy{}
+	}
+	version := s.transportService.GetVersion(node)
+	done := make(chan *shardActionResponse, 1)
+	s.transportService.SendRequestWithRetries(node, action, common.ToBytes(req, version), transport.RequestOptions{}, policy, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			res, err := readShardActionResponse(common.NewStreamInput(response, version))
+			if err != nil {
+				res = &shardActionResponse{Error: err.Error()}
+			}
+			done <- res
+		},
+		OnFailure: func(err error) {
+			done <- &shardActionResponse{Error: err.Error()}
+		},
+	})
+	return <-done
+}
+
+// Replicator sends the writes of a local primary to the nodes holding its replicas.
+func (s *RecoveryService) Replicator(shardId state.ShardId) index.Replicator {
+	return func(nodeIds []string, ops []index.Operation) error {
+		req := replicaRequest{
+			ShardId:    shardId,
+			Operations: ops,
+		}
+		clusterState := s.clusterService.State()
+		var failures []string
+		for _, nodeId := range nodeIds {
+			node, existing := clusterState.Nodes.Nodes[nodeId]
+			if !existing {
+				failures = append(failures, "["+nodeId+"] left the cluster")
+				continue
+			}
+			if res := s.sendRequest(node, ReplicaWriteAction, &req); res.Error != "" {
+				failures = append(failures, "["+nodeId+"] "+res.Error)
+				// the replica missed a write, it has to be recovered again
+				for _, shardCopy := range clusterState.RoutingTable.IndicesRouting[shardId.Index.Name].Shards[shardId.ShardId].Copies() {
+					if !shardCopy.Primary && shardCopy.CurrentNodeId == nodeId {
+						s.shardStateAction.ShardFailed(shardCopy, "failed to perform replica write: "+res.Error)
+					}
+					if shardCopy.State == state.ShardRelocating && shardCopy.RelocatingNodeId == nodeId {
+						s.shardStateAction.ShardFailed(shardCopy.RelocationTarget(), "failed to perform replica write: "+res.Error)
+					}
+				}
+			}
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("%s", strings.Join(failures, ", "))
+		}
+		return nil
+	}
+}
+
+// Recovering tells whether a peer recovery of the shard is ongoing on this node.
+func (s *RecoveryService) Recovering(shardId state.ShardId) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.recovering[shardId]
+	return ok
+}
+
+// Failed tells whether the recovery of this allocation of a copy failed on this node.
+func (s *RecoveryService) Failed(shardRouting state.ShardRouting) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.failed[shardRouting.AllocationId]
+	return ok
+}
+
+// recordStoreRecovery records the creation of a primary from the local store.
+func (s *RecoveryService) recordStoreRecovery(shardRouting state.ShardRouting, existingStore bool) {
+	recoveryType := RecoveryTypeEmptyStore
+	if existingStore {
+		recoveryType = RecoveryTypeExistingStore
+	}
+	now := time.Now()
+	s.indicesService.putRecoveryState(RecoveryState{
+		ShardId:    shardRouting.ShardId,
+		Primary:    true,
+		Type:       recoveryType,
+		Stage:      RecoveryStageDone,
+		TargetNode: s.transportService.GetLocalNode(),
+		StartTime:  now,
+		StopTime:   now,
+	})
+}
+
+// StartRecovery recovers the local copy of a shard from the primary on sourceNode in the background,
+// then reports the copy as started to the master.
+func (s *RecoveryService) StartRecovery(shardRouting state.ShardRouting, sourceNode state.Node) {
+	s.mux.Lock()
+	s.recovering[shardRouting.ShardId] = struct{}{}
+	s.mux.Unlock()
+
+	s.indicesService.putRecoveryState(RecoveryState{
+		ShardId:    shardRouting.ShardId,
+		Primary:    shardRouting.Primary,
+		Type:       RecoveryTypePeer,
+		Stage:      RecoveryStageInit,
+		SourceNode: sourceNode,
+		TargetNode: s.transportService.GetLocalNode(),
+		StartTime:  time.Now(),
+	})
+
+	go func() {
+		s.limiter <- struct{}{}
+		recoveryId := common.RandomBase64()
+		err := s.recover(recoveryId, shardRouting, sourceNode)
+		<-s.limiter
+
+		s.mux.Lock()
+		delete(s.recovering, shardRouting.ShardId)
+		if err != nil {
+			s.failed[shardRouting.AllocationId] = struct{}{}
+		}
+		s.mux.Unlock()
+
+		shardId := shardRouting.ShardId
+		if err != nil {
+			logrus.Warnf("Failed to recover shard [%s][%d] from [%s]: %v", shardId.Index.Name, shardId.ShardId, sourceNode.Name, err)
+			req := recoveryRequest{
+				RecoveryId: recoveryId,
+				ShardId:    shardId,
+			}
+			s.sendRequest(sourceNode, RecoveryCancelAction, &req)
+			s.clusterStateService.removeShard(shardId)
+			s.shardStateAction.ShardFailed(shardRouting, "failed recovery: "+err.Error())
+			return
+		}
+		logrus.Infof("Recovered shard [%s][%d] from [%s]", shardId.Index.Name, shardId.ShardId, sourceNode.Name)
+		s.shardStateAction.ShardStarted(shardRouting)
+	}()
+}
+
+func (s *RecoveryService) recover(recoveryId string, shardRouting state.ShardRouting, sourceNode state.Node) error {
+	shardId := shardRouting.ShardId
+	req := recoveryRequest{
+		RecoveryId:   recoveryId,
+		ShardId:      shardId,
+		TargetNodeId: s.transportService.GetLocalNode().Id,
+	}
+
+	res := s.sendRequest(sourceNode, RecoveryStartAction, &req)
+	if res.Error != "" {
+		return fmt.Errorf("%s", res.Error)
+	}
+	snapshotSeqNo, files := res.SeqNo, res.Files
+	s.indicesService.updateRecoveryState(shardId, func(recoveryState *RecoveryState) {
+		recoveryState.Stage = RecoveryStageIndex
+		recoveryState.TotalFiles = len(files)
+		for _, file := range files {
+			recoveryState.TotalBytes += file.Length
+		}
+	})
+
+	indexService, existing := s.indicesService.IndexService(shardId.Index.Uuid)
+	if !existing {
+		return fmt.Errorf("no such index [%s]", shardId.Index.Name)
+	}
+	shardPath := indexService.ShardPath(shardId.ShardId)
+	if err := os.RemoveAll(shardPath); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := s.fetchFile(sourceNode, req, shardPath, file); err != nil {
+			return err
+		}
+		s.indicesService.updateRecoveryState(shardId, func(recoveryState *RecoveryState) {
+			recoveryState.RecoveredFiles++
+		})
+	}
+
+	s.indicesService.updateRecoveryState(shardId, func(recoveryState *RecoveryState) {
+		recoveryState.Stage = RecoveryStageVerifyIndex
+	})
+	indexShard, err := s.clusterStateService.createShard(shardRouting)
+	if err != nil {
+		return err
+	}
+
+	s.indicesService.updateRecoveryState(shardId, func(recoveryState *RecoveryState) {
+		recoveryState.Stage = RecoveryStageTranslog
+	})
+	req.SeqNo = snapshotSeqNo
+	seqNo, err := s.replayOperations(sourceNode, RecoveryTranslogOpsAction, req, indexShard)
+	if err != nil {
+		return err
+	}
+
+	// the primary blocks its writes while collecting the last operations, then replicates the
+	// following ones to this copy
+	s.indicesService.updateRecoveryState(shardId, func(recoveryState *RecoveryState) {
+		recoveryState.Stage = RecoveryStageFinalize
+	})
+	req.SeqNo = seqNo
+	if _, err := s.replayOperations(sourceNode, RecoveryFinalizeAction, req, indexShard); err != nil {
+		return err
+	}
+
+	s.indicesService.updateRecoveryState(shardId, func(recoveryState *RecoveryState) {
+		recoveryState.Stage = RecoveryStageDone
+		recoveryState.StopTime = time.Now()
+	})
+	return nil
+}
+
+// SetMaxBytesPerSec updates the rate the recoveries copy the files at, 0 disables the throttling.
+func (s *RecoveryService) SetMaxBytesPerSec(maxBytesPerSec int64) {
+	atomic.StoreInt64(&s.maxBytesPerSec, maxBytesPerSec)
+}
+
+// throttle pauses a copy started at startTime until the bytes copied so far are within the rate limit.
+func (s *RecoveryService) throttle(startTime time.Time, copiedBytes int64) {
+	maxBytesPerSec := atomic.LoadInt64(&s.maxBytesPerSec)
+	if maxBytesPerSec <= 0 {
+		return
+	}
+	expected := time.Duration(float64(copiedBytes) / float64(maxBytesPerSec) * float64(time.Second))
+	if pause := expected - time.Since(startTime); pause > 0 {
+		time.Sleep(pause)
+	}
+}
+
+// fetchFile copies a file of the primary's recovery snapshot into the shard directory, chunk by chunk.
+func (s *RecoveryService) fetchFile(sourceNode state.Node, req recoveryRequest, shardPath string, file index.RecoveryFile) error {
+	root := filepath.Clean(shardPath)
+	path := filepath.Join(root, filepath.FromSlash(file.Name))
+	if !strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return fmt.Errorf("invalid recovery file [%s]", file.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req.FileName = file.Name
+	req.Length = recoveryChunkSize
+	startTime := time.Now()
+	for req.Offset = 0; req.Offset < file.Length; {
+		res := s.sendRequest(sourceNode, RecoveryFileChunkAction, &req)
+		if res.Error != "" {
+			return fmt.Errorf("%s", res.Error)
+		}
+		if len(res.Chunk) == 0 {
+			return fmt.Errorf("recovery file [%s] ended at [%d] of [%d] bytes", file.Name, req.Offset, file.Length)
+		}
+		if _, err := f.Write(res.Chunk); err != nil {
+			return err
+		}
+		req.Offset += int64(len(res.Chunk))
+		s.indicesService.updateRecoveryState(req.ShardId, func(recoveryState *RecoveryState) {
+			recoveryState.RecoveredBytes += int64(len(res.Chunk))
+		})
+		s.throttle(startTime, req.Offset)
+	}
+	return f.Sync()
+}
+
+// replayOperations applies the operations the primary returns for action and returns the highest
+// sequence number seen, req.SeqNo when there are none.
+func (s *RecoveryService) replayOperations(sourceNode state.Node, action string, req recoveryRequest, indexShard *index.Shard) (int64, error) {
+	res := s.sendRequest(sourceNode, action, &req)
+	if res.Error != "" {
+		return req.SeqNo, fmt.Errorf("%s", res.Error)
+	}
+	ops := res.Operations
+	s.indicesService.updateRecoveryState(req.ShardId, func(recoveryState *RecoveryState) {
+		recoveryState.TotalTranslogOps += len(ops)
+	})
+	if err := indexShard.ApplyOperations(ops); err != nil {
+		return req.SeqNo, err
+	}
+	s.indicesService.updateRecoveryState(req.ShardId, func(recoveryState *RecoveryState) {
+		recoveryState.RecoveredTranslogOps += len(ops)
+	})
+
+	seqNo := req.SeqNo
+	for _, op := range ops {
+		if op.SeqNo > seqNo {
+			seqNo = op.SeqNo
+		}
+	}
+	return seqNo, nil
+}
@@ -1,10 +1,9 @@
 package state
 
 import (
-	"bytes"
-	"encoding/gob"
 	"github.com/actumn/searchgoose/common"
 	"github.com/sirupsen/logrus"
+	"time"
 )
 
 // ClusterState
@@ -18,25 +17,37 @@ type ClusterState struct {
 	RoutingTable RoutingTable
 }
 
-func (c *ClusterState) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(c); err != nil {
-		logrus.Fatal(err)
-	}
-	return buffer.Bytes()
+func (c *ClusterState) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(c.Version)
+	out.WriteString(c.StateUUID)
+	out.WriteString(c.Name)
+	c.Nodes.WriteTo(out)
+	c.Metadata.WriteTo(out)
+	c.RoutingTable.WriteTo(out)
 }
-func ClusterStateFromBytes(b []byte, localNode Node) *ClusterState {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var state ClusterState
-	if err := decoder.Decode(&state); err != nil {
-		logrus.Fatal(err)
+
+// ReadClusterState reads a state received from the master, the local node is put in its nodes as it knows itself.
+func ReadClusterState(in *common.StreamInput, localNode Node) (*ClusterState, error) {
+	state := ClusterState{
+		Version:      in.ReadInt64(),
+		StateUUID:    in.ReadString(),
+		Name:         in.ReadString(),
+		Nodes:        ReadNodes(in),
+		Metadata:     ReadMetadata(in),
+		RoutingTable: ReadRoutingTable(in),
 	}
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+
+	state.setLocalNode(localNode)
+	return &state, nil
+}
 
-	state.Nodes.LocalNodeId = localNode.Id
-	state.Nodes.Nodes[localNode.Id] = localNode
-	return &state
+// setLocalNode puts the local node as it knows itself in the nodes of a state received from the master.
+func (c *ClusterState) setLocalNode(localNode Node) {
+	c.Nodes.LocalNodeId = localNode.Id
+	c.Nodes.Nodes[localNode.Id] = localNode
 }
 
 type ClusterBlocks struct {
@@ -57,20 +68,23 @@ func (c *CoordinationState) getCurrentTerm() int64 {
 	return c.Term
 }
 
-func (c *CoordinationState) IsElectionQuorum(nodes []string) bool {
-	return c.JoinVotes.IsQuorum(nodes)
+// IsElectionQuorum tells whether the votes are a majority of both the last committed and the last accepted
+// voting configurations.
+func (c *CoordinationState) IsElectionQuorum(votes *VoteCollection) bool {
+	coordination := c.PersistedState.GetLastAcceptedState().Metadata.Coordination
+	return votes.IsQuorum(coordination.LastCommittedConfiguration.NodeIds) && votes.IsQuorum(coordination.LastAcceptedConfiguration.NodeIds)
 }
 
 // VoteCollection
 type VoteCollection struct {
 	nodes map[string]*Node
-	joins map[Join]bool //Set data structure
+	joins map[string]Join // keyed by source node id
 }
 
 func NewVoteCollection() *VoteCollection {
 	return &VoteCollection{
 		nodes: make(map[string]*Node),
-		joins: make(map[Join]bool),
+		joins: make(map[string]Join),
 	}
 }
 
@@ -102,8 +116,7 @@ func (v *VoteCollection) AddVote(sourceNode *Node) bool {
 func (v *VoteCollection) AddJoinVote(join Join) bool {
 	added := v.AddVote(&(join.SourceNode))
 	if added {
-		// Set data structure
-		v.joins[join] = true
+		v.joins[join.SourceNode.Id] = join
 	}
 	return added
 }
@@ -112,6 +125,33 @@ type Join struct {
 	SourceNode Node
 	TargetNode Node
 	Term       int64
+	// the term and version of the last state the voter accepted, a candidate with an older state does not get the vote
+	LastAcceptedTerm    int64
+	LastAcceptedVersion int64
+}
+
+func (j *Join) WriteTo(out *common.StreamOutput) {
+	j.SourceNode.WriteTo(out)
+	j.TargetNode.WriteTo(out)
+	out.WriteInt64(j.Term)
+	if out.Version >= common.V_2 {
+		out.WriteInt64(j.LastAcceptedTerm)
+		out.WriteInt64(j.LastAcceptedVersion)
+	}
+}
+
+// ReadJoin reads a join, a voter of the first version does not tell its last accepted state.
+func ReadJoin(in *common.StreamInput) Join {
+	join := Join{
+		SourceNode: ReadNode(in),
+		TargetNode: ReadNode(in),
+		Term:       in.ReadInt64(),
+	}
+	if in.Version >= common.V_2 {
+		join.LastAcceptedTerm = in.ReadInt64()
+		join.LastAcceptedVersion = in.ReadInt64()
+	}
+	return join
 }
 
 func NewJoin(sourceNode Node, targetNode Node, term int64) *Join {
@@ -139,10 +179,72 @@ const (
 type Metadata struct {
 	//ClusterUUID string
 	//Version     int64
-	//Coordination CoordinationMetadata
-	Indices map[string]IndexMetadata
+	Coordination CoordinationMetadata
+	Indices      map[string]IndexMetadata
 	//Templates    map[string]IndexTemplateMetadata
 	IndicesLookup map[string]IndexAbstractionAlias
+	// PersistentSettings are the cluster settings, e.g. cluster.routing.rebalance.enable
+	PersistentSettings map[string]string
+	// TransientSettings override the persistent ones, they do not survive a full cluster restart
+	TransientSettings map[string]string
+	Security          SecurityMetadata
+}
+
+func (m *Metadata) WriteTo(out *common.StreamOutput) {
+	m.Coordination.WriteTo(out)
+	out.WriteVInt(uint64(len(m.Indices)))
+	for name, indexMetadata := range m.Indices {
+		out.WriteString(name)
+		indexMetadata.WriteTo(out)
+	}
+	out.WriteVInt(uint64(len(m.IndicesLookup)))
+	for name, alias := range m.IndicesLookup {
+		out.WriteString(name)
+		out.WriteString(alias.AliasName)
+		alias.WriteIndex.WriteTo(out)
+	}
+	out.WriteStringMap(m.PersistentSettings)
+	out.WriteStringMap(m.TransientSettings)
+	m.Security.WriteTo(out)
+}
+
+func ReadMetadata(in *common.StreamInput) Metadata {
+	m := Metadata{
+		Coordination: ReadCoordinationMetadata(in),
+	}
+	if count := in.ReadCount(); count > 0 {
+		m.Indices = make(map[string]IndexMetadata, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			m.Indices[name] = ReadIndexMetadata(in)
+		}
+	}
+	if count := in.ReadCount(); count > 0 {
+		m.IndicesLookup = make(map[string]IndexAbstractionAlias, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			m.IndicesLookup[name] = IndexAbstractionAlias{
+				AliasName:  in.ReadString(),
+				WriteIndex: ReadIndexMetadata(in),
+			}
+		}
+	}
+	m.PersistentSettings = in.ReadStringMap()
+	m.TransientSettings = in.ReadStringMap()
+	m.Security = ReadSecurityMetadata(in)
+	return m
+}
+
+// Settings are the cluster settings in effect, the transient ones over the persistent ones.
+func (m *Metadata) Settings() map[string]string {
+	settings := map[string]string{}
+	for key, value := range m.PersistentSettings {
+		settings[key] = value
+	}
+	for key, value := range m.TransientSettings {
+		settings[key] = value
+	}
+	return settings
 }
 
 func (m *Metadata) FindAliases(aliases []string, concreteIndices []string) map[string][]AliasMetadata {
@@ -184,14 +286,103 @@ type Index struct {
 }
 
 type IndexMetadata struct {
-	Index          Index
-	NumberOfShards int
-	//NumberOfReplicas int
+	Index            Index
+	NumberOfShards   int
+	NumberOfReplicas int
 	//Version            int64
 	//State              IndexMetadataState
 	Aliases map[string]AliasMetadata
 	Mapping map[string]MappingMetadata
 	//Settings Settings
+	RoutingPartitionSize int
+	// RoutingRequired is the _routing.required of the mapping
+	RoutingRequired bool
+	// RefreshInterval is the index.refresh_interval, negative when the periodic refresh is disabled
+	RefreshInterval time.Duration
+	// TranslogDurability is the index.translog.durability, "request" or "async"
+	TranslogDurability   string
+	TranslogSyncInterval time.Duration
+	// RoutingAllocationRequire, RoutingAllocationInclude and RoutingAllocationExclude are the
+	// index.routing.allocation.{require,include,exclude}.* filters keyed by node attribute
+	RoutingAllocationRequire map[string]string
+	RoutingAllocationInclude map[string]string
+	RoutingAllocationExclude map[string]string
+	// ReadOnlyAllowDelete is the index.blocks.read_only_allow_delete block, put when a node holding the index
+	// exceeds the flood-stage disk watermark. Writes are rejected, deleting the index is allowed.
+	ReadOnlyAllowDelete bool
+}
+
+func (i *Index) WriteTo(out *common.StreamOutput) {
+	out.WriteString(i.Name)
+	out.WriteString(i.Uuid)
+}
+
+func ReadIndex(in *common.StreamInput) Index {
+	return Index{
+		Name: in.ReadString(),
+		Uuid: in.ReadString(),
+	}
+}
+
+func (m *IndexMetadata) WriteTo(out *common.StreamOutput) {
+	m.Index.WriteTo(out)
+	out.WriteInt(m.NumberOfShards)
+	out.WriteInt(m.NumberOfReplicas)
+	out.WriteVInt(uint64(len(m.Aliases)))
+	for name, alias := range m.Aliases {
+		out.WriteString(name)
+		out.WriteString(alias.Alias)
+	}
+	out.WriteVInt(uint64(len(m.Mapping)))
+	for name, mapping := range m.Mapping {
+		out.WriteString(name)
+		out.WriteString(mapping.Type)
+		out.WriteBytes(mapping.Source)
+	}
+	out.WriteInt(m.RoutingPartitionSize)
+	out.WriteBool(m.RoutingRequired)
+	out.WriteDuration(m.RefreshInterval)
+	out.WriteString(m.TranslogDurability)
+	out.WriteDuration(m.TranslogSyncInterval)
+	out.WriteStringMap(m.RoutingAllocationRequire)
+	out.WriteStringMap(m.RoutingAllocationInclude)
+	out.WriteStringMap(m.RoutingAllocationExclude)
+	out.WriteBool(m.ReadOnlyAllowDelete)
+}
+
+func ReadIndexMetadata(in *common.StreamInput) IndexMetadata {
+	m := IndexMetadata{
+		Index:            ReadIndex(in),
+		NumberOfShards:   in.ReadInt(),
+		NumberOfReplicas: in.ReadInt(),
+	}
+	if count := in.ReadCount(); count > 0 {
+		m.Aliases = make(map[string]AliasMetadata, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			m.Aliases[name] = AliasMetadata{Alias: in.ReadString()}
+		}
+	}
+	if count := in.ReadCount(); count > 0 {
+		m.Mapping = make(map[string]MappingMetadata, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			m.Mapping[name] = MappingMetadata{
+				Type:   in.ReadString(),
+				Source: in.ReadBytes(),
+			}
+		}
+	}
+	m.RoutingPartitionSize = in.ReadInt()
+	m.RoutingRequired = in.ReadBool()
+	m.RefreshInterval = in.ReadDuration()
+	m.TranslogDurability = in.ReadString()
+	m.TranslogSyncInterval = in.ReadDuration()
+	m.RoutingAllocationRequire = in.ReadStringMap()
+	m.RoutingAllocationInclude = in.ReadStringMap()
+	m.RoutingAllocationExclude = in.ReadStringMap()
+	m.ReadOnlyAllowDelete = in.ReadBool()
+	return m
 }
 
 type AliasMetadata struct {
@@ -209,9 +400,57 @@ type MappingMetadata struct {
 
 //type IndexTemplateMetadata struct {
 //}
-//
-//type CoordinationMetadata struct {
-//}
+
+// CoordinationMetadata is the voting state of the cluster, an election needs a majority of both configurations.
+type CoordinationMetadata struct {
+	Term                       int64
+	LastCommittedConfiguration VotingConfiguration
+	LastAcceptedConfiguration  VotingConfiguration
+	VotingConfigExclusions     []VotingConfigExclusion
+}
+
+func (m *CoordinationMetadata) WriteTo(out *common.StreamOutput) {
+	out.WriteInt64(m.Term)
+	out.WriteStringSlice(m.LastCommittedConfiguration.NodeIds)
+	out.WriteStringSlice(m.LastAcceptedConfiguration.NodeIds)
+	out.WriteVInt(uint64(len(m.VotingConfigExclusions)))
+	for _, exclusion := range m.VotingConfigExclusions {
+		out.WriteString(exclusion.NodeId)
+		out.WriteString(exclusion.NodeName)
+	}
+}
+
+func ReadCoordinationMetadata(in *common.StreamInput) CoordinationMetadata {
+	m := CoordinationMetadata{
+		Term:                       in.ReadInt64(),
+		LastCommittedConfiguration: VotingConfiguration{NodeIds: in.ReadStringSlice()},
+		LastAcceptedConfiguration:  VotingConfiguration{NodeIds: in.ReadStringSlice()},
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		m.VotingConfigExclusions = append(m.VotingConfigExclusions, VotingConfigExclusion{
+			NodeId:   in.ReadString(),
+			NodeName: in.ReadString(),
+		})
+	}
+	return m
+}
+
+// IsExcluded tells whether the node is withdrawn from the voting configuration, by id or by name.
+func (m CoordinationMetadata) IsExcluded(node Node) bool {
+	for _, exclusion := range m.VotingConfigExclusions {
+		if exclusion.NodeId == node.Id || (exclusion.NodeId == "" && exclusion.NodeName == node.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// VotingConfigExclusion withdraws a master-eligible node from the voting configuration, the node id is empty
+// for a node excluded by the name while it is not in the cluster.
+type VotingConfigExclusion struct {
+	NodeId   string
+	NodeName string
+}
 
 type VotingConfiguration struct {
 	// nodeIds  map[string]bool
@@ -224,6 +463,24 @@ func NewVotingConfiguration() *VotingConfiguration {
 	}
 }
 
+func (c VotingConfiguration) IsEmpty() bool {
+	return len(c.NodeIds) == 0
+}
+
+func (c VotingConfiguration) Contains(nodeId string) bool {
+	for _, id := range c.NodeIds {
+		if id == nodeId {
+			return true
+		}
+	}
+	return false
+}
+
+// HasQuorum tells whether the node ids are a majority of the configuration.
+func (c VotingConfiguration) HasQuorum(nodeIds []string) bool {
+	return len(common.GetIntersection(c.NodeIds, nodeIds))*2 > len(c.NodeIds)
+}
+
 type RoutingTable struct {
 	IndicesRouting map[string]IndexRoutingTable
 }
@@ -234,9 +491,76 @@ type IndexRoutingTable struct {
 }
 
 type IndexShardRoutingTable struct {
-	ShardId ShardId
-	Primary ShardRouting
-	//Replicas []ShardRouting
+	ShardId  ShardId
+	Primary  ShardRouting
+	Replicas []ShardRouting
+}
+
+func (t *RoutingTable) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(uint64(len(t.IndicesRouting)))
+	for name, indexRoutingTable := range t.IndicesRouting {
+		out.WriteString(name)
+		indexRoutingTable.WriteTo(out)
+	}
+}
+
+func ReadRoutingTable(in *common.StreamInput) RoutingTable {
+	var t RoutingTable
+	if count := in.ReadCount(); count > 0 {
+		t.IndicesRouting = make(map[string]IndexRoutingTable, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			t.IndicesRouting[name] = ReadIndexRoutingTable(in)
+		}
+	}
+	return t
+}
+
+func (t *IndexRoutingTable) WriteTo(out *common.StreamOutput) {
+	t.Index.WriteTo(out)
+	out.WriteVInt(uint64(len(t.Shards)))
+	for _, shardRoutingTable := range t.Shards {
+		shardRoutingTable.WriteTo(out)
+	}
+}
+
+func ReadIndexRoutingTable(in *common.StreamInput) IndexRoutingTable {
+	t := IndexRoutingTable{
+		Index: ReadIndex(in),
+	}
+	if count := in.ReadCount(); count > 0 {
+		t.Shards = make(map[int]IndexShardRoutingTable, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			shardRoutingTable := ReadIndexShardRoutingTable(in)
+			t.Shards[shardRoutingTable.ShardId.ShardId] = shardRoutingTable
+		}
+	}
+	return t
+}
+
+func (t *IndexShardRoutingTable) WriteTo(out *common.StreamOutput) {
+	t.ShardId.WriteTo(out)
+	t.Primary.WriteTo(out)
+	out.WriteVInt(uint64(len(t.Replicas)))
+	for _, replica := range t.Replicas {
+		replica.WriteTo(out)
+	}
+}
+
+func ReadIndexShardRoutingTable(in *common.StreamInput) IndexShardRoutingTable {
+	t := IndexShardRoutingTable{
+		ShardId: ReadShardId(in),
+		Primary: ReadShardRouting(in),
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		t.Replicas = append(t.Replicas, ReadShardRouting(in))
+	}
+	return t
+}
+
+// Copies returns the primary followed by the replicas of the shard.
+func (t IndexShardRoutingTable) Copies() []ShardRouting {
+	return append([]ShardRouting{t.Primary}, t.Replicas...)
 }
 
 type ShardId struct {
@@ -244,11 +568,154 @@ type ShardId struct {
 	ShardId int
 }
 
+func (i *ShardId) WriteTo(out *common.StreamOutput) {
+	i.Index.WriteTo(out)
+	out.WriteInt(i.ShardId)
+}
+
+func ReadShardId(in *common.StreamInput) ShardId {
+	return ShardId{
+		Index:   ReadIndex(in),
+		ShardId: in.ReadInt(),
+	}
+}
+
+type ShardRoutingState string
+
+const (
+	// ShardUnassigned is a shard copy that is not allocated to any node.
+	ShardUnassigned ShardRoutingState = "UNASSIGNED"
+	// ShardInitializing is a shard copy allocated to a node that is still creating or recovering it.
+	ShardInitializing ShardRoutingState = "INITIALIZING"
+	// ShardStarted is a shard copy that has been created or recovered.
+	ShardStarted ShardRoutingState = "STARTED"
+	// ShardRelocating is a started shard copy being moved to another node.
+	ShardRelocating ShardRoutingState = "RELOCATING"
+)
+
+type UnassignedReason string
+
+const (
+	UnassignedIndexCreated     UnassignedReason = "INDEX_CREATED"
+	UnassignedClusterRecovered UnassignedReason = "CLUSTER_RECOVERED"
+	UnassignedNodeLeft         UnassignedReason = "NODE_LEFT"
+	UnassignedAllocationFailed UnassignedReason = "ALLOCATION_FAILED"
+	UnassignedPrimaryFailed    UnassignedReason = "PRIMARY_FAILED"
+	UnassignedRerouteCancelled UnassignedReason = "REROUTE_CANCELLED"
+	// UnassignedForcedEmptyPrimary marks a primary allocated with an empty store by the reroute API
+	UnassignedForcedEmptyPrimary UnassignedReason = "FORCED_EMPTY_PRIMARY"
+)
+
+// UnassignedInfo tells why a shard copy was last unassigned. It is kept until the copy starts.
+type UnassignedInfo struct {
+	Reason            UnassignedReason
+	At                time.Time
+	Details           string
+	FailedAllocations int
+}
+
 type ShardRouting struct {
 	ShardId       ShardId
 	CurrentNodeId string
-	//RelocatingNodeId string
-	Primary bool
+	// RelocatingNodeId is the node a relocating copy moves to, or the node a relocation target comes from
+	RelocatingNodeId string
+	Primary          bool
+	State            ShardRoutingState
+	// AllocationId identifies an allocation of the copy to a node, it changes every time the copy is allocated
+	AllocationId string
+	// RelocationAllocationId is the allocation id of the target of a relocating copy
+	RelocationAllocationId string
+	UnassignedInfo         UnassignedInfo
+}
+
+func (r *ShardRouting) WriteTo(out *common.StreamOutput) {
+	r.ShardId.WriteTo(out)
+	out.WriteString(r.CurrentNodeId)
+	out.WriteString(r.RelocatingNodeId)
+	out.WriteBool(r.Primary)
+	out.WriteString(string(r.State))
+	out.WriteString(r.AllocationId)
+	out.WriteString(r.RelocationAllocationId)
+	out.WriteString(string(r.UnassignedInfo.Reason))
+	out.WriteTime(r.UnassignedInfo.At)
+	out.WriteString(r.UnassignedInfo.Details)
+	out.WriteInt(r.UnassignedInfo.FailedAllocations)
+}
+
+func ReadShardRouting(in *common.StreamInput) ShardRouting {
+	return ShardRouting{
+		ShardId:                ReadShardId(in),
+		CurrentNodeId:          in.ReadString(),
+		RelocatingNodeId:       in.ReadString(),
+		Primary:                in.ReadBool(),
+		State:                  ShardRoutingState(in.ReadString()),
+		AllocationId:           in.ReadString(),
+		RelocationAllocationId: in.ReadString(),
+		UnassignedInfo: UnassignedInfo{
+			Reason:            UnassignedReason(in.ReadString()),
+			At:                in.ReadTime(),
+			Details:           in.ReadString(),
+			FailedAllocations: in.ReadInt(),
+		},
+	}
+}
+
+// Active tells whether the copy can serve requests.
+func (r ShardRouting) Active() bool {
+	return r.State == ShardStarted || r.State == ShardRelocating
+}
+
+// Unassigned returns the copy unassigned for the given reason.
+func (r ShardRouting) Unassigned(reason UnassignedReason, details string) ShardRouting {
+	failedAllocations := 0
+	if reason == UnassignedAllocationFailed {
+		failedAllocations = r.UnassignedInfo.FailedAllocations + 1
+	}
+	r.CurrentNodeId = ""
+	r.RelocatingNodeId = ""
+	r.State = ShardUnassigned
+	r.AllocationId = ""
+	r.RelocationAllocationId = ""
+	r.UnassignedInfo = UnassignedInfo{
+		Reason:            reason,
+		At:                time.Now(),
+		Details:           details,
+		FailedAllocations: failedAllocations,
+	}
+	return r
+}
+
+// Relocate returns the started copy relocating to the given node. It stays active until the target has recovered.
+func (r ShardRouting) Relocate(nodeId string, allocationId string) ShardRouting {
+	r.State = ShardRelocating
+	r.RelocatingNodeId = nodeId
+	r.RelocationAllocationId = allocationId
+	return r
+}
+
+// CancelRelocation returns the relocating copy started again on its current node.
+func (r ShardRouting) CancelRelocation() ShardRouting {
+	r.State = ShardStarted
+	r.RelocatingNodeId = ""
+	r.RelocationAllocationId = ""
+	return r
+}
+
+// RelocationTarget returns the initializing copy a relocating copy moves to.
+func (r ShardRouting) RelocationTarget() ShardRouting {
+	return ShardRouting{
+		ShardId:          r.ShardId,
+		CurrentNodeId:    r.RelocatingNodeId,
+		RelocatingNodeId: r.CurrentNodeId,
+		Primary:          r.Primary,
+		State:            ShardInitializing,
+		AllocationId:     r.RelocationAllocationId,
+	}
+}
+
+// IsRelocationTarget tells whether the copy is the target of a relocation, it is not part of the routing table.
+func (r ShardRouting) IsRelocationTarget() bool {
+	return r.State == ShardInitializing && r.RelocatingNodeId != ""
 }
 
 type IndexAbstractionAlias struct {
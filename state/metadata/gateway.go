@@ -28,20 +28,15 @@ func (m *GatewayMetaState) Start(
 	clusterState := &state.ClusterState{
 		Name: "searchgoose-testCluster",
 		Nodes: &state.Nodes{
-			Nodes: map[string]state.Node{
-				transportService.LocalNode.Id: transportService.GetLocalNode(),
-			},
-			MasterNodes: map[string]state.Node{
-				transportService.LocalNode.Id: transportService.GetLocalNode(),
-			},
-			DataNodes: map[string]state.Node{
-				transportService.LocalNode.Id: transportService.GetLocalNode(),
-			},
+			Nodes:       map[string]state.Node{},
+			MasterNodes: map[string]state.Node{},
+			DataNodes:   map[string]state.Node{},
 			LocalNodeId: transportService.LocalNode.Id,
 		},
 		Version:  onDiskState.LastAcceptedVersion,
 		Metadata: onDiskState.Metadata,
 	}
+	clusterState.Nodes.Add(transportService.GetLocalNode())
 
 	m.PersistedState = &BlevePersistedState{
 		PersistedClusterStateService: persistedClusterStateService,
@@ -0,0 +1,73 @@
+package state
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestReadClusterState(t *testing.T) {
+	// Arrange
+	node1 := Node{Name: "node1", Id: "testNodeId1", HostAddress: "127.0.0.1:8180", Attributes: map[string]string{"rack": "r1"}, Roles: NodeRoles(true, true, true)}
+	node2 := Node{Name: "node2", Id: "testNodeId2", Roles: NodeRoles(false, true, false)}
+	clusterState := diffTestClusterState(5, []Node{node1, node2}, "index1", "index2")
+	clusterState.StateUUID = "testUuid"
+	indexMetadata := clusterState.Metadata.Indices["index1"]
+	indexMetadata.Aliases = map[string]AliasMetadata{"alias1": {Alias: "alias1"}}
+	indexMetadata.Mapping = map[string]MappingMetadata{"_doc": {Type: "_doc", Source: []byte(`{"properties":{}}`)}}
+	indexMetadata.RefreshInterval = time.Second
+	indexMetadata.RoutingAllocationExclude = map[string]string{"rack": "r2"}
+	clusterState.Metadata.Indices["index1"] = indexMetadata
+	clusterState.Metadata.IndicesLookup = map[string]IndexAbstractionAlias{"alias1": {AliasName: "alias1", WriteIndex: indexMetadata}}
+	clusterState.Metadata.Coordination.LastAcceptedConfiguration = VotingConfiguration{NodeIds: []string{"testNodeId1"}}
+	clusterState.Metadata.Coordination.VotingConfigExclusions = []VotingConfigExclusion{{NodeName: "node3"}}
+	clusterState.Metadata.PersistentSettings = map[string]string{"cluster.routing.rebalance.enable": "none"}
+	clusterState.Metadata.Security = SecurityMetadata{
+		Users: map[string]User{"user1": {Username: "user1", PasswordHash: "hash", Roles: []string{"role1"}, Enabled: true}},
+		Roles: map[string]Role{"role1": {Name: "role1", Indices: []IndicesPrivileges{
+			{Names: []string{"index*"}, Privileges: []string{"read"}, FieldSecurity: &FieldSecurity{Grant: []string{"field1"}}},
+		}}},
+		ApiKeys: map[string]ApiKey{"key1": {Id: "key1", Username: "user1", RoleDescriptors: []Role{{Name: "limited"}}, Creation: 1}},
+	}
+	shardRoutingTable := clusterState.RoutingTable.IndicesRouting["index2"].Shards[0]
+	shardRoutingTable.Primary.UnassignedInfo = UnassignedInfo{Reason: UnassignedNodeLeft, At: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), FailedAllocations: 1}
+	shardRoutingTable.Replicas = []ShardRouting{{ShardId: shardRoutingTable.ShardId, CurrentNodeId: "testNodeId2", State: ShardStarted, AllocationId: "a"}}
+	clusterState.RoutingTable.IndicesRouting["index2"].Shards[0] = shardRoutingTable
+	written := common.ToBytes(&clusterState, common.CurrentVersion)
+
+	// Action
+	read, err := ReadClusterState(common.NewStreamInput(written, common.CurrentVersion), node2)
+	_, truncatedErr := ReadClusterState(common.NewStreamInput(written[:len(written)-1], common.CurrentVersion), node2)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, clusterState.Nodes.Nodes, read.Nodes.Nodes)
+	assert.Equal(t, clusterState.Nodes.MasterNodes, read.Nodes.MasterNodes)
+	assert.Equal(t, "testNodeId2", read.Nodes.LocalNodeId)
+	assert.Equal(t, clusterState.Metadata, read.Metadata)
+	assert.Equal(t, clusterState.RoutingTable, read.RoutingTable)
+	assert.Equal(t, "testUuid", read.StateUUID)
+	assert.NotNil(t, truncatedErr)
+}
+
+func TestReadJoin(t *testing.T) {
+	// Arrange
+	join := Join{
+		SourceNode:          Node{Name: "node1", Id: "testNodeId1"},
+		TargetNode:          Node{Name: "node2", Id: "testNodeId2"},
+		Term:                3,
+		LastAcceptedTerm:    2,
+		LastAcceptedVersion: 7,
+	}
+
+	// Action
+	read := ReadJoin(common.NewStreamInput(common.ToBytes(&join, common.V_2), common.V_2))
+	previous := ReadJoin(common.NewStreamInput(common.ToBytes(&join, common.V_1), common.V_1))
+
+	// Assert
+	assert.Equal(t, join, read)
+	// the first version does not carry the last accepted state
+	assert.Equal(t, int64(3), previous.Term)
+	assert.Equal(t, int64(0), previous.LastAcceptedVersion)
+}
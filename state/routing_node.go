@@ -10,6 +10,7 @@ func NewRoutingNodes(clusterState ClusterState) *RoutingNodes {
 	var unassignedShards []*ShardRouting
 
 	for id, node := range clusterState.Nodes.DataNodes {
+		node := node
 		nodesToShards[id] = &RoutingNode{
 			NodeId:        id,
 			node:          &node,
@@ -20,12 +21,25 @@ func NewRoutingNodes(clusterState ClusterState) *RoutingNodes {
 
 	for _, indexRoutingTable := range clusterState.RoutingTable.IndicesRouting {
 		for _, shardRoutingTable := range indexRoutingTable.Shards {
-			primary := shardRoutingTable.Primary
-			if primary.CurrentNodeId != "" {
-				node := nodesToShards[primary.CurrentNodeId]
-				node.Add(primary)
-			} else {
-				unassignedShards = append(unassignedShards, &primary)
+			for _, shard := range shardRoutingTable.Copies() {
+				shard := shard
+				if shard.State == ShardRelocating {
+					if _, existing := nodesToShards[shard.RelocatingNodeId]; !existing {
+						// the target left, the copy stays where it is
+						shard = shard.CancelRelocation()
+					}
+				}
+				if node, existing := nodesToShards[shard.CurrentNodeId]; existing {
+					node.Add(shard)
+					if shard.State == ShardRelocating {
+						nodesToShards[shard.RelocatingNodeId].Add(shard.RelocationTarget())
+					}
+				} else {
+					if shard.CurrentNodeId != "" {
+						shard = shard.Unassigned(UnassignedNodeLeft, "node_left ["+shard.CurrentNodeId+"]")
+					}
+					unassignedShards = append(unassignedShards, &shard)
+				}
 			}
 		}
 	}
@@ -43,6 +57,10 @@ type RoutingNode struct {
 	ShardsByIndex map[string]map[ShardRouting]struct{}
 }
 
+func (n *RoutingNode) Node() Node {
+	return *n.node
+}
+
 func (n *RoutingNode) Add(shard ShardRouting) {
 	n.Shards[shard.ShardId] = shard
 	if _, ok := n.ShardsByIndex[shard.ShardId.Index.Name]; !ok {
@@ -51,9 +69,46 @@ func (n *RoutingNode) Add(shard ShardRouting) {
 	n.ShardsByIndex[shard.ShardId.Index.Name][shard] = struct{}{}
 }
 
+func (n *RoutingNode) Remove(shard ShardRouting) {
+	delete(n.Shards, shard.ShardId)
+	delete(n.ShardsByIndex[shard.ShardId.Index.Name], shard)
+}
+
+// Initializing returns the number of copies recovering on the node, relocation targets included.
+func (n *RoutingNode) Initializing() int {
+	count := 0
+	for _, shard := range n.Shards {
+		if shard.State == ShardInitializing {
+			count++
+		}
+	}
+	return count
+}
+
 func (n *RoutingNode) NumShards() int {
 	return len(n.Shards)
 }
 func (n *RoutingNode) NumShardsOfIndex(index string) int {
 	return len(n.ShardsByIndex[index])
 }
+
+// NumRelocatingShards returns the number of copies moving away from the node.
+func (n *RoutingNode) NumRelocatingShards() int {
+	count := 0
+	for _, shard := range n.Shards {
+		if shard.State == ShardRelocating {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *RoutingNode) NumRelocatingShardsOfIndex(index string) int {
+	count := 0
+	for shard := range n.ShardsByIndex[index] {
+		if shard.State == ShardRelocating {
+			count++
+		}
+	}
+	return count
+}
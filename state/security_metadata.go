@@ -0,0 +1,214 @@
+package state
+
+import (
+	"github.com/actumn/searchgoose/common"
+)
+
+// SecurityMetadata is the native user store of the cluster: the users, the roles and the API keys. It is part of
+// the cluster metadata, every node authenticates and authorizes the requests it receives with it.
+type SecurityMetadata struct {
+	Users   map[string]User
+	Roles   map[string]Role
+	ApiKeys map[string]ApiKey
+}
+
+// User is a native user, it is granted the privileges of its roles.
+type User struct {
+	Username string
+	// PasswordHash is the salted hash of the password, the password itself is never stored
+	PasswordHash string
+	Roles        []string
+	FullName     string
+	Email        string
+	Enabled      bool
+}
+
+// Role grants privileges on the cluster and on the indices matching patterns.
+type Role struct {
+	Name    string
+	Cluster []string
+	Indices []IndicesPrivileges
+}
+
+// IndicesPrivileges are the privileges granted on the indices matching one of the Names, e.g. "logs-*".
+type IndicesPrivileges struct {
+	Names      []string
+	Privileges []string
+	// Query limits the documents read to those matching it, a query of the search API as JSON. Empty, every
+	// document is read.
+	Query string
+	// FieldSecurity limits the fields read, nil grants every field
+	FieldSecurity *FieldSecurity
+}
+
+// FieldSecurity grants the fields matching one of the Grant patterns and none of the Except ones, e.g. "user.*".
+type FieldSecurity struct {
+	Grant  []string
+	Except []string
+}
+
+// ApiKey authenticates as the user who created it. Its RoleDescriptors, when set, limit the privileges of the key
+// to those the roles of the user and the descriptors both grant.
+type ApiKey struct {
+	Id   string
+	Name string
+	// KeyHash is the salted hash of the key, the key itself is only returned when it is created
+	KeyHash         string
+	Username        string
+	RoleDescriptors []Role
+	// Creation and Expiration are in milliseconds since the epoch, a zero Expiration never expires
+	Creation    int64
+	Expiration  int64
+	Invalidated bool
+}
+
+// Copy returns a copy of the metadata whose maps can be updated.
+func (m SecurityMetadata) Copy() SecurityMetadata {
+	c := SecurityMetadata{
+		Users:   map[string]User{},
+		Roles:   map[string]Role{},
+		ApiKeys: map[string]ApiKey{},
+	}
+	for k, v := range m.Users {
+		c.Users[k] = v
+	}
+	for k, v := range m.Roles {
+		c.Roles[k] = v
+	}
+	for k, v := range m.ApiKeys {
+		c.ApiKeys[k] = v
+	}
+	return c
+}
+
+func (m *SecurityMetadata) WriteTo(out *common.StreamOutput) {
+	out.WriteVInt(uint64(len(m.Users)))
+	for name, user := range m.Users {
+		out.WriteString(name)
+		user.WriteTo(out)
+	}
+	out.WriteVInt(uint64(len(m.Roles)))
+	for name, role := range m.Roles {
+		out.WriteString(name)
+		role.WriteTo(out)
+	}
+	out.WriteVInt(uint64(len(m.ApiKeys)))
+	for id, apiKey := range m.ApiKeys {
+		out.WriteString(id)
+		apiKey.WriteTo(out)
+	}
+}
+
+func ReadSecurityMetadata(in *common.StreamInput) SecurityMetadata {
+	var m SecurityMetadata
+	if count := in.ReadCount(); count > 0 {
+		m.Users = make(map[string]User, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			m.Users[name] = ReadUser(in)
+		}
+	}
+	if count := in.ReadCount(); count > 0 {
+		m.Roles = make(map[string]Role, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			name := in.ReadString()
+			m.Roles[name] = ReadRole(in)
+		}
+	}
+	if count := in.ReadCount(); count > 0 {
+		m.ApiKeys = make(map[string]ApiKey, count)
+		for i := 0; i < count && in.Err() == nil; i++ {
+			id := in.ReadString()
+			m.ApiKeys[id] = ReadApiKey(in)
+		}
+	}
+	return m
+}
+
+func (u *User) WriteTo(out *common.StreamOutput) {
+	out.WriteString(u.Username)
+	out.WriteString(u.PasswordHash)
+	out.WriteStringSlice(u.Roles)
+	out.WriteString(u.FullName)
+	out.WriteString(u.Email)
+	out.WriteBool(u.Enabled)
+}
+
+func ReadUser(in *common.StreamInput) User {
+	return User{
+		Username:     in.ReadString(),
+		PasswordHash: in.ReadString(),
+		Roles:        in.ReadStringSlice(),
+		FullName:     in.ReadString(),
+		Email:        in.ReadString(),
+		Enabled:      in.ReadBool(),
+	}
+}
+
+func (r *Role) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Name)
+	out.WriteStringSlice(r.Cluster)
+	out.WriteVInt(uint64(len(r.Indices)))
+	for _, indices := range r.Indices {
+		out.WriteStringSlice(indices.Names)
+		out.WriteStringSlice(indices.Privileges)
+		out.WriteString(indices.Query)
+		out.WriteBool(indices.FieldSecurity != nil)
+		if indices.FieldSecurity != nil {
+			out.WriteStringSlice(indices.FieldSecurity.Grant)
+			out.WriteStringSlice(indices.FieldSecurity.Except)
+		}
+	}
+}
+
+func ReadRole(in *common.StreamInput) Role {
+	role := Role{
+		Name:    in.ReadString(),
+		Cluster: in.ReadStringSlice(),
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		indices := IndicesPrivileges{
+			Names:      in.ReadStringSlice(),
+			Privileges: in.ReadStringSlice(),
+			Query:      in.ReadString(),
+		}
+		if in.ReadBool() {
+			indices.FieldSecurity = &FieldSecurity{
+				Grant:  in.ReadStringSlice(),
+				Except: in.ReadStringSlice(),
+			}
+		}
+		role.Indices = append(role.Indices, indices)
+	}
+	return role
+}
+
+func (k *ApiKey) WriteTo(out *common.StreamOutput) {
+	out.WriteString(k.Id)
+	out.WriteString(k.Name)
+	out.WriteString(k.KeyHash)
+	out.WriteString(k.Username)
+	out.WriteVInt(uint64(len(k.RoleDescriptors)))
+	for _, role := range k.RoleDescriptors {
+		role.WriteTo(out)
+	}
+	out.WriteInt64(k.Creation)
+	out.WriteInt64(k.Expiration)
+	out.WriteBool(k.Invalidated)
+}
+
+func ReadApiKey(in *common.StreamInput) ApiKey {
+	apiKey := ApiKey{
+		Id:       in.ReadString(),
+		Name:     in.ReadString(),
+		KeyHash:  in.ReadString(),
+		Username: in.ReadString(),
+	}
+	for i := in.ReadCount(); i > 0 && in.Err() == nil; i-- {
+		apiKey.RoleDescriptors = append(apiKey.RoleDescriptors, ReadRole(in))
+	}
+	apiKey.Creation = in.ReadInt64()
+	apiKey.Expiration = in.ReadInt64()
+	apiKey.Invalidated = in.ReadBool()
+	return apiKey
+}
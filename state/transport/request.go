@@ -0,0 +1,250 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"sync"
+	"time"
+)
+
+// DefaultRequestTimeout is the timeout of the requests sent without options.
+const DefaultRequestTimeout = 60 * time.Second
+
+// RequestOptions are the options of a transport request.
+type RequestOptions struct {
+	// Timeout is how long the response is waited for, DefaultRequestTimeout when zero
+	Timeout time.Duration
+}
+
+func (o RequestOptions) timeout() time.Duration {
+	if o.Timeout <= 0 {
+		return DefaultRequestTimeout
+	}
+	return o.Timeout
+}
+
+// ResponseHandler receives the response of a request, or the error it failed with. Exactly one of them is called.
+type ResponseHandler struct {
+	OnResponse func(response []byte)
+	OnFailure  func(err error)
+}
+
+// PendingRequest calls the handler of a request once, with its response or with its failure, whichever comes first.
+// The request fails with a ReceiveTimeoutError when no response comes within the timeout.
+type PendingRequest struct {
+	handler  ResponseHandler
+	once     sync.Once
+	timer    *time.Timer
+	timerMux sync.Mutex
+}
+
+func NewPendingRequest(address string, action string, options RequestOptions, handler ResponseHandler) *PendingRequest {
+	p := &PendingRequest{handler: handler}
+	timeout := options.timeout()
+	p.timerMux.Lock()
+	defer p.timerMux.Unlock()
+	p.timer = time.AfterFunc(timeout, func() {
+		p.Fail(&ReceiveTimeoutError{Address: address, Action: action, Timeout: timeout})
+	})
+	return p
+}
+
+// Respond calls the response handler, it returns false when the request already completed.
+func (p *PendingRequest) Respond(response []byte) bool {
+	return p.complete(func() {
+		if p.handler.OnResponse != nil {
+			p.handler.OnResponse(response)
+		}
+	})
+}
+
+// Fail calls the failure handler, it returns false when the request already completed.
+func (p *PendingRequest) Fail(err error) bool {
+	return p.complete(func() {
+		if p.handler.OnFailure != nil {
+			p.handler.OnFailure(err)
+		}
+	})
+}
+
+func (p *PendingRequest) complete(callback func()) bool {
+	completed := false
+	p.once.Do(func() {
+		completed = true
+		p.timerMux.Lock()
+		p.timer.Stop()
+		p.timerMux.Unlock()
+		callback()
+	})
+	return completed
+}
+
+// IncompatibleVersionError fails the handshake with a node of a version this node cannot talk to.
+type IncompatibleVersionError struct {
+	Address              string
+	Version              common.Version
+	MinCompatibleVersion common.Version
+}
+
+func (e *IncompatibleVersionError) Error() string {
+	return fmt.Sprintf("[%s] version [%v] is not compatible, the minimum compatible version is [%v]", e.Address, e.Version, e.MinCompatibleVersion)
+}
+
+func (e *IncompatibleVersionError) ErrorType() string {
+	return "illegal_state_exception"
+}
+
+// ReceiveTimeoutError fails a request without response within its timeout.
+type ReceiveTimeoutError struct {
+	Address string
+	Action  string
+	Timeout time.Duration
+}
+
+func (e *ReceiveTimeoutError) Error() string {
+	return fmt.Sprintf("[%s][%s] request timed out after [%v]", e.Address, e.Action, e.Timeout)
+}
+
+func (e *ReceiveTimeoutError) ErrorType() string {
+	return "receive_timeout_transport_exception"
+}
+
+// NodeDisconnectedError fails the pending requests of a lost connection.
+type NodeDisconnectedError struct {
+	Address string
+	Action  string
+}
+
+func (e *NodeDisconnectedError) Error() string {
+	return fmt.Sprintf("[%s][%s] disconnected", e.Address, e.Action)
+}
+
+func (e *NodeDisconnectedError) ErrorType() string {
+	return "node_disconnected_exception"
+}
+
+// NodeNotConnectedError fails a request to a node without connection.
+type NodeNotConnectedError struct {
+	NodeId string
+	Action string
+}
+
+func (e *NodeNotConnectedError) Error() string {
+	return fmt.Sprintf("[%s][%s] node not connected", e.NodeId, e.Action)
+}
+
+func (e *NodeNotConnectedError) ErrorType() string {
+	return "node_not_connected_exception"
+}
+
+// ActionNotFoundError is replied to a request whose action has no handler.
+type ActionNotFoundError struct {
+	Action string
+}
+
+func (e *ActionNotFoundError) Error() string {
+	return fmt.Sprintf("No handler for action [%s]", e.Action)
+}
+
+func (e *ActionNotFoundError) ErrorType() string {
+	return "action_not_found_transport_exception"
+}
+
+// TypedError is an error replied with its type, e.g. "illegal_argument_exception".
+type TypedError interface {
+	error
+	ErrorType() string
+}
+
+// ErrorType returns the type of an error, "exception" when it has none.
+func ErrorType(err error) string {
+	if typed, ok := err.(TypedError); ok {
+		return typed.ErrorType()
+	}
+	return "exception"
+}
+
+// RemoteTransportError is the error a handler replied with on the remote node.
+type RemoteTransportError struct {
+	Address string
+	Action  string
+	Type    string
+	Reason  string
+}
+
+func (e *RemoteTransportError) Error() string {
+	return fmt.Sprintf("[%s][%s] %s: %s", e.Address, e.Action, e.Type, e.Reason)
+}
+
+func (e *RemoteTransportError) ErrorType() string {
+	return e.Type
+}
+
+// ErrorResponse is an error sent back to the node of a request.
+type ErrorResponse struct {
+	Type   string
+	Reason string
+}
+
+func NewErrorResponse(err error) *ErrorResponse {
+	return &ErrorResponse{
+		Type:   ErrorType(err),
+		Reason: err.Error(),
+	}
+}
+
+func (r *ErrorResponse) WriteTo(out *common.StreamOutput) {
+	out.WriteString(r.Type)
+	out.WriteString(r.Reason)
+}
+
+func ReadErrorResponse(in *common.StreamInput) *ErrorResponse {
+	response := &ErrorResponse{
+		Type:   in.ReadString(),
+		Reason: in.ReadString(),
+	}
+	if err := in.Err(); err != nil {
+		return &ErrorResponse{Type: "exception", Reason: "failed to read the error response: " + err.Error()}
+	}
+	return response
+}
+
+// Err returns the error replied by the handler of a request to address.
+func (r *ErrorResponse) Err(address string, action string) error {
+	return &RemoteTransportError{
+		Address: address,
+		Action:  action,
+		Type:    r.Type,
+		Reason:  r.Reason,
+	}
+}
+
+// RetryPolicy sends a request again when it fails without reaching the remote handler, e.g. on a timeout or a
+// lost connection. The errors replied by the handler are not retried.
+type RetryPolicy struct {
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled for every next one up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// IsRetryable tells whether a failed request may be sent again.
+func IsRetryable(err error) bool {
+	switch err.(type) {
+	case *ReceiveTimeoutError, *NodeDisconnectedError, *NodeNotConnectedError:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.Backoff
+	for i := 0; i < retry; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
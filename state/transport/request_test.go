@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"errors"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// failingConnection fails the requests with the errors in turn, then replies with the request.
+type failingConnection struct {
+	errs []error
+	sent int
+}
+
+func (c *failingConnection) SendRequest(action string, req []byte, options RequestOptions, handler ResponseHandler) {
+	c.sent++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		handler.OnFailure(err)
+		return
+	}
+	handler.OnResponse(req)
+}
+func (c *failingConnection) GetSourceAddress() string   { return "" }
+func (c *failingConnection) GetDestAddress() string     { return "remote:8180" }
+func (c *failingConnection) GetMessage() string         { return "" }
+func (c *failingConnection) GetVersion() common.Version { return common.CurrentVersion }
+
+func TestService_SendRequestWithRetries(t *testing.T) {
+	// Arrange
+	timeout := &ReceiveTimeoutError{Address: "remote:8180", Action: "test", Timeout: time.Second}
+	remote := state.Node{Id: "remoteId", HostAddress: "remote:8180"}
+	policy := RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond}
+	send := func(errs ...error) (*failingConnection, string, error) {
+		s := &Service{
+			LocalNode:         &state.Node{Id: "localId"},
+			ConnectionManager: map[string]ConnectionEntry{},
+		}
+		conn := &failingConnection{errs: errs}
+		s.SetConnection(remote.Id, ConnectionEntry{conn: conn, node: remote})
+		responses := make(chan string, 1)
+		failures := make(chan error, 1)
+		s.SendRequestWithRetries(remote, "test", []byte("request"), RequestOptions{}, policy, ResponseHandler{
+			OnResponse: func(response []byte) {
+				responses <- string(response)
+			},
+			OnFailure: func(err error) {
+				failures <- err
+			},
+		})
+		select {
+		case response := <-responses:
+			return conn, response, nil
+		case err := <-failures:
+			return conn, "", err
+		}
+	}
+
+	// Action
+	retried, retriedResponse, _ := send(timeout, timeout)
+	exhausted, _, exhaustedErr := send(timeout, timeout, timeout)
+	remoteErr := &RemoteTransportError{Address: "remote:8180", Action: "test", Type: "exception", Reason: "failed"}
+	notRetried, _, notRetriedErr := send(remoteErr)
+
+	// Assert
+	assert.Equal(t, 3, retried.sent)
+	assert.Equal(t, "request", retriedResponse)
+	assert.Equal(t, 3, exhausted.sent)
+	assert.Equal(t, timeout, exhaustedErr)
+	assert.Equal(t, 1, notRetried.sent)
+	assert.Equal(t, remoteErr, notRetriedErr)
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	// Arrange
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+
+	// Action
+	var backoffs []time.Duration
+	for retry := 0; retry < 4; retry++ {
+		backoffs = append(backoffs, policy.backoff(retry))
+	}
+
+	// Assert
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}, backoffs)
+	assert.False(t, IsRetryable(errors.New("failed")))
+}
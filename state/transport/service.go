@@ -1,11 +1,13 @@
 package transport
 
 import (
-	"bytes"
-	"encoding/gob"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state"
 	"github.com/sirupsen/logrus"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 const (
@@ -22,22 +24,36 @@ const (
 	START_JOIN_ACK  = "START_JOIN_ACK"
 	START_JOIN_FAIL = "START_JOIN_FAIL"
 	JOIN_REQ        = "JOIN_REQ"
+	JOIN_ACK        = "JOIN_ACK"
 	PUBLISH_REQ     = "PUBLISH_REQ"
 	PUBLISH_ACK     = "PUBLISH_ACK"
+	COMMIT_REQ      = "COMMIT_REQ"
+	COMMIT_ACK      = "COMMIT_ACK"
+
+	FOLLOWER_CHECK_REQ = "FOLLOWER_CHECK_REQ"
+	FOLLOWER_CHECK_ACK = "FOLLOWER_CHECK_ACK"
+	LEADER_CHECK_REQ   = "LEADER_CHECK_REQ"
+	LEADER_CHECK_ACK   = "LEADER_CHECK_ACK"
 )
 
 // Interfaces
 type Connection interface {
-	SendRequest(action string, req []byte, callback func(byte []byte))
+	SendRequest(action string, req []byte, options RequestOptions, handler ResponseHandler)
 	GetSourceAddress() string
 	GetDestAddress() string
 	GetMessage() string
+	// GetVersion is the protocol version the requests are written with
+	GetVersion() common.Version
 }
 
 type ReplyChannel interface {
 	SendMessage(action string, content []byte) (n int, err error)
+	// SendError replies the error to the node of the request, which fails with a RemoteTransportError
+	SendError(err error) error
 	GetSourceAddress() string
 	GetDestAddress() string
+	// GetVersion is the protocol version of the request, its response is written with the same version
+	GetVersion() common.Version
 }
 
 type Transport interface {
@@ -48,11 +64,104 @@ type Transport interface {
 	GetSeedHosts() []string
 	GetNodeId() string
 	GetHandler(action string) RequestHandler
+	Stats() Stats
+}
+
+// Stats are the counters of the transport, the totals include the connections closed since it started.
+type Stats struct {
+	ServerOpen  int
+	ClientOpen  int
+	RxCount     int64
+	RxSize      int64
+	TxCount     int64
+	TxSize      int64
+	Connections []ConnectionStats
+}
+
+// ConnectionStats are the counters of an open connection.
+type ConnectionStats struct {
+	LocalAddress  string
+	RemoteAddress string
+	// Inbound tells whether the connection was opened by the remote node
+	Inbound bool
+	// Version is the protocol version negotiated in the handshake
+	Version         common.Version
+	RxCount         int64
+	RxSize          int64
+	TxCount         int64
+	TxSize          int64
+	PendingRequests int
+	QueuedMessages  int
+}
+
+func (s *Stats) WriteTo(out *common.StreamOutput) {
+	out.WriteInt(s.ServerOpen)
+	out.WriteInt(s.ClientOpen)
+	out.WriteInt64(s.RxCount)
+	out.WriteInt64(s.RxSize)
+	out.WriteInt64(s.TxCount)
+	out.WriteInt64(s.TxSize)
+	out.WriteVInt(uint64(len(s.Connections)))
+	for _, conn := range s.Connections {
+		out.WriteString(conn.LocalAddress)
+		out.WriteString(conn.RemoteAddress)
+		out.WriteBool(conn.Inbound)
+		out.WriteInt32(int32(conn.Version))
+		out.WriteInt64(conn.RxCount)
+		out.WriteInt64(conn.RxSize)
+		out.WriteInt64(conn.TxCount)
+		out.WriteInt64(conn.TxSize)
+		out.WriteInt(conn.PendingRequests)
+		out.WriteInt(conn.QueuedMessages)
+	}
+}
+
+func ReadStats(in *common.StreamInput) Stats {
+	stats := Stats{
+		ServerOpen: in.ReadInt(),
+		ClientOpen: in.ReadInt(),
+		RxCount:    in.ReadInt64(),
+		RxSize:     in.ReadInt64(),
+		TxCount:    in.ReadInt64(),
+		TxSize:     in.ReadInt64(),
+	}
+	count := in.ReadCount()
+	for i := 0; i < count && in.Err() == nil; i++ {
+		stats.Connections = append(stats.Connections, ConnectionStats{
+			LocalAddress:    in.ReadString(),
+			RemoteAddress:   in.ReadString(),
+			Inbound:         in.ReadBool(),
+			Version:         common.Version(in.ReadInt32()),
+			RxCount:         in.ReadInt64(),
+			RxSize:          in.ReadInt64(),
+			TxCount:         in.ReadInt64(),
+			TxSize:          in.ReadInt64(),
+			PendingRequests: in.ReadInt(),
+			QueuedMessages:  in.ReadInt(),
+		})
+	}
+	return stats
 }
 
 // structures
 type RequestHandler func(channel ReplyChannel, req []byte)
 
+// HandleRequest runs the handler of a received request, the request fails when there is none or it panics.
+func HandleRequest(handler RequestHandler, action string, channel ReplyChannel, req []byte) {
+	if handler == nil {
+		logrus.Warnf("No handler for action [%s] requested by %s", action, channel.GetDestAddress())
+		channel.SendError(&ActionNotFoundError{Action: action})
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Failed to handle [%s]: %v\n%s", action, r, debug.Stack())
+			channel.SendError(fmt.Errorf("%v", r))
+		}
+	}()
+	handler(channel, req)
+}
+
 type ConnectionEntry struct {
 	conn Connection
 	node state.Node
@@ -83,31 +192,103 @@ func (s *Service) Start(port int) {
 	s.Transport.Start(port)
 }
 
+// SendRequestConn sends a request with the default timeout, a failure is logged without calling the callback.
 func (s *Service) SendRequestConn(conn Connection, action string, req []byte, callback func(response []byte)) {
-	conn.SendRequest(action, req, callback)
+	conn.SendRequest(action, req, RequestOptions{}, callbackHandler(conn.GetDestAddress(), action, callback))
 }
 
+// SendRequest sends a request with the default timeout, a failure is logged without calling the callback.
 func (s *Service) SendRequest(node state.Node, action string, req []byte, callback func(response []byte)) {
+	s.SendRequestWithHandler(node, action, req, RequestOptions{}, callbackHandler(node.HostAddress, action, callback))
+}
+
+func callbackHandler(address string, action string, callback func(response []byte)) ResponseHandler {
+	return ResponseHandler{
+		OnResponse: callback,
+		OnFailure: func(err error) {
+			logrus.Warnf("Failed to send %s to %s; err: %v", action, address, err)
+		},
+	}
+}
+
+// SendRequestWithHandler sends a request to a connected node, the handler receives its response or its failure.
+func (s *Service) SendRequestWithHandler(node state.Node, action string, req []byte, options RequestOptions, handler ResponseHandler) {
 	var conn Connection
 	if node.Id == s.LocalNode.Id {
 		conn = &LocalConnection{
 			service: s,
 		}
+	} else if entry, existing := s.GetConnection(node.Id); existing {
+		conn = entry.conn
+		onFailure := handler.OnFailure
+		handler.OnFailure = func(err error) {
+			// the node is connected again by the next request
+			if _, disconnected := err.(*NodeDisconnectedError); disconnected {
+				s.removeConnection(node.Id, entry.conn)
+			}
+			if onFailure != nil {
+				onFailure(err)
+			}
+		}
 	} else {
-		conn = s.ConnectionManager[node.Id].conn
+		if handler.OnFailure != nil {
+			handler.OnFailure(&NodeNotConnectedError{NodeId: node.Id, Action: action})
+		}
+		return
 	}
 
-	s.SendRequestConn(conn, action, req, callback)
+	conn.SendRequest(action, req, options, handler)
+}
+
+// SendRequestWithRetries sends a request again, after the backoff of the policy, while it fails with a retryable error.
+func (s *Service) SendRequestWithRetries(node state.Node, action string, req []byte, options RequestOptions, policy RetryPolicy, handler ResponseHandler) {
+	var send func(retry int)
+	send = func(retry int) {
+		s.SendRequestWithHandler(node, action, req, options, ResponseHandler{
+			OnResponse: handler.OnResponse,
+			OnFailure: func(err error) {
+				if retry >= policy.MaxRetries || !IsRetryable(err) {
+					if handler.OnFailure != nil {
+						handler.OnFailure(err)
+					}
+					return
+				}
+				backoff := policy.backoff(retry)
+				logrus.Warnf("Failed to send %s to %s, retrying in %v; err: %v", action, node.HostAddress, backoff, err)
+				time.AfterFunc(backoff, func() {
+					send(retry + 1)
+				})
+			},
+		})
+	}
+	send(0)
+}
+
+// GetVersion returns the protocol version of the messages to a node, the version negotiated with it in the
+// handshake.
+func (s *Service) GetVersion(node state.Node) common.Version {
+	if node.Id == s.LocalNode.Id {
+		return common.CurrentVersion
+	}
+	if entry, existing := s.GetConnection(node.Id); existing {
+		return entry.conn.GetVersion()
+	}
+	return common.MinCompatibleVersion
+}
+
+func (s *Service) Stats() Stats {
+	return s.Transport.Stats()
 }
 
 func (s *Service) RegisterRequestHandler(action string, handler RequestHandler) {
 	s.Transport.Register(action, handler)
 }
 
-func (s *Service) GetConnection(id string) ConnectionEntry {
+func (s *Service) GetConnection(id string) (ConnectionEntry, bool) {
 	s.ConnectionLock.RLock()
-	defer s.ConnectionLock.Unlock()
-	return s.ConnectionManager[id]
+	defer s.ConnectionLock.RUnlock()
+	entry, existing := s.ConnectionManager[id]
+	return entry, existing
 }
 
 func (s *Service) SetConnection(key string, conn ConnectionEntry) {
@@ -116,6 +297,22 @@ func (s *Service) SetConnection(key string, conn ConnectionEntry) {
 	s.ConnectionLock.Unlock()
 }
 
+// DisconnectFromNode forgets the connection to a node that left the cluster.
+func (s *Service) DisconnectFromNode(id string) {
+	s.ConnectionLock.Lock()
+	delete(s.ConnectionManager, id)
+	s.ConnectionLock.Unlock()
+}
+
+// removeConnection forgets a lost connection, unless the node is connected again already.
+func (s *Service) removeConnection(id string, conn Connection) {
+	s.ConnectionLock.Lock()
+	defer s.ConnectionLock.Unlock()
+	if entry, existing := s.ConnectionManager[id]; existing && entry.conn == conn {
+		delete(s.ConnectionManager, id)
+	}
+}
+
 func (s *Service) GetConnectedPeers() ([]string, []state.Node) {
 	ids := make([]string, 0, len(s.ConnectionManager))
 	values := make([]state.Node, 0, len(s.ConnectionManager))
@@ -151,10 +348,15 @@ func (s *Service) ConnectToRemoteNode(address string, callback func(node *state.
 		handshakeData := HandshakeRequest{
 			RemoteAddress: address,
 		}
-		content := handshakeData.ToBytes()
+		content := common.ToBytes(&handshakeData, common.MinCompatibleVersion)
 
 		s.SendRequestConn(conn, HANDSHAKE_REQ, content, func(res []byte) {
-			data := HandshakeResponseFromBytes(res)
+			data, err := ReadHandshakeResponse(common.NewStreamInput(res, common.MinCompatibleVersion))
+			if err != nil {
+				logrus.Warnf("Failed to read the handshake of %s; err: %v", address, err)
+				callback(nil)
+				return
+			}
 			logrus.Infof("Success on handshaking with %v\n", data.Node)
 
 			connectedNode := data.Node
@@ -194,34 +396,30 @@ func (s *Service) handleHandshake(channel ReplyChannel, req []byte) {
 		// clusterName:
 	}
 
-	response := handShakeData.ToBytes()
-	channel.SendMessage(HANDSHAKE_ACK, response)
+	channel.SendMessage(HANDSHAKE_ACK, common.ToBytes(&handShakeData, common.MinCompatibleVersion))
 }
 
 // Templates
 
 // Handshake
+// The handshake messages are read before the version of a connection is known, they are written with the minimum
+// compatible version.
 type HandshakeRequest struct {
 	RemoteAddress string
 }
 
-func (h *HandshakeRequest) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(h); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
+func (h *HandshakeRequest) WriteTo(out *common.StreamOutput) {
+	out.WriteString(h.RemoteAddress)
 }
 
-func HandshakeRequestFromBytes(b []byte) *HandshakeRequest {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data HandshakeRequest
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadHandshakeRequest(in *common.StreamInput) (*HandshakeRequest, error) {
+	data := HandshakeRequest{
+		RemoteAddress: in.ReadString(),
+	}
+	if err := in.Err(); err != nil {
+		return nil, err
 	}
-	return &data
+	return &data, nil
 }
 
 type HandshakeResponse struct {
@@ -229,37 +427,33 @@ type HandshakeResponse struct {
 	// ClusterName string
 }
 
-func (h *HandshakeResponse) ToBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(h); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
+func (h *HandshakeResponse) WriteTo(out *common.StreamOutput) {
+	h.Node.WriteTo(out)
 }
 
-func HandshakeResponseFromBytes(b []byte) *HandshakeResponse {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data HandshakeResponse
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func ReadHandshakeResponse(in *common.StreamInput) (*HandshakeResponse, error) {
+	data := HandshakeResponse{
+		Node: state.ReadNode(in),
+	}
+	if err := in.Err(); err != nil {
+		return nil, err
 	}
-	return &data
+	return &data, nil
 }
 
 type LocalConnection struct {
 	service *Service
 }
 
-func (c *LocalConnection) SendRequest(action string, req []byte, callback func(response []byte)) {
-	handler := c.service.Transport.GetHandler(action)
+func (c *LocalConnection) SendRequest(action string, req []byte, options RequestOptions, handler ResponseHandler) {
+	address := c.service.LocalNode.HostAddress
 	replyChannel := &DirectReplyChannel{
-		callback: callback,
-		address:  c.service.LocalNode.HostAddress,
+		pending: NewPendingRequest(address, action, options, handler),
+		address: address,
+		action:  action,
 	}
 
-	handler(replyChannel, req)
+	HandleRequest(c.service.Transport.GetHandler(action), action, replyChannel, req)
 }
 
 func (c *LocalConnection) GetDestAddress() string {
@@ -274,16 +468,26 @@ func (c *LocalConnection) GetMessage() string {
 	return ""
 }
 
+func (c *LocalConnection) GetVersion() common.Version {
+	return common.CurrentVersion
+}
+
 type DirectReplyChannel struct {
-	address  string
-	callback func(byte []byte)
+	address string
+	action  string
+	pending *PendingRequest
 }
 
 func (c *DirectReplyChannel) SendMessage(action string, b []byte) (int, error) {
-	c.callback(b)
+	c.pending.Respond(b)
 	return 0, nil
 }
 
+func (c *DirectReplyChannel) SendError(err error) error {
+	c.pending.Fail(NewErrorResponse(err).Err(c.address, c.action))
+	return nil
+}
+
 func (c *DirectReplyChannel) GetDestAddress() string {
 	return c.address
 }
@@ -291,3 +495,7 @@ func (c *DirectReplyChannel) GetDestAddress() string {
 func (c *DirectReplyChannel) GetSourceAddress() string {
 	return c.address
 }
+
+func (c *DirectReplyChannel) GetVersion() common.Version {
+	return common.CurrentVersion
+}
@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReadHandshakeResponse(t *testing.T) {
+	// Arrange
+	response := HandshakeResponse{
+		Node: state.Node{
+			Name:        "node1",
+			Id:          "nodeId1",
+			HostAddress: "127.0.0.1:8180",
+			Attributes:  map[string]string{"rack": "r1"},
+			Roles:       []string{"master", "data"},
+		},
+	}
+	written := common.ToBytes(&response, common.MinCompatibleVersion)
+
+	// Action
+	read, err := ReadHandshakeResponse(common.NewStreamInput(written, common.MinCompatibleVersion))
+	_, truncatedErr := ReadHandshakeResponse(common.NewStreamInput(written[:len(written)-1], common.MinCompatibleVersion))
+
+	// Assert
+	assert.Nil(t, err)
+	assert.Equal(t, response, *read)
+	assert.NotNil(t, truncatedErr)
+}
@@ -0,0 +1,391 @@
+package tcp
+
+import (
+	"errors"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sendQueueSize is how many messages wait to be written on a connection, the senders block beyond
+	sendQueueSize = 1024
+
+	handshakeAction  = "internal:tcp/handshake"
+	handshakeTimeout = 30 * time.Second
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+// Connection multiplexes the requests and the responses of both nodes on a TCP connection. A single loop reads
+// the messages, it completes the pending request of a response by its id and runs the handlers of both on
+// goroutines of their own. A single loop writes the messages the senders queue.
+// The node opening the connection sends a handshake first, both nodes then write with the lowest of their versions.
+type Connection struct {
+	transport    *Transport
+	conn         net.Conn
+	localAddress string
+	destAddress  string
+	inbound      bool
+	err          string
+	// version is the negotiated protocol version, the minimum compatible one until the handshake completes
+	version int32
+
+	pendingRequests map[uint64]*pendingRequest
+	// isClosed is set under pendingMux, no request is added once the pending ones failed
+	isClosed   bool
+	pendingMux sync.Mutex
+
+	sendQueue chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	rxCount int64
+	rxSize  int64
+	txCount int64
+	txSize  int64
+}
+
+type pendingRequest struct {
+	action  string
+	request *transport.PendingRequest
+}
+
+func newConnection(t *Transport, conn net.Conn, destAddress string, inbound bool) *Connection {
+	return &Connection{
+		transport:       t,
+		conn:            conn,
+		localAddress:    t.LocalAddress,
+		destAddress:     destAddress,
+		inbound:         inbound,
+		version:         int32(t.minCompatibleVersion),
+		pendingRequests: map[uint64]*pendingRequest{},
+		sendQueue:       make(chan []byte, sendQueueSize),
+		closed:          make(chan struct{}),
+	}
+}
+
+func (c *Connection) start() {
+	c.transport.addConnection(c)
+	go c.readLoop()
+	go c.writeLoop()
+}
+
+func (c *Connection) GetVersion() common.Version {
+	return common.Version(atomic.LoadInt32(&c.version))
+}
+
+func (c *Connection) SendRequest(action string, content []byte, options transport.RequestOptions, handler transport.ResponseHandler) {
+	c.sendRequest(action, content, false, options, handler)
+}
+
+func (c *Connection) sendRequest(action string, content []byte, handshake bool, options transport.RequestOptions, handler transport.ResponseHandler) {
+	id := atomic.AddUint64(&requestIdGenerator, 1)
+	pending := &pendingRequest{
+		action: action,
+		request: transport.NewPendingRequest(c.destAddress, action, options, transport.ResponseHandler{
+			OnResponse: handler.OnResponse,
+			OnFailure: func(err error) {
+				c.removePendingRequest(id)
+				if handler.OnFailure != nil {
+					handler.OnFailure(err)
+				}
+			},
+		}),
+	}
+	if c.conn == nil {
+		pending.request.Fail(&transport.NodeDisconnectedError{Address: c.destAddress, Action: action})
+		return
+	}
+	c.pendingMux.Lock()
+	if c.isClosed {
+		c.pendingMux.Unlock()
+		pending.request.Fail(&transport.NodeDisconnectedError{Address: c.destAddress, Action: action})
+		return
+	}
+	c.pendingRequests[id] = pending
+	c.pendingMux.Unlock()
+
+	logrus.Infof("Send %s to %s\n", action, c.destAddress)
+	version := c.GetVersion()
+	if handshake {
+		// the remote node reads a handshake whatever version it speaks
+		version = c.transport.minCompatibleVersion
+	}
+	// the pending request fails once the connection is closed
+	c.enqueue(&DataFormat{
+		Id:        id,
+		Version:   version,
+		Source:    c.GetSourceAddress(),
+		Action:    action,
+		Handshake: handshake,
+		Content:   content,
+	})
+}
+
+// handshake sends the version of the node and negotiates the version of the connection.
+func (c *Connection) handshake() error {
+	out := common.NewStreamOutput(c.transport.minCompatibleVersion)
+	out.WriteInt32(int32(c.transport.version))
+	result := make(chan error, 1)
+	c.sendRequest(handshakeAction, out.Bytes(), true, transport.RequestOptions{Timeout: handshakeTimeout}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			in := common.NewStreamInput(response, c.transport.minCompatibleVersion)
+			remoteVersion := common.Version(in.ReadInt32())
+			if err := in.Err(); err != nil {
+				result <- err
+				return
+			}
+			if remoteVersion < c.transport.minCompatibleVersion {
+				result <- &transport.IncompatibleVersionError{Address: c.destAddress, Version: remoteVersion, MinCompatibleVersion: c.transport.minCompatibleVersion}
+				return
+			}
+			c.setVersion(common.MinVersion(remoteVersion, c.transport.version))
+			result <- nil
+		},
+		OnFailure: func(err error) {
+			result <- err
+		},
+	})
+	return <-result
+}
+
+func (c *Connection) handleHandshake(request *DataFormat) {
+	channel := &ReplyChannel{
+		requestId:   request.Id,
+		connection:  c,
+		destAddress: request.Source,
+		version:     request.Version,
+		handshake:   true,
+	}
+	in := common.NewStreamInput(request.Content, request.Version)
+	remoteVersion := common.Version(in.ReadInt32())
+	if err := in.Err(); err != nil {
+		channel.SendError(err)
+		return
+	}
+	if remoteVersion < c.transport.minCompatibleVersion {
+		logrus.Warnf("Rejecting the handshake of %s of version [%v]", c.destAddress, remoteVersion)
+		channel.SendError(&transport.IncompatibleVersionError{Address: c.transport.LocalAddress, Version: remoteVersion, MinCompatibleVersion: c.transport.minCompatibleVersion})
+		return
+	}
+	c.setVersion(common.MinVersion(remoteVersion, c.transport.version))
+	out := common.NewStreamOutput(request.Version)
+	out.WriteInt32(int32(c.transport.version))
+	channel.SendMessage(handshakeAction, out.Bytes())
+}
+
+func (c *Connection) setVersion(version common.Version) {
+	atomic.StoreInt32(&c.version, int32(version))
+}
+
+// enqueue queues a message to write, it blocks while the send queue is full.
+func (c *Connection) enqueue(message *DataFormat) error {
+	select {
+	case <-c.closed:
+		return errConnectionClosed
+	default:
+	}
+	select {
+	case c.sendQueue <- message.toBytes():
+		return nil
+	case <-c.closed:
+		return errConnectionClosed
+	}
+}
+
+func (c *Connection) writeLoop() {
+	for {
+		select {
+		case frame := <-c.sendQueue:
+			if _, err := c.conn.Write(frame); err != nil {
+				logrus.Errorf("Fail to send to %s; err: %v", c.destAddress, err)
+				c.close()
+				return
+			}
+			atomic.AddInt64(&c.txCount, 1)
+			atomic.AddInt64(&c.txSize, int64(len(frame)))
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Connection) readLoop() {
+	for {
+		message, err := c.readMessage()
+		if err != nil {
+			if err == io.EOF {
+				logrus.Warnf("Connection is closed by %s", c.destAddress)
+			} else {
+				logrus.Errorf("Fail to receive from %s; err: %v", c.destAddress, err)
+			}
+			c.close()
+			return
+		}
+		if message.Response {
+			c.handleResponse(message)
+		} else if message.Handshake {
+			c.handleHandshake(message)
+		} else {
+			go c.handleRequest(message)
+		}
+	}
+}
+
+func (c *Connection) readMessage() (*DataFormat, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	msgLength, err := readFrameLength(header)
+	if err != nil {
+		return nil, err
+	}
+	recvBuf := make([]byte, msgLength)
+	if _, err := io.ReadFull(c.conn, recvBuf); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&c.rxCount, 1)
+	atomic.AddInt64(&c.rxSize, int64(frameHeaderSize+msgLength))
+	return dataFormatFromBytes(recvBuf, c.transport.minCompatibleVersion, c.transport.version)
+}
+
+func (c *Connection) handleResponse(response *DataFormat) {
+	logrus.Infof("Receive %s from %s\n", response.Action, response.Source)
+	pending := c.removePendingRequest(response.Id)
+	if pending == nil {
+		logrus.Warnf("Received response for a request that has timed out, sent to %s, id [%d]", c.destAddress, response.Id)
+		return
+	}
+	// the handlers run off the read loop, one waiting on another response of the connection would stall it
+	if response.Error {
+		errorResponse := transport.ReadErrorResponse(common.NewStreamInput(response.Content, response.Version))
+		go pending.request.Fail(errorResponse.Err(c.destAddress, pending.action))
+		return
+	}
+	go pending.request.Respond(response.Content)
+}
+
+func (c *Connection) handleRequest(request *DataFormat) {
+	transport.HandleRequest(c.transport.GetHandler(request.Action), request.Action, &ReplyChannel{
+		requestId:   request.Id,
+		connection:  c,
+		destAddress: request.Source,
+		version:     request.Version,
+	}, request.Content)
+}
+
+func (c *Connection) removePendingRequest(id uint64) *pendingRequest {
+	c.pendingMux.Lock()
+	defer c.pendingMux.Unlock()
+	pending := c.pendingRequests[id]
+	delete(c.pendingRequests, id)
+	return pending
+}
+
+// close closes a lost connection and fails its pending requests.
+func (c *Connection) close() {
+	c.closeOnce.Do(func() {
+		c.pendingMux.Lock()
+		c.isClosed = true
+		pendingRequests := c.pendingRequests
+		c.pendingRequests = map[uint64]*pendingRequest{}
+		c.pendingMux.Unlock()
+
+		logrus.Warnf("Connection to %s is closed, failing %d pending requests", c.destAddress, len(pendingRequests))
+		close(c.closed)
+		c.conn.Close()
+		c.transport.removeConnection(c)
+		for _, pending := range pendingRequests {
+			pending.request.Fail(&transport.NodeDisconnectedError{Address: c.destAddress, Action: pending.action})
+		}
+	})
+}
+
+func (c *Connection) Stats() transport.ConnectionStats {
+	c.pendingMux.Lock()
+	pendingRequests := len(c.pendingRequests)
+	c.pendingMux.Unlock()
+	return transport.ConnectionStats{
+		LocalAddress:    c.localAddress,
+		RemoteAddress:   c.destAddress,
+		Inbound:         c.inbound,
+		Version:         c.GetVersion(),
+		RxCount:         atomic.LoadInt64(&c.rxCount),
+		RxSize:          atomic.LoadInt64(&c.rxSize),
+		TxCount:         atomic.LoadInt64(&c.txCount),
+		TxSize:          atomic.LoadInt64(&c.txSize),
+		PendingRequests: pendingRequests,
+		QueuedMessages:  len(c.sendQueue),
+	}
+}
+
+func (c *Connection) GetSourceAddress() string {
+	return c.localAddress
+}
+
+func (c *Connection) GetDestAddress() string {
+	return c.destAddress
+}
+
+func (c *Connection) GetMessage() string {
+	return c.err
+}
+
+// ReplyChannel replies to a request with the version of the request.
+type ReplyChannel struct {
+	requestId   uint64
+	connection  *Connection
+	destAddress string
+	version     common.Version
+	handshake   bool
+}
+
+func (c *ReplyChannel) SendMessage(action string, content []byte) (n int, err error) {
+	logrus.Infof("Send %s Reply to %s\n", action, c.GetDestAddress())
+	if err := c.connection.enqueue(&DataFormat{
+		Id:        c.requestId,
+		Version:   c.version,
+		Source:    c.GetSourceAddress(),
+		Action:    action,
+		Response:  true,
+		Handshake: c.handshake,
+		Content:   content,
+	}); err != nil {
+		return 0, err
+	}
+	return len(content), nil
+}
+
+func (c *ReplyChannel) SendError(err error) error {
+	logrus.Infof("Send error reply to %s; err: %v", c.GetDestAddress(), err)
+	out := common.NewStreamOutput(c.version)
+	transport.NewErrorResponse(err).WriteTo(out)
+	return c.connection.enqueue(&DataFormat{
+		Id:        c.requestId,
+		Version:   c.version,
+		Source:    c.GetSourceAddress(),
+		Response:  true,
+		Error:     true,
+		Handshake: c.handshake,
+		Content:   out.Bytes(),
+	})
+}
+
+func (c *ReplyChannel) GetSourceAddress() string {
+	return c.connection.localAddress
+}
+
+func (c *ReplyChannel) GetDestAddress() string {
+	return c.destAddress
+}
+
+func (c *ReplyChannel) GetVersion() common.Version {
+	return c.version
+}
@@ -0,0 +1,121 @@
+package tcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+)
+
+// A message is written in a frame:
+//
+//	magic        2 bytes  'S' 'G'
+//	length       uint32   the length of the rest of the frame
+//	request id   uint64   the id of the request, a response carries the id of its request
+//	status       byte     the statusResponse, statusError and statusHandshake flags
+//	version      int32    the protocol version the rest of the frame is written with
+//	action       string   the action of the request, the reply action of a response
+//	source       string   the address of the node sending the message
+//	content      bytes    the rest of the frame, the request or the response
+//
+// The integers are big endian, a string is prefixed by its length as a variable length integer. The fields up to
+// the version never change, those after it may change in a later version. The handshake messages keep the
+// fields of the first version, a node reads them whatever version it speaks.
+const (
+	frameHeaderSize = 6
+	// maxMessageSize bounds the length read from the wire, a larger one means the stream is corrupted
+	maxMessageSize = 1 << 30
+
+	statusResponse  byte = 1 << 0
+	statusError     byte = 1 << 1
+	statusHandshake byte = 1 << 2
+)
+
+var frameMagic = []byte{'S', 'G'}
+
+// DataFormat is a message sent on a connection.
+type DataFormat struct {
+	Id      uint64
+	Version common.Version
+	Source  string
+	Action  string
+	// Response tells a response from a request, both are sent on the same connection
+	Response bool
+	// Error is set on the response of a failed request, its content is a transport.ErrorResponse
+	Error bool
+	// Handshake is set on the messages negotiating the version of a connection
+	Handshake bool
+	Content   []byte
+}
+
+func (d *DataFormat) status() byte {
+	var status byte
+	if d.Response {
+		status |= statusResponse
+	}
+	if d.Error {
+		status |= statusError
+	}
+	if d.Handshake {
+		status |= statusHandshake
+	}
+	return status
+}
+
+// toBytes returns the frame of the message.
+func (d *DataFormat) toBytes() []byte {
+	out := common.NewStreamOutput(d.Version)
+	out.WriteInt64(int64(d.Id))
+	out.WriteUint8(d.status())
+	out.WriteInt32(int32(d.Version))
+	out.WriteString(d.Action)
+	out.WriteString(d.Source)
+	body := append(out.Bytes(), d.Content...)
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(body))
+	copy(frame, frameMagic)
+	binary.BigEndian.PutUint32(frame[2:], uint32(len(body)))
+	return append(frame, body...)
+}
+
+// readFrameLength reads the header of a frame and returns the length of the rest of it.
+func readFrameLength(header []byte) (int, error) {
+	if !bytes.Equal(header[:2], frameMagic) {
+		return 0, fmt.Errorf("invalid transport message format, got magic bytes %q", header[:2])
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > maxMessageSize {
+		return 0, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", length, maxMessageSize)
+	}
+	return int(length), nil
+}
+
+// dataFormatFromBytes reads the message of a frame, it fails when the message is written with a version out of
+// minVersion and maxVersion, the handshake messages aside.
+func dataFormatFromBytes(b []byte, minVersion common.Version, maxVersion common.Version) (*DataFormat, error) {
+	in := common.NewStreamInput(b, common.MinCompatibleVersion)
+	data := DataFormat{
+		Id: uint64(in.ReadInt64()),
+	}
+	status := in.ReadUint8()
+	data.Response = status&statusResponse != 0
+	data.Error = status&statusError != 0
+	data.Handshake = status&statusHandshake != 0
+	data.Version = common.Version(in.ReadInt32())
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	if !data.Handshake && (data.Version < minVersion || data.Version > maxVersion) {
+		return nil, fmt.Errorf("received a message of version [%v], the supported versions are [%v] to [%v]", data.Version, minVersion, maxVersion)
+	}
+	if !data.Handshake {
+		in.Version = data.Version
+	}
+	data.Action = in.ReadString()
+	data.Source = in.ReadString()
+	if err := in.Err(); err != nil {
+		return nil, err
+	}
+	data.Content = in.Remaining()
+	return &data, nil
+}
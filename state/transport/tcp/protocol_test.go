@@ -0,0 +1,42 @@
+package tcp
+
+import (
+	"github.com/actumn/searchgoose/common"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDataFormat_toBytes(t *testing.T) {
+	// Arrange
+	message := DataFormat{
+		Id:       42,
+		Version:  common.V_1,
+		Source:   "127.0.0.1:8180",
+		Action:   "JOIN_ACK",
+		Response: true,
+		Error:    true,
+		Content:  []byte("content"),
+	}
+	newer := message
+	newer.Version = common.V_1 + 1
+	newerHandshake := newer
+	newerHandshake.Handshake = true
+
+	// Action
+	frame := message.toBytes()
+	length, lengthErr := readFrameLength(frame[:frameHeaderSize])
+	read, readErr := dataFormatFromBytes(frame[frameHeaderSize:], common.V_1, common.V_1)
+	_, newerErr := dataFormatFromBytes(newer.toBytes()[frameHeaderSize:], common.V_1, common.V_1)
+	readHandshake, handshakeErr := dataFormatFromBytes(newerHandshake.toBytes()[frameHeaderSize:], common.V_1, common.V_1)
+	_, magicErr := readFrameLength([]byte("GET / "))
+
+	// Assert
+	assert.NoError(t, lengthErr)
+	assert.Equal(t, len(frame)-frameHeaderSize, length)
+	assert.NoError(t, readErr)
+	assert.Equal(t, &message, read)
+	assert.EqualError(t, newerErr, "received a message of version [2], the supported versions are [1] to [1]")
+	assert.NoError(t, handshakeErr)
+	assert.Equal(t, &newerHandshake, readHandshake)
+	assert.EqualError(t, magicErr, `invalid transport message format, got magic bytes "GE"`)
+}
@@ -1,135 +1,48 @@
 package tcp
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
+	"crypto/tls"
+	"github.com/actumn/searchgoose/common"
 	"github.com/actumn/searchgoose/state/transport"
 	"github.com/sirupsen/logrus"
-	"io"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 )
 
 var (
 	requestIdGenerator uint64
 )
 
+// tlsHandshakeTimeout bounds the TLS handshake of a connection opened to a node
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSConfig returns the TLS configurations of the connections, the listener requires the certificates of the
+// nodes connecting to it.
+type TLSConfig interface {
+	ServerConfig() *tls.Config
+	ClientConfig(address string) *tls.Config
+}
+
 type Transport struct {
 	LocalAddress    string
 	LocalNodeId     string
 	SeedHosts       []string
 	RequestHandlers map[string]transport.RequestHandler
-}
-
-type Connection struct {
-	conn             net.Conn
-	localAddress     string
-	destAddress      string
-	err              string
-	responseHandlers map[uint64]func(byte []byte)
-	wLock            sync.Mutex
-	rLock            sync.Mutex
-}
-
-func (c *Connection) SendRequest(action string, content []byte, callback func(byte []byte)) {
-	atomic.AddUint64(&requestIdGenerator, 1)
-
-	request := DataFormat{
-		Id:      requestIdGenerator,
-		Source:  c.GetSourceAddress(),
-		Dest:    c.GetDestAddress(),
-		Action:  action,
-		Content: content,
-	}
-	c.responseHandlers[request.Id] = callback
-	logrus.Infof("Send %s to %s\n", request.Action, request.Dest)
-
-	bytesBuf := request.toBytes()
-	lengthBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lengthBuf, uint32(len(bytesBuf)))
-	c.wLock.Lock()
-	defer c.wLock.Unlock()
-	if _, err := c.conn.Write(lengthBuf); err != nil {
-		logrus.Errorf("Failed to send msg length; err: %v", err)
-	}
-	if _, err := c.conn.Write(bytesBuf); err != nil {
-		logrus.Errorf("Fail to send request; err:%v\n", err)
-	}
-	go func() {
-		c.rLock.Lock()
-		defer c.rLock.Unlock()
-		lengthBuf := make([]byte, 4)
-		if _, err := c.conn.Read(lengthBuf); err != nil {
-			logrus.Fatalf("Failed to read msg length; err: %v", err)
-		}
-		msgLength := binary.LittleEndian.Uint32(lengthBuf)
-		recvBuf := make([]byte, int(msgLength))
-		if _, err := io.ReadFull(c.conn, recvBuf); err != nil {
-			logrus.Fatalf("Fail to get response; err: %v", err)
-		}
-		response := dataFormatFromBytes(recvBuf)
-		logrus.Infof("Receive %s from %s\n", response.Action, response.Source)
-		if strings.Contains(response.Action, "_FAIL") {
-			logrus.Warnf("%s", string(response.Content))
-		} else {
-			handler := c.responseHandlers[response.Id]
-			delete(c.responseHandlers, response.Id)
-			handler(response.Content)
-		}
-	}()
-}
-
-func (c *Connection) GetSourceAddress() string {
-	return c.localAddress
-}
-
-func (c *Connection) GetDestAddress() string {
-	return c.destAddress
-}
-
-func (c *Connection) GetMessage() string {
-	return c.err
-}
+	handlersMux     sync.RWMutex
 
-type ReplyChannel struct {
-	requestId    uint64
-	conn         net.Conn
-	localAddress string
-	destAddress  string
-}
-
-func (c *ReplyChannel) SendMessage(action string, content []byte) (n int, err error) {
-
-	request := DataFormat{
-		Id:      c.requestId,
-		Source:  c.GetSourceAddress(),
-		Dest:    c.GetDestAddress(),
-		Action:  action,
-		Content: content,
-	}
+	// version is the protocol version of the node, it talks to the nodes of minCompatibleVersion or later
+	version              common.Version
+	minCompatibleVersion common.Version
+	// TLS encrypts the connections with mutual TLS, they are plaintext when nil
+	TLS TLSConfig
 
-	logrus.Infof("Send %s Reply to %s\n", action, request.Dest)
-
-	bytesBuf := request.toBytes()
-	lengthBuf := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lengthBuf, uint32(len(bytesBuf)))
-	if n, err := c.conn.Write(lengthBuf); err != nil {
-		logrus.Error("Failed to send msg length; err: %v", err)
-		return n, err
-	}
-	return c.conn.Write(bytesBuf)
-}
-
-func (c *ReplyChannel) GetSourceAddress() string {
-	return c.localAddress
-}
-
-func (c *ReplyChannel) GetDestAddress() string {
-	return c.destAddress
+	connections map[*Connection]struct{}
+	// closedStats are the counters of the connections closed so far
+	closedStats transport.Stats
+	statsMux    sync.Mutex
 }
 
 func NewTransport(port int, seedHost string, nodeId string) *Transport {
@@ -155,14 +68,19 @@ func NewTransport(port int, seedHost string, nodeId string) *Transport {
 	}
 
 	return &Transport{
-		LocalAddress:    hostAddress,
-		LocalNodeId:     nodeId,
-		SeedHosts:       seedHosts,
-		RequestHandlers: make(map[string]transport.RequestHandler),
+		LocalAddress:         hostAddress,
+		LocalNodeId:          nodeId,
+		SeedHosts:            seedHosts,
+		RequestHandlers:      make(map[string]transport.RequestHandler),
+		version:              common.CurrentVersion,
+		minCompatibleVersion: common.MinCompatibleVersion,
+		connections:          map[*Connection]struct{}{},
 	}
 }
 
 func (t *Transport) Register(action string, handler transport.RequestHandler) {
+	t.handlersMux.Lock()
+	defer t.handlersMux.Unlock()
 	t.RequestHandlers[action] = handler
 }
 
@@ -171,7 +89,10 @@ func (t *Transport) Start(port int) {
 	go func() {
 		l, err := net.Listen("tcp", listen)
 		if err != nil {
-			logrus.Fatalf("Fail to bind address to %s; err: %v", err)
+			logrus.Fatalf("Fail to bind address to %s; err: %v", listen, err)
+		}
+		if t.TLS != nil {
+			l = tls.NewListener(l, t.TLS.ServerConfig())
 		}
 		logrus.Infof("Success of listening on %s", listen)
 		defer l.Close()
@@ -182,43 +103,7 @@ func (t *Transport) Start(port int) {
 				logrus.Errorf("Fail to accept; err: %v", err)
 				continue
 			}
-			go func(conn net.Conn) {
-				for {
-					lengthBuf := make([]byte, 4)
-					if _, err := conn.Read(lengthBuf); err != nil {
-						if io.EOF == err {
-							logrus.Warnf("Connection is closed from client; %v", conn.RemoteAddr().String())
-							return
-						}
-						logrus.Errorf("Fail to receive data; err: %v", err)
-						return
-					}
-					msgLength := binary.LittleEndian.Uint32(lengthBuf)
-					recvBuf := make([]byte, int(msgLength))
-					n, err := io.ReadFull(conn, recvBuf)
-					if err != nil {
-						logrus.Errorf("Fail to get response; err: %v", err)
-						return
-					}
-					if 0 < n {
-						// Receive request data
-						recvData := dataFormatFromBytes(recvBuf)
-						action := recvData.Action
-						data := recvData.Content
-
-						if strings.Contains(action, "_FAIL") {
-							logrus.Fatalln("Error: %s", string(data))
-						} else {
-							t.RequestHandlers[action](&ReplyChannel{
-								requestId:    recvData.Id,
-								conn:         conn,
-								localAddress: t.LocalAddress,
-								destAddress:  recvData.Source,
-							}, data)
-						}
-					}
-				}
-			}(conn)
+			newConnection(t, conn, conn.RemoteAddr().String(), true).start()
 		}
 	}()
 }
@@ -228,18 +113,40 @@ func (t *Transport) OpenConnection(address string, callback func(conn transport.
 	if err != nil {
 		logrus.Errorf("Failed to connect to %s : %v", address, err)
 		callback(&Connection{
-			err: "Failed to connect to " + address,
+			destAddress: address,
+			err:         "Failed to connect to " + address,
 		})
 		return
 	}
 
+	if t.TLS != nil {
+		tlsConn := tls.Client(conn, t.TLS.ClientConfig(address))
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			logrus.Errorf("Failed the TLS handshake with %s : %v", address, err)
+			conn.Close()
+			callback(&Connection{
+				destAddress: address,
+				err:         "Failed the TLS handshake with " + address + ": " + err.Error(),
+			})
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+
 	logrus.Info("Success on connecting ", address)
 
-	c := &Connection{
-		conn:             conn,
-		localAddress:     t.LocalAddress,
-		destAddress:      address,
-		responseHandlers: map[uint64]func(byte []byte){},
+	c := newConnection(t, conn, address, false)
+	c.start()
+	if err := c.handshake(); err != nil {
+		logrus.Errorf("Failed to handshake with %s : %v", address, err)
+		c.close()
+		callback(&Connection{
+			destAddress: address,
+			err:         "Failed to handshake with " + address + ": " + err.Error(),
+		})
+		return
 	}
 	callback(c)
 }
@@ -257,33 +164,45 @@ func (t *Transport) GetNodeId() string {
 }
 
 func (t *Transport) GetHandler(action string) transport.RequestHandler {
+	t.handlersMux.RLock()
+	defer t.handlersMux.RUnlock()
 	return t.RequestHandlers[action]
 }
 
-// Data Format
-type DataFormat struct {
-	Id      uint64
-	Source  string
-	Dest    string
-	Action  string
-	Content []byte
-}
-
-func (d *DataFormat) toBytes() []byte {
-	var buffer bytes.Buffer
-	enc := gob.NewEncoder(&buffer)
-	if err := enc.Encode(d); err != nil {
-		logrus.Fatalln(err)
-	}
-	return buffer.Bytes()
-}
-
-func dataFormatFromBytes(b []byte) *DataFormat {
-	buffer := bytes.NewBuffer(b)
-	decoder := gob.NewDecoder(buffer)
-	var data DataFormat
-	if err := decoder.Decode(&data); err != nil {
-		logrus.Fatalln(err)
+func (t *Transport) addConnection(c *Connection) {
+	t.statsMux.Lock()
+	defer t.statsMux.Unlock()
+	t.connections[c] = struct{}{}
+}
+
+func (t *Transport) removeConnection(c *Connection) {
+	stats := c.Stats()
+	t.statsMux.Lock()
+	defer t.statsMux.Unlock()
+	delete(t.connections, c)
+	t.closedStats.RxCount += stats.RxCount
+	t.closedStats.RxSize += stats.RxSize
+	t.closedStats.TxCount += stats.TxCount
+	t.closedStats.TxSize += stats.TxSize
+}
+
+func (t *Transport) Stats() transport.Stats {
+	t.statsMux.Lock()
+	defer t.statsMux.Unlock()
+	stats := t.closedStats
+	stats.Connections = []transport.ConnectionStats{}
+	for c := range t.connections {
+		connectionStats := c.Stats()
+		if connectionStats.Inbound {
+			stats.ServerOpen++
+		} else {
+			stats.ClientOpen++
+		}
+		stats.RxCount += connectionStats.RxCount
+		stats.RxSize += connectionStats.RxSize
+		stats.TxCount += connectionStats.TxCount
+		stats.TxSize += connectionStats.TxSize
+		stats.Connections = append(stats.Connections, connectionStats)
 	}
-	return &data
+	return stats
 }
@@ -0,0 +1,207 @@
+package tcp
+
+import (
+	"errors"
+	"github.com/actumn/searchgoose/common"
+	"github.com/actumn/searchgoose/state/transport"
+	"github.com/actumn/searchgoose/state/transport/tcp/tcptest"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testResult struct {
+	response string
+	err      error
+}
+
+func sendTestRequest(conn transport.Connection, action string, timeout time.Duration) <-chan testResult {
+	results := make(chan testResult, 1)
+	conn.SendRequest(action, []byte(action), transport.RequestOptions{Timeout: timeout}, transport.ResponseHandler{
+		OnResponse: func(response []byte) {
+			results <- testResult{response: string(response)}
+		},
+		OnFailure: func(err error) {
+			results <- testResult{err: err}
+		},
+	})
+	return results
+}
+
+func TestConnection_SendRequest(t *testing.T) {
+	// Arrange
+	port := tcptest.FreePort(t)
+	server := NewTransport(port, "", "server")
+	server.Register("echo", func(channel transport.ReplyChannel, req []byte) {
+		channel.SendMessage("", req)
+	})
+	server.Register("fail", func(channel transport.ReplyChannel, req []byte) {
+		channel.SendError(errors.New("failed on purpose"))
+	})
+	server.Register("panic", func(channel transport.ReplyChannel, req []byte) {
+		panic("handler panic")
+	})
+	hold := make(chan struct{})
+	server.Register("hold", func(channel transport.ReplyChannel, req []byte) {
+		go func() {
+			<-hold
+			channel.SendMessage("", req)
+		}()
+	})
+	server.Start(port)
+	time.Sleep(50 * time.Millisecond)
+	client := NewTransport(0, "", "client")
+	address := "127.0.0.1:" + strconv.Itoa(port)
+	var conn transport.Connection
+	client.OpenConnection(address, func(c transport.Connection) {
+		conn = c
+	})
+
+	// Action
+	echo := <-sendTestRequest(conn, "echo", time.Second)
+	failed := <-sendTestRequest(conn, "fail", time.Second)
+	panicked := <-sendTestRequest(conn, "panic", time.Second)
+	notFound := <-sendTestRequest(conn, "unknown", time.Second)
+	timedOut := <-sendTestRequest(conn, "hold", 50*time.Millisecond)
+	close(hold)
+	// the late response of the request that timed out is dropped
+	afterTimeout := <-sendTestRequest(conn, "echo", time.Second)
+	pending := sendTestRequest(conn, "hold", time.Minute)
+	conn.(*Connection).conn.Close()
+	disconnected := <-pending
+	afterClose := <-sendTestRequest(conn, "echo", time.Second)
+
+	// Assert
+	assert.Equal(t, testResult{response: "echo"}, echo)
+	assert.Equal(t, &transport.RemoteTransportError{Address: address, Action: "fail", Type: "exception", Reason: "failed on purpose"}, failed.err)
+	assert.Equal(t, &transport.RemoteTransportError{Address: address, Action: "panic", Type: "exception", Reason: "handler panic"}, panicked.err)
+	assert.Equal(t, &transport.RemoteTransportError{Address: address, Action: "unknown", Type: "action_not_found_transport_exception", Reason: "No handler for action [unknown]"}, notFound.err)
+	assert.Equal(t, &transport.ReceiveTimeoutError{Address: address, Action: "hold", Timeout: 50 * time.Millisecond}, timedOut.err)
+	assert.Equal(t, testResult{response: "echo"}, afterTimeout)
+	assert.Equal(t, &transport.NodeDisconnectedError{Address: address, Action: "hold"}, disconnected.err)
+	assert.Equal(t, &transport.NodeDisconnectedError{Address: address, Action: "echo"}, afterClose.err)
+	assert.True(t, transport.IsRetryable(timedOut.err))
+	assert.False(t, transport.IsRetryable(failed.err))
+}
+
+func TestConnection_Multiplexing(t *testing.T) {
+	// Arrange
+	port := tcptest.FreePort(t)
+	server := NewTransport(port, "", "server")
+	server.Register("slow", func(channel transport.ReplyChannel, req []byte) {
+		// the first requests reply last
+		delay, _ := strconv.Atoi(string(req))
+		time.Sleep(time.Duration(100-delay) * time.Millisecond)
+		channel.SendMessage("", req)
+	})
+	server.Start(port)
+	time.Sleep(50 * time.Millisecond)
+	client := NewTransport(0, "", "client")
+	client.Register("client", func(channel transport.ReplyChannel, req []byte) {
+		channel.SendMessage("", append([]byte("client "), req...))
+	})
+	var conn transport.Connection
+	client.OpenConnection("127.0.0.1:"+strconv.Itoa(port), func(c transport.Connection) {
+		conn = c
+	})
+
+	// Action
+	var results []<-chan testResult
+	for i := 0; i < 100; i++ {
+		i := i
+		result := make(chan testResult, 1)
+		conn.SendRequest("slow", []byte(strconv.Itoa(i)), transport.RequestOptions{Timeout: 5 * time.Second}, transport.ResponseHandler{
+			OnResponse: func(response []byte) {
+				result <- testResult{response: string(response)}
+			},
+			OnFailure: func(err error) {
+				result <- testResult{err: err}
+			},
+		})
+		results = append(results, result)
+	}
+	// the server sends a request to the client on the connection the client opened
+	var inbound *Connection
+	for inbound == nil {
+		server.statsMux.Lock()
+		for c := range server.connections {
+			inbound = c
+		}
+		server.statsMux.Unlock()
+	}
+	fromServer := <-sendTestRequest(inbound, "client", time.Second)
+	var responses []string
+	for _, result := range results {
+		r := <-result
+		responses = append(responses, r.response)
+	}
+	clientStats := client.Stats()
+	serverStats := server.Stats()
+
+	// Assert
+	for i, response := range responses {
+		assert.Equal(t, strconv.Itoa(i), response)
+	}
+	assert.Equal(t, "client client", fromServer.response)
+	assert.Equal(t, 1, clientStats.ClientOpen)
+	assert.Equal(t, 1, serverStats.ServerOpen)
+	// the handshake, the requests and the reply to the server
+	assert.Equal(t, int64(102), clientStats.TxCount)
+	assert.Equal(t, int64(102), clientStats.RxCount)
+	assert.Equal(t, clientStats.TxSize, serverStats.RxSize)
+	assert.Equal(t, 0, clientStats.Connections[0].PendingRequests)
+}
+
+func TestTransport_OpenConnection_Handshake(t *testing.T) {
+	// Arrange
+	port := tcptest.FreePort(t)
+	// the server is one version ahead and still talks to the nodes of the previous version
+	server := NewTransport(port, "", "server")
+	server.version = common.V_1 + 1
+	server.Register("echo", func(channel transport.ReplyChannel, req []byte) {
+		channel.SendMessage("", req)
+	})
+	server.Start(port)
+	time.Sleep(50 * time.Millisecond)
+	address := "127.0.0.1:" + strconv.Itoa(port)
+	client := NewTransport(0, "", "client")
+	client.version = common.V_1
+	client.minCompatibleVersion = common.V_1
+	newerClient := NewTransport(0, "", "newerClient")
+	newerClient.version = common.V_1 + 2
+	newerClient.minCompatibleVersion = common.V_1 + 1
+	// this client no longer talks to the version of the server
+	incompatibleClient := NewTransport(0, "", "incompatibleClient")
+	incompatibleClient.version = common.V_1 + 2
+	incompatibleClient.minCompatibleVersion = common.V_1 + 2
+
+	// Action
+	var conn, newerConn, incompatibleConn transport.Connection
+	client.OpenConnection(address, func(c transport.Connection) {
+		conn = c
+	})
+	newerClient.OpenConnection(address, func(c transport.Connection) {
+		newerConn = c
+	})
+	incompatibleClient.OpenConnection(address, func(c transport.Connection) {
+		incompatibleConn = c
+	})
+	echo := <-sendTestRequest(conn, "echo", time.Second)
+	newerEcho := <-sendTestRequest(newerConn, "echo", time.Second)
+
+	// Assert
+	assert.Empty(t, conn.GetMessage())
+	assert.Equal(t, common.V_1, conn.(*Connection).GetVersion())
+	assert.Equal(t, testResult{response: "echo"}, echo)
+	assert.Empty(t, newerConn.GetMessage())
+	assert.Equal(t, common.V_1+1, newerConn.(*Connection).GetVersion())
+	assert.Equal(t, testResult{response: "echo"}, newerEcho)
+	assert.Equal(t, "Failed to handshake with "+address+": [127.0.0.1:"+strconv.Itoa(port)+"] version [2] is not compatible, the minimum compatible version is [3]", incompatibleConn.GetMessage())
+	var versions []common.Version
+	for _, connection := range server.Stats().Connections {
+		versions = append(versions, connection.Version)
+	}
+	assert.Contains(t, versions, common.V_1)
+	assert.Contains(t, versions, common.V_1+1)
+}
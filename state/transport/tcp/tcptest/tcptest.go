@@ -0,0 +1,17 @@
+// Package tcptest provides utilities for the tests running the tcp transport.
+package tcptest
+
+import (
+	"net"
+	"testing"
+)
+
+// FreePort returns a port nothing listens on, for a transport of a test to listen on.
+func FreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
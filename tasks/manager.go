@@ -0,0 +1,140 @@
+package tasks
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxStoredResults is how many results of completed tasks are kept, the oldest are dropped beyond it.
+const maxStoredResults = 1000
+
+var (
+	ErrTaskNotFound       = errors.New("task not found")
+	ErrTaskNotCancellable = errors.New("task is not cancellable")
+)
+
+// Manager keeps track of the tasks running on the local node and the results of the last completed ones.
+type Manager struct {
+	nodeId  string
+	lastId  int64
+	tasks   map[int64]*Task
+	results map[int64]*Result
+	// resultIds are the ids of the stored results in the order the tasks completed
+	resultIds []int64
+	mux       sync.RWMutex
+}
+
+func NewManager(nodeId string) *Manager {
+	return &Manager{
+		nodeId:  nodeId,
+		tasks:   map[int64]*Task{},
+		results: map[int64]*Result{},
+	}
+}
+
+func (m *Manager) Register(taskType string, action string, description string, cancellable bool) *Task {
+	task := &Task{
+		Id:          atomic.AddInt64(&m.lastId, 1),
+		NodeId:      m.nodeId,
+		Type:        taskType,
+		Action:      action,
+		Description: description,
+		StartTime:   time.Now(),
+		Cancellable: cancellable,
+		done:        make(chan struct{}),
+	}
+
+	m.mux.Lock()
+	m.tasks[task.Id] = task
+	m.mux.Unlock()
+	return task
+}
+
+func (m *Manager) Unregister(task *Task) {
+	m.mux.Lock()
+	delete(m.tasks, task.Id)
+	m.mux.Unlock()
+	close(task.done)
+}
+
+// StoreResult unregisters a completed task and keeps its response so it can be fetched later, dropping the oldest
+// result when maxStoredResults are kept.
+func (m *Manager) StoreResult(task *Task, response map[string]interface{}, err map[string]interface{}) {
+	result := &Result{
+		Completed: true,
+		Task:      task.Info(),
+		Response:  response,
+		Error:     err,
+	}
+
+	m.mux.Lock()
+	m.results[task.Id] = result
+	m.resultIds = append(m.resultIds, task.Id)
+	if len(m.resultIds) > maxStoredResults {
+		delete(m.results, m.resultIds[0])
+		m.resultIds = m.resultIds[1:]
+	}
+	m.mux.Unlock()
+	m.Unregister(task)
+}
+
+func (m *Manager) Task(id int64) (*Task, bool) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	task, ok := m.tasks[id]
+	return task, ok
+}
+
+// Get returns the running or completed task, waiting up to timeout for a running task to complete.
+func (m *Manager) Get(id int64, timeout time.Duration) (*Result, error) {
+	task, running := m.Task(id)
+	if running && timeout > 0 {
+		select {
+		case <-task.Done():
+		case <-time.After(timeout):
+		}
+	}
+
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if result, ok := m.results[id]; ok {
+		return result, nil
+	}
+	if task, ok := m.tasks[id]; ok {
+		return &Result{
+			Completed: false,
+			Task:      task.Info(),
+		}, nil
+	}
+	return nil, ErrTaskNotFound
+}
+
+func (m *Manager) Cancel(id int64, reason string) (*Task, error) {
+	task, ok := m.Task(id)
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	if !task.Cancellable {
+		return nil, ErrTaskNotCancellable
+	}
+	task.cancel(reason)
+	return task, nil
+}
+
+// List returns the infos of the running tasks ordered by id.
+func (m *Manager) List() []Info {
+	m.mux.RLock()
+	infos := make([]Info, 0, len(m.tasks))
+	for _, task := range m.tasks {
+		infos = append(infos, task.Info())
+	}
+	m.mux.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Id < infos[j].Id
+	})
+	return infos
+}
@@ -0,0 +1,94 @@
+package tasks
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestManager_Register(t *testing.T) {
+	// Arrange
+	manager := NewManager("node1")
+
+	// Action
+	task := manager.Register("transport", "indices:data/write/delete/byquery", "delete-by-query [test]", true)
+	task.SetStatus(func() map[string]interface{} {
+		return map[string]interface{}{"deleted": 1}
+	})
+
+	// Assert
+	assert.Equal(t, "node1:1", task.TaskId())
+	infos := manager.List()
+	assert.Equal(t, 1, len(infos))
+	assert.Equal(t, 1, infos[0].Status["deleted"])
+}
+
+func TestManager_Cancel(t *testing.T) {
+	// Arrange
+	manager := NewManager("node1")
+	task := manager.Register("transport", "indices:data/write/update/byquery", "", true)
+	uncancellable := manager.Register("transport", "cluster:monitor/stats", "", false)
+
+	// Action
+	_, err := manager.Cancel(task.Id, "by user request")
+	_, uncancellableErr := manager.Cancel(uncancellable.Id, "by user request")
+	_, missingErr := manager.Cancel(100, "by user request")
+
+	// Assert
+	assert.Nil(t, err)
+	assert.True(t, task.IsCancelled())
+	assert.Equal(t, "by user request", task.CancelReason())
+	assert.Equal(t, ErrTaskNotCancellable, uncancellableErr)
+	assert.Equal(t, ErrTaskNotFound, missingErr)
+}
+
+func TestManager_Get(t *testing.T) {
+	// Arrange
+	manager := NewManager("node1")
+	task := manager.Register("transport", "indices:data/write/delete/byquery", "", true)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		manager.StoreResult(task, map[string]interface{}{"deleted": 3}, nil)
+	}()
+
+	// Action
+	result, err := manager.Get(task.Id, time.Second)
+
+	// Assert
+	assert.Nil(t, err)
+	assert.True(t, result.Completed)
+	assert.Equal(t, 3, result.Response["deleted"])
+	assert.Equal(t, 0, len(manager.List()))
+}
+
+func TestManager_StoreResult(t *testing.T) {
+	// Arrange
+	manager := NewManager("node1")
+	var first *Task
+	for i := 0; i <= maxStoredResults; i++ {
+		task := manager.Register("transport", "indices:data/write/reindex", "", true)
+		if first == nil {
+			first = task
+		}
+		manager.StoreResult(task, map[string]interface{}{}, nil)
+	}
+
+	// Action
+	_, firstErr := manager.Get(first.Id, 0)
+	_, lastErr := manager.Get(first.Id+maxStoredResults, 0)
+
+	// Assert
+	assert.Equal(t, ErrTaskNotFound, firstErr)
+	assert.Nil(t, lastErr)
+	assert.Equal(t, maxStoredResults, len(manager.results))
+}
+
+func TestParseTaskId(t *testing.T) {
+	nodeId, id, err := ParseTaskId("oTUltX4IQMOUUVeiohTt8A:124")
+	assert.Nil(t, err)
+	assert.Equal(t, "oTUltX4IQMOUUVeiohTt8A", nodeId)
+	assert.Equal(t, int64(124), id)
+
+	_, _, err = ParseTaskId("124")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,171 @@
+package tasks
+
+import (
+	"fmt"
+	"github.com/actumn/searchgoose/common"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Task struct {
+	Id           int64
+	NodeId       string
+	Type         string
+	Action       string
+	Description  string
+	StartTime    time.Time
+	Cancellable  bool
+	ParentTaskId string
+
+	cancelled int32
+	reason    atomic.Value
+	// mux guards status, it is set by the task while the task info is read by the task APIs
+	mux    sync.Mutex
+	status func() map[string]interface{}
+	done   chan struct{}
+}
+
+// TaskId returns the cluster wide identifier of the task, "nodeId:id".
+func (t *Task) TaskId() string {
+	return t.NodeId + ":" + strconv.FormatInt(t.Id, 10)
+}
+
+// SetStatus registers a supplier of the progress reported by the task info.
+func (t *Task) SetStatus(status func() map[string]interface{}) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.status = status
+}
+
+func (t *Task) cancel(reason string) {
+	t.reason.Store(reason)
+	atomic.StoreInt32(&t.cancelled, 1)
+}
+
+func (t *Task) IsCancelled() bool {
+	return atomic.LoadInt32(&t.cancelled) == 1
+}
+
+// CancelReason returns the reason given when the task was cancelled.
+func (t *Task) CancelReason() string {
+	if reason, ok := t.reason.Load().(string); ok {
+		return reason
+	}
+	return ""
+}
+
+// Done is closed once the task is unregistered.
+func (t *Task) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *Task) Info() Info {
+	info := Info{
+		Node:         t.NodeId,
+		Id:           t.Id,
+		Type:         t.Type,
+		Action:       t.Action,
+		Description:  t.Description,
+		StartTime:    t.StartTime.UnixNano() / int64(time.Millisecond),
+		RunningTime:  time.Since(t.StartTime).Nanoseconds(),
+		Cancellable:  t.Cancellable,
+		Cancelled:    t.IsCancelled(),
+		ParentTaskId: t.ParentTaskId,
+	}
+	t.mux.Lock()
+	status := t.status
+	t.mux.Unlock()
+	if status != nil {
+		info.Status = status()
+	}
+	return info
+}
+
+// Info is the serializable snapshot of a task.
+type Info struct {
+	Node         string
+	Id           int64
+	Type         string
+	Action       string
+	Description  string
+	StartTime    int64
+	RunningTime  int64
+	Cancellable  bool
+	Cancelled    bool
+	ParentTaskId string
+	Status       map[string]interface{}
+}
+
+func (i Info) TaskId() string {
+	return i.Node + ":" + strconv.FormatInt(i.Id, 10)
+}
+
+func (i *Info) WriteTo(out *common.StreamOutput) {
+	out.WriteString(i.Node)
+	out.WriteInt64(i.Id)
+	out.WriteString(i.Type)
+	out.WriteString(i.Action)
+	out.WriteString(i.Description)
+	out.WriteInt64(i.StartTime)
+	out.WriteInt64(i.RunningTime)
+	out.WriteBool(i.Cancellable)
+	out.WriteBool(i.Cancelled)
+	out.WriteString(i.ParentTaskId)
+	out.WriteMap(i.Status)
+}
+
+func ReadInfo(in *common.StreamInput) Info {
+	return Info{
+		Node:         in.ReadString(),
+		Id:           in.ReadInt64(),
+		Type:         in.ReadString(),
+		Action:       in.ReadString(),
+		Description:  in.ReadString(),
+		StartTime:    in.ReadInt64(),
+		RunningTime:  in.ReadInt64(),
+		Cancellable:  in.ReadBool(),
+		Cancelled:    in.ReadBool(),
+		ParentTaskId: in.ReadString(),
+		Status:       in.ReadMap(),
+	}
+}
+
+// Result is a task together with its response once it has completed.
+type Result struct {
+	Completed bool
+	Task      Info
+	Response  map[string]interface{}
+	Error     map[string]interface{}
+}
+
+func (r *Result) WriteTo(out *common.StreamOutput) {
+	out.WriteBool(r.Completed)
+	r.Task.WriteTo(out)
+	out.WriteMap(r.Response)
+	out.WriteMap(r.Error)
+}
+
+func ReadResult(in *common.StreamInput) Result {
+	return Result{
+		Completed: in.ReadBool(),
+		Task:      ReadInfo(in),
+		Response:  in.ReadMap(),
+		Error:     in.ReadMap(),
+	}
+}
+
+// ParseTaskId splits a "nodeId:id" task identifier.
+func ParseTaskId(taskId string) (string, int64, error) {
+	idx := strings.LastIndex(taskId, ":")
+	if idx <= 0 {
+		return "", 0, fmt.Errorf("malformed task id %s", taskId)
+	}
+	id, err := strconv.ParseInt(taskId[idx+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed task id %s", taskId)
+	}
+	return taskId[:idx], id, nil
+}